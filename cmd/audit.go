@@ -0,0 +1,372 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/utils"
+
+	"github.com/urfave/cli/v2"
+)
+
+func auditFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "audit",
+		Usage:     "cross-check objects and metadata to find orphaned objects and lost blocks",
+		ArgsUsage: "META-URL",
+		Action:    audit,
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of threads to check and delete objects",
+			},
+			&cli.BoolFlag{
+				Name:  "fix-orphans",
+				Usage: "delete the orphaned objects older than --orphan-age",
+			},
+			&cli.DurationFlag{
+				Name:  "orphan-age",
+				Value: time.Hour,
+				Usage: "objects modified within this duration are skipped, as their slices may be not committed yet",
+			},
+		}, storageFlags()...),
+	}
+}
+
+type auditCounter struct {
+	count int64
+	bytes int64
+}
+
+func (c *auditCounter) add(size int64) {
+	c.count++
+	c.bytes += size
+}
+
+func (c auditCounter) String() string {
+	return fmt.Sprintf("%d (%d bytes)", c.count, c.bytes)
+}
+
+type auditReport struct {
+	sync.Mutex
+	objects    auditCounter // all the objects under chunks/
+	valid      auditCounter // referenced by slices
+	orphans    auditCounter // not referenced by any slice, reclaimable
+	mismatched auditCounter // the size doesn't match the slice
+	recent     auditCounter // modified within the window, skipped
+	unknown    auditCounter // not a block of JuiceFS
+	deleted    auditCounter // orphans deleted by --fix-orphans
+	slices     auditCounter // all the slices in metadata
+	lost       auditCounter // blocks used by slices but not found in object storage
+	broken     map[meta.Ino]string
+}
+
+type auditOptions struct {
+	blockSize  int
+	inlineSize int
+	layout     *chunk.Config
+	threads    int
+	fixOrphans bool
+	orphanAge  time.Duration
+}
+
+// parseBlock returns the chunkid, index and size of a block, the key is relative to chunks/.
+func parseBlock(key string) (cid uint64, indx, size int, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return
+	}
+	parts = strings.Split(parts[2], "_")
+	if len(parts) != 3 {
+		return
+	}
+	var err1, err2, err3 error
+	cid, err1 = strconv.ParseUint(parts[0], 10, 64)
+	indx, err2 = strconv.Atoi(parts[1])
+	size, err3 = strconv.Atoi(parts[2])
+	return cid, indx, size, err1 == nil && err2 == nil && err3 == nil
+}
+
+// keyLayout returns the options of the volume deciding the keys of blocks.
+func keyLayout(format *meta.Format) *chunk.Config {
+	return &chunk.Config{
+		Partitions:   format.Partitions,
+		KeyPrefixes:  format.KeyPrefixes,
+		PrefixedFrom: format.PrefixedFrom,
+	}
+}
+
+// blockKey returns the key of a block relative to chunks/, the same as the one in chunk store.
+func blockKey(layout *chunk.Config, cid uint64, indx, size int) string {
+	if layout == nil {
+		layout = &chunk.Config{}
+	}
+	return strings.TrimPrefix(chunk.BlockKey(layout, cid, indx, size), "chunks/")
+}
+
+// matchSlice checks whether a block (from parseBlock) is a part of the slice of ssize bytes.
+func matchSlice(indx, size, blockSize int, ssize uint32) bool {
+	return indx*blockSize+size == int(ssize) || size == blockSize && (indx+1)*size <= int(ssize)
+}
+
+// blockSet remembers the blocks of slices found in the object storage, as a bitmap for every
+// slice, so the memory is bounded by the slices in metadata rather than the objects listed.
+type blockSet map[uint64][]uint64
+
+func (s blockSet) add(cid uint64, indx int) {
+	bits := s[cid]
+	for len(bits) <= indx/64 {
+		bits = append(bits, 0)
+	}
+	bits[indx/64] |= 1 << uint(indx%64)
+	s[cid] = bits
+}
+
+func (s blockSet) has(cid uint64, indx int) bool {
+	bits := s[cid]
+	return indx/64 < len(bits) && bits[indx/64]&(1<<uint(indx%64)) != 0
+}
+
+// auditStorage scans the slices in metadata and the objects in storage (with prefix chunks/) in both directions.
+func auditStorage(m meta.Meta, blob object.ObjectStorage, opt auditOptions, progress *utils.Progress) (*auditReport, error) {
+	blockSize := opt.blockSize
+	r := &auditReport{broken: make(map[meta.Ino]string)}
+	sliceSpin := progress.AddCountSpinner("Listed slices")
+	slices := make(map[meta.Ino][]meta.Slice)
+	if st := m.ListSlices(meta.NewContext(0, 0, []uint32{0}), slices, false, sliceSpin.Increment); st != 0 {
+		return nil, fmt.Errorf("list all slices: %s", st)
+	}
+	sliceSpin.Done()
+	sizes := make(map[uint64]uint32)
+	for _, ss := range slices {
+		for _, s := range ss {
+			sizes[s.Chunkid] = s.Size
+			r.slices.add(int64(s.Size))
+		}
+	}
+
+	// objects -> metadata
+	objs, err := osync.ListAll(blob, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("list all blocks: %s", err)
+	}
+	objBar := progress.AddCountSpinner("Scanned objects")
+	orphanSpin := progress.AddDoubleSpinner("Orphaned objects")
+	maxMtime := time.Now().Add(-opt.orphanAge)
+	var wg sync.WaitGroup
+	orphans := make(chan object.Object, 10240)
+	if opt.fixOrphans {
+		for i := 0; i < opt.threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for o := range orphans {
+					if err := blob.Delete(o.Key()); err != nil {
+						logger.Warnf("delete %s: %s", o.Key(), err)
+						continue
+					}
+					r.Lock()
+					r.deleted.add(o.Size())
+					r.Unlock()
+				}
+			}()
+		}
+	}
+	found := make(blockSet) // the blocks used by slices
+	for o := range objs {
+		if o == nil {
+			close(orphans)
+			return nil, fmt.Errorf("listing failed")
+		}
+		if o.IsDir() {
+			continue
+		}
+		objBar.Increment()
+		r.objects.add(o.Size())
+		cid, indx, size, ok := parseBlock(o.Key())
+		if !ok {
+			logger.Debugf("unknown object: %s", o.Key())
+			r.unknown.add(o.Size())
+			continue
+		}
+		ssize, ok := sizes[cid]
+		if ok && matchSlice(indx, size, blockSize, ssize) {
+			found.add(cid, indx)
+			r.valid.add(o.Size())
+			continue
+		}
+		if o.Mtime().After(maxMtime) || o.Mtime().Unix() == 0 {
+			logger.Debugf("ignore new block: %s %s", o.Key(), o.Mtime())
+			r.recent.add(o.Size())
+			continue
+		}
+		if ok {
+			logger.Warnf("size of block %s doesn't match the slice (%d bytes)", o.Key(), ssize)
+			r.mismatched.add(o.Size())
+			continue
+		}
+		logger.Debugf("found orphaned object: %s, size: %d", o.Key(), o.Size())
+		r.orphans.add(o.Size())
+		orphanSpin.IncrInt64(o.Size())
+		if opt.fixOrphans {
+			orphans <- o
+		}
+	}
+	close(orphans)
+	objBar.Done()
+	orphanSpin.Done()
+
+	// metadata -> objects, check the missing ones again in case the listing is not consistent
+	sliceBar := progress.AddCountBar("Checked slices", r.slices.count)
+	lostSpin := progress.AddDoubleSpinner("Lost blocks")
+	type block struct {
+		inode meta.Ino
+		key   string
+		size  int
+	}
+	missing := make(chan block, 10240)
+	for i := 0; i < opt.threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range missing {
+				if _, err := blob.Head(b.key); err == nil {
+					continue
+				}
+				logger.Debugf("can't find block %s of inode %d", b.key, b.inode)
+				lostSpin.IncrInt64(int64(b.size))
+				r.Lock()
+				r.lost.add(int64(b.size))
+				r.broken[b.inode] = ""
+				r.Unlock()
+			}
+		}()
+	}
+	for inode, ss := range slices {
+		for _, s := range ss {
+			if int(s.Size) <= opt.inlineSize { // the inline ones have no object
+				sliceBar.Increment()
+				continue
+			}
+			n := int(s.Size-1) / blockSize
+			for i := 0; i <= n; i++ {
+				sz := blockSize
+				if i == n {
+					sz = int(s.Size) - i*blockSize
+				}
+				if found.has(s.Chunkid, i) {
+					continue
+				}
+				missing <- block{inode, blockKey(opt.layout, s.Chunkid, i, sz), sz}
+			}
+			sliceBar.Increment()
+		}
+	}
+	close(missing)
+	wg.Wait()
+	progress.Done()
+	for inode := range r.broken {
+		if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
+			r.broken[inode] = p
+		} else {
+			r.broken[inode] = st.Error()
+		}
+	}
+	return r, nil
+}
+
+func (r *auditReport) print() {
+	fmt.Printf("Objects:          %s\n", r.objects)
+	fmt.Printf("  valid:          %s\n", r.valid)
+	fmt.Printf("  orphaned:       %s, reclaimable\n", r.orphans)
+	if r.deleted.count > 0 {
+		fmt.Printf("  deleted:        %s\n", r.deleted)
+	}
+	fmt.Printf("  mismatched:     %s\n", r.mismatched)
+	fmt.Printf("  recent:         %s, skipped\n", r.recent)
+	fmt.Printf("  unknown:        %s\n", r.unknown)
+	fmt.Printf("Slices:           %s\n", r.slices)
+	fmt.Printf("  lost blocks:    %s\n", r.lost)
+	fmt.Printf("  broken files:   %d\n", len(r.broken))
+	if len(r.broken) > 0 {
+		var files []string
+		for inode, p := range r.broken {
+			files = append(files, fmt.Sprintf("%13d: %s", inode, p))
+		}
+		sort.Strings(files)
+		fmt.Printf("%13s: PATH\n%s\n", "INODE", strings.Join(files, "\n"))
+	}
+}
+
+func audit(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	if ctx.Int("threads") <= 0 {
+		return fmt.Errorf("threads should be greater than 0")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+
+	opt := auditOptions{
+		blockSize:  format.BlockSize * 1024,
+		inlineSize: format.InlineSize,
+		layout:     keyLayout(format),
+		threads:    ctx.Int("threads"),
+		fixOrphans: ctx.Bool("fix-orphans"),
+		orphanAge:  ctx.Duration("orphan-age"),
+	}
+	progress := utils.NewProgress(false, false)
+	r, err := auditStorage(m, object.WithPrefix(blob, "chunks/"), opt, progress)
+	if err != nil {
+		logger.Fatalf("audit: %s", err)
+	}
+	r.print()
+	if r.orphans.count > 0 && !opt.fixOrphans {
+		logger.Infof("Please add `--fix-orphans` to delete orphaned objects")
+	}
+	if r.lost.count > 0 {
+		logger.Fatalf("%d blocks are lost (%d bytes), %d files are broken", r.lost.count, r.lost.bytes, len(r.broken))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+func TestAuditStorage(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "audit.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	_ = m.NewSession()
+	blob, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	old := time.Now().Add(-time.Hour * 2)
+	put := func(key string, size int, mtime time.Time) {
+		if err := blob.Put(key, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		_ = blob.(object.MtimeChanger).Chtimes(key, mtime)
+	}
+
+	ctx := meta.Background
+	var chunkids []uint64
+	for _, name := range []string{"f1", "f2"} {
+		var inode meta.Ino
+		var cid uint64
+		if st := m.Create(ctx, 1, name, 0644, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		if st := m.NewChunk(ctx, &cid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: cid, Size: 5000, Len: 5000}); st != 0 {
+			t.Fatalf("write %s: %s", name, st)
+		}
+		chunkids = append(chunkids, cid)
+	}
+	// f1 has both blocks, the second one of f2 is lost
+	put(fmt.Sprintf("0/0/%d_0_4096", chunkids[0]), 4096, old)
+	put(fmt.Sprintf("0/0/%d_1_904", chunkids[0]), 904, old)
+	put(fmt.Sprintf("0/0/%d_0_4096", chunkids[1]), 4096, old)
+	put(fmt.Sprintf("0/0/%d_1_100", chunkids[0]), 100, old) // mismatched
+	put("0/0/999_0_10", 10, old)                            // orphaned
+	put("0/0/998_0_10", 10, time.Now())                     // recent
+	put("0/0/unknown", 1, old)
+
+	opt := auditOptions{blockSize: 4096, threads: 2, orphanAge: time.Hour}
+	r, err := auditStorage(m, blob, opt, utils.NewProgress(true, false))
+	if err != nil {
+		t.Fatalf("audit: %s", err)
+	}
+	expected := map[string]auditCounter{
+		"objects":    {7, 4096*2 + 904 + 100 + 10 + 10 + 1},
+		"valid":      {3, 4096*2 + 904},
+		"orphans":    {1, 10},
+		"mismatched": {1, 100},
+		"recent":     {1, 10},
+		"unknown":    {1, 1},
+		"slices":     {2, 10000},
+		"lost":       {1, 904},
+	}
+	got := map[string]auditCounter{
+		"objects": r.objects, "valid": r.valid, "orphans": r.orphans, "mismatched": r.mismatched,
+		"recent": r.recent, "unknown": r.unknown, "slices": r.slices, "lost": r.lost,
+	}
+	for k, c := range expected {
+		if got[k] != c {
+			t.Fatalf("%s: expected %s, but got %s", k, c, got[k])
+		}
+	}
+	if len(r.broken) != 1 {
+		t.Fatalf("broken files: %+v", r.broken)
+	}
+	for _, p := range r.broken {
+		if p != "/f2" {
+			t.Fatalf("broken file: %s", p)
+		}
+	}
+	if _, err := blob.Head("0/0/999_0_10"); err != nil {
+		t.Fatalf("orphan should not be deleted without fix-orphans: %s", err)
+	}
+
+	opt.fixOrphans = true
+	if r, err = auditStorage(m, blob, opt, utils.NewProgress(true, false)); err != nil {
+		t.Fatalf("audit: %s", err)
+	}
+	if r.deleted != r.orphans || r.deleted.count != 1 {
+		t.Fatalf("deleted %s, orphans %s", r.deleted, r.orphans)
+	}
+	if _, err := blob.Head("0/0/999_0_10"); err == nil {
+		t.Fatalf("orphan should be deleted")
+	}
+	for _, key := range []string{"0/0/998_0_10", "0/0/unknown", fmt.Sprintf("0/0/%d_1_100", chunkids[0])} {
+		if _, err := blob.Head(key); err != nil {
+			t.Fatalf("%s should be kept: %s", key, err)
+		}
+	}
+}
+
+func TestAuditInline(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "audit.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4, InlineSize: 1024}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	_ = m.NewSession()
+	blob, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+
+	ctx := meta.Background
+	var inode meta.Ino
+	var cid uint64
+	if st := m.Create(ctx, 1, "small", 0644, 022, 0, &inode, nil); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.NewChunk(ctx, &cid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.SetSliceData(ctx, cid, make([]byte, 100)); st != 0 {
+		t.Fatalf("set slice data: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: cid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+
+	opt := auditOptions{blockSize: 4096, inlineSize: 1024, threads: 2, orphanAge: time.Hour}
+	r, err := auditStorage(m, blob, opt, utils.NewProgress(true, false))
+	if err != nil {
+		t.Fatalf("audit: %s", err)
+	}
+	if r.slices.count != 1 || r.lost.count != 0 || len(r.broken) != 0 {
+		t.Fatalf("slices %s, lost %s, broken files %+v", r.slices, r.lost, r.broken)
+	}
+}
+
+func TestBlockSet(t *testing.T) {
+	s := make(blockSet)
+	for _, indx := range []int{0, 63, 64, 1000} {
+		s.add(7, indx)
+	}
+	for _, indx := range []int{0, 63, 64, 1000} {
+		if !s.has(7, indx) {
+			t.Fatalf("block %d should be found", indx)
+		}
+	}
+	for _, b := range [][2]int{{7, 1}, {7, 65}, {7, 1001}, {8, 0}} {
+		if s.has(uint64(b[0]), b[1]) {
+			t.Fatalf("block %v should not be found", b)
+		}
+	}
+	if k := blockKey(nil, 1234567, 1, 100); k != "1/1234/1234567_1_100" {
+		t.Fatalf("unexpected key: %s", k)
+	}
+	if k := blockKey(&chunk.Config{Partitions: 4}, 1234567, 1, 100); k != "87/1/1234567_1_100" {
+		t.Fatalf("unexpected key with partitions: %s", k)
+	}
+	layout := keyLayout(&meta.Format{KeyPrefixes: 256, PrefixedFrom: 1000000})
+	if k := blockKey(layout, 1234567, 1, 100); k != "87/1/1234567_1_100" {
+		t.Fatalf("unexpected key with prefixes: %s", k)
+	}
+	if k := blockKey(layout, 999999, 1, 100); k != "0/999/999999_1_100" {
+		t.Fatalf("unexpected key before prefixes: %s", k)
+	}
+	if cid, indx, size, ok := parseBlock(blockKey(layout, 1234567, 1, 100)); !ok || cid != 1234567 || indx != 1 || size != 100 {
+		t.Fatalf("parse prefixed key: %d %d %d %v", cid, indx, size, ok)
+	}
+}
@@ -21,11 +21,14 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -34,26 +37,59 @@ import (
 )
 
 var resultRange = map[string][4]float64{
-	"bigwr":   {100, 200, 10, 50},
-	"bigrd":   {100, 200, 10, 50},
-	"smallwr": {12.5, 20, 50, 80},
-	"smallrd": {50, 100, 10, 20},
-	"stat":    {20, 1000, 1, 5},
-	"fuse":    {0, 0, 0.5, 2},
-	"meta":    {0, 0, 2, 5},
-	"put":     {0, 0, 100, 200},
-	"get":     {0, 0, 100, 200},
-	"delete":  {0, 0, 30, 100},
-	"cachewr": {0, 0, 10, 20},
-	"cacherd": {0, 0, 1, 5},
+	"bigwr":       {100, 200, 10, 50},
+	"bigrd":       {100, 200, 10, 50},
+	"bigrdwarm":   {200, 1000, 2, 10},
+	"smallwr":     {12.5, 20, 50, 80},
+	"smallrd":     {50, 100, 10, 20},
+	"smallrdwarm": {100, 500, 2, 10},
+	"stat":        {20, 1000, 1, 5},
+	"unlink":      {20, 100, 10, 50},
+	"fuse":        {0, 0, 0.5, 2},
+	"meta":        {0, 0, 2, 5},
+	"put":         {0, 0, 100, 200},
+	"get":         {0, 0, 100, 200},
+	"delete":      {0, 0, 30, 100},
+	"cachewr":     {0, 0, 10, 20},
+	"cacherd":     {0, 0, 1, 5},
 }
 
 type benchCase struct {
 	bm               *benchmark
 	name             string
-	fsize, bsize     int        // file/block size in Bytes
-	fcount, bcount   int        // file/block count
-	wbar, rbar, sbar *utils.Bar // progress bar for write/read/stat
+	fsize, bsize     int               // file/block size in Bytes
+	fcount, bcount   int               // file/block count
+	wbar, rbar, sbar *utils.Bar        // progress bar for write/read/stat
+	wrbar, dbar      *utils.Bar        // progress bar for warm read/delete
+	lats             [][]time.Duration // latency of every operation in each thread
+}
+
+// benchResult is the result of one item, the latency percentiles are of every operation, which is
+// writing or reading a block of big file, or a whole small file.
+type benchResult struct {
+	Item     string   `json:"item"`
+	Value    float64  `json:"value"`
+	Unit     string   `json:"unit"`
+	Cost     float64  `json:"cost"`
+	CostUnit string   `json:"cost_unit"`
+	P50      float64  `json:"p50_ms,omitempty"`
+	P99      float64  `json:"p99_ms,omitempty"`
+	CacheHit *float64 `json:"cache_hit_ratio,omitempty"` // ratio of bytes read from the block cache
+	nick     string
+	prec     int
+}
+
+type benchReport struct {
+	Round          int            `json:"round"`
+	BlockSize      uint           `json:"block_size_mib"`
+	BigFileSize    uint           `json:"big_file_size_mib"`
+	SmallFileSize  uint           `json:"small_file_size_kib"`
+	SmallFileCount uint           `json:"small_file_count"`
+	Threads        uint           `json:"threads"`
+	Results        []*benchResult `json:"results"`
+	TimeUsed       float64        `json:"time_used,omitempty"` // seconds
+	CPU            float64        `json:"cpu_usage,omitempty"` // percent
+	Memory         float64        `json:"memory_mib,omitempty"`
 }
 
 type benchmark struct {
@@ -66,6 +102,7 @@ type benchmark struct {
 func (bc *benchCase) writeFiles(index int) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
+		start := time.Now()
 		fp, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			logger.Fatalf("Failed to open file %s: %s", fname, err)
@@ -76,15 +113,22 @@ func (bc *benchCase) writeFiles(index int) {
 			if _, err = fp.Write(buf); err != nil {
 				logger.Fatalf("Failed to write file %s: %s", fname, err)
 			}
+			if j == bc.bcount-1 {
+				if err = fp.Close(); err != nil {
+					logger.Fatalf("Failed to close file %s: %s", fname, err)
+				}
+			}
+			bc.record(index, start)
 			bc.wbar.Increment()
+			start = time.Now()
 		}
-		_ = fp.Close()
 	}
 }
 
-func (bc *benchCase) readFiles(index int) {
+func (bc *benchCase) readFiles(index int, bar *utils.Bar) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
+		start := time.Now()
 		fp, err := os.Open(fname)
 		if err != nil {
 			logger.Fatalf("Failed to open file %s: %s", fname, err)
@@ -94,32 +138,76 @@ func (bc *benchCase) readFiles(index int) {
 			if n, err := fp.Read(buf); err != nil || n != bc.bsize {
 				logger.Fatalf("Failed to read file %s: %d %s", fname, n, err)
 			}
-			bc.rbar.Increment()
+			if j == bc.bcount-1 {
+				_ = fp.Close()
+			}
+			bc.record(index, start)
+			bar.Increment()
+			start = time.Now()
 		}
-		_ = fp.Close()
 	}
 }
 
 func (bc *benchCase) statFiles(index int) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
+		start := time.Now()
 		if _, err := os.Stat(fname); err != nil {
 			logger.Fatalf("Failed to stat file %s: %s", fname, err)
 		}
+		bc.record(index, start)
 		bc.sbar.Increment()
 	}
 }
 
+func (bc *benchCase) deleteFiles(index int) {
+	for i := 0; i < bc.fcount; i++ {
+		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
+		start := time.Now()
+		if err := os.Remove(fname); err != nil {
+			logger.Fatalf("Failed to delete file %s: %s", fname, err)
+		}
+		bc.record(index, start)
+		bc.dbar.Increment()
+	}
+}
+
+// record the latency of an operation in thread index, which is accessed by the thread only.
+func (bc *benchCase) record(index int, start time.Time) {
+	bc.lats[index] = append(bc.lats[index], time.Since(start))
+}
+
+// percentiles returns the p50 and p99 latency in ms of the operations in last run.
+func (bc *benchCase) percentiles() (float64, float64) {
+	var all []time.Duration
+	for _, l := range bc.lats {
+		all = append(all, l...)
+	}
+	if len(all) == 0 {
+		return 0, 0
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	pick := func(p float64) float64 {
+		return float64(all[int(float64(len(all)-1)*p)]) / 1e6
+	}
+	return pick(0.5), pick(0.99)
+}
+
 func (bc *benchCase) run(test string) float64 {
 	var fn func(int)
 	switch test {
 	case "write":
 		fn = bc.writeFiles
 	case "read":
-		fn = bc.readFiles
+		fn = func(index int) { bc.readFiles(index, bc.rbar) }
+	case "warmread":
+		fn = func(index int) { bc.readFiles(index, bc.wrbar) }
 	case "stat":
 		fn = bc.statFiles
+	case "delete":
+		fn = bc.deleteFiles
 	} // default: fatal
+	bc.lats = make([][]time.Duration, bc.bm.threads)
 	var wg sync.WaitGroup
 	start := time.Now()
 	for i := 0; i < bc.bm.threads; i++ {
@@ -172,7 +260,7 @@ func (bm *benchmark) colorize(item string, value, cost float64, prec int) (strin
 		if !ok {
 			logger.Fatalf("Invalid item: %s", item)
 		}
-		if item == "smallwr" || item == "smallrd" || item == "stat" {
+		if item == "smallwr" || item == "smallrd" || item == "smallrdwarm" || item == "stat" || item == "unlink" {
 			r[0] *= float64(bm.threads)
 			r[1] *= float64(bm.threads)
 		}
@@ -197,7 +285,15 @@ func (bm *benchmark) colorize(item string, value, cost float64, prec int) (strin
 	return svalue, scost
 }
 
-func (bm *benchmark) printResult(result [][3]string) {
+func (bm *benchmark) printResult(results []*benchResult) {
+	var result [][3]string
+	for _, r := range results {
+		line := [3]string{r.Item}
+		line[1], line[2] = bm.colorize(r.nick, r.Value, r.Cost, r.prec)
+		line[1] += " " + r.Unit
+		line[2] += " " + r.CostUnit
+		result = append(result, line)
+	}
 	var rawmax, max [3]int
 	for _, l := range result {
 		for i := 0; i < 3; i++ {
@@ -280,11 +376,6 @@ func bench(ctx *cli.Context) error {
 	}
 
 	/* --- Prepare --- */
-	if _, err := os.Stat(bm.tmpdir); os.IsNotExist(err) {
-		if err = os.MkdirAll(bm.tmpdir, 0755); err != nil {
-			logger.Fatalf("Failed to create %s: %s", bm.tmpdir, err)
-		}
-	}
 	var statsPath string
 	for mp := filepath.Dir(bm.tmpdir); mp != "/"; mp = filepath.Dir(mp) {
 		if _, err := os.Stat(filepath.Join(mp, ".stats")); err == nil {
@@ -301,22 +392,92 @@ func bench(ctx *cli.Context) error {
 			logger.Warnf("Clear cache operation has been skipped")
 		}
 	}
-	if os.Getuid() != 0 {
+	jsonOut := ctx.Bool("json")
+	if os.Getuid() != 0 && !jsonOut {
 		fmt.Println("Cleaning kernel cache, may ask for root privilege...")
 	}
 	dropCaches()
-	bm.tty = isatty.IsTerminal(os.Stdout.Fd())
-	progress := utils.NewProgress(!bm.tty, false)
+	bm.tty = isatty.IsTerminal(os.Stdout.Fd()) && !jsonOut
+
+	// the files are removed if it's interrupted, e.g. to stop the soak test
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(signalChan)
+		close(done)
+	}()
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-signalChan:
+		case <-done:
+			return
+		}
+		logger.Infof("Received signal %s, cleaning up %s", sig, bm.tmpdir)
+		if err := exec.Command("rm", "-rf", bm.tmpdir).Run(); err != nil {
+			logger.Warnf("Failed to cleanup %s: %s", bm.tmpdir, err)
+		}
+		os.Exit(1)
+	}()
+
+	rounds := int(ctx.Uint("rounds"))
+	for round := 1; rounds == 0 || round <= rounds; round++ {
+		report := bm.runRound(statsPath, dropCaches, jsonOut)
+		report.Round = round
+		report.BlockSize, report.BigFileSize = ctx.Uint("block-size"), ctx.Uint("big-file-size")
+		report.SmallFileSize, report.SmallFileCount = ctx.Uint("small-file-size"), ctx.Uint("small-file-count")
+		report.Threads = ctx.Uint("threads")
+
+		/* --- Report --- */
+		if jsonOut {
+			printJson(report)
+			continue
+		}
+		if rounds != 1 {
+			fmt.Printf("Round %d finished!\n", round)
+		} else {
+			fmt.Println("Benchmark finished!")
+		}
+		fmt.Printf("BlockSize: %d MiB, BigFileSize: %d MiB, SmallFileSize: %d KiB, SmallFileCount: %d, NumThreads: %d\n",
+			report.BlockSize, report.BigFileSize, report.SmallFileSize, report.SmallFileCount, report.Threads)
+		if statsPath != "" {
+			var fmtString string
+			if bm.tty {
+				greenSeq := fmt.Sprintf("%s%dm", COLOR_SEQ, GREEN)
+				fmtString = fmt.Sprintf("Time used: %s%%.1f%s s, CPU: %s%%.1f%s%%%%, Memory: %s%%.1f%s MiB\n",
+					greenSeq, RESET_SEQ, greenSeq, RESET_SEQ, greenSeq, RESET_SEQ)
+			} else {
+				fmtString = "Time used: %.1f s, CPU: %.1f%%, Memory: %.1f MiB\n"
+			}
+			fmt.Printf(fmtString, report.TimeUsed, report.CPU, report.Memory)
+		}
+		bm.printResult(report.Results)
+	}
+	return nil
+}
+
+// runRound writes, reads, stats and deletes the files in tmpdir, then removes it.
+func (bm *benchmark) runRound(statsPath string, dropCaches func(), quiet bool) *benchReport {
+	if _, err := os.Stat(bm.tmpdir); os.IsNotExist(err) {
+		if err = os.MkdirAll(bm.tmpdir, 0755); err != nil {
+			logger.Fatalf("Failed to create %s: %s", bm.tmpdir, err)
+		}
+	}
+	progress := utils.NewProgress(!bm.tty || quiet, false)
 	if b := bm.big; b != nil {
 		total := int64(bm.threads * b.fcount * b.bcount)
 		b.wbar = progress.AddCountBar("Write big", total)
 		b.rbar = progress.AddCountBar("Read big", total)
+		b.wrbar = progress.AddCountBar("Read big (warm)", total)
 	}
 	if s := bm.small; s != nil {
 		total := int64(bm.threads * s.fcount * s.bcount)
 		s.wbar = progress.AddCountBar("Write small", total)
 		s.rbar = progress.AddCountBar("Read small", total)
+		s.wrbar = progress.AddCountBar("Read small (warm)", total)
 		s.sbar = progress.AddCountBar("Stat file", int64(bm.threads*s.fcount))
+		s.dbar = progress.AddCountBar("Delete file", int64(bm.threads*s.fcount))
 	}
 
 	/* --- Run Benchmark --- */
@@ -324,46 +485,64 @@ func bench(ctx *cli.Context) error {
 	if statsPath != "" {
 		stats = readStats(statsPath)
 	}
-	var result [][3]string
+	report := &benchReport{}
+	add := func(bc *benchCase, item, nick string, value, cost float64, big bool) *benchResult {
+		r := &benchResult{Item: item, nick: nick, Value: value, Cost: cost}
+		if big {
+			r.Unit, r.CostUnit, r.prec = "MiB/s", "s/file", 2
+		} else {
+			r.Unit, r.CostUnit, r.prec = "files/s", "ms/file", 1
+		}
+		r.P50, r.P99 = bc.percentiles()
+		report.Results = append(report.Results, r)
+		return r
+	}
+	// read runs the test and sets the ratio of bytes read from the block cache
+	read := func(bc *benchCase, test string) (float64, *float64) {
+		var before map[string]float64
+		if statsPath != "" {
+			before = readStats(statsPath)
+		}
+		cost := bc.run(test)
+		if before == nil {
+			return cost, nil
+		}
+		after := readStats(statsPath)
+		hit := after["juicefs_blockcache_hit_bytes"] - before["juicefs_blockcache_hit_bytes"]
+		miss := after["juicefs_blockcache_miss_bytes"] - before["juicefs_blockcache_miss_bytes"]
+		if hit+miss <= 0 {
+			return cost, nil
+		}
+		ratio := hit / (hit + miss)
+		return cost, &ratio
+	}
 	if b := bm.big; b != nil {
+		mib := float64((b.fsize >> 20) * b.fcount * bm.threads)
 		cost := b.run("write")
-		line := [3]string{"Write big file"}
-		line[1], line[2] = bm.colorize("bigwr", float64((b.fsize>>20)*b.fcount*bm.threads)/cost, cost/float64(b.fcount), 2)
-		line[1] += " MiB/s"
-		line[2] += " s/file"
-		result = append(result, line)
+		add(b, "Write big file", "bigwr", mib/cost, cost/float64(b.fcount), true)
 		dropCaches()
 
-		cost = b.run("read")
-		line[0] = "Read big file"
-		line[1], line[2] = bm.colorize("bigrd", float64((b.fsize>>20)*b.fcount*bm.threads)/cost, cost/float64(b.fcount), 2)
-		line[1] += " MiB/s"
-		line[2] += " s/file"
-		result = append(result, line)
+		cost, hit := read(b, "read")
+		add(b, "Read big file", "bigrd", mib/cost, cost/float64(b.fcount), true).CacheHit = hit
+		cost, hit = read(b, "warmread")
+		add(b, "Read big file (warm)", "bigrdwarm", mib/cost, cost/float64(b.fcount), true).CacheHit = hit
 	}
 	if s := bm.small; s != nil {
+		files := float64(s.fcount * bm.threads)
 		cost := s.run("write")
-		line := [3]string{"Write small file"}
-		line[1], line[2] = bm.colorize("smallwr", float64(s.fcount*bm.threads)/cost, cost*1000/float64(s.fcount), 1)
-		line[1] += " files/s"
-		line[2] += " ms/file"
-		result = append(result, line)
+		add(s, "Write small file", "smallwr", files/cost, cost*1000/float64(s.fcount), false)
 		dropCaches()
 
-		cost = s.run("read")
-		line[0] = "Read small file"
-		line[1], line[2] = bm.colorize("smallrd", float64(s.fcount*bm.threads)/cost, cost*1000/float64(s.fcount), 1)
-		line[1] += " files/s"
-		line[2] += " ms/file"
-		result = append(result, line)
+		cost, hit := read(s, "read")
+		add(s, "Read small file", "smallrd", files/cost, cost*1000/float64(s.fcount), false).CacheHit = hit
+		cost, hit = read(s, "warmread")
+		add(s, "Read small file (warm)", "smallrdwarm", files/cost, cost*1000/float64(s.fcount), false).CacheHit = hit
 		dropCaches()
 
 		cost = s.run("stat")
-		line[0] = "Stat file"
-		line[1], line[2] = bm.colorize("stat", float64(s.fcount*bm.threads)/cost, cost*1000/float64(s.fcount), 1)
-		line[1] += " files/s"
-		line[2] += " ms/file"
-		result = append(result, line)
+		add(s, "Stat file", "stat", files/cost, cost*1000/float64(s.fcount), false)
+		cost = s.run("delete")
+		add(s, "Delete file", "unlink", files/cost, cost*1000/float64(s.fcount), false)
 	}
 	progress.Done()
 
@@ -372,10 +551,6 @@ func bench(ctx *cli.Context) error {
 		logger.Warnf("Failed to cleanup %s: %s", bm.tmpdir, err)
 	}
 
-	/* --- Report --- */
-	fmt.Println("Benchmark finished!")
-	fmt.Printf("BlockSize: %d MiB, BigFileSize: %d MiB, SmallFileSize: %d KiB, SmallFileCount: %d, NumThreads: %d\n",
-		ctx.Uint("block-size"), ctx.Uint("big-file-size"), ctx.Uint("small-file-size"), ctx.Uint("small-file-count"), ctx.Uint("threads"))
 	if stats != nil {
 		stats2 := readStats(statsPath)
 		diff := func(item string) float64 {
@@ -387,11 +562,8 @@ func bench(ctx *cli.Context) error {
 			if count > 0 {
 				cost = diff(item+"_sum") * 1000 / count
 			}
-			line := [3]string{title}
-			line[1], line[2] = bm.colorize(nick, count, cost, 0)
-			line[1] += " operations"
-			line[2] += " ms/op"
-			result = append(result, line)
+			report.Results = append(report.Results, &benchResult{Item: title, nick: nick, Value: count, Unit: "operations",
+				Cost: cost, CostUnit: "ms/op"})
 		}
 		show("FUSE operation", "fuse", "fuse_ops_durations_histogram_seconds")
 		show("Update meta", "meta", "transaction_durations_histogram_seconds")
@@ -400,24 +572,19 @@ func bench(ctx *cli.Context) error {
 		show("Delete object", "delete", "object_request_durations_histogram_seconds_DELETE")
 		show("Write into cache", "cachewr", "blockcache_write_hist_seconds")
 		show("Read from cache", "cacherd", "blockcache_read_hist_seconds")
-		var fmtString string
-		if bm.tty {
-			greenSeq := fmt.Sprintf("%s%dm", COLOR_SEQ, GREEN)
-			fmtString = fmt.Sprintf("Time used: %s%%.1f%s s, CPU: %s%%.1f%s%%%%, Memory: %s%%.1f%s MiB\n",
-				greenSeq, RESET_SEQ, greenSeq, RESET_SEQ, greenSeq, RESET_SEQ)
-		} else {
-			fmtString = "Time used: %.1f s, CPU: %.1f%%, Memory: %.1f MiB\n"
+		report.TimeUsed = diff("uptime")
+		if report.TimeUsed > 0 {
+			report.CPU = diff("cpu_usage") * 100 / report.TimeUsed
 		}
-		fmt.Printf(fmtString, diff("uptime"), diff("cpu_usage")*100/diff("uptime"), stats2["juicefs_memory"]/1024/1024)
+		report.Memory = stats2["juicefs_memory"] / 1024 / 1024
 	}
-	bm.printResult(result)
-	return nil
+	return report
 }
 
 func benchFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "bench",
-		Usage:     "run benchmark to read/write/stat big/small files",
+		Usage:     "run benchmark to read/write/stat/delete big/small files",
 		Action:    bench,
 		ArgsUsage: "PATH",
 		Flags: []cli.Flag{
@@ -447,6 +614,15 @@ func benchFlags() *cli.Command {
 				Value:   1,
 				Usage:   "number of concurrent threads",
 			},
+			&cli.UintFlag{
+				Name:  "rounds",
+				Value: 1,
+				Usage: "number of rounds to run, 0 means running until it's interrupted (for soak test)",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report of every round in JSON",
+			},
 		},
 	}
 }
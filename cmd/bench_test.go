@@ -31,3 +31,15 @@ func TestBench(t *testing.T) {
 		t.Fatalf("test bench failed: %s", err)
 	}
 }
+
+func TestBenchRounds(t *testing.T) {
+	os.Setenv("SKIP_DROP_CACHES", "true")
+	defer os.Unsetenv("SKIP_DROP_CACHES")
+	dir := t.TempDir()
+	if err := Main([]string{"", "bench", dir, "--big-file-size", "4", "--small-file-count", "10", "-p", "2", "--rounds", "2", "--json"}); err != nil {
+		t.Fatalf("bench in rounds: %s", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("the files should be removed after bench: %d left", len(entries))
+	}
+}
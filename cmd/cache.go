@@ -0,0 +1,136 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cacheFlags() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "manage the cache of a mount point",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "stats",
+				Usage:     "show the counters of block cache (hits, misses, evictions and bytes) of a mount point",
+				ArgsUsage: "MOUNTPOINT",
+				Action:    cacheStats,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "reset",
+						Usage: "reset the counters to zero after showing them",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the counters in JSON",
+					},
+				},
+			},
+		},
+	}
+}
+
+func cacheStats(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	mp, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	f := openController(mp)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+
+	var reset uint8
+	if ctx.Bool("reset") {
+		reset = 1
+	}
+	wb := utils.NewBuffer(8 + 1)
+	wb.Put32(meta.CacheStats)
+	wb.Put32(1)
+	wb.Put8(reset)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		return fmt.Errorf("read size: %d %s", n, err)
+	}
+	if n == 1 && data[0] == byte(syscall.EINVAL&0xff) {
+		return fmt.Errorf("cache stats is not supported, please upgrade and mount again")
+	}
+	if n == 1 {
+		return fmt.Errorf("read cache stats: %s", syscall.Errno(data[0]))
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(f, data); err != nil {
+		return fmt.Errorf("read cache stats: %s", err)
+	}
+	var stats chunk.CacheStats
+	if err = json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("decode cache stats: %s", err)
+	}
+	if ctx.Bool("json") {
+		printJson(&stats)
+	} else {
+		printCacheStats(os.Stdout, &stats, time.Now())
+	}
+	if reset != 0 && !ctx.Bool("json") {
+		fmt.Println("The counters are reset.")
+	}
+	return nil
+}
+
+func ratio(part, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", float64(part)*100/float64(total))
+}
+
+func printCacheStats(w io.Writer, s *chunk.CacheStats, now time.Time) {
+	fmt.Fprintf(w, "%-10s %s (%s ago)\n", "Since:", s.Since.Format("2006-01-02 15:04:05"), now.Sub(s.Since).Round(time.Second))
+	fmt.Fprintf(w, "%-10s %d (%s)\n", "Hits:", s.Hits, formatSize(uint64(s.HitBytes)))
+	fmt.Fprintf(w, "%-10s %d (%s)\n", "Misses:", s.Misses, formatSize(uint64(s.MissBytes)))
+	fmt.Fprintf(w, "%-10s %s of requests, %s of bytes\n", "Hit ratio:", ratio(s.Hits, s.Hits+s.Misses), ratio(s.HitBytes, s.HitBytes+s.MissBytes))
+	fmt.Fprintf(w, "%-10s %s\n", "Bypassed:", formatSize(uint64(s.BypassBytes)))
+	fmt.Fprintf(w, "%-10s %d (%s)\n", "Writes:", s.Writes, formatSize(uint64(s.WriteBytes)))
+	fmt.Fprintf(w, "%-10s %d\n", "Evictions:", s.Evicts)
+	fmt.Fprintf(w, "%-10s %d\n", "Drops:", s.Drops)
+}
@@ -0,0 +1,47 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+)
+
+func TestPrintCacheStats(t *testing.T) {
+	since := time.Date(2022, 6, 1, 10, 0, 0, 0, time.Local)
+	s := &chunk.CacheStats{Since: since, Hits: 3, Misses: 1, HitBytes: 3 << 20, MissBytes: 2 << 20, Writes: 2, WriteBytes: 2048, Evicts: 1}
+	var w bytes.Buffer
+	printCacheStats(&w, s, since.Add(time.Minute))
+	expected := `Since:     2022-06-01 10:00:00 (1m0s ago)
+Hits:      3 (3.00 MiB)
+Misses:    1 (2.00 MiB)
+Hit ratio: 75.00% of requests, 60.00% of bytes
+Bypassed:  0 B
+Writes:    2 (2.00 KiB)
+Evictions: 1
+Drops:     0
+`
+	if w.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, w.String())
+	}
+	if r := ratio(0, 0); r != "-" {
+		t.Fatalf("ratio without requests: %s", r)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func chattrFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "chattr",
+		Usage:     "change the immutable (i) or append-only (a) flag of files and directories in the mount point",
+		ArgsUsage: "MODE PATH ...",
+		Action:    chattr,
+	}
+}
+
+// parseFlags parses the mode of chattr (e.g. +i, -a, =ia), and returns the flags to clear and set.
+func parseFlags(s string) (clear, set uint8, err error) {
+	if s == "" {
+		return 0, 0, fmt.Errorf("invalid mode: %s", s)
+	}
+	for i := 0; i < len(s); {
+		op := s[i]
+		if op != '+' && op != '-' && op != '=' {
+			return 0, 0, fmt.Errorf("invalid mode: %s", s)
+		}
+		var flags uint8
+		for i++; i < len(s) && strings.IndexByte("+-=", s[i]) < 0; i++ {
+			switch s[i] {
+			case 'i':
+				flags |= meta.FlagImmutable
+			case 'a':
+				flags |= meta.FlagAppend
+			default:
+				return 0, 0, fmt.Errorf("invalid mode: %s", s)
+			}
+		}
+		switch op {
+		case '+':
+			set |= flags
+			clear &^= flags
+		case '-':
+			clear |= flags
+			set &^= flags
+		case '=':
+			clear = meta.FlagImmutable | meta.FlagAppend
+			set = flags
+		}
+	}
+	return clear, set, nil
+}
+
+func flagsString(flags uint8) string {
+	s := []byte("--")
+	if flags&meta.FlagImmutable != 0 {
+		s[0] = 'i'
+	}
+	if flags&meta.FlagAppend != 0 {
+		s[1] = 'a'
+	}
+	return string(s)
+}
+
+func chattr(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("MODE and PATH are needed")
+	}
+	clear, set, err := parseFlags(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	for i := 1; i < ctx.Args().Len(); i++ {
+		path := ctx.Args().Get(i)
+		p, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("abs of %s: %s", path, err)
+		}
+		inode, err := utils.GetFileInode(p)
+		if err != nil {
+			return fmt.Errorf("lookup inode for %s: %s", p, err)
+		}
+		f := openController(p)
+		if f == nil {
+			return fmt.Errorf("%s is not inside JuiceFS", path)
+		}
+		wb := utils.NewBuffer(8 + 8 + 1 + 1)
+		wb.Put32(meta.ChangeFlags)
+		wb.Put32(8 + 1 + 1)
+		wb.Put64(inode)
+		wb.Put8(clear)
+		wb.Put8(set)
+		_, err = f.Write(wb.Bytes())
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("write message: %s", err)
+		}
+		var resp = make([]byte, 2)
+		n, err := io.ReadFull(f, resp[:1])
+		if err == nil && resp[0] != uint8(syscall.EINVAL) {
+			n, err = io.ReadFull(f, resp[1:])
+		}
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("read message: %d %s", n, err)
+		}
+		if resp[0] == uint8(syscall.EINVAL) {
+			return fmt.Errorf("not supported by the mount point, please upgrade it")
+		}
+		if st := syscall.Errno(resp[0]); st != 0 {
+			return fmt.Errorf("chattr %s: %s", path, st)
+		}
+		logger.Infof("%s: %s", path, flagsString(resp[1]))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestParseFlags(t *testing.T) {
+	const i, a = meta.FlagImmutable, meta.FlagAppend
+	cases := []struct {
+		mode       string
+		from, to   uint8
+		shouldFail bool
+	}{
+		{"+i", 0, i, false},
+		{"+a", i, i | a, false},
+		{"-i", i | a, a, false},
+		{"=a", i, a, false},
+		{"=", i | a, 0, false},
+		{"+ia", 0, i | a, false},
+		{"+i-a", a, i, false},
+		{"", 0, 0, true},
+		{"i", 0, 0, true},
+		{"+x", 0, 0, true},
+	}
+	for _, c := range cases {
+		clear, set, err := parseFlags(c.mode)
+		if c.shouldFail {
+			if err == nil {
+				t.Fatalf("mode %q should be invalid", c.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parse %s: %s", c.mode, err)
+		}
+		if flags := c.from&^clear | set; flags != c.to {
+			t.Fatalf("chattr %s %d: expected %d, but got %d", c.mode, c.from, c.to, flags)
+		}
+	}
+	if s := flagsString(i | a); s != "ia" {
+		t.Fatalf("flags string: %s", s)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func attrChangeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"R"},
+			Usage:   "change files and directories recursively",
+		},
+		&cli.UintFlag{
+			Name:  "batch",
+			Value: 10000,
+			Usage: "number of inodes visited by the mount point in a batch",
+		},
+	}
+}
+
+func chmodFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "chmod",
+		Usage:     "change the mode of files and directories in the mount point",
+		ArgsUsage: "MODE PATH ...",
+		Action:    chmod,
+		Flags:     attrChangeFlags(),
+	}
+}
+
+func chownFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "chown",
+		Usage:     "change the owner and group of files and directories in the mount point",
+		ArgsUsage: "[OWNER][:GROUP] PATH ...",
+		Action:    chown,
+		Flags:     attrChangeFlags(),
+	}
+}
+
+// parseMode parses an octal mode or symbolic ones like chmod (e.g. u+x,go-w), and returns the bits
+// to clear and set. The umask is not used if no user is specified, X is not supported.
+func parseMode(s string) (unset, set uint16, err error) {
+	if v, e := strconv.ParseUint(s, 8, 16); e == nil {
+		if v > 07777 {
+			return 0, 0, fmt.Errorf("invalid mode: %s", s)
+		}
+		return 07777, uint16(v), nil
+	}
+	for _, clause := range strings.Split(s, ",") {
+		var who uint16
+		i := 0
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			}
+		}
+		if who == 0 {
+			who = 07777
+		}
+		if i == len(clause) {
+			return 0, 0, fmt.Errorf("invalid mode: %s", s)
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, 0, fmt.Errorf("invalid mode: %s", s)
+			}
+			var bits uint16
+			for i++; i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0; i++ {
+				switch clause[i] {
+				case 'r':
+					bits |= 0444
+				case 'w':
+					bits |= 0222
+				case 'x':
+					bits |= 0111
+				case 's':
+					bits |= 06000
+				case 't':
+					bits |= 01000
+				default:
+					return 0, 0, fmt.Errorf("invalid mode: %s", s)
+				}
+			}
+			bits &= who
+			switch op {
+			case '+':
+				set |= bits
+			case '-':
+				unset |= bits
+				set &^= bits
+			case '=':
+				unset |= who
+				set = set&^who | bits
+			}
+		}
+	}
+	return unset, set, nil
+}
+
+// parseOwner parses [OWNER][:GROUP], the names are looked up in local users and groups.
+func parseOwner(s string) (c meta.AttrChange, err error) {
+	owner, group := s, ""
+	if p := strings.IndexByte(s, ':'); p >= 0 {
+		owner, group = s[:p], s[p+1:]
+	}
+	if owner != "" {
+		id, err := strconv.ParseUint(owner, 10, 32)
+		if err != nil {
+			u, e := user.Lookup(owner)
+			if e != nil {
+				return c, fmt.Errorf("invalid user: %s", owner)
+			}
+			id, _ = strconv.ParseUint(u.Uid, 10, 32)
+		}
+		c.Set |= meta.SetAttrUID
+		c.Uid = uint32(id)
+	}
+	if group != "" {
+		id, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, e := user.LookupGroup(group)
+			if e != nil {
+				return c, fmt.Errorf("invalid group: %s", group)
+			}
+			id, _ = strconv.ParseUint(g.Gid, 10, 32)
+		}
+		c.Set |= meta.SetAttrGID
+		c.Gid = uint32(id)
+	}
+	if c.Set == 0 {
+		return c, fmt.Errorf("invalid owner: %s", s)
+	}
+	return c, nil
+}
+
+func chmod(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("MODE and PATH are needed")
+	}
+	unset, set, err := parseMode(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return changeAttrs(ctx, "chmod", &meta.AttrChange{Set: meta.SetAttrMode, Clear: unset, Mode: set})
+}
+
+func chown(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("OWNER and PATH are needed")
+	}
+	c, err := parseOwner(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	return changeAttrs(ctx, "chown", &c)
+}
+
+func changeAttrs(ctx *cli.Context, op string, c *meta.AttrChange) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Uint("batch") == 0 {
+		return fmt.Errorf("batch should be greater than 0")
+	}
+	progress := utils.NewProgress(false, false)
+	visited := progress.AddCountSpinner("Scanned inodes")
+	changed := progress.AddCountSpinner("Changed inodes")
+	var failed error
+	for i := 1; i < ctx.Args().Len() && failed == nil; i++ {
+		path := ctx.Args().Get(i)
+		p, err := filepath.Abs(path)
+		if err != nil {
+			failed = fmt.Errorf("abs of %s: %s", path, err)
+			break
+		}
+		inode, err := utils.GetFileInode(p)
+		if err != nil {
+			failed = fmt.Errorf("lookup inode for %s: %s", p, err)
+			break
+		}
+		f := openController(p)
+		if f == nil {
+			failed = fmt.Errorf("%s is not inside JuiceFS", path)
+			break
+		}
+		err = sendAttrChange(f, inode, c, ctx.Bool("recursive"), uint32(ctx.Uint("batch")), func(v, n uint64, last string, st syscall.Errno) {
+			visited.IncrBy(int(v))
+			changed.IncrBy(int(n))
+			if st != 0 {
+				failed = fmt.Errorf("%s %s: %s", op, filepath.Join(p, last), st)
+			}
+		})
+		if err != nil {
+			failed = err
+		}
+		_ = f.Close()
+	}
+	progress.Done()
+	if failed != nil {
+		return failed
+	}
+	logger.Infof("%s: %d inodes are changed, %d scanned", op, changed.Current(), visited.Current())
+	return nil
+}
+
+// sendAttrChange sends the change in batches, and calls report with the result of every batch.
+func sendAttrChange(f *os.File, inode uint64, c *meta.AttrChange, recursive bool, batch uint32, report func(visited, changed uint64, last string, st syscall.Errno)) error {
+	var after string
+	var rec uint8
+	if recursive {
+		rec = 1
+	}
+	for {
+		size := 8 + 1 + 2 + 2 + 4 + 4 + 1 + 4 + 4 + uint32(len(after))
+		wb := utils.NewBuffer(8 + size)
+		wb.Put32(meta.ChangeAttrs)
+		wb.Put32(size)
+		wb.Put64(inode)
+		wb.Put8(c.Set)
+		wb.Put16(c.Clear)
+		wb.Put16(c.Mode)
+		wb.Put32(c.Uid)
+		wb.Put32(c.Gid)
+		wb.Put8(rec)
+		wb.Put32(batch)
+		wb.Put32(uint32(len(after)))
+		wb.Put([]byte(after))
+		if _, err := f.Write(wb.Bytes()); err != nil {
+			return fmt.Errorf("write message: %s", err)
+		}
+		var resp = make([]byte, 1+8+8+4)
+		if n, err := io.ReadFull(f, resp[:1]); err != nil {
+			return fmt.Errorf("read message: %d %s", n, err)
+		}
+		if resp[0] == uint8(syscall.EINVAL) {
+			return fmt.Errorf("not supported by the mount point, please upgrade it")
+		}
+		if n, err := io.ReadFull(f, resp[1:]); err != nil {
+			return fmt.Errorf("read message: %d %s", n, err)
+		}
+		rb := utils.ReadBuffer(resp)
+		st := syscall.Errno(rb.Get8())
+		visited, changed := rb.Get64(), rb.Get64()
+		last := make([]byte, rb.Get32())
+		if n, err := io.ReadFull(f, last); err != nil {
+			return fmt.Errorf("read message: %d %s", n, err)
+		}
+		report(visited, changed, string(last), st)
+		if st != 0 || len(last) == 0 {
+			return nil
+		}
+		after = string(last)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		mode       string
+		from, to   uint16
+		shouldFail bool
+	}{
+		{"755", 0600, 0755, false},
+		{"4750", 0644, 04750, false},
+		{"u+x", 0644, 0744, false},
+		{"go-w", 0666, 0644, false},
+		{"a=r", 0755, 0444, false},
+		{"+x", 0644, 0755, false},
+		{"u=rwx,g=rx,o=", 0600, 0750, false},
+		{"u+rw-x", 0500, 0600, false},
+		{"g+s,o+t", 0755, 03755, false},
+		{"o=u", 0755, 0, true},
+		{"u", 0755, 0, true},
+		{"17777", 0755, 0, true},
+		{"x+r", 0755, 0, true},
+	}
+	for _, c := range cases {
+		unset, set, err := parseMode(c.mode)
+		if c.shouldFail {
+			if err == nil {
+				t.Fatalf("mode %s should be invalid", c.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parse %s: %s", c.mode, err)
+		}
+		if mode := c.from&^unset | set; mode != c.to {
+			t.Fatalf("chmod %s %o: expected %o, but got %o", c.mode, c.from, c.to, mode)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	cases := []struct {
+		owner string
+		set   uint8
+		uid   uint32
+		gid   uint32
+	}{
+		{"100", meta.SetAttrUID, 100, 0},
+		{"100:200", meta.SetAttrUID | meta.SetAttrGID, 100, 200},
+		{":200", meta.SetAttrGID, 0, 200},
+		{"root:0", meta.SetAttrUID | meta.SetAttrGID, 0, 0},
+	}
+	for _, c := range cases {
+		r, err := parseOwner(c.owner)
+		if err != nil || r.Set != c.set || r.Uid != c.uid || r.Gid != c.gid {
+			t.Fatalf("parse %s: %+v %v", c.owner, r, err)
+		}
+	}
+	for _, owner := range []string{"", ":", "no-such-user-xx"} {
+		if _, err := parseOwner(owner); err == nil {
+			t.Fatalf("owner %q should be invalid", owner)
+		}
+	}
+}
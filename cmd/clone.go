@@ -0,0 +1,120 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cloneFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "clone",
+		Usage:     "clone a file or directory without copying the data",
+		ArgsUsage: "SRC DST",
+		Action:    clone,
+	}
+}
+
+// findMountpoint returns the mount point of JuiceFS which the path belongs to
+func findMountpoint(path string) (string, error) {
+	for p := path; ; p = filepath.Dir(p) {
+		inode, err := utils.GetFileInode(p)
+		if err != nil {
+			return "", fmt.Errorf("lookup inode for %s: %s", p, err)
+		}
+		if inode == 1 {
+			return p, nil
+		}
+		if p == "/" {
+			return "", fmt.Errorf("%s is not inside JuiceFS", path)
+		}
+	}
+}
+
+func clone(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("SRC and DST are needed")
+	}
+	src, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	dst, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(1), err)
+	}
+	srcIno, err := utils.GetLinkInode(src) // clone the symlink itself
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", src, err)
+	}
+	dir := filepath.Dir(dst)
+	name := filepath.Base(dst)
+	if len(name) > 255 {
+		return fmt.Errorf("clone %s to %s: %s", src, dst, syscall.ENAMETOOLONG)
+	}
+	parent, err := utils.GetFileInode(dir)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", dir, err)
+	}
+	srcMp, err := findMountpoint(filepath.Dir(src))
+	if err != nil {
+		return err
+	}
+	dstMp, err := findMountpoint(dir)
+	if err != nil {
+		return err
+	}
+	if srcMp != dstMp {
+		return fmt.Errorf("%s and %s are not in the same JuiceFS volume", src, dst)
+	}
+
+	f := openController(dstMp)
+	if f == nil {
+		return fmt.Errorf("open control file under %s", dstMp)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 8 + 8 + 1 + uint32(len(name)))
+	wb.Put32(meta.Clone)
+	wb.Put32(8 + 8 + 1 + uint32(len(name)))
+	wb.Put64(srcIno)
+	wb.Put64(parent)
+	wb.Put8(uint8(len(name)))
+	wb.Put([]byte(name))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	n, err := f.Read(errs)
+	if err != nil || n != 1 {
+		logger.Fatalf("read message: %d %s", n, err)
+	}
+	if errs[0] != 0 {
+		return fmt.Errorf("clone %s to %s: %s", src, dst, syscall.Errno(errs[0]))
+	}
+	return nil
+}
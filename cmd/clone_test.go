@@ -0,0 +1,46 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	mountTemp(t, nil)
+	defer umountTemp(t)
+
+	if err := os.MkdirAll(testMountPoint+"/src/d", 0777); err != nil {
+		t.Fatalf("mkdirAll err %s", err)
+	}
+	if err := os.WriteFile(testMountPoint+"/src/d/f", []byte("test"), 0644); err != nil {
+		t.Fatalf("write file failed: %s", err)
+	}
+	if err := Main([]string{"", "clone", testMountPoint + "/src", testMountPoint + "/dst"}); err != nil {
+		t.Fatalf("clone failed: %s", err)
+	}
+	if err := os.WriteFile(testMountPoint+"/dst/d/f", []byte("changed"), 0644); err != nil {
+		t.Fatalf("write clone failed: %s", err)
+	}
+	if data, err := os.ReadFile(testMountPoint + "/src/d/f"); err != nil || string(data) != "test" {
+		t.Fatalf("source is changed: %q %s", data, err)
+	}
+	if err := Main([]string{"", "clone", testMountPoint + "/src", testMountPoint + "/src/d/loop"}); err == nil {
+		t.Fatalf("clone into itself should fail")
+	}
+}
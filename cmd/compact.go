@@ -0,0 +1,141 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func compactFlags() *cli.Command {
+	return &cli.Command{
+		Name:   "compact",
+		Usage:  "rewrite the data of files into one slice per chunk",
+		Action: compact,
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     "file",
+				Usage:    "path of the file to compact (can be specified multiple times)",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the result in JSON",
+			},
+		},
+	}
+}
+
+type compactResult struct {
+	Path string `json:"path"`
+	meta.CompactStats
+}
+
+func compact(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	var results []*compactResult
+	for _, p := range ctx.StringSlice("file") {
+		path, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("abs of %s: %s", p, err)
+		}
+		r, err := compactFile(path)
+		if err != nil {
+			return err
+		}
+		if !ctx.Bool("json") {
+			printCompactResult(os.Stdout, r)
+		}
+		results = append(results, r)
+	}
+	if ctx.Bool("json") {
+		printJson(results)
+	}
+	return nil
+}
+
+func compactFile(path string) (*compactResult, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	inode, err := utils.GetFileInode(path)
+	if err != nil {
+		return nil, fmt.Errorf("lookup inode for %s: %s", path, err)
+	}
+	mp, err := findMountpoint(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	f := openController(mp)
+	if f == nil {
+		return nil, fmt.Errorf("open control file under %s", mp)
+	}
+	defer f.Close()
+
+	wb := utils.NewBuffer(8 + 8)
+	wb.Put32(meta.CompactFile)
+	wb.Put32(8)
+	wb.Put64(inode)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return nil, fmt.Errorf("write message: %s", err)
+	}
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("read size: %d %s", n, err)
+	}
+	if n == 1 && data[0] == byte(syscall.EBUSY&0xff) {
+		return nil, fmt.Errorf("compact %s: it's being written or changed, please try again later", path)
+	}
+	if n == 1 {
+		return nil, fmt.Errorf("compact %s: %s", path, syscall.Errno(data[0]))
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("read result: %s", err)
+	}
+	r := &compactResult{Path: path}
+	if err = json.Unmarshal(data, &r.CompactStats); err != nil {
+		return nil, fmt.Errorf("decode result: %s", err)
+	}
+	return r, nil
+}
+
+func printCompactResult(w io.Writer, r *compactResult) {
+	if r.Chunks == 0 {
+		fmt.Fprintf(w, "%s: %d slices, nothing to compact\n", r.Path, r.OldSlices)
+		return
+	}
+	fmt.Fprintf(w, "%s: %d -> %d slices, %s rewritten in %d chunks\n", r.Path, r.OldSlices, r.NewSlices, formatSize(r.Bytes), r.Chunks)
+}
@@ -0,0 +1,34 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestPrintCompactResult(t *testing.T) {
+	var w bytes.Buffer
+	printCompactResult(&w, &compactResult{"/jfs/a", meta.CompactStats{Chunks: 2, OldSlices: 7, NewSlices: 2, Bytes: 10 << 20}})
+	printCompactResult(&w, &compactResult{"/jfs/b", meta.CompactStats{OldSlices: 1, NewSlices: 1}})
+	expected := "/jfs/a: 7 -> 2 slices, 10.00 MiB rewritten in 2 chunks\n/jfs/b: 1 slices, nothing to compact\n"
+	if w.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, w.String())
+	}
+}
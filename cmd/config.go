@@ -19,10 +19,17 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/urfave/cli/v2"
 )
 
@@ -45,8 +52,135 @@ func userConfirmed() bool {
 	return false
 }
 
+// refreshCreds sends the new credentials of object storage to a running mount point, they are
+// used by the following requests, but not saved in the volume.
+func refreshCreds(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("Windows is not supported")
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	accessKey, secretKey, token := ctx.String("access-key"), ctx.String("secret-key"), ctx.String("session-token")
+	if accessKey == "" {
+		accessKey = os.Getenv("ACCESS_KEY")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("SECRET_KEY")
+	}
+	if token == "" {
+		token = os.Getenv("SESSION_TOKEN")
+	}
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("--access-key and --secret-key are needed")
+	}
+	mp, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	f := openController(mp)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	size := 4 + len(accessKey) + 4 + len(secretKey) + 4 + len(token)
+	wb := utils.NewBuffer(8 + uint32(size))
+	wb.Put32(meta.RefreshCreds)
+	wb.Put32(uint32(size))
+	for _, s := range []string{accessKey, secretKey, token} {
+		wb.Put32(uint32(len(s)))
+		wb.Put([]byte(s))
+	}
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	var st = make([]byte, 1)
+	if _, err = io.ReadFull(f, st); err != nil {
+		return fmt.Errorf("read message: %s", err)
+	}
+	switch errno := syscall.Errno(st[0]); errno {
+	case 0:
+		logger.Infof("Credentials of %s are updated to access key %s", mp, accessKey)
+		return nil
+	case syscall.EINVAL:
+		return fmt.Errorf("not supported by the mount point, please upgrade it")
+	case syscall.EPERM:
+		return fmt.Errorf("only root or the owner of mount point can update the credentials")
+	default:
+		var msg = make([]byte, 4)
+		if _, err = io.ReadFull(f, msg); err == nil {
+			msg = make([]byte, utils.ReadBuffer(msg).Get32())
+			_, err = io.ReadFull(f, msg)
+		}
+		if err != nil {
+			return fmt.Errorf("read message: %s", err)
+		}
+		return fmt.Errorf("update credentials (old ones are kept): %s", msg)
+	}
+}
+
+// pauseBackground pauses (or resumes) the background tasks of a running mount point, e.g. the
+// cleanup of deleted files, the compaction and deletion of slices, to save the bandwidth of object
+// storage for the foreground requests. It's not kept after remounting.
+func pauseBackground(ctx *cli.Context, pause bool) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("Windows is not supported")
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	mp, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	f := openController(mp)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 1)
+	wb.Put32(meta.PauseBackground)
+	wb.Put32(1)
+	if pause {
+		wb.Put8(1)
+	} else {
+		wb.Put8(0)
+	}
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	var st = make([]byte, 1)
+	if _, err = io.ReadFull(f, st); err != nil {
+		return fmt.Errorf("read message: %s", err)
+	}
+	switch errno := syscall.Errno(st[0]); errno {
+	case 0:
+		if pause {
+			logger.Infof("Background tasks of %s are paused", mp)
+		} else {
+			logger.Infof("Background tasks of %s are resumed", mp)
+		}
+		return nil
+	case syscall.EINVAL:
+		return fmt.Errorf("not supported by the mount point, please upgrade it")
+	case syscall.EPERM:
+		return fmt.Errorf("only root or the owner of mount point can pause or resume the background tasks")
+	default:
+		return fmt.Errorf("pause background tasks: %s", errno)
+	}
+}
+
 func config(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
+	if ctx.Bool("refresh-creds") {
+		return refreshCreds(ctx)
+	}
+	if ctx.Bool("pause-background") && ctx.Bool("resume-background") {
+		return fmt.Errorf("--pause-background and --resume-background can't be used together")
+	}
+	if ctx.Bool("pause-background") || ctx.Bool("resume-background") {
+		return pauseBackground(ctx, ctx.Bool("pause-background"))
+	}
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("META-URL is needed")
 	}
@@ -63,7 +197,7 @@ func config(ctx *cli.Context) error {
 		return nil
 	}
 
-	var quota, storage, trash bool
+	var quota, storage, trash, prefixes bool
 	var msg strings.Builder
 	for _, flag := range ctx.LocalFlagNames() {
 		switch flag {
@@ -97,12 +231,84 @@ func config(ctx *cli.Context) error {
 				format.SecretKey = new
 				storage = true
 			}
+		case "client-ops-limit":
+			if new := ctx.Int(flag); new != format.ClientOpsLimit {
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.ClientOpsLimit, new))
+				format.ClientOpsLimit = new
+			}
+		case "journal-size":
+			if new := ctx.Int(flag); new != format.JournalSize {
+				if new < 0 {
+					return fmt.Errorf("invalid journal size: %d", new)
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.JournalSize, new))
+				format.JournalSize = new
+			}
+		case "compress":
+			new := strings.ToLower(ctx.String(flag))
+			if !compress.Tagged(new) {
+				new += compress.TagSuffix
+			}
+			if new == format.Compression {
+				break
+			}
+			if !compress.Tagged(format.Compression) {
+				return fmt.Errorf("the compression of blocks is not tagged in this volume (not formatted with --tag-codec), it can't be changed")
+			}
+			if compress.NewCompressor(new) == nil {
+				return fmt.Errorf("unsupported compress algorithm: %s", ctx.String(flag))
+			}
+			msg.WriteString(fmt.Sprintf("%10s: %s -> %s\n", flag, format.Compression, new))
+			format.Compression = new
 		case "trash-days":
 			if new := ctx.Int(flag); new != format.TrashDays {
 				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.TrashDays, new))
 				format.TrashDays = new
 				trash = true
 			}
+		case "xattr-checksum":
+			new := ctx.Bool(flag)
+			if new == format.XattrChecksum {
+				break
+			}
+			if !new {
+				return fmt.Errorf("xattr checksum can't be disabled once enabled, since the stamped values would be exposed")
+			}
+			msg.WriteString(fmt.Sprintf("%10s: %t -> %t\n", flag, format.XattrChecksum, new))
+			format.XattrChecksum = new
+		case "key-prefixes":
+			new := ctx.Int(flag)
+			if new == format.KeyPrefixes {
+				break
+			}
+			if format.KeyPrefixes != 0 {
+				return fmt.Errorf("key prefixes can't be changed once enabled (%d)", format.KeyPrefixes)
+			}
+			if err = checkKeyPrefixes(new); err != nil {
+				return err
+			}
+			// the running clients would keep writing the blocks of new slices without prefixes
+			m.CleanStaleSessions()
+			sessions, err := m.ListSessions()
+			if err != nil {
+				return fmt.Errorf("list sessions: %s", err)
+			}
+			if num := len(sessions); num > 0 {
+				ss := make([][3]string, num)
+				for i, s := range sessions {
+					ss[i] = [3]string{strconv.FormatUint(s.Sid, 10), s.HostName, s.MountPoint}
+				}
+				return fmt.Errorf("%d sessions are active, please umount them before enabling key prefixes:\n%s", num, printSessions(ss))
+			}
+			// any slice created from now on is not older than it
+			var next uint64
+			if st := m.NewChunk(meta.Background, &next); st != 0 {
+				return fmt.Errorf("allocate chunk id: %s", st)
+			}
+			msg.WriteString(fmt.Sprintf("%10s: %d -> %d (since slice %d)\n", flag, format.KeyPrefixes, new, next))
+			format.KeyPrefixes = new
+			format.PrefixedFrom = next
+			prefixes = true
 		}
 	}
 	if msg.Len() == 0 {
@@ -112,7 +318,12 @@ func config(ctx *cli.Context) error {
 
 	if !ctx.Bool("force") {
 		if storage {
-			blob, err := createStorage(format)
+			sconf, err := newStorageConfig(ctx)
+			if err != nil {
+				return err
+			}
+			defer sconf.close()
+			blob, err := createStorage(format, sconf)
 			if err != nil {
 				return err
 			}
@@ -133,6 +344,12 @@ func config(ctx *cli.Context) error {
 				}
 			}
 		}
+		if prefixes {
+			warn("The blocks of new slices will be written with hashed prefixes, all the clients should be upgraded before mounting it again, old clients can't read them.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
 		if trash && format.TrashDays == 0 {
 			warn("The current trash will be emptied and future removed files will purged immediately.")
 			if !userConfirmed() {
@@ -151,9 +368,9 @@ func configFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "config",
 		Usage:     "change config of a volume",
-		ArgsUsage: "META-URL",
+		ArgsUsage: "META-URL | --refresh-creds MOUNTPOINT | --pause-background MOUNTPOINT | --resume-background MOUNTPOINT",
 		Action:    config,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.Uint64Flag{
 				Name:  "capacity",
 				Usage: "the limit for space in GiB",
@@ -174,14 +391,50 @@ func configFlags() *cli.Command {
 				Name:  "secret-key",
 				Usage: "Secret key for object storage",
 			},
+			&cli.StringFlag{
+				Name:  "session-token",
+				Usage: "session token of the temporary credentials, only used with --refresh-creds",
+			},
+			&cli.BoolFlag{
+				Name:  "refresh-creds",
+				Usage: "update the credentials of object storage in a running mount point without remounting, they are not saved in the volume",
+			},
+			&cli.BoolFlag{
+				Name:  "pause-background",
+				Usage: "pause the background tasks (cleanup, compaction and deletion of data) of a running mount point until resumed or remounted",
+			},
+			&cli.BoolFlag{
+				Name:  "resume-background",
+				Usage: "resume the background tasks of a running mount point paused by --pause-background",
+			},
+			&cli.StringFlag{
+				Name:  "compress",
+				Usage: "compression algorithm (lz4, zstd, none) of new blocks, only for the volumes formatted with --tag-codec",
+			},
 			&cli.IntFlag{
 				Name:  "trash-days",
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.IntFlag{
+				Name:  "key-prefixes",
+				Usage: "spread the blocks of new slices across N hashed key prefixes (2 to 4096), it can't be changed once enabled",
+			},
+			&cli.BoolFlag{
+				Name:  "xattr-checksum",
+				Usage: "store a checksum with the value of every xattr set from now on, it can't be disabled once enabled",
+			},
+			&cli.IntFlag{
+				Name:  "client-ops-limit",
+				Usage: "max meta operations per second of each client, the clients exceeded it are throttled (0 means unlimited)",
+			},
+			&cli.IntFlag{
+				Name:  "journal-size",
+				Usage: "keep the latest N changes in the journal for 'juicefs watch' to tail (0 means disabled), it's applied to the running clients within a minute",
+			},
 			&cli.BoolFlag{
 				Name:  "force",
 				Usage: "skip sanity check and force update the configurations",
 			},
-		},
+		}, storageFlags()...),
 	}
 }
@@ -47,7 +47,7 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("format: %s", err)
 	}
 
-	if err := Main([]string{"", "config", testMeta, "--trash-days", "2"}); err != nil {
+	if err := Main([]string{"", "config", testMeta, "--trash-days", "2", "--client-ops-limit", "1000"}); err != nil {
 		t.Fatalf("config: %s", err)
 	}
 	data, err := getStdout([]string{"", "config", testMeta})
@@ -61,6 +61,9 @@ func TestConfig(t *testing.T) {
 	if format.TrashDays != 2 {
 		t.Fatalf("trash-days %d != expect 2", format.TrashDays)
 	}
+	if format.ClientOpsLimit != 1000 {
+		t.Fatalf("client-ops-limit %d != expect 1000", format.ClientOpsLimit)
+	}
 
 	if err = Main([]string{"", "config", testMeta, "--capacity", "10", "--inodes", "1000000"}); err != nil {
 		t.Fatalf("config: %s", err)
@@ -78,4 +81,54 @@ func TestConfig(t *testing.T) {
 		format.Bucket != "/tmp/newBucket" || format.AccessKey != "testAK" || format.SecretKey != "removed" {
 		t.Fatalf("unexpect format: %+v", format)
 	}
+	if err = Main([]string{"", "config", testMeta, "--compress", "lz4"}); err == nil {
+		t.Fatalf("compression should not be changed without --tag-codec")
+	}
+
+	_ = resetTestMeta()
+	if err = Main([]string{"", "format", testMeta, "--bucket", "/tmp/testBucket", "--compress", "zstd", "--tag-codec", testVolume}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	if err = Main([]string{"", "config", testMeta, "--compress", "lz4"}); err != nil {
+		t.Fatalf("config: %s", err)
+	}
+	if data, err = getStdout([]string{"", "config", testMeta}); err != nil {
+		t.Fatalf("getStdout: %s", err)
+	}
+	if err = json.Unmarshal(data, &format); err != nil {
+		t.Fatalf("json unmarshal: %s", err)
+	}
+	if format.Compression != "lz4+tag" {
+		t.Fatalf("compression %s != expect lz4+tag", format.Compression)
+	}
+}
+
+func TestConfigKeyPrefixes(t *testing.T) {
+	_ = resetTestMeta()
+	if err := Main([]string{"", "format", testMeta, "--bucket", "/tmp/testBucket", testVolume}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	m := meta.NewClient(testMeta, &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	if err := Main([]string{"", "config", testMeta, "--key-prefixes", "16", "--force"}); err == nil {
+		t.Fatalf("key prefixes should not be enabled with active sessions")
+	}
+	if err := m.CloseSession(); err != nil {
+		t.Fatalf("close session: %s", err)
+	}
+	if err := Main([]string{"", "config", testMeta, "--key-prefixes", "16", "--force"}); err != nil {
+		t.Fatalf("config: %s", err)
+	}
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if format.KeyPrefixes != 16 || format.PrefixedFrom == 0 {
+		t.Fatalf("unexpect format: %+v", format)
+	}
 }
@@ -0,0 +1,185 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func debugFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "debug",
+		Usage:     "show the operations in progress of a mount point, or capture a profile of it",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    debug,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the operations in JSON",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "capture a profile of the mount process instead, could be cpu, heap or goroutine",
+			},
+			&cli.DurationFlag{
+				Name:  "duration",
+				Value: time.Second * 30,
+				Usage: "duration of the CPU profile",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "file to save the profile (default: juicefs.<profile>.<time>.pprof in current directory)",
+			},
+		},
+	}
+}
+
+func printPendingOps(w io.Writer, ops []vfs.PendingOp) {
+	if len(ops) == 0 {
+		fmt.Fprintln(w, "No operation is in progress")
+		return
+	}
+	fmt.Fprintln(w, "START\tAGE\tOP\tINODE\tPID\tWAITING")
+	for _, op := range ops {
+		age := time.Duration(op.Age * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", op.Start.Format("2006/01/02 15:04:05.000000"), age, op.Op, op.Inode, op.Pid, op.Waiting)
+	}
+}
+
+func debug(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		logger.Infof("MOUNTPOINT is needed")
+		return nil
+	}
+	mp, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	f := openController(mp)
+	if f == nil {
+		logger.Fatalf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	if kind := ctx.String("profile"); kind != "" {
+		return captureProfile(f, kind, ctx.Duration("duration"), ctx.String("output"))
+	}
+
+	wb := utils.NewBuffer(8)
+	wb.Put32(meta.PendingOps)
+	wb.Put32(0)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	if n == 1 {
+		if data[0] == byte(syscall.EINVAL&0xff) {
+			logger.Fatalf("debug is not supported, please upgrade and mount again")
+		}
+		logger.Fatalf("dump pending operations: %s", syscall.Errno(data[0]))
+	}
+	size := utils.ReadBuffer(data).Get32()
+	data = make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		logger.Fatalf("read pending operations: %s", err)
+	}
+	if ctx.Bool("json") {
+		fmt.Println(string(data))
+		return nil
+	}
+	var ops []vfs.PendingOp
+	if err = json.Unmarshal(data, &ops); err != nil {
+		logger.Fatalf("invalid pending operations: %s", err)
+	}
+	printPendingOps(os.Stdout, ops)
+	return nil
+}
+
+// captureProfile asks the mount process to capture a profile through the control file, and saves
+// it into output, which could be analyzed by `go tool pprof`.
+func captureProfile(f *os.File, kind string, duration time.Duration, output string) error {
+	switch kind {
+	case "cpu":
+		if duration < time.Second || duration > vfs.MaxProfileDuration {
+			return fmt.Errorf("duration of CPU profile should be between 1s and %s: %s", vfs.MaxProfileDuration, duration)
+		}
+	case "heap", "goroutine":
+		duration = 0
+	default:
+		return fmt.Errorf("invalid profile: %s, should be cpu, heap or goroutine", kind)
+	}
+	if output == "" {
+		output = fmt.Sprintf("juicefs.%s.%s.pprof", kind, time.Now().Format("20060102150405"))
+	}
+	wb := utils.NewBuffer(4 + 4 + 4 + uint32(len(kind)) + 4)
+	wb.Put32(meta.Profile)
+	wb.Put32(4 + uint32(len(kind)) + 4)
+	wb.Put32(uint32(len(kind)))
+	wb.Put([]byte(kind))
+	wb.Put32(uint32(duration / time.Second))
+	if _, err := f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	if duration > 0 {
+		logger.Infof("Capturing CPU profile for %s ...", duration)
+	}
+
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	if n == 1 {
+		switch syscall.Errno(data[0]) {
+		case syscall.EINVAL:
+			logger.Fatalf("profile is not supported, please upgrade and mount again")
+		case syscall.EBUSY:
+			logger.Fatalf("another CPU profile is in progress")
+		}
+		logger.Fatalf("capture profile: %s", syscall.Errno(data[0]))
+	}
+	size := utils.ReadBuffer(data).Get32()
+	data = make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		logger.Fatalf("read profile: %s", err)
+	}
+	if err = os.WriteFile(output, data, 0600); err != nil {
+		return fmt.Errorf("save profile: %s", err)
+	}
+	logger.Infof("Saved %s profile (%d bytes) into %s, analyze it with `go tool pprof %s`", kind, size, output, output)
+	return nil
+}
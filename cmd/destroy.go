@@ -123,7 +123,12 @@ func destroy(ctx *cli.Context) error {
 		}
 	}
 
-	blob, err := createStorage(format)
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("create object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
 	if err != nil {
 		logger.Fatalf("create object storage: %s", err)
 	}
@@ -192,11 +197,11 @@ func destroyFlags() *cli.Command {
 		Usage:     "destroy an existing volume",
 		ArgsUsage: "META-URL UUID",
 		Action:    destroy,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.BoolFlag{
 				Name:  "force",
 				Usage: "skip sanity check and force destroy the volume",
 			},
-		},
+		}, storageFlags()...),
 	}
 }
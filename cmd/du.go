@@ -0,0 +1,287 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func duFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "du",
+		Usage:     "show the largest directories and files under a path, from the metadata without mounting",
+		ArgsUsage: "META-URL [PATH]",
+		Action:    du,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "top",
+				Value: 10,
+				Usage: "number of the largest directories and files to show",
+			},
+			&cli.IntFlag{
+				Name:  "depth",
+				Usage: "show only the entries at most this deep under PATH (0 means unlimited), the size of a directory still includes everything in it",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of directories read concurrently",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the result in JSON",
+			},
+		},
+	}
+}
+
+type duEntry struct {
+	Path   string   `json:"path"`
+	Inode  meta.Ino `json:"inode"`
+	Size   uint64   `json:"size"`   // in bytes, the length of every file rounded up to 4 KiB, as du
+	Length uint64   `json:"length"` // apparent size
+	Files  uint64   `json:"files,omitempty"`
+	Dirs   uint64   `json:"dirs,omitempty"`
+}
+
+// topEntries keeps the largest n entries in a min-heap.
+type topEntries struct {
+	n       int
+	entries []*duEntry
+}
+
+func (t *topEntries) Len() int           { return len(t.entries) }
+func (t *topEntries) Less(i, j int) bool { return t.entries[i].Size < t.entries[j].Size }
+func (t *topEntries) Swap(i, j int)      { t.entries[i], t.entries[j] = t.entries[j], t.entries[i] }
+func (t *topEntries) Push(x interface{}) { t.entries = append(t.entries, x.(*duEntry)) }
+func (t *topEntries) Pop() interface{} {
+	e := t.entries[len(t.entries)-1]
+	t.entries = t.entries[:len(t.entries)-1]
+	return e
+}
+
+func (t *topEntries) add(e *duEntry) {
+	if t.n <= 0 {
+		return
+	}
+	if len(t.entries) < t.n {
+		heap.Push(t, e)
+	} else if e.Size > t.entries[0].Size {
+		t.entries[0] = e
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the entries from the largest one.
+func (t *topEntries) sorted() []*duEntry {
+	es := append([]*duEntry{}, t.entries...)
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Size != es[j].Size {
+			return es[i].Size > es[j].Size
+		}
+		return es[i].Path < es[j].Path
+	})
+	return es
+}
+
+type duResult struct {
+	Total *duEntry   `json:"total"`
+	Dirs  []*duEntry `json:"dirs"`
+	Files []*duEntry `json:"files"`
+}
+
+type duWalker struct {
+	m       meta.Meta
+	depth   int
+	threads chan struct{}
+
+	sync.Mutex
+	linked map[meta.Ino]bool // files with hard links are counted once
+	dirs   topEntries
+	files  topEntries
+	err    error
+}
+
+func duSize(length uint64) uint64 {
+	return (length + 4095) / 4096 * 4096
+}
+
+func (w *duWalker) shown(level int) bool {
+	return w.depth == 0 || level <= w.depth
+}
+
+func (w *duWalker) addFile(p string, inode meta.Ino, attr *meta.Attr, level int) bool {
+	w.Lock()
+	defer w.Unlock()
+	if attr.Nlink > 1 {
+		if w.linked[inode] {
+			return false
+		}
+		w.linked[inode] = true
+	}
+	if w.shown(level) {
+		w.files.add(&duEntry{Path: p, Inode: inode, Size: duSize(attr.Length), Length: attr.Length})
+	}
+	return true
+}
+
+func (w *duWalker) fail(p string, st syscall.Errno) {
+	w.Lock()
+	if w.err == nil {
+		w.err = fmt.Errorf("readdir %s: %s", p, st)
+	}
+	w.Unlock()
+}
+
+// walk returns the usage of directory inode at level (0 for the top one), the sub-directories are
+// read concurrently if there are idle threads.
+func (w *duWalker) walk(p string, inode meta.Ino, level int) *duEntry {
+	d := &duEntry{Path: p, Inode: inode, Size: 4096, Dirs: 1}
+	var entries []*meta.Entry
+	if st := w.m.Readdir(meta.Background, inode, 1, &entries); st != 0 {
+		w.fail(p, st)
+		return d
+	}
+	var wg sync.WaitGroup
+	var subs []*duEntry
+	var mu sync.Mutex
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 1 && e.Name[0] == '.' || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+			continue
+		}
+		name := path.Join(p, string(e.Name))
+		if e.Attr.Typ != meta.TypeDirectory {
+			if w.addFile(name, e.Inode, e.Attr, level+1) {
+				d.Files++
+				d.Length += e.Attr.Length
+				d.Size += duSize(e.Attr.Length)
+			}
+			continue
+		}
+		select {
+		case w.threads <- struct{}{}:
+			wg.Add(1)
+			go func(name string, inode meta.Ino) {
+				defer wg.Done()
+				s := w.walk(name, inode, level+1)
+				<-w.threads
+				mu.Lock()
+				subs = append(subs, s)
+				mu.Unlock()
+			}(name, e.Inode)
+		default:
+			subs = append(subs, w.walk(name, e.Inode, level+1))
+		}
+	}
+	wg.Wait()
+	for _, s := range subs {
+		d.Size += s.Size
+		d.Length += s.Length
+		d.Files += s.Files
+		d.Dirs += s.Dirs
+	}
+	if level > 0 && w.shown(level) {
+		w.Lock()
+		w.dirs.add(d)
+		w.Unlock()
+	}
+	return d
+}
+
+// duTop returns the usage of inode (at path p) and the largest directories and files at most depth
+// levels under it.
+func duTop(m meta.Meta, p string, inode meta.Ino, attr *meta.Attr, top, depth, threads int) (*duResult, error) {
+	if attr.Typ != meta.TypeDirectory {
+		e := &duEntry{Path: p, Inode: inode, Size: duSize(attr.Length), Length: attr.Length, Files: 1}
+		return &duResult{Total: e, Dirs: []*duEntry{}, Files: []*duEntry{e}}, nil
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	w := &duWalker{m: m, depth: depth, threads: make(chan struct{}, threads-1), linked: make(map[meta.Ino]bool)}
+	w.dirs.n, w.files.n = top, top
+	total := w.walk(p, inode, 0)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return &duResult{Total: total, Dirs: w.dirs.sorted(), Files: w.files.sorted()}, nil
+}
+
+func humanSize(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	v, i := float64(n), 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func du(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	if _, err := m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	p := "/"
+	if ctx.Args().Len() > 1 {
+		p = path.Join("/", ctx.Args().Get(1))
+	}
+	inode, attr, st := resolvePath(m, p)
+	if st != 0 {
+		return fmt.Errorf("resolve %s: %s", p, st)
+	}
+	r, err := duTop(m, p, inode, attr, ctx.Int("top"), ctx.Int("depth"), ctx.Int("threads"))
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		printJson(r)
+		return nil
+	}
+	fmt.Printf("%s: %s (%d bytes), %d files, %d directories\n", r.Total.Path, humanSize(r.Total.Size), r.Total.Length, r.Total.Files, r.Total.Dirs)
+	if len(r.Dirs) > 0 && attr.Typ == meta.TypeDirectory {
+		fmt.Println("\nLargest directories:")
+		for _, e := range r.Dirs {
+			fmt.Printf("%12s %10d files  %s\n", humanSize(e.Size), e.Files, strings.TrimSuffix(e.Path, "/")+"/")
+		}
+	}
+	if len(r.Files) > 0 {
+		fmt.Println("\nLargest files:")
+		for _, e := range r.Files {
+			fmt.Printf("%12s  %s\n", humanSize(e.Size), e.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestDuTop(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "du.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4096}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := meta.Background
+	mkdir := func(parent meta.Ino, name string) meta.Ino {
+		var inode meta.Ino
+		if st := m.Mkdir(ctx, parent, name, 0755, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+		return inode
+	}
+	create := func(parent meta.Ino, name string, length uint64) meta.Ino {
+		var inode meta.Ino
+		if st := m.Create(ctx, parent, name, 0644, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		if st := m.Truncate(ctx, inode, 0, length, nil); st != 0 {
+			t.Fatalf("truncate %s: %s", name, st)
+		}
+		return inode
+	}
+	// /a/b/c/big (1 MiB), /a/small (100), /d/x{0..9} (10 KiB each), /d/link -> /a/small
+	a := mkdir(1, "a")
+	b := mkdir(a, "b")
+	c := mkdir(b, "c")
+	create(c, "big", 1<<20)
+	small := create(a, "small", 100)
+	d := mkdir(1, "d")
+	for i := 0; i < 10; i++ {
+		create(d, fmt.Sprintf("x%d", i), 10<<10)
+	}
+	if st := m.Link(ctx, small, d, "link", nil); st != 0 {
+		t.Fatalf("link: %s", st)
+	}
+
+	var attr meta.Attr
+	_ = m.GetAttr(ctx, 1, &attr)
+	r, err := duTop(m, "/", 1, &attr, 3, 0, 4)
+	if err != nil {
+		t.Fatalf("du: %s", err)
+	}
+	if tt := r.Total; tt.Files != 12 || tt.Dirs != 5 || tt.Length != 1<<20+100+100<<10 || tt.Size != 1<<20+4096+10*12<<10+5*4096 {
+		t.Fatalf("total: %+v", tt)
+	}
+	var dirs, files []string
+	for _, e := range r.Dirs {
+		dirs = append(dirs, e.Path)
+	}
+	for _, e := range r.Files {
+		files = append(files, e.Path)
+	}
+	// /a, /a/b and /a/b/c are all larger than /d
+	if fmt.Sprint(dirs) != "[/a /a/b /a/b/c]" || len(files) != 3 || files[0] != "/a/b/c/big" {
+		t.Fatalf("top: %v %v", dirs, files)
+	}
+	// 3 directories and big, small (4K) could be counted in /d as the link
+	if r.Dirs[0].Size-r.Dirs[0].Files*4096 != 1<<20+3*4096-4096 {
+		t.Fatalf("/a: %+v", r.Dirs[0])
+	}
+
+	// only the top-level entries, and the sizes of directories are still the whole tree
+	if r, err = duTop(m, "/", 1, &attr, 10, 1, 1); err != nil {
+		t.Fatalf("du: %s", err)
+	}
+	if len(r.Dirs) != 2 || r.Dirs[0].Path != "/a" || r.Dirs[1].Path != "/d" || len(r.Files) != 0 {
+		t.Fatalf("depth 1: %+v %+v", r.Dirs, r.Files)
+	}
+	// the hard linked file is counted in either of them
+	if r.Dirs[0].Files+r.Dirs[1].Files != 12 {
+		t.Fatalf("files: %d + %d", r.Dirs[0].Files, r.Dirs[1].Files)
+	}
+	_ = m.GetAttr(ctx, b, &attr)
+	if r, err = duTop(m, "/a/b", b, &attr, 10, 1, 1); err != nil {
+		t.Fatalf("du: %s", err)
+	}
+	if len(r.Dirs) != 1 || r.Dirs[0].Path != "/a/b/c" || len(r.Files) != 0 || r.Total.Files != 1 {
+		t.Fatalf("depth 1 of /a/b: %+v %+v", r.Dirs, r.Files)
+	}
+
+	inode, fattr, st := resolvePath(m, "/a/b/c/big")
+	if st != 0 {
+		t.Fatalf("resolve: %s", st)
+	}
+	if r, err = duTop(m, "/a/b/c/big", inode, fattr, 10, 0, 1); err != nil || r.Total.Size != 1<<20 || len(r.Files) != 1 || len(r.Dirs) != 0 {
+		t.Fatalf("du of file: %+v %v", r, err)
+	}
+}
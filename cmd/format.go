@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
@@ -53,18 +54,72 @@ func fixObjectSize(s int) int {
 	return s
 }
 
-func createStorage(format *meta.Format) (object.ObjectStorage, error) {
-	object.UserAgent = "JuiceFS-" + version.Version()
+// newBucket creates the object storage of a bucket with the storage type and shards of the volume.
+func newBucket(format *meta.Format, conf *storageConfig, bucket, accessKey, secretKey string) (object.ObjectStorage, error) {
 	var blob object.ObjectStorage
 	var err error
 	if format.Shards > 1 {
-		blob, err = object.NewSharded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.Shards)
+		blob, err = object.NewSharded(strings.ToLower(format.Storage), bucket, accessKey, secretKey, format.Shards)
 	} else {
-		blob, err = object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
+		blob, err = object.CreateStorage(strings.ToLower(format.Storage), bucket, accessKey, secretKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conf.setup(blob); err != nil {
+		return nil, err
+	}
+	if conf.sse != "" {
+		if err = object.SetServerSideEncryption(blob, conf.sse, conf.kmsKeyID); err != nil {
+			return nil, fmt.Errorf("server-side encryption of %s: %s", blob, err)
+		}
+	}
+	if conf.requestLog != nil {
+		blob = object.WithRequestLog(blob, conf.requestLog)
+	}
+	return blob, nil
+}
+
+func createFallback(format *meta.Format, conf *storageConfig) (object.ObjectStorage, error) {
+	ak, sk := conf.fallback.accessKey, conf.fallback.secretKey
+	if ak == "" && sk == "" {
+		ak, sk = format.AccessKey, format.SecretKey
+	}
+	blob, err := newBucket(format, conf, conf.fallback.bucket, ak, sk)
+	if err != nil {
+		return nil, err
 	}
+	return object.WithRetry(blob, conf.retries), nil
+}
+
+func createStorage(format *meta.Format, conf *storageConfig) (object.ObjectStorage, error) {
+	object.UserAgent = "JuiceFS-" + version.Version()
+	blob, err := newBucket(format, conf, format.Bucket, format.AccessKey, format.SecretKey)
 	if err != nil {
 		return nil, err
 	}
+	if len(conf.replicas) > 0 {
+		var stores []object.ObjectStorage
+		for _, bucket := range conf.replicas {
+			replica, err := newBucket(format, conf, bucket, format.AccessKey, format.SecretKey)
+			if err != nil {
+				return nil, fmt.Errorf("replica storage %s: %s", bucket, err)
+			}
+			stores = append(stores, replica)
+		}
+		logger.Infof("Read objects from the nearest healthy one of %s and %d replicas, write them into %s", blob, len(stores), blob)
+		// the retries go through the endpoints again, so a failed one is skipped at once
+		blob = object.WithEndpoints(blob, stores, nil, conf.probeInterval)
+	}
+	blob = object.WithRetry(blob, conf.retries)
+	if conf.fallback.bucket != "" {
+		secondary, err := createFallback(format, conf)
+		if err != nil {
+			return nil, fmt.Errorf("fallback storage %s: %s", conf.fallback.bucket, err)
+		}
+		logger.Infof("Read objects from %s when they can't be read from %s", secondary, blob)
+		blob = object.WithFallback(blob, secondary)
+	}
 	blob = object.WithPrefix(blob, format.Name+"/")
 
 	if format.EncryptKey != "" {
@@ -161,7 +216,11 @@ func format(c *cli.Context) error {
 		logger.Fatalf("invalid name: %s, only alphabet, number and - are allowed, and the length should be 3 to 63 characters.", name)
 	}
 
-	compressor := compress.NewCompressor(c.String("compress"))
+	algr := c.String("compress")
+	if c.Bool("tag-codec") && !compress.Tagged(algr) {
+		algr += compress.TagSuffix
+	}
+	compressor := compress.NewCompressor(algr)
 	if compressor == nil {
 		logger.Fatalf("Unsupported compress algorithm: %s", c.String("compress"))
 	}
@@ -182,8 +241,25 @@ func format(c *cli.Context) error {
 		Capacity:    c.Uint64("capacity") << 30,
 		Inodes:      c.Uint64("inodes"),
 		BlockSize:   fixObjectSize(c.Int("block-size")),
-		Compression: c.String("compress"),
+		Compression: algr,
 		TrashDays:   c.Int("trash-days"),
+		KeyPrefixes: c.Int("key-prefixes"),
+
+		XattrChecksum: c.Bool("xattr-checksum"),
+		InlineSize:    c.Int("inline-size"),
+		JournalSize:   c.Int("journal-size"),
+	}
+	if err := checkKeyPrefixes(format.KeyPrefixes); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := checkInlineSize(format.InlineSize); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if format.JournalSize < 0 {
+		logger.Fatalf("invalid journal size: %d", format.JournalSize)
+	}
+	if bs := c.Int("block-size"); bs != format.BlockSize {
+		logger.Warnf("Block size %d KiB is changed to %d KiB, it should be a power of two between 64 KiB and 16 MiB", bs, format.BlockSize)
 	}
 	if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 		format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -205,9 +281,17 @@ func format(c *cli.Context) error {
 			logger.Fatalf("load RSA key from %s: %s", keyPath, err)
 		}
 		format.EncryptKey = string(pem)
+		if format.InlineSize > 0 {
+			logger.Fatalf("--inline-size can't be used with --encrypt-rsa-key, the data in meta engine would not be encrypted")
+		}
 	}
 
-	blob, err := createStorage(&format)
+	sconf, err := newStorageConfig(c)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(&format, sconf)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
@@ -218,6 +302,20 @@ func format(c *cli.Context) error {
 		}
 	}
 
+	if old, err := m.Load(); err == nil {
+		if format.KeyPrefixes > 0 && format.KeyPrefixes != old.KeyPrefixes {
+			// the existing blocks would not be found with the prefixes
+			logger.Fatalf("Key prefixes of an existing volume can only be enabled by `juicefs config`")
+		}
+		format.KeyPrefixes, format.PrefixedFrom = old.KeyPrefixes, old.PrefixedFrom // keep the keys of existing blocks
+		// the stamped xattrs can't be read without the checksum
+		format.XattrChecksum = format.XattrChecksum || old.XattrChecksum
+		if c.IsSet("inline-size") && format.InlineSize != old.InlineSize {
+			// the inline slices would be read from object storage with a different one
+			logger.Fatalf("Inline size of an existing volume can't be changed (%d)", old.InlineSize)
+		}
+		format.InlineSize = old.InlineSize
+	}
 	if !c.Bool("force") && format.Compression == "none" { // default
 		if old, err := m.Load(); err == nil && old.Compression == "lz4" { // lz4 is the previous default algr
 			format.Compression = old.Compression // keep the existing default compress algr
@@ -232,6 +330,22 @@ func format(c *cli.Context) error {
 	return nil
 }
 
+// checkKeyPrefixes checks the number of hashed prefixes of keys, 0 means no prefix.
+func checkKeyPrefixes(n int) error {
+	if n != 0 && (n < 2 || n > 4096) {
+		return fmt.Errorf("invalid number of key prefixes: %d, it should be between 2 and 4096", n)
+	}
+	return nil
+}
+
+// checkInlineSize checks the max size of the slices stored in meta engine, 0 means none.
+func checkInlineSize(n int) error {
+	if n < 0 || n > chunk.MaxInlineSize {
+		return fmt.Errorf("invalid inline size: %d, it should be between 0 and %d", n, chunk.MaxInlineSize)
+	}
+	return nil
+}
+
 func formatFlags() *cli.Command {
 	var defaultBucket string
 	switch runtime.GOOS {
@@ -250,11 +364,11 @@ func formatFlags() *cli.Command {
 		Name:      "format",
 		Usage:     "format a volume",
 		ArgsUsage: "META-URL NAME",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.IntFlag{
 				Name:  "block-size",
 				Value: 4096,
-				Usage: "size of block in KiB",
+				Usage: "size of block in KiB, a power of two between 64 and 16384, can not be changed after formatted",
 			},
 			&cli.Uint64Flag{
 				Name:  "capacity",
@@ -271,11 +385,31 @@ func formatFlags() *cli.Command {
 				Value: "none",
 				Usage: "compression algorithm (lz4, zstd, none)",
 			},
+			&cli.BoolFlag{
+				Name:  "tag-codec",
+				Usage: "store the id of compression codec in every block, so the compression can be changed by `juicefs config` later (the volume can't be used by old clients)",
+			},
 			&cli.IntFlag{
 				Name:  "shards",
 				Value: 0,
 				Usage: "store the blocks into N buckets by hash of key",
 			},
+			&cli.IntFlag{
+				Name:  "key-prefixes",
+				Usage: "spread the blocks across N hashed key prefixes (2 to 4096) to avoid hot partitions of object storage (the volume can't be used by old clients)",
+			},
+			&cli.BoolFlag{
+				Name:  "xattr-checksum",
+				Usage: "store a checksum with the value of every xattr to detect the corruption in meta engine (the volume can't be used by old clients)",
+			},
+			&cli.IntFlag{
+				Name:  "journal-size",
+				Usage: "keep the latest N changes in a journal in meta engine for 'juicefs watch' to tail (0 means disabled)",
+			},
+			&cli.IntFlag{
+				Name:  "inline-size",
+				Usage: "store the data of the slices up to this size (in bytes, at most 65536) in meta engine instead of object storage, can not be changed after formatted (the volume can't be used by old clients)",
+			},
 			&cli.StringFlag{
 				Name:  "storage",
 				Value: "file",
@@ -312,7 +446,7 @@ func formatFlags() *cli.Command {
 				Name:  "no-update",
 				Usage: "don't update existing volume",
 			},
-		},
+		}, storageFlags()...),
 		Action: format,
 	}
 }
@@ -37,6 +37,20 @@ func checkFlags() *cli.Command {
 		Usage:     "Check consistency of file system",
 		ArgsUsage: "META-URL",
 		Action:    fsck,
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "reparent",
+				Usage: "link the orphaned inodes (no entry refers to them) into /" + meta.LostFoundName,
+			},
+			&cli.BoolFlag{
+				Name:  "fix-nlink",
+				Usage: "recompute the nlink of all directories (2 plus the number of subdirectories) and fix the wrong ones",
+			},
+			&cli.BoolFlag{
+				Name:  "xattrs",
+				Usage: "verify the checksums of all xattrs (stamped with --xattr-checksum) to find the corrupted ones",
+			},
+		}, storageFlags()...),
 	}
 }
 
@@ -51,10 +65,25 @@ func fsck(ctx *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if ctx.Bool("reparent") {
+		reparent(m)
+	}
+	if ctx.Bool("fix-nlink") {
+		fixNlink(m)
+	}
+	var corrupted int
+	if ctx.Bool("xattrs") {
+		if !format.XattrChecksum {
+			logger.Warnf("The xattrs are not stamped with checksum, enable it by `juicefs config --xattr-checksum`")
+		}
+		corrupted = checkXattrs(m)
+	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		KeyPrefixes:  format.KeyPrefixes,
+		PrefixedFrom: format.PrefixedFrom,
 
 		GetTimeout: time.Second * 60,
 		PutTimeout: time.Second * 60,
@@ -63,21 +92,42 @@ func fsck(ctx *cli.Context) error {
 		CacheDir:   "memory",
 	}
 
-	blob, err := createStorage(format)
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
 	blob = object.WithPrefix(blob, "chunks/")
+
+	// List all slices in metadata engine
+	progress := utils.NewProgress(false, false)
+	sliceCSpin := progress.AddCountSpinner("Listed slices")
+	var c = meta.NewContext(0, 0, []uint32{0})
+	slices := make(map[meta.Ino][]meta.Slice)
+	r := m.ListSlices(c, slices, false, sliceCSpin.Increment)
+	if r != 0 {
+		logger.Fatalf("list all slices: %s", r)
+	}
+	sliceCSpin.Done()
+	sizes := make(map[uint64]uint32)
+	for _, ss := range slices {
+		for _, s := range ss {
+			sizes[s.Chunkid] = s.Size
+		}
+	}
+
+	// Find all blocks in object storage, only the ones used by slices are remembered
 	objs, err := osync.ListAll(blob, "", "")
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
-
-	// Find all blocks in object storage
-	progress := utils.NewProgress(false, false)
 	blockDSpin := progress.AddDoubleSpinner("Found blocks")
-	var blocks = make(map[string]int64)
+	blocks := make(blockSet)
 	for obj := range objs {
 		if obj == nil {
 			break // failed listing
@@ -87,13 +137,14 @@ func fsck(ctx *cli.Context) error {
 		}
 
 		logger.Debugf("found block %s", obj.Key())
-		parts := strings.Split(obj.Key(), "/")
-		if len(parts) != 3 {
+		blockDSpin.IncrInt64(obj.Size())
+		cid, indx, size, ok := parseBlock(obj.Key())
+		if !ok {
 			continue
 		}
-		name := parts[2]
-		blocks[name] = obj.Size()
-		blockDSpin.IncrInt64(obj.Size())
+		if ssize, ok := sizes[cid]; ok && matchSlice(indx, size, chunkConf.BlockSize, ssize) {
+			blocks.add(cid, indx)
+		}
 	}
 	blockDSpin.Done()
 	if progress.Quiet {
@@ -101,31 +152,27 @@ func fsck(ctx *cli.Context) error {
 		logger.Infof("Found %d blocks (%d bytes)", c, b)
 	}
 
-	// List all slices in metadata engine
-	sliceCSpin := progress.AddCountSpinner("Listed slices")
-	var c = meta.NewContext(0, 0, []uint32{0})
-	slices := make(map[meta.Ino][]meta.Slice)
-	r := m.ListSlices(c, slices, false, sliceCSpin.Increment)
-	if r != 0 {
-		logger.Fatalf("list all slices: %s", r)
-	}
-	sliceCSpin.Done()
-
 	// Scan all slices to find lost blocks
 	sliceCBar := progress.AddCountBar("Scanned slices", sliceCSpin.Current())
 	sliceBSpin := progress.AddByteSpinner("Scanned slices")
 	lostDSpin := progress.AddDoubleSpinner("Lost blocks")
 	brokens := make(map[meta.Ino]string)
+	layout := keyLayout(format)
 	for inode, ss := range slices {
 		for _, s := range ss {
+			if isInline(m, format, s) { // no block
+				sliceCBar.Increment()
+				sliceBSpin.IncrInt64(int64(s.Size))
+				continue
+			}
 			n := (s.Size - 1) / uint32(chunkConf.BlockSize)
 			for i := uint32(0); i <= n; i++ {
 				sz := chunkConf.BlockSize
 				if i == n {
 					sz = int(s.Size) - int(i)*chunkConf.BlockSize
 				}
-				key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
-				if _, ok := blocks[key]; !ok {
+				if !blocks.has(s.Chunkid, int(i)) {
+					key := blockKey(layout, s.Chunkid, int(i), sz)
 					if _, err := blob.Head(key); err != nil {
 						if _, ok := brokens[inode]; !ok {
 							if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
@@ -159,6 +206,66 @@ func fsck(ctx *cli.Context) error {
 		msg += strings.Join(fileList, "\n")
 		logger.Fatal(msg)
 	}
-
+	if corrupted > 0 {
+		return fmt.Errorf("%d xattrs are corrupted", corrupted)
+	}
 	return nil
 }
+
+// isInline tells whether the data of slice s is stored in the metadata engine instead of blocks.
+func isInline(m meta.Meta, format *meta.Format, s meta.Slice) bool {
+	if int(s.Size) > format.InlineSize {
+		return false
+	}
+	var data []byte
+	return m.GetSliceData(meta.Background, s.Chunkid, &data) == 0
+}
+
+// checkXattrs logs the corrupted xattrs with the paths of their files, and returns the number of them.
+func checkXattrs(m meta.Meta) int {
+	corrupted := make(map[meta.Ino][]string)
+	if st := m.CheckXattrs(meta.Background, corrupted); st != 0 {
+		logger.Fatalf("check xattrs: %s", st)
+	}
+	var n int
+	for inode, names := range corrupted {
+		p, st := meta.GetPath(m, meta.Background, inode)
+		if st != 0 {
+			p = st.Error()
+		}
+		sort.Strings(names)
+		logger.Errorf("Corrupted xattrs of inode %d (%s): %s", inode, p, strings.Join(names, ", "))
+		n += len(names)
+	}
+	logger.Infof("Found %d corrupted xattrs of %d files", n, len(corrupted))
+	return n
+}
+
+func fixNlink(m meta.Meta) {
+	fixed := make(map[meta.Ino][2]uint32)
+	st := m.FixNlink(meta.Background, fixed)
+	for inode, n := range fixed {
+		p, e := meta.GetPath(m, meta.Background, inode)
+		if e != 0 {
+			p = e.Error()
+		}
+		logger.Infof("Fixed nlink of directory %d (%s): %d -> %d", inode, p, n[0], n[1])
+	}
+	logger.Infof("Fixed nlink of %d directories", len(fixed))
+	if st != 0 {
+		logger.Fatalf("fix nlink: %s", st)
+	}
+}
+
+func reparent(m meta.Meta) {
+	var recovered []*meta.Entry
+	st := m.Reparent(meta.Background, &recovered)
+	var total uint64
+	for _, e := range recovered {
+		total += e.Attr.Length
+	}
+	logger.Infof("Recovered %d orphaned inodes (%d bytes) into /%s", len(recovered), total, meta.LostFoundName)
+	if st != 0 {
+		logger.Fatalf("reparent orphaned inodes: %s", st)
+	}
+}
@@ -66,7 +66,11 @@ func gatewayFlags() *cli.Command {
 		&cli.StringFlag{
 			Name:  "metrics",
 			Value: "127.0.0.1:9567",
-			Usage: "address to export metrics",
+			Usage: "address to export metrics and health checks (/healthz and /readyz)",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-labels",
+			Usage: "static labels attached to all the metrics, in format of key=value,key2=value2 (at most 10)",
 		},
 		&cli.StringFlag{
 			Name:  "consul",
@@ -85,9 +89,63 @@ func gatewayFlags() *cli.Command {
 			Name:  "multi-buckets",
 			Usage: "use top level of directories as buckets",
 		},
+		&cli.StringFlag{
+			Name:  "buckets",
+			Usage: "only serve these top-level directories as buckets with --multi-buckets, separated by comma (default: all of them, including the new ones)",
+		},
 		&cli.BoolFlag{
 			Name:  "keep-etag",
 			Usage: "keep the ETag for uploaded objects",
+		},
+		&cli.StringFlag{
+			Name:  "default-content-type",
+			Value: jfsgateway.DefaultContentType,
+			Usage: "content type of the objects without one (kept in xattr user.jfs.content-type) or a known extension",
+		},
+		&cli.Int64Flag{
+			Name:  "max-put-size",
+			Usage: "max size in MiB of the objects uploaded in a single PUT, the larger ones should use multipart uploads (0 means unlimited)",
+		},
+		&cli.Int64Flag{
+			Name:  "max-object-size",
+			Usage: "max size in MiB of the objects, including the ones completed from multipart uploads (0 means unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "bucket-limits",
+			Usage: "limits of the sizes of objects in some buckets, in the format of BUCKET:MAX-PUT-SIZE[:MAX-OBJECT-SIZE] separated by comma, the empty ones are taken from --max-put-size and --max-object-size",
+		},
+		&cli.Float64Flag{
+			Name:  "max-requests",
+			Usage: "max number of requests per second from all the clients (0 means unlimited)",
+		},
+		&cli.Float64Flag{
+			Name:  "max-requests-per-key",
+			Usage: "max number of requests per second from every access key (0 means unlimited)",
+		},
+		&cli.IntFlag{
+			Name:  "max-connections",
+			Usage: "max number of concurrent connections (0 means unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "website",
+			Usage: "serve buckets as static websites for anonymous reads, in the format of BUCKET[:INDEX[:ERROR]] separated by comma",
+		},
+		&cli.StringFlag{
+			Name:  "compress-types",
+			Usage: "compress the GET responses of these content types by gzip for the clients accepting it, separated by comma (e.g. text/*,application/json)",
+		},
+		&cli.IntFlag{
+			Name:  "compress-min-size",
+			Value: 1024,
+			Usage: "min size in bytes of the responses to be compressed",
+		},
+		&cli.BoolFlag{
+			Name:  "object-lock",
+			Usage: "serve the retention of objects (S3 Object Lock), the locked objects can't be overwritten or deleted until the retain-until date",
+		},
+		&cli.StringFlag{
+			Name:  "region",
+			Usage: "region of the buckets, returned by GetBucketLocation and HeadBucket, the requests should be signed with it (default: any region is accepted)",
 		})
 	return &cli.Command{
 		Name:      "gateway",
@@ -120,8 +178,40 @@ func gateway(c *cli.Context) error {
 		logger.Fatalf("MINIO_ROOT_PASSWORD should be specified as an environment variable with at least 8 characters")
 	}
 
+	if region := c.String("region"); region != "" {
+		// MinIO loads the region from the environment when it starts
+		os.Setenv("MINIO_REGION", region)
+	}
+
+	sconf, err := newStorageConfig(c)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
 	address := c.Args().Get(1)
-	gw = &GateWay{c}
+	gw = &GateWay{ctx: c, storage: sconf}
+	limits := jfsgateway.LimitConfig{
+		MaxRequests:       c.Float64("max-requests"),
+		MaxRequestsPerKey: c.Float64("max-requests-per-key"),
+		MaxConnections:    c.Int("max-connections"),
+	}
+	sites, err := jfsgateway.ParseWebsites(c.String("website"))
+	if err != nil {
+		logger.Fatalf("website: %s", err)
+	}
+	compress := jfsgateway.CompressConfig{
+		Types:   jfsgateway.ParseCompressTypes(c.String("compress-types")),
+		MinSize: int64(c.Int("compress-min-size")),
+	}
+	if c.Bool("object-lock") {
+		gw.lock = jfsgateway.NewObjectLock(ak, sk)
+	}
+	if limits.Enabled() || len(sites) > 0 || compress.Enabled() || gw.lock != nil {
+		// the requests are checked before they are forwarded to the S3 server on a local address
+		if gw.limiter, address, err = jfsgateway.ServeWithLimits(address, limits, sites, compress, gw.lock); err != nil {
+			logger.Fatalf("listen on %s: %s", c.Args().Get(1), err)
+		}
+	}
 
 	args := []string{"gateway", "--address", address, "--anonymous"}
 	if c.Bool("no-banner") {
@@ -160,7 +250,10 @@ func gateway2(ctx *mcli.Context) error {
 }
 
 type GateWay struct {
-	ctx *cli.Context
+	ctx     *cli.Context
+	storage *storageConfig
+	limiter *jfsgateway.Limiter
+	lock    *jfsgateway.ObjectLock
 }
 
 func (g *GateWay) Name() string {
@@ -176,39 +269,66 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	addr := c.Args().Get(0)
 	removePassword(addr)
 	m := meta.NewClient(addr, &meta.Config{
-		Retries:    10,
-		Strict:     true,
-		ReadOnly:   c.Bool("read-only"),
-		OpenCache:  time.Duration(c.Float64("open-cache") * 1e9),
-		MountPoint: "s3gateway",
-		Subdir:     c.String("subdir"),
-		MaxDeletes: c.Int("max-deletes"),
+		Retries:         10,
+		Strict:          true,
+		ReadOnly:        c.Bool("read-only"),
+		OpenCache:       time.Duration(c.Float64("open-cache") * 1e9),
+		MountPoint:      "s3gateway",
+		Subdir:          c.String("subdir"),
+		MaxDeletes:      c.Int("max-deletes"),
+		AuditLog:        c.String("audit-log"),
+		AuditBuffer:     c.Int("audit-buffer"),
+		Consistency:     checkConsistency(c.String("consistency")),
+		AtimeMode:       atimeMode(c),
+		CompactSlices:   c.Int("compact-slices"),
+		CompactBytes:    uint64(c.Int("compact-size")) << 20,
+		TxnRetries:      c.Int("txn-retries"),
+		Replica:         c.String("meta-replica"),
+		ListConsistency: checkListConsistency(c),
+		MaxStaleness:    c.Duration("max-staleness"),
 	})
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
-	wrapRegister("s3gateway", format.Name)
+	labels, err := parseMetricsLabels(c.String("metrics-labels"))
+	if err != nil {
+		logger.Fatalf("metrics labels: %s", err)
+	}
+	wrapRegister("s3gateway", format.Name, labels)
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		KeyPrefixes:  format.KeyPrefixes,
+		PrefixedFrom: format.PrefixedFrom,
 
-		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
-		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
-		MaxUpload:     c.Int("max-uploads"),
-		Writeback:     c.Bool("writeback"),
-		Prefetch:      c.Int("prefetch"),
-		BufferSize:    c.Int("buffer-size") << 20,
-		UploadLimit:   c.Int64("upload-limit") * 1e6 / 8,
-		DownloadLimit: c.Int64("download-limit") * 1e6 / 8,
+		GetTimeout:      time.Second * time.Duration(c.Int("get-timeout")),
+		GetParts:        c.Int("get-parts"),
+		GetThreshold:    int64(c.Int("get-parts-threshold")) << 20,
+		CoalesceGap:     int64(c.Int("read-coalesce-gap")) << 10,
+		CoalesceWait:    c.Duration("read-coalesce-wait"),
+		PutTimeout:      time.Second * time.Duration(c.Int("put-timeout")),
+		MaxUpload:       c.Int("max-uploads"),
+		MaxUploadBuffer: int64(c.Int("max-upload-buffer")) << 20,
+		Writeback:       c.Bool("writeback"),
+		PutIfAbsent:     c.Bool("put-if-absent"),
+		Prefetch:        c.Int("prefetch"),
+		BufferSize:      c.Int("buffer-size") << 20,
+		UploadLimit:     c.Int64("upload-limit") * 1e6 / 8,
+		DownloadLimit:   c.Int64("download-limit") * 1e6 / 8,
 
 		CacheDir:       c.String("cache-dir"),
 		CacheSize:      int64(c.Int("cache-size")),
 		FreeSpace:      float32(c.Float64("free-space-ratio")),
 		CacheMode:      os.FileMode(0600),
 		CacheFullBlock: !c.Bool("cache-partial-only"),
+		CacheScanMode:  c.String("cache-scan-mode"),
 		AutoCreate:     true,
+
+		CacheErrorPolicy:    checkCacheErrorPolicy(c.String("cache-error-policy")),
+		CacheErrorThreshold: c.Int("cache-error-threshold"),
+		VerifyChecksums:     c.Bool("verify-checksums"),
 	}
 	if chunkConf.CacheDir != "memory" {
 		ds := utils.SplitDir(chunkConf.CacheDir)
@@ -220,12 +340,14 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	if c.IsSet("bucket") {
 		format.Bucket = c.String("bucket")
 	}
-	blob, err := createStorage(format)
+	blob, err := createStorage(format, g.storage)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
 
+	setChecksums(&chunkConf, m)
+	setInline(&chunkConf, m, format)
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
 		chunkid := args[0].(uint64)
@@ -253,9 +375,19 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		DirEntryTimeout: time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000),
 		AccessLog:       c.String("access-log"),
 		Chunk:           &chunkConf,
+		ReadTimeout:     time.Second * time.Duration(c.Int("read-timeout")),
+		InodeCacheSize:  c.Int("inode-cache-size"),
+		InodeCacheTTL:   time.Millisecond * time.Duration(c.Float64("inode-cache-ttl")*1000),
+
+		WriteCombine:     c.Duration("write-combine"),
+		WriteCombineSize: c.Int("write-combine-size") << 20,
 	}
 
 	metricsAddr := exposeMetrics(m, c)
+	registerHealth(m, blob)
+	if g.limiter != nil {
+		g.limiter.InitMetrics()
+	}
 	if c.IsSet("consul") {
 		metric.RegisterToConsul(c.String("consul"), metricsAddr, "s3gateway")
 	}
@@ -265,5 +397,28 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	if !c.Bool("no-usage-report") {
 		go usage.ReportUsage(m, "gateway "+version.Version())
 	}
-	return jfsgateway.NewJFSGateway(conf, m, store, c.Bool("multi-buckets"), c.Bool("keep-etag"))
+	var buckets []string
+	for _, b := range strings.Split(c.String("buckets"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			buckets = append(buckets, b)
+		}
+	}
+	if len(buckets) > 0 && !c.Bool("multi-buckets") {
+		logger.Fatalf("--buckets can only be used with --multi-buckets")
+	}
+	if c.Int64("max-put-size") < 0 || c.Int64("max-object-size") < 0 {
+		logger.Fatalf("--max-put-size and --max-object-size should not be negative")
+	}
+	limits, err := jfsgateway.ParseLimits(c.String("bucket-limits"), jfsgateway.Limits{
+		MaxPutSize:    c.Int64("max-put-size") << 20,
+		MaxObjectSize: c.Int64("max-object-size") << 20,
+	})
+	if err != nil {
+		logger.Fatalf("--bucket-limits: %s", err)
+	}
+	layer, err := jfsgateway.NewJFSGateway(conf, m, store, c.Bool("multi-buckets"), c.Bool("keep-etag"), c.String("default-content-type"), buckets, limits)
+	if err == nil && g.lock != nil {
+		g.lock.SetStore(layer.(jfsgateway.RetentionStore))
+	}
+	return layer, err
 }
@@ -0,0 +1,340 @@
+//go:build !nogateway
+// +build !nogateway
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close()
+	return address
+}
+
+// startGateway returns the addresses of gateway and metrics.
+func startGateway(t *testing.T, args ...string) (string, string) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "gateway.db")
+	if err := Main([]string{"", "format", "--bucket", t.TempDir(), metaUrl, testVolume}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	address, metrics := freeAddress(t), freeAddress(t)
+
+	os.Setenv("MINIO_ROOT_USER", "testUser")
+	os.Setenv("MINIO_ROOT_PASSWORD", "testUserPassword")
+	ResetPrometheus()
+	// the requests go through the limiter, which should keep the Host header for the signatures
+	go func() {
+		_ = Main(append(append([]string{"", "gateway", "--no-banner", "--no-usage-report", "--cache-dir", "memory",
+			"--metrics", metrics, "--max-requests-per-key", "1000"}, args...), metaUrl, address))
+	}()
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get("http://" + address + "/minio/health/ready"); err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return address, metrics
+			}
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatalf("gateway is not ready on %s", address)
+	return "", ""
+}
+
+func s3Client(t *testing.T, address, ak, sk string) *s3.S3 {
+	return s3RegionClient(t, address, "us-east-1", ak, sk)
+}
+
+func s3RegionClient(t *testing.T, address, region, ak, sk string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(region),
+		Endpoint:         aws.String("http://" + address),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials(ak, sk, ""),
+	})
+	if err != nil {
+		t.Fatalf("create session: %s", err)
+	}
+	return s3.New(sess)
+}
+
+func doPresigned(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestGatewayPresignedURL(t *testing.T) {
+	address, _ := startGateway(t)
+	client := s3Client(t, address, "testUser", "testUserPassword")
+
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(testVolume), Key: aws.String("dir/file")})
+	url, err := req.Presign(time.Minute)
+	if err != nil {
+		t.Fatalf("presign put: %s", err)
+	}
+	if code, body := doPresigned(t, "PUT", url, "hello"); code != http.StatusOK {
+		t.Fatalf("presigned put: %d %s", code, body)
+	}
+
+	req, _ = client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(testVolume), Key: aws.String("dir/file")})
+	url, err = req.Presign(time.Minute)
+	if err != nil {
+		t.Fatalf("presign get: %s", err)
+	}
+	if code, body := doPresigned(t, "GET", url, ""); code != http.StatusOK || body != "hello" {
+		t.Fatalf("presigned get: %d %s", code, body)
+	}
+	// the signature covers the object key and the method
+	if code, _ := doPresigned(t, "GET", strings.Replace(url, "dir/file", "dir/other", 1), ""); code != http.StatusForbidden {
+		t.Fatalf("presigned get of another object: %d", code)
+	}
+	if code, _ := doPresigned(t, "DELETE", url, ""); code != http.StatusForbidden {
+		t.Fatalf("presigned get used for delete: %d", code)
+	}
+	if code, body := doPresigned(t, "GET", url+"0", ""); code != http.StatusForbidden || !strings.Contains(body, "SignatureDoesNotMatch") {
+		t.Fatalf("tampered signature: %d %s", code, body)
+	}
+
+	req, _ = client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(testVolume), Key: aws.String("dir/file")})
+	url, _ = req.Presign(time.Second)
+	time.Sleep(time.Second * 2)
+	if code, body := doPresigned(t, "GET", url, ""); code != http.StatusForbidden || !strings.Contains(body, "expired") {
+		t.Fatalf("expired presigned get: %d %s", code, body)
+	}
+
+	// signed by unknown key
+	other := s3Client(t, address, "otherUser", "otherUserPassword")
+	req, _ = other.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(testVolume), Key: aws.String("dir/file")})
+	url, _ = req.Presign(time.Minute)
+	if code, body := doPresigned(t, "GET", url, ""); code != http.StatusForbidden || !strings.Contains(body, "InvalidAccessKeyId") {
+		t.Fatalf("presigned get by unknown key: %d %s", code, body)
+	}
+}
+
+func TestGatewayDeleteObjects(t *testing.T) {
+	address, _ := startGateway(t)
+	client := s3Client(t, address, "testUser", "testUserPassword")
+	put := func(keys ...string) {
+		for _, key := range keys {
+			if _, err := client.PutObject(&s3.PutObjectInput{Bucket: aws.String(testVolume), Key: aws.String(key), Body: strings.NewReader(key)}); err != nil {
+				t.Fatalf("put %s: %s", key, err)
+			}
+		}
+	}
+	del := func(quiet bool, keys ...string) *s3.DeleteObjectsOutput {
+		var ids []*s3.ObjectIdentifier
+		for _, key := range keys {
+			ids = append(ids, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := client.DeleteObjects(&s3.DeleteObjectsInput{Bucket: aws.String(testVolume), Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(quiet)}})
+		if err != nil {
+			t.Fatalf("delete objects: %s", err)
+		}
+		return out
+	}
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("dir/%d/obj", i))
+	}
+	put(append(keys, "a", "f")...)
+
+	// the missing objects are reported as deleted, as S3
+	out := del(false, append(keys, "a", "missing", "dir/missing", "f/x")...)
+	var deleted []string
+	for _, d := range out.Deleted {
+		deleted = append(deleted, *d.Key)
+	}
+	if len(deleted) != 104 || len(out.Errors) != 0 {
+		t.Fatalf("deleted %d: %v, errors: %v", len(deleted), deleted, out.Errors)
+	}
+	for _, key := range []string{"a", "dir/0/obj", "dir/99/obj", "missing"} {
+		if !strings.Contains(fmt.Sprint(deleted), key) {
+			t.Fatalf("%s is not deleted: %v", key, deleted)
+		}
+	}
+	list, err := client.ListObjects(&s3.ListObjectsInput{Bucket: aws.String(testVolume)})
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	// the empty directories are removed too
+	if len(list.Contents) != 1 || *list.Contents[0].Key != "f" {
+		t.Fatalf("objects left: %v", list.Contents)
+	}
+
+	put("b", "c")
+	if out = del(true, "b", "c", "missing"); len(out.Deleted) != 0 || len(out.Errors) != 0 {
+		t.Fatalf("quiet mode should not report the deleted ones: %v %v", out.Deleted, out.Errors)
+	}
+	if _, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testVolume), Key: aws.String("b")}); err == nil {
+		t.Fatalf("b should be deleted")
+	}
+}
+
+func TestGatewayBucket(t *testing.T) {
+	address, _ := startGateway(t, "--region", "cn-test-1")
+	defer os.Unsetenv("MINIO_REGION")
+	client := s3RegionClient(t, address, "cn-test-1", "testUser", "testUserPassword")
+	if err := client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(testVolume)}); err != nil {
+		t.Fatalf("wait for bucket: %s", err)
+	}
+	req, _ := client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(testVolume)})
+	if err := req.Send(); err != nil {
+		t.Fatalf("head bucket: %s", err)
+	}
+	if region := req.HTTPResponse.Header.Get("X-Amz-Bucket-Region"); region != "cn-test-1" {
+		t.Fatalf("region of bucket: %q", region)
+	}
+	req, _ = client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String("other-bucket")})
+	if err := req.Send(); err == nil || req.HTTPResponse.StatusCode != http.StatusNotFound {
+		t.Fatalf("head other bucket: %s", err)
+	} else if region := req.HTTPResponse.Header.Get("X-Amz-Bucket-Region"); region != "cn-test-1" {
+		t.Fatalf("region of missing bucket: %q", region)
+	}
+	out, err := client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(testVolume)})
+	if err != nil || out.LocationConstraint == nil || *out.LocationConstraint != "cn-test-1" {
+		t.Fatalf("bucket location: %v %s", out, err)
+	}
+	if _, err = client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String("other-bucket")}); err == nil {
+		t.Fatalf("location of other bucket should fail")
+	}
+}
+
+func TestGatewayContentType(t *testing.T) {
+	address, _ := startGateway(t, "--default-content-type", "application/x-unknown")
+	client := s3Client(t, address, "testUser", "testUserPassword")
+	head := func(key string) string {
+		out, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(testVolume), Key: aws.String(key)})
+		if err != nil {
+			t.Fatalf("head %s: %s", key, err)
+		}
+		return aws.StringValue(out.ContentType)
+	}
+	for key, typ := range map[string]string{"ct/readme": "text/markdown", "ct/a.json": "", "ct/b": ""} {
+		in := &s3.PutObjectInput{Bucket: aws.String(testVolume), Key: aws.String(key), Body: strings.NewReader(key)}
+		if typ != "" {
+			in.ContentType = aws.String(typ)
+		}
+		if _, err := client.PutObject(in); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	if typ := head("ct/readme"); typ != "text/markdown" {
+		t.Fatalf("uploaded content type: %s", typ)
+	}
+	if typ := head("ct/a.json"); typ != "application/json" {
+		t.Fatalf("content type by extension: %s", typ)
+	}
+	if typ := head("ct/b"); typ != "application/x-unknown" {
+		t.Fatalf("default content type: %s", typ)
+	}
+	out, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(testVolume), Key: aws.String("ct/readme")})
+	if err != nil || aws.StringValue(out.ContentType) != "text/markdown" {
+		t.Fatalf("get: %v %v", out, err)
+	}
+	_ = out.Body.Close()
+
+	src := aws.String(testVolume + "/ct/readme")
+	if _, err = client.CopyObject(&s3.CopyObjectInput{Bucket: aws.String(testVolume), Key: aws.String("ct/copied"), CopySource: src}); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if typ := head("ct/copied"); typ != "text/markdown" {
+		t.Fatalf("copied content type: %s", typ)
+	}
+	if _, err = client.CopyObject(&s3.CopyObjectInput{Bucket: aws.String(testVolume), Key: aws.String("ct/readme"), CopySource: src,
+		MetadataDirective: aws.String("REPLACE"), ContentType: aws.String("text/plain")}); err != nil {
+		t.Fatalf("replace metadata: %s", err)
+	}
+	if typ := head("ct/readme"); typ != "text/plain" {
+		t.Fatalf("replaced content type: %s", typ)
+	}
+}
+
+func TestGatewayHealth(t *testing.T) {
+	_, metrics := startGateway(t)
+	if code, body := doPresigned(t, "GET", "http://"+metrics+"/healthz", ""); code != http.StatusOK {
+		t.Fatalf("healthz: %d %s", code, body)
+	}
+	code, body := doPresigned(t, "GET", "http://"+metrics+"/readyz", "")
+	var s healthStatus
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatalf("readyz %q: %s", body, err)
+	}
+	if code != http.StatusOK || !s.Healthy || !s.Deps["meta"].Healthy || !s.Deps["object"].Healthy {
+		t.Fatalf("readyz: %d %s", code, body)
+	}
+}
+
+type brokenStorage struct {
+	object.ObjectStorage
+}
+
+func (s *brokenStorage) Head(key string) (object.Object, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestHealthChecker(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "health.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	blob, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	h := &healthChecker{m: m, blob: &brokenStorage{blob}}
+	s := h.check()
+	if s.Healthy || !s.Deps["meta"].Healthy || s.Deps["object"].Healthy || s.Deps["object"].Error != "connection refused" {
+		t.Fatalf("unexpected status: %+v %+v %+v", s, s.Deps["meta"], s.Deps["object"])
+	}
+	h.blob = blob
+	if s2 := h.check(); s2 != s {
+		t.Fatalf("status should be cached")
+	}
+	h.expire = time.Now()
+	if s = h.check(); !s.Healthy {
+		t.Fatalf("should be healthy: %+v %+v %+v", s, s.Deps["meta"], s.Deps["object"])
+	}
+}
@@ -40,7 +40,7 @@ func gcFlags() *cli.Command {
 		Usage:     "collect any leaked objects",
 		ArgsUsage: "META-URL",
 		Action:    gc,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.BoolFlag{
 				Name:  "delete",
 				Usage: "deleted leaked objects",
@@ -54,10 +54,13 @@ func gcFlags() *cli.Command {
 				Value: 10,
 				Usage: "number threads to delete leaked objects",
 			},
-		},
+		}, storageFlags()...),
 	}
 }
 
+// gcDeleteBatch is the number of leaked objects deleted in one request.
+const gcDeleteBatch = 1000
+
 type dChunk struct {
 	chunkid uint64
 	length  uint32
@@ -80,8 +83,10 @@ func gc(ctx *cli.Context) error {
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		KeyPrefixes:  format.KeyPrefixes,
+		PrefixedFrom: format.PrefixedFrom,
 
 		GetTimeout: time.Second * 60,
 		PutTimeout: time.Second * 60,
@@ -90,11 +95,17 @@ func gc(ctx *cli.Context) error {
 		CacheDir:   "memory",
 	}
 
-	blob, err := createStorage(format)
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	setInline(&chunkConf, m, format)
 	store := chunk.NewCachedStore(blob, chunkConf)
 
 	// Scan all chunks first and do compaction if necessary
@@ -187,10 +198,13 @@ func gc(ctx *cli.Context) error {
 	for _, ss := range slices {
 		for _, s := range ss {
 			keys[s.Chunkid] = s.Size
-			total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
+			if int(s.Size) > format.InlineSize { // the inline ones have no object
+				total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
+			}
 			totalBytes += uint64(s.Size)
 		}
 	}
+	slices = nil // only the sizes are needed to scan the objects
 	if progress.Quiet {
 		logger.Infof("using %d slices (%d bytes)", len(keys), totalBytes)
 	}
@@ -215,10 +229,21 @@ func gc(ctx *cli.Context) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for key := range leakedObj {
-				if err := blob.Delete(key); err != nil {
+			batch := make([]string, 0, gcDeleteBatch)
+			deleteBatch := func() {
+				for key, err := range object.DeleteMany(blob, batch) {
 					logger.Warnf("delete %s: %s", key, err)
 				}
+				batch = batch[:0]
+			}
+			for key := range leakedObj {
+				batch = append(batch, key)
+				if len(batch) == gcDeleteBatch {
+					deleteBatch()
+				}
+			}
+			if len(batch) > 0 {
+				deleteBatch()
 			}
 		}()
 	}
@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// healthCacheTime is how long the result of a check is reused, to not overload the dependencies.
+const healthCacheTime = time.Second * 2
+
+type depStatus struct {
+	Healthy  bool     `json:"healthy"`
+	Latency  float64  `json:"latency"` // in seconds
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type healthStatus struct {
+	Healthy bool                  `json:"healthy"`
+	Checked time.Time             `json:"checked"`
+	Deps    map[string]*depStatus `json:"dependencies"`
+}
+
+// healthChecker checks whether the meta engine and object storage are reachable.
+type healthChecker struct {
+	sync.Mutex
+	m      meta.Meta
+	blob   object.ObjectStorage
+	last   *healthStatus
+	expire time.Time
+}
+
+func probe(f func() error) *depStatus {
+	start := time.Now()
+	err := f()
+	s := &depStatus{Healthy: err == nil, Latency: time.Since(start).Seconds()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+func (h *healthChecker) check() *healthStatus {
+	h.Lock()
+	defer h.Unlock()
+	if h.last != nil && time.Now().Before(h.expire) {
+		return h.last
+	}
+	var wg sync.WaitGroup
+	var ms, ds *depStatus
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mh := h.m.CheckHealth()
+		ms = &depStatus{Healthy: mh.Reachable, Latency: mh.Latency.Seconds(), Error: mh.Error, Warnings: mh.Warnings}
+	}()
+	go func() {
+		defer wg.Done()
+		ds = probe(func() error {
+			_, err := h.blob.List("", "", 1)
+			if err != nil && err.Error() == "not supported" {
+				// file, hdfs and sftp can't list objects with a limit
+				if _, err = h.blob.Head("juicefs-health-probe"); os.IsNotExist(err) {
+					err = nil
+				}
+			}
+			return err
+		})
+	}()
+	wg.Wait()
+	h.last = &healthStatus{ms.Healthy && ds.Healthy, time.Now(), map[string]*depStatus{"meta": ms, "object": ds}}
+	h.expire = time.Now().Add(healthCacheTime)
+	return h.last
+}
+
+// registerHealth adds the handlers of liveness (/healthz) and readiness (/readyz) probes.
+func registerHealth(m meta.Meta, blob object.ObjectStorage) {
+	h := &healthChecker{m: m, blob: blob}
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{\"healthy\":true}\n"))
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s := h.check()
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(s)
+	})
+}
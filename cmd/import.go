@@ -0,0 +1,360 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+
+	"github.com/urfave/cli/v2"
+)
+
+func importFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "create files in metadata for the blocks already in object storage, without copying data",
+		ArgsUsage: "META-URL LAYOUT",
+		Action:    importLayout,
+		Description: `
+The LAYOUT is a file of JSON lines, one for every file to be created:
+  {"path": "/dir/file", "size": 100000000, "chunks": [10000001, 10000002], "mode": 420, "mtime": 1650000000}
+The data of every 64 MiB (a chunk) of the file should be uploaded as the blocks of a slice with
+the chunk id in the list, in the same layout as JuiceFS (e.g. chunks/10/10000/10000001_0_4194304),
+with the block size of the volume, without compression or encryption. The chunk ids should be
+larger than the ones used by JuiceFS, they are reserved before creating the files.
+
+Examples:
+# Check the blocks and the paths only
+$ juicefs import redis://localhost layout.jsonl --dry-run
+
+# Create the files
+$ juicefs import redis://localhost layout.jsonl`,
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of threads to check the blocks",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "check the blocks and the paths without creating any file",
+			},
+		}, storageFlags()...),
+	}
+}
+
+// importEntry is a file in the layout, whose data is in existing blocks.
+type importEntry struct {
+	Path   string   `json:"path"`
+	Size   uint64   `json:"size"`
+	Chunks []uint64 `json:"chunks"` // id of the slice for every chunk of the file
+	Mode   uint16   `json:"mode,omitempty"`
+	Mtime  int64    `json:"mtime,omitempty"`
+}
+
+func loadLayout(r io.Reader) ([]*importEntry, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var entries []*importEntry
+	for {
+		var e importEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid layout after %d files: %s", len(entries), err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+// checkLayout checks the paths and chunks of the files, and returns the range of chunk ids.
+func checkLayout(entries []*importEntry) (minid, maxid uint64, err error) {
+	paths := make(map[string]bool)
+	chunks := make(map[uint64]string)
+	for _, e := range entries {
+		p := path.Clean("/" + e.Path)
+		if p == "/" || strings.HasPrefix(p, "/"+meta.TrashName) {
+			return 0, 0, fmt.Errorf("invalid path: %q", e.Path)
+		}
+		if paths[p] {
+			return 0, 0, fmt.Errorf("duplicated path: %s", p)
+		}
+		paths[p] = true
+		e.Path = p
+		if n := (e.Size + meta.ChunkSize - 1) / meta.ChunkSize; uint64(len(e.Chunks)) != n {
+			return 0, 0, fmt.Errorf("%s of %d bytes should have %d chunks, but got %d", p, e.Size, n, len(e.Chunks))
+		}
+		for _, cid := range e.Chunks {
+			if cid == 0 {
+				return 0, 0, fmt.Errorf("invalid chunk id 0 of %s", p)
+			}
+			if o, ok := chunks[cid]; ok {
+				return 0, 0, fmt.Errorf("chunk %d is used by both %s and %s", cid, o, p)
+			}
+			chunks[cid] = p
+			if minid == 0 || cid < minid {
+				minid = cid
+			}
+			if cid > maxid {
+				maxid = cid
+			}
+		}
+	}
+	return
+}
+
+// chunkLen returns the length of the indx-th chunk of a file.
+func chunkLen(size uint64, indx int) uint32 {
+	if l := size - uint64(indx)*meta.ChunkSize; l < meta.ChunkSize {
+		return uint32(l)
+	}
+	return meta.ChunkSize
+}
+
+type importOptions struct {
+	blockSize int
+	layout    *chunk.Config
+	threads   int
+	dryRun    bool
+}
+
+type importReport struct {
+	files   auditCounter
+	skipped auditCounter // existing files
+	dirs    int64
+}
+
+// checkBlocks heads all the blocks (with prefix chunks/) of the files, and returns the number of
+// the missing ones and the ones of wrong size.
+func checkBlocks(blob object.ObjectStorage, entries []*importEntry, opt importOptions, progress *utils.Progress) (missing, mismatched int64) {
+	type block struct {
+		key  string
+		size int
+	}
+	var total int64
+	for _, e := range entries {
+		total += int64((e.Size + uint64(opt.blockSize) - 1) / uint64(opt.blockSize))
+	}
+	bar := progress.AddCountBar("Checked blocks", total)
+	todo := make(chan block, 10240)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < opt.threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range todo {
+				o, err := blob.Head(b.key)
+				mu.Lock()
+				if err != nil {
+					logger.Errorf("Block %s is missing: %s", b.key, err)
+					missing++
+				} else if o.Size() != int64(b.size) {
+					logger.Errorf("Size of block %s is %d, but expect %d", b.key, o.Size(), b.size)
+					mismatched++
+				}
+				mu.Unlock()
+				bar.Increment()
+			}
+		}()
+	}
+	for _, e := range entries {
+		for indx, cid := range e.Chunks {
+			clen := int(chunkLen(e.Size, indx))
+			for i := 0; i*opt.blockSize < clen; i++ {
+				bsize := opt.blockSize
+				if (i+1)*opt.blockSize > clen {
+					bsize = clen - i*opt.blockSize
+				}
+				todo <- block{blockKey(opt.layout, cid, i, bsize), bsize}
+			}
+		}
+	}
+	close(todo)
+	wg.Wait()
+	bar.Done()
+	return
+}
+
+// importFiles creates the files in the layout after all the blocks are checked, the existing files are skipped.
+func importFiles(m meta.Meta, blob object.ObjectStorage, entries []*importEntry, opt importOptions, progress *utils.Progress) (*importReport, error) {
+	minid, maxid, err := checkLayout(entries)
+	if err != nil {
+		return nil, err
+	}
+	if missing, mismatched := checkBlocks(blob, entries, opt, progress); missing+mismatched > 0 {
+		return nil, fmt.Errorf("%d blocks are missing and %d blocks are of wrong size", missing, mismatched)
+	}
+	ctx := meta.Background
+	r := &importReport{}
+	if !opt.dryRun && maxid > 0 {
+		if st := m.ReserveChunks(ctx, minid, maxid); st != 0 {
+			return nil, fmt.Errorf("reserve chunk ids [%d, %d]: %s", minid, maxid, st)
+		}
+	}
+
+	dirs := map[string]meta.Ino{"/": meta.Ino(1)}
+	var mkdirs func(p string) (meta.Ino, syscall.Errno)
+	mkdirs = func(p string) (meta.Ino, syscall.Errno) {
+		if ino, ok := dirs[p]; ok {
+			return ino, 0
+		}
+		parent, st := mkdirs(path.Dir(p))
+		if st != 0 {
+			return 0, st
+		}
+		var ino meta.Ino
+		var attr meta.Attr
+		if st = m.Lookup(ctx, parent, path.Base(p), &ino, &attr); st == syscall.ENOENT {
+			if opt.dryRun {
+				ino = 0 // created later
+			} else if st = m.Mkdir(ctx, parent, path.Base(p), 0755, 0, 0, &ino, &attr); st == 0 {
+				r.dirs++
+			}
+		} else if st == 0 && attr.Typ != meta.TypeDirectory {
+			st = syscall.ENOTDIR
+		}
+		if st != 0 && !(opt.dryRun && st == syscall.ENOENT) {
+			return 0, st
+		}
+		dirs[p] = ino
+		return ino, 0
+	}
+
+	bar := progress.AddCountBar("Imported files", int64(len(entries)))
+	defer bar.Done()
+	for _, e := range entries {
+		parent, st := mkdirs(path.Dir(e.Path))
+		if st != 0 {
+			return r, fmt.Errorf("create directory %s: %s", path.Dir(e.Path), st)
+		}
+		var inode meta.Ino
+		var attr meta.Attr
+		if parent != 0 {
+			st = m.Lookup(ctx, parent, path.Base(e.Path), &inode, &attr)
+			if st == 0 {
+				logger.Warnf("Skip %s which exists already", e.Path)
+				r.skipped.add(int64(e.Size))
+				bar.Increment()
+				continue
+			} else if st != syscall.ENOENT {
+				return r, fmt.Errorf("lookup %s: %s", e.Path, st)
+			}
+		}
+		if opt.dryRun {
+			r.files.add(int64(e.Size))
+			bar.Increment()
+			continue
+		}
+		mode := e.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if st = m.Create(ctx, parent, path.Base(e.Path), mode, 0, syscall.O_EXCL, &inode, &attr); st != 0 {
+			return r, fmt.Errorf("create %s: %s", e.Path, st)
+		}
+		for indx, cid := range e.Chunks {
+			clen := chunkLen(e.Size, indx)
+			if st = m.Write(ctx, inode, uint32(indx), 0, meta.Slice{Chunkid: cid, Size: clen, Len: clen}); st != 0 {
+				break
+			}
+		}
+		if st == 0 && e.Mtime != 0 {
+			attr = meta.Attr{Mtime: e.Mtime, Atime: e.Mtime}
+			st = m.SetAttr(ctx, inode, meta.SetAttrMtime|meta.SetAttrAtime, 0, &attr)
+		}
+		_ = m.Close(ctx, inode)
+		if st != 0 {
+			return r, fmt.Errorf("write %s: %s", e.Path, st)
+		}
+		r.files.add(int64(e.Size))
+		bar.Increment()
+	}
+	return r, nil
+}
+
+func importLayout(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and LAYOUT are needed")
+	}
+	if ctx.Int("threads") <= 0 {
+		return fmt.Errorf("threads should be greater than 0")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if format.Compression != "" && format.Compression != "none" {
+		logger.Fatalf("The blocks are compressed by %s in this volume, the objects can't be imported", format.Compression)
+	}
+	if format.EncryptKey != "" {
+		logger.Fatalf("The blocks are encrypted in this volume, the objects can't be imported")
+	}
+	fp, err := os.Open(ctx.Args().Get(1))
+	if err != nil {
+		logger.Fatalf("open layout: %s", err)
+	}
+	entries, err := loadLayout(fp)
+	_ = fp.Close()
+	if err != nil {
+		logger.Fatalf("load layout: %s", err)
+	}
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+
+	opt := importOptions{
+		blockSize: format.BlockSize * 1024,
+		layout:    keyLayout(format),
+		threads:   ctx.Int("threads"),
+		dryRun:    ctx.Bool("dry-run"),
+	}
+	progress := utils.NewProgress(false, false)
+	r, err := importFiles(m, object.WithPrefix(blob, "chunks/"), entries, opt, progress)
+	progress.Done()
+	if err != nil {
+		logger.Fatalf("import: %s", err)
+	}
+	if opt.dryRun {
+		logger.Infof("Dry run: %s files would be imported, %s files exist already", r.files, r.skipped)
+	} else {
+		logger.Infof("Imported %s files in %d new directories, skipped %s existing files", r.files, r.dirs, r.skipped)
+	}
+	return nil
+}
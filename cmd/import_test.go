@@ -0,0 +1,120 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+func TestImportFiles(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "import.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	_ = m.NewSession()
+	blob, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	opt := importOptions{blockSize: 4096, threads: 2}
+	put := func(cid uint64, indx, size int) {
+		if err := blob.Put(blockKey(nil, cid, indx, size), bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatalf("put: %s", err)
+		}
+	}
+	layout := `{"path": "/a/b/f1", "size": 5000, "chunks": [1000001], "mtime": 1650000000}
+{"path": "a/f2", "size": 0, "chunks": [], "mode": 384}
+{"path": "/f3", "size": 67108865, "chunks": [1000002, 1000003]}`
+	entries, err := loadLayout(strings.NewReader(layout))
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("load layout: %d %s", len(entries), err)
+	}
+	put(1000001, 0, 4096)
+	put(1000001, 1, 904)
+	for i := 0; i < meta.ChunkSize/4096; i++ {
+		put(1000002, i, 4096)
+	}
+	// the last block is missing
+	if _, err = importFiles(m, blob, entries, opt, utils.NewProgress(true, false)); err == nil {
+		t.Fatalf("import should fail with missing block")
+	}
+	put(1000003, 0, 1)
+
+	opt.dryRun = true
+	r, err := importFiles(m, blob, entries, opt, utils.NewProgress(true, false))
+	if err != nil || r.files.count != 3 || r.dirs != 0 {
+		t.Fatalf("dry run: %+v %s", r, err)
+	}
+	ctx := meta.Background
+	var inode meta.Ino
+	if st := m.Lookup(ctx, 1, "a", &inode, nil); st == 0 {
+		t.Fatalf("dry run should not create anything")
+	}
+
+	opt.dryRun = false
+	if r, err = importFiles(m, blob, entries, opt, utils.NewProgress(true, false)); err != nil || r.files.count != 3 || r.dirs != 2 {
+		t.Fatalf("import: %+v %s", r, err)
+	}
+	var attr meta.Attr
+	var ino meta.Ino
+	_ = m.Lookup(ctx, 1, "a", &ino, &attr)
+	_ = m.Lookup(ctx, ino, "b", &ino, &attr)
+	if st := m.Lookup(ctx, ino, "f1", &inode, &attr); st != 0 || attr.Length != 5000 || attr.Mtime != 1650000000 {
+		t.Fatalf("lookup f1: %s %+v", st, attr)
+	}
+	var slices []meta.Slice
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != 1000001 || slices[0].Len != 5000 {
+		t.Fatalf("read f1: %s %+v", st, slices)
+	}
+	if st := m.Lookup(ctx, 1, "f3", &inode, &attr); st != 0 || attr.Length != meta.ChunkSize+1 {
+		t.Fatalf("lookup f3: %s %+v", st, attr)
+	}
+	if st := m.Read(ctx, inode, 1, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != 1000003 || slices[0].Len != 1 {
+		t.Fatalf("read f3: %s %+v", st, slices)
+	}
+	// the chunk ids are reserved
+	var cid uint64
+	if st := m.NewChunk(ctx, &cid); st != 0 || cid <= 1000003 {
+		t.Fatalf("new chunk %d: %s", cid, st)
+	}
+
+	// existing files are skipped, and the chunk ids can't be reserved again
+	if r, err = importFiles(m, blob, entries, opt, utils.NewProgress(true, false)); err == nil {
+		t.Fatalf("import again should fail: %+v", r)
+	}
+	opt.dryRun = true
+	if r, err = importFiles(m, blob, entries, opt, utils.NewProgress(true, false)); err != nil || r.skipped.count != 3 {
+		t.Fatalf("dry run again: %+v %s", r, err)
+	}
+
+	for _, l := range []string{
+		`{"path": "/", "size": 0}`,
+		`{"path": "/x", "size": 1, "chunks": []}`,
+		`{"path": "/x", "size": 1, "chunks": [0]}`,
+		`{"path": "/x", "size": 1, "chunks": [5]}` + "\n" + `{"path": "/y", "size": 1, "chunks": [5]}`,
+		`{"path": "/x", "size": 0}` + "\n" + `{"path": "x", "size": 0}`,
+	} {
+		es, _ := loadLayout(strings.NewReader(l))
+		if _, _, err := checkLayout(es); err == nil {
+			t.Fatalf("layout %s should be invalid", l)
+		}
+	}
+}
@@ -19,8 +19,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	. "github.com/smartystreets/goconvey/convey"
@@ -61,6 +63,14 @@ func TestInfo(t *testing.T) {
 			}
 			replacer := strings.NewReplacer("\n", "", " ", "")
 			res := replacer.Replace(string(content))
+			// the birth time is checked alone, since it changes in every run
+			btime := regexp.MustCompile(`btime:(\S+)$`)
+			m := btime.FindStringSubmatch(res)
+			So(m, ShouldHaveLength, 2)
+			born, err := time.Parse(time.RFC3339Nano, m[1])
+			So(err, ShouldBeNil)
+			So(time.Since(born), ShouldBeLessThan, time.Hour)
+			res = btime.ReplaceAllString(res, "")
 			answer := fmt.Sprintf("%s/dir1: inode: 2 files:	10 dirs:	1 length:	40 size:	45056", testMountPoint)
 			answer = replacer.Replace(answer)
 			So(res, ShouldEqual, answer)
@@ -81,16 +81,34 @@ func Main(args []string) error {
 			gatewayFlags(),
 			syncFlags(),
 			rmrFlags(),
+			cloneFlags(),
+			snapshotFlags(),
+			chmodFlags(),
+			chownFlags(),
+			chattrFlags(),
 			infoFlags(),
+			presignFlags(),
+			duFlags(),
+			quotaFlags(),
 			benchFlags(),
 			gcFlags(),
+			compactFlags(),
+			reshardFlags(),
+			auditFlags(),
 			checkFlags(),
 			profileFlags(),
+			slowlogFlags(),
+			debugFlags(),
 			statsFlags(),
 			statusFlags(),
+			watchFlags(),
 			warmupFlags(),
+			cacheFlags(),
+			sessionFlags(),
 			dumpFlags(),
 			loadFlags(),
+			importFlags(),
+			migrateFlags(),
 			configFlags(),
 			destroyFlags(),
 		},
@@ -241,6 +259,16 @@ func reorderOptions(app *cli.App, args []string) []string {
 
 	newArgs = append(newArgs, cmdName)
 	args, others = others[1:], nil
+	// the options of a subcommand follow its name
+	if len(args) > 0 {
+		for _, sub := range cmd.Subcommands {
+			if sub.Name == args[0] {
+				newArgs = append(newArgs, sub.Name)
+				cmd, args = sub, args[1:]
+				break
+			}
+		}
+	}
 	// -h is valid for all the commands
 	cmdFlags := append(cmd.Flags, cli.HelpFlag)
 	for i := 0; i < len(args); i++ {
@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func migrateFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "migrate",
+		Usage:     "copy metadata into another meta engine while the volume is in use",
+		ArgsUsage: "SRC-META-URL DST-META-URL",
+		Action:    migrate,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "work-dir",
+				Value: filepath.Join(os.Getenv("HOME"), ".juicefs", "migrate"),
+				Usage: "directory to keep the snapshots of source, which are used to resume the migration",
+			},
+			&cli.IntFlag{
+				Name:  "rounds",
+				Value: 2,
+				Usage: "max number of rounds to copy the changes since the previous round",
+			},
+		},
+	}
+}
+
+func migrate(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("SRC-META-URL and DST-META-URL are needed")
+	}
+	srcURL, dstURL := ctx.Args().Get(0), ctx.Args().Get(1)
+	if srcURL == dstURL {
+		return fmt.Errorf("the source and destination should be different")
+	}
+	removePassword(srcURL)
+	removePassword(dstURL)
+	src := meta.NewClient(srcURL, &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	format, err := src.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	dst := meta.NewClient(dstURL, &meta.Config{Retries: 10, Strict: true})
+	dir := filepath.Join(ctx.String("work-dir"), format.UUID)
+	if err = meta.Migrate(src, dst, dir, ctx.Int("rounds")); err != nil {
+		return err
+	}
+	logger.Infof("Migrated metadata of %s from %s to %s, stop writing into the volume and run it again to copy the latest changes before switching to %s",
+		format.Name, src.Name(), dst.Name(), dst.Name())
+	return nil
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -24,13 +25,17 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -42,14 +47,21 @@ import (
 	"github.com/juicedata/juicefs/pkg/vfs"
 )
 
-func installHandler(mp string) {
+func installHandler(mp string, logFile *utils.LogFile) {
 	// Go will catch all the signals
 	signal.Ignore(syscall.SIGPIPE)
 	signalChan := make(chan os.Signal, 10)
 	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	go func() {
 		for {
-			<-signalChan
+			sig := <-signalChan
+			if sig == syscall.SIGHUP && logFile != nil {
+				// the log file is moved away by logrotate
+				if err := logFile.Reopen(); err != nil {
+					logger.Errorf("reopen log file: %s", err)
+				}
+				continue
+			}
 			go func() { _ = doUmount(mp, true) }()
 			go func() {
 				time.Sleep(time.Second * 3)
@@ -59,6 +71,28 @@ func installHandler(mp string) {
 	}()
 }
 
+// umountIdle unmounts mp gracefully (files are flushed and released by the kernel before that) once
+// no operation is done in it for timeout, it's tried again later if mp is busy (e.g. a file is open).
+func umountIdle(mp string, timeout time.Duration, idle func() time.Duration, umount func(mp string, force bool) error) {
+	retry := timeout
+	if retry > time.Minute {
+		retry = time.Minute
+	}
+	for {
+		if d := idle(); d < timeout {
+			time.Sleep(timeout - d)
+			continue
+		}
+		logger.Infof("No operation in %s for %s, unmount it", mp, idle().Round(time.Second))
+		err := umount(mp, false)
+		if err == nil {
+			return
+		}
+		logger.Warnf("Unmount idle %s: %s, try again in %s", mp, err, retry)
+		time.Sleep(retry)
+	}
+}
+
 func exposeMetrics(m meta.Meta, c *cli.Context) string {
 	var ip, port string
 	//default set
@@ -117,18 +151,232 @@ func exposeMetrics(m meta.Meta, c *cli.Context) string {
 	return metricsAddr
 }
 
-func wrapRegister(mp, name string) {
+const maxMetricsLabels = 10
+
+var labelNameRe = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func checkFsyncPolicy(policy string) string {
+	switch policy {
+	case vfs.FsyncBoth, vfs.FsyncData, vfs.FsyncMeta:
+	default:
+		logger.Fatalf("invalid fsync policy: %s, it should be both, data or meta", policy)
+	}
+	return policy
+}
+
+func checkRenameDurability(durability string) string {
+	switch durability {
+	case vfs.RenameNone, vfs.RenameFsynced, vfs.RenameAlways:
+	default:
+		logger.Fatalf("invalid rename durability: %s, it should be none, fsync or always", durability)
+	}
+	return durability
+}
+
+func checkWriteFailure(behavior string) string {
+	switch behavior {
+	case vfs.WriteFailureReport, vfs.WriteFailureRollback:
+	default:
+		logger.Fatalf("invalid behavior of write failure: %s, it should be report or rollback", behavior)
+	}
+	return behavior
+}
+
+func checkCacheErrorPolicy(policy string) string {
+	switch policy {
+	case chunk.CacheErrorRetry, chunk.CacheErrorBypass, chunk.CacheErrorFail:
+	default:
+		logger.Fatalf("invalid cache error policy: %s, it should be retry, bypass or fail", policy)
+	}
+	return policy
+}
+
+// setChecksums saves the checksums of slices into m and loads them from it, with --verify-checksums.
+func setChecksums(conf *chunk.Config, m meta.Meta) {
+	if !conf.VerifyChecksums {
+		return
+	}
+	conf.SaveChecksums = func(id uint64, sums []uint32) error {
+		if st := m.SetSliceChecksums(meta.Background, id, sums); st != 0 {
+			return st
+		}
+		return nil
+	}
+	conf.LoadChecksums = func(id uint64) ([]uint32, error) {
+		var sums []uint32
+		if st := m.GetSliceChecksums(meta.Background, id, &sums); st == syscall.ENOENT {
+			return nil, nil
+		} else if st != 0 {
+			return nil, st
+		}
+		return sums, nil
+	}
+}
+
+// setInline saves the small slices into m and loads them from it, with InlineSize of the volume.
+func setInline(conf *chunk.Config, m meta.Meta, format *meta.Format) {
+	if format.InlineSize == 0 {
+		return
+	}
+	conf.InlineSize = format.InlineSize
+	conf.SaveInline = func(id uint64, data []byte) error {
+		if st := m.SetSliceData(meta.Background, id, data); st != 0 {
+			return st
+		}
+		return nil
+	}
+	conf.LoadInline = func(id uint64) ([]byte, error) {
+		var data []byte
+		if st := m.GetSliceData(meta.Background, id, &data); st == syscall.ENOENT {
+			return nil, nil
+		} else if st != 0 {
+			return nil, st
+		}
+		return data, nil
+	}
+}
+
+func checkReaddirOrder(order string) string {
+	switch order {
+	case vfs.OrderNone, vfs.OrderName, vfs.OrderInode, vfs.OrderMtime:
+	default:
+		logger.Fatalf("invalid readdir order: %s, it should be none, name, inode or mtime", order)
+	}
+	return order
+}
+
+func checkReadSemantics(semantics string) string {
+	switch semantics {
+	case vfs.ReadShared, vfs.ReadSnapshot:
+	default:
+		logger.Fatalf("invalid read semantics: %s, it should be shared or snapshot", semantics)
+	}
+	return semantics
+}
+
+func checkConsistency(mode string) string {
+	switch mode {
+	case meta.ConsistencySession, meta.ConsistencyStrict, meta.ConsistencyRelaxed:
+	default:
+		logger.Fatalf("invalid consistency mode: %s, it should be session, strict or relaxed", mode)
+	}
+	return mode
+}
+
+func checkListConsistency(c *cli.Context) string {
+	level := c.String("list-consistency")
+	switch level {
+	case meta.ListStrong:
+	case meta.ListEventual:
+		if c.String("meta-replica") == "" {
+			logger.Fatalf("--list-consistency=eventual requires a replica of meta engine (--meta-replica)")
+		}
+	default:
+		logger.Fatalf("invalid list consistency: %s, it should be strong or eventual", level)
+	}
+	return level
+}
+
+// atimeMode returns the mode to update atime, only one of --noatime, --relatime and --strictatime can be set.
+func atimeMode(c *cli.Context) string {
+	mode := meta.RelAtime
+	var n int
+	for _, m := range []string{meta.NoAtime, meta.RelAtime, meta.StrictAtime} {
+		if c.Bool(m) {
+			mode = m
+			n++
+		}
+	}
+	if n > 1 {
+		logger.Fatalf("only one of --noatime, --relatime and --strictatime can be set")
+	}
+	return mode
+}
+
+// parseModeFlag parses the permission bits in octal of flag, it returns 0 if it's not set.
+func parseModeFlag(c *cli.Context, flag string) uint16 {
+	if !c.IsSet(flag) {
+		return 0
+	}
+	v, err := strconv.ParseUint(c.String(flag), 8, 16)
+	if err != nil || v > 0777 {
+		logger.Fatalf("invalid --%s: %s, it should be permission bits in octal, e.g. 0664", flag, c.String(flag))
+	}
+	return uint16(v)
+}
+
+// parseMetricsLabels parses static labels in format of "key=value,key2=value2".
+func parseMetricsLabels(s string) (prometheus.Labels, error) {
+	labels := make(prometheus.Labels)
+	if s == "" {
+		return labels, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		ps := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(ps) != 2 {
+			return nil, fmt.Errorf("invalid label %q, should be key=value", kv)
+		}
+		k, v := ps[0], ps[1]
+		if !labelNameRe.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if k == "mp" || k == "vol_name" {
+			return nil, fmt.Errorf("label %q is reserved", k)
+		}
+		if v == "" || len(v) > 128 || !utf8.ValidString(v) {
+			return nil, fmt.Errorf("invalid value %q of label %s", v, k)
+		}
+		if _, ok := labels[k]; ok {
+			return nil, fmt.Errorf("duplicated label %s", k)
+		}
+		labels[k] = v
+	}
+	if len(labels) > maxMetricsLabels {
+		return nil, fmt.Errorf("too many labels: %d > %d", len(labels), maxMetricsLabels)
+	}
+	return labels, nil
+}
+
+func wrapRegister(mp, name string, labels prometheus.Labels) {
 	registry := prometheus.NewRegistry() // replace default so only JuiceFS metrics are exposed
 	prometheus.DefaultGatherer = registry
 	metricLabels := prometheus.Labels{"mp": mp, "vol_name": name}
+	for k, v := range labels {
+		metricLabels[k] = v
+	}
 	prometheus.DefaultRegisterer = prometheus.WrapRegistererWithPrefix("juicefs_",
 		prometheus.WrapRegistererWith(metricLabels, registry))
 	prometheus.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	prometheus.MustRegister(prometheus.NewGoCollector())
 }
 
+// openLogFile writes the logs into the file of --log, which is rotated by --log-max-size and --log-max-age.
+func openLogFile(c *cli.Context) *utils.LogFile {
+	path := c.String("log")
+	f, err := utils.OpenLogFile(path, c.Int64("log-max-size")<<20, c.Duration("log-max-age"), c.Int("log-backups"))
+	if err != nil {
+		logger.Warnf("open log file %s: %s", path, err)
+		return nil
+	}
+	utils.SetOutput(f)
+	return f
+}
+
 func mount(c *cli.Context) error {
 	setLoggerLevel(c)
+	if l := c.String("log-level"); l != "" {
+		lvl, err := logrus.ParseLevel(l)
+		if err != nil {
+			logger.Fatalf("invalid log level: %s", l)
+		}
+		utils.SetLogLevel(lvl)
+	}
+	// the daemon opens it after started
+	background := c.Bool("background") && os.Getenv("JFS_FOREGROUND") == ""
+	var logFile *utils.LogFile
+	if c.IsSet("log") && !background {
+		logFile = openLogFile(c)
+	}
 	if c.Args().Len() < 1 {
 		logger.Fatalf("Meta URL and mountpoint are required")
 	}
@@ -137,6 +385,8 @@ func mount(c *cli.Context) error {
 		logger.Fatalf("MOUNTPOINT is required")
 	}
 	mp := c.Args().Get(1)
+	// before touching the mount point, which may hang on a stale connection
+	recoverMount(c, mp)
 	fi, err := os.Stat(mp)
 	if !strings.Contains(mp, ":") && err != nil {
 		if err := os.MkdirAll(mp, 0777); err != nil {
@@ -161,48 +411,84 @@ func mount(c *cli.Context) error {
 		}
 	}
 	metaConf := &meta.Config{
-		Retries:     10,
-		Strict:      true,
-		CaseInsensi: strings.HasSuffix(mp, ":") && runtime.GOOS == "windows",
-		ReadOnly:    readOnly,
-		OpenCache:   time.Duration(c.Float64("open-cache") * 1e9),
-		MountPoint:  mp,
-		Subdir:      c.String("subdir"),
-		MaxDeletes:  c.Int("max-deletes"),
+		Retries:            10,
+		Strict:             true,
+		CaseInsensi:        strings.HasSuffix(mp, ":") && runtime.GOOS == "windows",
+		ReadOnly:           readOnly,
+		OpenCache:          time.Duration(c.Float64("open-cache") * 1e9),
+		MountPoint:         mp,
+		Subdir:             c.String("subdir"),
+		MaxDeletes:         c.Int("max-deletes"),
+		AuditLog:           c.String("audit-log"),
+		AuditBuffer:        c.Int("audit-buffer"),
+		SlowThreshold:      time.Duration(c.Int64("slow-meta-threshold")) * time.Millisecond,
+		Consistency:        checkConsistency(c.String("consistency")),
+		AtimeMode:          atimeMode(c),
+		CompactSlices:      c.Int("compact-slices"),
+		CompactBytes:       uint64(c.Int("compact-size")) << 20,
+		TxnRetries:         c.Int("txn-retries"),
+		RevalidateInterval: c.Duration("revalidate-interval"),
+		Replica:            c.String("meta-replica"),
+		ListConsistency:    checkListConsistency(c),
+		MaxStaleness:       c.Duration("max-staleness"),
 	}
 	m := meta.NewClient(addr, metaConf)
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	// to tell the logs of mounts on the same host apart
+	utils.SetLogID(format.Name)
 
+	labels, err := parseMetricsLabels(c.String("metrics-labels"))
+	if err != nil {
+		logger.Fatalf("metrics labels: %s", err)
+	}
 	// Wrap the default registry, all prometheus.MustRegister() calls should be afterwards
-	wrapRegister(mp, format.Name)
+	wrapRegister(mp, format.Name, labels)
 
 	if !c.Bool("writeback") && c.IsSet("upload-delay") {
 		logger.Warnf("delayed upload only work in writeback mode")
 	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
-
-		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
-		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
-		MaxUpload:     c.Int("max-uploads"),
-		Writeback:     c.Bool("writeback"),
-		UploadDelay:   c.Duration("upload-delay"),
-		Prefetch:      c.Int("prefetch"),
-		BufferSize:    c.Int("buffer-size") << 20,
-		UploadLimit:   c.Int64("upload-limit") * 1e6 / 8,
-		DownloadLimit: c.Int64("download-limit") * 1e6 / 8,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		KeyPrefixes:  format.KeyPrefixes,
+		PrefixedFrom: format.PrefixedFrom,
+
+		GetTimeout:      time.Second * time.Duration(c.Int("get-timeout")),
+		GetParts:        c.Int("get-parts"),
+		GetThreshold:    int64(c.Int("get-parts-threshold")) << 20,
+		CoalesceGap:     int64(c.Int("read-coalesce-gap")) << 10,
+		CoalesceWait:    c.Duration("read-coalesce-wait"),
+		PutTimeout:      time.Second * time.Duration(c.Int("put-timeout")),
+		MaxUpload:       c.Int("max-uploads"),
+		MaxUploadBuffer: int64(c.Int("max-upload-buffer")) << 20,
+		Writeback:       c.Bool("writeback"),
+		PutIfAbsent:     c.Bool("put-if-absent"),
+		UploadDelay:     c.Duration("upload-delay"),
+		Prefetch:        c.Int("prefetch"),
+		BufferSize:      c.Int("buffer-size") << 20,
+		UploadLimit:     c.Int64("upload-limit") * 1e6 / 8,
+		DownloadLimit:   c.Int64("download-limit") * 1e6 / 8,
 
 		CacheDir:       c.String("cache-dir"),
 		CacheSize:      int64(c.Int("cache-size")),
 		FreeSpace:      float32(c.Float64("free-space-ratio")),
 		CacheMode:      os.FileMode(0600),
 		CacheFullBlock: !c.Bool("cache-partial-only"),
+		CacheScanMode:  c.String("cache-scan-mode"),
 		AutoCreate:     true,
+
+		CacheErrorPolicy:    checkCacheErrorPolicy(c.String("cache-error-policy")),
+		CacheErrorThreshold: c.Int("cache-error-threshold"),
+		VerifyChecksums:     c.Bool("verify-checksums"),
+		OnCacheFailure: func(dir string, err error) {
+			logger.Errorf("Umount %s because cache dir %s failed: %s", mp, dir, err)
+			_ = doUmount(mp, true)
+			logger.Fatalf("Cache dir %s failed: %s", dir, err)
+		},
 	}
 
 	if chunkConf.CacheDir != "memory" {
@@ -215,11 +501,18 @@ func mount(c *cli.Context) error {
 	if c.IsSet("bucket") {
 		format.Bucket = c.String("bucket")
 	}
-	blob, err := createStorage(format)
+	sconf, err := newStorageConfig(c)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
 	if err != nil {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	setChecksums(&chunkConf, m)
+	setInline(&chunkConf, m, format)
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
 		chunkid := args[0].(uint64)
@@ -232,14 +525,54 @@ func mount(c *cli.Context) error {
 		return vfs.Compact(chunkConf, store, slices, chunkid)
 	})
 	conf := &vfs.Config{
-		Meta:       metaConf,
-		Format:     format,
-		Version:    version.Version(),
-		Mountpoint: mp,
-		Chunk:      &chunkConf,
+		Meta:           metaConf,
+		Format:         format,
+		Version:        version.Version(),
+		Mountpoint:     mp,
+		Chunk:          &chunkConf,
+		ReadTimeout:    time.Second * time.Duration(c.Int("read-timeout")),
+		InodeCacheSize: c.Int("inode-cache-size"),
+		InodeCacheTTL:  time.Millisecond * time.Duration(c.Float64("inode-cache-ttl")*1000),
+
+		AllowStaleReads:  c.Bool("allow-stale-reads"),
+		RetryENOENT:      c.Bool("retry-enoent"),
+		ReaddirPageSize:  c.Int("readdir-page-size"),
+		ReaddirOrder:     checkReaddirOrder(c.String("readdir-order")),
+		WriteCombine:     c.Duration("write-combine"),
+		WriteCombineSize: c.Int("write-combine-size") << 20,
+		WriteCacheLimit:  uint64(c.Int("write-cache-threshold")) << 20,
+		FileMode:         parseModeFlag(c, "file-mode"),
+		DirMode:          parseModeFlag(c, "dir-mode"),
+		FsyncPolicy:      checkFsyncPolicy(c.String("fsync-policy")),
+		RenameDurability: checkRenameDurability(c.String("rename-durability")),
+		WriteFailure:     checkWriteFailure(c.String("write-failure")),
+		ReadSemantics:    checkReadSemantics(c.String("read-semantics")),
+		MaxFileSize:      c.Uint64("max-file-size") << 30,
+		MaxDepth:         c.Int("max-depth"),
+	}
+	if c.IsSet("umask") {
+		umask := parseModeFlag(c, "umask")
+		conf.Umask = &umask
+	}
+	if c.IsSet("uid") {
+		uid := uint32(c.Uint("uid"))
+		conf.Uid = &uid
+	}
+	if c.IsSet("gid") {
+		gid := uint32(c.Uint("gid"))
+		conf.Gid = &gid
+	}
+	if conf.AllSquash = c.Bool("all-squash"); conf.AllSquash && (conf.Uid == nil || conf.Gid == nil) {
+		logger.Fatalf("--all-squash needs --uid and --gid")
+	}
+	if conf.RootSquash = c.Bool("root-squash"); conf.RootSquash {
+		if conf.AllSquash {
+			logger.Fatalf("--root-squash and --all-squash can't be used together")
+		}
+		conf.AnonUid, conf.AnonGid = uint32(c.Uint("anon-uid")), uint32(c.Uint("anon-gid"))
 	}
 
-	if c.Bool("background") && os.Getenv("JFS_FOREGROUND") == "" {
+	if background {
 		if runtime.GOOS != "windows" {
 			d := c.String("cache-dir")
 			if d != "memory" && !strings.HasPrefix(d, "/") {
@@ -267,12 +600,15 @@ func mount(c *cli.Context) error {
 				}
 			}
 		}
-		// The default log to syslog is only in daemon mode.
-		utils.InitLoggers(!c.Bool("no-syslog"))
+		// The default log to syslog is only in daemon mode, not if the log file is specified.
+		utils.InitLoggers(!c.Bool("no-syslog") && !c.IsSet("log"))
 		err := makeDaemon(c, conf.Format.Name, conf.Mountpoint, m)
 		if err != nil {
 			logger.Fatalf("Failed to make daemon: %s", err)
 		}
+		if c.String("log") != "" {
+			logFile = openLogFile(c)
+		}
 	} else {
 		go checkMountpoint(conf.Format.Name, mp)
 	}
@@ -282,9 +618,18 @@ func mount(c *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
-	installHandler(mp)
+	installHandler(mp, logFile)
 	v := vfs.NewVFS(conf, m, store)
+	if pins := c.String("cache-pin"); pins != "" {
+		if err = v.PinCache(utils.SplitDir(pins), 10); err != nil {
+			logger.Fatalf("pin cache: %s", err)
+		}
+	}
+	if dirs := c.String("cache-bypass"); dirs != "" {
+		v.BypassCache(utils.SplitDir(dirs))
+	}
 	metricsAddr := exposeMetrics(m, c)
+	registerHealth(m, blob)
 	if c.IsSet("consul") {
 		metric.RegisterToConsul(c.String("consul"), metricsAddr, mp)
 	}
@@ -311,7 +656,7 @@ func clientFlags() []cli.Flag {
 		}
 		defaultCacheDir = path.Join(homeDir, ".juicefs", "cache")
 	}
-	return []cli.Flag{
+	return append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "bucket",
 			Usage: "customized endpoint to access object store",
@@ -321,11 +666,36 @@ func clientFlags() []cli.Flag {
 			Value: 60,
 			Usage: "the max number of seconds to download an object",
 		},
+		&cli.IntFlag{
+			Name:  "get-parts",
+			Value: 1,
+			Usage: "number of ranged requests to download a large block in parallel (1 means disabled)",
+		},
+		&cli.IntFlag{
+			Name:  "get-parts-threshold",
+			Value: 4,
+			Usage: "min size in MiB of a block to be downloaded in parts",
+		},
+		&cli.IntFlag{
+			Name:  "read-coalesce-gap",
+			Value: 0,
+			Usage: "merge the ranged reads of a block into one request if they are at most this many KiB apart (0 means disabled)",
+		},
+		&cli.DurationFlag{
+			Name:  "read-coalesce-wait",
+			Value: 2 * time.Millisecond,
+			Usage: "time to wait for the nearby reads of a block to be merged before sending the request",
+		},
 		&cli.IntFlag{
 			Name:  "put-timeout",
 			Value: 60,
 			Usage: "the max number of seconds to upload an object",
 		},
+		&cli.IntFlag{
+			Name:  "read-timeout",
+			Value: 0,
+			Usage: "the max number of seconds to read a block from object storage before failing with EIO (0 means no limit)",
+		},
 		&cli.IntFlag{
 			Name:  "io-retries",
 			Value: 30,
@@ -336,11 +706,24 @@ func clientFlags() []cli.Flag {
 			Value: 20,
 			Usage: "number of connections to upload",
 		},
+		&cli.IntFlag{
+			Name:  "max-upload-buffer",
+			Usage: "max size of the blocks held in memory by the uploads in MiB, the writes are blocked once it's reached (0 means no limit)",
+		},
 		&cli.IntFlag{
 			Name:  "max-deletes",
 			Value: 2,
 			Usage: "number of threads to delete objects",
 		},
+		&cli.IntFlag{
+			Name:  "compact-slices",
+			Value: 5,
+			Usage: "number of slices in a chunk to compact them into one when the chunk is read",
+		},
+		&cli.IntFlag{
+			Name:  "compact-size",
+			Usage: "total size of the slices (including the overwritten parts) in a chunk in MB to compact them when the chunk is read (0 means disabled)",
+		},
 		&cli.IntFlag{
 			Name:  "buffer-size",
 			Value: 300,
@@ -370,6 +753,24 @@ func clientFlags() []cli.Flag {
 			Name:  "upload-delay",
 			Usage: "delayed duration for uploading objects (\"s\", \"m\", \"h\")",
 		},
+		&cli.BoolFlag{
+			Name:  "put-if-absent",
+			Usage: "upload a block only if it does not exist, to detect the slice ids used twice (HEAD before PUT if not supported by the object storage)",
+		},
+		&cli.DurationFlag{
+			Name:  "write-combine",
+			Usage: "window to combine small sequential writes into the same slice (0 means disable this feature)",
+		},
+		&cli.IntFlag{
+			Name:  "write-combine-size",
+			Value: 0,
+			Usage: "only the slices smaller than this (in MB) are combined (0 means the block size)",
+		},
+		&cli.IntFlag{
+			Name:  "write-cache-threshold",
+			Value: 0,
+			Usage: "the data written beyond this size (in MB) of a file is uploaded directly without the cache (0 means disable this feature)",
+		},
 		&cli.StringFlag{
 			Name:  "cache-dir",
 			Value: defaultCacheDir,
@@ -389,6 +790,25 @@ func clientFlags() []cli.Flag {
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.StringFlag{
+			Name:  "cache-scan-mode",
+			Value: "full",
+			Usage: "how to load the disk cache on startup: full (scan the cache directory), fast (trust the index and verify blocks on first read), none (discard the cached blocks)",
+		},
+		&cli.StringFlag{
+			Name:  "cache-error-policy",
+			Value: "retry",
+			Usage: "what to do when a cache directory keeps failing with I/O errors: retry (keep using it), bypass (stop using it) or fail (umount and exit)",
+		},
+		&cli.IntFlag{
+			Name:  "cache-error-threshold",
+			Value: 10,
+			Usage: "number of I/O errors in a row for a cache directory to be considered failed",
+		},
+		&cli.BoolFlag{
+			Name:  "verify-checksums",
+			Usage: "save the checksums of the blocks written into the metadata, and verify the blocks read from object storage with them",
+		},
 		&cli.DurationFlag{
 			Name:  "backup-meta",
 			Value: time.Hour,
@@ -404,11 +824,74 @@ func clientFlags() []cli.Flag {
 			Value: 0.0,
 			Usage: "open files cache timeout in seconds (0 means disable this feature)",
 		},
+		&cli.DurationFlag{
+			Name:  "revalidate-interval",
+			Usage: "interval to check the cached chunks of open files against the meta engine and drop the ones changed by other clients (0 means disable this feature)",
+		},
+		&cli.IntFlag{
+			Name:  "inode-cache-size",
+			Value: 0,
+			Usage: "max number of inodes and entries cached in client (0 means disable this feature)",
+		},
+		&cli.Float64Flag{
+			Name:  "inode-cache-ttl",
+			Value: 1.0,
+			Usage: "inode cache timeout in seconds",
+		},
+		&cli.BoolFlag{
+			Name:  "retry-enoent",
+			Usage: "look up an inode or entry once more if it's not found by the meta engine, to tell a transient error from the deletion by other clients",
+		},
+		&cli.StringFlag{
+			Name:  "consistency",
+			Value: meta.ConsistencySession,
+			Usage: "consistency of cached metadata: session (read your own writes), strict (no cache of open files and inodes) or relaxed",
+		},
+		&cli.StringFlag{
+			Name:  "meta-replica",
+			Usage: "address of a read-only replica of the meta engine, to read the entries of directories from with --list-consistency=eventual",
+		},
+		&cli.StringFlag{
+			Name:  "list-consistency",
+			Value: meta.ListStrong,
+			Usage: "consistency of listings and lookups: strong (always read from the primary) or eventual (read from --meta-replica, the recent changes could be missed)",
+		},
+		&cli.DurationFlag{
+			Name:  "max-staleness",
+			Value: 5 * time.Second,
+			Usage: "max lag of the meta replica to read from it, the primary is used when it's behind more than that",
+		},
+		&cli.IntFlag{
+			Name:  "txn-retries",
+			Value: 50,
+			Usage: "max restarts of a meta transaction on conflicts, after which the operation fails with EAGAIN instead of being retried",
+		},
+		&cli.BoolFlag{
+			Name:  "noatime",
+			Usage: "never update the access time of files and directories when they are read",
+		},
+		&cli.BoolFlag{
+			Name:  "relatime",
+			Usage: "update the access time only if it's older than the modify or change time, or one day ago (default)",
+		},
+		&cli.BoolFlag{
+			Name:  "strictatime",
+			Usage: "update the access time on every read",
+		},
 		&cli.StringFlag{
 			Name:  "subdir",
 			Usage: "mount a sub-directory as root",
 		},
-	}
+		&cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "file or address (tcp://HOST:PORT, udp://HOST:PORT) to record metadata changes (empty means disabled)",
+		},
+		&cli.IntFlag{
+			Name:  "audit-buffer",
+			Value: 10240,
+			Usage: "max number of pending audit events, newer events are dropped if it's full",
+		},
+	}, storageFlags()...)
 }
 
 func mountFlags() *cli.Command {
@@ -421,7 +904,11 @@ func mountFlags() *cli.Command {
 			&cli.StringFlag{
 				Name:  "metrics",
 				Value: "127.0.0.1:9567",
-				Usage: "address to export metrics",
+				Usage: "address to export metrics and health checks (/healthz and /readyz)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-labels",
+				Usage: "static labels attached to all the metrics, in format of key=value,key2=value2 (at most 10)",
 			},
 			&cli.StringFlag{
 				Name:  "consul",
@@ -432,6 +919,99 @@ func mountFlags() *cli.Command {
 				Name:  "no-usage-report",
 				Usage: "do not send usage report",
 			},
+			&cli.Int64Flag{
+				Name:  "slow-meta-threshold",
+				Usage: "record the metadata operations slower than it in milliseconds, which can be shown by the slowlog command (0 means disabled)",
+			},
+			&cli.StringFlag{
+				Name:  "cache-pin",
+				Usage: "paths in the volume (separated by colon) whose data are always kept in cache and never evicted",
+			},
+			&cli.StringFlag{
+				Name:  "cache-bypass",
+				Usage: "directories in the volume (separated by colon) whose files are read from and written into the object storage directly without cache",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-stale-reads",
+				Usage: "serve lookup/getattr/open for read from the stale cache when the meta engine is unreachable",
+			},
+			&cli.IntFlag{
+				Name:  "readdir-page-size",
+				Value: 10000,
+				Usage: "number of entries read from the meta engine at a time when listing a directory (0 means all of them)",
+			},
+			&cli.StringFlag{
+				Name:  "readdir-order",
+				Value: vfs.OrderNone,
+				Usage: "order of the entries when listing a directory: none (the order of meta engine), name, inode or mtime, the entries are sorted in every page of --readdir-page-size",
+			},
+			&cli.StringFlag{
+				Name:  "umask",
+				Usage: "umask in octal applied to new files and directories, instead of the umask of the process",
+			},
+			&cli.StringFlag{
+				Name:  "file-mode",
+				Usage: "permissions in octal of new files (e.g. 0664), instead of the ones requested by the application",
+			},
+			&cli.StringFlag{
+				Name:  "dir-mode",
+				Usage: "permissions in octal of new directories (e.g. 0775), instead of the ones requested by the application",
+			},
+			&cli.UintFlag{
+				Name:  "uid",
+				Usage: "show all the files as owned by this user in the mount point, their owners are not changed",
+			},
+			&cli.UintFlag{
+				Name:  "gid",
+				Usage: "show all the files as owned by this group in the mount point, their groups are not changed",
+			},
+			&cli.BoolFlag{
+				Name:  "all-squash",
+				Usage: "make the requests of all users (including root) as --uid and --gid, so new files are owned by them",
+			},
+			&cli.BoolFlag{
+				Name:  "root-squash",
+				Usage: "make the requests of root as --anon-uid and --anon-gid, with their permissions checked, other users are not changed",
+			},
+			&cli.UintFlag{
+				Name:  "anon-uid",
+				Value: 65534,
+				Usage: "user of root squashed by --root-squash (nobody by default)",
+			},
+			&cli.UintFlag{
+				Name:  "anon-gid",
+				Value: 65534,
+				Usage: "group of root squashed by --root-squash (nogroup by default)",
+			},
+			&cli.StringFlag{
+				Name:  "fsync-policy",
+				Value: vfs.FsyncBoth,
+				Usage: "what fsync waits for: both (the data persisted and committed into meta engine), data (persisted only) or meta (no data)",
+			},
+			&cli.StringFlag{
+				Name:  "rename-durability",
+				Value: vfs.RenameNone,
+				Usage: "when a rename waits for the buffered data of the file to be committed before it: none, fsync (if fsync is called on it) or always",
+			},
+			&cli.StringFlag{
+				Name:  "write-failure",
+				Value: vfs.WriteFailureReport,
+				Usage: "what to do when some data of a file fails to be written: report (the offset below which the data is durable) or rollback (to the last flush)",
+			},
+			&cli.StringFlag{
+				Name:  "read-semantics",
+				Value: vfs.ReadShared,
+				Usage: "what a read-only handle sees when the file is changed after it's opened (e.g. truncated by O_TRUNC): shared (the changes, as POSIX) or snapshot (the file as it's opened)",
+			},
+			&cli.Uint64Flag{
+				Name:  "max-file-size",
+				Usage: "maximum size of a file in GiB, a write or truncate beyond it fails with EFBIG (0 means no limit other than the hard one)",
+			},
+			&cli.IntFlag{
+				Name:  "max-depth",
+				Value: 1000,
+				Usage: "maximum depth of directories from the root of volume, a new entry deeper than it fails with ENAMETOOLONG (0 means no limit)",
+			},
 		},
 	}
 	cmd.Flags = append(cmd.Flags, mount_flags()...)
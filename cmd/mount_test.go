@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -135,3 +136,69 @@ func TestUmount(t *testing.T) {
 		t.Fatalf("umount failed: inode of %s is 1", testMountPoint)
 	}
 }
+
+func TestUmountIdle(t *testing.T) {
+	var last = time.Now()
+	var lock sync.Mutex
+	idle := func() time.Duration {
+		lock.Lock()
+		defer lock.Unlock()
+		return time.Since(last)
+	}
+	umounts := make(chan time.Time, 2)
+	var tries int
+	go umountIdle("/jfs", time.Millisecond*200, idle, func(mp string, force bool) error {
+		if force {
+			t.Errorf("an idle mount point should not be unmounted by force")
+		}
+		umounts <- time.Now()
+		// a file is still open in the first try
+		if tries++; tries == 1 {
+			return fmt.Errorf("target is busy")
+		}
+		return nil
+	})
+	// the activities reset the timer
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 100)
+		lock.Lock()
+		last = time.Now()
+		lock.Unlock()
+	}
+	started := time.Now()
+	var first, second time.Time
+	select {
+	case first = <-umounts:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the idle mount point is not unmounted")
+	}
+	if d := first.Sub(started); d < time.Millisecond*150 {
+		t.Fatalf("unmounted %s after the last activity", d)
+	}
+	select {
+	case second = <-umounts:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the busy mount point is not unmounted again")
+	}
+	if d := second.Sub(first); d < time.Millisecond*150 {
+		t.Fatalf("a busy mount point is retried too soon: %s", d)
+	}
+}
+
+func TestParseMetricsLabels(t *testing.T) {
+	labels, err := parseMetricsLabels("env=prod, role=worker")
+	if err != nil {
+		t.Fatalf("parse labels: %s", err)
+	}
+	if len(labels) != 2 || labels["env"] != "prod" || labels["role"] != "worker" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+	if labels, err = parseMetricsLabels(""); err != nil || len(labels) != 0 {
+		t.Fatalf("empty labels: %v %v", labels, err)
+	}
+	for _, s := range []string{"env", "1env=a", "__name=a", "mp=/jfs", "env=", "env=a,env=b", "a=1,b=1,c=1,d=1,e=1,f=1,g=1,h=1,i=1,j=1,k=1"} {
+		if _, err := parseMetricsLabels(s); err == nil {
+			t.Fatalf("labels %q should be invalid", s)
+		}
+	}
+}
@@ -117,7 +117,24 @@ func mount_flags() []cli.Flag {
 		&cli.StringFlag{
 			Name:  "log",
 			Value: path.Join(defaultLogDir, "juicefs.log"),
-			Usage: "path of log file when running in background",
+			Usage: "path of log file when running in background, or in foreground if it's set (syslog is not used then)",
+		},
+		&cli.StringFlag{
+			Name:  "log-level",
+			Usage: "level of logs (trace, debug, info, warn or error), which overrides --verbose, --trace and --quiet",
+		},
+		&cli.Int64Flag{
+			Name:  "log-max-size",
+			Usage: "rotate the log file when it's larger than this size in MiB (0 means never)",
+		},
+		&cli.DurationFlag{
+			Name:  "log-max-age",
+			Usage: "rotate the log file when it's opened longer than this (0 means never)",
+		},
+		&cli.IntFlag{
+			Name:  "log-backups",
+			Value: 5,
+			Usage: "number of rotated log files to keep (as FILE.1, FILE.2 and so on)",
 		},
 		&cli.StringFlag{
 			Name:  "o",
@@ -142,9 +159,55 @@ func mount_flags() []cli.Flag {
 			Name:  "enable-xattr",
 			Usage: "enable extended attributes (xattr)",
 		},
+		&cli.IntFlag{
+			Name:  "fuse-workers",
+			Usage: "number of goroutines waiting for FUSE requests, in range [2, 16] (0 means the number of CPUs)",
+		},
+		&cli.IntFlag{
+			Name:  "max-background",
+			Usage: "max number of async FUSE requests (readahead, writeback) in flight (0 means 8 per CPU, at least 50)",
+		},
+		&cli.IntFlag{
+			Name:  "congestion-threshold",
+			Usage: "number of async FUSE requests in flight before the kernel throttles them (0 means 3/4 of max-background)",
+		},
+		&cli.IntFlag{
+			Name:  "read-buffer",
+			Usage: "max size of data in a FUSE read request in KiB, a multiple of 4 in range [4, 128] (0 means the default)",
+		},
+		&cli.IntFlag{
+			Name:  "write-buffer",
+			Usage: "max size of data in a FUSE write request in KiB, a multiple of 4 in range [4, 128] (0 means 128)",
+		},
+		&cli.StringFlag{
+			Name:  "propagation",
+			Usage: "mount propagation type of the mount point (shared, slave, private, unbindable, or the recursive ones with prefix r)",
+		},
+		&cli.DurationFlag{
+			Name:  "idle-timeout",
+			Usage: "unmount gracefully after no operation for this duration (0 means never)",
+		},
+		&cli.BoolFlag{
+			Name:  "recover",
+			Usage: "abort the stale FUSE connection passed in JFS_FUSE_FD and mount again at the same mount point",
+		},
 	}
 }
 
+func recoverMount(c *cli.Context, mp string) {
+	if err := fuse.CheckPropagation(c.String("propagation")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if !c.Bool("recover") || os.Getenv(fuse.FdEnv) == "" && godaemon.Stage() != 0 {
+		return
+	}
+	if err := fuse.Recover(mp); err != nil {
+		logger.Fatalf("recover %s: %s", mp, err)
+	}
+	// the connection is closed, don't pass it to the daemon
+	_ = os.Unsetenv(fuse.FdEnv)
+}
+
 func disableUpdatedb() {
 	path := "/etc/updatedb.conf"
 	data, err := ioutil.ReadFile(path)
@@ -184,7 +247,25 @@ func mount_main(v *vfs.VFS, c *cli.Context) {
 	conf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
 	conf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
 	logger.Infof("Mounting volume %s at %s ...", conf.Format.Name, conf.Mountpoint)
-	err := fuse.Serve(v, c.String("o"), c.Bool("enable-xattr"))
+	cc := fuse.Concurrency{
+		Workers:             c.Int("fuse-workers"),
+		MaxBackground:       c.Int("max-background"),
+		CongestionThreshold: c.Int("congestion-threshold"),
+	}
+	if cc.Workers < 0 || cc.MaxBackground < 0 || cc.CongestionThreshold < 0 {
+		logger.Fatalf("fuse-workers, max-background and congestion-threshold should not be negative")
+	}
+	if cc.MaxBackground > 0 && cc.CongestionThreshold > cc.MaxBackground {
+		logger.Fatalf("congestion-threshold (%d) should not be greater than max-background (%d)", cc.CongestionThreshold, cc.MaxBackground)
+	}
+	bufs := fuse.Buffers{Read: c.Int("read-buffer") << 10, Write: c.Int("write-buffer") << 10}
+	if err := bufs.Check(); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if d := c.Duration("idle-timeout"); d > 0 {
+		go umountIdle(conf.Mountpoint, d, v.IdleTime, doUmount)
+	}
+	err := fuse.Serve(v, c.String("o"), c.Bool("enable-xattr"), c.String("propagation"), cc, bufs)
 	if err != nil {
 		logger.Fatalf("fuse: %s", err)
 	}
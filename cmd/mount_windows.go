@@ -45,6 +45,9 @@ func mount_flags() []cli.Flag {
 	}
 }
 
+func recoverMount(c *cli.Context, mp string) {
+}
+
 func makeDaemon(c *cli.Context, name, mp string, m meta.Meta) error {
 	logger.Warnf("Cannot run in background in Windows.")
 	return nil
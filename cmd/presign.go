@@ -0,0 +1,211 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/urfave/cli/v2"
+)
+
+func presignFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "presign",
+		Usage:     "print the objects holding a range of a file with presigned URLs, for readers bypassing the mount point",
+		ArgsUsage: "META-URL PATH",
+		Action:    presign,
+		Flags: append([]cli.Flag{
+			&cli.Uint64Flag{
+				Name:  "offset",
+				Usage: "offset of the range in the file",
+			},
+			&cli.Uint64Flag{
+				Name:  "length",
+				Usage: "length of the range (0 means to the end of the file)",
+			},
+			&cli.DurationFlag{
+				Name:  "expire",
+				Value: time.Hour,
+				Usage: "how long the presigned URLs are valid",
+			},
+		}, storageFlags()...),
+	}
+}
+
+// presignedRange maps a range of a file to a range of a block object.
+type presignedRange struct {
+	Offset    uint64 `json:"offset"` // in the file
+	Length    uint64 `json:"length"`
+	Hole      bool   `json:"hole,omitempty"` // zeros, there is no object
+	Key       string `json:"key,omitempty"`
+	BlockSize int    `json:"block_size,omitempty"`
+	BlockOff  int    `json:"block_offset"`
+	URL       string `json:"url,omitempty"`
+	// the range can be read from the object directly, otherwise the whole block should be
+	// downloaded and decompressed (or decrypted) first
+	Raw bool `json:"raw"`
+}
+
+type presignResult struct {
+	Path        string           `json:"path"`
+	Inode       meta.Ino         `json:"inode"`
+	Length      uint64           `json:"length"`
+	Compression string           `json:"compression,omitempty"`
+	Encrypted   bool             `json:"encrypted,omitempty"`
+	Expire      time.Time        `json:"expire"`
+	Ranges      []presignedRange `json:"ranges"`
+}
+
+// resolvePath returns the inode and attributes of path (relative to the root).
+func resolvePath(m meta.Meta, path string) (meta.Ino, *meta.Attr, syscall.Errno) {
+	ctx := meta.Background
+	var inode meta.Ino
+	var attr = &meta.Attr{}
+	if st := m.Resolve(ctx, 1, path, &inode, attr); st != syscall.ENOTSUP {
+		return inode, attr, st
+	}
+	inode = 1
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if st := m.Lookup(ctx, inode, name, &inode, attr); st != 0 {
+			return 0, nil, st
+		}
+	}
+	if inode == 1 {
+		if st := m.GetAttr(ctx, inode, attr); st != 0 {
+			return 0, nil, st
+		}
+	}
+	return inode, attr, 0
+}
+
+// presignRanges returns the blocks holding the data [off, end) of inode, the URLs are presigned by
+// blob if raw is true (the blocks are not compressed or encrypted) or presign is set.
+func presignRanges(m meta.Meta, blob object.ObjectStorage, conf *chunk.Config, inode meta.Ino, off, end uint64, expire time.Duration, raw, presign bool) ([]presignedRange, error) {
+	var rs []presignedRange
+	for off < end {
+		indx := uint32(off / meta.ChunkSize)
+		var slices []meta.Slice
+		if st := m.Read(meta.Background, inode, indx, &slices); st != 0 {
+			return nil, fmt.Errorf("read chunk %d: %s", indx, st)
+		}
+		start := uint64(indx) * meta.ChunkSize
+		cend := start + meta.ChunkSize
+		if cend > end {
+			cend = end
+		}
+		pos := start
+		for _, s := range slices {
+			sstart, send := pos, pos+uint64(s.Len)
+			pos = send
+			if send <= off {
+				continue
+			}
+			if sstart >= cend {
+				break
+			}
+			if send > cend {
+				send = cend
+			}
+			if s.Chunkid == 0 {
+				rs = append(rs, presignedRange{Offset: off, Length: send - off, Hole: true, Raw: true})
+				off = send
+				continue
+			}
+			if int(s.Size) <= conf.InlineSize {
+				return nil, fmt.Errorf("slice %d is stored in the metadata engine, it has no object to presign", s.Chunkid)
+			}
+			for _, b := range chunk.SliceBlocks(conf, s.Chunkid, int(s.Size), int(s.Off+uint32(off-sstart)), int(send-off)) {
+				r := presignedRange{Offset: off, Length: uint64(b.Len), Key: b.Key, BlockSize: b.Size, BlockOff: b.Off, Raw: raw}
+				if raw || presign {
+					u, err := object.Presign(blob, b.Key, expire)
+					if err != nil {
+						return nil, fmt.Errorf("presign %s: %s", b.Key, err)
+					}
+					r.URL = u
+				}
+				rs = append(rs, r)
+				off += uint64(b.Len)
+			}
+		}
+		if off < cend { // after the last slice
+			rs = append(rs, presignedRange{Offset: off, Length: cend - off, Hole: true, Raw: true})
+			off = cend
+		}
+	}
+	return rs, nil
+}
+
+func presign(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and PATH are needed")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	path := ctx.Args().Get(1)
+	inode, attr, st := resolvePath(m, path)
+	if st != 0 {
+		return fmt.Errorf("resolve %s: %s", path, st)
+	}
+	if attr.Typ != meta.TypeFile {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	off, end := ctx.Uint64("offset"), attr.Length
+	if l := ctx.Uint64("length"); l > 0 && off+l < end {
+		end = off + l
+	}
+
+	encrypted := format.EncryptKey != ""
+	format.EncryptKey = "" // the URLs are for the objects as they are
+	sconf, err := newStorageConfig(ctx)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	defer sconf.close()
+	blob, err := createStorage(format, sconf)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	compressed := format.Compression != "" && format.Compression != "none"
+	conf := keyLayout(format)
+	conf.BlockSize = format.BlockSize * 1024
+	conf.InlineSize = format.InlineSize
+	expire := ctx.Duration("expire")
+	r := &presignResult{Path: path, Inode: inode, Length: attr.Length, Encrypted: encrypted, Expire: time.Now().Add(expire).Truncate(time.Second)}
+	if compressed {
+		r.Compression = format.Compression
+	}
+	// the encrypted objects can't be read by others without the private key
+	if r.Ranges, err = presignRanges(m, blob, conf, inode, off, end, expire, !compressed && !encrypted, !encrypted); err != nil {
+		return err
+	}
+	printJson(r)
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func TestPresignRanges(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "presign.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := meta.Background
+	var parent, inode meta.Ino
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &parent, nil); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, 0, &inode, nil); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	// 0-5000: slice 1, 5000-6000: hole, 6000-7000: slice 2, 7000-8000: hole
+	if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: 1, Size: 5000, Len: 5000}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 6000, meta.Slice{Chunkid: 2, Size: 1000, Len: 1000}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 8000, nil); st != 0 {
+		t.Fatalf("truncate f: %s", st)
+	}
+
+	ino, attr, st := resolvePath(m, "/d/f")
+	if st != 0 || ino != inode || attr.Length != 8000 {
+		t.Fatalf("resolve /d/f: %s %d %+v", st, ino, attr)
+	}
+	if _, _, st = resolvePath(m, "d/none"); st != syscall.ENOENT {
+		t.Fatalf("resolve d/none should fail with ENOENT: %s", st)
+	}
+
+	conf := &chunk.Config{BlockSize: 4096}
+	rs, err := presignRanges(m, nil, conf, inode, 100, 8000, time.Minute, false, false)
+	if err != nil {
+		t.Fatalf("ranges: %s", err)
+	}
+	var got []string
+	for _, r := range rs {
+		got = append(got, fmt.Sprintf("%d+%d:%s@%d", r.Offset, r.Length, r.Key, r.BlockOff))
+	}
+	expected := "100+3996:chunks/0/0/1_0_4096@100,4096+904:chunks/0/0/1_1_904@0,5000+1000:@0," +
+		"6000+1000:chunks/0/0/2_0_1000@0,7000+1000:@0"
+	if strings.Join(got, ",") != expected {
+		t.Fatalf("expect %s, but got %s", expected, strings.Join(got, ","))
+	}
+
+	blob, err := object.CreateStorage("minio", "http://127.0.0.1:9000/bucket", "ak", "sk")
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	blob = object.WithPrefix(blob, "test/")
+	if rs, err = presignRanges(m, blob, conf, inode, 6500, 7500, time.Minute, true, true); err != nil {
+		t.Fatalf("presign: %s", err)
+	}
+	if len(rs) != 2 || !rs[0].Raw || !strings.Contains(rs[0].URL, "/bucket/test/chunks/0/0/2_0_1000?") || rs[0].BlockOff != 500 || !rs[1].Hole {
+		t.Fatalf("unexpected ranges: %+v", rs)
+	}
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	if _, err = presignRanges(m, mem, conf, inode, 0, 100, time.Minute, true, true); err == nil {
+		t.Fatalf("presign should not be supported by mem")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func quotaFlags() *cli.Command {
+	return &cli.Command{
+		Name:  "quota",
+		Usage: "report the usage of a volume",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "report",
+				Usage:     "report the inodes and bytes used by every directory at a level (e.g. one for each team), by walking the whole tree in the metadata without mounting",
+				ArgsUsage: "META-URL",
+				Action:    quotaReport,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "depth",
+						Value: 1,
+						Usage: "level of the directories to report, 1 for the top-level ones",
+					},
+					&cli.IntFlag{
+						Name:  "threads",
+						Value: 10,
+						Usage: "number of directories read concurrently",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the report in JSON",
+					},
+				},
+			},
+		},
+	}
+}
+
+// quotaUsage is the usage of a directory in the report, the percentages are of the quota of the
+// volume, 0 if it's not set.
+type quotaUsage struct {
+	Path         string  `json:"path"`
+	Inodes       uint64  `json:"inodes"`
+	Size         uint64  `json:"size"`   // in bytes, the length of every file rounded up to 4 KiB, as du
+	Length       uint64  `json:"length"` // apparent size
+	SizePercent  float64 `json:"size_percent,omitempty"`
+	InodePercent float64 `json:"inode_percent,omitempty"`
+}
+
+type quotaResult struct {
+	Dirs   []*quotaUsage `json:"dirs"`
+	Others *quotaUsage   `json:"others"` // the root and the files above depth
+	Total  *quotaUsage   `json:"total"`
+}
+
+// buildQuotaReport returns the usage of the directories at depth (at least 1), with the usage not in
+// any of them as Others. No summary of the usage of directories is maintained in the metadata, so
+// it takes a full walk of the tree (every directory is read once), the cost grows with the number
+// of files, not the directories reported.
+func buildQuotaReport(m meta.Meta, format *meta.Format, depth, threads int) (*quotaResult, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("depth should be at least 1: %d", depth)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	w := &duWalker{m: m, depth: depth, threads: make(chan struct{}, threads-1), linked: make(map[meta.Ino]bool)}
+	w.dirs.n = math.MaxInt32
+	total := w.walk("/", 1, 0)
+	if w.err != nil {
+		return nil, w.err
+	}
+	usage := func(e *duEntry) *quotaUsage {
+		u := &quotaUsage{Path: e.Path, Inodes: e.Files + e.Dirs, Size: e.Size, Length: e.Length}
+		if format.Capacity > 0 {
+			u.SizePercent = float64(u.Size) * 100 / float64(format.Capacity)
+		}
+		if format.Inodes > 0 {
+			u.InodePercent = float64(u.Inodes) * 100 / float64(format.Inodes)
+		}
+		return u
+	}
+	r := &quotaResult{Dirs: []*quotaUsage{}, Total: usage(total)}
+	others := *total
+	for _, e := range w.dirs.entries {
+		if strings.Count(e.Path, "/") != depth {
+			continue
+		}
+		r.Dirs = append(r.Dirs, usage(e))
+		others.Files -= e.Files
+		others.Dirs -= e.Dirs
+		others.Size -= e.Size
+		others.Length -= e.Length
+	}
+	sort.Slice(r.Dirs, func(i, j int) bool { return r.Dirs[i].Path < r.Dirs[j].Path })
+	r.Others = usage(&others)
+	r.Others.Path = ""
+	return r, nil
+}
+
+func printQuotaReport(w io.Writer, r *quotaResult) {
+	percent := func(p float64) string {
+		if p == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f%%", p)
+	}
+	line := func(name string, u *quotaUsage) {
+		fmt.Fprintf(w, "%-40s %12d %12s %8s %8s\n", name, u.Inodes, humanSize(u.Size), percent(u.SizePercent), percent(u.InodePercent))
+	}
+	fmt.Fprintf(w, "%-40s %12s %12s %8s %8s\n", "PATH", "INODES", "SIZE", "SIZE%", "INODES%")
+	for _, u := range r.Dirs {
+		line(u.Path, u)
+	}
+	line("(others)", r.Others)
+	line("(total)", r.Total)
+}
+
+func quotaReport(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	r, err := buildQuotaReport(m, format, ctx.Int("depth"), ctx.Int("threads"))
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		printJson(r)
+	} else {
+		printQuotaReport(os.Stdout, r)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestQuotaReport(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "quota.db")
+	m := meta.NewClient(metaUrl, &meta.Config{})
+	format := meta.Format{Name: "test", BlockSize: 4096, Capacity: 10 << 20, Inodes: 100}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := meta.Background
+	mkdir := func(parent meta.Ino, name string) meta.Ino {
+		var inode meta.Ino
+		if st := m.Mkdir(ctx, parent, name, 0755, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+		return inode
+	}
+	create := func(parent meta.Ino, name string, length uint64) {
+		var inode meta.Ino
+		if st := m.Create(ctx, parent, name, 0644, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		if st := m.Truncate(ctx, inode, 0, length, nil); st != 0 {
+			t.Fatalf("truncate %s: %s", name, st)
+		}
+	}
+	// /team-a/{f1 (1 MiB), data/f2 (100)}, /team-b/f3 (5000), /readme (10)
+	a := mkdir(1, "team-a")
+	create(a, "f1", 1<<20)
+	create(mkdir(a, "data"), "f2", 100)
+	create(mkdir(1, "team-b"), "f3", 5000)
+	create(1, "readme", 10)
+
+	r, err := buildQuotaReport(m, &format, 1, 4)
+	if err != nil {
+		t.Fatalf("report: %s", err)
+	}
+	expected := []quotaUsage{
+		{Path: "/team-a", Inodes: 4, Size: 4096 + 1<<20 + 4096 + 4096, Length: 1<<20 + 100},
+		{Path: "/team-b", Inodes: 2, Size: 4096 + 8192, Length: 5000},
+	}
+	if len(r.Dirs) != len(expected) {
+		t.Fatalf("dirs: %+v", r.Dirs)
+	}
+	for i, e := range expected {
+		d := r.Dirs[i]
+		if d.Path != e.Path || d.Inodes != e.Inodes || d.Size != e.Size || d.Length != e.Length {
+			t.Fatalf("expect %+v, but got %+v", e, *d)
+		}
+	}
+	if o := r.Others; o.Inodes != 2 || o.Size != 4096+4096 || o.Length != 10 {
+		t.Fatalf("others: %+v", *o)
+	}
+	if tt := r.Total; tt.Inodes != 8 || tt.Length != 1<<20+100+5000+10 || tt.InodePercent != 8 {
+		t.Fatalf("total: %+v", *tt)
+	}
+	if p := r.Dirs[1].SizePercent; p != float64(4096+8192)*100/(10<<20) {
+		t.Fatalf("size percent of team-b: %f", p)
+	}
+
+	// deeper
+	if r, err = buildQuotaReport(m, &format, 2, 1); err != nil {
+		t.Fatalf("report: %s", err)
+	}
+	if len(r.Dirs) != 1 || r.Dirs[0].Path != "/team-a/data" || r.Dirs[0].Inodes != 2 || r.Others.Inodes != 6 {
+		t.Fatalf("report at depth 2: %+v, others %+v", r.Dirs, *r.Others)
+	}
+	var w bytes.Buffer
+	printQuotaReport(&w, r)
+	if lines := strings.Split(strings.TrimSpace(w.String()), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[1], "/team-a/data") {
+		t.Fatalf("report:\n%s", w.String())
+	}
+	if err = Main([]string{"", "quota", "report", "--depth", "1", metaUrl}); err != nil {
+		t.Fatalf("quota report: %s", err)
+	}
+}
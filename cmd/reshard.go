@@ -0,0 +1,133 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func reshardFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "reshard",
+		Usage:     "find the hot ranges of keys in the KV meta engine and split them",
+		ArgsUsage: "META-URL",
+		Action:    reshard,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "top",
+				Value: 10,
+				Usage: "max number of hot ranges to report (0 means no limit)",
+			},
+			&cli.Float64Flag{
+				Name:  "ratio",
+				Value: 2,
+				Usage: "a region is hot if its load is at least this times of the average of the volume",
+			},
+			&cli.IntFlag{
+				Name:  "split",
+				Usage: "split every hot range into this many regions by the number of keys (0 means reporting only)",
+			},
+			&cli.BoolFlag{
+				Name:  "scatter",
+				Value: true,
+				Usage: "scatter the regions split into different nodes",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the result in JSON",
+			},
+		},
+	}
+}
+
+type reshardResult struct {
+	*meta.HotRange
+	Path string `json:"path,omitempty"`
+}
+
+func reshard(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	if ctx.Int("split") == 1 || ctx.Int("split") < 0 {
+		return fmt.Errorf("invalid number of regions to split into: %d", ctx.Int("split"))
+	}
+	if ctx.Float64("ratio") <= 0 {
+		return fmt.Errorf("invalid ratio: %f", ctx.Float64("ratio"))
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	r, ok := m.(meta.Resharder)
+	if !ok {
+		logger.Fatalf("reshard is not supported by %s", m.Name())
+	}
+	ranges, err := r.Reshard(meta.Background, &meta.ReshardOption{
+		Top:     ctx.Int("top"),
+		Ratio:   ctx.Float64("ratio"),
+		Split:   ctx.Int("split"),
+		Scatter: ctx.Bool("scatter"),
+	})
+	if err != nil {
+		logger.Fatalf("reshard: %s", err)
+	}
+	results := make([]*reshardResult, 0, len(ranges))
+	for _, hr := range ranges {
+		res := &reshardResult{HotRange: hr}
+		if hr.Inode > 0 {
+			res.Path, _ = meta.GetPath(m, meta.Background, hr.Inode)
+		}
+		results = append(results, res)
+	}
+	if ctx.Bool("json") {
+		printJson(results)
+	} else {
+		printReshardResults(os.Stdout, results)
+	}
+	return nil
+}
+
+func printReshardResults(w io.Writer, results []*reshardResult) {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "no hot range is found")
+		return
+	}
+	for _, r := range results {
+		owner := r.Owner
+		if r.Inode > 0 {
+			owner = fmt.Sprintf("%s %d", owner, r.Inode)
+			if r.Path != "" {
+				owner += " (" + r.Path + ")"
+			}
+		}
+		fmt.Fprintf(w, "region %d [%s, %s): read %s/s, write %s/s, %d keys, %.0f%% %s\n", r.Region, r.Start, r.End,
+			formatSize(uint64(r.Reads)), formatSize(uint64(r.Writes)), r.Keys, r.Share*100, owner)
+		if r.Error != "" {
+			fmt.Fprintf(w, "  not split: %s\n", r.Error)
+		} else if r.Splits > 0 {
+			fmt.Fprintf(w, "  split into %d regions\n", r.Splits+1)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -35,6 +36,17 @@ func rmrFlags() *cli.Command {
 		Usage:     "remove directories recursively",
 		ArgsUsage: "PATH ...",
 		Action:    rmr,
+		Flags: []cli.Flag{
+			&cli.UintFlag{
+				Name:  "pace",
+				Usage: "remove at most this many entries per second, to not overload the meta engine and object storage (0 means no limit)",
+			},
+			&cli.UintFlag{
+				Name:  "batch",
+				Value: 1000,
+				Usage: "number of entries removed between the pauses of --pace",
+			},
+		},
 	}
 }
 
@@ -77,6 +89,15 @@ func rmr(ctx *cli.Context) error {
 			logger.Errorf("%s is not inside JuiceFS", path)
 			continue
 		}
+		if pace := ctx.Uint("pace"); pace > 0 {
+			batch := ctx.Uint("batch")
+			if batch == 0 {
+				batch = 1
+			}
+			rmrPaced(f, path, d, inode, name, pace, batch)
+			_ = f.Close()
+			continue
+		}
 		wb := utils.NewBuffer(8 + 8 + 1 + uint32(len(name)))
 		wb.Put32(meta.Rmr)
 		wb.Put32(8 + 1 + uint32(len(name)))
@@ -103,3 +124,90 @@ func rmr(ctx *cli.Context) error {
 	}
 	return nil
 }
+
+func rmrMessage(cmd uint32, inode uint64, name string, pace, batch uint) []byte {
+	size := 8 + 1 + uint32(len(name))
+	if pace > 0 {
+		size += 8
+	}
+	wb := utils.NewBuffer(8 + size)
+	wb.Put32(cmd)
+	wb.Put32(size)
+	wb.Put64(inode)
+	wb.Put8(uint8(len(name)))
+	wb.Put([]byte(name))
+	if pace > 0 {
+		wb.Put32(uint32(pace))
+		wb.Put32(uint32(batch))
+	}
+	return wb.Bytes()
+}
+
+// readRmrReply returns the status and the number of removed entries in the reply of a paced Rmr
+// or RmrProgress.
+func readRmrReply(f *os.File) (syscall.Errno, uint64, error) {
+	data := make([]byte, 9)
+	n, err := f.Read(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n == 1 {
+		return syscall.Errno(data[0]), 0, nil
+	}
+	if n != 9 {
+		return 0, 0, fmt.Errorf("short reply: %d", n)
+	}
+	rb := utils.ReadBuffer(data)
+	return syscall.Errno(rb.Get8()), rb.Get64(), nil
+}
+
+// rmrPaced removes path in the mount point by a paced Rmr, and shows the number of removed entries,
+// which is polled through another handle of the control file.
+func rmrPaced(f *os.File, path, dir string, inode uint64, name string, pace, batch uint) {
+	progress := utils.NewProgress(false, true)
+	bar := progress.AddCountSpinner("Removed entries")
+	done := make(chan struct{})
+	go func() {
+		pf := openController(dir)
+		if pf == nil {
+			return
+		}
+		defer pf.Close()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if _, err := pf.Write(rmrMessage(meta.RmrProgress, inode, name, 0, 0)); err != nil {
+				logger.Warnf("Query progress of %s: %s", path, err)
+				return
+			}
+			st, removed, err := readRmrReply(pf)
+			if err != nil {
+				logger.Warnf("Query progress of %s: %s", path, err)
+				return
+			}
+			if st == 0 {
+				bar.SetCurrent(int64(removed))
+			}
+		}
+	}()
+	_, err := f.Write(rmrMessage(meta.Rmr, inode, name, pace, batch))
+	close(done)
+	if err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	st, removed, err := readRmrReply(f)
+	if err != nil {
+		logger.Fatalf("read message: %s", err)
+	}
+	bar.SetCurrent(int64(removed))
+	progress.Done()
+	if st != 0 {
+		logger.Fatalf("RMR %s: %s (%d entries removed)", path, st, removed)
+	}
+	logger.Infof("Removed %d entries of %s", removed, path)
+}
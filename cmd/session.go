@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+// staleSessionAge is the age of the last heartbeat after which a session is cleaned up by the
+// other clients (CleanStaleSessions), a client sends a heartbeat every minute.
+const staleSessionAge = time.Minute * 5
+
+func sessionFlags() *cli.Command {
+	return &cli.Command{
+		Name:  "session",
+		Usage: "list or kill the client sessions of a volume",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "list the sessions with their hosts, processes, mount points and last heartbeats",
+				ArgsUsage: "META-URL",
+				Action:    listSessions,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the sessions in JSON",
+					},
+				},
+			},
+			{
+				Name:      "kill",
+				Usage:     "remove a session (e.g. of a crashed client) at once, releasing its locks and deleting its sustained inodes",
+				ArgsUsage: "META-URL SID",
+				Action:    killSession,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "kill the session even if its heartbeat is recent (the client is likely alive)",
+					},
+				},
+			},
+		},
+	}
+}
+
+func listSessions(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	sessions, err := m.ListSessions()
+	if err != nil {
+		return fmt.Errorf("list sessions: %s", err)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Sid < sessions[j].Sid })
+	if ctx.Bool("json") {
+		printJson(sessions)
+	} else {
+		printSessionList(os.Stdout, sessions, time.Now())
+	}
+	return nil
+}
+
+func printSessionList(w io.Writer, sessions []*meta.Session, now time.Time) {
+	fmt.Fprintf(w, "%-8s %-20s %-8s %-30s %s\n", "SID", "HOST", "PID", "MOUNTPOINT", "HEARTBEAT")
+	for _, s := range sessions {
+		age := now.Sub(s.Heartbeat).Round(time.Second)
+		var stale string
+		if age > staleSessionAge {
+			stale = " (stale)"
+		}
+		fmt.Fprintf(w, "%-8d %-20s %-8d %-30s %s (%s ago)%s\n", s.Sid, s.HostName, s.ProcessID, s.MountPoint,
+			s.Heartbeat.Format("2006-01-02 15:04:05"), age, stale)
+	}
+}
+
+func killSession(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and SID are needed")
+	}
+	sid, err := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid session id %s: %s", ctx.Args().Get(1), err)
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	s, err := m.GetSession(sid)
+	if err != nil {
+		return fmt.Errorf("get session %d: %s", sid, err)
+	}
+	if age := time.Since(s.Heartbeat).Round(time.Second); age < staleSessionAge {
+		if !ctx.Bool("force") {
+			return fmt.Errorf("session %d of %s (pid %d) sent a heartbeat %s ago, it's likely alive, use --force to kill it anyway",
+				sid, s.HostName, s.ProcessID, age)
+		}
+		logger.Warnf("Kill session %d of %s (pid %d) with a heartbeat %s ago, the client will fail if it's alive", sid, s.HostName, s.ProcessID, age)
+	}
+	if err = m.KillSession(sid); err != nil {
+		return fmt.Errorf("kill session %d: %s", sid, err)
+	}
+	logger.Infof("Session %d is killed: %d flocks, %d plocks and %d sustained inodes are cleaned up",
+		sid, len(s.Flocks), len(s.Plocks), len(s.Sustained))
+	return nil
+}
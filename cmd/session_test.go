@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestPrintSessionList(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.Local)
+	sessions := []*meta.Session{
+		{Sid: 1, Heartbeat: now.Add(-time.Minute), SessionInfo: meta.SessionInfo{HostName: "alive", ProcessID: 100, MountPoint: "/jfs"}},
+		{Sid: 2, Heartbeat: now.Add(-time.Hour), SessionInfo: meta.SessionInfo{HostName: "crashed", ProcessID: 200, MountPoint: "/jfs"}},
+	}
+	var w bytes.Buffer
+	printSessionList(&w, sessions, now)
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 sessions, got:\n%s", w.String())
+	}
+	if !strings.Contains(lines[1], "alive") || strings.Contains(lines[1], "(stale)") {
+		t.Fatalf("session 1 should not be stale: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], "2022-06-01 09:00:00 (1h0m0s ago) (stale)") {
+		t.Fatalf("session 2 should be stale: %s", lines[2])
+	}
+}
+
+func TestSessionKill(t *testing.T) {
+	dir := t.TempDir()
+	metaUrl := "sqlite3://" + filepath.Join(dir, "jfs-session.db")
+	if err := Main([]string{"", "format", "--bucket", filepath.Join(dir, "bucket"), metaUrl, testVolume}); err != nil {
+		t.Fatalf("format failed: %s", err)
+	}
+	// a client which never sends heartbeat again
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true, MountPoint: "/jfs"})
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ss, err := m.ListSessions()
+	if err != nil || len(ss) != 1 {
+		t.Fatalf("list sessions: %+v %v", ss, err)
+	}
+	sid := fmt.Sprint(ss[0].Sid)
+	if err = Main([]string{"", "session", "list", metaUrl}); err != nil {
+		t.Fatalf("session list: %s", err)
+	}
+
+	// the heartbeat is recent
+	if err = Main([]string{"", "session", "kill", metaUrl, sid}); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("kill a live session without --force: %v", err)
+	}
+	if err = Main([]string{"", "session", "kill", "--force", metaUrl, sid}); err != nil {
+		t.Fatalf("session kill: %s", err)
+	}
+	if ss, err = m.ListSessions(); err != nil || len(ss) != 0 {
+		t.Fatalf("the session is not removed: %+v %v", ss, err)
+	}
+	if err = Main([]string{"", "session", "kill", metaUrl, sid}); err == nil {
+		t.Fatalf("kill a removed session")
+	}
+	if err = Main([]string{"", "session", "kill", metaUrl, "abc"}); err == nil {
+		t.Fatalf("kill an invalid session id")
+	}
+}
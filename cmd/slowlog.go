@@ -0,0 +1,97 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func slowlogFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "slowlog",
+		Usage:     "show recent slow metadata operations of a mount point (mounted with --slow-meta-threshold)",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    slowlog,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "reset",
+				Usage: "clear the recorded operations after showing them",
+			},
+		},
+	}
+}
+
+func slowlog(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		logger.Infof("MOUNTPOINT is needed")
+		return nil
+	}
+	mp, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	f := openController(mp)
+	if f == nil {
+		logger.Fatalf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+
+	var reset uint8
+	if ctx.Bool("reset") {
+		reset = 1
+	}
+	wb := utils.NewBuffer(8 + 1)
+	wb.Put32(meta.SlowOps)
+	wb.Put32(1)
+	wb.Put8(reset)
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	if n == 1 && data[0] == byte(syscall.EINVAL&0xff) {
+		logger.Fatalf("slowlog is not supported, please upgrade and mount again")
+	}
+	size := utils.ReadBuffer(data).Get32()
+	data = make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		logger.Fatalf("read slow operations: %s", err)
+	}
+	if size == 0 {
+		fmt.Println("No slow operation is recorded")
+		return nil
+	}
+	fmt.Println("TIME\tOP\tINODE\tDURATION\tRETRIES")
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func snapshotFlags() *cli.Command {
+	name := func() cli.Flag {
+		return &cli.StringFlag{
+			Name:     "name",
+			Required: true,
+			Usage:    "name of the snapshot",
+		}
+	}
+	return &cli.Command{
+		Name:  "snapshot",
+		Usage: "manage the named snapshots of directories, which share the data as clones",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "create",
+				Usage:  "create a snapshot of a directory",
+				Action: snapshotCreate,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Required: true,
+						Usage:    "path of the directory in a mount point",
+					},
+					name(),
+				},
+			},
+			{
+				Name:      "list",
+				Usage:     "list the snapshots",
+				ArgsUsage: "MOUNTPOINT",
+				Action:    snapshotList,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the snapshots in JSON",
+					},
+				},
+			},
+			{
+				Name:      "rollback",
+				Usage:     "switch the directory of a snapshot back to the state of it",
+				ArgsUsage: "MOUNTPOINT",
+				Action:    snapshotRollback,
+				Flags:     []cli.Flag{name()},
+			},
+			{
+				Name:      "delete",
+				Usage:     "delete a snapshot and free the data only used by it",
+				ArgsUsage: "MOUNTPOINT",
+				Action:    snapshotDelete,
+				Flags:     []cli.Flag{name()},
+			},
+		},
+	}
+}
+
+// sendSnapshotMsg sends an operation of snapshot to the mount point of path, and returns the
+// controller to read the reply.
+func sendSnapshotMsg(path string, op uint8, name string, inode uint64) (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("Windows is not supported")
+	}
+	if len(name) > 255 {
+		return nil, fmt.Errorf("snapshot %s: %s", name, syscall.ENAMETOOLONG)
+	}
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("abs of %s: %s", path, err)
+	}
+	f := openController(p)
+	if f == nil {
+		return nil, fmt.Errorf("%s is not inside JuiceFS", p)
+	}
+	size := 1 + 1 + uint32(len(name))
+	if op == meta.SnapshotCreate {
+		size += 8
+	}
+	wb := utils.NewBuffer(8 + size)
+	wb.Put32(meta.ManageSnapshot)
+	wb.Put32(size)
+	wb.Put8(op)
+	wb.Put8(uint8(len(name)))
+	wb.Put([]byte(name))
+	if op == meta.SnapshotCreate {
+		wb.Put64(inode)
+	}
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("write message: %s", err)
+	}
+	return f, nil
+}
+
+func snapshotErr(errno syscall.Errno) error {
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EINVAL:
+		return fmt.Errorf("invalid name or not supported by the mount point, please upgrade it")
+	case syscall.EPERM:
+		return fmt.Errorf("only root or the owner of mount point can manage the snapshots")
+	default:
+		return errno
+	}
+}
+
+// snapshotDo sends an operation without reply data, and returns the result of it.
+func snapshotDo(path string, op uint8, name string, inode uint64) error {
+	f, err := sendSnapshotMsg(path, op, name, inode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var st = make([]byte, 1)
+	if _, err = io.ReadFull(f, st); err != nil {
+		return fmt.Errorf("read message: %s", err)
+	}
+	return snapshotErr(syscall.Errno(st[0]))
+}
+
+func snapshotCreate(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	dir, err := filepath.Abs(ctx.String("path"))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.String("path"), err)
+	}
+	inode, err := utils.GetFileInode(dir)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", dir, err)
+	}
+	if err = snapshotDo(dir, meta.SnapshotCreate, ctx.String("name"), inode); err != nil {
+		return fmt.Errorf("create snapshot %s of %s: %s", ctx.String("name"), dir, err)
+	}
+	return nil
+}
+
+func snapshotList(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	f, err := sendSnapshotMsg(ctx.Args().Get(0), meta.SnapshotList, "", 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, 4)
+	n, err := f.Read(data)
+	if err != nil {
+		return fmt.Errorf("read size: %d %s", n, err)
+	}
+	if n == 1 {
+		return fmt.Errorf("list snapshots: %s", snapshotErr(syscall.Errno(data[0])))
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(f, data); err != nil {
+		return fmt.Errorf("read snapshots: %s", err)
+	}
+	var snapshots []*meta.Snapshot
+	if err = json.Unmarshal(data, &snapshots); err != nil {
+		return fmt.Errorf("decode snapshots: %s", err)
+	}
+	if ctx.Bool("json") {
+		printJson(snapshots)
+		return nil
+	}
+	fmt.Printf("%-30s %-20s %s\n", "NAME", "CREATED", "PATH")
+	for _, s := range snapshots {
+		fmt.Printf("%-30s %-20s %s\n", s.Name, s.Created.Format("2006-01-02 15:04:05"), s.Path)
+	}
+	return nil
+}
+
+func snapshotRollback(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	if err := snapshotDo(ctx.Args().Get(0), meta.SnapshotRollback, ctx.String("name"), 0); err != nil {
+		return fmt.Errorf("rollback to snapshot %s: %s", ctx.String("name"), err)
+	}
+	return nil
+}
+
+func snapshotDelete(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	if err := snapshotDo(ctx.Args().Get(0), meta.SnapshotDelete, ctx.String("name"), 0); err != nil {
+		return fmt.Errorf("delete snapshot %s: %s", ctx.String("name"), err)
+	}
+	return nil
+}
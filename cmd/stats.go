@@ -103,6 +103,7 @@ func (w *statsWatcher) buildSchema(schema string, verbosity uint) {
 			s.items = append(s.items, &item{"cpu", "juicefs_cpu_usage", metricCPU | metricCounter})
 			s.items = append(s.items, &item{"mem", "juicefs_memory", metricGauge})
 			s.items = append(s.items, &item{"buf", "juicefs_used_buffer_size_bytes", metricGauge})
+			s.items = append(s.items, &item{"upload", "juicefs_upload_buffer_bytes", metricGauge})
 			if verbosity > 0 {
 				s.items = append(s.items, &item{"cache", "juicefs_store_cache_size_bytes", metricGauge})
 			}
@@ -111,22 +112,39 @@ func (w *statsWatcher) buildSchema(schema string, verbosity uint) {
 			s.items = append(s.items, &item{"ops", "juicefs_fuse_ops_durations_histogram_seconds", metricTime | metricHist})
 			s.items = append(s.items, &item{"read", "juicefs_fuse_read_size_bytes_sum", metricByte | metricCounter})
 			s.items = append(s.items, &item{"write", "juicefs_fuse_written_size_bytes_sum", metricByte | metricCounter})
+			if verbosity > 0 {
+				s.items = append(s.items, &item{"comb", "juicefs_fuse_combined_writes", metricCount | metricCounter})
+				s.items = append(s.items, &item{"slice", "juicefs_fuse_flushed_slices", metricCount | metricCounter})
+			}
 		case 'm':
 			s.name = "meta"
 			s.items = append(s.items, &item{"ops", "juicefs_meta_ops_durations_histogram_seconds", metricTime | metricHist})
 			if verbosity > 0 {
 				s.items = append(s.items, &item{"txn", "juicefs_transaction_durations_histogram_seconds", metricTime | metricHist})
 				s.items = append(s.items, &item{"retry", "juicefs_transaction_restart", metricCount | metricCounter})
+				s.items = append(s.items, &item{"again", "juicefs_transaction_conflict_failures", metricCount | metricCounter})
+				s.items = append(s.items, &item{"stale", "juicefs_fuse_stale_reads", metricCount | metricCounter})
+				s.items = append(s.items, &item{"down", "juicefs_meta_degraded", metricGauge})
+				s.items = append(s.items, &item{"pause", "juicefs_meta_background_paused", metricGauge})
+				s.items = append(s.items, &item{"reval", "juicefs_meta_revalidated_chunks", metricCount | metricCounter})
+				s.items = append(s.items, &item{"drop", "juicefs_meta_stale_chunks", metricCount | metricCounter})
 			}
 		case 'c':
 			s.name = "blockcache"
 			s.items = append(s.items, &item{"read", "juicefs_blockcache_hit_bytes", metricByte | metricCounter})
 			s.items = append(s.items, &item{"write", "juicefs_blockcache_write_bytes", metricByte | metricCounter})
+			if verbosity > 0 {
+				s.items = append(s.items, &item{"pin", "juicefs_blockcache_pinned_bytes", metricGauge})
+				s.items = append(s.items, &item{"bypass", "juicefs_blockcache_bypass_bytes", metricByte | metricCounter})
+				s.items = append(s.items, &item{"bypass_w", "juicefs_blockcache_bypass_write_bytes", metricByte | metricCounter})
+				s.items = append(s.items, &item{"fail", "juicefs_blockcache_failed_dirs", metricGauge})
+			}
 		case 'o':
 			s.name = "object"
 			s.items = append(s.items, &item{"get", "juicefs_object_request_data_bytes_GET", metricByte | metricCounter})
 			if verbosity > 0 {
 				s.items = append(s.items, &item{"get_c", "juicefs_object_request_durations_histogram_seconds_GET", metricTime | metricHist})
+				s.items = append(s.items, &item{"coal", "juicefs_object_request_coalesced", metricCount | metricCounter})
 			}
 			s.items = append(s.items, &item{"put", "juicefs_object_request_data_bytes_PUT", metricByte | metricCounter})
 			if verbosity > 0 {
@@ -27,6 +27,7 @@ import (
 type sections struct {
 	Setting  *meta.Format
 	Sessions []*meta.Session
+	Health   *meta.Health
 }
 
 func printJson(v interface{}) {
@@ -65,7 +66,7 @@ func status(ctx *cli.Context) error {
 		logger.Fatalf("list sessions: %s", err)
 	}
 
-	printJson(&sections{format, sessions})
+	printJson(&sections{format, sessions, m.CheckHealth()})
 	return nil
 }
 
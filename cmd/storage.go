@@ -0,0 +1,264 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/urfave/cli/v2"
+)
+
+// objectFlags are the options of the clients of object storage.
+func objectFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ca-cert",
+			Usage: "path to a CA bundle (PEM) to verify the certificates of object storage",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure-skip-verify",
+			Usage: "skip verifying the certificates of object storage (insecure)",
+		},
+		&cli.BoolFlag{
+			Name:  "http2",
+			Usage: "attempt HTTP/2 to HTTPS endpoints of object storage, which multiplexes requests in fewer connections",
+		},
+		&cli.IntFlag{
+			Name:  "max-idle-conns",
+			Value: 500,
+			Usage: "max number of idle connections kept for reuse per host of object storage",
+		},
+		&cli.IntFlag{
+			Name:  "max-conns",
+			Value: 0,
+			Usage: "max number of connections per host of object storage (0 means unlimited)",
+		},
+		&cli.DurationFlag{
+			Name:  "idle-conn-timeout",
+			Value: time.Minute * 5,
+			Usage: "timeout of idle connections to object storage",
+		},
+		&cli.DurationFlag{
+			Name:  "dial-timeout",
+			Value: time.Second * 10,
+			Usage: "timeout to establish the connections to object storage",
+		},
+		&cli.DurationFlag{
+			Name:  "header-timeout",
+			Value: time.Second * 30,
+			Usage: "timeout to receive the response header after a request is sent to object storage",
+		},
+		&cli.DurationFlag{
+			Name:  "body-timeout",
+			Usage: "timeout of no progress in sending or receiving the body of a request to object storage (0 means unlimited)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "op-timeout",
+			Usage: "timeouts of a type of requests (head, get, list, put, delete or multipart) to object storage in format of OP:KEY=DURATION[,KEY=DURATION] with keys connect, header and body, e.g. multipart:header=2m, it can be repeated",
+		},
+		&cli.BoolFlag{
+			Name:  "upload-checksum",
+			Usage: "send the checksum of uploaded objects to be verified by object storage (OSS, COS and GCS, it is always sent for S3)",
+		},
+	}
+}
+
+// storageFlags are the options of the object storage of a volume, for the commands accessing it.
+func storageFlags() []cli.Flag {
+	return append(objectFlags(),
+		&cli.StringFlag{
+			Name:  "read-retry",
+			Value: "3,100ms",
+			Usage: "retries and the initial backoff (doubled for every retry) of failed HEAD, GET and LIST requests to object storage",
+		},
+		&cli.StringFlag{
+			Name:  "write-retry",
+			Value: "1,1s",
+			Usage: "retries and the initial backoff of failed PUT and DELETE requests to object storage",
+		},
+		&cli.StringFlag{
+			Name:  "multipart-retry",
+			Value: "2,1s",
+			Usage: "retries and the initial backoff of failed requests of multipart uploads",
+		},
+		&cli.StringFlag{
+			Name:  "fallback-bucket",
+			Usage: "read-only copy of the bucket (in the same storage type) to read objects from when they can't be read from the primary one",
+		},
+		&cli.StringFlag{
+			Name:    "fallback-access-key",
+			EnvVars: []string{"JFS_FALLBACK_ACCESS_KEY"},
+			Usage:   "access key of the fallback bucket (default: the one of the volume)",
+		},
+		&cli.StringFlag{
+			Name:    "fallback-secret-key",
+			EnvVars: []string{"JFS_FALLBACK_SECRET_KEY"},
+			Usage:   "secret key of the fallback bucket (default: the one of the volume)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "replica-bucket",
+			Usage: "replica of the bucket in another region (in the same storage type, with the same credentials), the objects are read from the nearest healthy one among the bucket and the replicas, and written into the bucket only, it can be repeated",
+		},
+		&cli.DurationFlag{
+			Name:  "endpoint-probe-interval",
+			Value: time.Second * 30,
+			Usage: "interval to probe the latency and health of the bucket and its replicas (with --replica-bucket)",
+		},
+		&cli.StringFlag{
+			Name:  "sse",
+			Usage: "ask the object storage to encrypt the objects at rest with the keys managed by it (s3) or by KMS (kms), only supported by S3 and the compatible ones",
+		},
+		&cli.StringFlag{
+			Name:  "sse-kms-key-id",
+			Usage: "ID or ARN of the KMS key to encrypt the objects with (--sse kms), the default key of the account if empty",
+		},
+		&cli.StringFlag{
+			Name:    "object-request-log",
+			EnvVars: []string{"JFS_OBJECT_REQUEST_LOG"},
+			Usage:   "file to log every request to object storage (method, key, bytes, duration and result), \"-\" for stderr",
+		},
+	)
+}
+
+// objectConfig is the config of the clients of object storage, from objectFlags.
+type objectConfig struct {
+	caCert             string
+	insecureSkipVerify bool
+	transport          object.TransportConfig
+	timeouts           object.TimeoutConfig
+	uploadChecksum     bool
+}
+
+// newObjectConfig parses objectFlags, and sets up the HTTP clients of object storage with them,
+// which are shared by all the storages in the process.
+func newObjectConfig(c *cli.Context) (*objectConfig, error) {
+	conf := &objectConfig{
+		caCert:             c.String("ca-cert"),
+		insecureSkipVerify: c.Bool("insecure-skip-verify"),
+		transport: object.TransportConfig{
+			HTTP2:               c.Bool("http2"),
+			MaxIdleConnsPerHost: c.Int("max-idle-conns"),
+			MaxConnsPerHost:     c.Int("max-conns"),
+			IdleConnTimeout:     c.Duration("idle-conn-timeout"),
+			DialTimeout:         c.Duration("dial-timeout"),
+		},
+		timeouts:       object.TimeoutConfig{Default: object.Timeouts{Header: c.Duration("header-timeout"), Body: c.Duration("body-timeout")}},
+		uploadChecksum: c.Bool("upload-checksum"),
+	}
+	for _, s := range c.StringSlice("op-timeout") {
+		op, t, err := object.ParseOpTimeouts(s)
+		if err != nil {
+			return nil, fmt.Errorf("--op-timeout: %s", err)
+		}
+		if conf.timeouts.Ops == nil {
+			conf.timeouts.Ops = make(map[string]object.Timeouts)
+		}
+		conf.timeouts.Ops[op] = t
+	}
+	if err := object.SetTransportConfig(conf.transport); err != nil {
+		return nil, err
+	}
+	if err := object.SetTimeoutConfig(conf.timeouts); err != nil {
+		return nil, err
+	}
+	if err := object.SetTLSConfig(conf.caCert, conf.insecureSkipVerify); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// setup applies the settings of every storage to store.
+func (conf *objectConfig) setup(store object.ObjectStorage) error {
+	if conf.uploadChecksum {
+		if err := object.SetUploadChecksum(store, true); err != nil && !object.IsNotSupported(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// storageConfig is the config of the object storage of a volume, from storageFlags.
+type storageConfig struct {
+	objectConfig
+	retries object.RetryConfig
+	// the copy of the bucket to read from when the primary one fails
+	fallback struct {
+		bucket, accessKey, secretKey string
+	}
+	// the replicas of the bucket in other regions to read from
+	replicas      []string
+	probeInterval time.Duration
+	// the server-side encryption of the objects
+	sse, kmsKeyID  string
+	requestLog     *object.RequestLog
+	requestLogFile *os.File
+}
+
+// newStorageConfig parses storageFlags, and sets up the HTTP clients of object storage with them.
+// It should be closed to write the summary of the request log.
+func newStorageConfig(c *cli.Context) (*storageConfig, error) {
+	oc, err := newObjectConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	conf := &storageConfig{objectConfig: *oc}
+	for _, r := range []struct {
+		flag   string
+		policy *object.RetryPolicy
+	}{{"read-retry", &conf.retries.Read}, {"write-retry", &conf.retries.Write}, {"multipart-retry", &conf.retries.Multipart}} {
+		if *r.policy, err = object.ParseRetryPolicy(c.String(r.flag)); err != nil {
+			return nil, fmt.Errorf("--%s: %s", r.flag, err)
+		}
+	}
+	conf.fallback.bucket, conf.fallback.accessKey, conf.fallback.secretKey = c.String("fallback-bucket"), c.String("fallback-access-key"), c.String("fallback-secret-key")
+	conf.replicas, conf.probeInterval = c.StringSlice("replica-bucket"), c.Duration("endpoint-probe-interval")
+	conf.sse, conf.kmsKeyID = c.String("sse"), c.String("sse-kms-key-id")
+	if conf.sse != "" && conf.sse != "s3" && conf.sse != "kms" {
+		return nil, fmt.Errorf("invalid --sse: %s, should be s3 or kms", conf.sse)
+	}
+	if conf.kmsKeyID != "" && conf.sse != "kms" {
+		return nil, fmt.Errorf("--sse-kms-key-id is only used with --sse kms")
+	}
+	if path := c.String("object-request-log"); path != "" {
+		conf.requestLogFile = os.Stderr
+		if path != "-" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("open request log %s: %s", path, err)
+			}
+			conf.requestLogFile = f
+		}
+		conf.requestLog = object.NewRequestLog(conf.requestLogFile)
+	}
+	return conf, nil
+}
+
+// close writes the summary of requests into the request log.
+func (conf *storageConfig) close() {
+	if conf.requestLog == nil {
+		return
+	}
+	_, _ = fmt.Fprintln(conf.requestLogFile, "Summary of object requests:")
+	conf.requestLog.Summary(conf.requestLogFile)
+	if conf.requestLogFile != os.Stderr {
+		_ = conf.requestLogFile.Close()
+	}
+	conf.requestLog = nil
+}
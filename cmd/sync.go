@@ -175,11 +175,64 @@ SRC and DST should be [NAME://][ACCESS_KEY:SECRET_KEY@]BUCKET[.ENDPOINT][/PREFIX
 func doSync(c *cli.Context) error {
 	setLoggerLevel(c)
 
+	config := sync.NewConfigFromCli(c)
+	oconf, err := newObjectConfig(c)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	if config.VerifyManifest != "" && (c.Args().Len() == 1 || c.Args().Len() == 2) {
+		// SRC is not needed
+		dstURL := strings.Replace(c.Args().Get(c.Args().Len()-1), "\\", "/", -1)
+		dst, err := createSyncStorage(dstURL, config)
+		if err != nil {
+			return err
+		}
+		if err = oconf.setup(dst); err != nil {
+			return err
+		}
+		return sync.VerifyManifest(dst, config)
+	}
 	if c.Args().Len() != 2 {
 		logger.Errorf(USAGE)
 		return nil
 	}
-	config := sync.NewConfigFromCli(c)
+	if config.TwoWay {
+		if config.DeleteSrc || config.DeleteDst || config.Workers != nil {
+			logger.Fatalf("--two-way can't be used with --delete-src, --delete-dst or --worker")
+		}
+		switch config.Conflict {
+		case sync.ConflictNewer, sync.ConflictLarger, sync.ConflictKeepBoth:
+		default:
+			logger.Fatalf("invalid conflict policy: %s", config.Conflict)
+		}
+	}
+	if config.Links && c.Bool("copy-links") {
+		logger.Fatalf("--links can't be used with --copy-links")
+	}
+	if config.Links && config.TwoWay {
+		logger.Fatalf("--links can't be used with --two-way")
+	}
+	if config.ListOnly && config.Plan == "" {
+		logger.Fatalf("--list-only requires --plan to write the actions into")
+	}
+	if config.Plan != "" && (config.TwoWay || config.Workers != nil) {
+		logger.Fatalf("--list-only and --plan can't be used with --two-way or --worker")
+	}
+	if (config.Failures != "" || config.RetryFrom != "") && (config.TwoWay || config.Workers != nil || config.ListOnly) {
+		logger.Fatalf("--failures-file and --retry-failures can't be used with --two-way, --worker or --list-only")
+	}
+	if config.Manifest != "" && (config.TwoWay || config.ListOnly) {
+		logger.Fatalf("--manifest can't be used with --two-way or --list-only")
+	}
+	if (config.MaxObjects > 0 || config.MaxBytes > 0) && (config.TwoWay || config.ListOnly) {
+		logger.Fatalf("--max-objects and --max-bytes can't be used with --two-way or --list-only")
+	}
+	if config.StructureOnly && (config.TwoWay || config.DeleteSrc || config.CheckAll || config.CheckNew || config.VerifyAfter || config.Compress || config.Decompress) {
+		logger.Fatalf("--structure-only can't be used with --two-way, --delete-src, --check-all, --check-new, --verify-after, --compress or --decompress")
+	}
+	if config.RetryFrom != "" && config.Plan != "" {
+		logger.Fatalf("--retry-failures can't be used with --plan")
+	}
 	go func() { _ = http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", config.HTTPPort), nil) }()
 
 	// Windows support `\` and `/` as its separator, Unix only use `/`
@@ -196,6 +249,11 @@ func doSync(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	for _, store := range []object.ObjectStorage{src, dst} {
+		if err = oconf.setup(store); err != nil {
+			return err
+		}
+	}
 	return sync.Sync(src, dst, config)
 }
 
@@ -205,7 +263,7 @@ func syncFlags() *cli.Command {
 		Usage:     "sync between two storage",
 		ArgsUsage: "SRC DST",
 		Action:    doSync,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:    "start",
 				Aliases: []string{"s"},
@@ -243,10 +301,24 @@ func syncFlags() *cli.Command {
 				Name:  "perms",
 				Usage: "preserve permissions",
 			},
+			&cli.BoolFlag{
+				Name:  "xattrs",
+				Usage: "preserve extended attributes (including POSIX ACLs kept in them), they are kept in the metadata for object storage",
+			},
 			&cli.BoolFlag{
 				Name:  "dirs",
 				Usage: "Sync directories or holders",
 			},
+			&cli.BoolFlag{
+				Name:    "links",
+				Aliases: []string{"l"},
+				Usage:   "copy symlinks as symlinks, the target is kept in the metadata for object storage",
+			},
+			&cli.BoolFlag{
+				Name:    "copy-links",
+				Aliases: []string{"L"},
+				Usage:   "follow symlinks and copy the files they point to (default)",
+			},
 			&cli.BoolFlag{
 				Name:  "dry",
 				Usage: "Don't copy file",
@@ -269,6 +341,10 @@ func syncFlags() *cli.Command {
 				Name:  "include",
 				Usage: "only include keys containing `PATTERN` (POSIX regular expressions)",
 			},
+			&cli.StringFlag{
+				Name:  "exclude-from",
+				Usage: "exclude keys matching the patterns in `FILE` (the format of .gitignore)",
+			},
 			&cli.StringFlag{
 				Name:  "manager",
 				Usage: "manager address",
@@ -277,10 +353,26 @@ func syncFlags() *cli.Command {
 				Name:  "worker",
 				Usage: "hosts (seperated by comma) to launch worker",
 			},
+			&cli.StringFlag{
+				Name:  "worker-id",
+				Usage: "id of the worker, a restarted worker with the same id resumes its unfinished objects (default: hostname)",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "save the objects in progress of workers into this `FILE` in the manager, to resume them when the sync is started again",
+			},
 			&cli.IntFlag{
 				Name:  "bwlimit",
 				Usage: "limit bandwidth in Mbps (0 means unlimited)",
 			},
+			&cli.Int64Flag{
+				Name:  "max-objects",
+				Usage: "stop copying new objects after this number of objects are copied in this run, the rest are deferred to the next run (0 means unlimited)",
+			},
+			&cli.Int64Flag{
+				Name:  "max-bytes",
+				Usage: "stop copying new objects after this amount of data in bytes is copied in this run, the rest are deferred to the next run (0 means unlimited)",
+			},
 			&cli.BoolFlag{
 				Name:  "no-https",
 				Usage: "donot use HTTPS",
@@ -293,6 +385,67 @@ func syncFlags() *cli.Command {
 				Name:  "check-new",
 				Usage: "verify integrity of newly copied files",
 			},
-		},
+			&cli.BoolFlag{
+				Name:  "verify-after",
+				Usage: "read every copied file back from destination to compare with source, and copy it again (up to 3 times) if they are different",
+			},
+			&cli.BoolFlag{
+				Name:  "two-way",
+				Usage: "propagate changes of files (not directories) in both directions since last sync",
+			},
+			&cli.StringFlag{
+				Name:  "conflict",
+				Value: "newer",
+				Usage: "policy for files changed in both sides in two-way mode: newer, larger or keep-both (keep the other one with a suffix)",
+			},
+			&cli.StringFlag{
+				Name:  "state-file",
+				Usage: "path of the state of last two-way sync (default: ~/.juicefs/sync/<hash of SRC and DST>.json)",
+			},
+			&cli.BoolFlag{
+				Name:  "list-only",
+				Usage: "write the actions to sync into the plan file (--plan) without transferring anything",
+			},
+			&cli.StringFlag{
+				Name:  "plan",
+				Usage: "execute the actions in the plan file written by --list-only, the objects copied are skipped if run again",
+			},
+			&cli.StringFlag{
+				Name:  "failures-file",
+				Usage: "record the objects failed after retries into the file, instead of only counting them",
+			},
+			&cli.StringFlag{
+				Name:  "retry-failures",
+				Usage: "sync only the failed objects recorded in the file by --failures-file",
+			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: "compress objects with gzip when copying them into the destination",
+			},
+			&cli.BoolFlag{
+				Name:  "decompress",
+				Usage: "decompress objects (compressed with gzip) when copying them into the destination",
+			},
+			&cli.StringFlag{
+				Name:  "rewrite-key",
+				Usage: "rewrite the keys in destination by `PATTERN:REPLACEMENT`, the pattern (regular expression) matches the beginning of keys, ${1} refers to its first group",
+			},
+			&cli.BoolFlag{
+				Name:  "at-most-once",
+				Usage: "skip the temporary files (.NAME.tmp*) of partial writes, remove the ones left in destination by interrupted syncs and abort the stale multipart uploads",
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "write the sizes and SHA256 of the objects in destination into the file after syncing, only the changed ones are hashed again if it exists",
+			},
+			&cli.BoolFlag{
+				Name:  "structure-only",
+				Usage: "create the directories and empty files in destination without copying any data, keeping the mtime (and permissions with --perms)",
+			},
+			&cli.StringFlag{
+				Name:  "verify-manifest",
+				Usage: "read the objects in DST again and verify them with the manifest in the file, instead of syncing",
+			},
+		}, objectFlags()...),
 	}
 }
@@ -18,9 +18,21 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -29,68 +41,563 @@ import (
 
 const batchMax = 10240
 
+var phasedOnce sync.Once
+
+// fillCacheReply is the reply of a fill-cache command.
+type fillCacheReply struct {
+	status  uint8     // meta.FillCacheOK, or the error (meta.FillCacheAgain for transient errors)
+	skipped uint64    // paths skipped because they are being deleted
+	threads uint16    // threads used by the controller, 0 if it's mounted by an old version which doesn't report it
+	old     uint64    // files skipped because they are modified before after (if not zero)
+	sizes   []uint64  // bytes warmed up for every path, nil if it's not reported
+	phases  [2]uint64 // files done in the metadata and data phases (with meta.FillCachePhased)
+}
+
 // send fill-cache command to controller file
-func sendCommand(cf *os.File, batch []string, count int, threads uint, background bool) {
+func sendCommand(cf *os.File, batch []string, count int, threads uint, background bool, flags uint8, after time.Time) fillCacheReply {
 	paths := strings.Join(batch[:count], "\n")
 	var back uint8
 	if background {
 		back = 1
 	}
-	wb := utils.NewBuffer(8 + 4 + 3 + uint32(len(paths)))
+	if !after.IsZero() {
+		flags |= meta.FillCacheAfter
+	}
+	size := 4 + 4 + uint32(len(paths))
+	if flags&meta.FillCacheAfter != 0 {
+		size += 8
+	}
+	wb := utils.NewBuffer(8 + size)
 	wb.Put32(meta.FillCache)
-	wb.Put32(4 + 3 + uint32(len(paths)))
+	wb.Put32(size)
 	wb.Put32(uint32(len(paths)))
 	wb.Put([]byte(paths))
 	wb.Put16(uint16(threads))
 	wb.Put8(back)
+	wb.Put8(flags)
+	if flags&meta.FillCacheAfter != 0 {
+		wb.Put64(uint64(after.UnixNano()))
+	}
 	if _, err := cf.Write(wb.Bytes()); err != nil {
-		logger.Fatalf("Write message: %s", err)
+		logger.Errorf("Write message: %s", err)
+		return fillCacheReply{status: uint8(syscall.EIO)}
+	}
+	var tail int // the part after the stats, which may not fit in one read
+	if flags&meta.FillCacheSizes != 0 {
+		tail += 4 + 8*count
+	}
+	if flags&meta.FillCachePhased != 0 {
+		tail += 8 + 8
+	}
+	var resp = make([]byte, 1+8+2+8+tail)
+	n, err := cf.Read(resp)
+	if err != nil || n < 1 {
+		logger.Errorf("Read message: %d %s", n, err)
+		return fillCacheReply{status: uint8(syscall.EIO)}
+	}
+	if resp[0] == meta.FillCacheInvalid && flags&meta.FillCachePhased != 0 {
+		phasedOnce.Do(func() {
+			logger.Warnf("--prefetch-metadata-first is not supported by the mount point, warm up in one phase")
+		})
+		return sendCommand(cf, batch, count, threads, background, flags&^meta.FillCachePhased, after)
+	}
+	if resp[0] == meta.FillCacheInvalid && flags&meta.FillCacheSizes != 0 {
+		// mounted by an old version, which doesn't report the sizes
+		return sendCommand(cf, batch, count, threads, background, flags&^meta.FillCacheSizes, after)
+	}
+	if resp[0] == meta.FillCacheInvalid && flags&meta.FillCacheErrors != 0 {
+		// mounted by an old version, which doesn't report the failures
+		return sendCommand(cf, batch, count, threads, background, flags&^meta.FillCacheErrors, after)
+	}
+	if resp[0] == meta.FillCacheInvalid && flags&meta.FillCacheAfter != 0 {
+		logger.Fatalf("--after is not supported by the mount point, please upgrade it")
+	}
+	if resp[0] == meta.FillCacheInvalid && flags&meta.FillCacheThreads != 0 {
+		// mounted by an old version, which rejects unknown flags
+		return sendCommand(cf, batch, count, threads, background, flags&^meta.FillCacheThreads, after)
+	}
+	if resp[0] != meta.FillCacheOK {
+		return fillCacheReply{status: resp[0]}
 	}
 	if background {
 		logger.Infof("Warm-up cache for %d paths in backgroud", count)
+	}
+	// mounted by an old version, no stats or threads
+	rb := utils.ReadBuffer(resp[1:n])
+	var reply fillCacheReply
+	if rb.Left() >= 8 && flags&meta.FillCacheStats != 0 {
+		reply.skipped = rb.Get64()
+	}
+	if rb.Left() >= 2 && flags&meta.FillCacheThreads != 0 {
+		reply.threads = rb.Get16()
+	}
+	if rb.Left() >= 8 && flags&meta.FillCacheAfter != 0 {
+		reply.old = rb.Get64()
+	}
+	if left := tail - rb.Left(); tail > 0 && left > 0 {
+		if m, err := io.ReadFull(cf, resp[n:n+left]); err != nil {
+			logger.Errorf("Read message: %d %s", n+m, err)
+			return fillCacheReply{status: uint8(syscall.EIO)}
+		}
+		rb = utils.ReadBuffer(resp[n-rb.Left() : n+left])
+	}
+	if flags&meta.FillCacheSizes != 0 {
+		reply.sizes = make([]uint64, rb.Get32())
+		for i := range reply.sizes {
+			reply.sizes[i] = rb.Get64()
+		}
+	}
+	if flags&meta.FillCachePhased != 0 {
+		reply.phases[0], reply.phases[1] = rb.Get64(), rb.Get64()
+	}
+	return reply
+}
+
+type warmedPath struct {
+	Path  string `json:"path"`
+	Bytes uint64 `json:"bytes"`
+}
+
+type warmupSummary struct {
+	Warmed   int64        `json:"warmed"`
+	Skipped  int64        `json:"skipped"`
+	Failed   int64        `json:"failed"`
+	Missing  int64        `json:"missing,omitempty"`
+	Old      int64        `json:"old,omitempty"`
+	Cached   int64        `json:"cached,omitempty"` // paths skipped by --only-missing
+	Bytes    uint64       `json:"bytes"`
+	Batches  int          `json:"batches"`
+	Elapsed  float64      `json:"elapsed"`    // in seconds
+	Speed    float64      `json:"throughput"` // in MiB/s
+	Sizes    []warmedPath `json:"sizes,omitempty"`
+	Attrs    uint64       `json:"attrs,omitempty"`    // inodes loaded into the inode cache by --attr-cache
+	Parents  uint64       `json:"parents,omitempty"`  // entries along the paths loaded by --warm-parents
+	Dentries uint64       `json:"dentries,omitempty"` // entries looked up into the kernel by --dentry
+	Running  bool         `json:"running,omitempty"`  // skipped as another warmup is running, by --if-running=skip
+
+	Replay *replayCoverage `json:"replay,omitempty"` // the access log replayed by --from-access-log
+
+	Mount   string           `json:"mount,omitempty"` // only with multiple mount points
+	Error   string           `json:"error,omitempty"`
+	Mounts  []*warmupSummary `json:"mounts,omitempty"`
+	noSizes bool             // not reported by the mount point
+}
+
+// warmupEvent is sent to --progress-socket as a line of JSON.
+type warmupEvent struct {
+	Event   string `json:"event"`           // start, batch or done
+	Mount   string `json:"mount,omitempty"` // only with multiple mount points
+	Time    int64  `json:"time"`
+	Total   int    `json:"total"` // number of paths to warm up
+	First   string `json:"first,omitempty"`
+	Paths   int    `json:"paths,omitempty"` // in the batch
+	Error   string `json:"error,omitempty"`
+	Warmed  int64  `json:"warmed"` // the counters below are accumulated
+	Skipped int64  `json:"skipped"`
+	Failed  int64  `json:"failed"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// progressWriter sends the events of warmup to a unix socket or named pipe, the events are
+// dropped once it fails or the reader is too slow, so the warmup won't be affected.
+type progressWriter struct {
+	sync.Mutex
+	path string
+	w    interface {
+		io.WriteCloser
+		SetWriteDeadline(t time.Time) error
+	}
+	enc *json.Encoder
+}
+
+func newProgressWriter(path string) *progressWriter {
+	pw := &progressWriter{path: path}
+	var err error
+	if fi, e := os.Stat(path); e == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		pw.w, err = os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	} else {
+		pw.w, err = net.DialTimeout("unix", path, time.Second)
+	}
+	if err != nil {
+		logger.Warnf("Open progress socket %s: %s, no progress will be sent", path, err)
+		return nil
+	}
+	pw.enc = json.NewEncoder(pw.w)
+	return pw
+}
+
+func (pw *progressWriter) send(e *warmupEvent) {
+	if pw == nil {
 		return
 	}
-	var errs = make([]byte, 1)
-	if n, err := cf.Read(errs); err != nil || n != 1 {
-		logger.Fatalf("Read message: %d %s", n, err)
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.w == nil {
+		return
 	}
-	if errs[0] != 0 {
-		logger.Fatalf("Warm up failed: %d", errs[0])
+	e.Time = time.Now().Unix()
+	_ = pw.w.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := pw.enc.Encode(e); err != nil {
+		logger.Warnf("Send progress to %s: %s, no more progress will be sent", pw.path, err)
+		_ = pw.w.Close()
+		pw.w = nil
 	}
 }
 
-func warmup(ctx *cli.Context) error {
-	fname := ctx.String("file")
-	paths := ctx.Args().Slice()
-	if fname != "" {
-		fd, err := os.Open(fname)
-		if err != nil {
-			logger.Fatalf("Failed to open file %s: %s", fname, err)
+func (pw *progressWriter) close() {
+	if pw == nil {
+		return
+	}
+	pw.Lock()
+	defer pw.Unlock()
+	if pw.w != nil {
+		_ = pw.w.Close()
+		pw.w = nil
+	}
+}
+
+// sortWarmed returns the paths sorted by the bytes warmed up in descending order.
+func sortWarmed(warmed map[string]uint64) []warmedPath {
+	var r []warmedPath
+	for p, n := range warmed {
+		r = append(r, warmedPath{p, n})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Bytes != r[j].Bytes {
+			return r[i].Bytes > r[j].Bytes
 		}
-		defer fd.Close()
-		scanner := bufio.NewScanner(fd)
-		for scanner.Scan() {
-			if p := strings.TrimSpace(scanner.Text()); p != "" {
-				paths = append(paths, p)
+		return r[i].Path < r[j].Path
+	})
+	return r
+}
+
+// human readable bytes size
+func formatSize(bytes uint64) string {
+	units := [7]string{" ", "K", "M", "G", "T", "P", "E"}
+	if bytes < 1024 {
+		return fmt.Sprintf("%v B", bytes)
+	}
+	z := 0
+	v := float64(bytes)
+	for v > 1024.0 {
+		z++
+		v /= 1024.0
+	}
+	return fmt.Sprintf("%.2f %siB", v, units[z])
+}
+
+func printWarmed(w io.Writer, s *warmupSummary) {
+	fmt.Fprintln(w, "SIZE\tBYTES\tPATH")
+	for _, p := range s.Sizes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", formatSize(p.Bytes), p.Bytes, p.Path)
+	}
+	fmt.Fprintf(w, "%s\t%d\tTOTAL\n", formatSize(s.Bytes), s.Bytes)
+}
+
+// throughput fills the throughput of warmup in the summary, and returns it in a line.
+func throughput(s *warmupSummary, elapsed time.Duration) string {
+	s.Elapsed = elapsed.Seconds()
+	if s.Elapsed > 0 {
+		s.Speed = float64(s.Bytes) / (1 << 20) / s.Elapsed
+	}
+	return fmt.Sprintf("Warmed up %s in %s with %d batches, throughput: %.2f MiB/s",
+		formatSize(s.Bytes), elapsed.Round(time.Millisecond), s.Batches, s.Speed)
+}
+
+// retryBatch calls send until it succeeds or fails with a terminal error, a batch failed with
+// transient errors is sent again up to retries times with a backoff, returns the last status.
+func retryBatch(retries int, backoff time.Duration, send func() uint8) uint8 {
+	st := send()
+	for i := 0; i < retries && st == meta.FillCacheAgain; i++ {
+		time.Sleep(backoff * time.Duration(i+1))
+		st = send()
+	}
+	return st
+}
+
+// dispatch splits the paths into batches, and calls send with up to n batches in flight,
+// worker is the index of the caller in [0, n).
+func dispatch(paths []string, n int, send func(worker int, batch []string)) {
+	batches := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for batch := range batches {
+				send(worker, batch)
 			}
+		}(i)
+	}
+	for i := 0; i < len(paths); i += batchMax {
+		end := i + batchMax
+		if end > len(paths) {
+			end = len(paths)
 		}
-		if err := scanner.Err(); err != nil {
-			logger.Fatalf("Reading file %s failed with error: %s", fname, err)
+		batches <- paths[i:end]
+	}
+	close(batches)
+	wg.Wait()
+}
+
+// groupBySize reorders the paths so that the batches split by dispatch have similar sizes: the
+// paths are dealt from the largest one to the batches in turn, the larger ones come first in
+// every batch so they're not left to the end of the threads.
+func groupBySize(paths []string, sizes []uint64) []string {
+	idx := make([]int, len(paths))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return sizes[idx[i]] > sizes[idx[j]] })
+	n := (len(paths) + batchMax - 1) / batchMax
+	batches := make([][]string, n)
+	j := 0
+	for _, i := range idx {
+		// only the last batch could be shorter
+		for len(batches[j]) == batchMax || j == n-1 && len(batches[j]) == len(paths)-(n-1)*batchMax {
+			j = (j + 1) % n
 		}
+		batches[j] = append(batches[j], paths[i])
+		j = (j + 1) % n
 	}
-	if len(paths) == 0 {
-		logger.Infof("Nothing to warm up")
-		return nil
+	r := make([]string, 0, len(paths))
+	for _, b := range batches {
+		r = append(r, b...)
 	}
+	return r
+}
 
-	// find mount point
-	first, err := filepath.Abs(paths[0])
+// pathSizes returns the sizes of the paths under mount point mp, files are stated by the threads,
+// the total length of a directory is queried from the controller (0 if it's not supported).
+func pathSizes(cf *os.File, mp string, paths []string, threads int) []uint64 {
+	sizes := make([]uint64, len(paths))
+	dirs := make([]bool, len(paths))
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				fi, err := os.Stat(filepath.Join(mp, paths[i]))
+				if err != nil {
+					logger.Warnf("Failed to stat %s: %s", paths[i], err)
+				} else if fi.IsDir() {
+					dirs[i] = true
+				} else {
+					sizes[i] = uint64(fi.Size())
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+	for i, dir := range dirs {
+		if dir {
+			_, _, size, ok := queryCacheSpace(cf, paths[i:i+1])
+			if !ok {
+				logger.Warnf("The size of directories is not reported by the mount point, please upgrade it")
+				break
+			}
+			sizes[i] = size
+		}
+	}
+	return sizes
+}
+
+// queryCacheSpace returns the capacity and free space of cache, and the total size of the paths,
+// ok is false if it's mounted by an old version.
+func queryCacheSpace(cf *os.File, paths []string) (capacity, free, size uint64, ok bool) {
+	for i := 0; i < len(paths) || i == 0; i += batchMax {
+		end := i + batchMax
+		if end > len(paths) {
+			end = len(paths)
+		}
+		data := strings.Join(paths[i:end], "\n")
+		wb := utils.NewBuffer(8 + 4 + uint32(len(data)))
+		wb.Put32(meta.CacheSpace)
+		wb.Put32(4 + uint32(len(data)))
+		wb.Put32(uint32(len(data)))
+		wb.Put([]byte(data))
+		if _, err := cf.Write(wb.Bytes()); err != nil {
+			logger.Fatalf("Write message: %s", err)
+		}
+		var resp = make([]byte, 1+8+8+8)
+		n, err := cf.Read(resp)
+		if err != nil || n < 1 {
+			logger.Fatalf("Read message: %d %s", n, err)
+		}
+		if n == 1 && resp[0] == uint8(syscall.EINVAL&0xff) {
+			return 0, 0, 0, false
+		}
+		if resp[0] != 0 || n != len(resp) {
+			logger.Fatalf("Query cache space failed: %v", resp[:n])
+		}
+		rb := utils.ReadBuffer(resp[1:])
+		capacity, free = rb.Get64(), rb.Get64()
+		size += rb.Get64()
+	}
+	return capacity, free, size, true
+}
+
+// checkCache returns the bytes in the cache of the mount point and the total bytes of every path.
+func checkCache(cf *os.File, paths []string, threads uint) (cached, total []uint64, err error) {
+	for i := 0; i < len(paths); i += batchMax {
+		end := i + batchMax
+		if end > len(paths) {
+			end = len(paths)
+		}
+		data := strings.Join(paths[i:end], "\n")
+		wb := utils.NewBuffer(8 + 4 + uint32(len(data)) + 2)
+		wb.Put32(meta.CheckCache)
+		wb.Put32(4 + uint32(len(data)) + 2)
+		wb.Put32(uint32(len(data)))
+		wb.Put([]byte(data))
+		wb.Put16(uint16(threads))
+		if _, err = cf.Write(wb.Bytes()); err != nil {
+			return nil, nil, fmt.Errorf("write message: %s", err)
+		}
+		var resp = make([]byte, 1+4+16*(end-i))
+		n, err := cf.Read(resp)
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("read message: %d %s", n, err)
+		}
+		switch errno := syscall.Errno(resp[0]); {
+		case n == 1 && errno == syscall.EINVAL:
+			return nil, nil, fmt.Errorf("--only-missing is not supported by the mount point, please upgrade it")
+		case errno != 0:
+			return nil, nil, fmt.Errorf("check cache: %s", errno)
+		}
+		if n < len(resp) {
+			if m, err := io.ReadFull(cf, resp[n:]); err != nil {
+				return nil, nil, fmt.Errorf("read message: %d %s", n+m, err)
+			}
+		}
+		rb := utils.ReadBuffer(resp[1:])
+		if rb.Get32() != uint32(end-i) {
+			return nil, nil, fmt.Errorf("check cache: unexpected reply for %d paths", end-i)
+		}
+		for j := i; j < end; j++ {
+			cached, total = append(cached, rb.Get64()), append(total, rb.Get64())
+		}
+	}
+	return cached, total, nil
+}
+
+// missingPaths returns the paths which are not fully in cache, the ones without any data (e.g. empty
+// files) are kept as well, which are cheap to warm up.
+func missingPaths(paths []string, cached, total []uint64) (missing []string) {
+	for i, p := range paths {
+		if total[i] == 0 || cached[i] < total[i] {
+			missing = append(missing, p)
+		}
+	}
+	return
+}
+
+// fillAttrCache loads the attributes of the paths (recursively) into the inode cache of the mount
+// point, and returns the number of inodes loaded, full is true if some of them are skipped because
+// the cache is full.
+func fillAttrCache(cf *os.File, paths []string) (loaded uint64, full bool, err error) {
+	for i := 0; i < len(paths); i += batchMax {
+		end := i + batchMax
+		if end > len(paths) {
+			end = len(paths)
+		}
+		data := strings.Join(paths[i:end], "\n")
+		wb := utils.NewBuffer(8 + 4 + uint32(len(data)))
+		wb.Put32(meta.FillAttrCache)
+		wb.Put32(4 + uint32(len(data)))
+		wb.Put32(uint32(len(data)))
+		wb.Put([]byte(data))
+		if _, err = cf.Write(wb.Bytes()); err != nil {
+			return loaded, full, fmt.Errorf("write message: %s", err)
+		}
+		var resp = make([]byte, 1+8+1)
+		n, err := cf.Read(resp)
+		if err != nil || n < 1 {
+			return loaded, full, fmt.Errorf("read message: %d %s", n, err)
+		}
+		switch errno := syscall.Errno(resp[0]); {
+		case n == 1 && errno == syscall.EINVAL:
+			return loaded, full, fmt.Errorf("--attr-cache is not supported by the mount point, please upgrade it")
+		case n == 1 && errno == syscall.ENOTSUP:
+			return loaded, full, fmt.Errorf("inode cache is disabled in the mount point, please mount it with --inode-cache-size and --inode-cache-ttl")
+		case errno != 0 || n != len(resp):
+			return loaded, full, fmt.Errorf("load attributes: %s", errno)
+		}
+		rb := utils.ReadBuffer(resp[1:])
+		loaded += rb.Get64()
+		if rb.Get8() != 0 {
+			return loaded, true, nil
+		}
+	}
+	return loaded, false, nil
+}
+
+// fillParents loads the entries along the paths (from the root) into the inode cache of the mount
+// point, and returns the number of entries loaded.
+func fillParents(cf *os.File, paths []string) (loaded uint64, err error) {
+	for i := 0; i < len(paths); i += batchMax {
+		end := i + batchMax
+		if end > len(paths) {
+			end = len(paths)
+		}
+		data := strings.Join(paths[i:end], "\n")
+		wb := utils.NewBuffer(8 + 4 + uint32(len(data)))
+		wb.Put32(meta.FillParents)
+		wb.Put32(4 + uint32(len(data)))
+		wb.Put32(uint32(len(data)))
+		wb.Put([]byte(data))
+		if _, err = cf.Write(wb.Bytes()); err != nil {
+			return loaded, fmt.Errorf("write message: %s", err)
+		}
+		var resp = make([]byte, 1+8)
+		n, err := cf.Read(resp)
+		if err != nil || n < 1 {
+			return loaded, fmt.Errorf("read message: %d %s", n, err)
+		}
+		switch errno := syscall.Errno(resp[0]); {
+		case n == 1 && errno == syscall.EINVAL:
+			return loaded, fmt.Errorf("--warm-parents is not supported by the mount point, please upgrade it")
+		case n == 1 && errno == syscall.ENOTSUP:
+			return loaded, fmt.Errorf("inode cache is disabled in the mount point, please mount it with --inode-cache-size and --inode-cache-ttl")
+		case errno != 0 || n != len(resp):
+			return loaded, fmt.Errorf("load parents: %s", errno)
+		}
+		loaded += utils.ReadBuffer(resp[1:]).Get64()
+	}
+	return loaded, nil
+}
+
+// parseAfter parses a duration before now (e.g. 1h), or a timestamp in local time.
+func parseAfter(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("negative duration: %s", s)
+		}
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid duration or timestamp: %s", s)
+}
+
+// findMountPoint returns the mount point of JuiceFS that path is inside.
+func findMountPoint(path string) (string, error) {
+	first, err := filepath.Abs(path)
 	if err != nil {
-		logger.Fatalf("Failed to get abs of %s: %s", paths[0], err)
+		return "", fmt.Errorf("Failed to get abs of %s: %s", path, err)
 	}
 	st, err := os.Stat(first)
 	if err != nil {
-		logger.Fatalf("Failed to stat path %s: %s", first, err)
+		return "", fmt.Errorf("Failed to stat path %s: %s", first, err)
 	}
 	var mp string
 	if st.IsDir() {
@@ -101,49 +608,731 @@ func warmup(ctx *cli.Context) error {
 	for ; mp != "/"; mp = filepath.Dir(mp) {
 		inode, err := utils.GetFileInode(mp)
 		if err != nil {
-			logger.Fatalf("Failed to lookup inode for %s: %s", mp, err)
+			return "", fmt.Errorf("Failed to lookup inode for %s: %s", mp, err)
 		}
 		if inode == 1 {
 			break
 		}
 	}
 	if mp == "/" {
-		logger.Fatalf("Path %s is not inside JuiceFS", first)
+		return "", fmt.Errorf("Path %s is not inside JuiceFS", first)
 	}
+	return mp, nil
+}
 
-	controller := openController(mp)
-	if controller == nil {
-		logger.Fatalf("Failed to open control file under %s", mp)
+// controlInode is the inode of the control file in the root of a mount point.
+const controlInode = 0x7FFFFFFF00000002
+
+// openControlFile opens path as the control file of a mount point, which is checked by its inode.
+func openControlFile(path string) (*os.File, error) {
+	inode, err := utils.GetFileInode(path)
+	if err != nil {
+		return nil, fmt.Errorf("lookup inode for %s: %s", path, err)
 	}
-	defer controller.Close()
+	if inode != controlInode {
+		return nil, fmt.Errorf("%s is not a control file of JuiceFS (inode %d)", path, inode)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open control file %s: %s", path, err)
+	}
+	return f, nil
+}
 
-	threads := ctx.Uint("threads")
-	background := ctx.Bool("background")
-	start := len(mp)
-	batch := make([]string, batchMax)
-	progress := utils.NewProgress(background, false)
-	bar := progress.AddCountBar("Warmed up paths", int64(len(paths)))
-	var index int
-	for _, path := range paths {
-		if strings.HasPrefix(path, mp) {
-			batch[index] = path[start:]
-			index++
+// pathsUnder returns the paths relative to mount point mp, the symlinks are resolved for the ones
+// not under mp literally, and the ones out of mp are skipped.
+func pathsUnder(mp string, paths []string) []string {
+	realMp, err := filepath.EvalSymlinks(mp)
+	if err != nil {
+		realMp = mp
+	}
+	var targets []string
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			logger.Warnf("Failed to get abs of %s: %s", p, err)
+			continue
+		}
+		rel, err := filepath.Rel(mp, abs)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			if real, e := filepath.EvalSymlinks(abs); e == nil {
+				rel, err = filepath.Rel(realMp, real)
+			}
+		}
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			logger.Warnf("Path %s is not under mount point %s", p, mp)
+			continue
+		}
+		targets = append(targets, filepath.Join("/", rel))
+	}
+	return targets
+}
+
+// existingPaths returns the paths under mount point mp which can be stated and the missing ones,
+// the paths are stated by the threads.
+func existingPaths(mp string, paths []string, threads int) (found, missing []string) {
+	ok := make([]bool, len(paths))
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				if _, err := os.Stat(filepath.Join(mp, paths[i])); err != nil {
+					logger.Warnf("Skip %s: %s", paths[i], err)
+				} else {
+					ok[i] = true
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+	for i, p := range paths {
+		if ok[i] {
+			found = append(found, p)
 		} else {
-			logger.Warnf("Path %s is not under mount point %s", path, mp)
+			missing = append(missing, p)
+		}
+	}
+	return
+}
+
+// lookupChildren looks up the children (not recursively) of the directories in paths under mp
+// with threads, and returns the number of entries found. FUSE can't push an entry into the kernel,
+// so they're looked up as the first access would do, then the kernel caches the entries and their
+// attributes until they expire. The paths which are not directories are skipped.
+func lookupChildren(mp string, paths []string, threads int) uint64 {
+	var found uint64
+	todo := make(chan string, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				if _, err := os.Lstat(p); err != nil {
+					logger.Debugf("Lookup %s: %s", p, err)
+				} else {
+					atomic.AddUint64(&found, 1)
+				}
+			}
+		}()
+	}
+	for _, p := range paths {
+		dir := filepath.Join(mp, p)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
 			continue
 		}
-		if index >= batchMax {
-			sendCommand(controller, batch, index, threads, background)
-			bar.IncrBy(index)
-			index = 0
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logger.Warnf("Read directory %s: %s", dir, err)
+		}
+		for _, e := range entries {
+			todo <- filepath.Join(dir, e.Name())
+		}
+	}
+	close(todo)
+	wg.Wait()
+	return found
+}
+
+// lockWarmup takes the lock of the warmups on the mount point mp on this host, which is held until
+// the returned file is closed. If it's held by another warmup, it waits for it with ifRunning "wait",
+// returns running as true with "skip", or an error with "fail".
+func lockWarmup(mp string, ifRunning string) (lock *os.File, running bool, err error) {
+	name := filepath.Join(os.TempDir(), fmt.Sprintf("juicefs-warmup-%08x.lock", crc32.ChecksumIEEE([]byte(mp))))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if os.IsPermission(err) { // created by another user, it can be locked as read-only
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("open lock file %s: %s", name, err)
+	}
+	if err = utils.LockFile(f, false); err == utils.ErrLocked {
+		pid, _ := io.ReadAll(f)
+		switch ifRunning {
+		case "skip":
+			_ = f.Close()
+			return nil, true, nil
+		case "fail":
+			_ = f.Close()
+			return nil, true, fmt.Errorf("another warmup (pid %s) is running on %s", pid, mp)
+		}
+		logger.Infof("Waiting for another warmup (pid %s) running on %s", pid, mp)
+		err = utils.LockFile(f, true)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, false, fmt.Errorf("lock %s: %s", name, err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		logger.Debugf("Write pid into %s: %s", name, err)
+	}
+	return f, false, nil
+}
+
+// rootPaths returns the paths relative to the root of JuiceFS as the ones used by the controller,
+// they can't go out of the root with "..".
+func rootPaths(paths []string) []string {
+	r := make([]string, len(paths))
+	for i, p := range paths {
+		r[i] = filepath.Join("/", p)
+	}
+	return r
+}
+
+// warmupTarget is a mount point to warm up, with the paths relative to its root.
+type warmupTarget struct {
+	mp        string
+	control   string // given by --control
+	checkRoot bool   // mp is given by --mount, which should be the root of JuiceFS
+	paths     []string
+	name      string // the mount point shown in the progress, empty if it's the only one
+}
+
+// warmupOptions are the options shared by all the mount points.
+type warmupOptions struct {
+	threads           uint
+	batches           int
+	retries           int
+	after             time.Time
+	groupBy           string
+	background        bool
+	quiet             bool
+	requireFit        bool
+	prefetch          bool
+	continueOnMissing bool
+	onlyMissing       bool
+	attrCache         bool
+	warmParents       bool
+	dentryCache       bool
+	ifRunning         string
+}
+
+// groupByMount groups the paths by the mount points of JuiceFS they're inside (found by find), the
+// mount points are returned in the order they're found, and the paths are relative to their roots.
+// A path not inside JuiceFS aborts the warmup if it's the first one, unless skipBad is true, where
+// it's skipped and returned as a bad one.
+func groupByMount(paths []string, skipBad bool, find func(string) (string, error)) ([]string, map[string][]string, []string) {
+	var mps, bad []string
+	groups := make(map[string][]string)
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
+		}
+		var mp string
+		for _, m := range mps {
+			if abs == m || strings.HasPrefix(abs, m+"/") {
+				mp = m
+				break
+			}
+		}
+		if mp == "" {
+			if mp, err = find(p); err != nil {
+				if skipBad {
+					logger.Warnf("%s, skip it", err)
+					bad = append(bad, p)
+				} else if len(mps) == 0 {
+					logger.Fatalf("%s", err)
+				} else {
+					logger.Warnf("%s, skip it", err)
+				}
+				continue
+			}
+			if _, ok := groups[mp]; !ok {
+				mps = append(mps, mp)
+			}
+			if abs != mp && !strings.HasPrefix(abs, mp+"/") {
+				logger.Warnf("Path %s is not under mount point %s", p, mp)
+				continue
+			}
+		}
+		groups[mp] = append(groups[mp], abs[len(mp):])
+	}
+	if len(mps) == 0 {
+		logger.Fatalf("None of the %d paths is inside JuiceFS", len(paths))
+	}
+	return mps, groups, bad
+}
+
+// mergeSummaries sums up the summaries of the mount points warmed up at the same time, which
+// are kept in Mounts, elapsed is the time spent on all of them.
+func mergeSummaries(mounts []*warmupSummary, elapsed time.Duration) *warmupSummary {
+	total := &warmupSummary{Mounts: mounts}
+	for _, s := range mounts {
+		total.Warmed += s.Warmed
+		total.Skipped += s.Skipped
+		total.Failed += s.Failed
+		total.Missing += s.Missing
+		total.Old += s.Old
+		total.Cached += s.Cached
+		total.Bytes += s.Bytes
+		total.Batches += s.Batches
+		total.Attrs += s.Attrs
+		total.Parents += s.Parents
+		total.Dentries += s.Dentries
+	}
+	throughput(total, elapsed)
+	return total
+}
+
+// warmupMount warms up the paths of a mount point, the returned summary is never nil, and the
+// error is also kept in it.
+func warmupMount(t *warmupTarget, o *warmupOptions, progress *utils.Progress, events *progressWriter) (summary *warmupSummary, err error) {
+	summary = &warmupSummary{Mount: t.mp}
+	defer func() {
+		if err != nil {
+			summary.Error = err.Error()
+		}
+	}()
+	if t.checkRoot {
+		inode, err := utils.GetFileInode(t.mp)
+		if err != nil {
+			return summary, fmt.Errorf("lookup inode for %s: %s", t.mp, err)
+		}
+		if inode != 1 {
+			return summary, fmt.Errorf("%s is not a mount point of JuiceFS", t.mp)
+		}
+	}
+	if o.ifRunning != "" {
+		lock, running, err := lockWarmup(t.mp, o.ifRunning)
+		if err != nil {
+			return summary, err
+		}
+		if running {
+			summary.Running = true
+			logger.Infof("Another warmup is running on %s, skip it", t.mp)
+			return summary, nil
+		}
+		defer lock.Close()
+	}
+	open := func() *os.File {
+		if t.control == "" {
+			return openController(t.mp)
+		}
+		f, err := openControlFile(t.control)
+		if err != nil {
+			logger.Errorf("%s", err)
+			return nil
+		}
+		return f
+	}
+	controller := open()
+	if controller == nil {
+		return summary, fmt.Errorf("failed to open control file under %s", t.mp)
+	}
+	defer controller.Close()
+
+	mp, targets := t.mp, t.paths
+	if o.continueOnMissing {
+		var lost []string
+		targets, lost = existingPaths(mp, targets, int(o.threads))
+		summary.Missing = int64(len(lost))
+		if len(lost) > 0 {
+			logger.Warnf("Skipped %d missing paths in %s", len(lost), mp)
+		}
+	}
+	if len(targets) == 0 {
+		logger.Infof("Nothing to warm up in %s", mp)
+		return summary, nil
+	}
+	if o.warmParents {
+		start := time.Now()
+		if summary.Parents, err = fillParents(controller, targets); err != nil {
+			return summary, err
+		}
+		if !o.quiet {
+			logger.Infof("Prefetched %d entries along the paths in %s in %.3fs", summary.Parents, mp, time.Since(start).Seconds())
+		}
+	}
+	if o.dentryCache {
+		start := time.Now()
+		summary.Dentries = lookupChildren(mp, targets, int(o.threads))
+		if !o.quiet {
+			logger.Infof("Looked up %d entries of the directories into the kernel of %s in %.3fs", summary.Dentries, mp, time.Since(start).Seconds())
+		}
+	}
+	if o.attrCache {
+		start := time.Now()
+		var full bool
+		summary.Attrs, full, err = fillAttrCache(controller, targets)
+		summary.Elapsed = time.Since(start).Seconds()
+		if err != nil {
+			return summary, err
+		}
+		summary.Warmed = int64(len(targets))
+		if full {
+			logger.Warnf("The inode cache of %s is full, the rest of the inodes are not loaded", mp)
+		}
+		if !o.quiet {
+			logger.Infof("Loaded %d inodes into the inode cache of %s in %.3fs", summary.Attrs, mp, summary.Elapsed)
+		}
+		return summary, nil
+	}
+	if o.onlyMissing {
+		cached, total, err := checkCache(controller, targets, o.threads)
+		if err != nil {
+			return summary, err
+		}
+		all := len(targets)
+		targets = missingPaths(targets, cached, total)
+		summary.Cached = int64(all - len(targets))
+		if !o.quiet {
+			logger.Infof("Skipped %d paths in %s which are fully cached", summary.Cached, mp)
+		}
+		if len(targets) == 0 {
+			return summary, nil
+		}
+	}
+	if capacity, free, size, ok := queryCacheSpace(controller, targets); !ok {
+		if o.requireFit {
+			return summary, fmt.Errorf("--require-fit is not supported by the mount point %s, please upgrade it", mp)
+		}
+	} else {
+		logger.Infof("The paths in %s have %d MiB data, cache capacity: %d MiB, free: %d MiB", mp, size>>20, capacity>>20, free>>20)
+		if size > capacity {
+			if o.requireFit {
+				return summary, fmt.Errorf("the data (%d MiB) can't fit in the cache (%d MiB) of %s", size>>20, capacity>>20, mp)
+			}
+			logger.Warnf("The data (%d MiB) can't fit in the cache (%d MiB) of %s, the warmed up blocks will be evicted by themselves", size>>20, capacity>>20, mp)
+		} else if size > free {
+			logger.Warnf("The data (%d MiB) exceeds the free space of cache (%d MiB) of %s, other cached blocks will be evicted", size>>20, free>>20, mp)
+		}
+	}
+	if o.groupBy == "size" {
+		targets = groupBySize(targets, pathSizes(controller, mp, targets, int(o.threads)))
+	}
+
+	// the responses can't be told apart in one handle, so every batch in flight has its own handle
+	controllers := []*os.File{controller}
+	for len(controllers) < o.batches {
+		cf := open()
+		if cf == nil {
+			return summary, fmt.Errorf("failed to open control file under %s", mp)
+		}
+		defer cf.Close()
+		controllers = append(controllers, cf)
+	}
+	label := func(s string) string {
+		if t.name != "" {
+			return s + " in " + t.name
 		}
+		return s
+	}
+	bar := progress.AddCountBar(label("Warmed up paths"), int64(len(targets)))
+	var prefetched, fetched *utils.Bar
+	if o.prefetch && !o.background {
+		prefetched = progress.AddCountSpinner(label("Prefetched metadata (files)"))
+		fetched = progress.AddCountSpinner(label("Fetched data (files)"))
+	}
+	skipped := progress.AddCountSpinner(label("Skipped paths"))
+	failed := progress.AddCountSpinner(label("Failed paths"))
+	var mu sync.Mutex
+	var oldFiles int64
+	var clamped bool
+	var failedBatches []string
+	warmed := make(map[string]uint64)
+	var noSizes bool
+	flags := uint8(meta.FillCacheStats | meta.FillCacheThreads | meta.FillCacheErrors)
+	if !o.background {
+		flags |= meta.FillCacheSizes
 	}
-	if index > 0 {
-		sendCommand(controller, batch, index, threads, background)
-		bar.IncrBy(index)
+	if o.prefetch {
+		flags |= meta.FillCachePhased
 	}
+	var warmedBytes uint64
+	stats := func(event string) *warmupEvent {
+		return &warmupEvent{Event: event, Mount: t.name, Total: len(targets), Warmed: bar.Current(), Skipped: skipped.Current(), Failed: failed.Current(), Bytes: warmedBytes}
+	}
+	events.send(stats("start"))
+	var sent int
+	start := time.Now()
+	dispatch(targets, o.batches, func(worker int, batch []string) {
+		var reply fillCacheReply
+		tries := 0
+		st := retryBatch(o.retries, time.Second, func() uint8 {
+			if tries > 0 {
+				logger.Warnf("Warm up %d paths from %s again (%d/%d)", len(batch), mp+batch[0], tries, o.retries)
+			}
+			tries++
+			reply = sendCommand(controllers[worker], batch, len(batch), o.threads, o.background, flags, o.after)
+			return reply.status
+		})
+		mu.Lock()
+		sent++
+		if st != meta.FillCacheOK {
+			logger.Warnf("Failed to warm up %d paths from %s: %s", len(batch), mp+batch[0], syscall.Errno(st))
+			failedBatches = append(failedBatches, batch[0])
+			bar.IncrTotal(int64(-len(batch)))
+			failed.IncrBy(len(batch))
+			e := stats("batch")
+			mu.Unlock()
+			e.First, e.Paths, e.Error = batch[0], len(batch), syscall.Errno(st).Error()
+			events.send(e)
+			return
+		}
+		oldFiles += int64(reply.old)
+		if prefetched != nil {
+			prefetched.IncrInt64(int64(reply.phases[0]))
+			fetched.IncrInt64(int64(reply.phases[1]))
+		}
+		if reply.sizes == nil {
+			noSizes = true
+		}
+		for i, size := range reply.sizes {
+			warmed[mp+batch[i]] += size
+			warmedBytes += size
+		}
+		if reply.threads != 0 && uint(reply.threads) != o.threads && !clamped {
+			logger.Warnf("The number of threads is limited to %d by the mount point %s (requested %d)", reply.threads, mp, o.threads)
+			clamped = true
+		}
+		bar.IncrTotal(int64(-reply.skipped))
+		bar.IncrBy(len(batch) - int(reply.skipped))
+		skipped.IncrBy(int(reply.skipped))
+		e := stats("batch")
+		mu.Unlock()
+		e.First, e.Paths = batch[0], len(batch)
+		events.send(e)
+	})
+	elapsed := time.Since(start)
+	events.send(stats("done"))
+	if n := skipped.Current(); n > 0 {
+		logger.Infof("Skipped %d paths in %s which are being deleted", n, mp)
+	}
+	if !o.after.IsZero() && !o.background {
+		logger.Infof("Skipped %d files in %s modified before %s", oldFiles, mp, o.after.Format(time.RFC3339))
+	}
+	summary.Warmed, summary.Skipped, summary.Failed = bar.Current(), skipped.Current(), failed.Current()
+	summary.Old, summary.Batches = oldFiles, sent
+	if !noSizes {
+		summary.Sizes = sortWarmed(warmed)
+		for _, p := range summary.Sizes {
+			summary.Bytes += p.Bytes
+		}
+	}
+	summary.noSizes = noSizes
+	throughput(summary, elapsed)
+	if len(failedBatches) > 0 {
+		sort.Strings(failedBatches)
+		return summary, fmt.Errorf("%d paths in %d batches (starting from %s) failed to warm up", failed.Current(), len(failedBatches), strings.Join(failedBatches, ", "))
+	}
+	return summary, nil
+}
+
+func warmup(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	fname := ctx.String("file")
+	paths := ctx.Args().Slice()
+	if fname != "" {
+		fd, err := os.Open(fname)
+		if err != nil {
+			logger.Fatalf("Failed to open file %s: %s", fname, err)
+		}
+		defer fd.Close()
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" {
+				paths = append(paths, p)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Fatalf("Reading file %s failed with error: %s", fname, err)
+		}
+	}
+	var replay *replayCoverage
+	if logName := ctx.String("from-access-log"); logName != "" {
+		if len(ctx.StringSlice("mount")) == 0 {
+			logger.Fatalf("--from-access-log needs --mount, the paths in the log are relative to the root of the volume")
+		}
+		replayed, coverage, err := replayAccessLog(logName, ctx.String("meta-url"))
+		if err != nil {
+			logger.Fatalf("Replay access log %s: %s", logName, err)
+		}
+		logger.Infof("Replay %s: %s", logName, coverage)
+		paths, replay = append(paths, replayed...), coverage
+	}
+	if len(paths) == 0 {
+		logger.Infof("Nothing to warm up")
+		return nil
+	}
+
+	var err error
+	var targets []*warmupTarget
+	var missing int
+	o := &warmupOptions{
+		threads:           ctx.Uint("threads"),
+		batches:           ctx.Int("batches"),
+		retries:           ctx.Int("retry"),
+		groupBy:           ctx.String("group-by"),
+		background:        ctx.Bool("background"),
+		quiet:             ctx.Bool("quiet"), // the global option
+		requireFit:        ctx.Bool("require-fit"),
+		prefetch:          ctx.Bool("prefetch-metadata-first"),
+		continueOnMissing: ctx.Bool("continue-on-missing") || replay != nil, // the files in the log may be deleted
+		onlyMissing:       ctx.Bool("only-missing"),
+		attrCache:         ctx.Bool("attr-cache"),
+		warmParents:       ctx.Bool("warm-parents"),
+		dentryCache:       ctx.Bool("dentry"),
+		ifRunning:         ctx.String("if-running"),
+	}
+	control := ctx.String("control")
+	mounts := ctx.StringSlice("mount")
+	if control != "" {
+		if len(mounts) > 1 {
+			logger.Fatalf("--control can't be used with multiple --mount")
+		}
+		if control, err = filepath.Abs(control); err != nil {
+			logger.Fatalf("Failed to get abs of %s: %s", ctx.String("control"), err)
+		}
+		f, err := openControlFile(control)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		_ = f.Close()
+	}
+	if len(mounts) > 0 {
+		seen := make(map[string]bool)
+		for _, mount := range mounts {
+			mp, err := filepath.Abs(mount)
+			if err != nil {
+				logger.Fatalf("Failed to get abs of %s: %s", mount, err)
+			}
+			if !seen[mp] {
+				seen[mp] = true
+				targets = append(targets, &warmupTarget{mp: mp, control: control, checkRoot: control == "", paths: rootPaths(paths)})
+			}
+		}
+	} else if control != "" {
+		// the control file is in the root of the mount point
+		mp := filepath.Dir(control)
+		targets = append(targets, &warmupTarget{mp: mp, control: control, paths: pathsUnder(mp, paths)})
+	} else {
+		mps, groups, bad := groupByMount(paths, o.continueOnMissing, findMountPoint)
+		missing += len(bad)
+		for _, mp := range mps {
+			if len(groups[mp]) > 0 {
+				targets = append(targets, &warmupTarget{mp: mp, paths: groups[mp]})
+			}
+		}
+	}
+	if len(targets) > 1 {
+		for _, t := range targets {
+			t.name = t.mp
+		}
+	}
+
+	if o.threads == 0 || o.threads > math.MaxUint16 {
+		logger.Fatalf("threads should be in range [1, %d]: %d", math.MaxUint16, o.threads)
+	}
+	if missing > 0 {
+		logger.Warnf("Skipped %d missing paths", missing)
+	}
+	if ctx.IsSet("after") {
+		if o.after, err = parseAfter(ctx.String("after")); err != nil {
+			logger.Fatalf("Invalid --after: %s", err)
+		}
+		logger.Infof("Warm up the files modified after %s", o.after.Format(time.RFC3339))
+	}
+	if o.groupBy != "path" && o.groupBy != "size" {
+		logger.Fatalf("Invalid --group-by: %s, should be path or size", o.groupBy)
+	}
+	if o.batches < 1 {
+		logger.Fatalf("batches should be at least 1: %d", o.batches)
+	}
+	if o.retries < 0 {
+		logger.Fatalf("retry should not be negative: %d", o.retries)
+	}
+	if o.onlyMissing && o.attrCache {
+		logger.Fatalf("--only-missing can't be used with --attr-cache")
+	}
+	switch o.ifRunning {
+	case "", "wait", "skip", "fail":
+	default:
+		logger.Fatalf("invalid value of --if-running: %s, it should be wait, skip or fail", o.ifRunning)
+	}
+	var events *progressWriter
+	if ps := ctx.String("progress-socket"); ps != "" {
+		events = newProgressWriter(ps)
+		defer events.close()
+	}
+	progress := utils.NewProgress(o.background || o.quiet, false)
+	// every mount point is warmed up by its own controllers, so a failed one won't block the others
+	summaries := make([]*warmupSummary, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *warmupTarget) {
+			defer wg.Done()
+			summaries[i], errs[i] = warmupMount(t, o, progress, events)
+		}(i, t)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
 	progress.Done()
 
+	var summary *warmupSummary
+	if len(summaries) == 1 {
+		summary = summaries[0]
+		summary.Mount = ""
+		summary.Missing += int64(missing)
+	} else {
+		summary = mergeSummaries(summaries, elapsed)
+		summary.Missing += int64(missing)
+	}
+	summary.Replay = replay
+	if !o.background {
+		var noSizes bool
+		for _, s := range summaries {
+			noSizes = noSizes || s.noSizes
+		}
+		if noSizes && !o.quiet {
+			logger.Warnf("The size of warmed up paths is not reported by the mount point, please upgrade it")
+		}
+		if ctx.Bool("json") {
+			printJson(summary)
+		} else if len(summaries) == 1 {
+			if !noSizes && !o.quiet && summary.Batches > 0 {
+				printWarmed(os.Stdout, summary)
+				logger.Infof("%s", throughput(summary, elapsed))
+			}
+		} else if !o.quiet {
+			for i, s := range summaries {
+				if errs[i] != nil {
+					logger.Errorf("%s: %s", s.Mount, errs[i])
+				} else if !s.noSizes && s.Batches > 0 {
+					printWarmed(os.Stdout, s)
+					logger.Infof("%s: %s", s.Mount, throughput(s, time.Duration(s.Elapsed*float64(time.Second))))
+				}
+			}
+			if !noSizes {
+				logger.Infof("Total of %d mount points: %s", len(summaries), throughput(summary, elapsed))
+			}
+		}
+	}
+	if len(targets) == 1 {
+		return errs[0]
+	}
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", targets[i].mp, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d mount points failed to warm up: %s", len(failed), len(targets), strings.Join(failed, "; "))
+	}
 	return nil
 }
 
@@ -159,11 +1348,86 @@ func warmupFlags() *cli.Command {
 				Aliases: []string{"f"},
 				Usage:   "file containing a list of paths",
 			},
+			&cli.StringFlag{
+				Name:  "from-access-log",
+				Usage: "warm up the files read in an access log (with the keys of blocks, e.g. of object storage, or the paths in the volume), it needs --mount",
+			},
+			&cli.StringFlag{
+				Name:  "meta-url",
+				Usage: "META-URL of the volume to resolve the keys of blocks in --from-access-log to files",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mount",
+				Usage: "treat the paths (and the ones in --file) as relative to the root of this mount point, it can be repeated to warm up the paths in all of them at the same time",
+			},
+			&cli.StringFlag{
+				Name:  "control",
+				Usage: "path of the control file (.control in the root of the mount point), the mount point is not searched from the paths",
+			},
 			&cli.UintFlag{
 				Name:    "threads",
 				Aliases: []string{"p"},
 				Value:   50,
-				Usage:   "number of concurrent workers",
+				Usage:   "number of concurrent workers, which is limited to 1000 by the mount point",
+			},
+			&cli.IntFlag{
+				Name:  "batches",
+				Value: 1,
+				Usage: "number of batches (10240 paths each) in flight, each one is warmed up by the threads",
+			},
+			&cli.StringFlag{
+				Name:  "group-by",
+				Value: "path",
+				Usage: "how the paths are grouped into batches: path (in the order given) or size (stat them first and mix the large and small ones in every batch)",
+			},
+			&cli.IntFlag{
+				Name:  "retry",
+				Value: 3,
+				Usage: "number of retries for a batch failed with transient errors (e.g. object storage), the batches still failing are reported at the end",
+			},
+			&cli.StringFlag{
+				Name:  "after",
+				Usage: "only warm up the files modified after the time, as a duration before now (e.g. 1h) or a timestamp (e.g. 2022-01-02 15:04:05)",
+			},
+			&cli.BoolFlag{
+				Name:  "prefetch-metadata-first",
+				Usage: "read the metadata of all the files in the directories first, and fetch their data in a pipeline after it, which is faster for cold directories with many files",
+			},
+			&cli.BoolFlag{
+				Name:  "attr-cache",
+				Usage: "load the attributes of the paths (recursively) into the inode cache of the mount point instead of their data, so the first lookup and stat of them are served without meta (it needs --inode-cache-size in mount)",
+			},
+			&cli.BoolFlag{
+				Name:  "warm-parents",
+				Usage: "load the entries of the parent directories of the paths into the inode cache of the mount point as well, so the first lookups walking down to them are served without meta (it needs --inode-cache-size in mount)",
+			},
+			&cli.BoolFlag{
+				Name:  "dentry",
+				Usage: "look up the children of the directories in the paths, so their entries and attributes are cached by the kernel for --entry-cache and --attr-cache of the mount point",
+			},
+			&cli.StringFlag{
+				Name:  "if-running",
+				Usage: "what to do if another warmup is running on the same mount point of this host: wait, skip or fail (not checked by default)",
+			},
+			&cli.BoolFlag{
+				Name:  "continue-on-missing",
+				Usage: "skip the paths which can't be stated with a warning, instead of aborting if the first one is missing",
+			},
+			&cli.BoolFlag{
+				Name:  "only-missing",
+				Usage: "check how much data of the paths is in cache first, and skip the ones fully cached, only the missing blocks of the others are fetched",
+			},
+			&cli.BoolFlag{
+				Name:  "require-fit",
+				Usage: "abort if the data of the paths can't fit in the cache",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the summary (including the bytes warmed up for every path) in JSON",
+			},
+			&cli.StringFlag{
+				Name:  "progress-socket",
+				Usage: "unix socket or named pipe to send the progress to, as a line of JSON when every batch is done",
 			},
 			&cli.BoolFlag{
 				Name:    "background",
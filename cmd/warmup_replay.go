@@ -0,0 +1,197 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// replayCoverage tells how much of an access log is replayed by --from-access-log.
+type replayCoverage struct {
+	Lines         int    `json:"lines"`
+	Invalid       int    `json:"invalid"` // lines with neither a block nor a path
+	Blocks        int    `json:"blocks"`  // distinct blocks
+	BlockBytes    uint64 `json:"block_bytes"`
+	Resolved      int    `json:"resolved"` // blocks still used by files
+	ResolvedBytes uint64 `json:"resolved_bytes"`
+	Paths         int    `json:"paths"` // distinct paths in the log
+	Files         int    `json:"files"` // files resolved from the blocks
+}
+
+func (c *replayCoverage) String() string {
+	s := fmt.Sprintf("%d lines (%d invalid), %d paths", c.Lines, c.Invalid, c.Paths)
+	if c.Blocks > 0 {
+		s += fmt.Sprintf(", %d blocks (%d bytes) of which %d (%d bytes, %.1f%%) are resolved to %d files",
+			c.Blocks, c.BlockBytes, c.Resolved, c.ResolvedBytes, float64(c.Resolved)*100/float64(c.Blocks), c.Files)
+	}
+	return s
+}
+
+// accessLog is the distinct blocks and paths read in an access log.
+type accessLog struct {
+	blocks   map[uint64]map[int]int // slice id -> index of block -> size of block
+	paths    []string
+	coverage replayCoverage
+}
+
+// blockInField returns the block of a key in a field of the log, the key could be URL-encoded,
+// quoted, prefixed by the bucket and volume name, or followed by a query string.
+func blockInField(field string) (cid uint64, indx, size int, ok bool) {
+	field = strings.Trim(field, `"'`)
+	if s, err := url.PathUnescape(field); err == nil {
+		field = s
+	}
+	i := strings.LastIndex(field, "chunks/")
+	if i < 0 {
+		return
+	}
+	key := field[i+len("chunks/"):]
+	if j := strings.IndexAny(key, `?#"' ,;`); j >= 0 {
+		key = key[:j]
+	}
+	return parseBlock(key)
+}
+
+// parseAccessLog finds the keys of blocks (anywhere in a line, e.g. the access log of object
+// storage or the one of --object-request-log) and the paths in the volume (the lines starting
+// with "/", e.g. a list of the files read recently), and dedups them.
+func parseAccessLog(r io.Reader) (*accessLog, error) {
+	l := &accessLog{blocks: make(map[uint64]map[int]int)}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		l.coverage.Lines++
+		var found bool
+		for _, field := range strings.Fields(line) {
+			cid, indx, size, ok := blockInField(field)
+			if !ok {
+				continue
+			}
+			found = true
+			if l.blocks[cid] == nil {
+				l.blocks[cid] = make(map[int]int)
+			}
+			if _, ok := l.blocks[cid][indx]; !ok {
+				l.blocks[cid][indx] = size
+				l.coverage.Blocks++
+				l.coverage.BlockBytes += uint64(size)
+			}
+		}
+		if found {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			if !seen[line] {
+				seen[line] = true
+				l.paths = append(l.paths, line)
+			}
+		} else {
+			l.coverage.Invalid++
+		}
+	}
+	l.coverage.Paths = len(l.paths)
+	return l, scanner.Err()
+}
+
+// resolve finds the files using the blocks in the log, and returns them with the paths in the
+// log, the blocks of deleted or compacted slices are not resolved.
+func (l *accessLog) resolve(m meta.Meta) ([]string, error) {
+	paths := l.paths
+	if len(l.blocks) == 0 {
+		return paths, nil
+	}
+	slices := make(map[meta.Ino][]meta.Slice)
+	if st := m.ListSlices(meta.Background, slices, false, nil); st != 0 {
+		return nil, fmt.Errorf("list slices: %s", st)
+	}
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		seen[p] = true
+	}
+	resolved := make(map[uint64]bool)
+	var files []string
+	for inode, ss := range slices {
+		var used bool
+		for _, s := range ss {
+			if _, ok := l.blocks[s.Chunkid]; ok {
+				resolved[s.Chunkid] = true
+				used = true
+			}
+		}
+		if !used {
+			continue
+		}
+		p, st := meta.GetPath(m, meta.Background, inode)
+		if st != 0 {
+			logger.Warnf("Get path of inode %d: %s", inode, st)
+			continue
+		}
+		if !seen[p] {
+			seen[p] = true
+			files = append(files, p)
+		}
+	}
+	for cid := range resolved {
+		for _, size := range l.blocks[cid] {
+			l.coverage.Resolved++
+			l.coverage.ResolvedBytes += uint64(size)
+		}
+	}
+	l.coverage.Files = len(files)
+	sort.Strings(files)
+	return append(paths, files...), nil
+}
+
+// replayAccessLog returns the paths (relative to the root of the volume) to warm up from the
+// access log in fname, the blocks in it are resolved to files with the metadata in metaUrl.
+func replayAccessLog(fname, metaUrl string) ([]string, *replayCoverage, error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+	l, err := parseAccessLog(fd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s: %s", fname, err)
+	}
+	if len(l.blocks) > 0 {
+		if metaUrl == "" {
+			return nil, nil, fmt.Errorf("--meta-url is needed to resolve the %d blocks in %s", l.coverage.Blocks, fname)
+		}
+		removePassword(metaUrl)
+		m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true, ReadOnly: true})
+		if _, err = m.Load(); err != nil {
+			return nil, nil, fmt.Errorf("load setting: %s", err)
+		}
+		paths, err := l.resolve(m)
+		return paths, &l.coverage, err
+	}
+	return l.paths, &l.coverage, nil
+}
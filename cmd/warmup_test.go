@@ -17,13 +17,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
 )
 
 func TestWarmup(t *testing.T) {
@@ -65,4 +78,535 @@ func TestWarmup(t *testing.T) {
 	if err != nil || string(content) != "test" {
 		t.Fatalf("warmup: %s; got content %s", err, content)
 	}
+
+	missing := fmt.Sprintf("%s/missing", testMountPoint)
+	if err = Main([]string{"", "warmup", "--continue-on-missing", missing, testMountPoint + "/f1.txt"}); err != nil {
+		t.Fatalf("warmup with missing path: %s", err)
+	}
+}
+
+func TestWarmupQuiet(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		quiet bool
+	}{
+		{[]string{"", "-q", "warmup", "/jfs/a"}, true},
+		{[]string{"", "warmup", "-q", "/jfs/a"}, true},
+		{[]string{"", "warmup", "/jfs/a", "--quiet"}, true},
+		{[]string{"", "warmup", "/jfs/a"}, false},
+	} {
+		var quiet bool
+		cmd := warmupFlags()
+		cmd.Action = func(ctx *cli.Context) error {
+			quiet = ctx.Bool("quiet")
+			return nil
+		}
+		app := &cli.App{Flags: globalFlags(), Commands: []*cli.Command{cmd}}
+		if err := app.Run(reorderOptions(app, c.args)); err != nil {
+			t.Fatalf("run %v: %s", c.args, err)
+		}
+		if quiet != c.quiet {
+			t.Fatalf("quiet of %v: expected %t, but got %t", c.args, c.quiet, quiet)
+		}
+	}
+
+	// nothing to warm up
+	defer utils.SetLogLevel(logrus.InfoLevel)
+	if err := Main([]string{"", "-q", "warmup"}); err != nil {
+		t.Fatalf("warmup: %s", err)
+	}
+	if level := utils.GetLogger("juicefs").Level; level != logrus.WarnLevel {
+		t.Fatalf("log level should be warn with -q, but got %s", level)
+	}
+}
+
+func TestExistingPaths(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+	_ = os.Mkdir(filepath.Join(dir, "d"), 0755)
+	found, missing := existingPaths(dir, []string{"/a", "/b", "/d", "/d/c"}, 2)
+	if !reflect.DeepEqual(found, []string{"/a", "/d"}) || !reflect.DeepEqual(missing, []string{"/b", "/d/c"}) {
+		t.Fatalf("found %v, missing %v", found, missing)
+	}
+}
+
+func TestLookupChildren(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "d"), 0755)
+	_ = os.Mkdir(filepath.Join(dir, "d", "s"), 0755)
+	for _, name := range []string{"a", "b", "s/c"} {
+		_ = os.WriteFile(filepath.Join(dir, "d", name), []byte(name), 0644)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "f"), []byte("f"), 0644)
+	// the files and missing paths are skipped, and the sub-directories are not walked into
+	if n := lookupChildren(dir, []string{"/d", "/f", "/missing"}, 2); n != 3 {
+		t.Fatalf("expect 3 entries looked up, but got %d", n)
+	}
+	if n := lookupChildren(dir, []string{"/", "/d/s"}, 1); n != 3 {
+		t.Fatalf("expect 3 entries looked up, but got %d", n)
+	}
+}
+
+func TestLockWarmup(t *testing.T) {
+	mp := t.TempDir()
+	first, running, err := lockWarmup(mp, "fail")
+	if err != nil || running {
+		t.Fatalf("lock: %v %s", running, err)
+	}
+	if _, running, err = lockWarmup(mp, "skip"); err != nil || !running {
+		t.Fatalf("the second warmup should be skipped: %v %s", running, err)
+	}
+	if _, _, err = lockWarmup(mp, "fail"); err == nil || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Fatalf("the second warmup should fail with the pid of the first one: %v", err)
+	}
+	// another mount point is not affected
+	other, running, err := lockWarmup(t.TempDir(), "fail")
+	if err != nil || running {
+		t.Fatalf("lock another mount point: %v %s", running, err)
+	}
+	_ = other.Close()
+
+	locked := make(chan *os.File)
+	go func() {
+		second, _, err := lockWarmup(mp, "wait")
+		if err != nil {
+			t.Errorf("wait: %s", err)
+		}
+		locked <- second
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("the second warmup should wait for the first one")
+	case <-time.After(time.Millisecond * 200):
+	}
+	_ = first.Close()
+	select {
+	case second := <-locked:
+		_ = second.Close()
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the second warmup should run after the first one")
+	}
+}
+
+func TestMissingPaths(t *testing.T) {
+	paths := []string{"/full", "/partial", "/empty", "/cold"}
+	missing := missingPaths(paths, []uint64{100, 50, 0, 0}, []uint64{100, 100, 0, 100})
+	if !reflect.DeepEqual(missing, []string{"/partial", "/empty", "/cold"}) {
+		t.Fatalf("missing %v", missing)
+	}
+}
+
+func TestParseAfter(t *testing.T) {
+	if ts, err := parseAfter("1h"); err != nil || time.Since(ts) < time.Hour || time.Since(ts) > time.Hour+time.Minute {
+		t.Fatalf("parse duration: %s %s", ts, err)
+	}
+	expected := time.Date(2022, 1, 2, 15, 4, 5, 0, time.Local)
+	for _, s := range []string{"2022-01-02 15:04:05", "2022-01-02T15:04:05", expected.Format(time.RFC3339)} {
+		if ts, err := parseAfter(s); err != nil || !ts.Equal(expected) {
+			t.Fatalf("parse %s: %s %s", s, ts, err)
+		}
+	}
+	if ts, err := parseAfter("2022-01-02"); err != nil || !ts.Equal(time.Date(2022, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("parse date: %s %s", ts, err)
+	}
+	for _, s := range []string{"-1h", "yesterday", ""} {
+		if _, err := parseAfter(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	paths := make([]string, batchMax*5+1)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/f%d", i)
+	}
+	var mu sync.Mutex
+	var inflight, maxInflight int32
+	seen := make(map[string]bool)
+	workers := make(map[int]bool)
+	dispatch(paths, 3, func(worker int, batch []string) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		mu.Lock()
+		if n > maxInflight {
+			maxInflight = n
+		}
+		workers[worker] = true
+		for _, p := range batch {
+			if seen[p] {
+				t.Errorf("%s is sent twice", p)
+			}
+			seen[p] = true
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+	})
+	if len(seen) != len(paths) {
+		t.Fatalf("expected %d paths, but got %d", len(paths), len(seen))
+	}
+	if maxInflight > 3 || len(workers) > 3 {
+		t.Fatalf("too many batches in flight: %d, workers: %d", maxInflight, len(workers))
+	}
+}
+
+func TestRetryBatch(t *testing.T) {
+	cases := []struct {
+		replies  []uint8
+		retries  int
+		expected uint8
+		sent     int
+	}{
+		{[]uint8{meta.FillCacheOK}, 3, meta.FillCacheOK, 1},
+		{[]uint8{meta.FillCacheAgain, meta.FillCacheAgain, meta.FillCacheOK}, 3, meta.FillCacheOK, 3},
+		{[]uint8{meta.FillCacheAgain, meta.FillCacheAgain, meta.FillCacheOK}, 1, meta.FillCacheAgain, 2},
+		{[]uint8{meta.FillCacheAgain}, 0, meta.FillCacheAgain, 1},
+		{[]uint8{meta.FillCacheAgain, uint8(syscall.EIO), meta.FillCacheOK}, 3, uint8(syscall.EIO), 2},
+	}
+	for i, c := range cases {
+		var sent int
+		st := retryBatch(c.retries, time.Millisecond, func() uint8 {
+			sent++
+			return c.replies[sent-1]
+		})
+		if st != c.expected || sent != c.sent {
+			t.Fatalf("case %d: expect status %d after %d sends, but got %d after %d", i, c.expected, c.sent, st, sent)
+		}
+	}
+}
+
+func TestPrintWarmed(t *testing.T) {
+	s := &warmupSummary{Sizes: sortWarmed(map[string]uint64{"/jfs/b": 100, "/jfs/a": 100, "/jfs/c": 3 << 30, "/jfs/d": 0})}
+	for _, p := range s.Sizes {
+		s.Bytes += p.Bytes
+	}
+	var buf bytes.Buffer
+	printWarmed(&buf, s)
+	expected := "SIZE\tBYTES\tPATH\n" +
+		"3.00 GiB\t3221225472\t/jfs/c\n" +
+		"100 B\t100\t/jfs/a\n" +
+		"100 B\t100\t/jfs/b\n" +
+		"0 B\t0\t/jfs/d\n" +
+		"3.00 GiB\t3221225672\tTOTAL\n"
+	if buf.String() != expected {
+		t.Fatalf("expect\n%s\nbut got\n%s", expected, buf.String())
+	}
+}
+
+func TestGroupByMount(t *testing.T) {
+	find := func(p string) (string, error) {
+		for _, mp := range []string{"/jfs1", "/jfs2"} {
+			if p == mp || strings.HasPrefix(p, mp+"/") {
+				return mp, nil
+			}
+		}
+		return "", fmt.Errorf("Path %s is not inside JuiceFS", p)
+	}
+	mps, groups, bad := groupByMount([]string{"/tmp/x", "/jfs2/a", "/jfs1", "/jfs2/b/c", "/jfs10/d", "/jfs1/e"}, true, find)
+	if !reflect.DeepEqual(mps, []string{"/jfs2", "/jfs1"}) || !reflect.DeepEqual(bad, []string{"/tmp/x", "/jfs10/d"}) {
+		t.Fatalf("mount points %v, bad paths %v", mps, bad)
+	}
+	expected := map[string][]string{"/jfs1": {"", "/e"}, "/jfs2": {"/a", "/b/c"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expect groups %v, but got %v", expected, groups)
+	}
+	// the paths out of JuiceFS after the first one are skipped without being counted
+	mps, groups, bad = groupByMount([]string{"/jfs1/a", "/tmp/x", "/jfs2/b"}, false, find)
+	if len(mps) != 2 || len(bad) != 0 || len(groups["/jfs1"]) != 1 || len(groups["/jfs2"]) != 1 {
+		t.Fatalf("mount points %v, groups %v, bad paths %v", mps, groups, bad)
+	}
+}
+
+func TestMergeSummaries(t *testing.T) {
+	mounts := []*warmupSummary{
+		{Mount: "/jfs1", Warmed: 2, Skipped: 1, Bytes: 100 << 20, Batches: 1, Sizes: []warmedPath{{"/jfs1/a", 100 << 20}}},
+		{Mount: "/jfs2", Failed: 3, Missing: 1, Batches: 2, Error: "3 paths in 2 batches (starting from /b) failed to warm up"},
+	}
+	s := mergeSummaries(mounts, time.Second)
+	if s.Warmed != 2 || s.Skipped != 1 || s.Failed != 3 || s.Missing != 1 || s.Bytes != 100<<20 || s.Batches != 3 || s.Speed != 100 || s.Sizes != nil {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	var decoded struct {
+		Mounts []struct {
+			Mount string `json:"mount"`
+			Error string `json:"error"`
+			Sizes []warmedPath
+		} `json:"mounts"`
+	}
+	if err = json.Unmarshal(data, &decoded); err != nil || len(decoded.Mounts) != 2 {
+		t.Fatalf("unmarshal %s: %s", data, err)
+	}
+	if m := decoded.Mounts[0]; m.Mount != "/jfs1" || m.Error != "" || len(m.Sizes) != 1 {
+		t.Fatalf("unexpected first mount point %+v", m)
+	}
+	if m := decoded.Mounts[1]; m.Mount != "/jfs2" || m.Error == "" {
+		t.Fatalf("unexpected second mount point %+v", m)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	s := &warmupSummary{Bytes: 300 << 20, Batches: 2}
+	line := throughput(s, time.Second*3/2)
+	if s.Elapsed != 1.5 || s.Speed != 200 || line != "Warmed up 300.00 MiB in 1.5s with 2 batches, throughput: 200.00 MiB/s" {
+		t.Fatalf("unexpected throughput %+v: %s", s, line)
+	}
+	s = &warmupSummary{}
+	if throughput(s, 0); s.Speed != 0 {
+		t.Fatalf("throughput without elapsed time: %f", s.Speed)
+	}
+}
+
+func TestRootPaths(t *testing.T) {
+	paths := rootPaths([]string{"datasets/foo", "/a/b/", "./c", "../../d", "e/../f", ""})
+	expected := []string{"/datasets/foo", "/a/b", "/c", "/d", "/f", "/"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expect %v, but got %v", expected, paths)
+	}
+}
+
+func TestPathsUnder(t *testing.T) {
+	dir := t.TempDir()
+	mp := filepath.Join(dir, "mnt")
+	_ = os.MkdirAll(filepath.Join(mp, "a", "b"), 0755)
+	_ = os.Symlink(filepath.Join(mp, "a"), filepath.Join(dir, "link"))
+	paths := pathsUnder(mp, []string{mp, filepath.Join(mp, "a/b"), filepath.Join(dir, "link", "b"), dir, filepath.Join(dir, "mnt2")})
+	expected := []string{"/", "/a/b", "/a/b"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expect %v, but got %v", expected, paths)
+	}
+	if f, err := openControlFile(filepath.Join(mp, "a")); err == nil {
+		_ = f.Close()
+		t.Fatalf("a directory should not be a control file")
+	}
+	if _, err := openControlFile(filepath.Join(mp, ".control")); err == nil {
+		t.Fatalf("a missing file should not be a control file")
+	}
+}
+
+// BenchmarkDispatch simulates a mount point with 20ms latency for every batch.
+func BenchmarkDispatch(b *testing.B) {
+	paths := make([]string, batchMax*32)
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("batches-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dispatch(paths, n, func(worker int, batch []string) {
+					time.Sleep(time.Millisecond * 20)
+				})
+			}
+		})
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket is not tested on Windows")
+	}
+	if pw := newProgressWriter(filepath.Join(t.TempDir(), "none.sock")); pw != nil {
+		t.Fatalf("progress writer should be nil for a non-existent socket")
+	}
+	var nilWriter *progressWriter
+	nilWriter.send(&warmupEvent{Event: "start"}) // no-op
+	nilWriter.close()
+
+	path := filepath.Join(t.TempDir(), "progress.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen %s: %s", path, err)
+	}
+	defer l.Close()
+	pw := newProgressWriter(path)
+	if pw == nil {
+		t.Fatalf("connect to %s failed", path)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	pw.send(&warmupEvent{Event: "start", Total: 3})
+	pw.send(&warmupEvent{Event: "batch", Total: 3, First: "/a", Paths: 3, Warmed: 2, Skipped: 1, Bytes: 100})
+	pw.send(&warmupEvent{Event: "done", Total: 3, Warmed: 2, Skipped: 1, Bytes: 100})
+	dec := json.NewDecoder(conn)
+	for _, expect := range []string{"start", "batch", "done"} {
+		var e warmupEvent
+		if err = dec.Decode(&e); err != nil {
+			t.Fatalf("decode event: %s", err)
+		}
+		if e.Event != expect || e.Total != 3 || e.Time == 0 {
+			t.Fatalf("expect %s event, but got %+v", expect, e)
+		}
+		if expect == "batch" && (e.First != "/a" || e.Paths != 3 || e.Warmed != 2 || e.Bytes != 100) {
+			t.Fatalf("unexpected batch event: %+v", e)
+		}
+	}
+
+	// the reader is gone, sending should not fail or block
+	_ = conn.Close()
+	start := time.Now()
+	for i := 0; i < 100 && pw.w != nil; i++ {
+		pw.send(&warmupEvent{Event: "batch", First: strings.Repeat("x", 4096)})
+	}
+	if pw.w != nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("progress writer should be closed after the reader is gone")
+	}
+	pw.close()
+}
+
+func TestGroupBySize(t *testing.T) {
+	paths := make([]string, batchMax*3+5)
+	sizes := make([]uint64, len(paths))
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/f%d", i)
+		if i < 100 {
+			sizes[i] = 1 << 30
+		} else {
+			sizes[i] = uint64(i % 10)
+		}
+	}
+	grouped := groupBySize(paths, sizes)
+	if len(grouped) != len(paths) {
+		t.Fatalf("expect %d paths, but got %d", len(paths), len(grouped))
+	}
+	seen := make(map[string]bool)
+	for _, p := range grouped {
+		seen[p] = true
+	}
+	if len(seen) != len(paths) {
+		t.Fatalf("expect %d distinct paths, but got %d", len(paths), len(seen))
+	}
+	big := func(p string) bool {
+		var i int
+		_, _ = fmt.Sscanf(p, "/f%d", &i)
+		return i < 100
+	}
+	for i := 0; i < len(grouped); i += batchMax {
+		end := i + batchMax
+		if end > len(grouped) {
+			end = len(grouped)
+		}
+		var n int
+		for j, p := range grouped[i:end] {
+			if big(p) {
+				if j != n {
+					t.Fatalf("large file %s is at %d of batch %d, after small ones", p, j, i/batchMax)
+				}
+				n++
+			}
+		}
+		// the last batch has only 5 paths
+		if end-i == batchMax && (n < 30 || n > 35) || end-i < batchMax && n > 5 {
+			t.Fatalf("batch %d has %d large files", i/batchMax, n)
+		}
+	}
+	if r := groupBySize([]string{"/a", "/b", "/c"}, []uint64{1, 3, 2}); strings.Join(r, ",") != "/b,/c,/a" {
+		t.Fatalf("one batch: %v", r)
+	}
+}
+
+// BenchmarkGroupBy simulates warming up 4 batches in flight by 50 threads each, where all the large
+// files (64 MiB) are in the first batch, the mount point reads 10 GiB/s and takes 100us for a file.
+func BenchmarkGroupBy(b *testing.B) {
+	paths := make([]string, batchMax*4)
+	sizes := make([]uint64, len(paths))
+	size := make(map[string]uint64)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/f%d", i)
+		sizes[i] = 4 << 10
+		if i < 200 {
+			sizes[i] = 64 << 20
+		}
+		size[paths[i]] = sizes[i]
+	}
+	// the time to finish a batch, the next file is read by the first idle thread
+	simulate := func(batch []string) time.Duration {
+		var threads [50]time.Duration
+		for _, p := range batch {
+			idle := 0
+			for i := range threads {
+				if threads[i] < threads[idle] {
+					idle = i
+				}
+			}
+			threads[idle] += time.Microsecond*100 + time.Duration(size[p]*uint64(time.Second)/(10<<30))
+		}
+		var longest time.Duration
+		for _, d := range threads {
+			if d > longest {
+				longest = d
+			}
+		}
+		return longest
+	}
+	for _, mode := range []string{"path", "size"} {
+		b.Run(mode, func(b *testing.B) {
+			targets := paths
+			if mode == "size" {
+				targets = groupBySize(paths, sizes)
+			}
+			for i := 0; i < b.N; i++ {
+				dispatch(targets, 4, func(worker int, batch []string) {
+					time.Sleep(simulate(batch))
+				})
+			}
+		})
+	}
+}
+
+func TestReplayAccessLog(t *testing.T) {
+	m := meta.NewClient("sqlite3://"+filepath.Join(t.TempDir(), "replay.db"), &meta.Config{})
+	if err := m.Init(meta.Format{Name: "test", BlockSize: 4}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	_ = m.NewSession()
+	ctx := meta.Background
+	var dir meta.Ino
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &dir, nil); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	var chunkids []uint64
+	for _, name := range []string{"f1", "f2"} {
+		var inode meta.Ino
+		var cid uint64
+		if st := m.Create(ctx, dir, name, 0644, 022, 0, &inode, nil); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		if st := m.NewChunk(ctx, &cid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: cid, Size: 5000, Len: 5000}); st != 0 {
+			t.Fatalf("write %s: %s", name, st)
+		}
+		chunkids = append(chunkids, cid)
+	}
+
+	log := fmt.Sprintf(`10.0.0.1 - - [01/Jun/2022:10:00:00 +0000] "GET /bucket/test/chunks/0/0/%[1]d_0_4096 HTTP/1.1" 200 4096
+10.0.0.1 - - [01/Jun/2022:10:00:01 +0000] "GET /bucket/test/chunks/0/0/%[1]d_1_904?partNumber=1 HTTP/1.1" 200 904
+2022/06/01 10:00:02.000000 object.go:1 GET chunks%%2F0%%2F0%%2F%[1]d_0_4096 (0.001s)
+GET chunks/0/0/999_0_10
+/d/f2
+/d/f2
+not a key
+`, chunkids[0])
+	l, err := parseAccessLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if len(l.blocks) != 2 || len(l.blocks[chunkids[0]]) != 2 || l.blocks[999][0] != 10 {
+		t.Fatalf("blocks: %+v", l.blocks)
+	}
+	paths, err := l.resolve(m)
+	if err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"/d/f2", "/d/f1"}) {
+		t.Fatalf("paths: %+v", paths)
+	}
+	expected := replayCoverage{Lines: 7, Invalid: 1, Blocks: 3, BlockBytes: 4096 + 904 + 10, Resolved: 2,
+		ResolvedBytes: 4096 + 904, Paths: 1, Files: 1}
+	if l.coverage != expected {
+		t.Fatalf("coverage: expect %+v, got %+v", expected, l.coverage)
+	}
 }
@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func watchFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "stream the changes of the volume recorded in the journal (enabled by --journal-size) as JSON lines",
+		ArgsUsage: "META-URL",
+		Action:    watch,
+		Flags: []cli.Flag{
+			&cli.Uint64Flag{
+				Name:  "since",
+				Usage: "print the events after this sequence number (the last one consumed) to resume, 0 means from the oldest one kept",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Second,
+				Usage: "interval to poll the journal for new events",
+			},
+			&cli.DurationFlag{
+				Name:  "gap-timeout",
+				Value: time.Second * 10,
+				Usage: "wait for a missing event (appended late by a client) this long, then skip it as removed or lost",
+			},
+			&cli.BoolFlag{
+				Name:  "once",
+				Usage: "exit after printing the events in the journal, instead of waiting for new ones",
+			},
+		},
+	}
+}
+
+// journalTail reads the events in order of sequence numbers. The clients append the events
+// asynchronously, so an event could be missing while the ones after it are appended, it's waited
+// for at most gapTimeout, then skipped as removed from the journal or lost.
+type journalTail struct {
+	m          meta.Meta
+	next       uint64 // the sequence number of the next event, 0 means any
+	gapTimeout time.Duration
+	gapSince   time.Time // when the missing event is found, zero if there is none
+}
+
+// poll returns the events in order after the ones returned before, and whether there could be
+// more of them in the journal.
+func (t *journalTail) poll(limit int) ([]*meta.JournalEvent, bool, error) {
+	var since uint64
+	if t.next > 0 {
+		since = t.next - 1
+	}
+	var events []*meta.JournalEvent
+	if st := t.m.ReadJournal(meta.Background, since, limit, &events); st != 0 {
+		return nil, false, fmt.Errorf("read journal after %d: %s", since, st)
+	}
+	for i, e := range events {
+		if t.next > 0 && e.Seq > t.next {
+			if t.gapSince.IsZero() {
+				t.gapSince = time.Now()
+			}
+			if time.Since(t.gapSince) < t.gapTimeout {
+				return events[:i], false, nil
+			}
+			logger.Warnf("Events %d-%d are missing, they are removed from the journal or lost", t.next, e.Seq-1)
+		}
+		t.gapSince = time.Time{}
+		t.next = e.Seq + 1
+	}
+	return events, len(events) == limit, nil
+}
+
+func watch(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if format.JournalSize == 0 {
+		logger.Warnf("The journal is not enabled, please enable it by `juicefs config --journal-size`")
+	}
+	t := &journalTail{m: m, gapTimeout: ctx.Duration("gap-timeout")}
+	if since := ctx.Uint64("since"); since > 0 {
+		t.next = since + 1
+	}
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	for {
+		events, more, err := t.poll(1000)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err = enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		if more {
+			continue
+		}
+		if ctx.Bool("once") {
+			return nil
+		}
+		time.Sleep(ctx.Duration("interval"))
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestJournalTail(t *testing.T) {
+	m := meta.NewClient("memkv://watch/jfs", &meta.Config{Retries: 10, Strict: true})
+	if err := m.Init(meta.Format{Name: "test", JournalSize: 5}, true); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	var inode meta.Ino
+	var attr meta.Attr
+	for i := 0; i < 3; i++ {
+		if st := m.Mkdir(meta.Background, 1, fmt.Sprintf("d%d", i), 0755, 022, 0, &inode, &attr); st != 0 {
+			t.Fatalf("mkdir d%d: %s", i, st)
+		}
+	}
+	if err := m.CloseSession(); err != nil { // append the pending events
+		t.Fatalf("close session: %s", err)
+	}
+
+	tail := &journalTail{m: m, gapTimeout: time.Hour}
+	events, more, err := tail.poll(2)
+	if err != nil || len(events) != 2 || !more || events[0].Name != "d0" || events[1].Name != "d1" {
+		t.Fatalf("poll: %d events %v %v", len(events), more, err)
+	}
+	events, more, err = tail.poll(2)
+	if err != nil || len(events) != 1 || more || events[0].Name != "d2" {
+		t.Fatalf("poll: %d events %v %v", len(events), more, err)
+	}
+	last := events[0].Seq
+
+	// resume after the second one
+	tail = &journalTail{m: m, next: last, gapTimeout: time.Hour}
+	if events, _, err = tail.poll(10); err != nil || len(events) != 1 || events[0].Seq != last {
+		t.Fatalf("resume from %d: %d events %v", last-1, len(events), err)
+	}
+
+	// the oldest ones are removed beyond the journal size
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	for i := 3; i < 10; i++ {
+		if st := m.Mkdir(meta.Background, 1, fmt.Sprintf("d%d", i), 0755, 022, 0, &inode, &attr); st != 0 {
+			t.Fatalf("mkdir d%d: %s", i, st)
+		}
+	}
+	if err := m.CloseSession(); err != nil {
+		t.Fatalf("close session: %s", err)
+	}
+	tail = &journalTail{m: m, next: last + 1, gapTimeout: time.Hour}
+	if events, _, err = tail.poll(10); err != nil || len(events) != 0 || tail.next != last+1 {
+		t.Fatalf("missing events should be waited for: %d events %v", len(events), err)
+	}
+	tail.gapTimeout = 0
+	if events, _, err = tail.poll(10); err != nil || len(events) != 5 || events[0].Name != "d5" || tail.next != last+8 {
+		t.Fatalf("missing events should be skipped after timeout: %d events %v", len(events), err)
+	}
+}
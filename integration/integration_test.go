@@ -164,7 +164,7 @@ func mountSimpleMethod(url, mp string) {
 	conf.EntryTimeout = time.Second
 	conf.DirEntryTimeout = time.Second
 	v := vfs.NewVFS(conf, m, store)
-	serverErr := fuse.Serve(v, "", true)
+	serverErr := fuse.Serve(v, "", true, "", fuse.Concurrency{}, fuse.Buffers{})
 	if serverErr != nil {
 		log.Fatalf("fuse server err: %s\n", serverErr)
 	}
@@ -383,5 +383,5 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		DirEntryTimeout: time.Second,
 		Chunk:           &chunkConf,
 	}
-	return jfsgateway.NewJFSGateway(conf, m, store, true, true)
+	return jfsgateway.NewJFSGateway(conf, m, store, true, true, "", nil, nil)
 }
@@ -0,0 +1,211 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ScanFull scans the cache directory to find the cached blocks on startup.
+	ScanFull = "full"
+	// ScanFast trusts the index of cached blocks, and verifies a block when it's read the first time.
+	ScanFast = "fast"
+	// ScanNone discards the cached blocks on startup.
+	ScanNone = "none"
+)
+
+const indexHeader = "juicefs cache index v1"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func (cache *cacheStore) indexPath() string {
+	return filepath.Join(cache.dir, cacheDir+".index")
+}
+
+// loadCached finds the cached blocks on startup according to the scan mode.
+func (cache *cacheStore) loadCached() {
+	start := time.Now()
+	discarded, _ := filepath.Glob(filepath.Join(cache.dir, cacheDir+".*.discarded"))
+	switch cache.scanMode {
+	case ScanNone:
+		prefix := filepath.Join(cache.dir, cacheDir)
+		dst := fmt.Sprintf("%s.%d.discarded", prefix, start.UnixNano())
+		if err := os.Rename(prefix, dst); err == nil {
+			discarded = append(discarded, dst)
+		} else if !os.IsNotExist(err) {
+			logger.Warnf("Discard cached blocks in %s: %s, scan them instead", prefix, err)
+			cache.scanCached()
+			break
+		}
+		_ = os.Remove(cache.indexPath())
+		cache.Lock()
+		cache.keys = make(map[string]cacheItem)
+		cache.used = 0
+		cache.scanned = true
+		cache.Unlock()
+		logger.Infof("Disk cache (%s): discarded the cached blocks in %s", cache.dir, time.Since(start))
+	case ScanFast:
+		if err := cache.loadIndex(); err == nil {
+			cache.Lock()
+			logger.Infof("Disk cache (%s): loaded %d blocks (%d MB) from the index in %s", cache.dir, len(cache.keys), cache.used>>20, time.Since(start))
+			cache.Unlock()
+			break
+		} else if !os.IsNotExist(err) {
+			logger.Warnf("Load the index of cached blocks in %s: %s, scan them instead", cache.dir, err)
+		}
+		fallthrough
+	default:
+		cache.scanCached()
+		cache.Lock()
+		logger.Infof("Disk cache (%s): found %d blocks (%d MB) in %s", cache.dir, len(cache.keys), cache.used>>20, time.Since(start))
+		cache.Unlock()
+	}
+	for _, d := range discarded {
+		go func(d string) {
+			if err := os.RemoveAll(d); err != nil {
+				logger.Warnf("Remove discarded cache %s: %s", d, err)
+			}
+		}(d)
+	}
+}
+
+// saveIndex writes the cached blocks (with their checksums) into the index, which is used by the fast scan mode.
+func (cache *cacheStore) saveIndex() {
+	cache.Lock()
+	if !cache.scanned {
+		cache.Unlock()
+		return
+	}
+	keys := make(map[string]cacheItem, len(cache.keys))
+	for k, v := range cache.keys {
+		keys[k] = v
+	}
+	cache.Unlock()
+
+	path := cache.indexPath()
+	tmp := path + ".tmp"
+	err := func() error {
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cache.mode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		_, _ = fmt.Fprintln(w, indexHeader)
+		for k, v := range keys {
+			_, _ = fmt.Fprintf(w, "%s %d %d %d\n", k, v.size, v.atime, v.crc)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		logger.Warnf("Save the index of cached blocks in %s: %s", cache.dir, err)
+		_ = os.Remove(tmp)
+	}
+}
+
+func (cache *cacheStore) loadIndex() error {
+	f, err := os.Open(cache.indexPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() || s.Text() != indexHeader {
+		return fmt.Errorf("invalid header")
+	}
+	keys := make(map[string]cacheItem)
+	var used int64
+	for s.Scan() {
+		var key string
+		var it cacheItem
+		if n, err := fmt.Sscanf(s.Text(), "%s %d %d %d", &key, &it.size, &it.atime, &it.crc); err != nil || n != 4 || strings.Contains(key, "..") {
+			return fmt.Errorf("invalid line: %q", s.Text())
+		}
+		keys[key] = it
+		if it.size > 0 {
+			used += int64(it.size + 4096)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	for k := range keys {
+		cache.unverified[k] = true
+	}
+	// blocks cached after started
+	for k, v := range cache.keys {
+		if it, ok := keys[k]; ok && it.size > 0 {
+			used -= int64(it.size + 4096)
+		}
+		delete(cache.unverified, k)
+		keys[k] = v
+		if v.size > 0 {
+			used += int64(v.size + 4096)
+		}
+	}
+	cache.keys = keys
+	cache.used = used
+	cache.scanned = true
+	return nil
+}
+
+// verify checks the size and checksum (if known) of a block loaded from the index.
+func verify(f *os.File, it cacheItem) error {
+	size := int64(it.size)
+	if size < 0 {
+		size = -size
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("size %d != %d", fi.Size(), size)
+	}
+	if it.crc == 0 {
+		return nil
+	}
+	h := crc32.New(crcTable)
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if h.Sum32() != it.crc {
+		return fmt.Errorf("checksum %08x != %08x", h.Sum32(), it.crc)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
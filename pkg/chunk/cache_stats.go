@@ -0,0 +1,88 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// CacheStats is the counters of block cache since the process started or they were reset.
+type CacheStats struct {
+	Since       time.Time `json:"since"`
+	Hits        int64     `json:"hits"`
+	Misses      int64     `json:"misses"`
+	HitBytes    int64     `json:"hit_bytes"`    // served from cache
+	MissBytes   int64     `json:"miss_bytes"`   // served from object storage
+	BypassBytes int64     `json:"bypass_bytes"` // read from object storage without cache
+	Writes      int64     `json:"writes"`
+	WriteBytes  int64     `json:"write_bytes"`
+	Evicts      int64     `json:"evicts"`
+	Drops       int64     `json:"drops"`
+}
+
+// The prometheus counters can't be reset, so the values at the last reset are subtracted.
+var cacheBase = struct {
+	sync.Mutex
+	CacheStats
+}{CacheStats: CacheStats{Since: time.Now()}}
+
+func counterValue(c prometheus.Counter) int64 {
+	var m io_prometheus_client.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return int64(m.Counter.GetValue())
+}
+
+// ReadCacheStats returns the counters of block cache, and resets them to zero if reset is
+// true, the returned ones and the reset are done at once, so no event is lost between them.
+func ReadCacheStats(reset bool) CacheStats {
+	cacheBase.Lock()
+	defer cacheBase.Unlock()
+	now := CacheStats{
+		Since:       time.Now(),
+		Hits:        counterValue(cacheHits),
+		Misses:      counterValue(cacheMiss),
+		HitBytes:    counterValue(cacheHitBytes),
+		MissBytes:   counterValue(cacheMissBytes),
+		BypassBytes: counterValue(cacheBypassBytes),
+		Writes:      counterValue(cacheWrites),
+		WriteBytes:  counterValue(cacheWriteBytes),
+		Evicts:      counterValue(cacheEvicts),
+		Drops:       counterValue(cacheDrops),
+	}
+	base := cacheBase.CacheStats
+	if reset {
+		cacheBase.CacheStats = now
+	}
+	return CacheStats{
+		Since:       base.Since,
+		Hits:        now.Hits - base.Hits,
+		Misses:      now.Misses - base.Misses,
+		HitBytes:    now.HitBytes - base.HitBytes,
+		MissBytes:   now.MissBytes - base.MissBytes,
+		BypassBytes: now.BypassBytes - base.BypassBytes,
+		Writes:      now.Writes - base.Writes,
+		WriteBytes:  now.WriteBytes - base.WriteBytes,
+		Evicts:      now.Evicts - base.Evicts,
+		Drops:       now.Drops - base.Drops,
+	}
+}
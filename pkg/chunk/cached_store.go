@@ -39,6 +39,9 @@ const chunkSize = 1 << 26 // 64M
 const pageSize = 1 << 16  // 64K
 const SlowRequest = time.Second * time.Duration(10)
 
+// MaxInlineSize is the max size of the slices stored inline, which fit in the first page of a slice.
+const MaxInlineSize = pageSize
+
 var (
 	logger = utils.GetLogger("juicefs")
 
@@ -54,6 +57,10 @@ var (
 		Name: "blockcache_writes",
 		Help: "written cached block",
 	})
+	cacheDiskErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_disk_errors",
+		Help: "I/O errors of cache disks",
+	})
 	cacheDrops = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "blockcache_drops",
 		Help: "dropped block",
@@ -74,6 +81,14 @@ var (
 		Name: "blockcache_write_bytes",
 		Help: "write bytes of cached block",
 	})
+	cacheBypassBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_bypass_bytes",
+		Help: "read and written bytes bypassing the cache",
+	})
+	cacheBypassWriteBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_bypass_write_bytes",
+		Help: "written bytes bypassing the cache",
+	})
 	cacheReadHist = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "blockcache_read_hist_seconds",
 		Help:    "read cached block latency distribution",
@@ -98,6 +113,18 @@ var (
 		Name: "object_request_data_bytes",
 		Help: "Object requests size in bytes.",
 	}, []string{"method"})
+	objectTruncations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_request_truncations",
+		Help: "responses from object store shorter or longer than expected",
+	})
+	objectChecksumMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_checksum_mismatches",
+		Help: "blocks from object store not matching the checksums saved when written",
+	})
+	objectPutConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_put_conflicts",
+		Help: "blocks found existing when uploaded with PutIfAbsent",
+	})
 
 	stageBlocks = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "staging_blocks",
@@ -111,13 +138,14 @@ var (
 
 // chunk for read only
 type rChunk struct {
-	id     uint64
-	length int
-	store  *cachedStore
+	id      uint64
+	length  int
+	store   *cachedStore
+	nocache bool // read from and write to object storage directly
 }
 
 func chunkForRead(id uint64, length int, store *cachedStore) *rChunk {
-	return &rChunk{id, length, store}
+	return &rChunk{id: id, length: length, store: store}
 }
 
 func (c *rChunk) blockSize(indx int) int {
@@ -129,10 +157,77 @@ func (c *rChunk) blockSize(indx int) int {
 }
 
 func (c *rChunk) key(indx int) string {
-	if c.store.conf.Partitions > 1 {
-		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", c.id%256, c.id/1000/1000, c.id, indx, c.blockSize(indx))
+	return BlockKey(&c.store.conf, c.id, indx, c.blockSize(indx))
+}
+
+// BlockKey returns the key of the indx-th block (of bsize bytes) of slice id in object storage.
+// With KeyPrefixes, the keys of the slices since PrefixedFrom start with a prefix in hex
+// derived from the id, so the requests are spread across the partitions of object storage.
+func BlockKey(conf *Config, id uint64, indx, bsize int) string {
+	if conf.KeyPrefixes > 1 && id >= conf.PrefixedFrom {
+		return fmt.Sprintf("chunks/%0*X/%v/%v_%v_%v", prefixWidth(conf.KeyPrefixes), id%uint64(conf.KeyPrefixes), id/1000/1000, id, indx, bsize)
+	}
+	if conf.Partitions > 1 {
+		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", id%256, id/1000/1000, id, indx, bsize)
+	}
+	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", id/1000/1000, id/1000, id, indx, bsize)
+}
+
+// prefixWidth returns the number of hex digits of the largest one among n prefixes.
+func prefixWidth(n int) int {
+	w := 1
+	for n--; n >= 16; n >>= 4 {
+		w++
+	}
+	return w
+}
+
+// BlockRange is a range of data in a block object.
+type BlockRange struct {
+	Key  string
+	Size int // size of the block
+	Off  int // offset in the block
+	Len  int
+}
+
+// SliceBlocks returns the ranges of blocks holding the data [off, off+length) of slice id,
+// which has size bytes in total.
+func SliceBlocks(conf *Config, id uint64, size, off, length int) []BlockRange {
+	var rs []BlockRange
+	for length > 0 && off < size {
+		indx := off / conf.BlockSize
+		bsize := size - indx*conf.BlockSize
+		if bsize > conf.BlockSize {
+			bsize = conf.BlockSize
+		}
+		boff := off - indx*conf.BlockSize
+		n := bsize - boff
+		if n > length {
+			n = length
+		}
+		rs = append(rs, BlockRange{BlockKey(conf, id, indx, bsize), bsize, boff, n})
+		off += n
+		length -= n
+	}
+	return rs
+}
+
+// inline tells whether the data of the chunk could be stored inline instead of in object storage.
+func (c *rChunk) inline() bool {
+	return c.length > 0 && c.length <= c.store.conf.InlineSize && c.store.conf.LoadInline != nil
+}
+
+// loadInline returns the data of the chunk stored inline, nil if it's not stored (e.g. written by
+// a client without InlineSize), then it should be read from object storage.
+func (c *rChunk) loadInline() ([]byte, error) {
+	data, err := c.store.conf.LoadInline(c.id)
+	if err != nil {
+		return nil, fmt.Errorf("load inline slice %d: %s", c.id, err)
 	}
-	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", c.id/1000/1000, c.id/1000, c.id, indx, c.blockSize(indx))
+	if data != nil && len(data) != c.length {
+		return nil, fmt.Errorf("inline slice %d has %d bytes, but expect %d", c.id, len(data), c.length)
+	}
+	return data, nil
 }
 
 func (c *rChunk) index(off int) int {
@@ -160,6 +255,20 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		return 0, io.EOF
 	}
 
+	if c.inline() {
+		data, err := c.loadInline()
+		if err != nil {
+			return 0, err
+		}
+		if data != nil {
+			n = copy(p, data[off:])
+			if n < len(p) {
+				return n, io.EOF
+			}
+			return n, nil
+		}
+	}
+
 	indx := c.index(off)
 	boff := off % c.store.conf.BlockSize
 	blockSize := c.blockSize(indx)
@@ -185,7 +294,9 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	}
 
 	key := c.key(indx)
-	if c.store.conf.CacheSize > 0 {
+	if c.nocache {
+		cacheBypassBytes.Add(float64(len(p)))
+	} else if c.store.conf.CacheSize > 0 {
 		start := time.Now()
 		r, err := c.store.bcache.load(key)
 		if err == nil {
@@ -204,18 +315,21 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		}
 	}
 
-	cacheMiss.Add(1)
-	cacheMissBytes.Add(float64(len(p)))
+	if !c.nocache {
+		cacheMiss.Add(1)
+		cacheMissBytes.Add(float64(len(p)))
+	}
 
-	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	// the partial reads can't be verified with the checksums of blocks
+	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 && !c.store.conf.VerifyChecksums {
 		if c.store.downLimit != nil {
 			c.store.downLimit.Wait(int64(len(p)))
 		}
 		// partial read
 		st := time.Now()
-		in, err := c.store.storage.Get(key, int64(boff), int64(len(p)))
+		in, err := object.GetWithContext(ctx, c.store.storage, key, int64(boff), int64(len(p)))
 		if err == nil {
-			n, err = io.ReadFull(in, p)
+			n, err = c.store.readBlock(in, p, nil)
 			_ = in.Close()
 		}
 		used := time.Since(st)
@@ -225,7 +339,9 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		}
 		objectDataBytes.WithLabelValues("GET").Add(float64(n))
 		objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
-		c.store.fetcher.fetch(key)
+		if !c.nocache {
+			c.store.fetcher.fetch(key)
+		}
 		if err == nil {
 			return n, nil
 		} else {
@@ -233,20 +349,26 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		}
 	}
 
-	block, err := c.store.group.Execute(key, func() (*Page, error) {
+	// without a deadline the reader always waits for the shared request, so its page can be filled in place
+	waiting := ctx.Done() == nil
+	// the request is shared by all the waiting readers, and canceled when all of them have given up
+	block, err := c.store.group.ExecuteContext(ctx, key, func(gctx context.Context) (*Page, error) {
 		tmp := page
-		if boff > 0 || len(p) < blockSize {
+		if boff > 0 || len(p) < blockSize || !waiting {
 			tmp = NewOffPage(blockSize)
 		} else {
 			tmp.Acquire()
 		}
 		tmp.Acquire()
-		err := utils.WithTimeout(func() error {
-			defer tmp.Release()
-			return c.store.load(key, tmp, c.store.shouldCache(blockSize), false)
-		}, c.store.conf.GetTimeout)
+		gctx, cancel := context.WithTimeout(gctx, c.store.conf.GetTimeout)
+		defer cancel()
+		defer tmp.Release()
+		err := c.store.load(gctx, key, tmp, !c.nocache && c.store.shouldCache(blockSize), false)
 		return tmp, err
 	})
+	if block == nil {
+		return 0, err
+	}
 	defer block.Release()
 	if err != nil {
 		return 0, err
@@ -278,20 +400,37 @@ func (c *rChunk) Remove() error {
 		// no block
 		return nil
 	}
+	if c.inline() {
+		// the data stored inline is removed together with the slice
+		if data, err := c.loadInline(); err != nil || data != nil {
+			return err
+		}
+	}
 
-	lastIndx := (c.length - 1) / c.store.conf.BlockSize
-	var err error
-	for i := 0; i <= lastIndx; i++ {
-		// there could be multiple clients try to remove the same chunk in the same time,
-		// any of them should succeed if any blocks is removed
-		key := c.key(i)
+	keys := c.keys()
+	for _, key := range keys {
 		c.store.pendingMutex.Lock()
 		delete(c.store.pendingKeys, key)
 		c.store.pendingMutex.Unlock()
 		c.store.bcache.remove(key)
-		if e := c.delete(i); e != nil {
-			err = e
-		}
+	}
+	if len(keys) == 1 {
+		return c.delete(0)
+	}
+	// there could be multiple clients try to remove the same chunk in the same time,
+	// any of them should succeed if any blocks is removed
+	st := time.Now()
+	errs := object.DeleteMany(c.store.storage, keys)
+	used := time.Since(st)
+	logger.Debugf("DELETE %d blocks of chunk %d (%d failed, %.3fs)", len(keys), c.id, len(errs), used.Seconds())
+	if used > SlowRequest {
+		logger.Infof("slow request: DELETE %d blocks of chunk %d (%d failed, %.3fs)", len(keys), c.id, len(errs), used.Seconds())
+	}
+	objectReqsHistogram.WithLabelValues("DELETE").Observe(used.Seconds())
+	var err error
+	for key, e := range errs {
+		objectReqErrors.Add(1)
+		err = fmt.Errorf("delete %s: %s", key, e)
 	}
 	return err
 }
@@ -330,14 +469,19 @@ type wChunk struct {
 	errors      chan error
 	uploadError error
 	pendings    int
+	sums        []uint32 // checksums of the blocks, with VerifyChecksums
 }
 
 func chunkForWrite(id uint64, store *cachedStore) *wChunk {
-	return &wChunk{
-		rChunk: rChunk{id, 0, store},
+	c := &wChunk{
+		rChunk: rChunk{id: id, store: store},
 		pages:  make([][]*Page, chunkSize/store.conf.BlockSize),
 		errors: make(chan error, chunkSize/store.conf.BlockSize),
 	}
+	if store.conf.VerifyChecksums {
+		c.sums = make([]uint32, chunkSize/store.conf.BlockSize)
+	}
+	return c
 }
 
 func (c *wChunk) SetID(id uint64) {
@@ -389,7 +533,8 @@ func (c *wChunk) WriteAt(p []byte, off int64) (n int, err error) {
 	return n, nil
 }
 
-func (c *wChunk) put(key string, p *Page) error {
+// put uploads a block, retry tells that a previous try of it has failed.
+func (c *wChunk) put(key string, p *Page, retry bool) error {
 	if c.store.upLimit != nil {
 		c.store.upLimit.Wait(int64(len(p.Data)))
 	}
@@ -397,7 +542,7 @@ func (c *wChunk) put(key string, p *Page) error {
 	return utils.WithTimeout(func() error {
 		defer p.Release()
 		st := time.Now()
-		err := c.store.storage.Put(key, bytes.NewReader(p.Data))
+		err := c.store.putObject(key, p.Data, retry)
 		used := time.Since(st)
 		logger.Debugf("PUT %s (%s, %.3fs)", key, err, used.Seconds())
 		if used > SlowRequest {
@@ -428,43 +573,46 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		return
 	}
 	buf.Data = buf.Data[:n]
-	if blen < c.store.conf.BlockSize {
+	if blen < c.store.conf.BlockSize && !c.nocache {
 		// block will be freed after written into disk
 		c.store.bcache.cache(key, block, false)
 	}
 	block.Release()
 
+	// the memory of block is held by upload()
 	c.store.currentUpload <- true
 	defer func() {
 		buf.Release()
-		<-c.store.currentUpload
+		c.store.finishUpload(blen)
 	}()
 
 	try := 0
 	for try <= 10 && c.uploadError == nil {
-		err = c.put(key, buf)
+		err = c.put(key, buf, try > 0)
 		if err == nil {
 			c.errors <- nil
 			return
 		}
+		if errors.Is(err, os.ErrExist) {
+			break
+		}
 		try++
 		logger.Warnf("upload %s: %s (try %d)", key, err, try)
 		time.Sleep(time.Second * time.Duration(try*try))
 	}
-	c.errors <- fmt.Errorf("upload block %s: %s (after %d tries)", key, err, try)
+	c.errors <- fmt.Errorf("upload block %s: %w (after %d tries)", key, err, try)
 }
 
 func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 	blockSize := len(block.Data)
 	defer c.store.bcache.uploaded(key, blockSize)
-	defer func() {
-		<-c.store.currentUpload
-	}()
+	defer c.store.finishUpload(blockSize)
 	select {
 	case c.store.currentUpload <- true:
 	default:
 		// release the memory and wait
 		block.Release()
+		c.store.uploadBuf.release(int64(blockSize))
 		c.store.pendingMutex.Lock()
 		c.store.pendingKeys[key] = time.Now()
 		c.store.pendingMutex.Unlock()
@@ -475,7 +623,7 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		}()
 
 		logger.Debugf("wait to upload %s", key)
-		c.store.currentUpload <- true
+		c.store.startUpload(blockSize)
 
 		// load from disk
 		f, err := os.Open(stagingPath)
@@ -518,8 +666,8 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 
 	try := 0
 	for c.uploadError == nil {
-		err = c.put(key, buf)
-		if err == nil {
+		err = c.put(key, buf, try > 0)
+		if err == nil || errors.Is(err, os.ErrExist) {
 			break
 		}
 		logger.Warnf("upload %s: %s (tried %d)", key, err, try)
@@ -539,6 +687,8 @@ func (c *wChunk) upload(indx int) {
 	pages := c.pages[indx]
 	c.pages[indx] = nil
 	c.pendings++
+	// the writer is blocked here if too much memory is held by the uploads
+	c.store.uploadBuf.acquire(int64(blen))
 
 	go func() {
 		var block *Page
@@ -555,7 +705,14 @@ func (c *wChunk) upload(indx int) {
 				logger.Fatalf("block length does not match: %v != %v", off, blen)
 			}
 		}
-		if c.store.conf.Writeback {
+		if c.sums != nil {
+			c.sums[indx] = checksum(block.Data)
+		}
+		if c.nocache {
+			cacheBypassBytes.Add(float64(blen))
+			cacheBypassWriteBytes.Add(float64(blen))
+			c.syncUpload(key, block)
+		} else if c.store.conf.Writeback {
 			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen))
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
@@ -566,6 +723,7 @@ func (c *wChunk) upload(indx int) {
 					go c.asyncUpload(key, block, stagingPath)
 				} else {
 					block.Release()
+					c.store.uploadBuf.release(int64(blen))
 					c.store.pendingMutex.Lock()
 					c.store.pendingKeys[key] = time.Now()
 					c.store.pendingMutex.Unlock()
@@ -607,6 +765,9 @@ func (c *wChunk) Finish(length int) error {
 	if c.length != length {
 		return fmt.Errorf("Length mismatch: %v != %v", c.length, length)
 	}
+	if c.uploaded == 0 && length > 0 && length <= c.store.conf.InlineSize && c.store.conf.SaveInline != nil {
+		return c.saveInline()
+	}
 
 	n := (length-1)/c.store.conf.BlockSize + 1
 	if err := c.FlushTo(n * c.store.conf.BlockSize); err != nil {
@@ -618,6 +779,24 @@ func (c *wChunk) Finish(length int) error {
 			return err
 		}
 	}
+	if c.sums != nil && c.store.conf.SaveChecksums != nil {
+		if err := c.store.conf.SaveChecksums(c.id, c.sums[:n]); err != nil {
+			return fmt.Errorf("save checksums of slice %d: %s", c.id, err)
+		}
+	}
+	return nil
+}
+
+// saveInline stores the data of a small slice (in the first page) inline, no block is uploaded.
+func (c *wChunk) saveInline() error {
+	page := c.pages[0][0]
+	c.pages[0] = nil
+	// the page is reused, but the data could be kept by SaveInline
+	data := append([]byte(nil), page.Data[:c.length]...)
+	freePage(page)
+	if err := c.store.conf.SaveInline(c.id, data); err != nil {
+		return fmt.Errorf("save inline slice %d: %s", c.id, err)
+	}
 	return nil
 }
 
@@ -635,25 +814,46 @@ func (c *wChunk) Abort() {
 
 // Config contains options for cachedStore
 type Config struct {
-	CacheDir       string
-	CacheMode      os.FileMode
-	CacheSize      int64
-	FreeSpace      float32
-	AutoCreate     bool
-	Compress       string
-	MaxUpload      int
-	UploadLimit    int64 // bytes per second
-	DownloadLimit  int64 // bytes per second
-	Writeback      bool
-	UploadDelay    time.Duration
-	Partitions     int
-	BlockSize      int
-	GetTimeout     time.Duration
-	PutTimeout     time.Duration
-	CacheFullBlock bool
-	BufferSize     int
-	Readahead      int
-	Prefetch       int
+	CacheDir        string
+	CacheMode       os.FileMode
+	CacheSize       int64
+	FreeSpace       float32
+	AutoCreate      bool
+	Compress        string
+	MaxUpload       int
+	MaxUploadBuffer int64 // max bytes of the blocks held in memory by the uploads, 0 means unlimited
+	UploadLimit     int64 // bytes per second
+	DownloadLimit   int64 // bytes per second
+	Writeback       bool
+	UploadDelay     time.Duration
+	Partitions      int
+	KeyPrefixes     int    // number of prefixes of the keys, 0 means no prefix
+	PrefixedFrom    uint64 // the first slice id with the prefixed keys
+	BlockSize       int
+	GetTimeout      time.Duration
+	GetParts        int   // number of ranged requests to download a large object in parallel
+	GetThreshold    int64 // min size of a download to be split into parts
+	CoalesceGap     int64 // max distance of the ranged reads of a block to be merged into one request, 0 means disabled
+	CoalesceWait    time.Duration
+	PutTimeout      time.Duration
+	CacheFullBlock  bool
+	CacheScanMode   string // how to find the cached blocks on startup: full, fast or none
+	BufferSize      int
+	Readahead       int
+	Prefetch        int
+	PutIfAbsent     bool // upload the blocks only if they don't exist, to detect the slice ids used twice
+
+	VerifyChecksums bool                                 // save the checksums of the blocks written, and verify the blocks read from object storage with them
+	SaveChecksums   func(id uint64, sums []uint32) error `json:"-"`
+	LoadChecksums   func(id uint64) ([]uint32, error)    `json:"-"` // nil if they are not saved
+
+	InlineSize int                                // max size of the slices stored inline by SaveInline instead of in object storage, at most MaxInlineSize
+	SaveInline func(id uint64, data []byte) error `json:"-"`
+	LoadInline func(id uint64) ([]byte, error)    `json:"-"` // nil if it's not stored
+
+	CacheErrorPolicy    string                      // what to do when a cache dir fails: retry (default), bypass or fail
+	CacheErrorThreshold int                         // consecutive I/O errors for a cache dir to fail, 10 by default
+	OnCacheFailure      func(dir string, err error) `json:"-"` // called with CacheErrorFail
 }
 
 type cachedStore struct {
@@ -663,15 +863,18 @@ type cachedStore struct {
 	conf          Config
 	group         *Controller
 	currentUpload chan bool
+	uploadBuf     *uploadBuffer
 	pendingKeys   map[string]time.Time
 	pendingMutex  sync.Mutex
 	compressor    compress.Compressor
 	seekable      bool
 	upLimit       *ratelimit.Bucket
 	downLimit     *ratelimit.Bucket
+	sumsMutex     sync.Mutex
+	sums          map[uint64][]uint32 // checksums of the recently read slices
 }
 
-func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool) (err error) {
+func (store *cachedStore) load(ctx context.Context, key string, page *Page, cache bool, forceCache bool) (err error) {
 	defer func() {
 		e := recover()
 		if e != nil {
@@ -684,36 +887,45 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	if store.downLimit != nil && !compressed {
 		store.downLimit.Wait(int64(len(page.Data)))
 	}
+	var buf []byte
+	if compressed {
+		c := NewOffPage(needed)
+		defer c.Release()
+		buf = c.Data
+	} else {
+		buf = page.Data
+	}
 	err = errors.New("Not downloaded")
 	var in io.ReadCloser
+	var n int
 	tried := 0
 	start := time.Now()
 	// it will be retried outside
-	for err != nil && tried < 2 {
+	for err != nil && tried < 2 && ctx.Err() == nil {
 		time.Sleep(time.Second * time.Duration(tried*tried))
 		if tried > 0 {
 			logger.Warnf("GET %s: %s; retrying", key, err)
 			objectReqErrors.Add(1)
 			start = time.Now()
 		}
-		in, err = store.storage.Get(key, 0, -1)
+		// the size of compressed block is unknown, it can not be split into parts
+		var limit int64 = -1
+		if !compressed && store.conf.GetParts > 1 {
+			limit = int64(len(page.Data))
+		}
+		in, err = object.GetWithContext(ctx, store.storage, key, 0, limit)
 		tried++
-	}
-	var n int
-	var buf []byte
-	if err == nil {
-		if compressed {
-			c := NewOffPage(needed)
-			defer c.Release()
-			buf = c.Data
-		} else {
-			buf = page.Data
+		if err == nil {
+			if compressed {
+				n, err = store.readBlock(in, buf, page.Data)
+			} else {
+				n, err = store.readBlock(in, buf, nil)
+			}
+			_ = in.Close()
+			if err == nil && store.conf.VerifyChecksums {
+				err = store.verify(key, page.Data)
+			}
 		}
-		n, err = io.ReadFull(in, buf)
-		_ = in.Close()
-	}
-	if compressed && err == io.ErrUnexpectedEOF {
-		err = nil
 	}
 	used := time.Since(start)
 	logger.Debugf("GET %s (%s, %.3fs)", key, err, used.Seconds())
@@ -727,14 +939,7 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
 	if err != nil {
 		objectReqErrors.Add(1)
-		return fmt.Errorf("get %s: %s", key, err)
-	}
-	if compressed {
-		n, err = store.compressor.Decompress(page.Data, buf[:n])
-	}
-	if err != nil || n < len(page.Data) {
-		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
-			used, tried)
+		return fmt.Errorf("get %s: %s (tried %d)", key, err, tried)
 	}
 	if cache {
 		store.bcache.cache(key, page, forceCache)
@@ -742,12 +947,104 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	return nil
 }
 
+// maxCachedChecksums is the number of slices whose checksums are kept in memory.
+const maxCachedChecksums = 10000
+
+// checksums returns the checksums of the blocks of slice id, nil if they are not saved.
+func (store *cachedStore) checksums(id uint64) ([]uint32, error) {
+	store.sumsMutex.Lock()
+	sums, ok := store.sums[id]
+	store.sumsMutex.Unlock()
+	if ok {
+		return sums, nil
+	}
+	sums, err := store.conf.LoadChecksums(id)
+	if err != nil {
+		return nil, err
+	}
+	store.sumsMutex.Lock()
+	if len(store.sums) >= maxCachedChecksums {
+		for k := range store.sums {
+			delete(store.sums, k)
+			break
+		}
+	}
+	store.sums[id] = sums
+	store.sumsMutex.Unlock()
+	return sums, nil
+}
+
+// verify checks a block loaded from object storage with the checksum saved when it was written, the
+// blocks without checksums (e.g. written without VerifyChecksums) are not verified.
+func (store *cachedStore) verify(key string, data []byte) error {
+	id, indx, ok := parseBlockKey(key)
+	if !ok || store.conf.LoadChecksums == nil {
+		return nil
+	}
+	sums, err := store.checksums(id)
+	if err != nil {
+		logger.Warnf("Load checksums of slice %d: %s, %s is not verified", id, err, key)
+		return nil
+	}
+	if indx >= len(sums) {
+		return nil
+	}
+	if crc := checksum(data); crc != sums[indx] {
+		objectChecksumMismatches.Add(1)
+		logger.Errorf("Block %s is corrupted in object storage: checksum %08x != %08x", key, crc, sums[indx])
+		return fmt.Errorf("checksum %08x != %08x", crc, sums[indx])
+	}
+	return nil
+}
+
+// readBlock reads a block from in into buf, which should be filled exactly, or decompresses it into
+// page if it's not nil, as the size of compressed block is unknown. A response shorter or longer
+// than expected is an error, so it's fetched again instead of being used as valid data. It returns
+// the number of bytes read from in.
+func (store *cachedStore) readBlock(in io.Reader, buf, page []byte) (int, error) {
+	n, err := io.ReadFull(in, buf)
+	if page != nil && err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		objectTruncations.Add(1)
+		return n, fmt.Errorf("truncated response: %d < %d bytes", n, len(buf))
+	} else if err != nil {
+		return n, err
+	}
+	if n == len(buf) {
+		var extra [1]byte
+		if m, _ := in.Read(extra[:]); m > 0 {
+			objectTruncations.Add(1)
+			return n, fmt.Errorf("oversized response: more than %d bytes", n)
+		}
+	}
+	if page != nil {
+		size, err := store.compressor.Decompress(page, buf[:n])
+		if err != nil {
+			return n, fmt.Errorf("decompress: %s", err)
+		}
+		if size != len(page) {
+			objectTruncations.Add(1)
+			return n, fmt.Errorf("truncated response: %d < %d bytes after decompressed", size, len(page))
+		}
+	}
+	return n, nil
+}
+
 // NewCachedStore create a cached store.
 func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	compressor := compress.NewCompressor(config.Compress)
 	if compressor == nil {
 		logger.Fatalf("unknown compress algorithm: %s", config.Compress)
 	}
+	switch config.CacheScanMode {
+	case "":
+		config.CacheScanMode = ScanFull
+	case ScanFull, ScanFast, ScanNone:
+	default:
+		logger.Fatalf("unknown cache scan mode: %s", config.CacheScanMode)
+	}
 	if config.GetTimeout == 0 {
 		config.GetTimeout = time.Second * 60
 	}
@@ -755,13 +1052,15 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 		config.PutTimeout = time.Second * 60
 	}
 	store := &cachedStore{
-		storage:       storage,
+		storage:       object.WithCoalescedGet(object.WithParallelGet(storage, config.GetThreshold, config.GetParts), config.CoalesceGap, config.CoalesceWait),
 		conf:          config,
 		currentUpload: make(chan bool, config.MaxUpload),
+		uploadBuf:     newUploadBuffer(config.MaxUploadBuffer),
 		compressor:    compressor,
 		seekable:      compressor.CompressBound(0) == 0,
 		pendingKeys:   make(map[string]time.Time),
 		group:         &Controller{},
+		sums:          make(map[uint64][]uint32),
 	}
 	if config.UploadLimit > 0 {
 		// there are overheads coming from HTTP/TCP/IP
@@ -781,7 +1080,7 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		_ = store.load(key, p, true, true)
+		_ = store.load(context.Background(), key, p, true, true)
 	})
 	_ = prometheus.Register(cacheHits)
 	_ = prometheus.Register(cacheHitBytes)
@@ -789,6 +1088,8 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	_ = prometheus.Register(cacheMissBytes)
 	_ = prometheus.Register(cacheWrites)
 	_ = prometheus.Register(cacheWriteBytes)
+	_ = prometheus.Register(cacheBypassBytes)
+	_ = prometheus.Register(cacheBypassWriteBytes)
 	_ = prometheus.Register(cacheDrops)
 	_ = prometheus.Register(cacheEvicts)
 	_ = prometheus.Register(cacheReadHist)
@@ -811,11 +1112,33 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 			_, used := store.bcache.stats()
 			return float64(used)
 		}))
+	_ = prometheus.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "blockcache_pinned_bytes",
+			Help: "number of cached bytes which are pinned",
+		},
+		func() float64 {
+			return float64(store.bcache.pinnedBytes())
+		}))
+	_ = prometheus.Register(cacheDiskErrors)
+	_ = prometheus.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "blockcache_failed_dirs",
+			Help: "number of cache dirs not used any more after too many I/O errors",
+		},
+		func() float64 {
+			return float64(store.bcache.failedDirs())
+		}))
 	_ = prometheus.Register(objectReqsHistogram)
 	_ = prometheus.Register(objectReqErrors)
 	_ = prometheus.Register(objectDataBytes)
+	_ = prometheus.Register(objectTruncations)
+	_ = prometheus.Register(objectChecksumMismatches)
+	_ = prometheus.Register(objectPutConflicts)
 	_ = prometheus.Register(stageBlocks)
 	_ = prometheus.Register(stageBlockBytes)
+	_ = prometheus.Register(uploadBufferBytes)
+	_ = prometheus.Register(uploadBufferWaits)
 
 	if store.conf.CacheDir != "memory" && store.conf.Writeback && store.conf.UploadDelay > 0 {
 		logger.Infof("delay uploading by %s", store.conf.UploadDelay)
@@ -833,10 +1156,38 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	return store
 }
 
+// startUpload holds the memory of a block and then a slot to upload it, they are always held in
+// this order, so an upload holding a slot never waits for the memory held by the others.
+func (store *cachedStore) startUpload(size int) {
+	store.uploadBuf.acquire(int64(size))
+	store.currentUpload <- true
+}
+
+func (store *cachedStore) finishUpload(size int) {
+	<-store.currentUpload
+	store.uploadBuf.release(int64(size))
+}
+
 func (store *cachedStore) shouldCache(size int) bool {
 	return store.conf.CacheFullBlock || size < store.conf.BlockSize || store.conf.UploadDelay > 0
 }
 
+// parseBlockKey returns the slice id and the index of the block in key.
+func parseBlockKey(key string) (id uint64, indx int, ok bool) {
+	ps := strings.Split(key[strings.LastIndexByte(key, '/')+1:], "_")
+	if len(ps) != 3 {
+		return
+	}
+	var err error
+	if id, err = strconv.ParseUint(ps[0], 10, 64); err != nil {
+		return
+	}
+	if indx, err = strconv.Atoi(ps[1]); err != nil {
+		return
+	}
+	return id, indx, true
+}
+
 func parseObjOrigSize(key string) int {
 	p := strings.LastIndexByte(key, '_')
 	l, _ := strconv.Atoi(key[p+1:])
@@ -844,18 +1195,16 @@ func parseObjOrigSize(key string) int {
 }
 
 func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
-	store.currentUpload <- true
+	blockSize := parseObjOrigSize(key)
+	store.startUpload(blockSize)
 	go func() {
-		defer func() {
-			<-store.currentUpload
-		}()
+		defer store.finishUpload(blockSize)
 
 		f, err := os.Open(stagingPath)
 		if err != nil {
 			logger.Errorf("open %s: %s", stagingPath, err)
 			return
 		}
-		blockSize := parseObjOrigSize(key)
 		block := NewOffPage(blockSize)
 		_, err = io.ReadFull(f, block.Data)
 		_ = f.Close()
@@ -879,7 +1228,7 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 				store.upLimit.Wait(int64(len(compressed)))
 			}
 			st := time.Now()
-			err := store.storage.Put(key, bytes.NewReader(compressed))
+			err := store.putObject(key, compressed, try > 0)
 			used := time.Since(st)
 			logger.Debugf("PUT %s (%s, %.3fs)", key, err, used.Seconds())
 			if used > SlowRequest {
@@ -892,6 +1241,9 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 			} else {
 				objectReqErrors.Add(1)
 			}
+			if errors.Is(err, os.ErrExist) {
+				break
+			}
 			logger.Warnf("upload %s: %s (try %d)", key, err, try)
 			try++
 			time.Sleep(time.Second * time.Duration(try*try))
@@ -907,6 +1259,25 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 	}()
 }
 
+// putObject uploads a block. With PutIfAbsent it fails with os.ErrExist if the block exists, which
+// means the slice id is used twice (a bug in the metadata), unless a previous (timed out) try of it
+// may have written the block.
+func (store *cachedStore) putObject(key string, data []byte, retry bool) error {
+	if !store.conf.PutIfAbsent {
+		return store.storage.Put(key, bytes.NewReader(data))
+	}
+	err := object.PutIfAbsent(store.storage, key, bytes.NewReader(data))
+	if errors.Is(err, os.ErrExist) {
+		if retry {
+			logger.Debugf("Block %s exists, it's likely written by a previous try", key)
+			return nil
+		}
+		objectPutConflicts.Inc()
+		logger.Errorf("Block %s exists already, the slice id is likely used twice", key)
+	}
+	return err
+}
+
 func (store *cachedStore) uploadDelayedStaging() {
 	store.pendingMutex.Lock()
 	cutoff := time.Now().Add(-store.conf.UploadDelay)
@@ -928,13 +1299,31 @@ func (store *cachedStore) NewWriter(chunkid uint64) Writer {
 	return chunkForWrite(chunkid, store)
 }
 
+func (store *cachedStore) NewUncachedReader(chunkid uint64, length int) Reader {
+	c := chunkForRead(chunkid, length, store)
+	c.nocache = true
+	return c
+}
+
+func (store *cachedStore) NewUncachedWriter(chunkid uint64) Writer {
+	c := chunkForWrite(chunkid, store)
+	c.nocache = true
+	return c
+}
+
 func (store *cachedStore) Remove(chunkid uint64, length int) error {
+	store.sumsMutex.Lock()
+	delete(store.sums, chunkid)
+	store.sumsMutex.Unlock()
 	r := chunkForRead(chunkid, length, store)
 	return r.Remove()
 }
 
 func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 	r := chunkForRead(chunkid, int(length), store)
+	if r.inline() {
+		return nil // read from meta without cache
+	}
 	keys := r.keys()
 	var err error
 	for _, k := range keys {
@@ -950,7 +1339,7 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		if e := store.load(k, p, true, true); e != nil {
+		if e := store.load(context.Background(), k, p, true, true); e != nil {
 			logger.Warnf("Failed to load key: %s %s", k, e)
 			err = e
 		}
@@ -958,8 +1347,46 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 	return err
 }
 
+func (store *cachedStore) CheckCache(chunkid uint64, length uint32) uint64 {
+	r := chunkForRead(chunkid, int(length), store)
+	if r.inline() {
+		return uint64(length)
+	}
+	var cached uint64
+	for _, k := range r.keys() {
+		if f, e := store.bcache.load(k); e == nil {
+			_ = f.Close()
+			cached += uint64(parseObjOrigSize(k))
+		}
+	}
+	return cached
+}
+
+// PinCache marks the blocks of the chunk as non-evictable in cache until the chunk is removed,
+// they should be filled by FillCache.
+func (store *cachedStore) PinCache(chunkid uint64, length uint32) error {
+	r := chunkForRead(chunkid, int(length), store)
+	if r.inline() {
+		return nil
+	}
+	for _, k := range r.keys() {
+		if err := store.bcache.pin(k, parseObjOrigSize(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (store *cachedStore) UsedMemory() int64 {
 	return store.bcache.usedMemory()
 }
 
+func (store *cachedStore) CacheSpace() (int64, int64) {
+	return store.bcache.space()
+}
+
+func (store *cachedStore) UpdateCredentials(accessKey, secretKey, token string) error {
+	return object.UpdateCredentials(store.storage, accessKey, secretKey, token)
+}
+
 var _ ChunkStore = &cachedStore{}
@@ -20,13 +20,20 @@ package chunk
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/object/objecttest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func forgeChunk(store ChunkStore, chunkid uint64, size int) error {
@@ -136,6 +143,19 @@ func TestStoreCompressed(t *testing.T) {
 	testStore(t, store)
 }
 
+func TestStoreParallelGet(t *testing.T) {
+	blob, _ := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.GetParts = 4
+	conf.GetThreshold = 64 << 10
+	store := NewCachedStore(blob, conf)
+	if _, ok := store.(*cachedStore).storage.(object.ContextGetter); !ok {
+		t.Fatalf("parallel get is not enabled")
+	}
+	testStore(t, store)
+}
+
 func TestStoreLimited(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "")
 	conf := defaultConf
@@ -230,6 +250,12 @@ func TestFillCache(t *testing.T) {
 	if cnt, used := bcache.stats(); cnt != 1 || used != 1024+4096 { // only chunk 10 cached
 		t.Fatalf("cache cnt %d used %d, expect cnt 1 used 5120", cnt, used)
 	}
+	if n := store.CheckCache(10, 1024); n != 1024 {
+		t.Fatalf("expect 1024 bytes of chunk 10 cached, but got %d", n)
+	}
+	if n := store.CheckCache(11, uint32(bsize)); n != 0 {
+		t.Fatalf("expect nothing of chunk 11 cached, but got %d", n)
+	}
 	if err := store.FillCache(10, 1024); err != nil {
 		t.Fatalf("fill cache 10 1024: %s", err)
 	}
@@ -241,6 +267,185 @@ func TestFillCache(t *testing.T) {
 	if cnt, used := bcache.stats(); cnt != 2 || used != expect {
 		t.Fatalf("cache cnt %d used %d, expect cnt 2 used %d", cnt, used, expect)
 	}
+	if n := store.CheckCache(11, uint32(bsize)); n != uint64(bsize) {
+		t.Fatalf("expect %d bytes of chunk 11 cached, but got %d", bsize, n)
+	}
+}
+
+func TestUncached(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 10
+	conf.Writeback = true
+	_ = os.RemoveAll(conf.CacheDir)
+	store := NewCachedStore(mem, conf)
+	bcache := store.(*cachedStore).bcache
+
+	w := store.NewUncachedWriter(12)
+	data := []byte("hello world")
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	defer store.Remove(12, len(data))
+	if _, err := mem.Head(BlockKey(&conf, 12, 0, len(data))); err != nil {
+		t.Fatalf("block should be uploaded: %s", err)
+	}
+
+	p := NewPage(make([]byte, 5))
+	defer p.Release()
+	r := store.NewUncachedReader(12, len(data))
+	if n, err := r.ReadAt(context.Background(), p, 6); err != nil || string(p.Data[:n]) != "world" {
+		t.Fatalf("read: %q %s", p.Data[:n], err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if cnt, _ := bcache.stats(); cnt != 0 {
+		t.Fatalf("nothing should be cached, but got %d blocks", cnt)
+	}
+}
+
+func TestStoreRetry(t *testing.T) {
+	blob := objecttest.New("retry")
+	conf := defaultConf
+	conf.CacheSize = 0
+	store := NewCachedStore(blob, conf)
+	// the upload is retried after a backoff
+	blob.Fail(objecttest.OpPut, "chunks/", nil, 1)
+	if err := forgeChunk(store, 13, 10); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	defer store.Remove(13, 10)
+	if n := blob.Calls(objecttest.OpPut); n != 2 {
+		t.Fatalf("expect 2 puts, but got %d", n)
+	}
+
+	blob.Fail(objecttest.OpGet, "chunks/", nil, 1)
+	p := NewPage(make([]byte, 10))
+	defer p.Release()
+	if n, err := store.NewReader(13, 10).ReadAt(context.Background(), p, 0); err != nil || n != 10 {
+		t.Fatalf("read: %d %s", n, err)
+	}
+	if n := blob.Calls(objecttest.OpGet); n != 2 {
+		t.Fatalf("expect 2 gets, but got %d", n)
+	}
+}
+
+func TestStorePutIfAbsent(t *testing.T) {
+	blob := objecttest.New("put-if-absent")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.PutIfAbsent = true
+	store := NewCachedStore(blob, conf)
+	if err := forgeChunk(store, 14, 10); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	defer store.Remove(14, 10)
+	// the slice id is used twice
+	if err := forgeChunk(store, 14, 10); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("overwrite should fail: %v", err)
+	}
+	if n := blob.Calls(objecttest.OpPut); n != 2 {
+		t.Fatalf("a conflict should not be retried, but got %d puts", n)
+	}
+}
+
+func TestStoreUploadBuffer(t *testing.T) {
+	blob := objecttest.New("upload-buffer")
+	blob.SetLatency(time.Millisecond * 50)
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.MaxUpload = 10
+	conf.MaxUploadBuffer = int64(conf.BlockSize) * 2
+	store := NewCachedStore(blob, conf)
+	ubuf := store.(*cachedStore).uploadBuf
+
+	var peak int64
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if used := ubuf.usedBytes(); used > peak {
+				peak = used
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	waits := testutil.ToFloat64(uploadBufferWaits)
+	start := time.Now()
+	// a burst of 8 blocks could be uploaded at once, but only 2 of them fit in the buffer
+	size := conf.BlockSize * 8
+	if err := forgeChunk(store, 15, size); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	used := time.Since(start)
+	close(done)
+	defer store.Remove(15, size)
+	if peak > conf.MaxUploadBuffer {
+		t.Fatalf("%d bytes are held by the uploads, more than the limit %d", peak, conf.MaxUploadBuffer)
+	}
+	if used < time.Millisecond*200 || testutil.ToFloat64(uploadBufferWaits) == waits {
+		t.Fatalf("the writes should be throttled, but done in %s", used)
+	}
+	if n := ubuf.usedBytes(); n != 0 {
+		t.Fatalf("%d bytes are still held after the uploads", n)
+	}
+	if n := blob.Calls(objecttest.OpPut); n != 8 {
+		t.Fatalf("expect 8 puts, but got %d", n)
+	}
+}
+
+// a chunk spanning multiple blocks, read randomly across the boundaries of blocks
+func TestStoreBlockSizes(t *testing.T) {
+	for _, bsize := range []int{64 << 10, 256 << 10, 4 << 20} {
+		mem, _ := object.CreateStorage("mem", "", "", "")
+		conf := defaultConf
+		conf.BlockSize = bsize
+		conf.CacheDir = "memory"
+		store := NewCachedStore(mem, conf)
+		size := bsize*3 + bsize/3
+		data := make([]byte, size)
+		rand.Read(data)
+		w := store.NewWriter(1)
+		for off := 0; off < size; off += 10000 {
+			end := off + 10000
+			if end > size {
+				end = size
+			}
+			if _, err := w.WriteAt(data[off:end], int64(off)); err != nil {
+				t.Fatalf("write with block size %d: %s", bsize, err)
+			}
+		}
+		if err := w.Finish(size); err != nil {
+			t.Fatalf("finish with block size %d: %s", bsize, err)
+		}
+		if keys, _ := mem.List("", "", 10); len(keys) != 4 {
+			t.Fatalf("expect 4 blocks with block size %d, got %d", bsize, len(keys))
+		}
+		r := store.NewReader(1, size)
+		for i := 0; i < 100; i++ {
+			off := rand.Intn(size)
+			p := NewPage(make([]byte, rand.Intn(bsize*2)+1))
+			n, err := r.ReadAt(context.Background(), p, off)
+			if err != nil && err != io.EOF {
+				t.Fatalf("read %d at %d with block size %d: %s", len(p.Data), off, bsize, err)
+			}
+			expect := data[off:]
+			if len(expect) > len(p.Data) {
+				expect = expect[:len(p.Data)]
+			}
+			if n != len(expect) || !bytes.Equal(p.Data[:n], expect) {
+				t.Fatalf("read %d at %d with block size %d: got %d bytes, not expected", len(p.Data), off, bsize, n)
+			}
+			p.Release()
+		}
+		_ = store.Remove(1, size)
+	}
 }
 
 func BenchmarkCachedRead(b *testing.B) {
@@ -288,3 +493,383 @@ func BenchmarkUncachedRead(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkBlockSize compares the block sizes with sequential and random reads from object storage,
+// run it with `go test -run - -bench BlockSize ./pkg/chunk`.
+func BenchmarkBlockSize(b *testing.B) {
+	const size = 64 << 20
+	for _, bsize := range []int{256 << 10, 1 << 20, 4 << 20} {
+		blob, _ := object.CreateStorage("mem", "", "", "")
+		config := defaultConf
+		config.BlockSize = bsize
+		config.CacheSize = 0
+		config.BufferSize = 300 << 20
+		store := NewCachedStore(blob, config)
+		if err := forgeChunk(store, 1, size); err != nil {
+			b.Fatalf("write: %s", err)
+		}
+		for _, c := range []struct {
+			name   string
+			length int
+			next   func(off int) int
+		}{
+			{"sequential", 128 << 10, func(off int) int { return (off + 128<<10) % size }},
+			{"random", 4 << 10, func(int) int { return rand.Intn(size - 4<<10) }},
+		} {
+			b.Run(fmt.Sprintf("%s-%dK", c.name, bsize>>10), func(b *testing.B) {
+				p := NewPage(make([]byte, c.length))
+				defer p.Release()
+				b.SetBytes(int64(c.length))
+				var off int
+				for i := 0; i < b.N; i++ {
+					r := store.NewReader(1, size)
+					if n, err := r.ReadAt(context.Background(), p, off); err != nil || n != c.length {
+						b.Fatalf("read at %d: %d %s", off, n, err)
+					}
+					off = c.next(off)
+				}
+			})
+		}
+	}
+}
+
+func TestSliceBlocks(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.BlockSize = 1 << 20
+	conf.CacheDir = "memory"
+	store := NewCachedStore(mem, conf)
+	size := 2<<20 + 100
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(make([]byte, size), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(size); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+
+	rs := SliceBlocks(&conf, 1, size, 1<<20-10, 1<<20+50)
+	expected := []BlockRange{
+		{"chunks/0/0/1_0_1048576", 1 << 20, 1<<20 - 10, 10},
+		{"chunks/0/0/1_1_1048576", 1 << 20, 0, 1 << 20},
+		{"chunks/0/0/1_2_100", 100, 0, 40},
+	}
+	if !reflect.DeepEqual(rs, expected) {
+		t.Fatalf("expect %+v, but got %+v", expected, rs)
+	}
+	for _, r := range rs {
+		if _, err := mem.Head(r.Key); err != nil {
+			t.Fatalf("block %s: %s", r.Key, err)
+		}
+	}
+	if rs = SliceBlocks(&conf, 1, size, size-10, 100); len(rs) != 1 || rs[0].Len != 10 {
+		t.Fatalf("range beyond the slice: %+v", rs)
+	}
+}
+
+func TestKeyPrefixes(t *testing.T) {
+	for n, w := range map[int]int{2: 1, 16: 1, 17: 2, 256: 2, 257: 3, 4096: 3} {
+		if pw := prefixWidth(n); pw != w {
+			t.Fatalf("width of %d prefixes: expect %d, but got %d", n, w, pw)
+		}
+	}
+	conf := Config{KeyPrefixes: 1000, PrefixedFrom: 100}
+	cases := map[uint64]string{
+		99:      "chunks/0/0/99_1_100",
+		100:     "chunks/064/0/100_1_100",
+		1234567: "chunks/237/1/1234567_1_100",
+	}
+	for id, key := range cases {
+		if k := BlockKey(&conf, id, 1, 100); k != key {
+			t.Fatalf("key of %d: expect %s, but got %s", id, key, k)
+		}
+	}
+	conf.Partitions = 256
+	if k := BlockKey(&conf, 99, 1, 100); k != "chunks/63/0/99_1_100" {
+		t.Fatalf("key of 99 with partitions: %s", k)
+	}
+
+	// the blocks written before enabling the prefixes are still readable
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf = defaultConf
+	conf.CacheDir = "memory"
+	data := []byte("hello world")
+	for _, id := range []uint64{1, 2} {
+		w := NewCachedStore(mem, conf).NewWriter(id)
+		if _, err := w.WriteAt(data, 0); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		if err := w.Finish(len(data)); err != nil {
+			t.Fatalf("finish: %s", err)
+		}
+		conf.KeyPrefixes, conf.PrefixedFrom = 16, 2
+	}
+	store := NewCachedStore(mem, conf)
+	for _, id := range []uint64{1, 2} {
+		p := NewPage(make([]byte, len(data)))
+		if n, err := store.NewReader(id, len(data)).ReadAt(context.Background(), p, 0); err != nil || string(p.Data[:n]) != string(data) {
+			t.Fatalf("read %d: %q %s", id, p.Data[:n], err)
+		}
+		p.Release()
+	}
+	if _, err := mem.Head("chunks/2/0/2_0_11"); err != nil {
+		t.Fatalf("block of slice 2 should be prefixed: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/1_0_11"); err != nil {
+		t.Fatalf("block of slice 1 should not be prefixed: %s", err)
+	}
+}
+
+func TestReadCacheStats(t *testing.T) {
+	before := ReadCacheStats(true)
+	cacheHits.Add(3)
+	cacheHitBytes.Add(300)
+	cacheMiss.Inc()
+	cacheMissBytes.Add(100)
+	s := ReadCacheStats(false)
+	if s.Hits != 3 || s.HitBytes != 300 || s.Misses != 1 || s.MissBytes != 100 || s.Since.Before(before.Since) {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s = ReadCacheStats(true); s.Hits != 3 || s.Misses != 1 {
+		t.Fatalf("stats should be returned before reset: %+v", s)
+	}
+	cacheHits.Inc()
+	if s = ReadCacheStats(false); s.Hits != 1 || s.HitBytes != 0 || s.Misses != 0 {
+		t.Fatalf("stats should be reset: %+v", s)
+	}
+}
+
+func TestStoreTruncated(t *testing.T) {
+	for _, compress := range []string{"", "lz4"} {
+		blob := objecttest.New("truncated")
+		conf := defaultConf
+		conf.CacheSize = 0
+		conf.Compress = compress
+		store := NewCachedStore(blob, conf)
+		if err := forgeChunk(store, 14, 100<<10); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		truncations := testutil.ToFloat64(objectTruncations)
+		// a short body is fetched again instead of being returned as valid data
+		blob.Truncate("chunks/", 16, 1)
+		p := NewPage(make([]byte, 100<<10))
+		if n, err := store.NewReader(14, 100<<10).ReadAt(context.Background(), p, 0); err != nil || n != 100<<10 {
+			t.Fatalf("read with %q: %d %s", compress, n, err)
+		}
+		if n := blob.Calls(objecttest.OpGet); n != 2 {
+			t.Fatalf("expect 2 gets with %q, but got %d", compress, n)
+		}
+		// a truncated compressed block could fail to be decompressed, which is not counted
+		if n := testutil.ToFloat64(objectTruncations) - truncations; compress == "" && n != 1 {
+			t.Fatalf("expect 1 truncation, but got %v", n)
+		}
+		// it fails if the body is always short
+		blob.Truncate("chunks/", 16, -1)
+		if _, err := store.NewReader(14, 100<<10).ReadAt(context.Background(), p, 0); err == nil {
+			t.Fatalf("read truncated block with %q should fail", compress)
+		}
+		p.Release()
+		blob.Recover()
+
+		if compress == "" {
+			// ranged reads are checked too, and fall back to the full block
+			blob.Truncate("chunks/", 1<<10, 1)
+			p = NewPage(make([]byte, 4<<10))
+			if n, err := store.NewReader(14, 100<<10).ReadAt(context.Background(), p, 50<<10); err != nil || n != 4<<10 {
+				t.Fatalf("ranged read: %d %s", n, err)
+			}
+			p.Release()
+		}
+		_ = store.Remove(14, 100<<10)
+	}
+}
+
+func TestStoreVerifyChecksums(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.VerifyChecksums = true
+	var mu sync.Mutex
+	saved := make(map[uint64][]uint32)
+	conf.SaveChecksums = func(id uint64, sums []uint32) error {
+		mu.Lock()
+		defer mu.Unlock()
+		saved[id] = append([]uint32(nil), sums...)
+		return nil
+	}
+	conf.LoadChecksums = func(id uint64) ([]uint32, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return saved[id], nil
+	}
+	store := NewCachedStore(mem, conf)
+	size := conf.BlockSize + 100<<10
+	if err := forgeChunk(store, 15, size); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	defer store.Remove(15, size)
+	if sums := saved[15]; len(sums) != 2 || sums[0] != checksum(bytes.Repeat([]byte{0x41}, conf.BlockSize)) {
+		t.Fatalf("checksums of 2 blocks should be saved: %v", sums)
+	}
+
+	// corrupted in place, with the same size
+	key := BlockKey(&conf, 15, 1, 100<<10)
+	good := bytes.Repeat([]byte{0x41}, 100<<10)
+	bad := append([]byte{0x42}, good[1:]...)
+	_ = mem.Put(key, bytes.NewReader(bad))
+	mismatches := testutil.ToFloat64(objectChecksumMismatches)
+	p := NewPage(make([]byte, 4<<10))
+	defer p.Release()
+	// a partial read is not verified, so it's read as a whole block
+	if _, err := store.NewReader(15, size).ReadAt(context.Background(), p, conf.BlockSize+50<<10); err == nil {
+		t.Fatalf("corrupted block should not be read")
+	}
+	if n := testutil.ToFloat64(objectChecksumMismatches) - mismatches; n != 2 {
+		t.Fatalf("the corrupted block should be fetched again, but got %v mismatches", n)
+	}
+	if n, err := store.NewReader(15, size).ReadAt(context.Background(), p, 0); err != nil || n != len(p.Data) {
+		t.Fatalf("the other block should be read: %d %s", n, err)
+	}
+
+	_ = mem.Put(key, bytes.NewReader(good))
+	if n, err := store.NewReader(15, size).ReadAt(context.Background(), p, conf.BlockSize+50<<10); err != nil || n != len(p.Data) {
+		t.Fatalf("read recovered block: %d %s", n, err)
+	}
+
+	// the slices written without checksums are not verified
+	_ = mem.Put(BlockKey(&conf, 16, 0, 10), bytes.NewReader([]byte("0123456789")))
+	if n, err := store.NewReader(16, 10).ReadAt(context.Background(), p.Slice(0, 10), 0); err != nil || n != 10 {
+		t.Fatalf("read slice without checksums: %d %s", n, err)
+	}
+}
+
+func TestStoreInline(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.InlineSize = 4 << 10
+	var mu sync.Mutex
+	saved := make(map[uint64][]byte)
+	conf.SaveInline = func(id uint64, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		saved[id] = append([]byte(nil), data...)
+		return nil
+	}
+	conf.LoadInline = func(id uint64) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return saved[id], nil
+	}
+	store := NewCachedStore(mem, conf)
+	if err := forgeChunk(store, 17, 100); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if objs, _ := mem.List("", "", 10); len(objs) != 0 || len(saved[17]) != 100 {
+		t.Fatalf("the small slice should be stored inline only: %d objects, %d bytes", len(objs), len(saved[17]))
+	}
+	p := NewPage(make([]byte, 50))
+	defer p.Release()
+	if n, err := store.NewReader(17, 100).ReadAt(context.Background(), p, 60); n != 40 || err != io.EOF || !bytes.Equal(p.Data[:n], bytes.Repeat([]byte{0x41}, 40)) {
+		t.Fatalf("read inline slice: %d %s", n, err)
+	}
+
+	// a larger slice (e.g. the file is grown and compacted) is stored in object storage
+	size := conf.InlineSize + 1
+	if err := forgeChunk(store, 18, size); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, ok := saved[18]; ok {
+		t.Fatalf("the large slice should not be stored inline")
+	}
+	if _, err := mem.Head(BlockKey(&conf, 18, 0, size)); err != nil {
+		t.Fatalf("block of the large slice: %s", err)
+	}
+	if n, err := store.NewReader(18, size).ReadAt(context.Background(), p, size-50); n != 50 || err != nil {
+		t.Fatalf("read large slice: %d %s", n, err)
+	}
+
+	// the small slices written without inline are read from object storage
+	_ = mem.Put(BlockKey(&conf, 19, 0, 10), bytes.NewReader([]byte("0123456789")))
+	if n, err := store.NewReader(19, 10).ReadAt(context.Background(), p.Slice(0, 10), 0); err != nil || n != 10 {
+		t.Fatalf("read slice without inline: %d %s", n, err)
+	}
+
+	if err := store.Remove(17, 100); err != nil {
+		t.Fatalf("remove inline slice: %s", err)
+	}
+	if err := store.Remove(18, size); err != nil {
+		t.Fatalf("remove large slice: %s", err)
+	}
+	if _, err := mem.Head(BlockKey(&conf, 18, 0, size)); err == nil {
+		t.Fatalf("block of the large slice should be removed")
+	}
+}
+
+// stuckStore blocks the GETs until they are canceled.
+type stuckStore struct {
+	object.ObjectStorage
+	started, canceled chan struct{}
+}
+
+func (s *stuckStore) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	s.canceled <- struct{}{}
+	return nil, ctx.Err()
+}
+
+func TestReadCancel(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.GetTimeout = time.Minute
+	store := NewCachedStore(mem, conf)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(make([]byte, 1<<20), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(1 << 20); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	stuck := &stuckStore{mem, make(chan struct{}, 10), make(chan struct{}, 10)}
+	store.(*cachedStore).storage = stuck
+	r := store.NewReader(1, 1<<20)
+
+	read := func(timeout time.Duration) chan error {
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			p := NewOffPage(1 << 20)
+			defer p.Release()
+			_, err := r.ReadAt(ctx, p, 0)
+			done <- err
+		}()
+		return done
+	}
+	// the shared GET is kept while a reader is still waiting for it
+	first := read(time.Millisecond * 100)
+	<-stuck.started
+	second := read(time.Second)
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the first read should time out: %v", err)
+	}
+	select {
+	case <-stuck.canceled:
+		t.Fatalf("the GET should not be canceled while the second reader is waiting")
+	case <-time.After(time.Millisecond * 100):
+	}
+	// and canceled once all of them have given up, long before the get timeout
+	if err := <-second; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the second read should time out: %v", err)
+	}
+	select {
+	case <-stuck.canceled:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the GET should be canceled after all the readers have given up")
+	}
+	if len(stuck.started) != 0 {
+		t.Fatalf("the GET should be shared by the readers")
+	}
+}
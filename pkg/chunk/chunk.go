@@ -37,7 +37,18 @@ type Writer interface {
 type ChunkStore interface {
 	NewReader(chunkid uint64, length int) Reader
 	NewWriter(chunkid uint64) Writer
+	// NewUncachedReader and NewUncachedWriter access the object storage directly,
+	// the blocks are neither read from nor written into the cache.
+	NewUncachedReader(chunkid uint64, length int) Reader
+	NewUncachedWriter(chunkid uint64) Writer
 	Remove(chunkid uint64, length int) error
 	FillCache(chunkid uint64, length uint32) error
+	PinCache(chunkid uint64, length uint32) error
+	// CheckCache returns the bytes of the chunk which can be read from cache (or meta if inlined).
+	CheckCache(chunkid uint64, length uint32) uint64
 	UsedMemory() int64
+	// CacheSpace returns the capacity of cache and the space left for caching, in bytes.
+	CacheSpace() (int64, int64)
+	// UpdateCredentials replaces the credentials of object storage, the old ones are kept if the new ones are invalid.
+	UpdateCredentials(accessKey, secretKey, token string) error
 }
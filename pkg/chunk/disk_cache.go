@@ -18,6 +18,7 @@ package chunk
 
 import (
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"math"
@@ -28,6 +29,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -38,9 +40,20 @@ var (
 	cacheDir   = "raw"
 )
 
+const (
+	// CacheErrorRetry keeps using a cache dir with I/O errors.
+	CacheErrorRetry = "retry"
+	// CacheErrorBypass stops using a failed cache dir, its blocks are cached in the other dirs (or
+	// read from object storage if there is none).
+	CacheErrorBypass = "bypass"
+	// CacheErrorFail calls Config.OnCacheFailure (or exits the process if it's nil) when a cache dir fails.
+	CacheErrorFail = "fail"
+)
+
 type cacheItem struct {
 	size  int32
 	atime uint32
+	crc   uint32 // checksum of the block, only used by the fast scan mode (0 means unknown)
 }
 
 type pendingFile struct {
@@ -58,11 +71,21 @@ type cacheStore struct {
 	pending   chan pendingFile
 	pages     map[string]*Page
 
-	used     int64
-	keys     map[string]cacheItem
-	scanned  bool
-	full     bool
-	uploader func(key, path string)
+	used       int64
+	keys       map[string]cacheItem
+	pinned     map[string]int32 // blocks will not be evicted
+	pinSize    int64
+	scanned    bool
+	full       bool
+	uploader   func(key, path string)
+	scanMode   string
+	unverified map[string]bool // blocks loaded from the index, not read yet
+
+	errPolicy    string
+	errThreshold int32
+	onFailure    func(dir string, err error)
+	ioErrors     int32 // consecutive I/O errors
+	failed       int32 // 1 if the dir failed and is not used any more
 }
 
 func newCacheStore(dir string, cacheSize int64, pendingPages int, config *Config, uploader func(key, path string)) *cacheStore {
@@ -78,10 +101,20 @@ func newCacheStore(dir string, cacheSize int64, pendingPages int, config *Config
 		capacity:  cacheSize,
 		freeRatio: config.FreeSpace,
 		keys:      make(map[string]cacheItem),
+		pinned:    make(map[string]int32),
 		pending:   make(chan pendingFile, pendingPages),
 		pages:     make(map[string]*Page),
 		uploader:  uploader,
+		scanMode:  config.CacheScanMode,
+
+		errPolicy:    config.CacheErrorPolicy,
+		errThreshold: int32(config.CacheErrorThreshold),
+		onFailure:    config.OnCacheFailure,
+	}
+	if c.errThreshold <= 0 {
+		c.errThreshold = 10
 	}
+	c.unverified = make(map[string]bool)
 	c.createDir(c.dir)
 	br, fr := c.curFreeRatio()
 	if br < c.freeRatio || fr < c.freeRatio {
@@ -105,6 +138,42 @@ func (cache *cacheStore) stats() (int64, int64) {
 	return int64(len(cache.pages) + len(cache.keys)), cache.used + cache.usedMemory()
 }
 
+// pin marks the block as non-evictable, it fails if the pinned blocks can't fit in the cache.
+func (cache *cacheStore) pin(key string, size int) error {
+	cache.Lock()
+	defer cache.Unlock()
+	if _, ok := cache.pinned[key]; ok {
+		return nil
+	}
+	if cache.pinSize+int64(size+4096) > cache.capacity {
+		return fmt.Errorf("pinned blocks exceed the cache size (%d MB) of %s", cache.capacity>>20, cache.dir)
+	}
+	cache.pinned[key] = int32(size)
+	cache.pinSize += int64(size + 4096)
+	return nil
+}
+
+func (cache *cacheStore) pinnedBytes() int64 {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.pinSize
+}
+
+// space returns the capacity and the space left for caching, which also keeps the free ratio of disk.
+func (cache *cacheStore) space() (int64, int64) {
+	cache.Lock()
+	free := cache.capacity - cache.used - cache.usedMemory()
+	cache.Unlock()
+	total, avail, _, _ := getDiskUsage(cache.dir)
+	if d := int64(avail) - int64(float64(total)*float64(cache.freeRatio)); d < free {
+		free = d
+	}
+	if free < 0 {
+		free = 0
+	}
+	return cache.capacity, free
+}
+
 func (cache *cacheStore) checkFreeSpace() {
 	for {
 		br, fr := cache.curFreeRatio()
@@ -125,14 +194,20 @@ func (cache *cacheStore) checkFreeSpace() {
 }
 
 func (cache *cacheStore) refreshCacheKeys() {
-	for {
-		cache.scanCached()
-		time.Sleep(time.Minute * 5)
+	cache.loadCached()
+	for i := 1; ; i++ {
+		time.Sleep(time.Minute)
+		if i%5 == 0 {
+			cache.scanCached()
+		}
+		if cache.scanMode == ScanFast {
+			cache.saveIndex()
+		}
 	}
 }
 
 func (cache *cacheStore) cache(key string, p *Page, force bool) {
-	if cache.capacity == 0 {
+	if cache.capacity == 0 || cache.isFailed() {
 		return
 	}
 	cache.Lock()
@@ -166,7 +241,39 @@ func (cache *cacheStore) curFreeRatio() (float32, float32) {
 	return float32(free) / float32(total), float32(ffree) / float32(files)
 }
 
+func (cache *cacheStore) isFailed() bool {
+	return atomic.LoadInt32(&cache.failed) == 1
+}
+
+// checkIOError counts the consecutive I/O errors of the disk (the missing files and the full disk
+// are not), and the dir is failed by the error policy once there are errThreshold of them.
+func (cache *cacheStore) checkIOError(err error) {
+	if err == nil {
+		atomic.StoreInt32(&cache.ioErrors, 0)
+		return
+	}
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+	cacheDiskErrors.Inc()
+	if cache.errPolicy != CacheErrorBypass && cache.errPolicy != CacheErrorFail {
+		return
+	}
+	if atomic.AddInt32(&cache.ioErrors, 1) < cache.errThreshold || !atomic.CompareAndSwapInt32(&cache.failed, 0, 1) {
+		return
+	}
+	logger.Errorf("Cache dir %s failed with %d I/O errors in a row, the last one: %s", cache.dir, cache.errThreshold, err)
+	if cache.errPolicy == CacheErrorBypass {
+		logger.Warnf("Stop using cache dir %s, the blocks in it are cached in the other dirs or read from object storage", cache.dir)
+	} else if cache.onFailure != nil {
+		go cache.onFailure(cache.dir, err)
+	} else {
+		logger.Fatalf("Exit because cache dir %s failed", cache.dir)
+	}
+}
+
 func (cache *cacheStore) flushPage(path string, data []byte) (err error) {
+	defer func() { cache.checkIOError(err) }()
 	start := time.Now()
 	cacheWrites.Add(1)
 	cacheWriteBytes.Add(float64(len(data)))
@@ -219,7 +326,12 @@ func (cache *cacheStore) createDir(dir string) {
 
 func (cache *cacheStore) remove(key string) {
 	cache.Lock()
+	if size, ok := cache.pinned[key]; ok {
+		delete(cache.pinned, key)
+		cache.pinSize -= int64(size + 4096)
+	}
 	path := cache.cachePath(key)
+	delete(cache.unverified, key)
 	if cache.keys[key].atime > 0 {
 		cache.used -= int64(cache.keys[key].size + 4096)
 		delete(cache.keys, key)
@@ -249,13 +361,41 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 	if cache.scanned && cache.keys[key].atime == 0 {
 		return nil, errors.New("not cached")
 	}
+	if cache.isFailed() {
+		return nil, fmt.Errorf("cache dir %s failed", cache.dir)
+	}
 	cache.Unlock()
 	f, err := os.Open(cache.cachePath(key))
+	cache.checkIOError(err)
 	cache.Lock()
+	if cache.unverified[key] {
+		it := cache.keys[key]
+		if err == nil {
+			cache.Unlock()
+			err = verify(f, it)
+			cache.Lock()
+			if err != nil {
+				logger.Warnf("Remove corrupted cache block %s: %s", key, err)
+				_ = f.Close()
+				_ = os.Remove(cache.cachePath(key))
+			}
+		}
+		delete(cache.unverified, key)
+		if err != nil {
+			if it, ok := cache.keys[key]; ok {
+				delete(cache.keys, key)
+				if it.size > 0 {
+					cache.used -= int64(it.size + 4096)
+				}
+			}
+			return nil, err
+		}
+	}
 	if err == nil {
 		if it, ok := cache.keys[key]; ok {
 			// update atime
-			cache.keys[key] = cacheItem{it.size, uint32(time.Now().Unix())}
+			it.atime = uint32(time.Now().Unix())
+			cache.keys[key] = it
 		}
 	}
 	return f, err
@@ -276,6 +416,7 @@ func (cache *cacheStore) flush() {
 		path := cache.cachePath(w.key)
 		if cache.capacity > 0 && cache.flushPage(path, w.page.Data) == nil {
 			cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
+			cache.setChecksum(w.key, w.page.Data)
 		}
 		cache.Lock()
 		delete(cache.pages, w.key)
@@ -294,9 +435,10 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	}
 	if atime == 0 {
 		// update size of staging block
-		cache.keys[key] = cacheItem{size, it.atime}
+		cache.keys[key] = cacheItem{size, it.atime, it.crc}
 	} else {
-		cache.keys[key] = cacheItem{size, atime}
+		cache.keys[key] = cacheItem{size, atime, 0}
+		delete(cache.unverified, key)
 	}
 	if size > 0 {
 		cache.used += int64(size + 4096)
@@ -308,11 +450,28 @@ func (cache *cacheStore) add(key string, size int32, atime uint32) {
 	}
 }
 
+// setChecksum remembers the checksum of a cached block, which is verified after restarted in the fast scan mode.
+func (cache *cacheStore) setChecksum(key string, data []byte) {
+	if cache.scanMode != ScanFast {
+		return
+	}
+	crc := checksum(data)
+	cache.Lock()
+	defer cache.Unlock()
+	if it, ok := cache.keys[key]; ok {
+		it.crc = crc
+		cache.keys[key] = it
+	}
+}
+
 func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string, error) {
 	stagingPath := cache.stagePath(key)
 	if cache.full {
 		return stagingPath, errors.New("Space not enough on device")
 	}
+	if cache.isFailed() {
+		return stagingPath, fmt.Errorf("cache dir %s failed", cache.dir)
+	}
 	err := cache.flushPage(stagingPath, data)
 	if err == nil {
 		stageBlocks.Add(1)
@@ -322,6 +481,7 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 			cache.createDir(filepath.Dir(path))
 			if err := os.Link(stagingPath, path); err == nil {
 				cache.add(key, -int32(len(data)), uint32(time.Now().Unix()))
+				cache.setChecksum(key, data)
 			} else {
 				logger.Warnf("link %s to %s failed: %s", stagingPath, path, err)
 			}
@@ -373,6 +533,9 @@ func (cache *cacheStore) cleanup() {
 		if value.size < 0 {
 			continue // staging
 		}
+		if _, ok := cache.pinned[key]; ok {
+			continue
+		}
 		if cnt == 0 || lastValue.atime > value.atime {
 			lastKey = key
 			lastValue = value
@@ -380,6 +543,7 @@ func (cache *cacheStore) cleanup() {
 		cnt++
 		if cnt > 1 {
 			delete(cache.keys, lastKey)
+			delete(cache.unverified, lastKey)
 			freed += int64(lastValue.size + 4096)
 			cache.used -= int64(lastValue.size + 4096)
 			todel = append(todel, lastKey)
@@ -454,6 +618,7 @@ func (cache *cacheStore) uploadStaging() {
 
 func (cache *cacheStore) scanCached() {
 	cache.Lock()
+	old := cache.keys
 	cache.used = 0
 	cache.keys = make(map[string]cacheItem)
 	cache.scanned = false
@@ -479,10 +644,15 @@ func (cache *cacheStore) scanCached() {
 					key = strings.ReplaceAll(key, "\\", "/")
 				}
 				atime := uint32(getAtime(fi).Unix())
+				size := int32(fi.Size())
 				if getNlink(fi) > 1 {
-					cache.add(key, -int32(fi.Size()), atime)
-				} else {
-					cache.add(key, int32(fi.Size()), atime)
+					size = -size
+				}
+				cache.add(key, size, atime)
+				if it := old[key]; it.crc != 0 && it.size == size {
+					cache.Lock()
+					cache.keys[key] = cacheItem{size, atime, it.crc}
+					cache.Unlock()
 				}
 			}
 		}
@@ -490,6 +660,11 @@ func (cache *cacheStore) scanCached() {
 	})
 
 	cache.Lock()
+	for k := range cache.unverified {
+		if _, ok := cache.keys[k]; !ok {
+			delete(cache.unverified, k)
+		}
+	}
 	cache.scanned = true
 	logger.Debugf("Found %d cached blocks (%d bytes) in %s with %s", len(cache.keys), cache.used, cache.dir, time.Since(start))
 	cache.Unlock()
@@ -591,6 +766,10 @@ type CacheManager interface {
 	stagePath(key string) string
 	stats() (int64, int64)
 	usedMemory() int64
+	pin(key string, size int) error
+	pinnedBytes() int64
+	space() (int64, int64)
+	failedDirs() int
 }
 
 func newCacheManager(config *Config, uploader func(key, path string)) CacheManager {
@@ -628,8 +807,42 @@ func newCacheManager(config *Config, uploader func(key, path string)) CacheManag
 	return m
 }
 
+// getStore returns the store of key, the keys of failed stores are spread over the other ones.
 func (m *cacheManager) getStore(key string) *cacheStore {
-	return m.stores[keyHash(key)%uint32(len(m.stores))]
+	h := keyHash(key)
+	s := m.stores[h%uint32(len(m.stores))]
+	if !s.isFailed() {
+		return s
+	}
+	var healthy uint32
+	for _, s := range m.stores {
+		if !s.isFailed() {
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		return s
+	}
+	i := h % healthy
+	for _, s := range m.stores {
+		if !s.isFailed() {
+			if i == 0 {
+				return s
+			}
+			i--
+		}
+	}
+	return s
+}
+
+func (m *cacheManager) failedDirs() int {
+	var n int
+	for _, s := range m.stores {
+		if s.isFailed() {
+			n++
+		}
+	}
+	return n
 }
 
 func (m *cacheManager) usedMemory() int64 {
@@ -650,6 +863,28 @@ func (m *cacheManager) stats() (int64, int64) {
 	return cnt, used
 }
 
+func (m *cacheManager) pin(key string, size int) error {
+	return m.getStore(key).pin(key, size)
+}
+
+func (m *cacheManager) pinnedBytes() int64 {
+	var pinned int64
+	for _, s := range m.stores {
+		pinned += s.pinnedBytes()
+	}
+	return pinned
+}
+
+func (m *cacheManager) space() (int64, int64) {
+	var capacity, free int64
+	for _, s := range m.stores {
+		c, f := s.space()
+		capacity += c
+		free += f
+	}
+	return capacity, free
+}
+
 func (m *cacheManager) cache(key string, p *Page, force bool) {
 	m.getStore(key).cache(key, p, force)
 }
@@ -17,8 +17,11 @@
 package chunk
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -51,6 +54,45 @@ func TestExpand(t *testing.T) {
 	}
 }
 
+func TestPinCache(t *testing.T) {
+	s := newCacheStore(filepath.Join(t.TempDir(), "diskCache"), 12<<10, 1, &defaultConf, nil)
+	pinned := "chunks/0/0/1_0_1024"
+	if err := s.pin(pinned, 1024); err != nil {
+		t.Fatalf("pin: %s", err)
+	}
+	if err := s.pin("chunks/0/0/2_0_8192", 8192); err == nil {
+		t.Fatalf("pinned blocks should not exceed the cache size")
+	}
+	if s.pinnedBytes() != 1024+4096 {
+		t.Fatalf("pinned bytes: %d", s.pinnedBytes())
+	}
+	for i := 0; i < 50; i++ { // wait for scanning
+		s.Lock()
+		scanned := s.scanned
+		s.Unlock()
+		if scanned {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	s.add(pinned, 1024, 1) // the oldest one
+	for i := 3; i < 10; i++ {
+		s.add(fmt.Sprintf("chunks/0/0/%d_0_1024", i), 1024, uint32(i))
+	}
+	s.Lock()
+	_, ok := s.keys[pinned]
+	n := len(s.keys)
+	s.Unlock()
+	if !ok || n > 3 {
+		t.Fatalf("pinned block should be kept in cache and others are evicted: %v %d", ok, n)
+	}
+	s.remove(pinned)
+	if s.pinnedBytes() != 0 {
+		t.Fatalf("block should be unpinned after removed: %d", s.pinnedBytes())
+	}
+}
+
 func BenchmarkLoadCached(b *testing.B) {
 	dir := b.TempDir()
 	s := newCacheStore(filepath.Join(dir, "diskCache"), 1<<30, 1, &defaultConf, nil)
@@ -79,3 +121,161 @@ func BenchmarkLoadUncached(b *testing.B) {
 		}
 	}
 }
+
+func TestCacheSpace(t *testing.T) {
+	conf := defaultConf
+	conf.FreeSpace = 0
+	s := newCacheStore(filepath.Join(t.TempDir(), "diskCache"), 1<<20, 1, &conf, nil)
+	if capacity, free := s.space(); capacity != 1<<20 || free != 1<<20 {
+		t.Fatalf("space of empty cache: %d %d", capacity, free)
+	}
+	s.add("chunks/0/0/1_0_1024", 1024, uint32(time.Now().Unix()))
+	if capacity, free := s.space(); capacity != 1<<20 || free != 1<<20-1024-4096 {
+		t.Fatalf("space of cache: %d %d", capacity, free)
+	}
+	s.freeRatio = 1 // no space left on disk
+	if _, free := s.space(); free != 0 {
+		t.Fatalf("free space should be limited by disk: %d", free)
+	}
+
+	m := newMemStore(&Config{CacheSize: 1})
+	m.cache("chunks/0/0/1_0_1024", NewPage(make([]byte, 1024)), false)
+	if capacity, free := m.space(); capacity != 1<<20 || free != 1<<20-1024 {
+		t.Fatalf("space of memory cache: %d %d", capacity, free)
+	}
+}
+
+func TestCacheScanMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "diskCache")
+	conf := defaultConf
+	conf.CacheScanMode = ScanFast
+	waitScanned := func(s *cacheStore) {
+		for i := 0; i < 50; i++ {
+			s.Lock()
+			scanned := s.scanned
+			s.Unlock()
+			if scanned {
+				return
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		t.Fatalf("cache of %s is not scanned", s.dir)
+	}
+	s := newCacheStore(dir, 1<<30, 1, &conf, nil)
+	waitScanned(s)
+	good, bad := "chunks/0/0/1_0_1024", "chunks/0/0/2_0_1024"
+	for _, key := range []string{good, bad} {
+		s.cache(key, NewPage(make([]byte, 1024)), true)
+	}
+	for i := 0; i < 50; i++ {
+		s.Lock()
+		n := len(s.keys)
+		s.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	s.saveIndex()
+	// corrupted without changing the size
+	if err := os.WriteFile(s.cachePath(bad), []byte(strings.Repeat("x", 1024)), 0600); err != nil {
+		t.Fatalf("corrupt %s: %s", bad, err)
+	}
+
+	s = newCacheStore(dir, 1<<30, 1, &conf, nil)
+	waitScanned(s)
+	s.Lock()
+	n := len(s.keys)
+	s.Unlock()
+	if n != 2 {
+		t.Fatalf("expect 2 blocks from the index, but got %d", n)
+	}
+	if f, err := s.load(good); err != nil {
+		t.Fatalf("load %s: %s", good, err)
+	} else {
+		buf := make([]byte, 1024)
+		if n, err := f.ReadAt(buf, 0); err != nil || n != 1024 {
+			t.Fatalf("read %s: %d %s", good, n, err)
+		}
+		_ = f.Close()
+	}
+	if _, err := s.load(bad); err == nil {
+		t.Fatalf("corrupted block %s should not be loaded", bad)
+	}
+	if _, err := os.Stat(s.cachePath(bad)); !os.IsNotExist(err) {
+		t.Fatalf("corrupted block %s should be removed: %v", bad, err)
+	}
+
+	conf.CacheScanMode = ScanNone
+	s = newCacheStore(dir, 1<<30, 1, &conf, nil)
+	waitScanned(s)
+	if _, err := s.load(good); err == nil {
+		t.Fatalf("cached blocks should be discarded")
+	}
+	if _, err := os.Stat(s.cachePath(good)); !os.IsNotExist(err) {
+		t.Fatalf("block %s should be discarded: %v", good, err)
+	}
+}
+
+func TestCacheErrorPolicy(t *testing.T) {
+	eio := &os.PathError{Op: "write", Path: "x", Err: syscall.EIO}
+	newManager := func(policy string, onFailure func(string, error)) *cacheManager {
+		conf := defaultConf
+		conf.CacheDir = filepath.Join(t.TempDir(), "a") + ":" + filepath.Join(t.TempDir(), "b")
+		conf.CacheErrorPolicy = policy
+		conf.CacheErrorThreshold = 3
+		conf.OnCacheFailure = onFailure
+		return newCacheManager(&conf, nil).(*cacheManager)
+	}
+
+	m := newManager(CacheErrorRetry, nil)
+	for i := 0; i < 10; i++ {
+		m.stores[0].checkIOError(eio)
+	}
+	if m.failedDirs() != 0 {
+		t.Fatalf("cache dir should not fail with policy %s", CacheErrorRetry)
+	}
+
+	m = newManager(CacheErrorBypass, nil)
+	s := m.stores[0]
+	s.checkIOError(eio)
+	s.checkIOError(eio)
+	s.checkIOError(nil) // errors should be consecutive
+	s.checkIOError(eio)
+	s.checkIOError(&os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT})
+	s.checkIOError(eio)
+	if m.failedDirs() != 0 {
+		t.Fatalf("cache dir should not fail before the threshold")
+	}
+	s.checkIOError(eio)
+	if m.failedDirs() != 1 {
+		t.Fatalf("cache dir should fail after %d errors", s.errThreshold)
+	}
+	for i := 0; i < 100; i++ {
+		if m.getStore(fmt.Sprintf("chunks/0/0/%d_0_1024", i)) == s {
+			t.Fatalf("failed cache dir %s should not be used", s.dir)
+		}
+	}
+	key := "chunks/0/0/1_0_1024"
+	s.cache(key, NewPage(make([]byte, 1024)), true)
+	if _, err := s.load(key); err == nil {
+		t.Fatalf("blocks should not be loaded from failed cache dir")
+	}
+	if _, err := s.stage(key, make([]byte, 1024), false); err == nil {
+		t.Fatalf("blocks should not be staged into failed cache dir")
+	}
+
+	failed := make(chan string, 1)
+	m = newManager(CacheErrorFail, func(dir string, err error) { failed <- dir })
+	for i := 0; i < 3; i++ {
+		m.stores[1].checkIOError(eio)
+	}
+	select {
+	case dir := <-failed:
+		if dir != m.stores[1].dir {
+			t.Fatalf("expect failure of %s, but got %s", m.stores[1].dir, dir)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("OnCacheFailure should be called")
+	}
+}
@@ -18,6 +18,7 @@ package chunk
 
 import (
 	"errors"
+	"fmt"
 	"runtime"
 	"sync"
 	"time"
@@ -33,12 +34,15 @@ type memcache struct {
 	capacity int64
 	used     int64
 	pages    map[string]memItem
+	pinned   map[string]int
+	pinSize  int64
 }
 
 func newMemStore(config *Config) *memcache {
 	c := &memcache{
 		capacity: config.CacheSize << 20,
 		pages:    make(map[string]memItem),
+		pinned:   make(map[string]int),
 	}
 	runtime.SetFinalizer(c, func(c *memcache) {
 		for _, p := range c.pages {
@@ -61,6 +65,39 @@ func (c *memcache) stats() (int64, int64) {
 	return int64(len(c.pages)), c.used
 }
 
+func (c *memcache) pin(key string, size int) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.pinned[key]; ok {
+		return nil
+	}
+	if c.pinSize+int64(size) > c.capacity {
+		return fmt.Errorf("pinned blocks exceed the cache size (%d MB) of memory", c.capacity>>20)
+	}
+	c.pinned[key] = size
+	c.pinSize += int64(size)
+	return nil
+}
+
+func (c *memcache) failedDirs() int {
+	return 0
+}
+
+func (c *memcache) pinnedBytes() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.pinSize
+}
+
+func (c *memcache) space() (int64, int64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.used > c.capacity {
+		return c.capacity, 0
+	}
+	return c.capacity, c.capacity - c.used
+}
+
 func (c *memcache) cache(key string, p *Page, force bool) {
 	if c.capacity == 0 {
 		return
@@ -95,6 +132,10 @@ func (c *memcache) remove(key string) {
 		c.delete(key, item.page)
 		logger.Debugf("remove %s from cache", key)
 	}
+	if size, ok := c.pinned[key]; ok {
+		delete(c.pinned, key)
+		c.pinSize -= int64(size)
+	}
 }
 
 func (c *memcache) load(key string) (ReadCloser, error) {
@@ -115,6 +156,9 @@ func (c *memcache) cleanup() {
 	var now = time.Now()
 	// for each two random keys, then compare the access time, evict the older one
 	for k, v := range c.pages {
+		if _, ok := c.pinned[k]; ok {
+			continue
+		}
 		if cnt == 0 || lastValue.atime.After(v.atime) {
 			lastKey = k
 			lastValue = v
@@ -16,13 +16,18 @@
 
 package chunk
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type request struct {
-	wg  sync.WaitGroup
-	val *Page
-	ref int
-	err error
+	key    string
+	done   chan struct{}
+	val    *Page
+	ref    int // number of the callers waiting for it
+	err    error
+	cancel context.CancelFunc
 }
 
 type Controller struct {
@@ -31,40 +36,72 @@ type Controller struct {
 }
 
 func (con *Controller) Execute(key string, fn func() (*Page, error)) (*Page, error) {
+	return con.ExecuteContext(context.Background(), key, func(context.Context) (*Page, error) { return fn() })
+}
+
+// ExecuteContext runs fn once for all the concurrent callers of the same key, and a caller stops
+// waiting once its ctx is done. The ctx passed to fn is canceled when all the callers have given up,
+// so the shared request is aborted rather than left running for nobody.
+func (con *Controller) ExecuteContext(ctx context.Context, key string, fn func(ctx context.Context) (*Page, error)) (*Page, error) {
 	con.Lock()
 	if con.rs == nil {
 		con.rs = make(map[string]*request)
 	}
-	if c, ok := con.rs[key]; ok {
-		c.ref++
-		con.Unlock()
-		c.wg.Wait()
-		c.val.Acquire()
-		con.Lock()
-		c.ref--
-		if c.ref == 0 {
-			c.val.Release()
-		}
-		con.Unlock()
-		return c.val, c.err
+	c, ok := con.rs[key]
+	if !ok {
+		var rctx context.Context
+		c = &request{key: key, done: make(chan struct{})}
+		rctx, c.cancel = context.WithCancel(context.Background())
+		con.rs[key] = c
+		go con.run(c, rctx, fn)
 	}
-	c := new(request)
-	c.wg.Add(1)
 	c.ref++
-	con.rs[key] = c
 	con.Unlock()
 
-	c.val, c.err = fn()
-	c.val.Acquire()
-	c.wg.Done()
+	select {
+	case <-c.done:
+		if c.val != nil {
+			c.val.Acquire()
+		}
+		con.leave(c)
+		return c.val, c.err
+	case <-ctx.Done():
+		con.leave(c)
+		return nil, ctx.Err()
+	}
+}
 
+func (con *Controller) run(c *request, ctx context.Context, fn func(ctx context.Context) (*Page, error)) {
+	val, err := fn(ctx)
 	con.Lock()
-	c.ref--
-	if c.ref == 0 {
-		c.val.Release()
+	c.val, c.err = val, err
+	if con.rs[c.key] == c {
+		delete(con.rs, c.key)
+	}
+	close(c.done)
+	if c.ref == 0 && val != nil { // all the callers have given up
+		val.Release()
 	}
-	delete(con.rs, key)
 	con.Unlock()
+	c.cancel()
+}
 
-	return c.val, c.err
+func (con *Controller) leave(c *request) {
+	con.Lock()
+	defer con.Unlock()
+	c.ref--
+	if c.ref > 0 {
+		return
+	}
+	select {
+	case <-c.done:
+		if c.val != nil {
+			c.val.Release()
+		}
+	default:
+		c.cancel()
+		if con.rs[c.key] == c { // the later callers start a new one
+			delete(con.rs, c.key)
+		}
+	}
 }
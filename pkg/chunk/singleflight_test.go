@@ -17,6 +17,7 @@
 package chunk
 
 import (
+	"context"
 	"strconv"
 	"sync"
 	"testing"
@@ -39,3 +40,32 @@ func TestSingleFlight(t *testing.T) {
 	}
 	gp.Wait()
 }
+
+func TestSingleFlightCancel(t *testing.T) {
+	g := &Controller{}
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+	_, err := g.ExecuteContext(ctx, "k", func(ctx context.Context) (*Page, error) {
+		<-ctx.Done()
+		close(canceled)
+		return NewOffPage(100), ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Fatalf("the caller should give up: %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("the shared request should be canceled without callers")
+	}
+	// a new request is started for the later callers
+	p, err := g.Execute("k", func() (*Page, error) { return NewOffPage(100), nil })
+	if err != nil {
+		t.Fatalf("execute again: %s", err)
+	}
+	p.Release()
+}
@@ -0,0 +1,94 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadBufferBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "upload_buffer_bytes",
+		Help: "Bytes of the blocks held in memory by the pending and running uploads.",
+	})
+	uploadBufferWaits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "upload_buffer_waits",
+		Help: "Number of uploads waiting for the memory held by the others to be released.",
+	})
+)
+
+// uploadBuffer limits the memory held by the blocks to be uploaded, a block waits for the others
+// to be released if it doesn't fit. The first one is always allowed, even if it's bigger than the
+// limit, so a block never waits forever. No limit if it's not positive.
+type uploadBuffer struct {
+	sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newUploadBuffer(limit int64) *uploadBuffer {
+	b := &uploadBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.Mutex)
+	return b
+}
+
+func (b *uploadBuffer) fit(size int64) bool {
+	return b.limit <= 0 || b.used == 0 || b.used+size <= b.limit
+}
+
+// acquire holds size bytes, it blocks until they fit in the limit.
+func (b *uploadBuffer) acquire(size int64) {
+	b.Lock()
+	if !b.fit(size) {
+		uploadBufferWaits.Inc()
+		for !b.fit(size) {
+			b.cond.Wait()
+		}
+	}
+	b.used += size
+	b.Unlock()
+	uploadBufferBytes.Add(float64(size))
+}
+
+// tryAcquire holds size bytes only if they fit in the limit now.
+func (b *uploadBuffer) tryAcquire(size int64) bool {
+	b.Lock()
+	defer b.Unlock()
+	if !b.fit(size) {
+		return false
+	}
+	b.used += size
+	uploadBufferBytes.Add(float64(size))
+	return true
+}
+
+func (b *uploadBuffer) release(size int64) {
+	b.Lock()
+	b.used -= size
+	b.Unlock()
+	uploadBufferBytes.Sub(float64(size))
+	b.cond.Broadcast()
+}
+
+func (b *uploadBuffer) usedBytes() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.used
+}
@@ -35,9 +35,30 @@ type Compressor interface {
 	Decompress(dst, src []byte) (int, error)
 }
 
+// TagSuffix is appended to the algorithm when every block is tagged with the id of its codec,
+// then the algorithm can be changed for the new blocks, and the old ones are still readable.
+const TagSuffix = "+tag"
+
+// the index is the id of codec stored in the tagged blocks, only append to it
+var codecs = []string{"none", "lz4", "zstd"}
+
+// Tagged returns whether the blocks compressed by the algorithm are tagged with their codec.
+func Tagged(algr string) bool {
+	return strings.HasSuffix(strings.ToLower(algr), TagSuffix)
+}
+
 // NewCompressor returns a struct implementing Compressor interface
 func NewCompressor(algr string) Compressor {
 	algr = strings.ToLower(algr)
+	if Tagged(algr) {
+		algr = strings.TrimSuffix(algr, TagSuffix)
+		for id, name := range codecs {
+			if name == algr || algr == "" && name == "none" {
+				return tagged{NewCompressor(name), byte(id)}
+			}
+		}
+		return nil
+	}
 	if algr == "zstd" {
 		return ZStandard{ZSTD_LEVEL}
 	} else if algr == "lz4" {
@@ -84,7 +105,7 @@ func (n ZStandard) Compress(dst, src []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if len(d) > 0 && len(dst) > 0 && &d[0] != &dst[0] {
+	if len(d) > 0 && (len(dst) == 0 || &d[0] != &dst[0]) {
 		return 0, fmt.Errorf("buffer too short: %d < %d", cap(dst), cap(d))
 	}
 	return len(d), err
@@ -120,3 +141,35 @@ func (l LZ4) Compress(dst, src []byte) (int, error) {
 func (l LZ4) Decompress(dst, src []byte) (int, error) {
 	return lz4.DecompressSafe(src, dst)
 }
+
+// tagged stores the id of codec as the first byte of every block, and decompresses a block
+// by the codec in it, so the blocks written by different codecs can be mixed in a volume.
+type tagged struct {
+	Compressor
+	id byte
+}
+
+func (t tagged) Name() string            { return t.Compressor.Name() + TagSuffix }
+func (t tagged) CompressBound(l int) int { return t.Compressor.CompressBound(l) + 1 }
+
+func (t tagged) Compress(dst, src []byte) (int, error) {
+	if len(dst) == 0 {
+		return 0, fmt.Errorf("buffer too short: 0 < %d", len(src)+1)
+	}
+	dst[0] = t.id
+	n, err := t.Compressor.Compress(dst[1:], src)
+	if err != nil {
+		return 0, err
+	}
+	return n + 1, nil
+}
+
+func (t tagged) Decompress(dst, src []byte) (int, error) {
+	if len(src) == 0 {
+		return 0, fmt.Errorf("no codec in empty block")
+	}
+	if int(src[0]) >= len(codecs) {
+		return 0, fmt.Errorf("unknown codec id: %d", src[0])
+	}
+	return NewCompressor(codecs[src[0]]).Decompress(dst, src[1:])
+}
@@ -17,7 +17,9 @@
 package compress
 
 import (
+	"bytes"
 	"io"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -59,6 +61,103 @@ func TestLZ4(t *testing.T) {
 	testCompress(t, NewCompressor("lz4"))
 }
 
+func TestTagged(t *testing.T) {
+	for _, algr := range []string{"none+tag", "lz4+tag", "zstd+tag"} {
+		testCompress(t, NewCompressor(algr))
+	}
+	if NewCompressor("gzip+tag") != nil {
+		t.Fatalf("gzip is not supported")
+	}
+	if !Tagged("ZSTD+TAG") || Tagged("zstd") {
+		t.Fatalf("tagged")
+	}
+
+	// the blocks written by any codec are readable after the compression is changed
+	src := bytes.Repeat([]byte("juicefs "), 1000)
+	var blocks [][]byte
+	for _, algr := range []string{"zstd+tag", "none+tag", "lz4+tag"} {
+		c := NewCompressor(algr)
+		buf := make([]byte, c.CompressBound(len(src)))
+		n, err := c.Compress(buf, src)
+		if err != nil {
+			t.Fatalf("compress with %s: %s", algr, err)
+		}
+		blocks = append(blocks, buf[:n])
+	}
+	if len(blocks[0]) >= len(src) || len(blocks[1]) != len(src)+1 {
+		t.Fatalf("unexpected size of blocks: %d %d", len(blocks[0]), len(blocks[1]))
+	}
+	c := NewCompressor("lz4+tag")
+	for i, block := range blocks {
+		dst := make([]byte, len(src))
+		if n, err := c.Decompress(dst, block); err != nil || !bytes.Equal(dst[:n], src) {
+			t.Fatalf("decompress block %d: %d %s", i, n, err)
+		}
+	}
+	if _, err := c.Decompress(make([]byte, 10), []byte{9, 0}); err == nil {
+		t.Fatalf("unknown codec should fail")
+	}
+	if _, err := c.Decompress(make([]byte, 10), nil); err == nil {
+		t.Fatalf("empty block should fail")
+	}
+}
+
+func randBytes(r *rand.Rand, n int) []byte {
+	buf := make([]byte, n)
+	r.Read(buf)
+	return buf
+}
+
+// BenchmarkCodecs compares the ratio and CPU of codecs, using the first 4 MiB of $PAYLOAD
+// (or generated text mixed with random bytes) as a block.
+func BenchmarkCodecs(b *testing.B) {
+	d := make([]byte, 4<<20)
+	f, err := os.Open(os.Getenv("PAYLOAD"))
+	if err == nil {
+		n, _ := io.ReadFull(f, d)
+		f.Close()
+		d = d[:n]
+	} else {
+		r := rand.New(rand.NewSource(0))
+		words := []string{"juicefs ", "chunk ", "slice ", "block ", "inode ", "\n"}
+		for off := 0; off < len(d); {
+			if r.Intn(100) == 0 {
+				n := r.Intn(256)
+				if off+n > len(d) {
+					n = len(d) - off
+				}
+				off += copy(d[off:], randBytes(r, n))
+			} else {
+				off += copy(d[off:], words[r.Intn(len(words))])
+			}
+		}
+	}
+	for _, algr := range []string{"none", "lz4", "zstd"} {
+		c := NewCompressor(algr)
+		buf := make([]byte, c.CompressBound(len(d)))
+		out := make([]byte, len(d))
+		b.Run(algr+"/compress", func(b *testing.B) {
+			var n int
+			b.SetBytes(int64(len(d)))
+			for i := 0; i < b.N; i++ {
+				if n, err = c.Compress(buf, d); err != nil {
+					b.Fatalf("compress: %s", err)
+				}
+			}
+			b.ReportMetric(float64(len(d))/float64(n), "ratio")
+		})
+		n, _ := c.Compress(buf, d)
+		b.Run(algr+"/decompress", func(b *testing.B) {
+			b.SetBytes(int64(len(d)))
+			for i := 0; i < b.N; i++ {
+				if _, err = c.Decompress(out, buf[:n]); err != nil {
+					b.Fatalf("decompress: %s", err)
+				}
+			}
+		})
+	}
+}
+
 func benchmarkDecompress(b *testing.B, comp Compressor) {
 	f, _ := os.Open(os.Getenv("PAYLOAD"))
 	var c = make([]byte, 5<<20)
@@ -898,6 +898,20 @@ func (f *File) Utime(ctx meta.Context, atime, mtime int64) (err syscall.Errno) {
 	return
 }
 
+// Chattr changes the flags of file (meta.FlagImmutable or meta.FlagAppend), only root can do it.
+func (f *File) Chattr(ctx meta.Context, flags uint8) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.Chattr").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { f.fs.log(l, "Chattr (%s,%d): %s", f.path, flags, errstr(err)) }()
+	if ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	var attr = Attr{Flags: flags}
+	err = f.fs.m.SetAttr(ctx, f.inode, meta.SetAttrFlag, 0, &attr)
+	f.fs.invalidateAttr(f.inode)
+	return
+}
+
 func (f *File) Seek(ctx meta.Context, offset int64, whence int) (int64, error) {
 	defer trace.StartRegion(context.TODO(), "fs.Seek").End()
 	l := vfs.NewLogContext(ctx)
@@ -953,7 +967,7 @@ func (f *File) pread(ctx meta.Context, b []byte, offset int64) (n int, err error
 		}
 	}
 	if f.rdata == nil {
-		f.rdata = f.fs.reader.Open(f.inode, uint64(f.info.Size()))
+		f.rdata = f.fs.reader.Open(f.inode, uint64(f.info.Size()), false)
 	}
 
 	got, eno := f.rdata.Read(ctx, uint64(offset), b)
@@ -994,7 +1008,7 @@ func (f *File) Pwrite(ctx meta.Context, b []byte, offset int64) (n int, err sysc
 
 func (f *File) pwrite(ctx meta.Context, b []byte, offset int64) (n int, err syscall.Errno) {
 	if f.wdata == nil {
-		f.wdata = f.fs.writer.Open(f.inode, uint64(f.info.Size()))
+		f.wdata = f.fs.writer.Open(f.inode, uint64(f.info.Size()), false)
 	}
 	err = f.wdata.Write(ctx, uint64(offset), b)
 	if err != 0 {
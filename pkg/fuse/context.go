@@ -18,6 +18,7 @@ package fuse
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"syscall"
 	"time"
@@ -41,10 +42,29 @@ type fuseContext struct {
 	context.Context
 	start    time.Time
 	header   *fuse.InHeader
+	uid, gid uint32
+	squashed bool // root squashed by RootSquash, whose permissions are not checked by the kernel
 	canceled bool
 	cancel   <-chan struct{}
 }
 
+// names of the FUSE operations, to show the pending ones
+var opNames = map[uint32]string{
+	1: "lookup", 3: "getattr", 4: "setattr", 5: "readlink", 6: "symlink", 8: "mknod", 9: "mkdir",
+	10: "unlink", 11: "rmdir", 12: "rename", 13: "link", 14: "open", 15: "read", 16: "write",
+	17: "statfs", 18: "release", 20: "fsync", 21: "setxattr", 22: "getxattr", 23: "listxattr",
+	24: "removexattr", 25: "flush", 27: "opendir", 28: "readdir", 29: "releasedir", 30: "fsyncdir",
+	31: "getlk", 32: "setlk", 33: "setlkw", 34: "access", 35: "create", 43: "fallocate",
+	44: "readdirplus", 45: "rename", 46: "lseek", 47: "copy_file_range",
+}
+
+func opName(opcode uint32) string {
+	if name, ok := opNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("op%d", opcode)
+}
+
 var contextPool = sync.Pool{
 	New: func() interface{} {
 		return &fuseContext{}
@@ -58,23 +78,27 @@ func newContext(cancel <-chan struct{}, header *fuse.InHeader) *fuseContext {
 	ctx.canceled = false
 	ctx.cancel = cancel
 	ctx.header = header
+	ctx.uid, ctx.gid = header.Uid, header.Gid
+	ctx.squashed = false
+	vfs.BeginOp(ctx, opName(header.Opcode), Ino(header.NodeId))
 	return ctx
 }
 
 func releaseContext(ctx *fuseContext) {
+	vfs.EndOp(ctx)
 	contextPool.Put(ctx)
 }
 
 func (c *fuseContext) Uid() uint32 {
-	return c.header.Uid
+	return c.uid
 }
 
 func (c *fuseContext) Gid() uint32 {
-	return c.header.Gid
+	return c.gid
 }
 
 func (c *fuseContext) Gids() []uint32 {
-	return []uint32{c.header.Gid}
+	return []uint32{c.gid}
 }
 
 func (c *fuseContext) Pid() uint32 {
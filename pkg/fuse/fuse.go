@@ -18,6 +18,7 @@ package fuse
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"strings"
@@ -33,6 +34,10 @@ import (
 
 var logger = utils.GetLogger("juicefs")
 
+// FdEnv is the environment variable to pass the file descriptor of an existing
+// FUSE connection to a new process, see Recover.
+const FdEnv = "JFS_FUSE_FD"
+
 type fileSystem struct {
 	fuse.RawFileSystem
 	conf *vfs.Config
@@ -59,13 +64,44 @@ func (fs *fileSystem) replyEntry(out *fuse.EntryOut, e *meta.Entry) fuse.Status
 	if vfs.IsSpecialNode(e.Inode) {
 		out.SetAttrTimeout(time.Hour)
 	}
-	attrToStat(e.Inode, e.Attr, &out.Attr)
+	fs.attrToStat(e.Inode, e.Attr, &out.Attr)
 	return 0
 }
 
-func (fs *fileSystem) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (status fuse.Status) {
+// newContext creates a context for the request, whose caller is squashed to Uid and Gid with AllSquash,
+// or to AnonUid and AnonGid with RootSquash if it's root.
+func (fs *fileSystem) newContext(cancel <-chan struct{}, header *fuse.InHeader) *fuseContext {
 	ctx := newContext(cancel, header)
+	if fs.conf.AllSquash {
+		ctx.uid, ctx.gid = *fs.conf.Uid, *fs.conf.Gid
+	} else if fs.conf.RootSquash {
+		if ctx.uid == 0 {
+			ctx.uid, ctx.squashed = fs.conf.AnonUid, true
+		}
+		if ctx.gid == 0 {
+			ctx.gid = fs.conf.AnonGid
+		}
+	}
+	return ctx
+}
+
+// attrToStat converts the attributes, whose owner is replaced by Uid and Gid if they are set.
+func (fs *fileSystem) attrToStat(inode Ino, attr *Attr, out *fuse.Attr) {
+	attrToStat(inode, attr, out)
+	if fs.conf.Uid != nil {
+		out.Uid = *fs.conf.Uid
+	}
+	if fs.conf.Gid != nil {
+		out.Gid = *fs.conf.Gid
+	}
+}
+
+func (fs *fileSystem) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (status fuse.Status) {
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkAccess(ctx, Ino(header.NodeId), vfs.MODE_MASK_X); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.Lookup(ctx, Ino(header.NodeId), name)
 	if err != 0 {
 		return fuse.Status(err)
@@ -74,7 +110,7 @@ func (fs *fileSystem) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name
 }
 
 func (fs *fileSystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	var opened uint8
 	if in.Fh() != 0 {
@@ -84,7 +120,7 @@ func (fs *fileSystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *f
 	if err != 0 {
 		return fuse.Status(err)
 	}
-	attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	fs.attrToStat(entry.Inode, entry.Attr, &out.Attr)
 	out.AttrValid = uint64(fs.conf.AttrTimeout.Seconds())
 	if vfs.IsSpecialNode(Ino(in.NodeId)) {
 		out.AttrValid = 3600
@@ -93,12 +129,15 @@ func (fs *fileSystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *f
 }
 
 func (fs *fileSystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	var opened uint8
 	if in.Fh != 0 {
 		opened = 1
 	}
+	if st := fs.checkSetAttr(ctx, in); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.SetAttr(ctx, Ino(in.NodeId), int(in.Valid), opened, in.Mode, in.Uid, in.Gid, int64(in.Atime), int64(in.Mtime), in.Atimensec, in.Mtimensec, in.Size)
 	if err != 0 {
 		return fuse.Status(err)
@@ -107,13 +146,16 @@ func (fs *fileSystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *f
 	if vfs.IsSpecialNode(entry.Inode) {
 		out.AttrValid = 3600
 	}
-	attrToStat(entry.Inode, entry.Attr, &out.Attr)
+	fs.attrToStat(entry.Inode, entry.Attr, &out.Attr)
 	return 0
 }
 
 func (fs *fileSystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(in.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.Mknod(ctx, Ino(in.NodeId), name, uint16(in.Mode), getUmask(in), in.Rdev)
 	if err != 0 {
 		return fuse.Status(err)
@@ -122,8 +164,11 @@ func (fs *fileSystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name strin
 }
 
 func (fs *fileSystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(in.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.Mkdir(ctx, Ino(in.NodeId), name, uint16(in.Mode), uint16(in.Umask))
 	if err != 0 {
 		return fuse.Status(err)
@@ -132,29 +177,44 @@ func (fs *fileSystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name strin
 }
 
 func (fs *fileSystem) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(header.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	err := fs.v.Unlink(ctx, Ino(header.NodeId), name)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(header.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	err := fs.v.Rmdir(ctx, Ino(header.NodeId), name)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(in.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
+	if st := fs.checkEntry(ctx, Ino(in.Newdir)); st != 0 {
+		return fuse.Status(st)
+	}
 	err := fs.v.Rename(ctx, Ino(in.NodeId), oldName, Ino(in.Newdir), newName, in.Flags)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Link(cancel <-chan struct{}, in *fuse.LinkIn, name string, out *fuse.EntryOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(in.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.Link(ctx, Ino(in.Oldnodeid), Ino(in.NodeId), name)
 	if err != 0 {
 		return fuse.Status(err)
@@ -163,8 +223,11 @@ func (fs *fileSystem) Link(cancel <-chan struct{}, in *fuse.LinkIn, name string,
 }
 
 func (fs *fileSystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) (code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(header.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, err := fs.v.Symlink(ctx, target, Ino(header.NodeId), name)
 	if err != 0 {
 		return fuse.Status(err)
@@ -173,15 +236,18 @@ func (fs *fileSystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, tar
 }
 
 func (fs *fileSystem) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
 	path, err := fs.v.Readlink(ctx, Ino(header.NodeId))
 	return path, fuse.Status(err)
 }
 
 func (fs *fileSystem) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkXattr(ctx, Ino(header.NodeId), attr, vfs.MODE_MASK_R); st != 0 {
+		return 0, fuse.Status(st)
+	}
 	value, err := fs.v.GetXattr(ctx, Ino(header.NodeId), attr, uint32(len(dest)))
 	if err != 0 {
 		return 0, fuse.Status(err)
@@ -191,7 +257,7 @@ func (fs *fileSystem) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, at
 }
 
 func (fs *fileSystem) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
 	data, err := fs.v.ListXattr(ctx, Ino(header.NodeId), len(dest))
 	if err != 0 {
@@ -202,39 +268,57 @@ func (fs *fileSystem) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, d
 }
 
 func (fs *fileSystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkXattr(ctx, Ino(in.NodeId), attr, vfs.MODE_MASK_W); st != 0 {
+		return fuse.Status(st)
+	}
 	err := fs.v.SetXattr(ctx, Ino(in.NodeId), attr, data, in.Flags)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (code fuse.Status) {
-	ctx := newContext(cancel, header)
+	ctx := fs.newContext(cancel, header)
 	defer releaseContext(ctx)
+	if st := fs.checkXattr(ctx, Ino(header.NodeId), attr, vfs.MODE_MASK_W); st != 0 {
+		return fuse.Status(st)
+	}
 	err := fs.v.RemoveXattr(ctx, Ino(header.NodeId), attr)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkEntry(ctx, Ino(in.NodeId)); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, fh, err := fs.v.Create(ctx, Ino(in.NodeId), name, uint16(in.Mode), 0, in.Flags)
 	if err != 0 {
 		return fuse.Status(err)
 	}
 	out.Fh = fh
+	if isDirectIO(in.Flags) {
+		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	}
 	return fs.replyEntry(&out.EntryOut, entry)
 }
 
 func (fs *fileSystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkOpen(ctx, Ino(in.NodeId), in.Flags); st != 0 {
+		return fuse.Status(st)
+	}
 	entry, fh, err := fs.v.Open(ctx, Ino(in.NodeId), in.Flags)
 	if err != 0 {
 		return fuse.Status(err)
 	}
 	out.Fh = fh
-	if vfs.IsSpecialNode(Ino(in.NodeId)) {
+	// bypass the page cache in kernel for O_DIRECT, the data is read from or written to JuiceFS directly,
+	// and for the snapshot readers, whose data should not be seen by the others
+	snapshot := fs.conf.ReadSemantics == vfs.ReadSnapshot && in.Flags&syscall.O_ACCMODE == syscall.O_RDONLY
+	if vfs.IsSpecialNode(Ino(in.NodeId)) || isDirectIO(in.Flags) || snapshot {
 		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
 	} else if entry.Attr.KeepCache {
 		out.OpenFlags |= fuse.FOPEN_KEEP_CACHE
@@ -243,7 +327,7 @@ func (fs *fileSystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Op
 }
 
 func (fs *fileSystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	n, err := fs.v.Read(ctx, Ino(in.NodeId), buf, in.Offset, in.Fh)
 	if err != 0 {
@@ -253,13 +337,13 @@ func (fs *fileSystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte)
 }
 
 func (fs *fileSystem) Release(cancel <-chan struct{}, in *fuse.ReleaseIn) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	fs.v.Release(ctx, Ino(in.NodeId), in.Fh)
 }
 
 func (fs *fileSystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.Write(ctx, Ino(in.NodeId), data, in.Offset, in.Fh)
 	if err != 0 {
@@ -269,28 +353,28 @@ func (fs *fileSystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byt
 }
 
 func (fs *fileSystem) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.Flush(ctx, Ino(in.NodeId), in.Fh, in.LockOwner)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.Fsync(ctx, Ino(in.NodeId), int(in.FsyncFlags), in.Fh)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) Fallocate(cancel <-chan struct{}, in *fuse.FallocateIn) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.Fallocate(ctx, Ino(in.NodeId), uint8(in.Mode), int64(in.Offset), int64(in.Length), in.Fh)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	copied, err := fs.v.CopyFileRange(ctx, Ino(in.NodeId), in.FhIn, in.OffIn, Ino(in.NodeIdOut), in.FhOut, in.OffOut, in.Len, uint32(in.Flags))
 	if err != 0 {
@@ -300,7 +384,7 @@ func (fs *fileSystem) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRan
 }
 
 func (fs *fileSystem) GetLk(cancel <-chan struct{}, in *fuse.LkIn, out *fuse.LkOut) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	l := in.Lk
 	err := fs.v.Getlk(ctx, Ino(in.NodeId), in.Fh, in.Owner, &l.Start, &l.End, &l.Typ, &l.Pid)
@@ -322,7 +406,7 @@ func (fs *fileSystem) setLk(cancel <-chan struct{}, in *fuse.LkIn, block bool) (
 	if in.LkFlags&fuse.FUSE_LK_FLOCK != 0 {
 		return fs.Flock(cancel, in, block)
 	}
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	l := in.Lk
 	err := fs.v.Setlk(ctx, Ino(in.NodeId), in.Fh, in.Owner, l.Start, l.End, l.Typ, l.Pid, block)
@@ -330,22 +414,25 @@ func (fs *fileSystem) setLk(cancel <-chan struct{}, in *fuse.LkIn, block bool) (
 }
 
 func (fs *fileSystem) Flock(cancel <-chan struct{}, in *fuse.LkIn, block bool) (code fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	err := fs.v.Flock(ctx, Ino(in.NodeId), in.Fh, in.Owner, in.Lk.Typ, block)
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) (status fuse.Status) {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
+	if st := fs.checkAccess(ctx, Ino(in.NodeId), vfs.MODE_MASK_R); st != 0 {
+		return fuse.Status(st)
+	}
 	fh, err := fs.v.Opendir(ctx, Ino(in.NodeId))
 	out.Fh = fh
 	return fuse.Status(err)
 }
 
 func (fs *fileSystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	entries, err := fs.v.Readdir(ctx, Ino(in.NodeId), in.Size, int(in.Offset), in.Fh, false)
 	var de fuse.DirEntry
@@ -361,7 +448,7 @@ func (fs *fileSystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse
 }
 
 func (fs *fileSystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
-	ctx := newContext(cancel, &in.InHeader)
+	ctx := fs.newContext(cancel, &in.InHeader)
 	defer releaseContext(ctx)
 	entries, err := fs.v.Readdir(ctx, Ino(in.NodeId), in.Size, int(in.Offset), in.Fh, true)
 	var de fuse.DirEntry
@@ -387,13 +474,13 @@ func (fs *fileSystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *
 var cancelReleaseDir = make(chan struct{})
 
 func (fs *fileSystem) ReleaseDir(in *fuse.ReleaseIn) {
-	ctx := newContext(cancelReleaseDir, &in.InHeader)
+	ctx := fs.newContext(cancelReleaseDir, &in.InHeader)
 	defer releaseContext(ctx)
 	fs.v.Releasedir(ctx, Ino(in.NodeId), in.Fh)
 }
 
 func (fs *fileSystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse.StatfsOut) (code fuse.Status) {
-	ctx := newContext(cancel, in)
+	ctx := fs.newContext(cancel, in)
 	defer releaseContext(ctx)
 	st, err := fs.v.StatFS(ctx, Ino(in.NodeId))
 	if err != 0 {
@@ -413,8 +500,58 @@ func (fs *fileSystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fus
 	return 0
 }
 
-// Serve starts a server to serve requests from FUSE.
-func Serve(v *vfs.VFS, options string, xattrs bool) error {
+// Concurrency controls how many FUSE requests are handled concurrently, zero means auto.
+type Concurrency struct {
+	Workers             int // goroutines waiting for requests, in range [2, 16]
+	MaxBackground       int // max_background of the kernel: async requests (readahead, writeback) in flight
+	CongestionThreshold int // async requests in flight before the kernel throttles them, 3/4 of MaxBackground by default
+}
+
+// defaults fills the zero values, which are scaled to the number of CPUs.
+func (c Concurrency) defaults() Concurrency {
+	if c.MaxBackground == 0 {
+		c.MaxBackground = 8 * runtime.NumCPU()
+		if c.MaxBackground < 50 {
+			c.MaxBackground = 50
+		}
+	}
+	if c.MaxBackground > math.MaxUint16 {
+		c.MaxBackground = math.MaxUint16
+	}
+	return c
+}
+
+// maxBuffer is the max size of data in a request, the kernel sends at most 32 pages in a request
+// since FUSE_MAX_PAGES is not negotiated.
+const maxBuffer = fuse.MAX_KERNEL_WRITE
+
+// Buffers are the sizes of data in the read and write requests from the kernel, which are also the
+// sizes of the buffers passed to VFS, zero means the default.
+type Buffers struct {
+	Read  int // max_read and max_readahead, 1 MiB of readahead by default (limited by the kernel)
+	Write int // max_write, maxBuffer by default
+}
+
+// Check returns an error if the sizes are not multiples of 4 KiB in range [4 KiB, maxBuffer].
+func (b Buffers) Check() error {
+	check := func(name string, size int) error {
+		if size != 0 && (size < 4<<10 || size > maxBuffer || size%(4<<10) != 0) {
+			return fmt.Errorf("%s buffer should be a multiple of 4 KiB in range [4 KiB, %d KiB], got %d bytes", name, maxBuffer>>10, size)
+		}
+		return nil
+	}
+	if err := check("read", b.Read); err != nil {
+		return err
+	}
+	return check("write", b.Write)
+}
+
+// Serve starts a server to serve requests from FUSE, the mount propagation
+// type is changed after mounted if propagation is not empty.
+func Serve(v *vfs.VFS, options string, xattrs bool, propagation string, cc Concurrency, bufs Buffers) error {
+	if err := bufs.Check(); err != nil {
+		return err
+	}
 	if err := syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), -19); err != nil {
 		logger.Warnf("setpriority: %s", err)
 	}
@@ -426,12 +563,22 @@ func Serve(v *vfs.VFS, options string, xattrs bool) error {
 	opt.FsName = "JuiceFS:" + conf.Format.Name
 	opt.Name = "juicefs"
 	opt.SingleThreaded = false
-	opt.MaxBackground = 50
+	cc = cc.defaults()
+	opt.MaxBackground = cc.MaxBackground
 	opt.EnableLocks = true
 	opt.DisableXAttrs = !xattrs
 	opt.IgnoreSecurityLabels = true
-	opt.MaxWrite = 1 << 20
+	opt.MaxWrite = maxBuffer
 	opt.MaxReadAhead = 1 << 20
+	if bufs.Write > 0 {
+		opt.MaxWrite = bufs.Write
+	}
+	if bufs.Read > 0 {
+		opt.MaxReadAhead = bufs.Read
+		if runtime.GOOS == "linux" {
+			opt.Options = append(opt.Options, fmt.Sprintf("max_read=%d", bufs.Read))
+		}
+	}
 	opt.DirectMount = true
 	opt.AllowOther = os.Getuid() == 0
 	for _, n := range strings.Split(options, ",") {
@@ -452,10 +599,25 @@ func Serve(v *vfs.VFS, options string, xattrs bool) error {
 		opt.Options = append(opt.Options, "volname="+conf.Format.Name)
 		opt.Options = append(opt.Options, "daemon_timeout=60", "iosize=65536", "novncache")
 	}
+	// the number of readers is decided by GOMAXPROCS when the server is created
+	procs := runtime.GOMAXPROCS(0)
+	if cc.Workers > 0 {
+		runtime.GOMAXPROCS(cc.Workers)
+	}
 	fssrv, err := fuse.NewServer(imp, conf.Mountpoint, &opt)
+	runtime.GOMAXPROCS(procs)
 	if err != nil {
 		return fmt.Errorf("fuse: %s", err)
 	}
+	if cc.CongestionThreshold > 0 {
+		if err = setCongestionThreshold(conf.Mountpoint, cc.CongestionThreshold); err != nil {
+			logger.Warnf("set congestion threshold to %d: %s", cc.CongestionThreshold, err)
+		}
+	}
+	if err = setPropagation(conf.Mountpoint, propagation); err != nil {
+		_ = fssrv.Unmount()
+		return fmt.Errorf("set propagation to %s: %s", propagation, err)
+	}
 
 	fssrv.Serve()
 	return nil
@@ -17,6 +17,8 @@
 package fuse
 
 import (
+	"fmt"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -26,3 +28,18 @@ func getUmask(in *fuse.MknodIn) uint16 {
 
 func setBlksize(out *fuse.Attr, size uint32) {
 }
+
+func setBirthtime(out *fuse.Attr, attr *Attr) {
+	btime := attr.Birthtime()
+	out.Crtime_ = uint64(btime.Unix())
+	out.Crtimensec_ = uint32(btime.Nanosecond())
+}
+
+// O_DIRECT is not available on macOS
+func isDirectIO(flags uint32) bool {
+	return false
+}
+
+func setCongestionThreshold(mp string, threshold int) error {
+	return fmt.Errorf("congestion threshold is not supported on macOS")
+}
@@ -17,6 +17,13 @@
 package fuse
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -27,3 +34,34 @@ func getUmask(in *fuse.MknodIn) uint16 {
 func setBlksize(out *fuse.Attr, size uint32) {
 	out.Blksize = size
 }
+
+// the protocol of FUSE has no birth time, statx() can't get it
+func setBirthtime(out *fuse.Attr, attr *Attr) {
+}
+
+func isDirectIO(flags uint32) bool {
+	return flags&syscall.O_DIRECT != 0
+}
+
+// setCongestionThreshold overrides the congestion threshold negotiated in INIT through fusectl,
+// the kernel starts to throttle the async requests (readahead, writeback) once there are so many of them.
+func setCongestionThreshold(mp string, threshold int) error {
+	mp, err := filepath.Abs(mp)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	mi, err := findMount(f, mp)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("read mountinfo: %s", err)
+	}
+	if mi == nil {
+		return fmt.Errorf("%s is not mounted", mp)
+	}
+	path := fmt.Sprintf("/sys/fs/fuse/connections/%d/congestion_threshold", mi.major<<20|mi.minor)
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(threshold)), 0644)
+}
@@ -0,0 +1,264 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//nolint:errcheck
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/posixtest"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	posixtest.All["MMap"] = MMap
+	posixtest.All["DirectIORoundTrip"] = DirectIORoundTrip
+	posixtest.All["Congestion"] = Congestion
+}
+
+// readDirect reads the whole file with O_DIRECT, so the data comes from JuiceFS rather than the page cache.
+func readDirect(t *testing.T, path string) []byte {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		t.Fatalf("open %s with O_DIRECT: %s", path, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s with O_DIRECT: %s", path, err)
+	}
+	return data
+}
+
+func MMap(t *testing.T, mp string) {
+	path := filepath.Join(mp, "mmap")
+	data := bytes.Repeat([]byte("a"), 3<<12)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+	shared, err := syscall.Mmap(int(f.Fd()), 0, len(data), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("mmap shared: %s", err)
+	}
+	copy(shared[100:], "shared")
+	copy(shared[1<<12+100:], "across pages")
+	if err = unix.Msync(shared, unix.MS_SYNC); err != nil {
+		t.Fatalf("msync: %s", err)
+	}
+	copy(data[100:], "shared")
+	copy(data[1<<12+100:], "across pages")
+	if got := readDirect(t, path); !bytes.Equal(got, data) {
+		t.Fatalf("data is not persisted after msync")
+	}
+	// written back at munmap and close
+	copy(shared[2<<12:], "unmapped")
+	copy(data[2<<12:], "unmapped")
+	if err = syscall.Munmap(shared); err != nil {
+		t.Fatalf("munmap: %s", err)
+	}
+	f.Close()
+	if got := readDirect(t, path); !bytes.Equal(got, data) {
+		t.Fatalf("data is not persisted after munmap")
+	}
+
+	f, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+	private, err := syscall.Mmap(int(f.Fd()), 0, len(data), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		t.Fatalf("mmap private: %s", err)
+	}
+	if !bytes.Equal(private, data) {
+		t.Fatalf("private mapping does not match the file")
+	}
+	copy(private, "private")
+	if err = unix.Msync(private, unix.MS_SYNC); err != nil {
+		t.Fatalf("msync private: %s", err)
+	}
+	_ = syscall.Munmap(private)
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatalf("changes in private mapping should not be written back")
+	}
+}
+
+func DirectIORoundTrip(t *testing.T, mp string) {
+	path := filepath.Join(mp, "direct")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|syscall.O_DIRECT, 0644)
+	if err != nil {
+		t.Fatalf("create with O_DIRECT: %s", err)
+	}
+	defer f.Close()
+	block := bytes.Repeat([]byte("b"), 1<<12)
+	for _, off := range []int64{0, 2 << 12, 1 << 12} {
+		if _, err = f.WriteAt(block, off); err != nil {
+			t.Fatalf("write at %d: %s", off, err)
+		}
+	}
+	// a buffered reader sees the direct writes at once
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(data, bytes.Repeat(block, 3)) {
+		t.Fatalf("buffered read after direct writes: %d bytes, %v", len(data), err)
+	}
+
+	g, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if _, err = g.WriteAt([]byte("buffered"), 1<<12); err != nil {
+		t.Fatalf("buffered write: %s", err)
+	}
+	g.Close()
+	buf := make([]byte, 1<<12)
+	if _, err = f.ReadAt(buf, 1<<12); err != nil || !bytes.HasPrefix(buf, []byte("buffered")) || buf[8] != 'b' {
+		t.Fatalf("direct read after buffered write: %q %v", buf[:16], err)
+	}
+	if err = f.Sync(); err != nil {
+		t.Fatalf("fsync: %s", err)
+	}
+}
+
+// Congestion checks the limits of async requests in fusectl, which are set by setUp.
+func Congestion(t *testing.T, mp string) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("open mountinfo: %s", err)
+	}
+	mi, err := findMount(f, mp)
+	f.Close()
+	if err != nil || mi == nil {
+		t.Fatalf("find mount %s: %+v %v", mp, mi, err)
+	}
+	dir := fmt.Sprintf("/sys/fs/fuse/connections/%d", mi.major<<20|mi.minor)
+	if _, err = os.Stat(dir); err != nil {
+		t.Skipf("fusectl is not available: %s", err)
+	}
+	for name, expected := range map[string]string{"max_background": "64", "congestion_threshold": "20"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || strings.TrimSpace(string(data)) != expected {
+			t.Fatalf("%s: expected %s, but got %q (%v)", name, expected, data, err)
+		}
+	}
+}
+
+// BenchmarkSmallFileRead reads 4 KiB from random small files with O_DIRECT, so every
+// read goes through FUSE, and reports the IOPS for different number of workers.
+func BenchmarkSmallFileRead(b *testing.B) {
+	const files = 1000
+	data := bytes.Repeat([]byte("j"), 4<<10)
+	for _, workers := range []int{2, 4, 8, 16} {
+		metaUrl := "sqlite3://" + filepath.Join(b.TempDir(), "meta.db")
+		mp := b.TempDir()
+		format(metaUrl)
+		go mount(metaUrl, mp, Concurrency{Workers: workers}, Buffers{})
+		if err := <-waitMountpoint(mp); err != nil {
+			b.Fatalf("setup: %s", err)
+		}
+		for i := 0; i < files; i++ {
+			if err := ioutil.WriteFile(filepath.Join(mp, strconv.Itoa(i)), data, 0644); err != nil {
+				b.Fatalf("write: %s", err)
+			}
+		}
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			b.SetParallelism(16)
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, len(data))
+				for pb.Next() {
+					f, err := os.OpenFile(filepath.Join(mp, strconv.Itoa(rand.Intn(files))), os.O_RDONLY|syscall.O_DIRECT, 0)
+					if err != nil {
+						b.Errorf("open: %s", err)
+						return
+					}
+					if n, err := f.ReadAt(buf, 0); n != len(data) {
+						b.Errorf("read %d bytes: %v", n, err)
+					}
+					f.Close()
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "iops")
+		})
+		umount(mp, true)
+	}
+}
+
+// BenchmarkSequentialIO writes and reads a file sequentially with O_DIRECT in 1 MiB, which are
+// split by the kernel into requests of the buffer sizes, and reports the throughput of each size.
+func BenchmarkSequentialIO(b *testing.B) {
+	const size = 64 << 20
+	data := bytes.Repeat([]byte("j"), 1<<20)
+	for _, bufSize := range []int{16 << 10, 32 << 10, 64 << 10, 128 << 10} {
+		metaUrl := "sqlite3://" + filepath.Join(b.TempDir(), "meta.db")
+		mp := b.TempDir()
+		format(metaUrl)
+		go mount(metaUrl, mp, Concurrency{}, Buffers{Read: bufSize, Write: bufSize})
+		if err := <-waitMountpoint(mp); err != nil {
+			b.Fatalf("setup: %s", err)
+		}
+		path := filepath.Join(mp, "file")
+		b.Run(fmt.Sprintf("write-%dK", bufSize>>10), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_DIRECT, 0644)
+				if err != nil {
+					b.Fatalf("open: %s", err)
+				}
+				for off := 0; off < size; off += len(data) {
+					if _, err = f.Write(data); err != nil {
+						b.Fatalf("write: %s", err)
+					}
+				}
+				if err = f.Close(); err != nil {
+					b.Fatalf("close: %s", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("read-%dK", bufSize>>10), func(b *testing.B) {
+			b.SetBytes(size)
+			buf := make([]byte, len(data))
+			for i := 0; i < b.N; i++ {
+				f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+				if err != nil {
+					b.Fatalf("open: %s", err)
+				}
+				for off := 0; off < size; off += len(buf) {
+					if _, err = f.ReadAt(buf, int64(off)); err != nil {
+						b.Fatalf("read: %s", err)
+					}
+				}
+				f.Close()
+			}
+		})
+		umount(mp, true)
+	}
+}
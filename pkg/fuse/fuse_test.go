@@ -36,6 +36,7 @@ import (
 
 	"github.com/gofrs/flock"
 	"github.com/google/uuid"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/posixtest"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
@@ -59,7 +60,7 @@ func format(url string) {
 	}
 }
 
-func mount(url, mp string) {
+func mount(url, mp string, cc Concurrency, bufs Buffers) {
 	if err := os.MkdirAll(mp, 0777); err != nil {
 		log.Fatalf("create %s: %s", mp, err)
 	}
@@ -114,7 +115,7 @@ func mount(url, mp string) {
 	conf.DirEntryTimeout = time.Second
 	conf.HideInternal = true
 	v := vfs.NewVFS(conf, m, store)
-	err = Serve(v, "", true)
+	err = Serve(v, "", true, "", cc, bufs)
 	if err != nil {
 		log.Fatalf("fuse server err: %s\n", err)
 	}
@@ -161,7 +162,7 @@ func waitMountpoint(mp string) chan error {
 
 func setUp(metaUrl, mp string) error {
 	format(metaUrl)
-	go mount(metaUrl, mp)
+	go mount(metaUrl, mp, Concurrency{MaxBackground: 64, CongestionThreshold: 20}, Buffers{})
 	return <-waitMountpoint(mp)
 }
 
@@ -303,3 +304,132 @@ func TestFUSE(t *testing.T) {
 		})
 	}
 }
+
+func TestSquash(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	format := &meta.Format{Name: "test", BlockSize: 4096}
+	if err := m.Init(*format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	chunkConf := chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, BufferSize: 100 << 20}
+	uid, gid := uint32(1000), uint32(2000)
+	conf := &vfs.Config{Meta: &meta.Config{}, Format: format, Chunk: &chunkConf, Uid: &uid, Gid: &gid}
+	fs := newFileSystem(conf, vfs.NewVFS(conf, m, chunk.NewCachedStore(blob, chunkConf)))
+	header := fuse.InHeader{NodeId: 1, Caller: fuse.Caller{Owner: fuse.Owner{Uid: 0, Gid: 0}}}
+
+	// the owner is shown as squashed, but not changed
+	var out fuse.EntryOut
+	if st := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: header, Mode: 0777}, "d", &out); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if out.Uid != uid || out.Gid != gid {
+		t.Fatalf("owner of new directory: %d:%d", out.Uid, out.Gid)
+	}
+	var attr Attr
+	if st := m.GetAttr(meta.Background, Ino(out.NodeId), &attr); st != 0 || attr.Uid != 0 || attr.Gid != 0 {
+		t.Fatalf("real owner of directory: %d:%d %s", attr.Uid, attr.Gid, st)
+	}
+	var aout fuse.AttrOut
+	if st := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: header}, &aout); st != 0 || aout.Uid != uid || aout.Gid != gid {
+		t.Fatalf("getattr: %d:%d %s", aout.Uid, aout.Gid, st)
+	}
+
+	// the new files are created as the squashed user
+	conf.AllSquash = true
+	var cout fuse.CreateOut
+	if st := fs.Create(nil, &fuse.CreateIn{InHeader: header, Mode: 0644, Flags: syscall.O_WRONLY}, "f", &cout); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	fs.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: cout.NodeId}, Fh: cout.Fh})
+	if st := m.GetAttr(meta.Background, Ino(cout.NodeId), &attr); st != 0 || attr.Uid != uid || attr.Gid != gid {
+		t.Fatalf("real owner of file: %d:%d %s", attr.Uid, attr.Gid, st)
+	}
+	if st := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: cout.NodeId}}, &aout); st != 0 || aout.Uid != uid || aout.Gid != gid {
+		t.Fatalf("getattr: %d:%d %s", aout.Uid, aout.Gid, st)
+	}
+}
+
+func TestRootSquash(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	format := &meta.Format{Name: "test", BlockSize: 4096}
+	if err := m.Init(*format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	chunkConf := chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, BufferSize: 100 << 20}
+	conf := &vfs.Config{Meta: &meta.Config{}, Format: format, Chunk: &chunkConf, RootSquash: true, AnonUid: 65534, AnonGid: 65534}
+	fs := newFileSystem(conf, vfs.NewVFS(conf, m, chunk.NewCachedStore(blob, chunkConf)))
+	root := fuse.InHeader{NodeId: 1, Caller: fuse.Caller{Owner: fuse.Owner{Uid: 0, Gid: 0}}}
+	user := fuse.InHeader{NodeId: 1, Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}}
+
+	// root is squashed to the anonymous user
+	var out fuse.EntryOut
+	if st := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: root, Mode: 0755}, "r", &out); st != 0 {
+		t.Fatalf("mkdir r: %s", st)
+	}
+	if out.Uid != 65534 || out.Gid != 65534 {
+		t.Fatalf("owner of r: %d:%d", out.Uid, out.Gid)
+	}
+	// but not the other users
+	if st := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: user, Mode: 0755}, "u", &out); st != 0 {
+		t.Fatalf("mkdir u: %s", st)
+	}
+	if out.Uid != 1000 || out.Gid != 1000 {
+		t.Fatalf("owner of u: %d:%d", out.Uid, out.Gid)
+	}
+	udir := out.NodeId
+
+	// the squashed root can't write into the directory of others
+	root.NodeId = udir
+	var cout fuse.CreateOut
+	if st := fs.Create(nil, &fuse.CreateIn{InHeader: root, Mode: 0644, Flags: syscall.O_WRONLY}, "f", &cout); st != fuse.EACCES {
+		t.Fatalf("create u/f as root: %s", st)
+	}
+	if st := fs.Mkdir(nil, &fuse.MkdirIn{InHeader: root, Mode: 0755}, "d", &out); st != fuse.EACCES {
+		t.Fatalf("mkdir u/d as root: %s", st)
+	}
+	user.NodeId = udir
+	if st := fs.Create(nil, &fuse.CreateIn{InHeader: user, Mode: 0600, Flags: syscall.O_WRONLY}, "f", &cout); st != 0 {
+		t.Fatalf("create u/f as user: %s", st)
+	}
+	fs.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: cout.NodeId}, Fh: cout.Fh})
+	if st := fs.Unlink(nil, &root, "f"); st != fuse.EACCES {
+		t.Fatalf("unlink u/f as root: %s", st)
+	}
+
+	// nor read, chmod or chown the files of others
+	root.NodeId = cout.NodeId
+	var oout fuse.OpenOut
+	if st := fs.Open(nil, &fuse.OpenIn{InHeader: root, Flags: syscall.O_RDONLY}, &oout); st != fuse.EACCES {
+		t.Fatalf("open u/f as root: %s", st)
+	}
+	var aout fuse.AttrOut
+	if st := fs.SetAttr(nil, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: root, Valid: fuse.FATTR_MODE, Mode: 0777}}, &aout); st != fuse.EPERM {
+		t.Fatalf("chmod u/f as root: %s", st)
+	}
+	if st := fs.SetAttr(nil, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: root, Valid: fuse.FATTR_UID}}, &aout); st != fuse.EPERM {
+		t.Fatalf("chown u/f as root: %s", st)
+	}
+	user.NodeId = cout.NodeId
+	if st := fs.SetAttr(nil, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: user, Valid: fuse.FATTR_MODE, Mode: 0640}}, &aout); st != 0 {
+		t.Fatalf("chmod u/f as user: %s", st)
+	}
+	if st := fs.Open(nil, &fuse.OpenIn{InHeader: user, Flags: syscall.O_RDONLY}, &oout); st != 0 {
+		t.Fatalf("open u/f as user: %s", st)
+	}
+	fs.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: cout.NodeId}, Fh: oout.Fh})
+}
+
+func TestBuffers(t *testing.T) {
+	for _, b := range []Buffers{{}, {Read: 4 << 10}, {Read: 128 << 10, Write: 64 << 10}} {
+		if err := b.Check(); err != nil {
+			t.Fatalf("buffers %+v: %s", b, err)
+		}
+	}
+	for _, b := range []Buffers{{Read: 1 << 10}, {Write: 256 << 10}, {Write: 10000}, {Read: -4096}} {
+		if err := b.Check(); err == nil {
+			t.Fatalf("buffers %+v should be invalid", b)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fuse
+
+import "fmt"
+
+func CheckPropagation(p string) error {
+	if p != "" {
+		return fmt.Errorf("mount propagation is only supported on Linux")
+	}
+	return nil
+}
+
+func setPropagation(mp, p string) error {
+	return CheckPropagation(p)
+}
+
+func Recover(mp string) error {
+	return fmt.Errorf("recover is only supported on Linux")
+}
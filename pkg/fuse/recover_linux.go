@@ -0,0 +1,178 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var propagations = map[string]uintptr{
+	"shared":      syscall.MS_SHARED,
+	"slave":       syscall.MS_SLAVE,
+	"private":     syscall.MS_PRIVATE,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// CheckPropagation returns an error if the mount propagation type is unknown.
+func CheckPropagation(p string) error {
+	if _, ok := propagations[p]; p != "" && !ok {
+		return fmt.Errorf("invalid propagation %q", p)
+	}
+	return nil
+}
+
+func setPropagation(mp, p string) error {
+	if p == "" {
+		return nil
+	}
+	flags, ok := propagations[p]
+	if !ok {
+		return fmt.Errorf("invalid propagation %q", p)
+	}
+	return syscall.Mount("none", mp, "", flags, "")
+}
+
+// fuseConnFd returns the FUSE connection passed in FdEnv.
+func fuseConnFd() (int, error) {
+	s := os.Getenv(FdEnv)
+	if s == "" {
+		return -1, fmt.Errorf("%s is not set", FdEnv)
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil || fd < 0 {
+		return -1, fmt.Errorf("invalid %s: %q", FdEnv, s)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return -1, fmt.Errorf("fstat fd %d: %s", fd, err)
+	}
+	// /dev/fuse is the character device 10:229
+	rdev := uint64(st.Rdev)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || unix.Major(rdev) != 10 || unix.Minor(rdev) != 229 {
+		return -1, fmt.Errorf("fd %d is not a FUSE connection", fd)
+	}
+	return fd, nil
+}
+
+type mountInfo struct {
+	major, minor uint32
+	fstype       string
+}
+
+// findMount looks up the mount at mp in a mountinfo table, the last one wins when stacked.
+func findMount(r io.Reader, mp string) (*mountInfo, error) {
+	var found *mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 0:45 / /mnt/jfs rw,relatime shared:1 - fuse.juicefs JuiceFS:myjfs rw,user_id=0
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+1 >= len(fields) || unescapeMount(fields[4]) != mp {
+			continue
+		}
+		var mi mountInfo
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &mi.major, &mi.minor); err != nil {
+			return nil, fmt.Errorf("invalid device %q: %s", fields[2], err)
+		}
+		mi.fstype = fields[sep+1]
+		found = &mi
+	}
+	return found, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes (\040 for space, etc.) in mountinfo.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Recover takes over the FUSE connection of a previous JuiceFS process at mp,
+// which is passed as the file descriptor in FdEnv. The connection is aborted,
+// so that pending and future requests of it fail with ENOTCONN instead of
+// hanging, and then the mount point is detached, so it can be mounted again
+// in the same mount namespace. It does nothing if mp is not mounted.
+func Recover(mp string) error {
+	fd, err := fuseConnFd()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	mp, err = filepath.Abs(mp)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	mi, err := findMount(f, mp)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("read mountinfo: %s", err)
+	}
+	if mi == nil {
+		logger.Infof("%s is not mounted, nothing to recover", mp)
+		return nil
+	}
+	if mi.fstype != "fuse.juicefs" {
+		return fmt.Errorf("%s is mounted as %s, not JuiceFS", mp, mi.fstype)
+	}
+	// the connections are named by the device number (in kernel encoding) in fusectl
+	abort := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", mi.major<<20|mi.minor)
+	if err = ioutil.WriteFile(abort, []byte("1"), 0200); err != nil {
+		logger.Warnf("abort FUSE connection: %s", err)
+	}
+	if err = syscall.Unmount(mp, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("umount %s: %s", mp, err)
+	}
+	logger.Infof("Recovered stale mount point %s (connection %d:%d)", mp, mi.major, mi.minor)
+	return nil
+}
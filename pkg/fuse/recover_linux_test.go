@@ -0,0 +1,132 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFindMount(t *testing.T) {
+	table := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+43 22 0:39 / /mnt/jfs rw,relatime shared:2 - fuse.juicefs JuiceFS:a rw,user_id=0
+44 22 0:40 / /mnt/my\040jfs rw,relatime - fuse.juicefs JuiceFS:b rw,user_id=0
+45 43 0:41 / /mnt/jfs rw,relatime - fuse.juicefs JuiceFS:c rw,user_id=0
+`
+	mi, err := findMount(strings.NewReader(table), "/mnt/jfs")
+	if err != nil || mi == nil || mi.major != 0 || mi.minor != 41 || mi.fstype != "fuse.juicefs" {
+		t.Fatalf("stacked mount: %+v %s", mi, err)
+	}
+	if mi, err = findMount(strings.NewReader(table), "/mnt/my jfs"); err != nil || mi == nil || mi.minor != 40 {
+		t.Fatalf("escaped mount: %+v %s", mi, err)
+	}
+	if mi, err = findMount(strings.NewReader(table), "/mnt"); err != nil || mi != nil {
+		t.Fatalf("not mounted: %+v %s", mi, err)
+	}
+	if mi, _ = findMount(strings.NewReader(table), "/"); mi == nil || mi.fstype != "ext4" {
+		t.Fatalf("root: %+v", mi)
+	}
+}
+
+func TestFuseConnFd(t *testing.T) {
+	defer os.Unsetenv(FdEnv)
+	os.Unsetenv(FdEnv)
+	if _, err := fuseConnFd(); err == nil {
+		t.Fatalf("should fail without %s", FdEnv)
+	}
+	os.Setenv(FdEnv, "abc")
+	if _, err := fuseConnFd(); err == nil {
+		t.Fatalf("should fail with invalid fd")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	os.Setenv(FdEnv, strconv.Itoa(int(r.Fd())))
+	if _, err := fuseConnFd(); err == nil {
+		t.Fatalf("pipe is not a FUSE connection")
+	}
+	if err := Recover(t.TempDir()); err == nil {
+		t.Fatalf("recover should fail with a pipe")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	for _, p := range []string{"", "shared", "rslave", "private"} {
+		if err := CheckPropagation(p); err != nil {
+			t.Fatalf("check %q: %s", p, err)
+		}
+	}
+	if err := CheckPropagation("bidirectional"); err == nil {
+		t.Fatalf("bidirectional should be invalid")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	fd, err := syscall.Open("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("open /dev/fuse: %s", err)
+	}
+	defer os.Unsetenv(FdEnv)
+	mp := t.TempDir()
+	// a connection which is mounted but never served, like the one left by a crashed process
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fd)
+	if err = syscall.Mount("JuiceFS:test", mp, "fuse.juicefs", syscall.MS_NOSUID|syscall.MS_NODEV, opts); err != nil {
+		syscall.Close(fd)
+		t.Skipf("mount: %s", err)
+	}
+	if err = setPropagation(mp, "private"); err != nil {
+		t.Fatalf("set propagation: %s", err)
+	}
+
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		t.Fatalf("dup: %s", err)
+	}
+	syscall.Close(fd)
+	os.Setenv(FdEnv, strconv.Itoa(dup))
+	if err = Recover(mp); err != nil {
+		_ = syscall.Unmount(mp, syscall.MNT_DETACH)
+		t.Fatalf("recover: %s", err)
+	}
+	if err = syscall.Close(dup); err != syscall.EBADF {
+		t.Fatalf("the connection should be closed by recover: %v", err)
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("open mountinfo: %s", err)
+	}
+	defer f.Close()
+	if mi, err := findMount(f, mp); err != nil || mi != nil {
+		t.Fatalf("%s should be unmounted: %+v %v", mp, mi, err)
+	}
+
+	// nothing to recover
+	if fd, err = syscall.Open("/dev/fuse", os.O_RDWR, 0); err != nil {
+		t.Fatalf("open /dev/fuse: %s", err)
+	}
+	os.Setenv(FdEnv, strconv.Itoa(fd))
+	if err = Recover(mp); err != nil {
+		t.Fatalf("recover a directory: %s", err)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fuse
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// The kernel doesn't check the permissions for root (with default_permissions), so a root squashed
+// by RootSquash would still do everything, the permissions are checked here for it instead, with
+// the anonymous user and group, before the operations are made.
+
+// checkAccess checks the permissions of the squashed root on inode.
+func (fs *fileSystem) checkAccess(ctx *fuseContext, inode Ino, mmask uint8) syscall.Errno {
+	if !ctx.squashed || vfs.IsSpecialNode(inode) {
+		return 0
+	}
+	return fs.v.Meta.Access(ctx, inode, mmask, nil)
+}
+
+// checkEntry checks the permissions to add or remove an entry in the directory parent.
+func (fs *fileSystem) checkEntry(ctx *fuseContext, parent Ino) syscall.Errno {
+	return fs.checkAccess(ctx, parent, vfs.MODE_MASK_W|vfs.MODE_MASK_X)
+}
+
+func (fs *fileSystem) checkOpen(ctx *fuseContext, inode Ino, flags uint32) syscall.Errno {
+	var mmask uint8
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mmask = vfs.MODE_MASK_R
+	case syscall.O_WRONLY:
+		mmask = vfs.MODE_MASK_W
+	case syscall.O_RDWR:
+		mmask = vfs.MODE_MASK_R | vfs.MODE_MASK_W
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mmask |= vfs.MODE_MASK_W
+	}
+	return fs.checkAccess(ctx, inode, mmask)
+}
+
+// checkSetAttr allows the squashed root to change the owner, mode and times of the files it owns
+// only, as other users. It can't give a file to others, but the group to its own one.
+func (fs *fileSystem) checkSetAttr(ctx *fuseContext, in *fuse.SetAttrIn) syscall.Errno {
+	inode := Ino(in.NodeId)
+	if !ctx.squashed || vfs.IsSpecialNode(inode) {
+		return 0
+	}
+	entry, st := fs.v.GetAttr(ctx, inode, 0)
+	if st != 0 {
+		return st
+	}
+	attr := entry.Attr
+	owner := ctx.uid == attr.Uid
+	if in.Valid&fuse.FATTR_UID != 0 && in.Uid != attr.Uid {
+		return syscall.EPERM
+	}
+	if in.Valid&fuse.FATTR_GID != 0 && in.Gid != attr.Gid && (!owner || in.Gid != ctx.gid) {
+		return syscall.EPERM
+	}
+	if in.Valid&fuse.FATTR_MODE != 0 && !owner {
+		return syscall.EPERM
+	}
+	if in.Valid&(fuse.FATTR_ATIME|fuse.FATTR_MTIME) != 0 && !owner {
+		// others can only set them to now (e.g. touch) with write permission
+		if in.Valid&(fuse.FATTR_ATIME|fuse.FATTR_ATIME_NOW) == fuse.FATTR_ATIME ||
+			in.Valid&(fuse.FATTR_MTIME|fuse.FATTR_MTIME_NOW) == fuse.FATTR_MTIME {
+			return syscall.EPERM
+		}
+		if st = fs.v.Meta.Access(ctx, inode, vfs.MODE_MASK_W, attr); st != 0 {
+			return st
+		}
+	}
+	if in.Valid&fuse.FATTR_SIZE != 0 && in.Fh == 0 { // ftruncate is checked when it's opened
+		return fs.v.Meta.Access(ctx, inode, vfs.MODE_MASK_W, attr)
+	}
+	return 0
+}
+
+// checkXattr checks the permissions to read or write the extended attribute name. The user ones
+// follow the permissions of the file, and the trusted ones are for root only.
+func (fs *fileSystem) checkXattr(ctx *fuseContext, inode Ino, name string, mmask uint8) syscall.Errno {
+	if !ctx.squashed {
+		return 0
+	}
+	if strings.HasPrefix(name, "trusted.") {
+		return syscall.EPERM
+	}
+	if strings.HasPrefix(name, "user.") {
+		return fs.checkAccess(ctx, inode, mmask)
+	}
+	return 0
+}
@@ -52,4 +52,5 @@ func attrToStat(inode Ino, attr *Attr, out *fuse.Attr) {
 	out.Size = size
 	out.Blocks = blocks
 	setBlksize(out, 0x10000)
+	setBirthtime(out, attr)
 }
@@ -0,0 +1,157 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressConfig is the content types of the GET responses to be compressed by gzip,
+// when the clients accept it.
+type CompressConfig struct {
+	Types   []string // "text/*" matches all the subtypes, empty means disabled
+	MinSize int64    // the smaller responses are not compressed
+}
+
+func (c *CompressConfig) Enabled() bool {
+	return len(c.Types) > 0
+}
+
+// ParseCompressTypes parses the content types separated by comma.
+func ParseCompressTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (c *CompressConfig) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.Types {
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip checks whether gzip (or *) is accepted with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, ae := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(ae, ",") {
+			ps := strings.Split(item, ";")
+			coding := strings.ToLower(strings.TrimSpace(ps[0]))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			accepted := true
+			for _, p := range ps[1:] {
+				if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+					q, err := strconv.ParseFloat(p[2:], 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// compressHandler compresses the whole objects of the compressible types on the fly. The Range
+// requests are passed through without compression, so the ranges are always of the original
+// content.
+type compressHandler struct {
+	conf CompressConfig
+	next http.Handler
+}
+
+func NewCompressHandler(conf CompressConfig, next http.Handler) http.Handler {
+	return &compressHandler{conf, next}
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, conf: &h.conf, accepted: acceptsGzip(r)}
+	h.next.ServeHTTP(cw, r)
+	if cw.gz != nil {
+		_ = cw.gz.Close()
+	}
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	conf        *CompressConfig
+	accepted    bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	header := c.Header()
+	if status == http.StatusOK && header.Get("Content-Encoding") == "" && c.conf.compressible(header.Get("Content-Type")) {
+		// the response depends on Accept-Encoding, even it's not compressed
+		header.Add("Vary", "Accept-Encoding")
+		size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if c.accepted && (err != nil || size >= c.conf.MinSize) {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			// the compressed content is not the object with the ETag
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+			c.gz = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.gz != nil {
+		return c.gz.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if c.gz != nil {
+		_ = c.gz.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
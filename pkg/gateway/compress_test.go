@@ -0,0 +1,128 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	objects := map[string]string{
+		"/b/a.json":    strings.Repeat(`{"key": "value"}`, 1000),
+		"/b/a.png":     strings.Repeat("x", 10000),
+		"/b/small.txt": "small",
+	}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".json"):
+			w.Header().Set("Content-Type", "application/json")
+		case strings.HasSuffix(r.URL.Path, ".txt"):
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		default:
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if rg := r.Header.Get("Range"); rg == "bytes=0-9" {
+			data = data[:10]
+			w.Header().Set("Content-Range", "bytes 0-9/"+strconv.Itoa(len(objects[r.URL.Path])))
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		_, _ = w.Write([]byte(data))
+	})
+	h := NewCompressHandler(CompressConfig{Types: ParseCompressTypes("text/*, application/json"), MinSize: 100}, backend)
+
+	serve := func(path, encoding, rg string) (*httptest.ResponseRecorder, string) {
+		r := httptest.NewRequest("GET", path, nil)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		if rg != "" {
+			r.Header.Set("Range", rg)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		body := w.Body.String()
+		if w.Header().Get("Content-Encoding") == "gzip" {
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("gzip reader of %s: %s", path, err)
+			}
+			data, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("decompress %s: %s", path, err)
+			}
+			body = string(data)
+		}
+		return w, body
+	}
+
+	// round trip
+	w, body := serve("/b/a.json", "deflate, gzip;q=0.8", "")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" || body != objects["/b/a.json"] {
+		t.Fatalf("expect compressed response, but got %d %+v", w.Code, w.Header())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"abc"` ||
+		w.Header().Get("Content-Length") != "" || w.Header().Get("Accept-Ranges") != "" {
+		t.Fatalf("unexpected headers of compressed response: %+v", w.Header())
+	}
+	if w.Body.Len() >= len(objects["/b/a.json"]) {
+		t.Fatalf("compressed size %d is not smaller than %d", w.Body.Len(), len(objects["/b/a.json"]))
+	}
+
+	// range is not compressed
+	w, body = serve("/b/a.json", "gzip", "bytes=0-9")
+	if w.Code != 206 || w.Header().Get("Content-Encoding") != "" || body != objects["/b/a.json"][:10] ||
+		w.Header().Get("Content-Range") == "" || w.Header().Get("ETag") != `"abc"` {
+		t.Fatalf("expect range without compression, but got %d %+v", w.Code, w.Header())
+	}
+
+	cases := []struct {
+		path, encoding string
+		vary           bool
+	}{
+		{"/b/a.json", "", true},
+		{"/b/a.json", "gzip;q=0", true},
+		{"/b/a.json", "br", true},
+		{"/b/small.txt", "gzip", true},
+		{"/b/a.png", "gzip", false},
+		{"/b/missing", "gzip", false},
+	}
+	for _, c := range cases {
+		w, body = serve(c.path, c.encoding, "")
+		if w.Header().Get("Content-Encoding") != "" || body != objects[c.path] {
+			t.Fatalf("%s with %q should not be compressed: %+v", c.path, c.encoding, w.Header())
+		}
+		if (w.Header().Get("Vary") != "") != c.vary {
+			t.Fatalf("%s with %q: unexpected Vary header %+v", c.path, c.encoding, w.Header())
+		}
+	}
+}
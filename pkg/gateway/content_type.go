@@ -0,0 +1,56 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// ContentTypeXattr keeps the content type of a file, which is set by the uploads through the
+// gateway, or by setfattr in a mount point.
+const ContentTypeXattr = "user.jfs.content-type"
+
+// DefaultContentType is the content type of the files without one or a known extension.
+const DefaultContentType = "application/octet-stream"
+
+// the content type filled by minio for the uploads without one
+const unsetContentType = "binary/octet-stream"
+
+// contentType returns the content type kept in file p (empty if none), and the one to be served,
+// which is detected from the extension of the file if it's not kept.
+func (n *jfsObjects) contentType(p string) (kept, served string) {
+	if v, eno := n.fs.GetXattr(mctx, p, ContentTypeXattr); eno == 0 && len(v) > 0 {
+		return string(v), string(v)
+	}
+	if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+		return "", t
+	}
+	return "", n.defaultType
+}
+
+// setContentType keeps the content type in the metadata of an upload into file p.
+func (n *jfsObjects) setContentType(p string, metadata map[string]string) {
+	t := metadata[strings.ToLower("Content-Type")]
+	if t == "" || t == unsetContentType {
+		return
+	}
+	if eno := n.fs.SetXattr(mctx, p, ContentTypeXattr, []byte(t), 0); eno != 0 {
+		logger.Warnf("set content type of %s to %s: %s", p, t, eno)
+	}
+}
@@ -43,18 +43,77 @@ import (
 const (
 	sep        = "/"
 	metaBucket = ".sys"
+	// number of objects deleted concurrently in a DeleteObjects request
+	deleteThreads = 16
 )
 
 var mctx meta.Context
 var logger = utils.GetLogger("juicefs")
 
-func NewJFSGateway(conf *vfs.Config, m meta.Meta, store chunk.ChunkStore, multiBucket, keepEtag bool) (minio.ObjectLayer, error) {
+// Limits are the limits of the sizes of uploaded objects in bytes, 0 means unlimited.
+type Limits struct {
+	MaxPutSize    int64 // of the objects uploaded in a single PUT, the larger ones should use multipart uploads
+	MaxObjectSize int64 // of all the objects, including the ones completed from multipart uploads
+}
+
+// ParseLimits parses the limits of buckets in the format of BUCKET:MAX-PUT-SIZE[:MAX-OBJECT-SIZE]
+// separated by comma, the sizes are in MiB, and the missing or empty ones are taken from def, which
+// is also returned as the limits of the other buckets (keyed by "").
+func ParseLimits(s string, def Limits) (map[string]Limits, error) {
+	limits := map[string]Limits{"": def}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ps := strings.Split(item, ":")
+		if len(ps) < 2 || len(ps) > 3 || ps[0] == "" {
+			return nil, fmt.Errorf("invalid limits %q, expect BUCKET:MAX-PUT-SIZE[:MAX-OBJECT-SIZE]", item)
+		}
+		l := def
+		for i, v := range []*int64{&l.MaxPutSize, &l.MaxObjectSize} {
+			if i+1 >= len(ps) || ps[i+1] == "" {
+				continue
+			}
+			size, err := strconv.ParseInt(ps[i+1], 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid size %q in the limits of bucket %s", ps[i+1], ps[0])
+			}
+			*v = size << 20
+		}
+		limits[ps[0]] = l
+	}
+	return limits, nil
+}
+
+// maxPut returns the max size of an object uploaded in a single PUT, 0 means unlimited.
+func (l Limits) maxPut() int64 {
+	if l.MaxObjectSize > 0 && (l.MaxPutSize == 0 || l.MaxObjectSize < l.MaxPutSize) {
+		return l.MaxObjectSize
+	}
+	return l.MaxPutSize
+}
+
+// NewJFSGateway creates the object layer of gateway, with multiBucket the top-level directories are
+// served as buckets, only the ones in buckets if it's not empty. The limits of a bucket are the ones
+// keyed by its name, or the ones keyed by "" if it's not there.
+func NewJFSGateway(conf *vfs.Config, m meta.Meta, store chunk.ChunkStore, multiBucket, keepEtag bool, defaultType string, buckets []string, limits map[string]Limits) (minio.ObjectLayer, error) {
 	jfs, err := fs.NewFileSystem(conf, m, store)
 	if err != nil {
 		return nil, fmt.Errorf("Initialize failed: %s", err)
 	}
 	mctx = meta.NewContext(uint32(os.Getpid()), uint32(os.Getuid()), []uint32{uint32(os.Getgid())})
-	return &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30), multiBucket: multiBucket, keepEtag: keepEtag}, nil
+	if defaultType == "" {
+		defaultType = DefaultContentType
+	}
+	var allowed map[string]bool
+	if multiBucket && len(buckets) > 0 {
+		allowed = make(map[string]bool)
+		for _, b := range buckets {
+			allowed[b] = true
+		}
+	}
+	return &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30), multiBucket: multiBucket, keepEtag: keepEtag, defaultType: defaultType, buckets: allowed, limits: limits}, nil
 }
 
 type jfsObjects struct {
@@ -64,6 +123,17 @@ type jfsObjects struct {
 	listPool    *minio.TreeWalkPool
 	multiBucket bool
 	keepEtag    bool
+	defaultType string          // the content type of the files without one or a known extension
+	buckets     map[string]bool // the top-level directories served as buckets, nil means all of them
+	limits      map[string]Limits
+}
+
+// limitsOf returns the limits of the sizes of objects in bucket.
+func (n *jfsObjects) limitsOf(bucket string) Limits {
+	if l, ok := n.limits[bucket]; ok {
+		return l
+	}
+	return n.limits[""]
 }
 
 func (n *jfsObjects) IsCompressionSupported() bool {
@@ -147,6 +217,9 @@ func (n *jfsObjects) isValidBucketName(bucket string) bool {
 	if !n.multiBucket && bucket != n.conf.Format.Name {
 		return false
 	}
+	if n.buckets != nil && !n.buckets[bucket] {
+		return false
+	}
 	return s3utils.CheckValidBucketNameStrict(bucket) == nil
 }
 
@@ -177,6 +250,9 @@ func (n *jfsObjects) DeleteBucket(ctx context.Context, bucket string, forceDelet
 		return minio.BucketNotEmpty{Bucket: bucket}
 	}
 	eno := n.fs.Delete(mctx, n.path(bucket))
+	if eno == 0 {
+		_ = n.fs.Delete(mctx, n.policyPath(bucket))
+	}
 	return jfsToObjectErr(ctx, eno, bucket)
 }
 
@@ -193,13 +269,20 @@ func (n *jfsObjects) MakeBucketWithLocation(ctx context.Context, bucket string,
 
 func (n *jfsObjects) GetBucketInfo(ctx context.Context, bucket string) (bi minio.BucketInfo, err error) {
 	if !n.isValidBucketName(bucket) {
+		// other buckets don't exist in single bucket mode, e.g. for HeadBucket
+		if s3utils.CheckValidBucketNameStrict(bucket) == nil {
+			return bi, minio.BucketNotFound{Bucket: bucket}
+		}
 		return bi, minio.BucketNameInvalid{Bucket: bucket}
 	}
 	fi, eno := n.fs.Stat(mctx, n.path(bucket))
+	if eno == 0 && !fi.IsDir() {
+		return bi, minio.BucketNotFound{Bucket: bucket}
+	}
 	if eno == 0 {
 		bi = minio.BucketInfo{
 			Name:    bucket,
-			Created: time.Unix(fi.Atime()/1000, 0),
+			Created: bucketCreated(fi),
 		}
 	}
 	return bi, jfsToObjectErr(ctx, eno, bucket)
@@ -213,6 +296,14 @@ func isReservedOrInvalidBucket(bucketEntry string, strict bool) bool {
 	return bucketEntry == metaBucket
 }
 
+// bucketCreated returns the creation time of a bucket, which is the birth time of its directory.
+func bucketCreated(fi *fs.FileStat) time.Time {
+	return fi.Sys().(*meta.Attr).Birthtime()
+}
+
+// ListBuckets returns the top-level directories (the allowed ones if the buckets are given) as
+// buckets in multi-bucket mode, so they can be browsed by S3 clients, or the only bucket named after
+// the volume.
 func (n *jfsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInfo, err error) {
 	if !n.multiBucket {
 		fi, eno := n.fs.Stat(mctx, "/")
@@ -221,7 +312,7 @@ func (n *jfsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInf
 		}
 		buckets = []minio.BucketInfo{{
 			Name:    n.conf.Format.Name,
-			Created: time.Unix(fi.Atime()/1000, 0),
+			Created: bucketCreated(fi),
 		}}
 		return buckets, nil
 	}
@@ -230,7 +321,7 @@ func (n *jfsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInf
 		return nil, jfsToObjectErr(ctx, eno)
 	}
 	defer f.Close(mctx)
-	entries, eno := f.Readdir(mctx, 10000)
+	entries, eno := f.Readdir(mctx, 0)
 	if eno != 0 {
 		return nil, jfsToObjectErr(ctx, eno)
 	}
@@ -243,7 +334,7 @@ func (n *jfsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInf
 		if entry.IsDir() {
 			buckets = append(buckets, minio.BucketInfo{
 				Name:    entry.Name(),
-				Created: time.Unix(entry.(*fs.FileStat).Atime()/1000, 0),
+				Created: bucketCreated(entry.(*fs.FileStat)),
 			})
 		}
 	}
@@ -333,6 +424,9 @@ func (n *jfsObjects) ListObjects(ctx context.Context, bucket, prefix, marker, de
 				IsDir:   fi.IsDir(),
 				AccTime: fi.ModTime(),
 			}
+		} else if fs.IsNotExist(eno) {
+			// removed after the directory is listed, which is skipped by the tree walker
+			return obj, errFileNotFound
 		}
 		return obj, jfsToObjectErr(ctx, eno, bucket, object)
 	}
@@ -343,41 +437,84 @@ func (n *jfsObjects) ListObjects(ctx context.Context, bucket, prefix, marker, de
 	return minio.ListObjects(ctx, n, bucket, prefix, marker, delimiter, maxKeys, n.listPool, n.listDirFactory(), n.isLeaf, n.isLeafDir, getObjectInfo, getObjectInfo)
 }
 
-// ListObjectsV2 lists all blobs in JFS bucket filtered by prefix
+// ListObjectsV2 lists all blobs in JFS bucket filtered by prefix, the owner is filled
+// by the handler if fetchOwner is set.
 func (n *jfsObjects) ListObjectsV2(ctx context.Context, bucket, prefix, continuationToken, delimiter string, maxKeys int,
 	fetchOwner bool, startAfter string) (loi minio.ListObjectsV2Info, err error) {
-	if !n.isValidBucketName(bucket) {
-		return minio.ListObjectsV2Info{}, minio.BucketNameInvalid{Bucket: bucket}
+	if err = n.checkBucket(ctx, bucket); err != nil {
+		return loi, err
+	}
+	loi.ContinuationToken = continuationToken
+	// start-after is ignored once the listing is continued
+	marker := startAfter
+	if continuationToken != "" {
+		if marker, err = decodeListToken(continuationToken, prefix, delimiter); err != nil {
+			return loi, minio.InvalidArgument{Bucket: bucket, Object: prefix, Err: err}
+		}
+	}
+	if maxKeys == 0 {
+		return loi, nil
 	}
-	// fetchOwner is not supported and unused.
-	marker := continuationToken
-	if marker == "" {
-		marker = startAfter
+	if !strings.HasPrefix(marker, prefix) {
+		if marker > prefix {
+			return loi, nil // all the keys with the prefix are before the marker
+		}
+		marker = ""
 	}
 	resultV1, err := n.ListObjects(ctx, bucket, prefix, marker, delimiter, maxKeys)
 	if err == nil {
-		loi = minio.ListObjectsV2Info{
-			Objects:               resultV1.Objects,
-			Prefixes:              resultV1.Prefixes,
-			ContinuationToken:     continuationToken,
-			NextContinuationToken: resultV1.NextMarker,
-			IsTruncated:           resultV1.IsTruncated,
+		loi.Objects = resultV1.Objects
+		loi.Prefixes = resultV1.Prefixes
+		loi.IsTruncated = resultV1.IsTruncated && resultV1.NextMarker != ""
+		if loi.IsTruncated {
+			loi.NextContinuationToken = encodeListToken(prefix, delimiter, resultV1.NextMarker)
 		}
 	}
 	return loi, err
 }
 
+// errFileNotFound is the same as the one in minio, which is ignored when listing objects.
+var errFileNotFound = minio.StorageErr("file not found")
+
+const listTokenVersion = "jfs1"
+
+// encodeListToken keeps the last returned key (or common prefix) in the continuation token,
+// the listing is resumed right after it, so the token is still valid after the key is removed,
+// the tree walker is expired or the request is sent to another gateway.
+// The token is encoded with base64 by the handler.
+func encodeListToken(prefix, delimiter, marker string) string {
+	return strings.Join([]string{listTokenVersion, prefix, delimiter, marker}, "\x00")
+}
+
+func decodeListToken(token, prefix, delimiter string) (string, error) {
+	ps := strings.SplitN(token, "\x00", 4)
+	if len(ps) != 4 || ps[0] != listTokenVersion {
+		return "", fmt.Errorf("invalid continuation token")
+	}
+	if ps[1] != prefix || ps[2] != delimiter {
+		return "", fmt.Errorf("the continuation token is for prefix %q and delimiter %q", ps[1], ps[2])
+	}
+	if !strings.HasPrefix(ps[3], prefix) {
+		return "", fmt.Errorf("invalid continuation token")
+	}
+	return ps[3], nil
+}
+
 func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, options minio.ObjectOptions) (info minio.ObjectInfo, err error) {
 	if err = n.checkBucket(ctx, bucket); err != nil {
 		return
 	}
 	info.Bucket = bucket
 	info.Name = object
+	if err = n.checkRetention(ctx, bucket, object); err != nil {
+		return
+	}
 	p := n.path(bucket, object)
 	root := n.path(bucket)
 	for p != root {
 		if eno := n.fs.Delete(mctx, p); eno != 0 {
-			if fs.IsNotEmpty(eno) {
+			// the parent could be removed by the deletion of another object
+			if fs.IsNotEmpty(eno) || eno == syscall.ENOENT && p != n.path(bucket, object) {
 				err = nil
 			} else {
 				err = eno
@@ -389,16 +526,30 @@ func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, op
 	return info, jfsToObjectErr(ctx, err, bucket, object)
 }
 
-func (n *jfsObjects) DeleteObjects(ctx context.Context, bucket string, objects []minio.ObjectToDelete, options minio.ObjectOptions) (objs []minio.DeletedObject, errs []error) {
-	for _, object := range objects {
-		_, err := n.DeleteObject(ctx, bucket, object.ObjectName, options)
-		if err == nil {
-			objs = append(objs, minio.DeletedObject{ObjectName: object.ObjectName})
-		} else {
-			errs = append(errs, err)
-		}
+// DeleteObjects deletes the objects concurrently. The results are in the same order as objects (an
+// error is nil if the object is deleted), as expected by the handler, which reports the objects not
+// found as deleted and omits the deleted ones in quiet mode.
+func (n *jfsObjects) DeleteObjects(ctx context.Context, bucket string, objects []minio.ObjectToDelete, options minio.ObjectOptions) ([]minio.DeletedObject, []error) {
+	objs := make([]minio.DeletedObject, len(objects))
+	errs := make([]error, len(objects))
+	todo := make(chan int, len(objects))
+	for i := range objects {
+		todo <- i
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	for i := 0; i < deleteThreads && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				objs[i].ObjectName = objects[i].ObjectName
+				_, errs[i] = n.DeleteObject(ctx, bucket, objects[i].ObjectName, options)
+			}
+		}()
 	}
-	return
+	wg.Wait()
+	return objs, errs
 }
 
 type fReader struct {
@@ -430,6 +581,10 @@ func (n *jfsObjects) GetObjectNInfo(ctx context.Context, bucket, object string,
 	return minio.NewGetObjectReaderFromReader(r, objInfo, opts, closer)
 }
 
+// CopyObject copies the metadata of the slices of the source file (no data is read or written), and
+// the content type and user-defined metadata in srcInfo, which are the ones of the source or those
+// in the request, as x-amz-metadata-directive is COPY or REPLACE. The metadata is replaced only
+// if the source is the destination.
 func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBucket, dstObject string, srcInfo minio.ObjectInfo, srcOpts, dstOpts minio.ObjectOptions) (info minio.ObjectInfo, err error) {
 	if err = n.checkBucket(ctx, srcBucket); err != nil {
 		return
@@ -437,18 +592,24 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 	if err = n.checkBucket(ctx, dstBucket); err != nil {
 		return
 	}
+	if err = n.checkRetention(ctx, dstBucket, dstObject); err != nil {
+		return
+	}
 	dst := n.path(dstBucket, dstObject)
 	src := n.path(srcBucket, srcObject)
 	if minio.IsStringEqual(src, dst) {
+		n.replaceMetadata(dst, srcInfo.UserDefined)
 		return n.GetObjectInfo(ctx, srcBucket, srcObject, minio.ObjectOptions{})
 	}
 	tmp := n.tpath(dstBucket, "tmp", minio.MustGetUUID())
 	_ = n.mkdirAll(ctx, path.Dir(tmp), 0755)
-	_, eno := n.fs.Create(mctx, tmp, 0644)
+	f, eno := n.fs.Create(mctx, tmp, 0644)
 	if eno != 0 {
+		err = jfsToObjectErr(ctx, eno, dstBucket, dstObject)
 		logger.Errorf("create %s: %s", tmp, eno)
 		return
 	}
+	_ = f.Close(mctx)
 	defer func() { _ = n.fs.Delete(mctx, tmp) }()
 
 	_, eno = n.fs.CopyFileRange(mctx, src, 0, tmp, 0, 1<<63)
@@ -457,38 +618,25 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 		logger.Errorf("copy %s to %s: %s", src, tmp, err)
 		return
 	}
-	eno = n.fs.Rename(mctx, tmp, dst, 0)
-	if eno != 0 {
-		err = jfsToObjectErr(ctx, eno, srcBucket, srcObject)
-		logger.Errorf("rename %s to %s: %s", tmp, dst, err)
-		return
+	n.setContentType(tmp, srcInfo.UserDefined)
+	n.setUserMetadata(tmp, srcInfo.UserDefined, false)
+	if n.keepEtag {
+		if etag, _ := n.fs.GetXattr(mctx, src, s3Etag); len(etag) != 0 {
+			if eno = n.fs.SetXattr(mctx, tmp, s3Etag, etag, 0); eno != 0 {
+				logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", tmp, s3Etag, etag, 0)
+			}
+		}
+	}
+	if dir := path.Dir(dst); dir != "" {
+		_ = n.mkdirAll(ctx, dir, os.FileMode(0755))
 	}
-	fi, eno := n.fs.Stat(mctx, dst)
+	eno = n.fs.Rename(mctx, tmp, dst, 0)
 	if eno != 0 {
 		err = jfsToObjectErr(ctx, eno, dstBucket, dstObject)
+		logger.Errorf("rename %s to %s: %s", tmp, dst, err)
 		return
 	}
-
-	var etag []byte
-	if n.keepEtag {
-		etag, _ = n.fs.GetXattr(mctx, src, s3Etag)
-		if len(etag) != 0 {
-			eno = n.fs.SetXattr(mctx, dst, s3Etag, etag, 0)
-			if eno != 0 {
-				logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", dst, s3Etag, etag, 0)
-			}
-		}
-	}
-
-	return minio.ObjectInfo{
-		Bucket:  dstBucket,
-		Name:    dstObject,
-		ETag:    string(etag),
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
-	}, nil
+	return n.GetObjectInfo(ctx, dstBucket, dstObject, minio.ObjectOptions{})
 }
 
 var buffPool = sync.Pool{
@@ -547,7 +695,7 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 	if n.keepEtag {
 		etag, _ = n.fs.GetXattr(mctx, n.path(bucket, object), s3Etag)
 	}
-	return minio.ObjectInfo{
+	objInfo = minio.ObjectInfo{
 		Bucket:  bucket,
 		Name:    object,
 		ModTime: fi.ModTime(),
@@ -555,7 +703,20 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 		IsDir:   fi.IsDir(),
 		AccTime: fi.ModTime(),
 		ETag:    string(etag),
-	}, nil
+	}
+	if !fi.IsDir() {
+		var kept string
+		kept, objInfo.ContentType = n.contentType(n.path(bucket, object))
+		// copied to the destination of CopyObject unless it's replaced
+		objInfo.UserDefined = n.userMetadata(n.path(bucket, object))
+		if kept != "" {
+			if objInfo.UserDefined == nil {
+				objInfo.UserDefined = make(map[string]string)
+			}
+			objInfo.UserDefined["content-type"] = kept
+		}
+	}
+	return objInfo, nil
 }
 
 func (n *jfsObjects) mkdirAll(ctx context.Context, p string, mode os.FileMode) error {
@@ -581,7 +742,9 @@ func (n *jfsObjects) mkdirAll(ctx context.Context, p string, mode os.FileMode) e
 	return eno
 }
 
-func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *minio.PutObjReader, opts minio.ObjectOptions) (err error) {
+// putObject writes the data of r into object, it fails with ObjectTooLarge once the data is larger
+// than limit (if it's not 0), in case the size of r is unknown.
+func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *minio.PutObjReader, opts minio.ObjectOptions, limit int64) (err error) {
 	tmpname := n.tpath(bucket, "tmp", minio.MustGetUUID())
 	_ = n.mkdirAll(ctx, path.Dir(tmpname), 0755)
 	f, eno := n.fs.Create(mctx, tmpname, 0644)
@@ -593,6 +756,7 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 	defer func() { _ = n.fs.Delete(mctx, tmpname) }()
 	var buf = buffPool.Get().(*[]byte)
 	defer buffPool.Put(buf)
+	var written int64
 	for {
 		var n int
 		n, err = io.ReadFull(r, *buf)
@@ -602,6 +766,10 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 			}
 			break
 		}
+		if written += int64(n); limit > 0 && written > limit {
+			err = minio.ObjectTooLarge{Bucket: bucket, Object: object}
+			break
+		}
 		_, eno := f.Write(mctx, (*buf)[:n])
 		if eno != 0 {
 			err = eno
@@ -619,6 +787,8 @@ func (n *jfsObjects) putObject(ctx context.Context, bucket, object string, r *mi
 	if err != nil {
 		return
 	}
+	n.setContentType(tmpname, opts.UserDefined)
+	n.setUserMetadata(tmpname, opts.UserDefined, false)
 	dir := path.Dir(object)
 	if dir != "" {
 		_ = n.mkdirAll(ctx, dir, os.FileMode(0755))
@@ -649,8 +819,17 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 			}
 			return
 		}
-	} else if err = n.putObject(ctx, bucket, p, r, opts); err != nil {
-		return
+	} else {
+		limit := n.limitsOf(bucket).maxPut()
+		if limit > 0 && r.Size() > limit {
+			return objInfo, minio.ObjectTooLarge{Bucket: bucket, Object: object}
+		}
+		if err = n.checkRetention(ctx, bucket, object); err != nil {
+			return
+		}
+		if err = n.putObject(ctx, bucket, p, r, opts, limit); err != nil {
+			return
+		}
 	}
 	fi, eno := n.fs.Stat(mctx, p)
 	if eno != 0 {
@@ -663,7 +842,7 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 			logger.Errorf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", p, s3Etag, etag, 0)
 		}
 	}
-	return minio.ObjectInfo{
+	objInfo = minio.ObjectInfo{
 		Bucket:  bucket,
 		Name:    object,
 		ETag:    etag,
@@ -671,7 +850,11 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 		Size:    fi.Size(),
 		IsDir:   fi.IsDir(),
 		AccTime: fi.ModTime(),
-	}, nil
+	}
+	if !fi.IsDir() {
+		_, objInfo.ContentType = n.contentType(p)
+	}
+	return objInfo, nil
 }
 
 func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, object string, opts minio.ObjectOptions) (uploadID string, err error) {
@@ -686,6 +869,9 @@ func (n *jfsObjects) NewMultipartUpload(ctx context.Context, bucket string, obje
 		if eno != 0 {
 			logger.Warnf("set object %s on upload %s: %s", object, uploadID, eno)
 		}
+		// moved to the object when the upload is completed
+		n.setContentType(p, opts.UserDefined)
+		n.setUserMetadata(p, opts.UserDefined, false)
 	}
 	return
 }
@@ -803,8 +989,10 @@ func (n *jfsObjects) PutObjectPart(ctx context.Context, bucket, object, uploadID
 		return
 	}
 	p := n.ppath(bucket, uploadID, strconv.Itoa(partID))
-	if err = n.putObject(ctx, bucket, p, r, opts); err != nil {
-		err = jfsToObjectErr(ctx, err, bucket, object)
+	if err = n.putObject(ctx, bucket, p, r, opts, n.limitsOf(bucket).MaxObjectSize); err != nil {
+		if _, ok := err.(minio.ObjectTooLarge); !ok {
+			err = jfsToObjectErr(ctx, err, bucket, object)
+		}
 		return
 	}
 	etag := r.MD5CurrentHexString()
@@ -841,7 +1029,12 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 		logger.Errorf("create complete: %s", err)
 		return
 	}
+	if t, eno := n.fs.GetXattr(mctx, n.upath(bucket, uploadID), ContentTypeXattr); eno == 0 && len(t) > 0 {
+		n.setContentType(tmp, map[string]string{"content-type": string(t)})
+	}
+	n.setUserMetadata(tmp, n.userMetadata(n.upath(bucket, uploadID)), false)
 	var total uint64
+	limit := n.limitsOf(bucket).MaxObjectSize
 	for _, part := range parts {
 		p := n.ppath(bucket, uploadID, strconv.Itoa(part.PartNumber))
 		copied, eno := n.fs.CopyFileRange(mctx, p, 0, tmp, total, 1<<30)
@@ -851,8 +1044,17 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 			return
 		}
 		total += copied
+		if limit > 0 && total > uint64(limit) {
+			// the parts are kept, so the upload can still be aborted
+			_ = n.fs.Delete(mctx, tmp)
+			return objInfo, minio.ObjectTooLarge{Bucket: bucket, Object: object}
+		}
 	}
 
+	if err = n.checkRetention(ctx, bucket, object); err != nil {
+		_ = n.fs.Delete(mctx, tmp)
+		return
+	}
 	name := n.path(bucket, object)
 	dir := path.Dir(name)
 	if dir != "" {
@@ -889,14 +1091,16 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 			logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", name, s3Etag, s3MD5, 0)
 		}
 	}
+	_, contentType := n.contentType(name)
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ETag:    s3MD5,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        s3MD5,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ContentType: contentType,
 	}, nil
 }
 
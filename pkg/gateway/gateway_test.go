@@ -0,0 +1,645 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/bucket/policy"
+	"github.com/minio/minio/pkg/hash"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func newTestGateway(t *testing.T) *jfsObjects {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	format := meta.Format{Name: "test", BlockSize: 4096}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	conf := &vfs.Config{
+		Meta:   &meta.Config{},
+		Format: &format,
+		Chunk:  &chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, BufferSize: 100 << 20},
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	layer, err := NewJFSGateway(conf, m, chunk.NewCachedStore(blob, *conf.Chunk), false, false, "", nil, nil)
+	if err != nil {
+		t.Fatalf("new gateway: %s", err)
+	}
+	return layer.(*jfsObjects)
+}
+
+func (n *jfsObjects) touch(t *testing.T, key string) {
+	p := n.path(key)
+	for i := 1; i < len(p); i++ {
+		if p[i] == '/' {
+			_ = n.fs.Mkdir(mctx, p[:i], 0755)
+		}
+	}
+	f, eno := n.fs.Create(mctx, p, 0644)
+	if eno != 0 {
+		t.Fatalf("create %s: %s", key, eno)
+	}
+	_ = f.Close(mctx)
+}
+
+// listAllV2 lists all the pages, and returns the keys and common prefixes in the order returned.
+func listAllV2(t *testing.T, n *jfsObjects, prefix, delimiter, startAfter string, maxKeys int, between func(page int, token string)) []string {
+	var keys []string
+	var token string
+	for page := 0; ; page++ {
+		r, err := n.ListObjectsV2(context.Background(), "test", prefix, token, delimiter, maxKeys, false, startAfter)
+		if err != nil {
+			t.Fatalf("list %q after %q: %s", prefix, token, err)
+		}
+		if r.ContinuationToken != token {
+			t.Fatalf("continuation token %q, expected %q", r.ContinuationToken, token)
+		}
+		if n := len(r.Objects) + len(r.Prefixes); n > maxKeys || r.IsTruncated && n != maxKeys {
+			t.Fatalf("page %d has %d entries, truncated: %t", page, n, r.IsTruncated)
+		}
+		for _, o := range r.Objects {
+			keys = append(keys, o.Name)
+		}
+		keys = append(keys, r.Prefixes...)
+		if !r.IsTruncated {
+			if r.NextContinuationToken != "" {
+				t.Fatalf("next continuation token of last page: %q", r.NextContinuationToken)
+			}
+			return keys
+		}
+		if r.NextContinuationToken == "" || r.NextContinuationToken == token {
+			t.Fatalf("invalid next continuation token: %q", r.NextContinuationToken)
+		}
+		token = r.NextContinuationToken
+		if between != nil {
+			between(page, token)
+		}
+	}
+}
+
+func TestListObjectsV2(t *testing.T) {
+	n := newTestGateway(t)
+	var all []string
+	for i := 0; i < 200; i++ {
+		all = append(all, fmt.Sprintf("big/f%03d", i))
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 5; j++ {
+			all = append(all, fmt.Sprintf("big/d%d/f%d", i, j))
+		}
+	}
+	all = append(all, "a", "big-file", "big.txt", "c")
+	for _, k := range all {
+		n.touch(t, k)
+	}
+	sort.Strings(all)
+	filter := func(keys []string, f func(k string) bool) []string {
+		var r []string
+		for _, k := range keys {
+			if f(k) {
+				r = append(r, k)
+			}
+		}
+		return r
+	}
+
+	// recursive
+	for _, size := range []int{1, 7, 50, 1000} {
+		if keys := listAllV2(t, n, "", "", "", size, nil); !reflect.DeepEqual(keys, all) {
+			t.Fatalf("list all in pages of %d: %d keys, expected %d", size, len(keys), len(all))
+		}
+	}
+	expected := filter(all, func(k string) bool { return strings.HasPrefix(k, "big/") })
+	if keys := listAllV2(t, n, "big/", "", "", 9, nil); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("list big/: %v", keys)
+	}
+
+	// with delimiter, the common prefixes are counted in max-keys
+	keys := listAllV2(t, n, "big/", "/", "", 7, nil)
+	expected = filter(all, func(k string) bool { return strings.HasPrefix(k, "big/f") })
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("big/d%d/", i))
+	}
+	sort.Strings(keys)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("list big/ with delimiter: %v", keys)
+	}
+	if keys = listAllV2(t, n, "", "/", "", 2, nil); !reflect.DeepEqual(keys, []string{"a", "big-file", "big.txt", "big/", "c"}) {
+		t.Fatalf("list root with delimiter: %v", keys)
+	}
+
+	// start-after
+	expected = filter(all, func(k string) bool { return k > "big/f150" })
+	if keys = listAllV2(t, n, "", "", "big/f150", 13, nil); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("list after big/f150: %v", keys)
+	}
+	expected = filter(all, func(k string) bool { return strings.HasPrefix(k, "big/") })
+	if keys = listAllV2(t, n, "big/", "", "a", 10, nil); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("start-after before the prefix: %v", keys)
+	}
+	if keys = listAllV2(t, n, "big/", "", "c", 10, nil); len(keys) != 0 {
+		t.Fatalf("start-after behind the prefix: %v", keys)
+	}
+
+	// max-keys of zero
+	r, err := n.ListObjectsV2(context.Background(), "test", "", "", "", 0, true, "")
+	if err != nil || len(r.Objects) != 0 || len(r.Prefixes) != 0 || r.IsTruncated {
+		t.Fatalf("list with max-keys 0: %+v %v", r, err)
+	}
+
+	// the directory is changed between pages
+	keys = listAllV2(t, n, "big/", "", "", 10, func(page int, token string) {
+		marker, _ := decodeListToken(token, "big/", "")
+		var removed, added []string
+		switch page {
+		case 2: // the last returned key
+			removed = append(removed, marker)
+		case 5: // a key not listed yet, which is still in the cached tree walker
+			removed = append(removed, "big/f199")
+		case 8: // a key before the position
+			removed = append(removed, "big/d0/f0")
+			added = append(added, "big/d0/f9")
+		case 12: // a key after the position
+			added = append(added, "big/zzz")
+		default:
+			return
+		}
+		for _, k := range removed {
+			_ = n.fs.Delete(mctx, n.path(k))
+		}
+		for _, k := range added {
+			n.touch(t, k)
+		}
+		if page != 5 {
+			// a new gateway can resume the listing
+			n.listPool = minio.NewTreeWalkPool(time.Minute)
+		}
+	})
+	expected = filter(all, func(k string) bool { return strings.HasPrefix(k, "big/") && k != "big/f199" })
+	expected = append(expected, "big/zzz")
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("list while changing: %d keys, expected %d\n%v", len(keys), len(expected), keys)
+	}
+
+	// invalid tokens
+	for _, token := range []string{"big/f100", encodeListToken("big/", "/", "big/f100"), encodeListToken("", "", "c")} {
+		if _, err = n.ListObjectsV2(context.Background(), "test", "big/", token, "", 10, false, ""); err == nil {
+			t.Fatalf("continuation token %q should be invalid", token)
+		} else if _, ok := err.(minio.InvalidArgument); !ok {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if _, err = n.ListObjectsV2(context.Background(), "other", "", "", "", 10, false, ""); err == nil {
+		t.Fatalf("list unknown bucket should fail")
+	}
+}
+
+func TestBucketPolicy(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	if _, err := n.GetBucketPolicy(ctx, "test"); err == nil {
+		t.Fatalf("policy should not exist")
+	} else if _, ok := err.(minio.BucketPolicyNotFound); !ok {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := n.DeleteBucketPolicy(ctx, "test"); err != nil {
+		t.Fatalf("delete policy not set: %s", err)
+	}
+
+	// the policy set by `mc policy set download`
+	download := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetBucketLocation","s3:ListBucket"],"Resource":["arn:aws:s3:::test"]},{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::test/*"]}]}`
+	p, err := policy.ParseConfig(strings.NewReader(download), "test")
+	if err != nil {
+		t.Fatalf("parse policy: %s", err)
+	}
+	if err = n.SetBucketPolicy(ctx, "test", p); err != nil {
+		t.Fatalf("set policy: %s", err)
+	}
+	if p, err = n.GetBucketPolicy(ctx, "test"); err != nil || len(p.Statements) != 2 {
+		t.Fatalf("get policy: %+v %v", p, err)
+	}
+	anonymous := func(action policy.Action, object string) bool {
+		return p.IsAllowed(policy.Args{
+			Action:          action,
+			BucketName:      "test",
+			ObjectName:      object,
+			ConditionValues: map[string][]string{},
+		})
+	}
+	if !anonymous(policy.GetObjectAction, "a/b") || !anonymous(policy.ListBucketAction, "") {
+		t.Fatalf("anonymous read should be allowed")
+	}
+	if anonymous(policy.PutObjectAction, "a/b") || anonymous(policy.DeleteObjectAction, "a/b") {
+		t.Fatalf("anonymous write should be rejected")
+	}
+
+	// `mc policy set public` is rejected, anonymous write is never allowed
+	public := strings.Replace(download, `"s3:GetObject"`, `"s3:GetObject","s3:PutObject"`, 1)
+	if p, err = policy.ParseConfig(strings.NewReader(public), "test"); err != nil {
+		t.Fatalf("parse policy: %s", err)
+	}
+	if err = n.SetBucketPolicy(ctx, "test", p); err == nil {
+		t.Fatalf("policy allowing PutObject should be rejected")
+	} else if _, ok := err.(policy.Error); !ok {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p, err = n.GetBucketPolicy(ctx, "test"); err != nil || p.IsAllowed(policy.Args{Action: policy.PutObjectAction, BucketName: "test", ObjectName: "a", ConditionValues: map[string][]string{}}) {
+		t.Fatalf("policy should not be changed: %+v %v", p, err)
+	}
+
+	if err = n.DeleteBucketPolicy(ctx, "test"); err != nil {
+		t.Fatalf("delete policy: %s", err)
+	}
+	if _, err = n.GetBucketPolicy(ctx, "test"); err == nil {
+		t.Fatalf("policy should be deleted")
+	}
+	if err = n.SetBucketPolicy(ctx, "other", p); err == nil {
+		t.Fatalf("set policy of unknown bucket should fail")
+	}
+}
+
+func TestDeleteObjects(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	var objects []minio.ObjectToDelete
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("d/%d/obj", i)
+		n.touch(t, key)
+		objects = append(objects, minio.ObjectToDelete{ObjectName: key})
+	}
+	objects = append(objects, minio.ObjectToDelete{ObjectName: "missing"})
+	objs, errs := n.DeleteObjects(ctx, "test", objects, minio.ObjectOptions{})
+	if len(objs) != len(objects) || len(errs) != len(objects) {
+		t.Fatalf("results: %d %d", len(objs), len(errs))
+	}
+	for i, o := range objects {
+		if objs[i].ObjectName != o.ObjectName {
+			t.Fatalf("result %d is for %s, expected %s", i, objs[i].ObjectName, o.ObjectName)
+		}
+		if o.ObjectName == "missing" {
+			if _, ok := errs[i].(minio.ObjectNotFound); !ok {
+				t.Fatalf("delete missing: %v", errs[i])
+			}
+		} else if errs[i] != nil {
+			t.Fatalf("delete %s: %s", o.ObjectName, errs[i])
+		}
+	}
+	if _, eno := n.fs.Stat(mctx, n.path("test", "d")); eno == 0 {
+		t.Fatalf("empty directories should be removed")
+	}
+}
+
+func isBucketNotFound(err error) bool {
+	_, ok := err.(minio.BucketNotFound)
+	return ok
+}
+
+func isBucketNameInvalid(err error) bool {
+	_, ok := err.(minio.BucketNameInvalid)
+	return ok
+}
+
+func TestGetBucketInfo(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	if bi, err := n.GetBucketInfo(ctx, "test"); err != nil || bi.Name != "test" {
+		t.Fatalf("bucket info: %+v %s", bi, err)
+	}
+	if _, err := n.GetBucketInfo(ctx, "other"); !isBucketNotFound(err) {
+		t.Fatalf("other bucket: %s", err)
+	}
+	if _, err := n.GetBucketInfo(ctx, "In_valid"); !isBucketNameInvalid(err) {
+		t.Fatalf("invalid bucket: %s", err)
+	}
+
+	// the files at top level are not buckets
+	n.multiBucket = true
+	n.touch(t, "file")
+	_ = n.fs.Mkdir(mctx, "/dir", 0755)
+	if _, err := n.GetBucketInfo(ctx, "dir"); err != nil {
+		t.Fatalf("bucket info of dir: %s", err)
+	}
+	for _, bucket := range []string{"file", "missing"} {
+		if _, err := n.GetBucketInfo(ctx, bucket); !isBucketNotFound(err) {
+			t.Fatalf("bucket info of %s: %s", bucket, err)
+		}
+	}
+}
+
+func TestListBuckets(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	if bs, err := n.ListBuckets(ctx); err != nil || len(bs) != 1 || bs[0].Name != "test" {
+		t.Fatalf("buckets in single bucket mode: %+v %s", bs, err)
+	}
+
+	n.multiBucket = true
+	n.touch(t, "file")
+	for _, name := range []string{"bkt2", "bkt1", "In_valid"} {
+		if eno := n.fs.Mkdir(mctx, "/"+name, 0755); eno != 0 {
+			t.Fatalf("mkdir %s: %s", name, eno)
+		}
+	}
+	bs, err := n.ListBuckets(ctx)
+	if err != nil || len(bs) != 2 || bs[0].Name != "bkt1" || bs[1].Name != "bkt2" {
+		t.Fatalf("buckets: %+v %s", bs, err)
+	}
+	for _, b := range bs {
+		fi, eno := n.fs.Stat(mctx, "/"+b.Name)
+		if eno != 0 {
+			t.Fatalf("stat %s: %s", b.Name, eno)
+		}
+		if btime := fi.Sys().(*meta.Attr).Birthtime(); !b.Created.Equal(btime) {
+			t.Fatalf("bucket %s is created at %s, but the directory at %s", b.Name, b.Created, btime)
+		}
+	}
+	// the new directories appear as buckets
+	_ = n.fs.Mkdir(mctx, "/bkt3", 0755)
+	if bs, err = n.ListBuckets(ctx); err != nil || len(bs) != 3 || bs[2].Name != "bkt3" {
+		t.Fatalf("buckets after mkdir: %+v %s", bs, err)
+	}
+
+	// only the allowed ones are exposed
+	n.buckets = map[string]bool{"bkt2": true, "bkt4": true}
+	if bs, err = n.ListBuckets(ctx); err != nil || len(bs) != 1 || bs[0].Name != "bkt2" {
+		t.Fatalf("allowed buckets: %+v %s", bs, err)
+	}
+	if _, err = n.GetBucketInfo(ctx, "bkt1"); !isBucketNotFound(err) {
+		t.Fatalf("bucket info of bkt1: %s", err)
+	}
+	if err = n.MakeBucketWithLocation(ctx, "bkt5", minio.BucketOptions{}); !isBucketNameInvalid(err) {
+		t.Fatalf("make bucket bkt5: %s", err)
+	}
+	if err = n.MakeBucketWithLocation(ctx, "bkt4", minio.BucketOptions{}); err != nil {
+		t.Fatalf("make bucket bkt4: %s", err)
+	}
+	if bs, err = n.ListBuckets(ctx); err != nil || len(bs) != 2 || bs[1].Name != "bkt4" {
+		t.Fatalf("allowed buckets after creating bkt4: %+v %s", bs, err)
+	}
+}
+
+func putTestObject(t *testing.T, n *jfsObjects, key, contentType string) minio.ObjectInfo {
+	r, err := hash.NewReader(strings.NewReader(key), int64(len(key)), "", "", int64(len(key)), false)
+	if err != nil {
+		t.Fatalf("new reader: %s", err)
+	}
+	info, err := n.PutObject(context.Background(), "test", key, minio.NewPutObjReader(r), minio.ObjectOptions{UserDefined: map[string]string{"content-type": contentType}})
+	if err != nil {
+		t.Fatalf("put %s: %s", key, err)
+	}
+	return info
+}
+
+func TestContentType(t *testing.T) {
+	n := newTestGateway(t)
+	n.defaultType = "application/x-test"
+	ctx := context.Background()
+	cases := []struct {
+		key, uploaded, served string
+	}{
+		{"a.html", "text/plain", "text/plain"},
+		{"b.html", unsetContentType, "text/html; charset=utf-8"},
+		{"c", "", "application/x-test"},
+		{"d.css", "", "text/css; charset=utf-8"},
+	}
+	for _, c := range cases {
+		if info := putTestObject(t, n, c.key, c.uploaded); info.ContentType != c.served {
+			t.Fatalf("put %s: content type %s", c.key, info.ContentType)
+		}
+		if info, err := n.GetObjectInfo(ctx, "test", c.key, minio.ObjectOptions{}); err != nil || info.ContentType != c.served {
+			t.Fatalf("head %s: content type %s %v", c.key, info.ContentType, err)
+		}
+	}
+
+	// set in a mount point
+	if eno := n.fs.SetXattr(mctx, n.path("test", "c"), ContentTypeXattr, []byte("image/png"), 0); eno != 0 {
+		t.Fatalf("setxattr: %s", eno)
+	}
+	info, err := n.GetObjectInfo(ctx, "test", "c", minio.ObjectOptions{})
+	if err != nil || info.ContentType != "image/png" || info.UserDefined["content-type"] != "image/png" {
+		t.Fatalf("head c: %+v %v", info, err)
+	}
+	// uploaded through the gateway
+	if v, eno := n.fs.GetXattr(mctx, n.path("test", "a.html"), ContentTypeXattr); eno != 0 || string(v) != "text/plain" {
+		t.Fatalf("getxattr: %q %s", v, eno)
+	}
+	if _, eno := n.fs.GetXattr(mctx, n.path("test", "b.html"), ContentTypeXattr); eno == 0 {
+		t.Fatalf("the content type should not be kept")
+	}
+
+	// copied with the object
+	if info, err = n.CopyObject(ctx, "test", "c", "test", "e", info, minio.ObjectOptions{}, minio.ObjectOptions{}); err != nil || info.ContentType != "image/png" {
+		t.Fatalf("copy c: %+v %v", info, err)
+	}
+
+	// multipart upload
+	id, err := n.NewMultipartUpload(ctx, "test", "f.bin", minio.ObjectOptions{UserDefined: map[string]string{"content-type": "video/mp4"}})
+	if err != nil {
+		t.Fatalf("new multipart upload: %s", err)
+	}
+	r, _ := hash.NewReader(strings.NewReader("part"), 4, "", "", 4, false)
+	part, err := n.PutObjectPart(ctx, "test", "f.bin", id, 1, minio.NewPutObjReader(r), minio.ObjectOptions{})
+	if err != nil {
+		t.Fatalf("put part: %s", err)
+	}
+	info, err = n.CompleteMultipartUpload(ctx, "test", "f.bin", id, []minio.CompletePart{{PartNumber: 1, ETag: part.ETag}}, minio.ObjectOptions{})
+	if err != nil || info.ContentType != "video/mp4" {
+		t.Fatalf("complete multipart upload: %+v %v", info, err)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	put := func(bucket, key string, metadata map[string]string) {
+		r, _ := hash.NewReader(strings.NewReader(key), int64(len(key)), "", "", int64(len(key)), false)
+		if _, err := n.PutObject(ctx, bucket, key, minio.NewPutObjReader(r), minio.ObjectOptions{UserDefined: metadata}); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	check := func(bucket, key, data string, metadata map[string]string) {
+		var buf bytes.Buffer
+		if err := n.GetObject(ctx, bucket, key, 0, 1<<20, &buf, "", minio.ObjectOptions{}); err != nil || buf.String() != data {
+			t.Fatalf("get %s/%s: %q %v", bucket, key, buf.String(), err)
+		}
+		info, err := n.GetObjectInfo(ctx, bucket, key, minio.ObjectOptions{})
+		if err != nil || !reflect.DeepEqual(info.UserDefined, metadata) {
+			t.Fatalf("metadata of %s/%s: %+v %v", bucket, key, info.UserDefined, err)
+		}
+	}
+	put("test", "src", map[string]string{"content-type": "text/plain", "X-Amz-Meta-Owner": "alice"})
+	src, err := n.GetObjectInfo(ctx, "test", "src", minio.ObjectOptions{})
+	if err != nil {
+		t.Fatalf("head src: %s", err)
+	}
+	check("test", "src", "src", map[string]string{"content-type": "text/plain", "X-Amz-Meta-Owner": "alice"})
+
+	// COPY: the metadata of the source, into a new directory
+	if _, err = n.CopyObject(ctx, "test", "src", "test", "dir/copied", src, minio.ObjectOptions{}, minio.ObjectOptions{}); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	check("test", "dir/copied", "src", map[string]string{"content-type": "text/plain", "X-Amz-Meta-Owner": "alice"})
+
+	// REPLACE: the metadata in the request
+	replaced := src
+	replaced.UserDefined = map[string]string{"content-type": unsetContentType, "X-Amz-Meta-Team": "storage"}
+	info, err := n.CopyObject(ctx, "test", "src", "test", "replaced.png", replaced, minio.ObjectOptions{}, minio.ObjectOptions{})
+	if err != nil || info.ContentType != "image/png" {
+		t.Fatalf("copy with new metadata: %+v %v", info, err)
+	}
+	check("test", "replaced.png", "src", map[string]string{"X-Amz-Meta-Team": "storage"})
+
+	// into itself, only the metadata is replaced
+	if _, err = n.CopyObject(ctx, "test", "src", "test", "src", replaced, minio.ObjectOptions{}, minio.ObjectOptions{}); err != nil {
+		t.Fatalf("copy into itself: %s", err)
+	}
+	check("test", "src", "src", map[string]string{"X-Amz-Meta-Team": "storage"})
+
+	// rename by copying and deleting
+	if _, err = n.CopyObject(ctx, "test", "dir/copied", "test", "renamed", src, minio.ObjectOptions{}, minio.ObjectOptions{}); err != nil {
+		t.Fatalf("copy to rename: %s", err)
+	}
+	if _, err = n.DeleteObject(ctx, "test", "dir/copied", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err = n.GetObjectInfo(ctx, "test", "dir/copied", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("renamed object should not exist")
+	}
+	check("test", "renamed", "src", map[string]string{"content-type": "text/plain", "X-Amz-Meta-Owner": "alice"})
+
+	// across buckets
+	n.multiBucket = true
+	for _, b := range []string{"bkt1", "bkt2"} {
+		if err = n.MakeBucketWithLocation(ctx, b, minio.BucketOptions{}); err != nil {
+			t.Fatalf("make bucket %s: %s", b, err)
+		}
+	}
+	put("bkt1", "obj", map[string]string{"X-Amz-Meta-Owner": "bob"})
+	if src, err = n.GetObjectInfo(ctx, "bkt1", "obj", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("head obj: %s", err)
+	}
+	if _, err = n.CopyObject(ctx, "bkt1", "obj", "bkt2", "a/b/obj", src, minio.ObjectOptions{}, minio.ObjectOptions{}); err != nil {
+		t.Fatalf("copy across buckets: %s", err)
+	}
+	check("bkt2", "a/b/obj", "obj", map[string]string{"X-Amz-Meta-Owner": "bob"})
+	if _, err = n.CopyObject(ctx, "bkt1", "missing", "bkt2", "missing", src, minio.ObjectOptions{}, minio.ObjectOptions{}); err == nil {
+		t.Fatalf("copy of missing object should fail")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	n := newTestGateway(t)
+	n.limits = map[string]Limits{"": {MaxPutSize: 10, MaxObjectSize: 20}, "big": {}}
+	ctx := context.Background()
+	put := func(bucket, key string, size int) error {
+		data := strings.Repeat("x", size)
+		r, _ := hash.NewReader(strings.NewReader(data), int64(size), "", "", int64(size), false)
+		_, err := n.PutObject(ctx, bucket, key, minio.NewPutObjReader(r), minio.ObjectOptions{})
+		return err
+	}
+	if err := put("test", "small", 10); err != nil {
+		t.Fatalf("put small object: %s", err)
+	}
+	if err := put("test", "large", 11); err == nil {
+		t.Fatalf("put an object larger than the max PUT size should fail")
+	} else if _, ok := err.(minio.ObjectTooLarge); !ok {
+		t.Fatalf("expect ObjectTooLarge, but got %T: %s", err, err)
+	}
+	if _, err := n.GetObjectInfo(ctx, "test", "large", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("the rejected object should not exist")
+	}
+	if limit := (Limits{MaxPutSize: 10, MaxObjectSize: 5}).maxPut(); limit != 5 {
+		t.Fatalf("expect the max PUT size limited by the max object size, but got %d", limit)
+	}
+	// the limits of a bucket replace the default ones
+	if l := n.limitsOf("big"); l.MaxPutSize != 0 || l.MaxObjectSize != 0 {
+		t.Fatalf("expect no limit on bucket big, but got %+v", l)
+	}
+
+	upload := func(parts ...int) error {
+		id, err := n.NewMultipartUpload(ctx, "test", "multi", minio.ObjectOptions{})
+		if err != nil {
+			t.Fatalf("new multipart upload: %s", err)
+		}
+		var completed []minio.CompletePart
+		for i, size := range parts {
+			data := strings.Repeat("x", size)
+			r, _ := hash.NewReader(strings.NewReader(data), int64(size), "", "", int64(size), false)
+			part, err := n.PutObjectPart(ctx, "test", "multi", id, i+1, minio.NewPutObjReader(r), minio.ObjectOptions{})
+			if err != nil {
+				return err
+			}
+			completed = append(completed, minio.CompletePart{PartNumber: i + 1, ETag: part.ETag})
+		}
+		if _, err = n.CompleteMultipartUpload(ctx, "test", "multi", id, completed, minio.ObjectOptions{}); err != nil {
+			if err := n.AbortMultipartUpload(ctx, "test", "multi", id, minio.ObjectOptions{}); err != nil {
+				t.Fatalf("abort multipart upload: %s", err)
+			}
+		}
+		return err
+	}
+	if err := upload(10, 10); err != nil {
+		t.Fatalf("complete multipart upload of 20 bytes: %s", err)
+	}
+	if err := upload(10, 10, 1); err == nil {
+		t.Fatalf("complete multipart upload larger than the max object size should fail")
+	} else if _, ok := err.(minio.ObjectTooLarge); !ok {
+		t.Fatalf("expect ObjectTooLarge, but got %T: %s", err, err)
+	}
+	if info, err := n.GetObjectInfo(ctx, "test", "multi", minio.ObjectOptions{}); err != nil || info.Size != 20 {
+		t.Fatalf("expect the object of 20 bytes kept, but got %+v: %v", info, err)
+	}
+	if err := upload(21); err == nil {
+		t.Fatalf("upload a part larger than the max object size should fail")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	def := Limits{MaxPutSize: 5 << 20, MaxObjectSize: 100 << 20}
+	limits, err := ParseLimits("logs:1:10, tmp::0 ,big:0", def)
+	if err != nil {
+		t.Fatalf("parse limits: %s", err)
+	}
+	expected := map[string]Limits{
+		"":     def,
+		"logs": {MaxPutSize: 1 << 20, MaxObjectSize: 10 << 20},
+		"tmp":  {MaxPutSize: 5 << 20},
+		"big":  {MaxObjectSize: 100 << 20},
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Fatalf("expect %+v, but got %+v", expected, limits)
+	}
+	for _, s := range []string{"logs", ":1", "logs:1:2:3", "logs:x", "logs:-1"} {
+		if _, err := ParseLimits(s, def); err == nil {
+			t.Fatalf("parse %q should fail", s)
+		}
+	}
+}
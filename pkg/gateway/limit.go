@@ -0,0 +1,272 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"encoding/xml"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_throttled_requests",
+	Help: "The number of requests rejected by the limits of gateway.",
+}, []string{"limit"})
+
+// LimitConfig is the limits of requests and connections of the gateway, 0 means unlimited.
+type LimitConfig struct {
+	MaxRequests       float64 // requests per second of all the clients
+	MaxRequestsPerKey float64 // requests per second of every access key
+	MaxConnections    int
+}
+
+func (c *LimitConfig) Enabled() bool {
+	return c.MaxRequests > 0 || c.MaxRequestsPerKey > 0 || c.MaxConnections > 0
+}
+
+type connKey struct{}
+
+// Limiter rejects the requests exceeding the limits with "503 SlowDown", as S3 does,
+// so the SDKs will back off and retry.
+type Limiter struct {
+	conf   LimitConfig
+	next   http.Handler
+	global *ratelimit.Bucket
+
+	sync.Mutex
+	keys     map[string]*ratelimit.Bucket
+	conns    map[net.Conn]bool // admitted or not
+	admitted int
+}
+
+func NewLimiter(conf LimitConfig, next http.Handler) *Limiter {
+	l := &Limiter{
+		conf:  conf,
+		next:  next,
+		keys:  make(map[string]*ratelimit.Bucket),
+		conns: make(map[net.Conn]bool),
+	}
+	if conf.MaxRequests > 0 {
+		l.global = newBucket(conf.MaxRequests)
+	}
+	return l
+}
+
+// newBucket allows a burst of requests in one second.
+func newBucket(rate float64) *ratelimit.Bucket {
+	return ratelimit.NewBucketWithRate(rate, int64(math.Ceil(rate)))
+}
+
+func (l *Limiter) InitMetrics() {
+	prometheus.MustRegister(throttledRequests)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gateway_connections",
+		Help: "The number of admitted connections of gateway.",
+	}, func() float64 {
+		l.Lock()
+		defer l.Unlock()
+		return float64(l.admitted)
+	}))
+	if l.conf.MaxConnections > 0 {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_connections_usage",
+			Help: "The ratio of admitted connections to the limit.",
+		}, func() float64 {
+			l.Lock()
+			defer l.Unlock()
+			return float64(l.admitted) / float64(l.conf.MaxConnections)
+		}))
+	}
+	if l.global != nil {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gateway_requests_usage",
+			Help: "The ratio of used tokens in the bucket of global request rate.",
+		}, func() float64 {
+			return bucketUsage(l.global)
+		}))
+	}
+}
+
+func bucketUsage(b *ratelimit.Bucket) float64 {
+	avail := b.Available()
+	if avail < 0 {
+		avail = 0
+	}
+	return 1 - float64(avail)/float64(b.Capacity())
+}
+
+// ConnState should be called by the server to track the connections.
+func (l *Limiter) ConnState(c net.Conn, state http.ConnState) {
+	l.Lock()
+	defer l.Unlock()
+	switch state {
+	case http.StateNew:
+		ok := l.conf.MaxConnections <= 0 || l.admitted < l.conf.MaxConnections
+		l.conns[c] = ok
+		if ok {
+			l.admitted++
+		}
+	case http.StateHijacked, http.StateClosed:
+		if l.conns[c] {
+			l.admitted--
+		}
+		delete(l.conns, c)
+	}
+}
+
+// ConnContext should be called by the server to remember the connection of requests.
+func (l *Limiter) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (l *Limiter) keyBucket(key string) *ratelimit.Bucket {
+	l.Lock()
+	defer l.Unlock()
+	b := l.keys[key]
+	if b == nil {
+		if len(l.keys) >= 10000 {
+			// forget the idle keys, whose buckets are full
+			for k, b := range l.keys {
+				if b.Available() >= b.Capacity() {
+					delete(l.keys, k)
+				}
+			}
+		}
+		b = newBucket(l.conf.MaxRequestsPerKey)
+		l.keys[key] = b
+	}
+	return b
+}
+
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		l.Lock()
+		admitted := l.conns[c]
+		l.Unlock()
+		if !admitted {
+			w.Header().Set("Connection", "close")
+			l.slowDown(w, r, "connections", 1)
+			return
+		}
+	}
+	// an abusive key should not use up the global tokens
+	if l.conf.MaxRequestsPerKey > 0 && l.keyBucket(accessKey(r)).TakeAvailable(1) == 0 {
+		l.slowDown(w, r, "key", l.conf.MaxRequestsPerKey)
+		return
+	}
+	if l.global != nil && l.global.TakeAvailable(1) == 0 {
+		l.slowDown(w, r, "requests", l.conf.MaxRequests)
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func (l *Limiter) slowDown(w http.ResponseWriter, r *http.Request, limit string, rate float64) {
+	throttledRequests.WithLabelValues(limit).Inc()
+	// wait for at least one token
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/rate))))
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(&errorResponse{
+		Code:     "SlowDown",
+		Message:  "Please reduce your request rate.",
+		Resource: r.URL.Path,
+	})
+}
+
+// accessKey finds the access key of a request signed by V4 or V2, or the presigned URL.
+func accessKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		if i := strings.Index(auth, "Credential="); i > 0 {
+			cred := auth[i+len("Credential="):]
+			if j := strings.Index(cred, "/"); j > 0 {
+				return cred[:j]
+			}
+		}
+	case strings.HasPrefix(auth, "AWS "):
+		if i := strings.LastIndex(auth, ":"); i > 4 {
+			return auth[4:i]
+		}
+	}
+	q := r.URL.Query()
+	if cred := q.Get("X-Amz-Credential"); cred != "" {
+		if j := strings.Index(cred, "/"); j > 0 {
+			return cred[:j]
+		}
+	}
+	return q.Get("AWSAccessKeyId")
+}
+
+// ServeWithLimits listens on address and forwards the requests within the limits to a local
+// address, which is returned for the S3 server to listen. The websites (if any) are served
+// with their index and error documents, the responses are compressed if enabled, and the
+// retention of objects is served by lock (if not nil).
+func ServeWithLimits(address string, conf LimitConfig, sites map[string]Website, compress CompressConfig, lock *ObjectLock) (*Limiter, string, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, "", err
+	}
+	// find a free port for the backend
+	bl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = ln.Close()
+		return nil, "", err
+	}
+	backend := bl.Addr().String()
+	_ = bl.Close()
+
+	// the Host header is kept, which is required by the signatures
+	var next http.Handler = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: backend})
+	if lock != nil {
+		next = lock.Handler(next)
+	}
+	if len(sites) > 0 {
+		next = NewWebsiteHandler(sites, next)
+	}
+	if compress.Enabled() {
+		next = NewCompressHandler(compress, next)
+	}
+	l := NewLimiter(conf, next)
+	srv := &http.Server{Handler: l, ConnState: l.ConnState, ConnContext: l.ConnContext}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logger.Fatalf("serve gateway on %s: %s", address, err)
+		}
+	}()
+	logger.Infof("Gateway is listening on %s with limits %+v, websites %+v, compression %+v and object lock %t", address, conf, sites, compress, lock != nil)
+	return l, backend, nil
+}
@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessKey(t *testing.T) {
+	cases := map[string]string{
+		"AWS4-HMAC-SHA256 Credential=AKID/20220101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc": "AKID",
+		"AWS AKID2:c2lnbmF0dXJl": "AKID2",
+		"":                       "",
+	}
+	for auth, key := range cases {
+		r := httptest.NewRequest("GET", "/bucket/key", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if k := accessKey(r); k != key {
+			t.Fatalf("expect key %q from %q, but got %q", key, auth, k)
+		}
+	}
+	r := httptest.NewRequest("GET", "/bucket/key?X-Amz-Credential=AKID3%2F20220101%2Fus-east-1%2Fs3%2Faws4_request", nil)
+	if k := accessKey(r); k != "AKID3" {
+		t.Fatalf("expect key AKID3 from presigned URL, but got %q", k)
+	}
+}
+
+func get(t *testing.T, c *http.Client, url, key string) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "AWS "+key+":c2lnbmF0dXJl")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("get %s: %s", url, err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	return resp
+}
+
+func TestLimiter(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	l := NewLimiter(LimitConfig{MaxRequests: 3, MaxRequestsPerKey: 2}, ok)
+	ts := httptest.NewServer(l)
+	defer ts.Close()
+
+	c := ts.Client()
+	for i := 0; i < 2; i++ {
+		if resp := get(t, c, ts.URL, "a"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d should succeed: %s", i, resp.Status)
+		}
+	}
+	if resp := get(t, c, ts.URL, "a"); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("request should be limited by key: %s", resp.Status)
+	}
+	if resp := get(t, c, ts.URL, "b"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("request of another key should succeed: %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/bucket", nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("request should be limited globally: %s", resp.Status)
+	}
+	var e errorResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&e); err != nil || e.Code != "SlowDown" || e.Resource != "/bucket" {
+		t.Fatalf("unexpected error response: %+v %v", e, err)
+	}
+}
+
+func TestLimitConnections(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	l := NewLimiter(LimitConfig{MaxConnections: 1}, ok)
+	ts := httptest.NewUnstartedServer(l)
+	ts.Config.ConnState = l.ConnState
+	ts.Config.ConnContext = l.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	c1 := &http.Client{Transport: &http.Transport{}}
+	if resp := get(t, c1, ts.URL, "a"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first connection should be admitted: %s", resp.Status)
+	}
+	c2 := &http.Client{Transport: &http.Transport{}}
+	if resp := get(t, c2, ts.URL, "a"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second connection should be rejected: %s", resp.Status)
+	}
+	c1.Transport.(*http.Transport).CloseIdleConnections()
+	c2.Transport.(*http.Transport).CloseIdleConnections()
+}
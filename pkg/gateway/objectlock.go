@@ -0,0 +1,324 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/pkg/s3signer"
+	"github.com/minio/minio-go/pkg/s3utils"
+	minio "github.com/minio/minio/cmd"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	maxClockSkew    = 15 * time.Minute
+	streamingV4     = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+// ObjectLock serves the retention of objects (S3 Object Lock), which is rejected by the S3 server in
+// gateway mode. It handles GET/PUT ?retention, the object-lock headers of PUT and the governance
+// bypass of DELETE, and forwards the other requests. The requests are authenticated here with the
+// credentials of gateway (signature V4 in header only), and a PUT with the object-lock headers is
+// signed again without them before it's forwarded, so the S3 server accepts it.
+type ObjectLock struct {
+	accessKey, secretKey string
+	store                atomic.Value // RetentionStore, set once the object layer is created
+}
+
+func NewObjectLock(accessKey, secretKey string) *ObjectLock {
+	return &ObjectLock{accessKey: accessKey, secretKey: secretKey}
+}
+
+// SetStore sets the store of retention, the requests of object lock fail until it's set.
+func (l *ObjectLock) SetStore(s RetentionStore) {
+	l.store.Store(s)
+}
+
+func (l *ObjectLock) Handler(next http.Handler) http.Handler {
+	return &lockHandler{l, next}
+}
+
+type lockHandler struct {
+	*ObjectLock
+	next http.Handler
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+var (
+	errAccessDenied    = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied."}
+	errSignature       = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errNoSuchKey       = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoRetention     = &apiError{http.StatusNotFound, "NoSuchObjectLockConfiguration", "The specified object does not have a ObjectLock configuration."}
+	errNotInitialized  = &apiError{http.StatusServiceUnavailable, "XMinioServerNotInitialized", "Server not initialized, please try again."}
+	errStreamingLocked = &apiError{http.StatusNotImplemented, "NotImplemented", "The object-lock headers are not supported with the streaming signature."}
+	errLegalHold       = &apiError{http.StatusNotImplemented, "NotImplemented", "Legal hold is not supported."}
+)
+
+func invalidRequest(err error) *apiError {
+	return &apiError{http.StatusBadRequest, "InvalidRequest", err.Error()}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(&errorResponse{Code: e.code, Message: e.message, Resource: r.URL.Path})
+}
+
+func toAPIError(err error) *apiError {
+	switch err.(type) {
+	case minio.PrefixAccessDenied:
+		return errAccessDenied
+	case minio.ObjectNotFound, minio.BucketNotFound, minio.BucketNameInvalid:
+		return errNoSuchKey
+	}
+	return &apiError{http.StatusInternalServerError, "InternalError", err.Error()}
+}
+
+func (h *lockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(ps) < 2 || ps[1] == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	bucket, object := ps[0], ps[1]
+	_, retention := r.URL.Query()["retention"]
+	switch {
+	case retention && (r.Method == http.MethodGet || r.Method == http.MethodPut):
+	case r.Method == http.MethodPut && objectlock.IsObjectLockRequested(r.Header):
+	case r.Method == http.MethodDelete && objectlock.IsObjectLockGovernanceBypassSet(r.Header):
+	default:
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	store, _ := h.store.Load().(RetentionStore)
+	if store == nil {
+		writeError(w, r, errNotInitialized)
+		return
+	}
+	region, e := h.authenticate(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	ctx := r.Context()
+	switch {
+	case retention && r.Method == http.MethodGet:
+		ret, err := store.GetObjectRetention(ctx, bucket, object)
+		if err != nil {
+			writeError(w, r, toAPIError(err))
+			return
+		}
+		if ret == nil {
+			writeError(w, r, errNoRetention)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(xml.Header))
+		_ = xml.NewEncoder(w).Encode(&objectlock.ObjectRetention{
+			XMLNS:           "http://s3.amazonaws.com/doc/2006-03-01/",
+			Mode:            ret.Mode,
+			RetainUntilDate: objectlock.RetentionDate{Time: ret.Until.UTC()},
+		})
+	case retention:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, invalidRequest(err))
+			return
+		}
+		if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != "UNSIGNED-PAYLOAD" {
+			if sum := sha256.Sum256(body); hash != hex.EncodeToString(sum[:]) {
+				writeError(w, r, &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."})
+				return
+			}
+		}
+		ol, err := objectlock.ParseObjectRetention(bytes.NewReader(body))
+		if err != nil {
+			writeError(w, r, &apiError{http.StatusBadRequest, "MalformedXML", err.Error()})
+			return
+		}
+		var ret *Retention
+		if ol.Mode.Valid() {
+			ret = &Retention{ol.Mode, ol.RetainUntilDate.Time}
+		}
+		if err = store.PutObjectRetention(ctx, bucket, object, ret, objectlock.IsObjectLockGovernanceBypassSet(r.Header)); err != nil {
+			writeError(w, r, toAPIError(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		if objectlock.IsObjectLockLegalHoldRequested(r.Header) {
+			writeError(w, r, errLegalHold)
+			return
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") == streamingV4 {
+			writeError(w, r, errStreamingLocked)
+			return
+		}
+		mode, until, err := objectlock.ParseObjectLockRetentionHeaders(r.Header)
+		if err != nil {
+			writeError(w, r, invalidRequest(err))
+			return
+		}
+		r.Header.Del(objectlock.AmzObjectLockMode)
+		r.Header.Del(objectlock.AmzObjectLockRetainUntilDate)
+		h.sign(r, region)
+		iw := &interceptor{header: make(http.Header)}
+		h.next.ServeHTTP(iw, r)
+		if iw.status == 0 {
+			iw.status = http.StatusOK
+		}
+		if iw.status == http.StatusOK {
+			if err = store.PutObjectRetention(ctx, bucket, object, &Retention{mode, until.Time}, false); err != nil {
+				logger.Warnf("set retention of %s/%s: %s", bucket, object, err)
+				writeError(w, r, toAPIError(err))
+				return
+			}
+		}
+		iw.w = w
+		iw.replay()
+	default: // DELETE bypassing the governance retention
+		ret, err := store.GetObjectRetention(ctx, bucket, object)
+		if err == nil && ret.locked(time.Now()) && ret.Mode == objectlock.RetGovernance {
+			if err = store.PutObjectRetention(ctx, bucket, object, nil, true); err != nil {
+				writeError(w, r, toAPIError(err))
+				return
+			}
+		}
+		h.next.ServeHTTP(w, r)
+	}
+}
+
+// authenticate checks the signature V4 in the Authorization header with the credentials of
+// gateway, and returns the region signed with.
+func (h *lockHandler) authenticate(r *http.Request) (string, *apiError) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signV4Algorithm+" ") {
+		return "", errAccessDenied
+	}
+	var cred, signedHeaders, signature string
+	for _, kv := range strings.Split(auth[len(signV4Algorithm)+1:], ",") {
+		kv = strings.TrimSpace(kv)
+		switch {
+		case strings.HasPrefix(kv, "Credential="):
+			cred = kv[len("Credential="):]
+		case strings.HasPrefix(kv, "SignedHeaders="):
+			signedHeaders = kv[len("SignedHeaders="):]
+		case strings.HasPrefix(kv, "Signature="):
+			signature = kv[len("Signature="):]
+		}
+	}
+	scope := strings.Split(cred, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" || signedHeaders == "" {
+		return "", errSignature
+	}
+	if scope[0] != h.accessKey {
+		return "", errAccessDenied
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || t.Format("20060102") != scope[1] {
+		return "", errSignature
+	}
+	if d := time.Since(t); d > maxClockSkew || d < -maxClockSkew {
+		return "", &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	}
+	region := scope[2]
+
+	canonical := strings.Join([]string{
+		r.Method,
+		s3utils.EncodePath(r.URL.Path),
+		strings.Replace(r.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders(r, strings.Split(signedHeaders, ";")),
+		signedHeaders,
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{signV4Algorithm, amzDate, strings.Join(scope[1:], "/"), hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + h.secretKey)
+	for _, s := range scope[1:] {
+		key = hmacSHA256(key, s)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", errSignature
+	}
+	return region, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalHeaders(r *http.Request, names []string) string {
+	sort.Strings(names)
+	var buf strings.Builder
+	for _, name := range names {
+		var vs []string
+		if name == "host" {
+			vs = []string{r.Host}
+		} else {
+			vs = r.Header.Values(name)
+		}
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		for i, v := range vs {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(strings.Join(strings.Fields(v), " "))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// hopHeaders are changed by the proxy, they can't be signed.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Expect", "X-Forwarded-For"}
+
+// sign signs the authenticated request again with the credentials of gateway, after its headers
+// are changed.
+func (h *lockHandler) sign(r *http.Request, region string) {
+	for _, name := range hopHeaders {
+		r.Header.Del(name)
+	}
+	r.Header.Del("Authorization")
+	signed := s3signer.SignV4(*r, h.accessKey, h.secretKey, "", region)
+	r.Header = signed.Header
+}
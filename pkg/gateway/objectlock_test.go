@@ -0,0 +1,200 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/pkg/s3signer"
+	minio "github.com/minio/minio/cmd"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+	"github.com/minio/minio/pkg/hash"
+)
+
+func isAccessDenied(err error) bool {
+	_, ok := err.(minio.PrefixAccessDenied)
+	return ok
+}
+
+func TestObjectRetention(t *testing.T) {
+	n := newTestGateway(t)
+	ctx := context.Background()
+	put := func(key string) error {
+		r, _ := hash.NewReader(strings.NewReader("data"), 4, "", "", 4, false)
+		_, err := n.PutObject(ctx, "test", key, minio.NewPutObjReader(r), minio.ObjectOptions{})
+		return err
+	}
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	n.touch(t, "locked")
+	if err := n.PutObjectRetention(ctx, "test", "locked", &Retention{objectlock.RetCompliance, later}, false); err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	if r, err := n.GetObjectRetention(ctx, "test", "locked"); err != nil || r.Mode != objectlock.RetCompliance || !r.Until.Equal(later) {
+		t.Fatalf("retention: %+v %v", r, err)
+	}
+	if _, err := n.DeleteObject(ctx, "test", "locked", minio.ObjectOptions{}); !isAccessDenied(err) {
+		t.Fatalf("delete a locked object: %v", err)
+	}
+	if err := put("locked"); !isAccessDenied(err) {
+		t.Fatalf("overwrite a locked object: %v", err)
+	}
+	if eno := n.fs.Delete(mctx, n.path("test", "locked")); eno != syscall.EPERM {
+		t.Fatalf("the locked file should be immutable: %v", eno)
+	}
+	// COMPLIANCE can't be shortened, removed or bypassed, only extended
+	if err := n.PutObjectRetention(ctx, "test", "locked", &Retention{objectlock.RetCompliance, later.Add(-time.Minute)}, true); !isAccessDenied(err) {
+		t.Fatalf("shorten compliance retention: %v", err)
+	}
+	if err := n.PutObjectRetention(ctx, "test", "locked", nil, true); !isAccessDenied(err) {
+		t.Fatalf("remove compliance retention: %v", err)
+	}
+	if err := n.PutObjectRetention(ctx, "test", "locked", &Retention{objectlock.RetGovernance, later.Add(time.Hour)}, true); !isAccessDenied(err) {
+		t.Fatalf("change compliance retention to governance: %v", err)
+	}
+	if err := n.PutObjectRetention(ctx, "test", "locked", &Retention{objectlock.RetCompliance, later.Add(time.Hour)}, false); err != nil {
+		t.Fatalf("extend compliance retention: %s", err)
+	}
+	if _, err := n.DeleteObject(ctx, "test", "locked", minio.ObjectOptions{}); !isAccessDenied(err) {
+		t.Fatalf("delete a locked object: %v", err)
+	}
+
+	n.touch(t, "governed")
+	if err := n.PutObjectRetention(ctx, "test", "governed", &Retention{objectlock.RetGovernance, later}, false); err != nil {
+		t.Fatalf("lock: %s", err)
+	}
+	if _, err := n.DeleteObject(ctx, "test", "governed", minio.ObjectOptions{}); !isAccessDenied(err) {
+		t.Fatalf("delete a locked object: %v", err)
+	}
+	if err := n.PutObjectRetention(ctx, "test", "governed", nil, false); !isAccessDenied(err) {
+		t.Fatalf("remove governance retention without bypass: %v", err)
+	}
+	if err := n.PutObjectRetention(ctx, "test", "governed", nil, true); err != nil {
+		t.Fatalf("remove governance retention with bypass: %s", err)
+	}
+	if _, err := n.DeleteObject(ctx, "test", "governed", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("delete an unlocked object: %s", err)
+	}
+
+	// the expired retention doesn't protect the object any more
+	n.touch(t, "expired")
+	p := n.path("test", "expired")
+	past := Retention{objectlock.RetCompliance, time.Now().Add(-time.Minute)}
+	if eno := n.fs.SetXattr(mctx, p, RetentionXattr, []byte(past.String()), 0); eno != 0 {
+		t.Fatalf("set retention: %s", eno)
+	}
+	if eno := n.setImmutable(p, true); eno != 0 {
+		t.Fatalf("set immutable: %s", eno)
+	}
+	if err := put("expired"); err != nil {
+		t.Fatalf("overwrite an expired object: %s", err)
+	}
+	if _, err := n.DeleteObject(ctx, "test", "expired", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("delete an expired object: %s", err)
+	}
+}
+
+func TestObjectLockHandler(t *testing.T) {
+	n := newTestGateway(t)
+	lock := NewObjectLock("admin", "12345678")
+	var forwarded []*http.Request
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r)
+		if r.Method == http.MethodPut {
+			// the S3 server checks the signature again
+			if _, e := (&lockHandler{lock, nil}).authenticate(r); e != nil {
+				t.Fatalf("the forwarded request should be signed: %s", e.code)
+			}
+			n.touch(t, strings.TrimPrefix(r.URL.Path, "/test/"))
+		}
+	})
+	h := lock.Handler(backend)
+	do := func(method, target, body, secret string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://localhost:9000"+target, strings.NewReader(body))
+		sum := sha256.Sum256([]byte(body))
+		r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		r = s3signer.SignV4(*r, "admin", secret, "", "us-east-1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	n.touch(t, "key")
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := fmt.Sprintf("<Retention><Mode>GOVERNANCE</Mode><RetainUntilDate>%s</RetainUntilDate></Retention>", until)
+	if w := do(http.MethodPut, "/test/key?retention", body, "12345678", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("retention without store: %d %s", w.Code, w.Body)
+	}
+	lock.SetStore(n)
+	if w := do(http.MethodPut, "/test/key?retention", body, "wrong-secret", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("put retention with a wrong signature: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPut, "/test/key?retention", body, "12345678", nil); w.Code != http.StatusOK {
+		t.Fatalf("put retention: %d %s", w.Code, w.Body)
+	}
+	w := do(http.MethodGet, "/test/key?retention", "", "12345678", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<Mode>GOVERNANCE</Mode>") || !strings.Contains(w.Body.String(), until) {
+		t.Fatalf("get retention: %d %s", w.Code, w.Body)
+	}
+	if w = do(http.MethodGet, "/test/missing?retention", "", "12345678", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("get retention of missing object: %d %s", w.Code, w.Body)
+	}
+	if len(forwarded) != 0 {
+		t.Fatalf("the requests of retention should not be forwarded")
+	}
+
+	// a plain DELETE is forwarded, and rejected by the object layer
+	do(http.MethodDelete, "/test/key", "", "12345678", nil)
+	if len(forwarded) != 1 {
+		t.Fatalf("DELETE should be forwarded")
+	}
+	if _, err := n.DeleteObject(context.Background(), "test", "key", minio.ObjectOptions{}); !isAccessDenied(err) {
+		t.Fatalf("delete a locked object: %v", err)
+	}
+	do(http.MethodDelete, "/test/key", "", "12345678", map[string]string{objectlock.AmzObjectLockBypassRetGovernance: "true"})
+	if r, _ := n.GetObjectRetention(context.Background(), "test", "key"); r != nil {
+		t.Fatalf("governance retention should be removed by bypass: %+v", r)
+	}
+
+	headers := map[string]string{objectlock.AmzObjectLockMode: "COMPLIANCE", objectlock.AmzObjectLockRetainUntilDate: until}
+	if w = do(http.MethodPut, "/test/new", "data", "12345678", headers); w.Code != http.StatusOK {
+		t.Fatalf("put with object lock: %d %s", w.Code, w.Body)
+	}
+	last := forwarded[len(forwarded)-1]
+	if objectlock.IsObjectLockRequested(last.Header) {
+		t.Fatalf("the object-lock headers should be removed")
+	}
+	if r, _ := n.GetObjectRetention(context.Background(), "test", "new"); r == nil || r.Mode != objectlock.RetCompliance {
+		t.Fatalf("retention of new object: %+v", r)
+	}
+	headers[objectlock.AmzObjectLockLegalHold] = "ON"
+	if w = do(http.MethodPut, "/test/hold", "data", "12345678", headers); w.Code != http.StatusNotImplemented {
+		t.Fatalf("put with legal hold: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"syscall"
+
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/bucket/policy"
+
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+// anonymousActions are the actions could be allowed by a bucket policy, the anonymous
+// requests are evaluated against it, so a bucket could be public readable but never writable.
+var anonymousActions = policy.NewActionSet(
+	policy.GetObjectAction,
+	policy.ListBucketAction,
+	policy.GetBucketLocationAction,
+)
+
+func (n *jfsObjects) policyPath(bucket string) string {
+	return n.tpath(bucket, "policy.json")
+}
+
+func checkPolicy(p *policy.Policy) error {
+	for _, st := range p.Statements {
+		if st.Effect != policy.Allow {
+			continue
+		}
+		for a := range st.Actions {
+			if !anonymousActions.Contains(a) {
+				return policy.Errorf("action %s is not supported, only %s could be allowed", a, anonymousActions)
+			}
+		}
+	}
+	return nil
+}
+
+// SetBucketPolicy saves the policy of bucket in the meta bucket, which is used to evaluate anonymous requests.
+func (n *jfsObjects) SetBucketPolicy(ctx context.Context, bucket string, p *policy.Policy) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if err := checkPolicy(p); err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	name := n.policyPath(bucket)
+	tmp := n.tpath(bucket, "tmp", minio.MustGetUUID())
+	if err = n.mkdirAll(ctx, path.Dir(tmp), 0755); err != nil {
+		return err
+	}
+	f, eno := n.fs.Create(mctx, tmp, 0644)
+	if eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket)
+	}
+	defer func() { _ = n.fs.Delete(mctx, tmp) }()
+	if _, eno = f.Write(mctx, data); eno == 0 {
+		eno = f.Close(mctx)
+	} else {
+		_ = f.Close(mctx)
+	}
+	if eno == 0 {
+		eno = n.fs.Rename(mctx, tmp, name, 0)
+	}
+	return jfsToObjectErr(ctx, eno, bucket)
+}
+
+// GetBucketPolicy returns the policy of bucket, or BucketPolicyNotFound if it's not set.
+func (n *jfsObjects) GetBucketPolicy(ctx context.Context, bucket string) (*policy.Policy, error) {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return nil, err
+	}
+	f, eno := n.fs.Open(mctx, n.policyPath(bucket), vfs.MODE_MASK_R)
+	if eno == syscall.ENOENT {
+		return nil, minio.BucketPolicyNotFound{Bucket: bucket}
+	} else if eno != 0 {
+		return nil, jfsToObjectErr(ctx, eno, bucket)
+	}
+	defer func() { _ = f.Close(mctx) }()
+	fi, _ := f.Stat()
+	data := make([]byte, fi.Size())
+	got, err := f.Pread(mctx, data, 0)
+	if err != nil && err != io.EOF {
+		return nil, jfsToObjectErr(ctx, err, bucket)
+	}
+	return policy.ParseConfig(bytes.NewReader(data[:got]), bucket)
+}
+
+// DeleteBucketPolicy removes the policy of bucket, then only signed requests are allowed.
+func (n *jfsObjects) DeleteBucketPolicy(ctx context.Context, bucket string) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if eno := n.fs.Delete(mctx, n.policyPath(bucket)); eno != 0 && eno != syscall.ENOENT {
+		return jfsToObjectErr(ctx, eno, bucket)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	minio "github.com/minio/minio/cmd"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+)
+
+// RetentionXattr keeps the retention of an object locked through the gateway, in the format of
+// "MODE RETAIN-UNTIL-DATE" (RFC 3339). The file is immutable until the date, so it can't be
+// changed or removed through the mount points either.
+const RetentionXattr = "user.jfs.retention"
+
+// Retention is the object lock of an object, it can't be overwritten or deleted until the date.
+// The GOVERNANCE ones can be removed with x-amz-bypass-governance-retention, but the COMPLIANCE
+// ones can only be extended.
+type Retention struct {
+	Mode  objectlock.RetMode
+	Until time.Time
+}
+
+func (r *Retention) locked(now time.Time) bool {
+	return r != nil && r.Until.After(now)
+}
+
+func (r *Retention) String() string {
+	return fmt.Sprintf("%s %s", r.Mode, r.Until.UTC().Format(time.RFC3339))
+}
+
+func parseRetention(s string) (*Retention, error) {
+	ps := strings.SplitN(s, " ", 2)
+	if len(ps) != 2 {
+		return nil, fmt.Errorf("invalid retention %q", s)
+	}
+	mode := objectlock.RetMode(ps[0])
+	if !mode.Valid() {
+		return nil, fmt.Errorf("invalid mode of retention %q", s)
+	}
+	until, err := time.Parse(time.RFC3339, ps[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid date of retention %q", s)
+	}
+	return &Retention{mode, until}, nil
+}
+
+// RetentionStore keeps the retention of objects, the gateway serves it.
+type RetentionStore interface {
+	GetObjectRetention(ctx context.Context, bucket, object string) (*Retention, error)
+	// PutObjectRetention sets the retention of an object, or removes it if r is nil. The retention
+	// in effect can only be extended, unless it's GOVERNANCE and bypass is set.
+	PutObjectRetention(ctx context.Context, bucket, object string, r *Retention, bypass bool) error
+}
+
+// retention returns the retention of file p, nil if there is none.
+func (n *jfsObjects) retention(p string) *Retention {
+	v, eno := n.fs.GetXattr(mctx, p, RetentionXattr)
+	if eno != 0 {
+		return nil
+	}
+	r, err := parseRetention(string(v))
+	if err != nil {
+		logger.Warnf("retention of %s: %s", p, err)
+		return nil
+	}
+	return r
+}
+
+// setImmutable sets or clears the immutable flag of file p, as root.
+func (n *jfsObjects) setImmutable(p string, on bool) syscall.Errno {
+	f, eno := n.fs.Open(meta.Background, p, 0)
+	if eno != 0 {
+		return eno
+	}
+	defer f.Close(meta.Background)
+	fi, _ := f.Stat()
+	flags := fi.Sys().(*meta.Attr).Flags
+	if on == (flags&meta.FlagImmutable != 0) {
+		return 0
+	}
+	return f.Chattr(meta.Background, flags^meta.FlagImmutable)
+}
+
+func (n *jfsObjects) GetObjectRetention(ctx context.Context, bucket, object string) (*Retention, error) {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return nil, err
+	}
+	p := n.path(bucket, object)
+	if _, eno := n.fs.Stat(mctx, p); eno != 0 {
+		return nil, jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	return n.retention(p), nil
+}
+
+func (n *jfsObjects) PutObjectRetention(ctx context.Context, bucket, object string, r *Retention, bypass bool) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	p := n.path(bucket, object)
+	fi, eno := n.fs.Stat(mctx, p)
+	if eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	if fi.IsDir() {
+		return minio.ObjectNotFound{Bucket: bucket, Object: object}
+	}
+	cur := n.retention(p)
+	if cur.locked(time.Now()) {
+		extended := r != nil && !r.Until.Before(cur.Until)
+		if cur.Mode == objectlock.RetCompliance && (!extended || r.Mode != objectlock.RetCompliance) ||
+			cur.Mode == objectlock.RetGovernance && !extended && !bypass {
+			return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+		}
+	}
+	if eno = n.setImmutable(p, false); eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	if r == nil {
+		if eno = n.fs.RemoveXattr(mctx, p, RetentionXattr); eno != 0 && eno != meta.ENOATTR {
+			return jfsToObjectErr(ctx, eno, bucket, object)
+		}
+		return nil
+	}
+	if eno = n.fs.SetXattr(mctx, p, RetentionXattr, []byte(r.String()), 0); eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	if r.locked(time.Now()) {
+		if eno = n.setImmutable(p, true); eno != 0 {
+			return jfsToObjectErr(ctx, eno, bucket, object)
+		}
+	}
+	return nil
+}
+
+// checkRetention fails with AccessDenied if the object is locked, which should be called before
+// it's overwritten or deleted. The expired retention is removed.
+func (n *jfsObjects) checkRetention(ctx context.Context, bucket, object string) error {
+	p := n.path(bucket, object)
+	r := n.retention(p)
+	if r == nil {
+		return nil
+	}
+	if r.locked(time.Now()) {
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+	}
+	if eno := n.setImmutable(p, false); eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	_ = n.fs.RemoveXattr(mctx, p, RetentionXattr)
+	return nil
+}
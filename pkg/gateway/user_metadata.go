@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UserMetadataXattrPrefix is the prefix of the extended attributes keeping the user-defined
+// metadata (x-amz-meta-*) of the files uploaded through the gateway.
+const UserMetadataXattrPrefix = "user.jfs.meta."
+
+const amzMetaPrefix = "x-amz-meta-"
+
+// userMetadata returns the user-defined metadata kept in file p, with the keys as the headers.
+func (n *jfsObjects) userMetadata(p string) map[string]string {
+	names, eno := n.fs.ListXattr(mctx, p)
+	if eno != 0 {
+		return nil
+	}
+	var metadata map[string]string
+	for _, name := range strings.Split(string(names), "\x00") {
+		if !strings.HasPrefix(name, UserMetadataXattrPrefix) {
+			continue
+		}
+		v, eno := n.fs.GetXattr(mctx, p, name)
+		if eno != 0 {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[http.CanonicalHeaderKey(amzMetaPrefix+name[len(UserMetadataXattrPrefix):])] = string(v)
+	}
+	return metadata
+}
+
+// setUserMetadata keeps the user-defined metadata of an upload into file p, the ones kept in p but
+// not in metadata are removed if replace is true.
+func (n *jfsObjects) setUserMetadata(p string, metadata map[string]string, replace bool) {
+	set := make(map[string]bool)
+	for k, v := range metadata {
+		if !strings.HasPrefix(strings.ToLower(k), amzMetaPrefix) {
+			continue
+		}
+		name := UserMetadataXattrPrefix + strings.ToLower(k[len(amzMetaPrefix):])
+		set[name] = true
+		if eno := n.fs.SetXattr(mctx, p, name, []byte(v), 0); eno != 0 {
+			logger.Warnf("set metadata %s of %s: %s", k, p, eno)
+		}
+	}
+	if !replace {
+		return
+	}
+	for k := range n.userMetadata(p) {
+		name := UserMetadataXattrPrefix + strings.ToLower(k[len(amzMetaPrefix):])
+		if set[name] {
+			continue
+		}
+		if eno := n.fs.RemoveXattr(mctx, p, name); eno != 0 {
+			logger.Warnf("remove metadata %s of %s: %s", k, p, eno)
+		}
+	}
+}
+
+// replaceMetadata replaces the content type and the user-defined metadata kept in file p, for a
+// copy of it into itself.
+func (n *jfsObjects) replaceMetadata(p string, metadata map[string]string) {
+	if t := metadata["content-type"]; t == "" || t == unsetContentType {
+		_ = n.fs.RemoveXattr(mctx, p, ContentTypeXattr)
+	} else {
+		n.setContentType(p, metadata)
+	}
+	n.setUserMetadata(p, metadata, true)
+}
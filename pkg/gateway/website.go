@@ -0,0 +1,187 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Website is the configuration of a bucket served as a static website.
+type Website struct {
+	Index string // the object served for the requests ending in "/"
+	Error string // the object served for the missing objects, empty means the default error
+}
+
+// ParseWebsites parses the websites in the format of "BUCKET[:INDEX[:ERROR]]", separated by comma.
+func ParseWebsites(s string) (map[string]Website, error) {
+	sites := make(map[string]Website)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ps := strings.Split(item, ":")
+		if len(ps) > 3 || ps[0] == "" {
+			return nil, fmt.Errorf("invalid website %q, expect BUCKET[:INDEX[:ERROR]]", item)
+		}
+		site := Website{Index: "index.html"}
+		if len(ps) > 1 && ps[1] != "" {
+			site.Index = ps[1]
+		}
+		if len(ps) > 2 {
+			site.Error = ps[2]
+		}
+		if strings.Contains(site.Index, "/") {
+			return nil, fmt.Errorf("invalid index document %q of bucket %s: should not contain /", site.Index, ps[0])
+		}
+		sites[ps[0]] = site
+	}
+	return sites, nil
+}
+
+// websiteHandler serves the index and error documents for the anonymous GET and HEAD requests
+// to the websites, the requests are still authorized by the bucket policy of the S3 server.
+type websiteHandler struct {
+	sites map[string]Website
+	next  http.Handler
+}
+
+func NewWebsiteHandler(sites map[string]Website, next http.Handler) http.Handler {
+	return &websiteHandler{sites, next}
+}
+
+func isAnonymous(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && accessKey(r) == "" && r.URL.RawQuery == ""
+}
+
+func (h *websiteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || !isAnonymous(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	ps := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	site, ok := h.sites[ps[0]]
+	if !ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	bucket, key := ps[0], ""
+	if len(ps) == 2 {
+		key = ps[1]
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += site.Index
+	} else if path.Ext(key) == "" && h.exists(r, bucket, key+"/"+site.Index) {
+		// a directory without the trailing slash, as S3 does
+		http.Redirect(w, r, "/"+bucket+"/"+ps[1]+"/", http.StatusFound)
+		return
+	}
+
+	iw := &interceptor{w: w, header: make(http.Header)}
+	h.next.ServeHTTP(iw, withPath(r, r.Method, bucket, key))
+	if iw.status != http.StatusNotFound {
+		return
+	}
+	if site.Error != "" {
+		ew := &interceptor{w: w, header: make(http.Header), force: http.StatusNotFound}
+		h.next.ServeHTTP(ew, withPath(r, r.Method, bucket, site.Error))
+		if ew.status == http.StatusOK {
+			return
+		}
+	}
+	iw.replay()
+}
+
+// exists checks whether an object is readable by the anonymous users.
+func (h *websiteHandler) exists(r *http.Request, bucket, key string) bool {
+	sw := &interceptor{header: make(http.Header)}
+	h.next.ServeHTTP(sw, withPath(r, http.MethodHead, bucket, key))
+	return sw.status == http.StatusOK
+}
+
+func withPath(r *http.Request, method, bucket, key string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.Method = method
+	r2.URL.Path = "/" + bucket + "/" + key
+	r2.URL.RawPath = ""
+	r2.RequestURI = ""
+	return r2
+}
+
+// interceptor holds back the "404 Not Found" responses so other documents could be served
+// instead of them, and passes through the others to w (if any).
+type interceptor struct {
+	w      http.ResponseWriter
+	header http.Header
+	status int
+	force  int // if set, only "200 OK" is passed through with this status
+	body   bytes.Buffer
+}
+
+func (i *interceptor) held() bool {
+	return i.w == nil || i.status == http.StatusNotFound || i.force != 0 && i.status != http.StatusOK
+}
+
+func (i *interceptor) Header() http.Header {
+	return i.header
+}
+
+func (i *interceptor) WriteHeader(status int) {
+	if i.status != 0 {
+		return
+	}
+	i.status = status
+	if i.held() {
+		return
+	}
+	for k, v := range i.header {
+		i.w.Header()[k] = v
+	}
+	if i.force != 0 {
+		status = i.force
+	}
+	i.w.WriteHeader(status)
+}
+
+func (i *interceptor) Write(p []byte) (int, error) {
+	if i.status == 0 {
+		i.WriteHeader(http.StatusOK)
+	}
+	if i.held() {
+		return i.body.Write(p)
+	}
+	return i.w.Write(p)
+}
+
+func (i *interceptor) Flush() {
+	if f, ok := i.w.(http.Flusher); ok && !i.held() {
+		f.Flush()
+	}
+}
+
+// replay writes the response held back.
+func (i *interceptor) replay() {
+	for k, v := range i.header {
+		i.w.Header()[k] = v
+	}
+	i.w.WriteHeader(i.status)
+	_, _ = i.w.Write(i.body.Bytes())
+}
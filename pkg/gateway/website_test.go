@@ -0,0 +1,121 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseWebsites(t *testing.T) {
+	sites, err := ParseWebsites("a, b:home.htm, c::404.html,d:idx.html:err.html")
+	if err != nil {
+		t.Fatalf("parse websites: %s", err)
+	}
+	expected := map[string]Website{
+		"a": {Index: "index.html"},
+		"b": {Index: "home.htm"},
+		"c": {Index: "index.html", Error: "404.html"},
+		"d": {Index: "idx.html", Error: "err.html"},
+	}
+	if len(sites) != len(expected) {
+		t.Fatalf("expect %+v but got %+v", expected, sites)
+	}
+	for b, s := range expected {
+		if sites[b] != s {
+			t.Fatalf("expect %+v for bucket %s but got %+v", s, b, sites[b])
+		}
+	}
+	for _, s := range []string{":index.html", "a:b:c:d", "a:x/index.html"} {
+		if _, err := ParseWebsites(s); err == nil {
+			t.Fatalf("website %q should be invalid", s)
+		}
+	}
+}
+
+func TestWebsite(t *testing.T) {
+	objects := map[string]string{
+		"/site/index.html":      "home",
+		"/site/docs/index.html": "docs",
+		"/site/a.html":          "a",
+		"/site/404.html":        "not found",
+		"/plain/index.html":     "plain",
+		"/noerr/index.html":     "noerr",
+	}
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/site/secret.html" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("AccessDenied"))
+			return
+		}
+		data, ok := objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("NoSuchKey"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(data))
+		}
+	})
+	h := NewWebsiteHandler(map[string]Website{
+		"site":  {Index: "index.html", Error: "404.html"},
+		"noerr": {Index: "index.html", Error: "missing.html"},
+	}, backend)
+
+	cases := []struct {
+		method, url string
+		auth        bool
+		status      int
+		body        string
+	}{
+		{"GET", "/site/", false, 200, "home"},
+		{"GET", "/site", false, 200, "home"},
+		{"GET", "/site/docs/", false, 200, "docs"},
+		{"GET", "/site/a.html", false, 200, "a"},
+		{"HEAD", "/site/docs/", false, 200, ""},
+		{"GET", "/site/docs", false, 302, ""},
+		{"GET", "/site/b.html", false, 404, "not found"},
+		{"HEAD", "/site/b.html", false, 404, ""},
+		{"GET", "/site/nodir/", false, 404, "not found"},
+		{"GET", "/site/secret.html", false, 403, "AccessDenied"},
+		{"GET", "/noerr/b.html", false, 404, "NoSuchKey"},
+		{"GET", "/plain/", false, 404, "NoSuchKey"},
+		// S3 API requests are not changed
+		{"GET", "/site/", true, 404, "NoSuchKey"},
+		{"GET", "/site/?list-type=2", false, 404, "NoSuchKey"},
+		{"PUT", "/site/", false, 404, "NoSuchKey"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, nil)
+		if c.auth {
+			r.Header.Set("Authorization", "AWS AKID:c2lnbmF0dXJl")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status || c.status != 302 && w.Body.String() != c.body {
+			t.Fatalf("%s %s: expect %d %q but got %d %q", c.method, c.url, c.status, c.body, w.Code, w.Body.String())
+		}
+		if c.status == 302 && w.Header().Get("Location") != c.url+"/" {
+			t.Fatalf("%s %s: redirect to %s", c.method, c.url, w.Header().Get("Location"))
+		}
+	}
+}
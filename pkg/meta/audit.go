@@ -0,0 +1,422 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	auditEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "audit_events",
+		Help: "The number of audit events written.",
+	})
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "audit_events_dropped",
+		Help: "The number of audit events dropped because the buffer is full or the sink is not writable.",
+	})
+)
+
+// AuditEvent is a record of a single metadata mutation.
+type AuditEvent struct {
+	Time    time.Time
+	Op      string
+	Sid     uint64
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Inode   Ino    `json:",omitempty"`
+	Parent  Ino    `json:",omitempty"`
+	Name    string `json:",omitempty"`
+	Path    string `json:",omitempty"`
+	DstPath string `json:",omitempty"` // target of rename
+	Detail  string `json:",omitempty"`
+
+	dstParent Ino
+	dstName   string
+}
+
+// auditSink is the destination of audit events, it could be a local file (appended),
+// or an external collector specified as tcp://host:port or udp://host:port.
+type auditSink struct {
+	uri      string
+	datagram bool // one event per datagram
+	w        io.WriteCloser
+}
+
+func openAuditSink(uri string) (*auditSink, error) {
+	s := &auditSink{uri: uri, datagram: strings.HasPrefix(uri, "udp://")}
+	return s, s.connect()
+}
+
+func (s *auditSink) connect() error {
+	var err error
+	for _, proto := range []string{"tcp", "udp"} {
+		if strings.HasPrefix(s.uri, proto+"://") {
+			s.w, err = net.DialTimeout(proto, s.uri[len(proto)+3:], time.Second*10)
+			return err
+		}
+	}
+	s.w, err = os.OpenFile(s.uri, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+type auditLog struct {
+	sync.RWMutex
+	closed bool
+	queue  chan *AuditEvent
+	done   chan struct{}
+
+	// lookup returns the parent of a directory and the entries of that parent
+	lookup  func(dir Ino) (Ino, []*Entry)
+	root    Ino
+	dirs    map[Ino]string // paths of directories seen by the writer
+	dropped int64
+
+	sink    *auditSink
+	buf     *bufio.Writer
+	pending int // events in buf
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func newAuditLog(sink *auditSink, buffer int, root Ino, lookup func(Ino) (Ino, []*Entry)) *auditLog {
+	if buffer <= 0 {
+		buffer = 10240
+	}
+	a := &auditLog{
+		queue:  make(chan *AuditEvent, buffer),
+		done:   make(chan struct{}),
+		lookup: lookup,
+		root:   root,
+		dirs:   map[Ino]string{root: "/"},
+		sink:   sink,
+	}
+	go a.run()
+	return a
+}
+
+// log never blocks the caller, events are dropped when the buffer is full or the log is closed.
+func (a *auditLog) log(e *AuditEvent) {
+	a.RLock()
+	defer a.RUnlock()
+	if a.closed {
+		auditDropped.Inc()
+		return
+	}
+	select {
+	case a.queue <- e:
+	default:
+		if atomic.AddInt64(&a.dropped, 1) == 1 {
+			logger.Warnf("audit log is overloaded, dropping events")
+		}
+		auditDropped.Inc()
+	}
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+	for e := range a.queue {
+		// record the gap in the log itself so the trail is never silently incomplete
+		if n := atomic.SwapInt64(&a.dropped, 0); n > 0 {
+			logger.Warnf("audit log dropped %d events", n)
+			if !a.write(&AuditEvent{Time: time.Now(), Op: "dropped", Detail: fmt.Sprintf("%d events", n)}) {
+				atomic.AddInt64(&a.dropped, n)
+			}
+		}
+		a.fillPath(e)
+		if !a.write(e) {
+			a.lost(1)
+		}
+		if len(a.queue) == 0 {
+			a.flush()
+		}
+	}
+	a.flush()
+}
+
+func (a *auditLog) lost(n int) {
+	atomic.AddInt64(&a.dropped, int64(n))
+	auditDropped.Add(float64(n))
+}
+
+// write sends an event to the sink, it's buffered unless the sink is datagram based.
+func (a *auditLog) write(e *AuditEvent) bool {
+	if a.sink.w == nil && !a.reconnect() {
+		return false
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("encode audit event: %s", err)
+		return false
+	}
+	data = append(data, '\n')
+	if a.sink.datagram {
+		if _, err = a.sink.w.Write(data); err != nil {
+			a.fail(err)
+			return false
+		}
+		auditEvents.Inc()
+		return true
+	}
+	if a.buf == nil {
+		a.buf = bufio.NewWriterSize(a.sink.w, 64<<10)
+	}
+	if a.buf.Available() < len(data) {
+		if a.flush(); a.sink.w == nil {
+			return false
+		}
+	}
+	if _, err = a.buf.Write(data); err != nil {
+		a.fail(err)
+		return false
+	}
+	a.pending++
+	return true
+}
+
+func (a *auditLog) flush() {
+	if a.pending == 0 {
+		return
+	}
+	if err := a.buf.Flush(); err != nil {
+		a.fail(err)
+		return
+	}
+	auditEvents.Add(float64(a.pending))
+	a.pending = 0
+}
+
+// fail closes the broken sink, the buffered events are lost.
+func (a *auditLog) fail(err error) {
+	logger.Errorf("write audit log: %s", err)
+	a.lost(a.pending)
+	a.pending = 0
+	a.buf = nil
+	_ = a.sink.w.Close()
+	a.sink.w = nil
+	a.delay()
+}
+
+func (a *auditLog) delay() {
+	if a.backoff == 0 {
+		a.backoff = time.Second
+	} else if a.backoff < time.Minute {
+		a.backoff *= 2
+	}
+	a.retryAt = time.Now().Add(a.backoff)
+}
+
+func (a *auditLog) reconnect() bool {
+	if time.Now().Before(a.retryAt) {
+		return false
+	}
+	if err := a.sink.connect(); err != nil {
+		logger.Warnf("reconnect audit log %s: %s", a.sink.uri, err)
+		a.sink.w = nil
+		a.delay()
+		return false
+	}
+	logger.Infof("audit log %s is reconnected", a.sink.uri)
+	a.backoff = 0
+	return true
+}
+
+// dirPath finds the path of a directory, the names of all the sub-directories of a parent
+// are cached when it's scanned, so every parent is scanned only once.
+func (a *auditLog) dirPath(dir Ino) string {
+	if p, ok := a.dirs[dir]; ok {
+		return p
+	}
+	if a.lookup == nil || dir == 1 {
+		return ""
+	}
+	parent, entries := a.lookup(dir)
+	if parent == 0 || parent == dir {
+		return ""
+	}
+	pp := a.dirPath(parent)
+	if pp == "" {
+		return ""
+	}
+	if len(a.dirs) > 100000 {
+		a.dirs = map[Ino]string{a.root: "/", parent: pp}
+	}
+	for _, e := range entries {
+		if e.Attr != nil && e.Attr.Typ == TypeDirectory {
+			a.dirs[e.Inode] = path.Join(pp, string(e.Name))
+		}
+	}
+	return a.dirs[dir]
+}
+
+// fillPath builds the paths of an event. Events are handled in order, so the paths of
+// directories are tracked from mkdir/rename/rmdir events, before they could be removed.
+// Changes made by other clients are not tracked, the path could be stale in that case.
+func (a *auditLog) fillPath(e *AuditEvent) {
+	if e.Parent > 0 {
+		if p := a.dirPath(e.Parent); p != "" {
+			e.Path = path.Join(p, e.Name)
+		}
+	}
+	if e.dstParent > 0 {
+		if p := a.dirPath(e.dstParent); p != "" {
+			e.DstPath = path.Join(p, e.dstName)
+		}
+	}
+	switch e.Op {
+	case "mkdir":
+		if e.Path != "" {
+			a.dirs[e.Inode] = e.Path
+		}
+	case "rmdir":
+		delete(a.dirs, e.Inode)
+	case "rename":
+		if _, ok := a.dirs[e.Inode]; ok {
+			// paths of all the sub-directories are changed
+			a.dirs = map[Ino]string{a.root: "/"}
+			if e.DstPath != "" {
+				a.dirs[e.Inode] = e.DstPath
+			}
+		}
+	}
+}
+
+// close flushes the pending events, the events logged after that are dropped.
+func (a *auditLog) close() {
+	a.Lock()
+	if a.closed {
+		a.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	a.Unlock()
+	<-a.done
+	if a.sink.w != nil {
+		_ = a.sink.w.Close()
+	}
+}
+
+func (m *baseMeta) openAuditLog() error {
+	if m.conf.AuditLog == "" || m.audit != nil {
+		return nil
+	}
+	sink, err := openAuditSink(m.conf.AuditLog)
+	if err != nil {
+		return err
+	}
+	_ = prometheus.Register(auditEvents)
+	_ = prometheus.Register(auditDropped)
+	m.audit = newAuditLog(sink, m.conf.AuditBuffer, m.root, m.auditDir)
+	logger.Infof("Audit log is written into %s", m.conf.AuditLog)
+	return nil
+}
+
+// auditDir returns the parent of a directory with its entries, it's called by the background writer.
+func (m *baseMeta) auditDir(dir Ino) (Ino, []*Entry) {
+	var attr Attr
+	if st := m.en.doGetAttr(Background, dir, &attr); st != 0 {
+		return 0, nil
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(Background, attr.Parent, 0, &entries); st != 0 {
+		return 0, nil
+	}
+	return attr.Parent, entries
+}
+
+func (m *baseMeta) auditEvent(ctx Context, op string, parent Ino, name string, inode Ino, detail string) {
+	if m.audit == nil {
+		return
+	}
+	m.audit.log(&AuditEvent{
+		Time:   time.Now(),
+		Op:     op,
+		Sid:    m.sid,
+		Uid:    ctx.Uid(),
+		Gid:    ctx.Gid(),
+		Pid:    ctx.Pid(),
+		Inode:  inode,
+		Parent: parent,
+		Name:   name,
+		Detail: detail,
+	})
+}
+
+func (m *baseMeta) auditRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode Ino) {
+	if m.audit == nil {
+		return
+	}
+	m.audit.log(&AuditEvent{
+		Time:      time.Now(),
+		Op:        "rename",
+		Sid:       m.sid,
+		Uid:       ctx.Uid(),
+		Gid:       ctx.Gid(),
+		Pid:       ctx.Pid(),
+		Inode:     inode,
+		Parent:    parentSrc,
+		Name:      nameSrc,
+		dstParent: parentDst,
+		dstName:   nameDst,
+	})
+}
+
+func (m *baseMeta) auditSetAttr(ctx Context, inode Ino, set uint16, attr *Attr) {
+	if m.audit == nil {
+		return
+	}
+	var ops []string
+	if set&SetAttrMode != 0 {
+		ops = append(ops, fmt.Sprintf("mode=%o", attr.Mode))
+	}
+	if set&(SetAttrUID|SetAttrGID) != 0 {
+		ops = append(ops, fmt.Sprintf("owner=%d:%d", attr.Uid, attr.Gid))
+	}
+	op := "setattr"
+	switch {
+	case set == SetAttrMode:
+		op = "chmod"
+	case set&^(SetAttrUID|SetAttrGID) == 0:
+		op = "chown"
+	case set&(SetAttrAtime|SetAttrMtime|SetAttrAtimeNow|SetAttrMtimeNow) != 0:
+		ops = append(ops, fmt.Sprintf("atime=%d mtime=%d", attr.Atime, attr.Mtime))
+	}
+	m.auditEvent(ctx, op, 0, "", inode, strings.Join(ops, " "))
+}
+
+// auditLookup finds the inode of an entry before it's removed, only if audit log or journal is enabled.
+func (m *baseMeta) auditLookup(ctx Context, parent Ino, name string) Ino {
+	var inode Ino
+	if m.audit != nil || m.journalEnabled() {
+		_ = m.en.doLookup(ctx, parent, name, &inode, nil)
+	}
+	return inode
+}
@@ -0,0 +1,258 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockedWriter struct {
+	*os.File
+	ready chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.ready
+	return w.File.Write(p)
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+func (brokenWriter) Close() error                { return nil }
+
+func readEvents(t *testing.T, path string) []AuditEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open audit log: %s", err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid event %q: %s", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := openAuditSink(path)
+	if err != nil {
+		t.Fatalf("open sink: %s", err)
+	}
+	var lookups int
+	lookup := func(dir Ino) (Ino, []*Entry) {
+		lookups++
+		return 1, []*Entry{
+			{Inode: 2, Name: []byte("d"), Attr: &Attr{Typ: TypeDirectory}},
+			{Inode: 4, Name: []byte("e"), Attr: &Attr{Typ: TypeDirectory}},
+			{Inode: 5, Name: []byte("x"), Attr: &Attr{Typ: TypeFile}},
+		}
+	}
+	a := newAuditLog(sink, 10, 1, lookup)
+	a.log(&AuditEvent{Time: time.Now(), Op: "create", Uid: 1, Gid: 2, Inode: 3, Parent: 2, Name: "f"})
+	a.log(&AuditEvent{Time: time.Now(), Op: "rename", Inode: 3, Parent: 2, Name: "f", dstParent: 4, dstName: "g"})
+	a.close()
+	a.log(&AuditEvent{Time: time.Now(), Op: "unlink", Inode: 3, Parent: 4, Name: "g"}) // dropped
+
+	events := readEvents(t, path)
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, but got %d", len(events))
+	}
+	if lookups != 1 {
+		t.Fatalf("parent should be scanned once, but got %d", lookups)
+	}
+	if e := events[0]; e.Op != "create" || e.Uid != 1 || e.Gid != 2 || e.Inode != 3 || e.Path != "/d/f" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	if e := events[1]; e.Op != "rename" || e.Path != "/d/f" || e.DstPath != "/e/g" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
+
+func TestAuditLogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen udp: %s", err)
+	}
+	defer conn.Close()
+	sink, err := openAuditSink("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("open sink: %s", err)
+	}
+	a := newAuditLog(sink, 10, 1, nil)
+	for i := 0; i < 3; i++ {
+		a.log(&AuditEvent{Time: time.Now(), Op: "setxattr", Inode: Ino(i + 2), Detail: strings.Repeat("x", 30000)})
+	}
+	a.close()
+
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < 3; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read datagram: %s", err)
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(buf[:n], &e); err != nil {
+			t.Fatalf("datagram %d is not a single event: %s", i, err)
+		}
+		if e.Inode != Ino(i+2) {
+			t.Fatalf("unexpected event: %d", e.Inode)
+		}
+	}
+}
+
+func TestAuditLogReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a := newAuditLog(&auditSink{uri: path, w: brokenWriter{}}, 10, 1, nil)
+	a.log(&AuditEvent{Time: time.Now(), Op: "unlink", Inode: 2})
+	time.Sleep(time.Millisecond * 1100) // backoff
+	a.log(&AuditEvent{Time: time.Now(), Op: "unlink", Inode: 3})
+	a.close()
+
+	events := readEvents(t, path)
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, but got %d", len(events))
+	}
+	if e := events[0]; e.Op != "dropped" || e.Detail != "1 events" {
+		t.Fatalf("lost events are not recorded: %+v", e)
+	}
+	if e := events[1]; e.Inode != 3 {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
+
+func TestAuditLogOverload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	w := &blockedWriter{f, make(chan struct{})}
+	a := newAuditLog(&auditSink{w: w}, 1, 1, nil)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		a.log(&AuditEvent{Time: time.Now(), Op: "unlink", Inode: Ino(i + 2)})
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("logging should not block")
+	}
+	close(w.ready)
+	a.log(&AuditEvent{Time: time.Now(), Op: "unlink", Inode: 1000})
+	a.close()
+
+	var dropped bool
+	for _, e := range readEvents(t, path) {
+		if e.Op == "dropped" {
+			dropped = true
+		}
+	}
+	if !dropped {
+		t.Fatalf("dropped events are not recorded")
+	}
+}
+
+func testAuditLog(t *testing.T, m Meta) {
+	var base *baseMeta
+	switch m := m.(type) {
+	case *redisMeta:
+		base = &m.baseMeta
+	case *dbMeta:
+		base = &m.baseMeta
+	case *kvMeta:
+		base = &m.baseMeta
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	base.conf.AuditLog = path
+	if err := base.openAuditLog(); err != nil {
+		t.Fatalf("open audit log: %s", err)
+	}
+	ctx := NewContext(100, 1, []uint32{2})
+	var parent, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(Background, 1, "ad", 0777, 022, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir ad: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create ad/f: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("chmod ad/f: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 100, attr); st != 0 {
+		t.Fatalf("truncate ad/f: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, "user.a", []byte("v"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr ad/f: %s", st)
+	}
+	if st := m.Rename(ctx, parent, "f", parent, "g", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename ad/f: %s", st)
+	}
+	if st := m.Unlink(ctx, parent, "g"); st != 0 {
+		t.Fatalf("unlink ad/g: %s", st)
+	}
+	if st := m.Rmdir(Background, 1, "ad"); st != 0 {
+		t.Fatalf("rmdir ad: %s", st)
+	}
+	base.audit.close()
+	base.conf.AuditLog = ""
+
+	events := readEvents(t, path)
+	var ops []string
+	for _, e := range events {
+		ops = append(ops, e.Op)
+	}
+	if len(events) != 8 {
+		t.Fatalf("unexpected events: %v", ops)
+	}
+	if e := events[1]; e.Op != "create" || e.Uid != 1 || e.Gid != 2 || e.Pid != 100 || e.Inode != inode || e.Path != "/ad/f" {
+		t.Fatalf("unexpected create event: %+v", e)
+	}
+	if e := events[2]; e.Op != "chmod" || e.Detail != "mode=600" {
+		t.Fatalf("unexpected chmod event: %+v", e)
+	}
+	if e := events[3]; e.Op != "setattr" || e.Detail != "size=100" {
+		t.Fatalf("unexpected truncate event: %+v", e)
+	}
+	if e := events[4]; e.Op != "setxattr" || e.Detail != "name=user.a" {
+		t.Fatalf("unexpected setxattr event: %+v", e)
+	}
+	if e := events[5]; e.Op != "rename" || e.Path != "/ad/f" || e.DstPath != "/ad/g" {
+		t.Fatalf("unexpected rename event: %+v", e)
+	}
+	if e := events[6]; e.Op != "unlink" || e.Inode != inode || e.Path != "/ad/g" {
+		t.Fatalf("unexpected unlink event: %+v", e)
+	}
+	if e := events[7]; e.Op != "rmdir" || e.Inode != parent || e.Path != "/ad" {
+		t.Fatalf("unexpected rmdir event: %+v", e)
+	}
+}
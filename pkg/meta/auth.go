@@ -0,0 +1,208 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	awsSession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+)
+
+// connOptions are the options of meta connection in the query of meta URL, which are removed
+// before the URL is passed to the driver.
+type connOptions struct {
+	caFile   string        // tls-ca-cert-file
+	certFile string        // tls-cert-file
+	keyFile  string        // tls-key-file
+	insecure bool          // insecure-skip-verify
+	auth     string        // auth, the provider of tokens used as password
+	refresh  time.Duration // auth-refresh
+}
+
+func parseConnOptions(query url.Values) (*connOptions, error) {
+	o := &connOptions{
+		caFile:   query.Get("tls-ca-cert-file"),
+		certFile: query.Get("tls-cert-file"),
+		keyFile:  query.Get("tls-key-file"),
+		auth:     query.Get("auth"),
+		refresh:  time.Minute * 5,
+	}
+	if v := query.Get("insecure-skip-verify"); v != "" {
+		o.insecure = v == "true" || v == "1"
+	}
+	if v := query.Get("auth-refresh"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid auth-refresh %q", v)
+		}
+		o.refresh = d
+	}
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, fmt.Errorf("tls-cert-file and tls-key-file should be used together")
+	}
+	for _, k := range []string{"tls-ca-cert-file", "tls-cert-file", "tls-key-file", "insecure-skip-verify", "auth", "auth-refresh"} {
+		query.Del(k)
+	}
+	return o, nil
+}
+
+func (o *connOptions) useTLS() bool {
+	return o.caFile != "" || o.certFile != "" || o.insecure
+}
+
+func (o *connOptions) tlsConfig(serverName string) (*tls.Config, error) {
+	c := &tls.Config{ServerName: serverName, InsecureSkipVerify: o.insecure}
+	if o.caFile != "" {
+		data, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA: %s", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid certificate in %s", o.caFile)
+		}
+	}
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// tokenProvider returns a short-lived token, which is used as the password of the connection.
+type tokenProvider func() (string, error)
+
+// tokenCreator creates a token provider for the user connecting to addr (host:port),
+// arg is the part after colon in the `auth` option.
+type tokenCreator func(arg, addr, user string) (tokenProvider, error)
+
+var tokenProviders = make(map[string]tokenCreator)
+
+// registerToken registers a provider of tokens, which can be used by `auth=name[:arg]` in meta URL.
+func registerToken(name string, creator tokenCreator) {
+	tokenProviders[name] = creator
+}
+
+func init() {
+	// the token is written into a file by other tools, read it again in every refresh
+	registerToken("file", func(path, addr, user string) (tokenProvider, error) {
+		if path == "" {
+			return nil, fmt.Errorf("path of token file is required: auth=file:PATH")
+		}
+		return func() (string, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(data)), nil
+		}, nil
+	})
+	// IAM authentication of Amazon RDS, which is valid for 15 minutes
+	registerToken("aws-iam", func(region, addr, user string) (tokenProvider, error) {
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			return nil, fmt.Errorf("region is required: auth=aws-iam:REGION")
+		}
+		sess, err := awsSession.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return func() (string, error) {
+			return rdsutils.BuildAuthToken(addr, region, user, sess.Config.Credentials)
+		}, nil
+	})
+}
+
+// tokenRefresher keeps the latest token, which is refreshed in background.
+type tokenRefresher struct {
+	sync.Mutex
+	token string
+	get   tokenProvider
+	done  chan struct{}
+}
+
+func newTokenRefresher(o *connOptions, addr, user string) (*tokenRefresher, error) {
+	name, arg := o.auth, ""
+	if p := strings.Index(name, ":"); p > 0 {
+		name, arg = name[:p], name[p+1:]
+	}
+	creator, ok := tokenProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown auth %q", name)
+	}
+	get, err := creator(arg, addr, user)
+	if err != nil {
+		return nil, fmt.Errorf("auth %s: %s", name, err)
+	}
+	token, err := get()
+	if err != nil {
+		return nil, fmt.Errorf("auth %s: get token: %s", name, err)
+	}
+	r := &tokenRefresher{token: token, get: get, done: make(chan struct{})}
+	go r.refresh(o.refresh)
+	return r, nil
+}
+
+// refresh updates the token periodically, the established connections are not affected,
+// and the new connections will use the latest one.
+func (r *tokenRefresher) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		token, err := r.get()
+		if err != nil {
+			logger.Warnf("Refresh token for meta: %s", err)
+			continue
+		}
+		r.Lock()
+		r.token = token
+		r.Unlock()
+	}
+}
+
+func (r *tokenRefresher) current() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.token
+}
+
+func (r *tokenRefresher) Close() error {
+	close(r.done)
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//nolint:errcheck
+package meta
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// writeCert creates a certificate signed by parent (self-signed if nil), and writes it into dir.
+func writeCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	_ = ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	return &testCert{cert, key}
+}
+
+// mockRedis is a Redis server over TLS, which requires client certificate and a password.
+type mockRedis struct {
+	sync.Mutex
+	ln       net.Listener
+	password string
+	conns    map[net.Conn]bool
+	auths    int
+}
+
+func newMockRedis(t *testing.T, dir string, password string) *mockRedis {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatalf("load server cert: %s", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(data)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	s := &mockRedis{ln: ln, password: password, conns: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns[conn] = true
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(s.close)
+	return s
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("invalid command: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (s *mockRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var authed bool
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			s.Lock()
+			s.auths++
+			authed = args[len(args)-1] == s.password
+			s.Unlock()
+			if authed {
+				reply = "+OK"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required."
+		case cmd == "SELECT":
+			reply = "+OK"
+		case cmd == "PING":
+			reply = "+PONG"
+		default:
+			reply = "-ERR unknown command"
+		}
+		if _, err = conn.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+// rotate changes the password and closes all the established connections.
+func (s *mockRedis) rotate(password string) {
+	s.Lock()
+	defer s.Unlock()
+	s.password = password
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+}
+
+func (s *mockRedis) close() {
+	s.ln.Close()
+	s.rotate("")
+}
+
+func TestRedisTLSAndToken(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", ca)
+	writeCert(t, dir, "client", ca)
+	tokenFile := filepath.Join(dir, "token")
+	_ = ioutil.WriteFile(tokenFile, []byte("token1\n"), 0600)
+	s := newMockRedis(t, dir, "token1")
+
+	connect := func(query string) (*redis.Client, error) {
+		opt, tokens, err := parseRedisURL(fmt.Sprintf("rediss://%s/2?%s", s.ln.Addr(), query))
+		if err != nil {
+			return nil, err
+		}
+		if tokens != nil {
+			t.Cleanup(func() { tokens.Close() })
+		}
+		opt.MaxRetries = 3
+		opt.MinRetryBackoff = time.Millisecond * 10
+		client := redis.NewClient(opt)
+		t.Cleanup(func() { client.Close() })
+		return client, client.Ping(context.Background()).Err()
+	}
+	tlsQuery := fmt.Sprintf("tls-ca-cert-file=%s&tls-cert-file=%s&tls-key-file=%s",
+		filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	auth := "auth=file:" + tokenFile + "&auth-refresh=50ms"
+
+	if _, err := connect(auth); err == nil {
+		t.Fatalf("should fail without the CA")
+	}
+	if _, err := connect(fmt.Sprintf("tls-ca-cert-file=%s&%s", filepath.Join(dir, "ca.crt"), auth)); err == nil {
+		t.Fatalf("should fail without the client certificate")
+	}
+	if _, err := connect(tlsQuery); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Fatalf("should fail without token: %v", err)
+	}
+	if _, err := connect("tls-cert-file=" + filepath.Join(dir, "client.crt")); err == nil {
+		t.Fatalf("tls-cert-file should be used with tls-key-file")
+	}
+	if _, _, err := parseRedisURL(fmt.Sprintf("redis://%s/2?%s", s.ln.Addr(), tlsQuery)); err == nil {
+		t.Fatalf("TLS options should require rediss://")
+	}
+	if _, _, err := parseRedisURL(fmt.Sprintf("rediss://%s/2?auth=unknown", s.ln.Addr())); err == nil {
+		t.Fatalf("unknown auth should fail")
+	}
+
+	client, err := connect(tlsQuery + "&" + auth)
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	s.Lock()
+	auths := s.auths
+	s.Unlock()
+	// the token is refreshed in background, and the old connections are dropped by server
+	_ = ioutil.WriteFile(tokenFile, []byte("token2\n"), 0600)
+	time.Sleep(time.Millisecond * 200)
+	s.rotate("token2")
+	for i := 0; i < 10; i++ {
+		if err = client.Ping(context.Background()).Err(); err != nil {
+			t.Fatalf("ping after token refreshed: %s", err)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.auths == auths {
+		t.Fatalf("the new connection should be authenticated again")
+	}
+}
+
+func TestSplitConnOptions(t *testing.T) {
+	cases := []struct{ dsn, expected string }{
+		{"root:pass@(127.0.0.1:3306)/juicefs", "root:pass@(127.0.0.1:3306)/juicefs"},
+		{"root:pass@(127.0.0.1:3306)/juicefs?charset=utf8", "root:pass@(127.0.0.1:3306)/juicefs?charset=utf8"},
+		{"root:a?b@(127.0.0.1:3306)/juicefs?auth=file:/tmp/token", "root:a?b@(127.0.0.1:3306)/juicefs"},
+		{"postgres://root@127.0.0.1/juicefs?sslmode=verify-ca&tls-ca-cert-file=/ca", "postgres://root@127.0.0.1/juicefs?sslmode=verify-ca"},
+	}
+	for _, c := range cases {
+		dsn, co, err := splitConnOptions(c.dsn)
+		if err != nil || dsn != c.expected {
+			t.Fatalf("split %s: expected %s, but got %s (%v)", c.dsn, c.expected, dsn, err)
+		}
+		if (co == nil) != (dsn == c.dsn) {
+			t.Fatalf("options of %s: %+v", c.dsn, co)
+		}
+	}
+	if _, err := newEngineWithOptions("sqlite3", "/tmp/test.db", &connOptions{auth: "file:/tmp/token"}); err == nil {
+		t.Fatalf("auth should not be supported by sqlite3")
+	}
+}
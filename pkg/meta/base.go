@@ -17,8 +17,11 @@
 package meta
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
 	"runtime"
 	"sort"
 	"strings"
@@ -28,6 +31,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juju/ratelimit"
 )
 
 const (
@@ -41,17 +45,28 @@ type engine interface {
 	setIfSmall(name string, value, diff int64) (bool, error)
 
 	doLoad() ([]byte, error)
+	// ping the engine, and return the warnings specific to it
+	doCheckHealth() ([]string, error)
 
 	doNewSession(sinfo []byte) error
-	doRefreshSession()
+	doRefreshSession(sinfo []byte)
 	doFindStaleSessions(ts int64, limit int) ([]uint64, error) // limit < 0 means all
 	doCleanStaleSession(sid uint64)
+	GetSession(sid uint64) (*Session, error)
 
 	doDeleteSustainedInode(sid uint64, inode Ino) error
 	doFindDeletedFiles(ts int64, limit int) (map[Ino]uint64, error) // limit < 0 means all
 	doDeleteFileData(inode Ino, length uint64)
 	doCleanupSlices()
 	doDeleteSlice(chunkid uint64, size uint32) error
+	doSetSliceChecksums(chunkid uint64, sums []byte) error
+	doGetSliceChecksums(chunkid uint64) ([]byte, error) // nil if not stored
+	doSetSliceData(chunkid uint64, data []byte) error
+	doGetSliceData(chunkid uint64) ([]byte, error) // nil if not stored
+	// allocates the sequence numbers of n records and appends them in one transaction, returns the last one
+	doAppendJournal(n int, encode func(first uint64) ([][]byte, error)) (uint64, error)
+	doReadJournal(since uint64, limit int) ([][]byte, error) // the records after since, in order
+	doTrimJournal(before uint64) error
 
 	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
@@ -61,9 +76,30 @@ type engine interface {
 	doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 	doReadlink(ctx Context, inode Ino) ([]byte, error)
 	doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno
+	doReaddirPage(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno)
 	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno
-	GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
-	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
+	doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno
+	doTruncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno
+	doFallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno
+	doGetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
+	doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
+	doCompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno
+	doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno
+	// read the slices of a chunk from the engine, bypassing the cache of open files
+	doRead(ctx Context, inode Ino, indx uint32) ([]*slice, syscall.Errno)
+	// compact the slices of a chunk, skip the large ones at the beginning unless whole is true,
+	// and schedule another round if there are still too many slices unless whole is true
+	compactChunk(inode Ino, indx uint32, whole, force bool) syscall.Errno
+
+	// link inode into parent as name, with the new nlink in attr, without checking it's orphaned
+	doReparent(ctx Context, parent Ino, name string, inode Ino, attr *Attr) syscall.Errno
+	// count the subdirectories of directory inode and set its nlink to 2 plus them in one transaction,
+	// the nlink before is returned in old
+	doFixNlink(ctx Context, inode Ino, old, nlink *uint32) syscall.Errno
+	scanAllEntries(ctx Context, scan func(parent Ino, name string, typ uint8, inode Ino)) error
+	scanAllInodes(ctx Context, scan func(inode Ino, attr *Attr)) error
+	scanAllXattrs(ctx Context, scan func(inode Ino, name string, value []byte)) error
 }
 
 type baseMeta struct {
@@ -85,22 +121,53 @@ type baseMeta struct {
 	usedSpace    int64
 	usedInodes   int64
 	umounting    bool
+	audit        *auditLog
+	journal      *journal
+	slow         *slowLog
+	sinfo        *SessionInfo
+	ops          int64        // number of operations since the last heartbeat
+	heartbeat    time.Time    // time of the last heartbeat
+	opsLimiter   atomic.Value // *ratelimit.Bucket, nil if not throttled
 
 	freeMu     sync.Mutex
 	freeInodes freeID
 	freeChunks freeID
 
-	en engine
+	pauseMu sync.Mutex
+	resumed chan struct{} // closed when the background tasks are resumed, nil if they are not paused
+
+	en      engine
+	replica *replica // nil if there is no replica
 }
 
 func newBaseMeta(conf *Config) baseMeta {
 	if conf.Retries == 0 {
 		conf.Retries = 30
 	}
+	switch conf.Consistency {
+	case "":
+		conf.Consistency = ConsistencySession
+	case ConsistencyStrict:
+		conf.OpenCache = 0
+	}
+	if conf.AtimeMode == "" {
+		conf.AtimeMode = RelAtime
+	}
+	if conf.CompactSlices <= 0 {
+		conf.CompactSlices = 5
+	}
+	if conf.TxnRetries <= 0 {
+		conf.TxnRetries = 50
+	}
+	var slow *slowLog
+	if conf.SlowThreshold > 0 {
+		slow = newSlowLog(conf.SlowThreshold)
+	}
 	return baseMeta{
 		conf:         conf,
+		slow:         slow,
 		root:         1,
-		of:           newOpenFiles(conf.OpenCache),
+		of:           newOpenFiles(conf.OpenCache, conf.Consistency),
 		removedFiles: make(map[Ino]bool),
 		compacting:   make(map[uint64]bool),
 		deleting:     make(chan int, conf.MaxDeletes),
@@ -154,18 +221,26 @@ func (m *baseMeta) Load() (*Format, error) {
 
 func (m *baseMeta) NewSession() error {
 	go m.refreshUsage()
+	if m.conf.RevalidateInterval > 0 {
+		go m.revalidateFiles()
+	}
 	if m.conf.ReadOnly {
 		return nil
 	}
+	if err := m.openAuditLog(); err != nil {
+		return fmt.Errorf("open audit log %s: %s", m.conf.AuditLog, err)
+	}
+	m.openJournal()
 
 	v, err := m.en.incrCounter("nextSession", 1)
 	if err != nil {
 		return fmt.Errorf("get session ID: %s", err)
 	}
 	m.sid = uint64(v)
-	info := newSessionInfo()
-	info.MountPoint = m.conf.MountPoint
-	data, err := json.Marshal(info)
+	m.sinfo = newSessionInfo()
+	m.sinfo.MountPoint = m.conf.MountPoint
+	m.heartbeat = time.Now()
+	data, err := json.Marshal(m.sinfo)
 	if err != nil {
 		return fmt.Errorf("json: %s", err)
 	}
@@ -184,16 +259,9 @@ func (m *baseMeta) NewSession() error {
 func (m *baseMeta) refreshSession() {
 	for {
 		utils.SleepWithJitter(time.Minute)
-		m.Lock()
-		if m.umounting {
-			m.Unlock()
+		if !m.refreshHeartbeat() {
 			return
 		}
-		m.en.doRefreshSession()
-		m.Unlock()
-		if _, err := m.Load(); err != nil {
-			logger.Warnf("reload setting: %s", err)
-		}
 		if ok, err := m.en.setIfSmall("lastCleanupSessions", time.Now().Unix(), 60); err != nil {
 			logger.Warnf("checking counter lastCleanupSessions: %s", err)
 		} else if ok {
@@ -202,6 +270,55 @@ func (m *baseMeta) refreshSession() {
 	}
 }
 
+// refreshHeartbeat reloads the setting, throttles the client if it exceeded ClientOpsLimit, and
+// updates the heartbeat of the session with its rate of operations. It returns false if umounting.
+func (m *baseMeta) refreshHeartbeat() bool {
+	if _, err := m.Load(); err != nil {
+		logger.Warnf("reload setting: %s", err)
+	}
+	now := time.Now()
+	rate := float64(atomic.SwapInt64(&m.ops, 0)) / now.Sub(m.heartbeat).Seconds()
+	m.heartbeat = now
+	m.throttleOps(rate, m.fmt.ClientOpsLimit)
+
+	m.Lock()
+	defer m.Unlock()
+	if m.umounting {
+		return false
+	}
+	m.sinfo.OpsRate = math.Round(rate*100) / 100
+	m.sinfo.Throttled = m.throttled()
+	data, err := json.Marshal(m.sinfo)
+	if err != nil {
+		logger.Errorf("json: %s", err)
+		return true
+	}
+	m.en.doRefreshSession(data)
+	return true
+}
+
+// throttleOps limits the operations to limit per second once the client exceeded it, and lifts
+// the limit after the client calms down (the demand is not visible when throttled).
+func (m *baseMeta) throttleOps(rate float64, limit int) {
+	b, _ := m.opsLimiter.Load().(*ratelimit.Bucket)
+	if limit <= 0 || b != nil && rate < float64(limit)*0.9 {
+		if b != nil {
+			logger.Infof("Stop throttling the operations (%.1f/s)", rate)
+			m.opsLimiter.Store((*ratelimit.Bucket)(nil))
+		}
+		return
+	}
+	if b == nil && rate > float64(limit) || b != nil && b.Rate() != float64(limit) {
+		logger.Warnf("Throttle the operations to %d/s, %.1f/s in the last minute", limit, rate)
+		m.opsLimiter.Store(ratelimit.NewBucketWithRate(float64(limit), int64(limit)))
+	}
+}
+
+func (m *baseMeta) throttled() bool {
+	b, _ := m.opsLimiter.Load().(*ratelimit.Bucket)
+	return b != nil
+}
+
 func (m *baseMeta) CleanStaleSessions() {
 	sids, err := m.en.doFindStaleSessions(time.Now().Add(time.Minute*-5).Unix(), 1000)
 	if err != nil {
@@ -213,6 +330,17 @@ func (m *baseMeta) CleanStaleSessions() {
 	}
 }
 
+func (m *baseMeta) KillSession(sid uint64) error {
+	if _, err := m.en.GetSession(sid); err != nil {
+		return err
+	}
+	m.en.doCleanStaleSession(sid)
+	if _, err := m.en.GetSession(sid); err == nil {
+		return fmt.Errorf("session %d is not removed completely, check the logs and try again", sid)
+	}
+	return nil
+}
+
 func (m *baseMeta) CloseSession() error {
 	if m.conf.ReadOnly {
 		return nil
@@ -221,6 +349,12 @@ func (m *baseMeta) CloseSession() error {
 	m.umounting = true
 	m.Unlock()
 	m.en.doCleanStaleSession(m.sid)
+	if m.audit != nil {
+		m.audit.close()
+	}
+	if m.journal != nil {
+		m.journal.close()
+	}
 	return nil
 }
 
@@ -268,9 +402,40 @@ func (m *baseMeta) flushStats() {
 	}
 }
 
+// PauseBackground pauses or resumes the background tasks of the client.
+func (m *baseMeta) PauseBackground(pause bool) {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+	if pause && m.resumed == nil {
+		m.resumed = make(chan struct{})
+		logger.Infof("Background tasks (cleanup, compaction and deletion) are paused")
+	} else if !pause && m.resumed != nil {
+		close(m.resumed)
+		m.resumed = nil
+		logger.Infof("Background tasks are resumed")
+	}
+}
+
+func (m *baseMeta) BackgroundPaused() bool {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+	return m.resumed != nil
+}
+
+// waitResumed blocks until the background tasks are resumed, if they are paused.
+func (m *baseMeta) waitResumed() {
+	m.pauseMu.Lock()
+	resumed := m.resumed
+	m.pauseMu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
 func (m *baseMeta) cleanupDeletedFiles() {
 	for {
 		utils.SleepWithJitter(time.Minute)
+		m.waitResumed()
 		if ok, err := m.en.setIfSmall("lastCleanupFiles", time.Now().Unix(), 60); err != nil {
 			logger.Warnf("checking counter lastCleanupFiles: %s", err)
 		} else if ok {
@@ -290,6 +455,7 @@ func (m *baseMeta) cleanupDeletedFiles() {
 func (m *baseMeta) cleanupSlices() {
 	for {
 		utils.SleepWithJitter(time.Hour)
+		m.waitResumed()
 		if ok, err := m.en.setIfSmall("nextCleanupSlices", time.Now().Unix(), 3600); err != nil {
 			logger.Warnf("checking counter nextCleanupSlices: %s", err)
 		} else if ok {
@@ -299,7 +465,7 @@ func (m *baseMeta) cleanupSlices() {
 }
 
 func (m *baseMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("statfs", 0, time.Now())
 	var used, inodes int64
 	var err error
 	err = utils.WithTimeout(func() error {
@@ -368,7 +534,7 @@ func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr
 	if inode == nil || attr == nil {
 		return syscall.EINVAL // bad request
 	}
-	defer timeit(time.Now())
+	defer m.timeit("lookup", parent, time.Now())
 	parent = m.checkRoot(parent)
 	if name == ".." {
 		if parent == m.root {
@@ -401,7 +567,7 @@ func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr
 		*inode = TrashInode
 		return 0
 	}
-	st := m.en.doLookup(ctx, parent, name, inode, attr)
+	st := m.listEngine().doLookup(ctx, parent, name, inode, attr)
 	if st == syscall.ENOENT && m.conf.CaseInsensi {
 		if e := m.resolveCase(ctx, parent, name); e != nil {
 			*inode = e.Inode
@@ -438,12 +604,16 @@ func (m *baseMeta) parseAttr(buf []byte, attr *Attr) {
 	if rb.Left() >= 8 {
 		attr.Parent = Ino(rb.Get64())
 	}
+	if rb.Left() >= 12 {
+		attr.Btime = int64(rb.Get64())
+		attr.Btimensec = rb.Get32()
+	}
 	attr.Full = true
 	logger.Tracef("attr: %+v -> %+v", buf, attr)
 }
 
 func (m *baseMeta) marshal(attr *Attr) []byte {
-	w := utils.NewBuffer(36 + 24 + 4 + 8)
+	w := utils.NewBuffer(36 + 24 + 4 + 8 + 12)
 	w.Put8(attr.Flags)
 	w.Put16((uint16(attr.Typ) << 12) | (attr.Mode & 0xfff))
 	w.Put32(attr.Uid)
@@ -458,6 +628,8 @@ func (m *baseMeta) marshal(attr *Attr) []byte {
 	w.Put64(attr.Length)
 	w.Put32(attr.Rdev)
 	w.Put64(uint64(attr.Parent))
+	w.Put64(uint64(attr.Btime))
+	w.Put32(attr.Btimensec)
 	logger.Tracef("attr: %+v -> %+v", attr, w.Bytes())
 	return w.Bytes()
 }
@@ -486,6 +658,41 @@ func clearSUGID(ctx Context, cur *Attr, set *Attr) {
 	}
 }
 
+// protected returns whether the node is immutable or append-only, which can't be removed,
+// renamed or linked, and its attributes can't be changed.
+func protected(flags uint8) bool {
+	return flags&(FlagImmutable|FlagAppend) != 0
+}
+
+// changeFlags sets the flags of node if SetAttrFlag is in set (only by root), the other
+// changes are rejected if the node is protected (after the flags are changed).
+func changeFlags(ctx Context, cur *uint8, set uint16, flags uint8) (bool, syscall.Errno) {
+	var changed bool
+	if set&SetAttrFlag != 0 {
+		if ctx.Uid() != 0 {
+			return false, syscall.EPERM
+		}
+		changed = *cur != flags
+		*cur = flags
+	}
+	if set&^(SetAttrFlag|SetAttrAtimeRead) != 0 && protected(*cur) {
+		return false, syscall.EPERM
+	}
+	return changed, 0
+}
+
+// checkProtected returns EPERM if the node is immutable or append-only.
+func (m *baseMeta) checkProtected(ctx Context, inode Ino) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if protected(attr.Flags) {
+		return syscall.EPERM
+	}
+	return 0
+}
+
 func (r *baseMeta) Resolve(ctx Context, parent Ino, path string, inode *Ino, attr *Attr) syscall.Errno {
 	return syscall.ENOTSUP
 }
@@ -516,7 +723,9 @@ func (m *baseMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	if m.conf.OpenCache > 0 && m.of.Check(inode, attr) {
 		return 0
 	}
-	defer timeit(time.Now())
+	defer m.timeit("getattr", inode, time.Now())
+	ver := m.of.startFetch()
+	defer m.of.endFetch()
 	var err syscall.Errno
 	if inode == 1 {
 		e := utils.WithTimeout(func() error {
@@ -534,11 +743,179 @@ func (m *baseMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 		err = m.en.doGetAttr(ctx, inode, attr)
 	}
 	if err == 0 {
-		m.of.Update(inode, attr)
+		m.of.Update(inode, attr, ver)
 	}
 	return err
 }
 
+func (m *baseMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if set == SetAttrAtimeRead && m.conf.AtimeMode == NoAtime {
+		return 0
+	}
+	defer m.timeit("setattr", inode, time.Now())
+	inode = m.checkRoot(inode)
+	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
+	st := m.en.doSetAttr(ctx, inode, set, sugidclearmode, attr)
+	if st == 0 && set != SetAttrAtimeRead {
+		m.auditSetAttr(ctx, inode, set, attr)
+	}
+	return st
+}
+
+// atimeNeedsUpdate returns whether the atime of a node accessed at now should be updated.
+func (m *baseMeta) atimeNeedsUpdate(attr *Attr, now time.Time) bool {
+	if attr.Flags&FlagImmutable != 0 {
+		return false
+	}
+	switch m.conf.AtimeMode {
+	case NoAtime:
+		return false
+	case StrictAtime:
+		return true
+	}
+	atime := time.Unix(attr.Atime, int64(attr.Atimensec))
+	return atime.Before(time.Unix(attr.Mtime, int64(attr.Mtimensec))) ||
+		atime.Before(time.Unix(attr.Ctime, int64(attr.Ctimensec))) || now.Sub(atime) > time.Hour*24
+}
+
+// needCompact returns whether a chunk of inode read with the recorded slices ss, which are built
+// into chunks, is fragmented enough to be compacted.
+func (m *baseMeta) needCompact(inode Ino, ss []*slice, chunks []Slice) bool {
+	if m.conf.ReadOnly {
+		return false
+	}
+	maxSlices, maxBytes := m.of.compactThresholds(inode)
+	if maxSlices == 0 {
+		maxSlices = m.conf.CompactSlices
+	}
+	if maxBytes == 0 {
+		maxBytes = m.conf.CompactBytes
+	}
+	if len(ss) >= maxSlices || len(chunks) >= maxSlices {
+		return true
+	}
+	if maxBytes > 0 {
+		var total uint64
+		for _, s := range ss {
+			total += uint64(s.len)
+		}
+		return total >= maxBytes
+	}
+	return false
+}
+
+func (m *baseMeta) SetCompactHint(inode Ino, slices int, bytes uint64) {
+	m.of.SetCompact(inode, slices, bytes)
+}
+
+func (m *baseMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	st := m.en.doTruncate(ctx, inode, flags, length, attr)
+	if st == 0 {
+		m.auditEvent(ctx, "setattr", 0, "", inode, fmt.Sprintf("size=%d", length))
+		m.journalEvent(ctx, "truncate", 0, "", inode, fmt.Sprintf("size=%d", length))
+	}
+	return st
+}
+
+func (m *baseMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	st := m.en.doFallocate(ctx, inode, mode, off, size)
+	if st == 0 {
+		m.auditEvent(ctx, "fallocate", 0, "", inode, fmt.Sprintf("mode=%d off=%d size=%d", mode, off, size))
+		m.journalEvent(ctx, "fallocate", 0, "", inode, fmt.Sprintf("mode=%d off=%d size=%d", mode, off, size))
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			go m.compactHole(inode, off, size)
+		}
+	}
+	return st
+}
+
+// compactHole compacts the chunks overlapped with a hole punched in the file, so the slices
+// covered by the hole are released, and the chunks without any data left are deleted.
+func (m *baseMeta) compactHole(inode Ino, off, size uint64) {
+	var attr Attr
+	if st := m.en.doGetAttr(Background, inode, &attr); st != 0 {
+		return
+	}
+	end := off + size
+	if end > attr.Length {
+		end = attr.Length
+	}
+	for indx := off / ChunkSize; indx*ChunkSize < end; indx++ {
+		if st := m.en.compactChunk(inode, uint32(indx), true, false); st != 0 {
+			logger.Debugf("compact chunk %d:%d in the hole: %s", inode, indx, st)
+		}
+	}
+}
+
+func (m *baseMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	st := m.en.doGetXattr(ctx, inode, name, vbuff)
+	if st == 0 && m.fmt.XattrChecksum {
+		var ok bool
+		if *vbuff, ok = unstampXattr(name, *vbuff); !ok {
+			logger.Errorf("Checksum mismatch of xattr %s of inode %d, it's corrupted in the meta engine", name, inode)
+			return syscall.EIO
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+	if st := m.checkProtected(ctx, inode); st != 0 {
+		return st
+	}
+	if m.fmt.XattrChecksum {
+		value = stampXattr(name, value)
+	}
+	st := m.en.doSetXattr(ctx, inode, name, value, flags)
+	if st == 0 {
+		m.auditEvent(ctx, "setxattr", 0, "", inode, "name="+name)
+	}
+	return st
+}
+
+func (m *baseMeta) CompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno {
+	if name == "" {
+		return syscall.EINVAL
+	}
+	if st := m.checkProtected(ctx, inode); st != 0 {
+		return st
+	}
+	if m.fmt.XattrChecksum {
+		// the stored value is compared, which may be stamped or not (set before the checksum is enabled)
+		var raw []byte
+		if st := m.en.doGetXattr(ctx, inode, name, &raw); st == 0 {
+			old, ok := unstampXattr(name, raw)
+			if !ok {
+				logger.Errorf("Checksum mismatch of xattr %s of inode %d, it's corrupted in the meta engine", name, inode)
+				return syscall.EIO
+			}
+			if !bytes.Equal(old, expected) {
+				return syscall.ECANCELED
+			}
+			expected = raw
+		} else if st != ENOATTR {
+			return st
+		}
+		value = stampXattr(name, value)
+	}
+	st := m.en.doCompareAndSwapXattr(ctx, inode, name, expected, value)
+	if st == 0 {
+		m.auditEvent(ctx, "setxattr", 0, "", inode, "name="+name)
+	}
+	return st
+}
+
+func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if st := m.checkProtected(ctx, inode); st != 0 {
+		return st
+	}
+	st := m.en.doRemoveXattr(ctx, inode, name)
+	if st == 0 {
+		m.auditEvent(ctx, "removexattr", 0, "", inode, "name="+name)
+	}
+	return st
+}
+
 func (m *baseMeta) nextInode() (Ino, error) {
 	m.freeMu.Lock()
 	defer m.freeMu.Unlock()
@@ -566,8 +943,13 @@ func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+	defer m.timeit("mknod", parent, time.Now())
+	st := m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+	if st == 0 && inode != nil {
+		m.auditEvent(ctx, "mknod", parent, name, *inode, fmt.Sprintf("type=%s mode=%o", typeToString(_type), mode))
+		m.journalEvent(ctx, "mknod", parent, name, *inode, fmt.Sprintf("type=%s mode=%o", typeToString(_type), mode))
+	}
+	return st
 }
 
 func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -577,16 +959,21 @@ func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cum
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
+	defer m.timeit("create", parent, time.Now())
 	if attr == nil {
 		attr = &Attr{}
 	}
+	// the attributes of an existing file could be fetched
+	ver := m.of.startFetch()
+	defer m.of.endFetch()
 	err := m.en.doMknod(ctx, parent, name, TypeFile, mode, cumask, 0, "", inode, attr)
 	if err == syscall.EEXIST && (flags&syscall.O_EXCL) == 0 && attr.Typ == TypeFile {
 		err = 0
 	}
 	if err == 0 && inode != nil {
-		m.of.Open(*inode, attr)
+		m.of.Open(*inode, attr, ver)
+		m.auditEvent(ctx, "create", parent, name, *inode, fmt.Sprintf("mode=%o", mode))
+		m.journalEvent(ctx, "create", parent, name, *inode, fmt.Sprintf("mode=%o", mode))
 	}
 	return err
 }
@@ -598,8 +985,13 @@ func (m *baseMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cuma
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, "", inode, attr)
+	defer m.timeit("mkdir", parent, time.Now())
+	st := m.en.doMknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, "", inode, attr)
+	if st == 0 && inode != nil {
+		m.auditEvent(ctx, "mkdir", parent, name, *inode, fmt.Sprintf("mode=%o", mode))
+		m.journalEvent(ctx, "mkdir", parent, name, *inode, fmt.Sprintf("mode=%o", mode))
+	}
+	return st
 }
 
 func (m *baseMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
@@ -609,8 +1001,13 @@ func (m *baseMeta) Symlink(ctx Context, parent Ino, name string, path string, in
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
+	defer m.timeit("symlink", parent, time.Now())
+	st := m.en.doMknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
+	if st == 0 && inode != nil {
+		m.auditEvent(ctx, "symlink", parent, name, *inode, "target="+path)
+		m.journalEvent(ctx, "symlink", parent, name, *inode, "target="+path)
+	}
+	return st
 }
 
 func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
@@ -620,10 +1017,15 @@ func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr)
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
+	defer m.timeit("link", inode, time.Now())
 	parent = m.checkRoot(parent)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return m.en.doLink(ctx, inode, parent, name, attr)
+	st := m.en.doLink(ctx, inode, parent, name, attr)
+	if st == 0 {
+		m.auditEvent(ctx, "link", parent, name, inode, "")
+		m.journalEvent(ctx, "link", parent, name, inode, "")
+	}
+	return st
 }
 
 func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
@@ -631,7 +1033,7 @@ func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno
 		*path = target.([]byte)
 		return 0
 	}
-	defer timeit(time.Now())
+	defer m.timeit("readlink", inode, time.Now())
 	target, err := m.en.doReadlink(ctx, inode)
 	if err != nil {
 		return errno(err)
@@ -648,9 +1050,15 @@ func (m *baseMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 	if parent == 1 && name == TrashName || isTrash(parent) && ctx.Uid() != 0 {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
+	defer m.timeit("unlink", parent, time.Now())
 	parent = m.checkRoot(parent)
-	return m.en.doUnlink(ctx, parent, name)
+	inode := m.auditLookup(ctx, parent, name)
+	st := m.en.doUnlink(ctx, parent, name)
+	if st == 0 {
+		m.auditEvent(ctx, "unlink", parent, name, inode, "")
+		m.journalEvent(ctx, "unlink", parent, name, inode, "")
+	}
+	return st
 }
 
 func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
@@ -663,9 +1071,15 @@ func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	if parent == 1 && name == TrashName || parent == TrashInode || isTrash(parent) && ctx.Uid() != 0 {
 		return syscall.EPERM
 	}
-	defer timeit(time.Now())
+	defer m.timeit("rmdir", parent, time.Now())
 	parent = m.checkRoot(parent)
-	return m.en.doRmdir(ctx, parent, name)
+	inode := m.auditLookup(ctx, parent, name)
+	st := m.en.doRmdir(ctx, parent, name)
+	if st == 0 {
+		m.auditEvent(ctx, "rmdir", parent, name, inode, "")
+		m.journalEvent(ctx, "rmdir", parent, name, inode, "")
+	}
+	return st
 }
 
 func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -682,10 +1096,19 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	default:
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("rename", parentSrc, time.Now())
 	parentSrc = m.checkRoot(parentSrc)
 	parentDst = m.checkRoot(parentDst)
-	return m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+	st := m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+	if st == 0 {
+		var ino Ino
+		if inode != nil {
+			ino = *inode
+		}
+		m.auditRename(ctx, parentSrc, nameSrc, parentDst, nameDst, ino)
+		m.journalRename(ctx, parentSrc, nameSrc, parentDst, nameDst, ino)
+	}
+	return st
 }
 
 func (m *baseMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscall.Errno {
@@ -693,19 +1116,44 @@ func (m *baseMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscal
 		return syscall.EROFS
 	}
 	if m.conf.OpenCache > 0 && m.of.OpenCheck(inode, attr) {
+		if st := checkOpenFlags(attr, flags); st != 0 {
+			m.of.Close(inode)
+			return st
+		}
 		return 0
 	}
+	ver := m.of.startFetch()
+	defer m.of.endFetch()
 	var err syscall.Errno
 	// attr may be valid, see fs.Open()
 	if attr != nil && !attr.Full {
 		err = m.GetAttr(ctx, inode, attr)
 	}
 	if err == 0 {
-		m.of.Open(inode, attr)
+		err = checkOpenFlags(attr, flags)
+	}
+	if err == 0 {
+		m.of.Open(inode, attr, ver)
 	}
 	return err
 }
 
+// checkOpenFlags rejects opening an immutable file for write, or an append-only file
+// for write without O_APPEND.
+func checkOpenFlags(attr *Attr, flags uint32) syscall.Errno {
+	if attr == nil {
+		return 0
+	}
+	write := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0
+	if attr.Flags&FlagImmutable != 0 && write {
+		return syscall.EPERM
+	}
+	if attr.Flags&FlagAppend != 0 && write && (flags&syscall.O_APPEND == 0 || flags&syscall.O_TRUNC != 0) {
+		return syscall.EPERM
+	}
+	return 0
+}
+
 func (m *baseMeta) InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno {
 	m.of.InvalidateChunk(inode, indx)
 	return 0
@@ -727,6 +1175,93 @@ func (m *baseMeta) NewChunk(ctx Context, chunkid *uint64) syscall.Errno {
 	return 0
 }
 
+func (m *baseMeta) ReserveChunks(ctx Context, minid, maxid uint64) syscall.Errno {
+	if minid > maxid {
+		return syscall.EINVAL
+	}
+	next, err := m.en.incrCounter("nextChunk", 0)
+	if err != nil {
+		return errno(err)
+	}
+	if uint64(next) > minid {
+		logger.Warnf("Chunk id %d could be used already, the next one is %d", minid, next)
+		return syscall.EEXIST
+	}
+	diff := int64(maxid + 1 - uint64(next))
+	v, err := m.en.incrCounter("nextChunk", diff)
+	if err != nil {
+		return errno(err)
+	}
+	if uint64(v-diff) > minid { // allocated by others in the meantime
+		logger.Warnf("Chunk id %d is allocated by other clients, the next one is %d", minid, v-diff)
+		return syscall.EEXIST
+	}
+	return 0
+}
+
+func (m *baseMeta) SetSliceChecksums(ctx Context, chunkid uint64, sums []uint32) syscall.Errno {
+	w := utils.NewBuffer(uint32(len(sums)) * 4)
+	for _, s := range sums {
+		w.Put32(s)
+	}
+	return errno(m.en.doSetSliceChecksums(chunkid, w.Bytes()))
+}
+
+func (m *baseMeta) GetSliceChecksums(ctx Context, chunkid uint64, sums *[]uint32) syscall.Errno {
+	buf, err := m.en.doGetSliceChecksums(chunkid)
+	if err != nil {
+		return errno(err)
+	}
+	if buf == nil {
+		return syscall.ENOENT
+	}
+	if len(buf)%4 != 0 {
+		logger.Errorf("Corrupt checksums of slice %d: %d bytes", chunkid, len(buf))
+		return syscall.EIO
+	}
+	rb := utils.ReadBuffer(buf)
+	*sums = make([]uint32, len(buf)/4)
+	for i := range *sums {
+		(*sums)[i] = rb.Get32()
+	}
+	return 0
+}
+
+func (m *baseMeta) SetSliceData(ctx Context, chunkid uint64, data []byte) syscall.Errno {
+	return errno(m.en.doSetSliceData(chunkid, data))
+}
+
+func (m *baseMeta) GetSliceData(ctx Context, chunkid uint64, data *[]byte) syscall.Errno {
+	buf, err := m.en.doGetSliceData(chunkid)
+	if err != nil {
+		return errno(err)
+	}
+	if buf == nil {
+		return syscall.ENOENT
+	}
+	*data = buf
+	return 0
+}
+
+// dumpSliceData fills the data of the inline slices of a dumped file.
+func (m *baseMeta) dumpSliceData(e *DumpedEntry) error {
+	if m.fmt.InlineSize == 0 {
+		return nil
+	}
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			if s.Chunkid > 0 && int(s.Size) <= m.fmt.InlineSize {
+				data, err := m.en.doGetSliceData(s.Chunkid)
+				if err != nil {
+					return err
+				}
+				s.Data = data
+			}
+		}
+	}
+	return nil
+}
+
 func (m *baseMeta) Close(ctx Context, inode Ino) syscall.Errno {
 	if m.of.Close(inode) {
 		m.Lock()
@@ -747,7 +1282,7 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	if err := m.GetAttr(ctx, inode, &attr); err != 0 {
 		return err
 	}
-	defer timeit(time.Now())
+	defer m.timeit("readdir", inode, time.Now())
 	if inode == m.root {
 		attr.Parent = m.root
 	}
@@ -763,7 +1298,48 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 		Name:  []byte(".."),
 		Attr:  &Attr{Typ: TypeDirectory},
 	})
-	return m.en.doReaddir(ctx, inode, plus, entries)
+	return m.listEngine().doReaddir(ctx, inode, plus, entries)
+}
+
+func (m *baseMeta) ReaddirPage(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno) {
+	inode = m.checkRoot(inode)
+	var attr Attr
+	if err := m.GetAttr(ctx, inode, &attr); err != 0 {
+		return "", err
+	}
+	defer m.timeit("readdir", inode, time.Now())
+	if limit <= 0 {
+		limit = 1
+	}
+	if cursor == "" {
+		if inode == m.root {
+			attr.Parent = m.root
+		}
+		dot, dotdot := &Attr{Typ: TypeDirectory}, &Attr{Typ: TypeDirectory}
+		if plus != 0 {
+			*dot = attr
+			if st := m.GetAttr(ctx, attr.Parent, dotdot); st != 0 {
+				return "", st
+			}
+		}
+		*entries = append(*entries, &Entry{
+			Inode: inode,
+			Name:  []byte("."),
+			Attr:  dot,
+		}, &Entry{
+			Inode: attr.Parent,
+			Name:  []byte(".."),
+			Attr:  dotdot,
+		})
+	}
+	n := len(*entries)
+	for {
+		next, st := m.listEngine().doReaddirPage(ctx, inode, plus, cursor, limit, entries)
+		if st != 0 || next == "" || len(*entries) > n {
+			return next, st
+		}
+		cursor = next // an empty page (e.g. HSCAN on a sparse hash)
+	}
 }
 
 func (m *baseMeta) fileDeleted(opened bool, inode Ino, length uint64) {
@@ -780,6 +1356,7 @@ func (m *baseMeta) deleteSlice(chunkid uint64, size uint32) {
 	if m.conf.MaxDeletes == 0 {
 		return
 	}
+	m.waitResumed()
 	m.deleting <- 1
 	defer func() { <-m.deleting }()
 	err := m.newMsg(DeleteChunk, chunkid, size)
@@ -832,6 +1409,7 @@ func (m *baseMeta) checkTrash(parent Ino, trash *Ino) syscall.Errno {
 func (m *baseMeta) cleanupTrash() {
 	for {
 		utils.SleepWithJitter(time.Hour)
+		m.waitResumed()
 		if st := m.en.doGetAttr(Background, TrashInode, nil); st != 0 {
 			if st != syscall.ENOENT {
 				logger.Warnf("getattr inode %d: %s", TrashInode, st)
@@ -891,13 +1469,19 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 					rmdir = false
 					continue
 				}
-				if count%10000 == 0 && time.Since(now) > 50*time.Minute {
+				if count%10000 == 0 && time.Since(now) > 50*time.Minute || !force && m.BackgroundPaused() {
 					return
 				}
 			}
 			if rmdir {
 				if st = m.en.doRmdir(ctx, TrashInode, string(e.Name)); st != 0 {
 					logger.Warnf("rmdir subTrash %s: %s", e.Name, st)
+				} else {
+					m.Lock()
+					if m.subTrash.name == string(e.Name) { // it's created again by the next removal
+						m.subTrash = internalNode{}
+					}
+					m.Unlock()
 				}
 			}
 		} else {
@@ -905,3 +1489,163 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 		}
 	}
 }
+
+// the inodes changed recently may be linked after the entries are scanned, leave them to the next run
+var reparentDelay = time.Minute
+
+func (m *baseMeta) Reparent(ctx Context, recovered *[]*Entry) syscall.Errno {
+	cutoff := time.Now().Add(-reparentDelay).Unix()
+	referred := make(map[Ino]bool)
+	subdirs := make(map[Ino]uint32)
+	if err := m.en.scanAllEntries(ctx, func(parent Ino, name string, typ uint8, inode Ino) {
+		referred[inode] = true
+		if typ == TypeDirectory {
+			subdirs[parent]++
+		}
+	}); err != nil {
+		logger.Errorf("scan entries: %s", err)
+		return errno(err)
+	}
+	var orphans []*Entry
+	if err := m.en.scanAllInodes(ctx, func(inode Ino, attr *Attr) {
+		// the unlinked files (nlink is 0) are waiting to be deleted
+		if inode == 1 || inode == TrashInode || referred[inode] || attr.Nlink == 0 || attr.Ctime > cutoff {
+			return
+		}
+		if attr.Typ == TypeDirectory {
+			attr.Nlink = 2 + subdirs[inode]
+		} else {
+			attr.Nlink = 1 // other hard links are lost too
+		}
+		orphans = append(orphans, &Entry{Inode: inode, Name: []byte(fmt.Sprintf("#%d", inode)), Attr: attr})
+	}); err != nil {
+		logger.Errorf("scan inodes: %s", err)
+		return errno(err)
+	}
+	if len(orphans) == 0 {
+		return 0
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Inode < orphans[j].Inode })
+
+	var lostFound Ino
+	var attr Attr
+	st := m.en.doLookup(ctx, 1, LostFoundName, &lostFound, &attr)
+	if st == syscall.ENOENT {
+		st = m.en.doMknod(ctx, 1, LostFoundName, TypeDirectory, 0700, 0, 0, "", &lostFound, &attr)
+	}
+	if st != 0 {
+		logger.Errorf("create %s: %s", LostFoundName, st)
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	for _, e := range orphans {
+		if st = m.en.doReparent(ctx, lostFound, string(e.Name), e.Inode, e.Attr); st != 0 {
+			logger.Errorf("reparent inode %d into %s: %s", e.Inode, LostFoundName, st)
+			return st
+		}
+		logger.Infof("Recovered inode %d (%d bytes) as /%s/%s", e.Inode, e.Attr.Length, LostFoundName, e.Name)
+		*recovered = append(*recovered, e)
+	}
+	return 0
+}
+
+func (m *baseMeta) FixNlink(ctx Context, fixed map[Ino][2]uint32) syscall.Errno {
+	var dirs []Ino
+	if err := m.en.scanAllInodes(ctx, func(inode Ino, attr *Attr) {
+		if attr.Typ == TypeDirectory {
+			dirs = append(dirs, inode)
+		}
+	}); err != nil {
+		logger.Errorf("scan inodes: %s", err)
+		return errno(err)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i] < dirs[j] })
+	for _, inode := range dirs {
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+		var old, nlink uint32
+		st := m.en.doFixNlink(ctx, inode, &old, &nlink)
+		if st == syscall.ENOENT || st == syscall.ENOTDIR { // removed after scanned
+			continue
+		}
+		if st != 0 {
+			logger.Errorf("fix nlink of directory %d: %s", inode, st)
+			return st
+		}
+		if old != nlink {
+			fixed[inode] = [2]uint32{old, nlink}
+		}
+	}
+	return 0
+}
+
+func (m *baseMeta) CheckXattrs(ctx Context, corrupted map[Ino][]string) syscall.Errno {
+	if err := m.en.scanAllXattrs(ctx, func(inode Ino, name string, value []byte) {
+		if _, ok := unstampXattr(name, value); !ok {
+			logger.Errorf("Checksum mismatch of xattr %s of inode %d", name, inode)
+			corrupted[inode] = append(corrupted[inode], name)
+		}
+	}); err != nil {
+		logger.Errorf("scan xattrs: %s", err)
+		return errno(err)
+	}
+	return 0
+}
+
+func (m *baseMeta) CompactFile(ctx Context, inode Ino, stats *CompactStats) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeFile {
+		return syscall.EINVAL
+	}
+	readChunk := func(indx uint32) ([]Slice, syscall.Errno) {
+		var cs, data []Slice
+		st := m.en.Read(ctx, inode, indx, &cs)
+		for _, s := range cs {
+			if s.Chunkid > 0 {
+				data = append(data, s)
+			}
+		}
+		return data, st
+	}
+	for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+		old, st := readChunk(indx)
+		if st != 0 {
+			return st
+		}
+		for i := 0; i < 3; i++ {
+			// EINVAL means the chunk was changed during the compaction
+			if st = m.en.compactChunk(inode, indx, true, true); st != syscall.EINVAL {
+				break
+			}
+		}
+		if st == syscall.EINVAL {
+			st = syscall.EBUSY
+		}
+		if st != 0 {
+			logger.Warnf("compact chunk %d:%d: %s", inode, indx, st)
+			return st
+		}
+		cs, st := readChunk(indx)
+		if st != 0 {
+			return st
+		}
+		stats.OldSlices += len(old)
+		stats.NewSlices += len(cs)
+		if !reflect.DeepEqual(old, cs) {
+			stats.Chunks++
+			for _, s := range cs {
+				stats.Bytes += uint64(s.Len)
+			}
+		}
+	}
+	return 0
+}
@@ -20,16 +20,51 @@ import "time"
 
 // Config for clients.
 type Config struct {
-	Strict      bool // update ctime
-	Retries     int
-	CaseInsensi bool
-	ReadOnly    bool
-	OpenCache   time.Duration
-	MountPoint  string
-	Subdir      string
-	MaxDeletes  int
+	Strict        bool // update ctime
+	Retries       int
+	CaseInsensi   bool
+	ReadOnly      bool
+	OpenCache     time.Duration
+	MountPoint    string
+	Subdir        string
+	MaxDeletes    int
+	AuditLog      string        // file or tcp/udp address to write audit events, empty means disabled
+	AuditBuffer   int           // max number of pending audit events
+	SlowThreshold time.Duration // record the operations and transactions slower than it, 0 means disabled
+	Consistency   string        // session (default), strict or relaxed
+	AtimeMode     string        // relatime (default), noatime or strictatime
+	CompactSlices int           // number of slices in a chunk to compact it when it's read, 5 by default
+	CompactBytes  uint64        // total length of the slices in a chunk to compact it when it's read, 0 means disabled
+	TxnRetries    int           // max restarts of a conflicted transaction, it fails with EAGAIN after that, 50 by default
+	// interval to check the cached chunks of open files against the engine, and drop the ones
+	// changed by other clients, 0 means disabled
+	RevalidateInterval time.Duration
+	Replica            string        // address of a read-only replica of the engine, empty means none
+	ListConsistency    string        // strong (default) or eventual, where to read the entries of directories from
+	MaxStaleness       time.Duration // max lag of the replica to read the entries from it, 5 seconds by default
 }
 
+const (
+	// ConsistencySession guarantees a client reads its own writes: the attributes fetched
+	// concurrently with its local changes are not cached.
+	ConsistencySession = "session"
+	// ConsistencyStrict caches nothing about open files, so the changes from other clients are
+	// seen once they are committed (--open-cache is ignored).
+	ConsistencyStrict = "strict"
+	// ConsistencyRelaxed caches whatever is fetched, a client could see its own changes late
+	// until the cached attributes expire (--open-cache).
+	ConsistencyRelaxed = "relaxed"
+)
+
+const (
+	// RelAtime updates atime on access only if it's older than mtime or ctime, or one day ago.
+	RelAtime = "relatime"
+	// NoAtime never updates atime on access.
+	NoAtime = "noatime"
+	// StrictAtime updates atime on every access.
+	StrictAtime = "strictatime"
+)
+
 type Format struct {
 	Name        string
 	UUID        string
@@ -45,6 +80,20 @@ type Format struct {
 	Inodes      uint64
 	EncryptKey  string `json:",omitempty"`
 	TrashDays   int
+	// max operations per second of each client, the clients exceeded it are throttled until
+	// the next heartbeat, 0 means unlimited
+	ClientOpsLimit int `json:",omitempty"`
+	// number of hashed prefixes of the keys of blocks, the slices before PrefixedFrom keep the keys
+	// without prefix, both of them are set by format or config
+	KeyPrefixes  int    `json:",omitempty"`
+	PrefixedFrom uint64 `json:",omitempty"`
+	// stamp the values of xattrs with a checksum verified on read, it can't be disabled once enabled
+	XattrChecksum bool `json:",omitempty"`
+	// the slices up to this size (in bytes) are stored in the metadata engine instead of object
+	// storage, it's set by format only, since the clients with a different one can't read them
+	InlineSize int `json:",omitempty"`
+	// number of the latest changes kept in the journal for the consumers to tail, 0 means disabled
+	JournalSize int `json:",omitempty"`
 }
 
 func (f *Format) RemoveSecret() {
@@ -65,6 +65,9 @@ type DumpedAttr struct {
 	Nlink     uint32 `json:"nlink"`
 	Length    uint64 `json:"length"`
 	Rdev      uint32 `json:"rdev,omitempty"`
+	Flags     uint8  `json:"flags,omitempty"`
+	Btime     int64  `json:"btime,omitempty"`
+	Btimensec uint32 `json:"btimensec,omitempty"`
 }
 
 type DumpedSlice struct {
@@ -73,6 +76,7 @@ type DumpedSlice struct {
 	Size    uint32 `json:"size"`
 	Off     uint32 `json:"off"`
 	Len     uint32 `json:"len"`
+	Data    []byte `json:"data,omitempty"` // of the slices stored inline
 }
 
 type DumpedChunk struct {
@@ -202,6 +206,9 @@ func dumpAttr(a *Attr) *DumpedAttr {
 		Ctimensec: a.Ctimensec,
 		Nlink:     a.Nlink,
 		Rdev:      a.Rdev,
+		Flags:     a.Flags,
+		Btime:     a.Btime,
+		Btimensec: a.Btimensec,
 	}
 	if a.Typ == TypeFile {
 		d.Length = a.Length
@@ -211,7 +218,7 @@ func dumpAttr(a *Attr) *DumpedAttr {
 
 func loadAttr(d *DumpedAttr) *Attr {
 	return &Attr{
-		// Flags:     0,
+		Flags:     d.Flags,
 		Typ:       typeFromString(d.Type),
 		Mode:      d.Mode,
 		Uid:       d.Uid,
@@ -224,6 +231,8 @@ func loadAttr(d *DumpedAttr) *Attr {
 		Ctimensec: d.Ctimensec,
 		Nlink:     d.Nlink,
 		Rdev:      d.Rdev,
+		Btime:     d.Btime,
+		Btimensec: d.Btimensec,
 		Full:      true,
 	} // Length and Parent not set
 }
@@ -0,0 +1,64 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status of the meta engine in a health check.
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"    // reachable, but with some warnings
+	HealthUnreachable = "unreachable" // failed to ping or read
+)
+
+// slowHealthCheck is the latency of a health check regarded as degraded.
+const slowHealthCheck = time.Millisecond * 100
+
+// Health is the result of a health check of the meta engine.
+type Health struct {
+	Status    string
+	Reachable bool
+	Latency   time.Duration // of the ping and read
+	Error     string        `json:",omitempty"`
+	Warnings  []string      `json:",omitempty"`
+}
+
+// CheckHealth pings the meta engine and reads the setting, which is cheap enough to be called by the probes.
+func (m *baseMeta) CheckHealth() *Health {
+	start := time.Now()
+	warnings, err := m.en.doCheckHealth()
+	if err == nil {
+		_, err = m.en.doLoad()
+	}
+	h := &Health{Reachable: err == nil, Latency: time.Since(start), Warnings: warnings}
+	if err != nil {
+		h.Status = HealthUnreachable
+		h.Error = err.Error()
+		return h
+	}
+	if h.Latency > slowHealthCheck {
+		h.Warnings = append(h.Warnings, fmt.Sprintf("latency %s is higher than %s", h.Latency, slowHealthCheck))
+	}
+	h.Status = HealthOK
+	if len(h.Warnings) > 0 {
+		h.Status = HealthDegraded
+	}
+	return h
+}
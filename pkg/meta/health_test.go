@@ -0,0 +1,60 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// mockEngine reports the result of health check as configured.
+type mockEngine struct {
+	engine
+	warnings []string
+	err      error
+	delay    time.Duration
+}
+
+func (e *mockEngine) doCheckHealth() ([]string, error) {
+	time.Sleep(e.delay)
+	return e.warnings, e.err
+}
+
+func TestCheckHealth(t *testing.T) {
+	m, err := newKVMeta("memkv", "jfs-unit-test", &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	base := m.(*kvMeta)
+	if h := m.CheckHealth(); h.Status != HealthOK || !h.Reachable || len(h.Warnings) > 0 || h.Latency <= 0 {
+		t.Fatalf("expect healthy, but got %+v", h)
+	}
+
+	base.en = &mockEngine{engine: m.(engine), warnings: []string{"memory pressure"}}
+	if h := m.CheckHealth(); h.Status != HealthDegraded || !h.Reachable || len(h.Warnings) != 1 {
+		t.Fatalf("expect degraded, but got %+v", h)
+	}
+	base.en = &mockEngine{engine: m.(engine), delay: slowHealthCheck + time.Millisecond*10}
+	if h := m.CheckHealth(); h.Status != HealthDegraded || len(h.Warnings) != 1 || h.Latency <= slowHealthCheck {
+		t.Fatalf("expect degraded for the latency, but got %+v", h)
+	}
+	base.en = &mockEngine{engine: m.(engine), err: errors.New("connection refused")}
+	if h := m.CheckHealth(); h.Status != HealthUnreachable || h.Reachable || h.Error != "connection refused" {
+		t.Fatalf("expect unreachable, but got %+v", h)
+	}
+}
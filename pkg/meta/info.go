@@ -65,6 +65,51 @@ type redisInfo struct {
 	redisVersion    string
 }
 
+// redisMemory finds the memory used by Redis and its limit (0 means unlimited) in the memory section of INFO.
+func redisMemory(rawInfo string) (used, max uint64) {
+	for _, l := range strings.Split(rawInfo, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(l), ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		switch kv[0] {
+		case "used_memory":
+			used, _ = strconv.ParseUint(kv[1], 10, 64)
+		case "maxmemory":
+			max, _ = strconv.ParseUint(kv[1], 10, 64)
+		}
+	}
+	return
+}
+
+// redisReplOffset finds the offset of replication applied in the replication section of INFO, which
+// is the one received from master for a replica.
+func redisReplOffset(rawInfo string) (uint64, error) {
+	var role, master, replica string
+	for _, l := range strings.Split(rawInfo, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(l), ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		switch kv[0] {
+		case "role":
+			role = kv[1]
+		case "master_repl_offset":
+			master = kv[1]
+		case "slave_repl_offset":
+			replica = kv[1]
+		}
+	}
+	offset := master
+	if role == "slave" {
+		offset = replica
+	}
+	if offset == "" {
+		return 0, fmt.Errorf("no replication offset of %s", role)
+	}
+	return strconv.ParseUint(offset, 10, 64)
+}
+
 func checkRedisInfo(rawInfo string) (info redisInfo, err error) {
 	lines := strings.Split(strings.TrimSpace(rawInfo), "\n")
 	for _, l := range lines {
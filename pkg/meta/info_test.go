@@ -246,6 +246,16 @@ func TestParseRedisInfo(t *testing.T) {
 		if info.maxMemoryPolicy != "allkeys-lru" {
 			t.Fatalf("Expect %s, got %s", "allkeys-lru", info.maxMemoryPolicy)
 		}
+		if used, max := redisMemory(input); used != 200001664 || max != 200000000 {
+			t.Fatalf("Expect used memory 200001664 of 200000000, got %d of %d", used, max)
+		}
+		if offset, err := redisReplOffset(input); err != nil || offset != 0 {
+			t.Fatalf("Expect replication offset 0 of master, got %d: %v", offset, err)
+		}
+		replica := "# Replication\nrole:slave\nmaster_link_status:up\nslave_repl_offset:1234\nmaster_repl_offset:1234\n"
+		if offset, err := redisReplOffset(replica); err != nil || offset != 1234 {
+			t.Fatalf("Expect replication offset 1234 of replica, got %d: %v", offset, err)
+		}
 	})
 	t.Run("Test fields that may emit warnings", func(t *testing.T) {
 		input := `# Server
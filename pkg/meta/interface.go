@@ -41,6 +41,79 @@ const (
 	Info = 1003
 	// FillCache is a message to build cache for target directories/files
 	FillCache = 1004
+	// Clone is a message to clone a file or directory tree by sharing its data
+	Clone = 1005
+	// SlowOps is a message to get the recent slow operations of metadata
+	SlowOps = 1006
+	// PendingOps is a message to get the operations in progress
+	PendingOps = 1007
+	// CacheSpace is a message to get the space of cache and the size of target paths
+	CacheSpace = 1008
+	// ChangeAttrs is a message to change the mode or owner of a file or directory tree
+	ChangeAttrs = 1009
+	// ChangeFlags is a message to set or clear the flags (immutable or append-only) of a node
+	ChangeFlags = 1010
+	// RefreshCreds is a message to replace the credentials of object storage
+	RefreshCreds = 1011
+	// CacheStats is a message to get (and optionally reset) the counters of block cache
+	CacheStats = 1012
+	// CompactFile is a message to rewrite all the chunks of a file into single slices
+	CompactFile = 1013
+	// FillAttrCache is a message to load the attributes of directory trees into the inode cache of a client
+	FillAttrCache = 1014
+	// FillParents is a message to load the entries along some paths into the inode cache of a client
+	FillParents = 1015
+	// StaleChunk is a message to drop the data of a chunk cached by a client, which is changed by other clients
+	StaleChunk = 1016
+	// Profile is a message to capture a profile (CPU, heap or goroutine) of a client
+	Profile = 1017
+	// RmrProgress is a message to get the number of entries removed by a paced Rmr in progress
+	RmrProgress = 1018
+	// PauseBackground is a message to pause or resume the background tasks of a client
+	PauseBackground = 1019
+	// ManageSnapshot is a message to create, list, roll back or delete the named snapshots of directories
+	ManageSnapshot = 1020
+	// CheckCache is a message to get how much data of the target paths is in the cache of a client
+	CheckCache = 1021
+)
+
+// Operations of ManageSnapshot, which are sent as the first byte of the message.
+const (
+	SnapshotCreate = iota + 1
+	SnapshotList
+	SnapshotRollback
+	SnapshotDelete
+)
+
+// Flags of FillCache, which are sent as an optional byte at the end of the message.
+const (
+	// FillCacheStats asks for the number of skipped paths in the reply.
+	FillCacheStats = 1
+	// FillCacheThreads asks for the number of threads used in the reply, after the stats.
+	FillCacheThreads = 2
+	// FillCacheAfter skips the files modified before the time (unix nanoseconds) following the flags,
+	// and asks for the number of them in the reply, after the threads.
+	FillCacheAfter = 4
+	// FillCacheErrors asks for FillCacheAgain in the reply if some files failed to be warmed up.
+	FillCacheErrors = 8
+	// FillCacheSizes asks for the bytes warmed up for every path in the reply, after the number of
+	// old files, as the number of paths (zero in background) followed by the sizes.
+	FillCacheSizes = 16
+	// FillCachePhased prefetches the metadata of the files before fetching their blocks, overlapped
+	// as a pipeline, and asks for the number of files done in each phase in the reply, after the sizes
+	// (zeros if it's warmed up in one phase, e.g. for a single file).
+	FillCachePhased = 32
+)
+
+// Status of FillCache in the first byte of the reply, any other non-zero value is a terminal error.
+const (
+	// FillCacheOK means all the files are warmed up (or skipped).
+	FillCacheOK = 0
+	// FillCacheAgain means some files failed because of transient errors (e.g. object storage),
+	// the batch could be sent again.
+	FillCacheAgain = uint8(syscall.EAGAIN & 0xff)
+	// FillCacheInvalid means the message or some flags are not supported by the mount point.
+	FillCacheInvalid = uint8(syscall.EINVAL & 0xff)
 )
 
 const (
@@ -70,11 +143,28 @@ const (
 	SetAttrCtime
 	SetAttrAtimeNow
 	SetAttrMtimeNow
+	// SetAttrFlag changes the flags (FlagImmutable or FlagAppend), which is only allowed for root.
+	SetAttrFlag
+	// SetAttrAtimeRead updates atime for an access (read or readdir) as AtimeMode of the client
+	// allows, ctime is not changed.
+	SetAttrAtimeRead
+)
+
+const (
+	// FlagImmutable is a flag of node (like chattr +i), the node can't be modified, removed,
+	// renamed or linked, and no entries can be added or removed if it's a directory.
+	FlagImmutable = 1 << iota
+	// FlagAppend is a flag of node (like chattr +a), data can only be appended to the file and
+	// entries can only be added to the directory, it can't be removed, renamed or linked either.
+	FlagAppend
 )
 
 const TrashInode = 0x7FFFFFFF10000000 // larger than vfs.minInternalNode
 const TrashName = ".trash"
 
+// LostFoundName is the directory under root to hold the orphaned inodes recovered by Reparent.
+const LostFoundName = "lost+found"
+
 func isTrash(ino Ino) bool {
 	return ino >= TrashInode
 }
@@ -89,7 +179,7 @@ type MsgCallback func(...interface{}) error
 
 // Attr represents attributes of a node.
 type Attr struct {
-	Flags     uint8  // reserved flags
+	Flags     uint8  // flags of node (FlagImmutable or FlagAppend)
 	Typ       uint8  // type of a node
 	Mode      uint16 // permission mode
 	Uid       uint32 // owner id
@@ -103,12 +193,22 @@ type Attr struct {
 	Ctimensec uint32 // nanosecond part of ctime
 	Nlink     uint32 // number of links (sub-directories or hardlinks)
 	Length    uint64 // length of regular file
+	Btime     int64  // birth time, 0 for the nodes created by old versions (see Birthtime)
+	Btimensec uint32 // nanosecond part of btime
 
 	Parent    Ino  // inode of parent, only for Directory
 	Full      bool // the attributes are completed or not
 	KeepCache bool // whether to keep the cached page or not
 }
 
+// Birthtime returns the birth time of the node, which is ctime if it's not stored.
+func (a *Attr) Birthtime() time.Time {
+	if a.Btime == 0 && a.Btimensec == 0 {
+		return time.Unix(a.Ctime, int64(a.Ctimensec))
+	}
+	return time.Unix(a.Btime, int64(a.Btimensec))
+}
+
 func typeToStatType(_type uint8) uint32 {
 	switch _type & 0x7F {
 	case TypeDirectory:
@@ -193,6 +293,14 @@ type Slice struct {
 	Len     uint32
 }
 
+// CompactStats is the result of CompactFile.
+type CompactStats struct {
+	Chunks    int    `json:"chunks"`     // number of chunks rewritten
+	OldSlices int    `json:"old_slices"` // number of slices before the compaction
+	NewSlices int    `json:"new_slices"` // number of slices after the compaction
+	Bytes     uint64 `json:"bytes"`      // bytes written into new slices
+}
+
 // Summary represents the total number of files/directories and
 // total length of all files inside a directory.
 type Summary struct {
@@ -207,6 +315,8 @@ type SessionInfo struct {
 	HostName   string
 	MountPoint string
 	ProcessID  int
+	OpsRate    float64 `json:",omitempty"` // operations per second in the last heartbeat interval
+	Throttled  bool    `json:",omitempty"` // whether the operations are throttled by ClientOpsLimit
 }
 
 type Flock struct {
@@ -253,6 +363,9 @@ type Meta interface {
 	ListSessions() ([]*Session, error)
 	// CleanStaleSessions cleans up sessions not active for more than 5 minutes
 	CleanStaleSessions()
+	// KillSession releases the locks of session sid, deletes its sustained inodes and removes it,
+	// no matter whether it's still active.
+	KillSession(sid uint64) error
 
 	// StatFS returns summary statistics of a volume.
 	StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno
@@ -293,6 +406,11 @@ type Meta interface {
 	Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
 	Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno
+	// ReaddirPage returns about limit entries of a directory after the cursor (empty for the first page,
+	// which includes . and ..), and the cursor of next page, which is empty at the end. It returns at
+	// least one entry unless it's the end. The entries added or removed during the pagination may or
+	// may not be returned.
+	ReaddirPage(ctx Context, inode Ino, wantattr uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno)
 	// Create creates a file in a directory with given name.
 	Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno
 	// Open checks permission on a node and track it as open.
@@ -303,6 +421,19 @@ type Meta interface {
 	Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno
 	// NewChunk returns a new id for new data.
 	NewChunk(ctx Context, chunkid *uint64) syscall.Errno
+	// ReserveChunks reserves the chunk ids in [minid, maxid] for the data imported from outside, so they
+	// will not be returned by NewChunk. It fails with EEXIST if some of them could be used already.
+	ReserveChunks(ctx Context, minid, maxid uint64) syscall.Errno
+	// SetSliceChecksums stores the checksums of the blocks of a slice, which are used to verify the blocks
+	// read from object storage. They are removed together with the slice.
+	SetSliceChecksums(ctx Context, chunkid uint64, sums []uint32) syscall.Errno
+	// GetSliceChecksums returns the checksums of the blocks of a slice, or ENOENT if they are not stored.
+	GetSliceChecksums(ctx Context, chunkid uint64, sums *[]uint32) syscall.Errno
+	// SetSliceData stores the data of a small slice inline, instead of in object storage. It is removed
+	// together with the slice.
+	SetSliceData(ctx Context, chunkid uint64, data []byte) syscall.Errno
+	// GetSliceData returns the data of a slice stored inline, or ENOENT if it's not stored.
+	GetSliceData(ctx Context, chunkid uint64, data *[]byte) syscall.Errno
 	// Write put a slice of data on top of the given chunk.
 	Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno
 	// InvalidateChunkCache invalidate chunk cache
@@ -316,6 +447,9 @@ type Meta interface {
 	ListXattr(ctx Context, inode Ino, dbuff *[]byte) syscall.Errno
 	// SetXattr update the extended attribute of a node.
 	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
+	// CompareAndSwapXattr sets the extended attribute to value only if its current value is expected
+	// (empty means it doesn't exist or is empty) in one transaction, or fails with ECANCELED.
+	CompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno
 	// RemoveXattr removes the extended attribute of a node.
 	RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
 	// Flock tries to put a lock on given file.
@@ -325,13 +459,40 @@ type Meta interface {
 	// Setlk sets a file range lock on given file.
 	Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno
 
+	// PauseBackground pauses (or resumes) the background tasks of the client: the cleanup of deleted
+	// files, leaked slices and trash, the compaction of chunks, and the deletion of slices.
+	PauseBackground(pause bool)
+	// BackgroundPaused returns whether the background tasks are paused.
+	BackgroundPaused() bool
+	// ReadJournal returns at most limit events in the journal after the sequence number since, in order.
+	// The events are appended by the clients asynchronously, so the ones with smaller numbers could be
+	// appended later, and the oldest ones are removed beyond JournalSize of the volume.
+	ReadJournal(ctx Context, since uint64, limit int, events *[]*JournalEvent) syscall.Errno
+
 	// Compact all the chunks by merge small slices together
 	CompactAll(ctx Context, bar *utils.Bar) syscall.Errno
+	// CompactFile rewrites every chunk of a file into one slice, including the large slices skipped by
+	// the compaction in background. The chunks written concurrently are retried, or fail with EBUSY.
+	CompactFile(ctx Context, inode Ino, stats *CompactStats) syscall.Errno
+	// SetCompactHint overrides CompactSlices and CompactBytes (if not zero) of the config for the
+	// chunks of the opened file inode.
+	SetCompactHint(inode Ino, slices int, bytes uint64)
 	// ListSlices returns all slices used by all files.
 	ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno
+	// Reparent links the orphaned inodes, which have no entry referring to them, into /lost+found.
+	Reparent(ctx Context, recovered *[]*Entry) syscall.Errno
+	// FixNlink recomputes the nlink of all directories (2 plus the number of subdirectories) and fixes
+	// the wrong ones, which are returned with the nlink before and after.
+	FixNlink(ctx Context, fixed map[Ino][2]uint32) syscall.Errno
+	// CheckXattrs verifies the checksums of all the extended attributes, the corrupted ones are returned.
+	CheckXattrs(ctx Context, corrupted map[Ino][]string) syscall.Errno
 
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
+	// SlowOps returns the recent operations slower than the threshold, and clears them if reset is true.
+	SlowOps(reset bool) []SlowOp
+	// CheckHealth pings the meta engine and reads a key, and reports the latency and the warnings of engine.
+	CheckHealth() *Health
 
 	// Dump the tree under root, which may be modified by checkRoot
 	DumpMeta(w io.Writer, root Ino) error
@@ -389,6 +550,12 @@ func NewClient(uri string, conf *Config) Meta {
 	if err != nil {
 		logger.Fatalf("Meta is not available: %s", err)
 	}
+	if conf.Replica != "" && conf.ListConsistency == ListEventual {
+		logger.Infof("Meta replica: %s", utils.RemovePassword(conf.Replica))
+		if err = openReplica(m, driver, conf.Replica, conf); err != nil {
+			logger.Fatalf("Meta replica is not available: %s", err)
+		}
+	}
 	return m
 }
 
@@ -401,10 +568,6 @@ func newSessionInfo() *SessionInfo {
 	return &SessionInfo{Version: version.Version(), HostName: host, ProcessID: os.Getpid()}
 }
 
-func timeit(start time.Time) {
-	opDist.Observe(time.Since(start).Seconds())
-}
-
 // Get full path of an inode; a random one is picked if it has multiple hard links
 func GetPath(m Meta, ctx Context, inode Ino) (string, syscall.Errno) {
 	var names []string
@@ -0,0 +1,266 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	journalEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "journal_events",
+		Help: "The number of events appended to the change journal.",
+	})
+	journalDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "journal_events_dropped",
+		Help: "The number of events of the change journal dropped because the meta engine failed.",
+	})
+)
+
+// JournalEvent is a change of the file system recorded in the journal of the volume.
+type JournalEvent struct {
+	Seq       uint64 // increasing with the order the events are appended, unique in the volume
+	Time      time.Time
+	Op        string // create, mknod, mkdir, symlink, link, write, truncate, fallocate, unlink, rmdir or rename
+	Sid       uint64
+	Uid       uint32
+	Gid       uint32
+	Inode     Ino    `json:",omitempty"`
+	Parent    Ino    `json:",omitempty"`
+	Name      string `json:",omitempty"`
+	DstParent Ino    `json:",omitempty"` // target of rename
+	DstName   string `json:",omitempty"`
+	Detail    string `json:",omitempty"`
+}
+
+const (
+	journalBatch   = 1000
+	journalRetries = 5 // tries of a batch before it's dropped, the transaction retries the conflicts in each one
+)
+
+// journal appends the events of a client in batches in background, the callers are blocked when
+// the buffer is full, so no event is lost unless the meta engine fails.
+type journal struct {
+	sync.RWMutex
+	closed  bool
+	pending sync.WaitGroup // the events logged but not written yet
+	queue   chan *JournalEvent
+	done    chan struct{}
+	write   func(events []*JournalEvent) error
+}
+
+func newJournal(write func([]*JournalEvent) error) *journal {
+	j := &journal{
+		queue: make(chan *JournalEvent, journalBatch*10),
+		done:  make(chan struct{}),
+		write: write,
+	}
+	go j.run()
+	return j
+}
+
+func (j *journal) log(e *JournalEvent) {
+	j.RLock()
+	defer j.RUnlock()
+	if j.closed {
+		journalDropped.Inc()
+		return
+	}
+	j.pending.Add(1)
+	j.queue <- e
+}
+
+// flush waits for the events logged before to be written.
+func (j *journal) flush() {
+	j.Lock() // no event is logged while waiting
+	defer j.Unlock()
+	j.pending.Wait()
+}
+
+func (j *journal) run() {
+	defer close(j.done)
+	for e := range j.queue {
+		batch := []*JournalEvent{e}
+	FILL:
+		for len(batch) < journalBatch {
+			select {
+			case e, ok := <-j.queue:
+				if !ok {
+					break FILL
+				}
+				batch = append(batch, e)
+			default:
+				break FILL
+			}
+		}
+		var err error
+		for i := 0; i < journalRetries; i++ {
+			if err = j.write(batch); err == nil {
+				break
+			}
+			if i+1 < journalRetries {
+				logger.Warnf("append %d events into journal (tried %d): %s", len(batch), i+1, err)
+				time.Sleep(time.Millisecond * 100 << i)
+			}
+		}
+		if err != nil {
+			logger.Errorf("append %d events into journal: %s", len(batch), err)
+			journalDropped.Add(float64(len(batch)))
+		} else {
+			journalEvents.Add(float64(len(batch)))
+		}
+		j.pending.Add(-len(batch))
+	}
+}
+
+func (j *journal) isClosed() bool {
+	j.RLock()
+	defer j.RUnlock()
+	return j.closed
+}
+
+// close appends the pending events, the events logged after that are dropped.
+func (j *journal) close() {
+	j.Lock()
+	if j.closed {
+		j.Unlock()
+		return
+	}
+	j.closed = true
+	close(j.queue)
+	j.Unlock()
+	<-j.done
+}
+
+// openJournal starts the writer of journal, or a new one if it's closed with the last session.
+func (m *baseMeta) openJournal() {
+	if m.journal != nil && !m.journal.isClosed() {
+		return
+	}
+	_ = prometheus.Register(journalEvents)
+	_ = prometheus.Register(journalDropped)
+	m.journal = newJournal(m.appendJournal)
+}
+
+// appendJournal assigns the sequence numbers to the events and appends them in one transaction,
+// the oldest ones beyond JournalSize are removed every a few batches.
+func (m *baseMeta) appendJournal(events []*JournalEvent) error {
+	n := uint64(len(events))
+	last, err := m.en.doAppendJournal(len(events), func(first uint64) ([][]byte, error) {
+		records := make([][]byte, n)
+		for i, e := range events {
+			e.Seq = first + uint64(i)
+			var err error
+			if records[i], err = json.Marshal(e); err != nil {
+				return nil, err
+			}
+		}
+		return records, nil
+	})
+	if err != nil {
+		return err
+	}
+	first := last - n + 1
+	size := uint64(m.fmt.JournalSize)
+	if size == 0 || last <= size {
+		return nil
+	}
+	step := size / 16
+	if step == 0 {
+		step = 1
+	} else if step > 1024 {
+		step = 1024
+	}
+	if (first-1)/step != last/step { // one of the clients removes them
+		if err = m.en.doTrimJournal(last - size + 1); err != nil {
+			logger.Warnf("trim journal before %d: %s", last-size+1, err)
+		}
+	}
+	return nil
+}
+
+func (m *baseMeta) journalEnabled() bool {
+	return m.journal != nil && m.fmt.JournalSize > 0
+}
+
+func (m *baseMeta) journalEvent(ctx Context, op string, parent Ino, name string, inode Ino, detail string) {
+	if !m.journalEnabled() {
+		return
+	}
+	m.journal.log(&JournalEvent{
+		Time:   time.Now(),
+		Op:     op,
+		Sid:    m.sid,
+		Uid:    ctx.Uid(),
+		Gid:    ctx.Gid(),
+		Inode:  inode,
+		Parent: parent,
+		Name:   name,
+		Detail: detail,
+	})
+}
+
+func (m *baseMeta) journalRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, inode Ino) {
+	if !m.journalEnabled() {
+		return
+	}
+	m.journal.log(&JournalEvent{
+		Time:      time.Now(),
+		Op:        "rename",
+		Sid:       m.sid,
+		Uid:       ctx.Uid(),
+		Gid:       ctx.Gid(),
+		Inode:     inode,
+		Parent:    parentSrc,
+		Name:      nameSrc,
+		DstParent: parentDst,
+		DstName:   nameDst,
+	})
+}
+
+// journalWrite records the data written into a file (or copied from another one) at off.
+func (m *baseMeta) journalWrite(ctx Context, inode Ino, off, length uint64) {
+	if m.journalEnabled() {
+		m.journalEvent(ctx, "write", 0, "", inode, fmt.Sprintf("off=%d len=%d", off, length))
+	}
+}
+
+func (m *baseMeta) ReadJournal(ctx Context, since uint64, limit int, events *[]*JournalEvent) syscall.Errno {
+	if limit <= 0 {
+		limit = journalBatch
+	}
+	records, err := m.en.doReadJournal(since, limit)
+	if err != nil {
+		return errno(err)
+	}
+	*events = make([]*JournalEvent, 0, len(records))
+	for _, r := range records {
+		var e JournalEvent
+		if err = json.Unmarshal(r, &e); err != nil {
+			logger.Warnf("invalid event in journal: %s", err)
+			return syscall.EIO
+		}
+		*events = append(*events, &e)
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testJournal(t *testing.T, m Meta, base *baseMeta) {
+	ctx := NewContext(100, 1, []uint32{2})
+	var events []*JournalEvent
+	if st := m.ReadJournal(ctx, 0, 0, &events); st != 0 || len(events) != 0 {
+		t.Fatalf("journal should be empty when disabled: %d events %s", len(events), st)
+	}
+	base.fmt.JournalSize = 100
+	base.openJournal()
+	defer func() {
+		base.journal.close()
+		base.fmt.JournalSize = 0
+	}()
+	var parent, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "jd", 0777, 022, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir jd: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create jd/f: %s", st)
+	}
+	var chunkid uint64
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 1, 100, Slice{Chunkid: chunkid, Size: 10, Len: 10}); st != 0 {
+		t.Fatalf("write jd/f: %s", st)
+	}
+	if st := m.Rename(ctx, parent, "f", parent, "g", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename jd/f: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 10, attr); st != 0 {
+		t.Fatalf("truncate jd/g: %s", st)
+	}
+	if st := m.Unlink(ctx, parent, "g"); st != 0 {
+		t.Fatalf("unlink jd/g: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "jd"); st != 0 {
+		t.Fatalf("rmdir jd: %s", st)
+	}
+	base.journal.flush()
+
+	if st := m.ReadJournal(ctx, 0, 0, &events); st != 0 {
+		t.Fatalf("read journal: %s", st)
+	}
+	var ops []string
+	for i, e := range events {
+		ops = append(ops, e.Op)
+		if i > 0 && e.Seq != events[i-1].Seq+1 {
+			t.Fatalf("sequence numbers are not continuous: %d after %d", e.Seq, events[i-1].Seq)
+		}
+	}
+	if expected := []string{"mkdir", "create", "write", "rename", "truncate", "unlink", "rmdir"}; !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("expect events %v, but got %v", expected, ops)
+	}
+	if e := events[1]; e.Uid != 1 || e.Gid != 2 || e.Sid != base.sid || e.Parent != parent || e.Name != "f" || e.Inode != inode {
+		t.Fatalf("unexpected create event: %+v", e)
+	}
+	if e := events[2]; e.Inode != inode || e.Detail != fmt.Sprintf("off=%d len=10", ChunkSize+100) {
+		t.Fatalf("unexpected write event: %+v", e)
+	}
+	if e := events[3]; e.Name != "f" || e.DstParent != parent || e.DstName != "g" {
+		t.Fatalf("unexpected rename event: %+v", e)
+	}
+	if e := events[5]; e.Inode != inode {
+		t.Fatalf("unexpected unlink event: %+v", e)
+	}
+
+	// resume from the last one consumed
+	var rest []*JournalEvent
+	if st := m.ReadJournal(ctx, events[2].Seq, 2, &rest); st != 0 || len(rest) != 2 {
+		t.Fatalf("resume from %d: %d events %s", events[2].Seq, len(rest), st)
+	}
+	if rest[0].Seq != events[3].Seq || rest[0].Op != "rename" || rest[1].Op != "truncate" {
+		t.Fatalf("resume from %d: %+v %+v", events[2].Seq, rest[0], rest[1])
+	}
+	last := events[len(events)-1].Seq
+	if st := m.ReadJournal(ctx, last, 0, &rest); st != 0 || len(rest) != 0 {
+		t.Fatalf("no event after %d: %d events %s", last, len(rest), st)
+	}
+
+	// only the latest ones are kept
+	base.fmt.JournalSize = 3
+	base.openJournal()
+	for i := 0; i < 5; i++ {
+		if st := m.Mknod(ctx, 1, fmt.Sprintf("j%d", i), TypeFile, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("mknod j%d: %s", i, st)
+		}
+		if st := m.Unlink(ctx, 1, fmt.Sprintf("j%d", i)); st != 0 {
+			t.Fatalf("unlink j%d: %s", i, st)
+		}
+	}
+	base.journal.flush()
+	if st := m.ReadJournal(ctx, 0, 0, &events); st != 0 || len(events) != 3 {
+		t.Fatalf("expect 3 events kept, but got %d %s", len(events), st)
+	}
+	if e := events[2]; e.Seq != last+10 || e.Op != "unlink" || e.Name != "j4" {
+		t.Fatalf("unexpected last event: %+v", e)
+	}
+	if e := events[0]; e.Seq != last+8 || e.Op != "unlink" || e.Name != "j3" {
+		t.Fatalf("unexpected first event: %+v", e)
+	}
+}
+
+func TestJournalRetry(t *testing.T) {
+	var tries int
+	var written []*JournalEvent
+	j := newJournal(func(events []*JournalEvent) error {
+		if tries++; tries < 3 {
+			return fmt.Errorf("conflicted")
+		}
+		written = append(written, events...)
+		return nil
+	})
+	j.log(&JournalEvent{Op: "mkdir"})
+	j.log(&JournalEvent{Op: "create"})
+	j.flush()
+	if len(written) != 2 || written[0].Op != "mkdir" || written[1].Op != "create" {
+		t.Fatalf("events should be written after retries: %+v", written)
+	}
+	j.close()
+}
@@ -17,6 +17,8 @@
 package meta
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
 	"os/exec"
 	"path"
@@ -77,6 +79,7 @@ func testLoad(t *testing.T, uri, fname string) Meta {
 }
 
 func testDump(t *testing.T, m Meta, root Ino, expect, result string) {
+	result = path.Join(t.TempDir(), result)
 	fp, err := os.OpenFile(result, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		t.Fatalf("open file %s: %s", result, err)
@@ -133,3 +136,143 @@ func TestLoadDump(t *testing.T) {
 		testDump(t, m, 0, sampleFile, "tkv.dump")
 	})
 }
+
+func dumpTree(t *testing.T, m Meta) string {
+	var buf bytes.Buffer
+	if err := m.DumpMeta(&buf, 1); err != nil {
+		t.Fatalf("dump meta: %s", err)
+	}
+	var dm DumpedMeta
+	if err := json.Unmarshal(buf.Bytes(), &dm); err != nil {
+		t.Fatalf("decode dumped meta: %s", err)
+	}
+	data, _ := json.Marshal(dm.FSTree)
+	return string(data)
+}
+
+func TestMigrate(t *testing.T) {
+	_ = os.Remove(settingPath)
+	src := testLoad(t, "sqlite3://"+path.Join(t.TempDir(), "jfs-migrate-src.db"), sampleFile)
+	dst := NewClient("memkv://migrate/jfs", &Config{Retries: 10, Strict: true})
+	dir := t.TempDir()
+	if err := Migrate(src, dst, dir, 1); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	if s, d := dumpTree(t, src), dumpTree(t, dst); s != d {
+		t.Fatalf("tree is different after migrated:\n%s\n%s", s, d)
+	}
+
+	// changes after the first round
+	ctx := Background
+	var inode Ino
+	attr := &Attr{}
+	if st := src.Create(ctx, 1, "new", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := src.Write(ctx, inode, 0, 0, Slice{Chunkid: 1000, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := src.SetXattr(ctx, inode, "user.k", []byte("v"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr: %s", st)
+	}
+	if st := src.Rename(ctx, 1, "new", 1, "renamed", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename: %s", st)
+	}
+	var entries []*Entry
+	if st := src.Readdir(ctx, 1, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	}
+	for _, e := range entries {
+		if e.Attr.Typ == TypeFile && string(e.Name) != "renamed" {
+			if st := src.Unlink(ctx, 1, string(e.Name)); st != 0 {
+				t.Fatalf("unlink %s: %s", e.Name, st)
+			}
+			break
+		}
+	}
+
+	// interrupted after dumped
+	if err := dumpSnapshot(src, path.Join(dir, "pending.json")); err != nil {
+		t.Fatalf("dump snapshot: %s", err)
+	}
+	if err := Migrate(src, dst, dir, 0); err != nil {
+		t.Fatalf("resume migration: %s", err)
+	}
+	if s, d := dumpTree(t, src), dumpTree(t, dst); s != d {
+		t.Fatalf("tree is different after resumed:\n%s\n%s", s, d)
+	}
+	var v []byte
+	if st := dst.Lookup(ctx, 1, "renamed", &inode, attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("lookup renamed: %s %+v", st, attr)
+	}
+	if st := dst.GetXattr(ctx, inode, "user.k", &v); st != 0 || string(v) != "v" {
+		t.Fatalf("getxattr: %s %s", st, v)
+	}
+	var total, avail, iused, iavail, total2, avail2, iused2 uint64
+	_ = src.StatFS(ctx, &total, &avail, &iused, &iavail)
+	_ = dst.StatFS(ctx, &total2, &avail2, &iused2, &iavail)
+	if total-avail != total2-avail2 || iused != iused2 {
+		t.Fatalf("statfs: %d %d != %d %d", total2-avail2, iused2, total-avail, iused)
+	}
+
+	// from tkv into sql
+	dst2 := NewClient("sqlite3://"+path.Join(t.TempDir(), "jfs-migrate-dst.db"), &Config{Retries: 10, Strict: true})
+	if err := Migrate(dst, dst2, t.TempDir(), 2); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	if s, d := dumpTree(t, dst), dumpTree(t, dst2); s != d {
+		t.Fatalf("tree is different after migrated:\n%s\n%s", s, d)
+	}
+	if err := Migrate(src, dst2, t.TempDir(), 1); err == nil {
+		t.Fatalf("migrate into non-empty destination should fail")
+	}
+
+	// new inodes and chunks should not conflict
+	var ninode Ino
+	if st := dst.Create(ctx, 1, "created", 0644, 022, 0, &ninode, attr); st != 0 || ninode <= inode {
+		t.Fatalf("create in destination: %s %d", st, ninode)
+	}
+	var chunkid uint64
+	if st := dst.NewChunk(ctx, &chunkid); st != 0 || chunkid <= 1000 {
+		t.Fatalf("new chunk in destination: %s %d", st, chunkid)
+	}
+}
+
+func TestLoadDumpInline(t *testing.T) {
+	m := NewClient("sqlite3://"+path.Join(t.TempDir(), "jfs-inline-test.db"), &Config{Retries: 10, Strict: true})
+	if err := m.Init(Format{Name: "test", InlineSize: 4096}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var chunkid uint64
+	if st := m.Create(ctx, 1, "f", 0644, 022, 0, &inode, &Attr{}); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.SetSliceData(ctx, chunkid, []byte("hello")); st != 0 {
+		t.Fatalf("set data: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 5, Len: 5}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	var buf bytes.Buffer
+	if err := m.DumpMeta(&buf, 1); err != nil {
+		t.Fatalf("dump meta: %s", err)
+	}
+
+	_ = os.Remove(settingPath)
+	m2 := NewClient("memkv://inline/jfs", &Config{Retries: 10, Strict: true})
+	if err := m2.Reset(); err != nil {
+		t.Fatalf("reset meta: %s", err)
+	}
+	if err := m2.LoadMeta(&buf); err != nil {
+		t.Fatalf("load meta: %s", err)
+	}
+	var data []byte
+	if st := m2.GetSliceData(ctx, chunkid, &data); st != 0 || string(data) != "hello" {
+		t.Fatalf("inline data after loaded: %q %s", data, st)
+	}
+}
@@ -28,6 +28,22 @@ var (
 		Name: "transaction_restart",
 		Help: "The number of times a transaction is restarted.",
 	})
+	txRestartByOp = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transaction_restart_by_op",
+		Help: "The number of times a transaction is restarted, by the operation starting it.",
+	}, []string{"op"})
+	txConflictFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "transaction_conflict_failures",
+		Help: "The number of transactions failed with EAGAIN after too many restarts.",
+	})
+	revalidatedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "meta_revalidated_chunks",
+		Help: "The number of cached chunks checked against the meta engine.",
+	})
+	staleChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "meta_stale_chunks",
+		Help: "The number of cached chunks dropped as they are changed by other clients.",
+	})
 	opDist = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "meta_ops_durations_histogram_seconds",
 		Help:    "Operation latency distributions.",
@@ -38,5 +54,9 @@ var (
 func InitMetrics() {
 	prometheus.MustRegister(txDist)
 	prometheus.MustRegister(txRestart)
+	prometheus.MustRegister(txRestartByOp)
+	prometheus.MustRegister(txConflictFailures)
 	prometheus.MustRegister(opDist)
+	prometheus.MustRegister(revalidatedChunks)
+	prometheus.MustRegister(staleChunks)
 }
@@ -0,0 +1,392 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// migrator is implemented by the meta engines to be the destination of a migration.
+type migrator interface {
+	prepareLoad() error
+	// cleanEntry removes all the records of inode, which may be stored in the shape of any of the versions.
+	cleanEntry(inode Ino, versions ...*DumpedEntry) error
+	// writeEntry writes the records of an entry.
+	writeEntry(e *DumpedEntry) error
+	// writeState writes the setting, counters, files to be deleted and the references of the given slices.
+	writeState(dm *DumpedMeta, cs *DumpedCounters, refs map[sliceID]int) error
+}
+
+type sliceID struct {
+	Chunkid uint64
+	Size    uint32
+}
+
+// snapshot is a dump of the source, loaded into memory.
+type snapshot struct {
+	dm      *DumpedMeta
+	entries map[Ino]*DumpedEntry
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	dm := &DumpedMeta{}
+	if err = json.NewDecoder(f).Decode(dm); err != nil {
+		return nil, fmt.Errorf("decode %s: %s", path, err)
+	}
+	return newSnapshot(dm)
+}
+
+func newSnapshot(dm *DumpedMeta) (*snapshot, error) {
+	if dm.FSTree == nil {
+		return nil, fmt.Errorf("no entries found")
+	}
+	dm.FSTree.Attr.Inode = 1
+	entries := make(map[Ino]*DumpedEntry)
+	if err := collectEntry(dm.FSTree, entries, nil); err != nil {
+		return nil, err
+	}
+	if dm.Trash != nil {
+		if err := collectEntry(dm.Trash, entries, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &snapshot{dm, entries}, nil
+}
+
+// counters returns the counters of the entries in snapshot, the next ones are not smaller than those of source.
+func (s *snapshot) counters() *DumpedCounters {
+	cs := &DumpedCounters{NextInode: 2, NextChunk: 1}
+	for inode, e := range s.entries {
+		var length uint64
+		switch typeFromString(e.Attr.Type) {
+		case TypeFile:
+			length = e.Attr.Length
+			for _, c := range e.Chunks {
+				for _, sl := range c.Slices {
+					if cs.NextChunk <= int64(sl.Chunkid) {
+						cs.NextChunk = int64(sl.Chunkid) + 1
+					}
+				}
+			}
+		case TypeDirectory:
+			length = 4 << 10
+		case TypeSymlink:
+			length = uint64(len(e.Symlink))
+		}
+		if inode > 1 && inode != TrashInode {
+			cs.UsedSpace += align4K(length)
+			cs.UsedInodes++
+		}
+		if inode < TrashInode {
+			if cs.NextInode <= int64(inode) {
+				cs.NextInode = int64(inode) + 1
+			}
+		} else if cs.NextTrash < int64(inode)-TrashInode {
+			cs.NextTrash = int64(inode) - TrashInode
+		}
+	}
+	if src := s.dm.Counters; src != nil {
+		max := func(a *int64, b int64) {
+			if *a < b {
+				*a = b
+			}
+		}
+		max(&cs.NextInode, src.NextInode)
+		max(&cs.NextChunk, src.NextChunk)
+		max(&cs.NextSession, src.NextSession)
+		max(&cs.NextTrash, src.NextTrash)
+	}
+	return cs
+}
+
+func sortedXattrs(xattrs []*DumpedXattr) []*DumpedXattr {
+	r := append([]*DumpedXattr(nil), xattrs...)
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// sameEntry returns whether the records of two versions of an entry are the same.
+func sameEntry(a, b *DumpedEntry) bool {
+	// the parent of a file with multiple links could be any of them
+	if a.Parent != b.Parent && (typeFromString(a.Attr.Type) != TypeFile || a.Attr.Nlink < 2) {
+		return false
+	}
+	if a.Symlink != b.Symlink || !reflect.DeepEqual(a.Attr, b.Attr) ||
+		len(a.Xattrs) != len(b.Xattrs) || len(a.Entries) != len(b.Entries) {
+		return false
+	}
+	if len(a.Xattrs) > 0 && !reflect.DeepEqual(sortedXattrs(a.Xattrs), sortedXattrs(b.Xattrs)) {
+		return false
+	}
+	var ca, cb []*DumpedChunk
+	for _, c := range a.Chunks {
+		if len(c.Slices) > 0 {
+			ca = append(ca, c)
+		}
+	}
+	for _, c := range b.Chunks {
+		if len(c.Slices) > 0 {
+			cb = append(cb, c)
+		}
+	}
+	if !reflect.DeepEqual(ca, cb) {
+		return false
+	}
+	for name, e := range a.Entries {
+		o, ok := b.Entries[name]
+		if !ok || o.Attr.Inode != e.Attr.Inode || o.Attr.Type != e.Attr.Type {
+			return false
+		}
+	}
+	return true
+}
+
+func addSlices(ids map[sliceID]int, e *DumpedEntry) {
+	if e == nil {
+		return
+	}
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			ids[sliceID{s.Chunkid, s.Size}] = 0
+		}
+	}
+}
+
+// applySnapshot changes the destination from the state of old (nil if it's empty) to that of s,
+// it returns the number of changed entries. It can be applied again if interrupted.
+func applySnapshot(dst migrator, old, s *snapshot) (int, error) {
+	var changed []*DumpedEntry
+	var removed []Ino
+	refs := make(map[sliceID]int)
+	var prev = func(inode Ino) *DumpedEntry { return nil }
+	if old != nil {
+		prev = func(inode Ino) *DumpedEntry { return old.entries[inode] }
+		for inode, e := range old.entries {
+			if _, ok := s.entries[inode]; !ok {
+				removed = append(removed, inode)
+				addSlices(refs, e)
+			}
+		}
+	}
+	for inode, e := range s.entries {
+		if o := prev(inode); o == nil || !sameEntry(o, e) {
+			changed = append(changed, e)
+			addSlices(refs, o)
+			addSlices(refs, e)
+		}
+	}
+	// the references of affected slices are counted in the whole tree
+	for _, e := range s.entries {
+		for _, c := range e.Chunks {
+			for _, sl := range c.Slices {
+				id := sliceID{sl.Chunkid, sl.Size}
+				if n, ok := refs[id]; ok {
+					refs[id] = n + 1
+				}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	todo := make(chan func() error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range todo {
+				if err := f(); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, inode := range removed {
+		inode := inode
+		todo <- func() error { return dst.cleanEntry(inode, old.entries[inode]) }
+	}
+	for _, e := range changed {
+		e := e
+		todo <- func() error {
+			inode := e.Attr.Inode
+			if err := dst.cleanEntry(inode, prev(inode), e); err != nil {
+				return fmt.Errorf("clean inode %d: %s", inode, err)
+			}
+			if err := dst.writeEntry(e); err != nil {
+				return fmt.Errorf("write inode %d: %s", inode, err)
+			}
+			return nil
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	if err := dst.writeState(s.dm, s.counters(), refs); err != nil {
+		return 0, fmt.Errorf("write counters: %s", err)
+	}
+	return len(changed) + len(removed), nil
+}
+
+func dumpSnapshot(m Meta, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = m.DumpMeta(f, 1); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// Migrate copies the metadata from src into dst (sessions are skipped), the states are kept in dir to
+// resume an interrupted migration. Every round dumps src, and applies the entries changed since the
+// previous round to dst, until there is no change or the number of rounds reaches rounds. Finally the
+// entries in dst are verified against the last round.
+func Migrate(src, dst Meta, dir string, rounds int) error {
+	d, ok := dst.(migrator)
+	if !ok {
+		return fmt.Errorf("%s is not supported as destination", dst.Name())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	basePath := filepath.Join(dir, "snapshot.json")
+	pendingPath := filepath.Join(dir, "pending.json")
+	base, err := readSnapshot(basePath)
+	if err != nil {
+		return err
+	}
+	pending, err := readSnapshot(pendingPath)
+	if err != nil {
+		return err
+	}
+	if base == nil && pending == nil {
+		if err = d.prepareLoad(); err != nil {
+			return err
+		}
+	}
+	apply := func(s *snapshot) (int, error) {
+		n, err := applySnapshot(d, base, s)
+		if err != nil {
+			return 0, err
+		}
+		if err = os.Rename(pendingPath, basePath); err != nil {
+			return 0, err
+		}
+		logger.Infof("Applied %d changed entries (%d in total) to %s", n, len(s.entries), dst.Name())
+		base = s
+		return n, nil
+	}
+	if pending != nil {
+		logger.Infof("Resume the interrupted migration in %s", dir)
+		if _, err = apply(pending); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < rounds; i++ {
+		logger.Infof("Dump metadata from %s (round %d)", src.Name(), i+1)
+		if err = dumpSnapshot(src, pendingPath); err != nil {
+			return fmt.Errorf("dump %s: %s", src.Name(), err)
+		}
+		if pending, err = readSnapshot(pendingPath); err != nil {
+			return err
+		}
+		if n, err := apply(pending); err != nil {
+			return err
+		} else if n == 0 {
+			break
+		}
+	}
+	if base == nil {
+		return fmt.Errorf("nothing is migrated")
+	}
+	return verifyMigrated(dst, base)
+}
+
+// verifyMigrated checks that the entries in dst are the same as those in snapshot s.
+func verifyMigrated(dst Meta, s *snapshot) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(dst.DumpMeta(pw, 1))
+	}()
+	dm := &DumpedMeta{}
+	err := json.NewDecoder(pr).Decode(dm)
+	_ = pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("dump %s: %s", dst.Name(), err)
+	}
+	m, err := newSnapshot(dm)
+	if err != nil {
+		return err
+	}
+	if len(m.entries) != len(s.entries) {
+		return fmt.Errorf("found %d entries in %s, but %d in source", len(m.entries), dst.Name(), len(s.entries))
+	}
+	// the timestamps are kept in microseconds by SQL engines
+	usec := func(e *DumpedEntry) *DumpedEntry {
+		c, a := *e, *e.Attr
+		a.Atimensec -= a.Atimensec % 1000
+		a.Mtimensec -= a.Mtimensec % 1000
+		a.Ctimensec -= a.Ctimensec % 1000
+		a.Btimensec -= a.Btimensec % 1000
+		c.Attr = &a
+		return &c
+	}
+	for inode, e := range s.entries {
+		if o := m.entries[inode]; o == nil || !sameEntry(usec(o), usec(e)) {
+			return fmt.Errorf("inode %d in %s is different from source", inode, dst.Name())
+		}
+	}
+	cs, dcs := s.counters(), dm.Counters
+	if dcs.UsedSpace != cs.UsedSpace || dcs.UsedInodes != cs.UsedInodes {
+		return fmt.Errorf("used space %d and inodes %d in %s, but %d and %d in source", dcs.UsedSpace, dcs.UsedInodes, dst.Name(), cs.UsedSpace, cs.UsedInodes)
+	}
+	logger.Infof("Verified %d entries (%d bytes) in %s", len(m.entries), cs.UsedSpace, dst.Name())
+	return nil
+}
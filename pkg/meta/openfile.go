@@ -11,23 +11,64 @@ type openFile struct {
 	refs      int
 	lastCheck time.Time
 	chunks    map[uint32][]Slice
+
+	compactSlices int    // overrides CompactSlices if not zero
+	compactBytes  uint64 // overrides CompactBytes if not zero
 }
 
 type openfiles struct {
 	sync.Mutex
-	expire time.Duration
-	files  map[Ino]*openFile
+	expire   time.Duration
+	mode     string
+	files    map[Ino]*openFile
+	version  uint64         // increased by every local change
+	fetching int            // number of attributes being fetched
+	changed  map[Ino]uint64 // version of the last local change of inodes, only kept when fetching
 }
 
-func newOpenFiles(expire time.Duration) *openfiles {
+func newOpenFiles(expire time.Duration, mode string) *openfiles {
 	of := &openfiles{
-		expire: expire,
-		files:  make(map[Ino]*openFile),
+		expire:  expire,
+		mode:    mode,
+		files:   make(map[Ino]*openFile),
+		changed: make(map[Ino]uint64),
 	}
 	go of.cleanup()
 	return of
 }
 
+// startFetch returns the version before fetching the attributes from the engine,
+// endFetch should be called after that.
+func (o *openfiles) startFetch() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	o.fetching++
+	return o.version
+}
+
+func (o *openfiles) endFetch() {
+	o.Lock()
+	defer o.Unlock()
+	o.fetching--
+	if o.fetching == 0 && len(o.changed) > 0 {
+		o.changed = make(map[Ino]uint64)
+	}
+}
+
+// modified records a local change of ino, o should be locked.
+func (o *openfiles) modified(ino Ino) {
+	o.version++
+	if o.fetching > 0 && o.mode != ConsistencyRelaxed {
+		o.changed[ino] = o.version
+	}
+}
+
+// outdated returns whether ino is changed by this client since ver, then the fetched attributes
+// could be older than its own writes.
+func (o *openfiles) outdated(ino Ino, ver uint64) bool {
+	return o.changed[ino] > ver
+}
+
 func (o *openfiles) cleanup() {
 	for {
 		o.Lock()
@@ -56,7 +97,7 @@ func (o *openfiles) OpenCheck(ino Ino, attr *Attr) bool {
 	return false
 }
 
-func (o *openfiles) Open(ino Ino, attr *Attr) {
+func (o *openfiles) Open(ino Ino, attr *Attr, ver uint64) {
 	o.Lock()
 	defer o.Unlock()
 	of, ok := o.files[ino]
@@ -75,7 +116,12 @@ func (o *openfiles) Open(ino Ino, attr *Attr) {
 	// next open can keep cache if not modified
 	of.attr.KeepCache = true
 	of.refs++
-	of.lastCheck = time.Now()
+	if o.outdated(ino, ver) {
+		of.chunks = make(map[uint32][]Slice)
+		of.lastCheck = time.Unix(0, 0)
+	} else {
+		of.lastCheck = time.Now()
+	}
 }
 
 func (o *openfiles) Close(ino Ino) bool {
@@ -103,14 +149,14 @@ func (o *openfiles) Check(ino Ino, attr *Attr) bool {
 	return false
 }
 
-func (o *openfiles) Update(ino Ino, attr *Attr) bool {
+func (o *openfiles) Update(ino Ino, attr *Attr, ver uint64) bool {
 	if attr == nil {
 		panic("attr is nil")
 	}
 	o.Lock()
 	defer o.Unlock()
 	of, ok := o.files[ino]
-	if ok {
+	if ok && !o.outdated(ino, ver) {
 		if attr.Mtime != of.attr.Mtime || attr.Mtimensec != of.attr.Mtimensec {
 			of.chunks = make(map[uint32][]Slice)
 		} else {
@@ -134,7 +180,7 @@ func (o *openfiles) ReadChunk(ino Ino, indx uint32) ([]Slice, bool) {
 	o.Lock()
 	defer o.Unlock()
 	of, ok := o.files[ino]
-	if !ok {
+	if !ok || o.mode == ConsistencyStrict {
 		return nil, false
 	}
 	cs, ok := of.chunks[indx]
@@ -153,6 +199,7 @@ func (o *openfiles) CacheChunk(ino Ino, indx uint32, cs []Slice) {
 func (o *openfiles) InvalidateChunk(ino Ino, indx uint32) {
 	o.Lock()
 	defer o.Unlock()
+	o.modified(ino)
 	of, ok := o.files[ino]
 	if ok {
 		if indx == 0xFFFFFFFF {
@@ -164,6 +211,72 @@ func (o *openfiles) InvalidateChunk(ino Ino, indx uint32) {
 	}
 }
 
+// cachedChunks returns a copy of the chunks cached for the open files.
+func (o *openfiles) cachedChunks() map[Ino]map[uint32][]Slice {
+	o.Lock()
+	defer o.Unlock()
+	cached := make(map[Ino]map[uint32][]Slice)
+	for ino, of := range o.files {
+		if of.refs <= 0 || len(of.chunks) == 0 {
+			continue
+		}
+		chunks := make(map[uint32][]Slice, len(of.chunks))
+		for indx, cs := range of.chunks {
+			chunks[indx] = cs
+		}
+		cached[ino] = chunks
+	}
+	return cached
+}
+
+// dropStale drops the chunk of ino if it's still cached as cs, and expires the attributes, since
+// the chunk is changed by other clients. It returns false if the chunk is not cached as cs anymore.
+func (o *openfiles) dropStale(ino Ino, indx uint32, cs []Slice) bool {
+	o.Lock()
+	defer o.Unlock()
+	of, ok := o.files[ino]
+	if !ok {
+		return false
+	}
+	if cur, ok := of.chunks[indx]; !ok || !sameSlices(cur, cs) {
+		return false
+	}
+	delete(of.chunks, indx)
+	of.lastCheck = time.Unix(0, 0)
+	return true
+}
+
+func sameSlices(a, b []Slice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCompact sets the thresholds to compact the chunks of the opened file ino.
+func (o *openfiles) SetCompact(ino Ino, slices int, bytes uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if of, ok := o.files[ino]; ok {
+		of.compactSlices, of.compactBytes = slices, bytes
+	}
+}
+
+// compactThresholds returns the thresholds to compact the chunks of ino set by SetCompact.
+func (o *openfiles) compactThresholds(ino Ino) (slices int, bytes uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if of, ok := o.files[ino]; ok {
+		return of.compactSlices, of.compactBytes
+	}
+	return 0, 0
+}
+
 func (o *openfiles) find(ino Ino) *openFile {
 	o.Lock()
 	defer o.Unlock()
@@ -21,6 +21,7 @@ package meta
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -29,6 +30,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"runtime"
 	"sort"
@@ -41,6 +43,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -58,6 +61,9 @@ import (
 
 	Removed files: delfiles -> [$inode:$length -> seconds]
 	Slices refs: k$chunkid_$size -> refcount
+	Slices checksums: sliceSums -> {$chunkid -> [crc32 of blocks]}
+	Inline slices: inlineSlices -> {$chunkid -> data}
+	Change journal: journal -> [event -> seq]
 
 	Redis features:
 	  Sorted Set: 1.2+
@@ -74,6 +80,7 @@ type redisMeta struct {
 	shaLookup  string           // The SHA returned by Redis for the loaded `scriptLookup`
 	shaResolve string           // The SHA returned by Redis for the loaded `scriptResolve`
 	snap       *redisSnap
+	tokens     *tokenRefresher // to authenticate new connections
 }
 
 var _ Meta = &redisMeta{}
@@ -85,13 +92,17 @@ func init() {
 
 // newRedisMeta return a meta store using Redis.
 func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
-	url := driver + "://" + addr
-	opt, err := redis.ParseURL(url)
+	opt, tokens, err := parseRedisURL(driver + "://" + addr)
 	if err != nil {
-		return nil, fmt.Errorf("parse %s: %s", url, err)
+		return nil, err
 	}
 	var rdb *redis.Client
 	if strings.Contains(opt.Addr, ",") {
+		if tokens != nil {
+			// it would be sent to sentinels also
+			_ = tokens.Close()
+			return nil, fmt.Errorf("auth is not supported with Redis Sentinel")
+		}
 		var fopt redis.FailoverOptions
 		ps := strings.Split(opt.Addr, ",")
 		fopt.MasterName = ps[0]
@@ -126,10 +137,10 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 		fopt.WriteTimeout = time.Second * 5
 		rdb = redis.NewFailoverClient(&fopt)
 	} else {
-		if opt.Password == "" {
+		if opt.Password == "" && tokens == nil {
 			opt.Password = os.Getenv("REDIS_PASSWORD")
 		}
-		if opt.Password == "" {
+		if opt.Password == "" && tokens == nil {
 			opt.Password = os.Getenv("META_PASSWORD")
 		}
 		opt.MaxRetries = conf.Retries
@@ -143,6 +154,7 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 	m := &redisMeta{
 		baseMeta: newBaseMeta(conf),
 		rdb:      rdb,
+		tokens:   tokens,
 	}
 	m.en = m
 	m.checkServerConfig()
@@ -150,12 +162,142 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 	return m, err
 }
 
+// parseRedisURL parses the options of connection, including TLS and authentication in the query,
+// the tokens are not nil if the connections are authenticated by tokens.
+func parseRedisURL(uri string) (*redis.Options, *tokenRefresher, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %s: %s", utils.RemovePassword(uri), err)
+	}
+	query := u.Query()
+	co, err := parseConnOptions(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.RawQuery = query.Encode()
+	opt, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %s: %s", utils.RemovePassword(uri), err)
+	}
+	if co.useTLS() {
+		if opt.TLSConfig == nil {
+			return nil, nil, fmt.Errorf("TLS options require rediss://")
+		}
+		if opt.TLSConfig, err = co.tlsConfig(opt.TLSConfig.ServerName); err != nil {
+			return nil, nil, err
+		}
+	}
+	var tokens *tokenRefresher
+	if co.auth != "" {
+		if tokens, err = newTokenRefresher(co, opt.Addr, opt.Username); err != nil {
+			return nil, nil, err
+		}
+		// the token is sent in AUTH of every new connection, which must be done before SELECT
+		user, db := opt.Username, opt.DB
+		opt.Password, opt.DB = "", 0
+		opt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+			var err error
+			if user != "" {
+				err = cn.AuthACL(ctx, user, tokens.current()).Err()
+			} else {
+				err = cn.Auth(ctx, tokens.current()).Err()
+			}
+			if err == nil && db > 0 {
+				err = cn.Select(ctx, db).Err()
+			}
+			return err
+		}
+	}
+	return opt, tokens, nil
+}
+
 func (r *redisMeta) Shutdown() error {
+	if r.tokens != nil {
+		_ = r.tokens.Close()
+	}
 	return r.rdb.Close()
 }
 
 func (m *redisMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.rdb.HDel(Background, sliceRefs, m.sliceKey(chunkid, size)).Err()
+	_, err := m.rdb.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+		pipe.HDel(Background, sliceRefs, m.sliceKey(chunkid, size))
+		pipe.HDel(Background, sliceSums, strconv.FormatUint(chunkid, 10))
+		pipe.HDel(Background, inlineSlices, strconv.FormatUint(chunkid, 10))
+		return nil
+	})
+	return err
+}
+
+func (m *redisMeta) doSetSliceChecksums(chunkid uint64, sums []byte) error {
+	return m.rdb.HSet(Background, sliceSums, strconv.FormatUint(chunkid, 10), sums).Err()
+}
+
+func (m *redisMeta) doGetSliceChecksums(chunkid uint64) ([]byte, error) {
+	buf, err := m.rdb.HGet(Background, sliceSums, strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (m *redisMeta) doSetSliceData(chunkid uint64, data []byte) error {
+	return m.rdb.HSet(Background, inlineSlices, strconv.FormatUint(chunkid, 10), data).Err()
+}
+
+func (m *redisMeta) doGetSliceData(chunkid uint64) ([]byte, error) {
+	buf, err := m.rdb.HGet(Background, inlineSlices, strconv.FormatUint(chunkid, 10)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+func (m *redisMeta) doAppendJournal(n int, encode func(first uint64) ([][]byte, error)) (uint64, error) {
+	var last uint64
+	var err error
+	st := m.txn(Background, func(tx *redis.Tx) error {
+		var v int64
+		if v, err = tx.Get(Background, "nextJournal").Int64(); err != nil && err != redis.Nil {
+			return err
+		}
+		last = uint64(v) + uint64(n)
+		first := last - uint64(n) + 1
+		var records [][]byte
+		if records, err = encode(first); err != nil {
+			return err
+		}
+		zs := make([]*redis.Z, len(records))
+		for i, r := range records {
+			zs[i] = &redis.Z{Score: float64(first + uint64(i)), Member: r}
+		}
+		_, err = tx.TxPipelined(Background, func(pipe redis.Pipeliner) error {
+			pipe.IncrBy(Background, "nextJournal", int64(n))
+			pipe.ZAdd(Background, changeJournal, zs...)
+			return nil
+		})
+		return err
+	}, "nextJournal", changeJournal)
+	if st != 0 {
+		return 0, st
+	}
+	return last, nil
+}
+
+func (m *redisMeta) doReadJournal(since uint64, limit int) ([][]byte, error) {
+	rng := &redis.ZRangeBy{Min: "(" + strconv.FormatUint(since, 10), Max: "+inf", Count: int64(limit)}
+	vals, err := m.rdb.ZRangeByScore(Background, changeJournal, rng).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([][]byte, len(vals))
+	for i, v := range vals {
+		records[i] = []byte(v)
+	}
+	return records, nil
+}
+
+func (m *redisMeta) doTrimJournal(before uint64) error {
+	return m.rdb.ZRemRangeByScore(Background, changeJournal, "-inf", "("+strconv.FormatUint(before, 10)).Err()
 }
 
 func (r *redisMeta) Name() string {
@@ -186,6 +328,19 @@ func (r *redisMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ClientOpsLimit = format.ClientOpsLimit
+			old.JournalSize = format.JournalSize
+			if old.KeyPrefixes == 0 {
+				// it can be enabled for the following slices, but can't be changed once enabled
+				old.KeyPrefixes = format.KeyPrefixes
+				old.PrefixedFrom = format.PrefixedFrom
+			}
+			if format.XattrChecksum {
+				old.XattrChecksum = true // the values set before are not stamped
+			}
+			if compress.Tagged(old.Compression) && compress.Tagged(format.Compression) {
+				old.Compression = format.Compression
+			}
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -204,6 +359,7 @@ func (r *redisMeta) Init(format Format, force bool) error {
 		Atime:  ts,
 		Mtime:  ts,
 		Ctime:  ts,
+		Btime:  ts,
 		Nlink:  2,
 		Length: 4 << 10,
 		Parent: 1,
@@ -239,6 +395,27 @@ func (r *redisMeta) doLoad() ([]byte, error) {
 	return body, err
 }
 
+func (r *redisMeta) doCheckHealth() ([]string, error) {
+	if err := r.rdb.Ping(Background).Err(); err != nil {
+		return nil, err
+	}
+	var warnings []string
+	if rawInfo, err := r.rdb.Info(Background, "memory").Result(); err == nil {
+		if used, max := redisMemory(rawInfo); max > 0 && used > max/10*9 {
+			warnings = append(warnings, fmt.Sprintf("used memory %d is more than 90%% of maxmemory %d", used, max))
+		}
+	}
+	return warnings, nil
+}
+
+func (r *redisMeta) replPosition() (uint64, error) {
+	rawInfo, err := r.rdb.Info(Background, "replication").Result()
+	if err != nil {
+		return 0, err
+	}
+	return redisReplOffset(rawInfo)
+}
+
 func (r *redisMeta) doNewSession(sinfo []byte) error {
 	err := r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.FormatUint(r.sid, 10)}).Err()
 	if err != nil {
@@ -539,7 +716,7 @@ func (r *redisMeta) Resolve(ctx Context, parent Ino, path string, inode *Ino, at
 	if len(r.shaResolve) == 0 || r.conf.CaseInsensi {
 		return syscall.ENOTSUP
 	}
-	defer timeit(time.Now())
+	defer r.timeit("resolve", parent, time.Now())
 	parent = r.checkRoot(parent)
 	args := []string{parent.String(), path,
 		strconv.FormatUint(uint64(ctx.Uid()), 10),
@@ -623,27 +800,29 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 	var khash = fnv.New32()
 	_, _ = khash.Write([]byte(keys[0]))
 	l := &r.txlocks[int(khash.Sum32())%len(r.txlocks)]
+	var retries int
 	start := time.Now()
-	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
+	defer func() { r.timeitTxn(start, retries) }()
 	l.Lock()
 	defer l.Unlock()
 	// TODO: enable retry for some of idempodent transactions
 	var retryOnFailture = false
-	for i := 0; i < 50; i++ {
+	for i := 0; ; i++ {
 		err = r.rdb.Watch(ctx, txf, keys...)
-		if shouldRetry(err, retryOnFailture) {
-			txRestart.Add(1)
-			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
-			continue
+		if !shouldRetry(err, retryOnFailture) {
+			return errno(err)
 		}
-		return errno(err)
+		if i >= r.conf.TxnRetries {
+			return r.txnGiveUp(err)
+		}
+		r.txnRestarted()
+		retries++
+		time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
 	}
-	logger.Warnf("Already tried 50 times, returning: %s", err)
-	return errno(err)
 }
 
-func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
+func (r *redisMeta) doTruncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	defer r.timeit("truncate", inode, time.Now())
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -657,7 +836,7 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			return err
 		}
 		r.parseAttr(a, &t)
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || protected(t.Flags) {
 			return syscall.EPERM
 		}
 		if length == t.Length {
@@ -736,7 +915,7 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 	}, r.inodeKey(inode))
 }
 
-func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+func (r *redisMeta) doFallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -752,7 +931,7 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 	if size == 0 {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer r.timeit("fallocate", inode, time.Now())
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -769,7 +948,10 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		if t.Typ == TypeFIFO {
 			return syscall.EPIPE
 		}
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || t.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagAppend != 0 && mode&^fallocKeepSize != 0 {
 			return syscall.EPERM
 		}
 		length := t.Length
@@ -814,10 +996,7 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 	}, r.inodeKey(inode))
 }
 
-func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
-	inode = r.checkRoot(inode)
-	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
+func (r *redisMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	return r.txn(ctx, func(tx *redis.Tx) error {
 		var cur Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
@@ -825,10 +1004,13 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			return err
 		}
 		r.parseAttr(a, &cur)
+		changed, st := changeFlags(ctx, &cur.Flags, set, attr.Flags)
+		if st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
-		var changed bool
 		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
 			clearSUGID(ctx, &cur, attr)
 			changed = true
@@ -863,6 +1045,12 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			cur.Atimensec = uint32(now.Nanosecond())
 			changed = true
 		}
+		var accessed bool
+		if set&SetAttrAtimeRead != 0 && r.atimeNeedsUpdate(&cur, now) {
+			cur.Atime = now.Unix()
+			cur.Atimensec = uint32(now.Nanosecond())
+			accessed = true
+		}
 		if set&SetAttrMtime != 0 && (cur.Mtime != attr.Mtime || cur.Mtimensec != attr.Mtimensec) {
 			cur.Mtime = attr.Mtime
 			cur.Mtimensec = attr.Mtimensec
@@ -873,12 +1061,14 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			cur.Mtimensec = uint32(now.Nanosecond())
 			changed = true
 		}
-		if !changed {
+		if !changed && !accessed {
 			*attr = cur
 			return nil
 		}
-		cur.Ctime = now.Unix()
-		cur.Ctimensec = uint32(now.Nanosecond())
+		if changed {
+			cur.Ctime = now.Unix()
+			cur.Ctimensec = uint32(now.Nanosecond())
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&cur), 0)
 			return nil
@@ -918,6 +1108,7 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 	attr.Mode = mode & ^cumask
 	attr.Uid = ctx.Uid()
 	attr.Gid = ctx.Gid()
+	attr.Flags = 0
 	if _type == TypeDirectory {
 		attr.Nlink = 2
 		attr.Length = 4 << 10
@@ -946,6 +1137,9 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 
 		buf, err := tx.HGet(ctx, r.entryKey(parent), name).Bytes()
 		if err != nil && err != redis.Nil {
@@ -991,6 +1185,8 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Btime = now.Unix()
+		attr.Btimensec = uint32(now.Nanosecond())
 		if pattr.Mode&02000 != 0 || ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			attr.Gid = pattr.Gid
 			if _type == TypeDirectory && runtime.GOOS == "linux" {
@@ -1051,6 +1247,9 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pattr.Flags) {
+			return syscall.EPERM
+		}
 		now := time.Now()
 		pattr.Mtime = now.Unix()
 		pattr.Mtimensec = uint32(now.Nanosecond())
@@ -1063,6 +1262,9 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
+			if protected(attr.Flags) {
+				return syscall.EPERM
+			}
 			attr.Ctime = now.Unix()
 			attr.Ctimensec = uint32(now.Nanosecond())
 			if trash == 0 {
@@ -1163,6 +1365,9 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pattr.Flags) {
+			return syscall.EPERM
+		}
 		now := time.Now()
 		pattr.Nlink--
 		pattr.Mtime = now.Unix()
@@ -1191,6 +1396,9 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
+			if protected(attr.Flags) {
+				return syscall.EPERM
+			}
 			if trash > 0 {
 				attr.Ctime = now.Unix()
 				attr.Ctimensec = uint32(now.Nanosecond())
@@ -1283,6 +1491,9 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 			return syscall.ENOTDIR
 		}
 		r.parseAttr([]byte(rs[2].(string)), &iattr)
+		if protected(sattr.Flags) || dattr.Flags&FlagImmutable != 0 || protected(iattr.Flags) {
+			return syscall.EPERM
+		}
 
 		dbuf, err := tx.HGet(ctx, r.entryKey(parentDst), nameDst).Bytes()
 		if err != nil && err != redis.Nil {
@@ -1307,6 +1518,9 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 				return err
 			}
 			r.parseAttr(a, &tattr)
+			if protected(tattr.Flags) || protected(dattr.Flags) {
+				return syscall.EPERM
+			}
 			tattr.Ctime = now.Unix()
 			tattr.Ctimensec = uint32(now.Nanosecond())
 			if exchange {
@@ -1453,7 +1667,7 @@ func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
 		r.parseAttr([]byte(rs[1].(string)), &iattr)
-		if iattr.Typ == TypeDirectory {
+		if iattr.Typ == TypeDirectory || protected(iattr.Flags) || pattr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		iattr.Ctime = now.Unix()
@@ -1482,87 +1696,287 @@ func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 	}, r.inodeKey(inode), r.entryKey(parent), r.inodeKey(parent))
 }
 
-func (r *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
-	var keys []string
+func (r *redisMeta) doReparent(ctx Context, parent Ino, name string, inode Ino, attr *Attr) syscall.Errno {
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		rs, err := tx.MGet(ctx, r.inodeKey(parent), r.inodeKey(inode)).Result()
+		if err != nil {
+			return err
+		}
+		if rs[0] == nil || rs[1] == nil {
+			return redis.Nil
+		}
+		var pattr, iattr Attr
+		r.parseAttr([]byte(rs[0].(string)), &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
+		if err != nil && err != redis.Nil {
+			return err
+		} else if err == nil {
+			return syscall.EEXIST
+		}
+		r.parseAttr([]byte(rs[1].(string)), &iattr)
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		if iattr.Typ == TypeDirectory {
+			pattr.Nlink++
+		}
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Nlink = attr.Nlink
+		iattr.Parent = parent
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(iattr.Typ, inode))
+			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&iattr), 0)
+			return nil
+		})
+		if err == nil {
+			*attr = iattr
+		}
+		return err
+	}, r.inodeKey(inode), r.entryKey(parent), r.inodeKey(parent))
+}
+
+func (r *redisMeta) doFixNlink(ctx Context, inode Ino, old, nlink *uint32) syscall.Errno {
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		r.parseAttr(a, &attr)
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		vals, err := tx.HVals(ctx, r.entryKey(inode)).Result()
+		if err != nil {
+			return err
+		}
+		n := uint32(2)
+		for _, v := range vals {
+			if typ, _ := r.parseEntry([]byte(v)); typ == TypeDirectory {
+				n++
+			}
+		}
+		*old, *nlink = attr.Nlink, n
+		if attr.Nlink == n {
+			return nil
+		}
+		attr.Nlink = n
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode), r.entryKey(inode))
+}
+
+func (r *redisMeta) scanAllEntries(ctx Context, scan func(parent Ino, name string, typ uint8, inode Ino)) error {
 	var cursor uint64
-	var err error
 	for {
-		keys, cursor, err = r.rdb.HScan(ctx, r.entryKey(inode), cursor, "*", 10000).Result()
+		keys, c, err := r.rdb.Scan(ctx, cursor, "d*", 10000).Result()
 		if err != nil {
-			return errno(err)
+			return err
 		}
-		newEntries := make([]Entry, len(keys)/2)
-		newAttrs := make([]Attr, len(keys)/2)
-		for i := 0; i < len(keys); i += 2 {
-			typ, inode := r.parseEntry([]byte(keys[i+1]))
-			ent := &newEntries[i/2]
-			ent.Inode = inode
-			ent.Name = []byte(keys[i])
-			ent.Attr = &newAttrs[i/2]
-			ent.Attr.Typ = typ
-			*entries = append(*entries, ent)
+		for _, key := range keys {
+			parent, err := strconv.ParseUint(key[1:], 10, 64)
+			if err != nil {
+				continue // not an entry
+			}
+			var entries []*Entry
+			if st := r.doReaddir(ctx, Ino(parent), 0, &entries); st != 0 && st != syscall.ENOENT {
+				return st
+			}
+			for _, e := range entries {
+				scan(Ino(parent), string(e.Name), e.Attr.Typ, e.Inode)
+			}
 		}
-		if cursor == 0 {
-			break
+		if c == 0 {
+			return nil
 		}
+		cursor = c
 	}
+}
 
-	if plus != 0 {
-		fillAttr := func(es []*Entry) error {
-			var keys = make([]string, len(es))
-			for i, e := range es {
-				keys[i] = r.inodeKey(e.Inode)
-			}
-			rs, err := r.rdb.MGet(ctx, keys...).Result()
+func (r *redisMeta) scanAllInodes(ctx Context, scan func(inode Ino, attr *Attr)) error {
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, "i*", 10000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			values, err := r.rdb.MGet(ctx, keys...).Result()
 			if err != nil {
 				return err
 			}
-			for j, re := range rs {
-				if re != nil {
-					if a, ok := re.(string); ok {
-						r.parseAttr([]byte(a), es[j].Attr)
-					}
+			for i, v := range values {
+				inode, err := strconv.ParseUint(keys[i][1:], 10, 64)
+				if v == nil || err != nil {
+					continue
 				}
+				var attr Attr
+				r.parseAttr([]byte(v.(string)), &attr)
+				scan(Ino(inode), &attr)
 			}
+		}
+		if c == 0 {
 			return nil
 		}
-		batchSize := 4096
-		nEntries := len(*entries)
-		if nEntries <= batchSize {
-			err = fillAttr(*entries)
-		} else {
-			indexCh := make(chan []*Entry, 10)
-			var wg sync.WaitGroup
-			for i := 0; i < 2; i++ {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for es := range indexCh {
-						e := fillAttr(es)
-						if e != nil {
-							err = e
-							break
-						}
-					}
-				}()
+		cursor = c
+	}
+}
+
+func (r *redisMeta) scanAllXattrs(ctx Context, scan func(inode Ino, name string, value []byte)) error {
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, "x*", 10000).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			inode, err := strconv.ParseUint(key[1:], 10, 64)
+			if err != nil {
+				continue
 			}
-			for i := 0; i < nEntries; i += batchSize {
-				if i+batchSize > nEntries {
-					indexCh <- (*entries)[i:]
-				} else {
-					indexCh <- (*entries)[i : i+batchSize]
-				}
+			vals, err := r.rdb.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
 			}
-			close(indexCh)
-			wg.Wait()
+			for name, value := range vals {
+				scan(Ino(inode), name, []byte(value))
+			}
+		}
+		if c == 0 {
+			return nil
 		}
+		cursor = c
+	}
+}
+
+func (r *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
+	var keys []string
+	var cursor uint64
+	var err error
+	for {
+		keys, cursor, err = r.rdb.HScan(ctx, r.entryKey(inode), cursor, "*", 10000).Result()
 		if err != nil {
 			return errno(err)
 		}
+		r.parseEntries(keys, entries)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if plus != 0 {
+		if err = r.fillAttrs(ctx, *entries); err != nil {
+			return errno(err)
+		}
 	}
 	return 0
 }
 
+// doReaddirPage uses the cursor of HSCAN, which returns all the entries existing during the whole
+// iteration, but some of them could be returned more than once if the hash is resized.
+func (r *redisMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno) {
+	var c uint64
+	if cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return "", syscall.EINVAL
+		}
+	}
+	keys, c, err := r.rdb.HScan(ctx, r.entryKey(inode), c, "*", int64(limit)).Result()
+	if err != nil {
+		return "", errno(err)
+	}
+	n := len(*entries)
+	r.parseEntries(keys, entries)
+	if plus != 0 {
+		if err = r.fillAttrs(ctx, (*entries)[n:]); err != nil {
+			return "", errno(err)
+		}
+	}
+	if c == 0 {
+		return "", 0
+	}
+	return strconv.FormatUint(c, 10), 0
+}
+
+// parseEntries parses the names and values returned by HSCAN.
+func (r *redisMeta) parseEntries(keys []string, entries *[]*Entry) {
+	newEntries := make([]Entry, len(keys)/2)
+	newAttrs := make([]Attr, len(keys)/2)
+	for i := 0; i < len(keys); i += 2 {
+		typ, inode := r.parseEntry([]byte(keys[i+1]))
+		ent := &newEntries[i/2]
+		ent.Inode = inode
+		ent.Name = []byte(keys[i])
+		ent.Attr = &newAttrs[i/2]
+		ent.Attr.Typ = typ
+		*entries = append(*entries, ent)
+	}
+}
+
+// fillAttrs reads the attributes of entries in batches.
+func (r *redisMeta) fillAttrs(ctx Context, entries []*Entry) (err error) {
+	fillAttr := func(es []*Entry) error {
+		var keys = make([]string, len(es))
+		for i, e := range es {
+			keys[i] = r.inodeKey(e.Inode)
+		}
+		rs, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for j, re := range rs {
+			if re != nil {
+				if a, ok := re.(string); ok {
+					r.parseAttr([]byte(a), es[j].Attr)
+				}
+			}
+		}
+		return nil
+	}
+	batchSize := 4096
+	nEntries := len(entries)
+	if nEntries <= batchSize {
+		return fillAttr(entries)
+	}
+	indexCh := make(chan []*Entry, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for es := range indexCh {
+				e := fillAttr(es)
+				if e != nil {
+					err = e
+					break
+				}
+			}
+		}()
+	}
+	for i := 0; i < nEntries; i += batchSize {
+		if i+batchSize > nEntries {
+			indexCh <- entries[i:]
+		} else {
+			indexCh <- entries[i : i+batchSize]
+		}
+	}
+	close(indexCh)
+	wg.Wait()
+	return err
+}
+
 func (r *redisMeta) doCleanStaleSession(sid uint64) {
 	// release locks
 	var ctx = Background
@@ -1620,8 +2034,9 @@ func (r *redisMeta) doFindStaleSessions(ts int64, limit int) ([]uint64, error) {
 	return sids, nil
 }
 
-func (r *redisMeta) doRefreshSession() {
+func (r *redisMeta) doRefreshSession(sinfo []byte) {
 	r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
+	r.rdb.HSet(Background, sessionInfos, r.sid, sinfo)
 }
 
 func (r *redisMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
@@ -1659,22 +2074,29 @@ func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) s
 		*chunks = cs
 		return 0
 	}
-	defer timeit(time.Now())
-	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000000).Result()
-	if err != nil {
-		return errno(err)
+	defer r.timeit("read", inode, time.Now())
+	ss, st := r.doRead(ctx, inode, indx)
+	if st != 0 {
+		return st
 	}
-	ss := readSlices(vals)
 	*chunks = buildSlice(ss)
 	r.of.CacheChunk(inode, indx, *chunks)
-	if !r.conf.ReadOnly && (len(vals) >= 5 || len(*chunks) >= 5) {
-		go r.compactChunk(inode, indx, false)
+	if r.needCompact(inode, ss, *chunks) {
+		go r.compactChunk(inode, indx, false, false)
 	}
 	return 0
 }
 
+func (r *redisMeta) doRead(ctx Context, inode Ino, indx uint32) ([]*slice, syscall.Errno) {
+	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000000).Result()
+	if err != nil {
+		return nil, errno(err)
+	}
+	return readSlices(vals), 0
+}
+
 func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
-	defer timeit(time.Now())
+	defer r.timeit("write", inode, time.Now())
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1689,7 +2111,7 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			return err
 		}
 		r.parseAttr(a, &attr)
-		if attr.Typ != TypeFile {
+		if attr.Typ != TypeFile || attr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
@@ -1723,21 +2145,24 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		}
 		return err
 	}, r.inodeKey(inode))
-	if eno == 0 && needCompact {
-		go r.compactChunk(inode, indx, false)
+	if eno == 0 {
+		r.journalWrite(ctx, inode, uint64(indx)*ChunkSize+uint64(off), uint64(slice.Len))
+		if needCompact {
+			go r.compactChunk(inode, indx, false, false)
+		}
 	}
 	return eno
 }
 
 func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
-	defer timeit(time.Now())
+	defer r.timeit("copyfilerange", fin, time.Now())
 	f := r.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(fin), r.inodeKey(fout)).Result()
 		if err != nil {
 			return err
@@ -1762,6 +2187,9 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagImmutable != 0 || attr.Flags&FlagAppend != 0 && offOut < attr.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
 		var added int64
@@ -1844,6 +2272,10 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		}
 		return err
 	}, r.inodeKey(fout), r.inodeKey(fin))
+	if st == 0 {
+		r.journalWrite(ctx, fout, offOut, *copied)
+	}
+	return st
 }
 
 // For now only deleted files
@@ -2123,14 +2555,63 @@ func (r *redisMeta) doDeleteFileData_(inode Ino, length uint64, tracking string)
 	_ = r.rdb.ZRem(ctx, delfiles, tracking)
 }
 
-func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
+// releaseHoles deletes a chunk without any data (all punched as holes) if it's not changed,
+// and releases its slices.
+func (r *redisMeta) releaseHoles(inode Ino, indx uint32, vals []string, ss []*slice) syscall.Errno {
+	var ctx = Background
+	key := r.chunkKey(inode, indx)
+	var released []*slice
+	var rs []*redis.IntCmd
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		released, rs = nil, nil
+		vals2, err := tx.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		if len(vals2) != len(vals) {
+			return syscall.EINVAL
+		}
+		for i, val := range vals2 {
+			if val != vals[i] {
+				return syscall.EINVAL
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			for _, s := range ss {
+				if s.chunkid > 0 {
+					released = append(released, s)
+					rs = append(rs, pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.chunkid, s.size), -1))
+				}
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if st != 0 {
+		return st
+	}
+	logger.Debugf("release %d slices in the holes of %d:%d", len(ss), inode, indx)
+	r.of.InvalidateChunk(inode, indx)
+	for i, s := range released {
+		if rs[i].Err() == nil && rs[i].Val() < 0 {
+			r.deleteSlice(s.chunkid, s.size)
+		}
+	}
+	return 0
+}
+
+func (r *redisMeta) compactChunk(inode Ino, indx uint32, whole, force bool) syscall.Errno {
 	// avoid too many or duplicated compaction
 	if !force {
+		if r.BackgroundPaused() {
+			return 0
+		}
 		r.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(r.compacting) > 10 || r.compacting[k] {
 			r.Unlock()
-			return
+			return 0
 		}
 		r.compacting[k] = true
 		r.Unlock()
@@ -2144,21 +2625,27 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	var ctx = Background
 	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000).Result()
 	if err != nil {
-		return
+		return errno(err)
 	}
 
 	ss := readSlices(vals)
-	skipped := skipSome(ss)
+	var skipped int
+	if !whole {
+		skipped = skipSome(ss)
+	}
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
+	if size == 0 && skipped == 0 && len(ss) > 0 {
+		return r.releaseHoles(inode, indx, vals, ss)
+	}
 	if len(ss) < 2 || size == 0 {
-		return
+		return 0
 	}
 
 	var chunkid uint64
 	st := r.NewChunk(ctx, &chunkid)
 	if st != 0 {
-		return
+		return st
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
 	err = r.newMsg(CompactChunk, chunks, chunkid)
@@ -2166,7 +2653,7 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return syscall.EIO
 	}
 	var rs []*redis.IntCmd
 	key := r.chunkKey(inode, indx)
@@ -2220,16 +2707,17 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 				r.deleteSlice(s.chunkid, s.size)
 			}
 		}
-		if r.rdb.LLen(ctx, r.chunkKey(inode, indx)).Val() > 5 {
+		if !whole && r.rdb.LLen(ctx, r.chunkKey(inode, indx)).Val() > 5 {
 			go func() {
 				// wait for the current compaction to finish
 				time.Sleep(time.Millisecond * 10)
-				r.compactChunk(inode, indx, force)
+				r.compactChunk(inode, indx, false, force)
 			}()
 		}
 	} else {
 		logger.Warnf("compact %s: %s", key, errno)
 	}
+	return errno
 }
 
 func (r *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
@@ -2259,7 +2747,7 @@ func (r *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 				n, err := fmt.Sscanf(keys[i], "c%d_%d", &inode, &indx)
 				if err == nil && n == 2 {
 					logger.Debugf("compact chunk %d:%d (%d slices)", inode, indx, cnt)
-					r.compactChunk(Ino(inode), indx, true)
+					r.compactChunk(Ino(inode), indx, false, true)
 				}
 			}
 			bar.Increment()
@@ -2385,8 +2873,8 @@ func (r *redisMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool,
 	return 0
 }
 
-func (r *redisMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+func (r *redisMeta) doGetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	defer r.timeit("getxattr", inode, time.Now())
 	inode = r.checkRoot(inode)
 	var err error
 	*vbuff, err = r.rdb.HGet(ctx, r.xattrKey(inode), name).Bytes()
@@ -2397,7 +2885,7 @@ func (r *redisMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte)
 }
 
 func (r *redisMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+	defer r.timeit("listxattr", inode, time.Now())
 	inode = r.checkRoot(inode)
 	vals, err := r.rdb.HKeys(ctx, r.xattrKey(inode)).Result()
 	if err != nil {
@@ -2411,11 +2899,11 @@ func (r *redisMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Err
 	return 0
 }
 
-func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+func (r *redisMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer r.timeit("setxattr", inode, time.Now())
 	inode = r.checkRoot(inode)
 	c := Background
 	key := r.xattrKey(inode)
@@ -2445,11 +2933,31 @@ func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte,
 	}, key)
 }
 
-func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+func (r *redisMeta) doCompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno {
+	defer r.timeit("setxattr", inode, time.Now())
+	inode = r.checkRoot(inode)
+	key := r.xattrKey(inode)
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		old, err := tx.HGet(ctx, key, name).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if !bytes.Equal(old, expected) {
+			return syscall.ECANCELED
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, name, value)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (r *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer r.timeit("removexattr", inode, time.Now())
 	inode = r.checkRoot(inode)
 	n, err := r.rdb.HDel(ctx, r.xattrKey(inode), name).Result()
 	if err != nil {
@@ -2621,7 +3129,7 @@ func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, dept
 		entry.Name = name
 		if typ == TypeDirectory {
 			err = m.dumpDir(inode, entry, bw, depth+2, showProgress)
-		} else {
+		} else if err = m.dumpSliceData(entry); err == nil {
 			err = entry.writeJSON(bw, depth+2)
 		}
 		if err != nil {
@@ -2899,6 +3407,9 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 				m.Lock()
 				refs[m.sliceKey(s.Chunkid, s.Size)]++
 				m.Unlock()
+				if s.Data != nil {
+					p.HSet(ctx, inlineSlices, strconv.FormatUint(s.Chunkid, 10), s.Data)
+				}
 				if cs.NextChunk < int64(s.Chunkid) {
 					cs.NextChunk = int64(s.Chunkid)
 				}
@@ -2944,15 +3455,24 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 	return err
 }
 
-func (m *redisMeta) LoadMeta(r io.Reader) error {
-	ctx := Background
-	dbsize, err := m.rdb.DBSize(ctx).Result()
+// prepareLoad checks that the database is empty.
+func (m *redisMeta) prepareLoad() error {
+	dbsize, err := m.rdb.DBSize(Background).Result()
 	if err != nil {
 		return err
 	}
 	if dbsize > 0 {
 		return fmt.Errorf("Database %s is not empty", m.Name())
 	}
+	return nil
+}
+
+func (m *redisMeta) LoadMeta(r io.Reader) error {
+	ctx := Background
+	err := m.prepareLoad()
+	if err != nil {
+		return err
+	}
 
 	dec := json.NewDecoder(r)
 	dm := &DumpedMeta{}
@@ -3057,3 +3577,62 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 	_, err = p.Exec(ctx)
 	return err
 }
+
+func (m *redisMeta) cleanEntry(inode Ino, versions ...*DumpedEntry) error {
+	keys := []string{m.inodeKey(inode), m.entryKey(inode), m.xattrKey(inode), m.symKey(inode)}
+	indexes := make(map[uint32]bool)
+	for _, e := range versions {
+		if e == nil {
+			continue
+		}
+		for _, c := range e.Chunks {
+			if !indexes[c.Index] {
+				indexes[c.Index] = true
+				keys = append(keys, m.chunkKey(inode, c.Index))
+			}
+		}
+	}
+	return m.rdb.Del(Background, keys...).Err()
+}
+
+func (m *redisMeta) writeEntry(e *DumpedEntry) error {
+	return m.loadEntry(e, &DumpedCounters{}, make(map[string]int))
+}
+
+func (m *redisMeta) writeState(dm *DumpedMeta, cs *DumpedCounters, refs map[sliceID]int) error {
+	ctx := Background
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
+		return err
+	}
+	p := m.rdb.Pipeline()
+	p.Set(ctx, "setting", format, 0)
+	p.MSet(ctx, map[string]interface{}{
+		usedSpace:     cs.UsedSpace,
+		totalInodes:   cs.UsedInodes,
+		"nextinode":   cs.NextInode - 1, // Redis nextInode/nextChunk is 1 smaller than sql/tkv
+		"nextchunk":   cs.NextChunk - 1,
+		"nextsession": cs.NextSession,
+		"nextTrash":   cs.NextTrash,
+	})
+	p.Del(ctx, delfiles)
+	if len(dm.DelFiles) > 0 {
+		zs := make([]*redis.Z, 0, len(dm.DelFiles))
+		for _, d := range dm.DelFiles {
+			zs = append(zs, &redis.Z{
+				Score:  float64(d.Expire),
+				Member: m.toDelete(d.Inode, d.Length),
+			})
+		}
+		p.ZAdd(ctx, delfiles, zs...)
+	}
+	for id, n := range refs {
+		if k := m.sliceKey(id.Chunkid, id.Size); n > 1 {
+			p.HSet(ctx, sliceRefs, k, n-1)
+		} else {
+			p.HDel(ctx, sliceRefs, k)
+		}
+	}
+	_, err = p.Exec(ctx)
+	return err
+}
@@ -20,9 +20,13 @@ package meta
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -60,17 +64,39 @@ func testMeta(t *testing.T, m Meta) {
 	testTruncateAndDelete(t, m)
 	testTrash(t, m)
 	testRemove(t, m)
+	testRemovePaced(t, m)
+	testHardLink(t, m)
+	testReparent(t, m)
+	testFixNlink(t, m)
 	testStickyBit(t, m)
+	testFlags(t, m)
+	testAtime(t, m, base)
+	testBtime(t, m)
 	testLocks(t, m)
 	testConcurrentWrite(t, m)
+	testCompareAndSwapXattr(t, m)
+	testSliceChecksums(t, m)
+	testSliceData(t, m)
+	testXattrChecksum(t, m, base)
 	testCompaction(t, m)
+	testPauseBackground(t, m, base)
+	testCompactFile(t, m)
+	testPunchHole(t, m)
 	testCopyFileRange(t, m)
+	testClone(t, m)
+	testSnapshot(t, m)
+	testApplyAttrChange(t, m)
+	testReaddirPage(t, m)
 	testCloseSession(t, m)
+	testKillSession(t, m)
+	testAuditLog(t, m)
+	testJournal(t, m, base)
 	base.conf.CaseInsensi = true
 	testCaseIncensi(t, m)
 	base.conf.OpenCache = time.Second
 	base.of.expire = time.Second
 	testOpenCache(t, m)
+	testReadYourWrites(t, m, base)
 	base.conf.ReadOnly = true
 	testReadOnly(t, m)
 }
@@ -89,6 +115,9 @@ func testMetaClient(t *testing.T, m Meta) {
 	if err := m.Init(Format{Name: "test2"}, false); err == nil { // not allowed
 		t.Fatalf("change name without --force is not allowed")
 	}
+	if err := m.Init(Format{Name: "test", BlockSize: 1 << 10}, false); err == nil { // not allowed
+		t.Fatalf("change block size without --force is not allowed")
+	}
 	format, err := m.Load()
 	if err != nil {
 		t.Fatalf("load failed after initialization: %s", err)
@@ -489,14 +518,14 @@ func testMetaClient(t *testing.T, m Meta) {
 	if st := GetSummary(m, ctx, 1, &summary, true); st != 0 {
 		t.Fatalf("summary: %s", st)
 	}
-	expected = Summary{Length: 402, Size: 20480, Files: 3, Dirs: 2}
+	expected = Summary{Length: 202, Size: 16384, Files: 2, Dirs: 2} // f and its link f3 are counted once
 	if summary != expected {
 		t.Fatalf("summary %+v not equal to expected: %+v", summary, expected)
 	}
 	if st := GetSummary(m, ctx, inode, &summary, true); st != 0 {
 		t.Fatalf("summary: %s", st)
 	}
-	expected = Summary{Length: 602, Size: 24576, Files: 4, Dirs: 2}
+	expected = Summary{Length: 402, Size: 20480, Files: 3, Dirs: 2}
 	if summary != expected {
 		t.Fatalf("summary %+v not equal to expected: %+v", summary, expected)
 	}
@@ -518,6 +547,175 @@ func testMetaClient(t *testing.T, m Meta) {
 	}
 }
 
+// dropEntry removes an entry without touching the inode, as it's lost after a crash.
+func dropEntry(t *testing.T, m Meta, parent Ino, name string) {
+	var err error
+	switch m := m.(type) {
+	case *redisMeta:
+		err = m.rdb.HDel(Background, m.entryKey(parent), name).Err()
+	case *dbMeta:
+		_, err = m.db.Delete(&edge{Parent: parent, Name: name})
+	case *kvMeta:
+		err = m.deleteKeys(m.entryKey(parent, name))
+	}
+	if err != nil {
+		t.Fatalf("drop entry %s: %s", name, err)
+	}
+}
+
+// setNlink corrupts the nlink of inode.
+func setNlink(t *testing.T, m Meta, inode Ino, nlink uint32) {
+	var err error
+	switch m := m.(type) {
+	case *redisMeta:
+		var a []byte
+		if a, err = m.rdb.Get(Background, m.inodeKey(inode)).Bytes(); err == nil {
+			var attr Attr
+			m.parseAttr(a, &attr)
+			attr.Nlink = nlink
+			err = m.rdb.Set(Background, m.inodeKey(inode), m.marshal(&attr), 0).Err()
+		}
+	case *dbMeta:
+		_, err = m.db.Cols("nlink").Update(&node{Nlink: nlink}, &node{Inode: inode})
+	case *kvMeta:
+		err = m.txn(func(tx kvTxn) error {
+			var attr Attr
+			m.parseAttr(tx.get(m.inodeKey(inode)), &attr)
+			attr.Nlink = nlink
+			tx.set(m.inodeKey(inode), m.marshal(&attr))
+			return nil
+		})
+	}
+	if err != nil {
+		t.Fatalf("set nlink of %d: %s", inode, err)
+	}
+}
+
+func testFixNlink(t *testing.T, m Meta) {
+	ctx := Background
+	var parent, sub, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "fixnlink", 0755, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir fixnlink: %s", st)
+	}
+	for _, name := range []string{"a", "b"} {
+		if st := m.Mkdir(ctx, parent, name, 0755, 0, 0, &sub, attr); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	setNlink(t, m, parent, 7)
+	setNlink(t, m, sub, 1)
+
+	fixed := make(map[Ino][2]uint32)
+	if st := m.FixNlink(ctx, fixed); st != 0 {
+		t.Fatalf("fix nlink: %s", st)
+	}
+	if fixed[parent] != [2]uint32{7, 4} || fixed[sub] != [2]uint32{1, 2} {
+		t.Fatalf("fixed: %v", fixed)
+	}
+	if st := m.GetAttr(ctx, parent, attr); st != 0 || attr.Nlink != 4 {
+		t.Fatalf("nlink of fixnlink: %d %s", attr.Nlink, st)
+	}
+	// the rest of the directory is untouched, and it can be removed
+	if st := m.Unlink(ctx, parent, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	for _, name := range []string{"a", "b"} {
+		if st := m.Rmdir(ctx, parent, name); st != 0 {
+			t.Fatalf("rmdir %s: %s", name, st)
+		}
+	}
+	if st := m.GetAttr(ctx, parent, attr); st != 0 || attr.Nlink != 2 {
+		t.Fatalf("nlink of fixnlink: %d %s", attr.Nlink, st)
+	}
+	if st := m.Rmdir(ctx, 1, "fixnlink"); st != 0 {
+		t.Fatalf("rmdir fixnlink: %s", st)
+	}
+
+	fixed = make(map[Ino][2]uint32)
+	if st := m.FixNlink(ctx, fixed); st != 0 || len(fixed) != 0 {
+		t.Fatalf("fix nlink again: %s, %v", st, fixed)
+	}
+}
+
+func testReparent(t *testing.T, m Meta) {
+	ctx := Background
+	var parent, dir, inode, ino, lostFound Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "reparent", 0755, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir reparent: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "reparent")
+	if st := m.Mkdir(ctx, parent, "d", 0755, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 0, 0, &ino, attr); st != 0 {
+		t.Fatalf("create d/f: %s", st)
+	}
+	_ = m.Close(ctx, ino)
+	if st := m.Create(ctx, parent, "g", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create g: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Truncate(ctx, inode, 0, 1000, attr); st != 0 {
+		t.Fatalf("truncate g: %s", st)
+	}
+	if st := m.Link(ctx, inode, parent, "h", attr); st != 0 {
+		t.Fatalf("link h -> g: %s", st)
+	}
+	for _, name := range []string{"d", "g", "h"} {
+		dropEntry(t, m, parent, name)
+	}
+
+	reparentDelay = 0
+	defer func() { reparentDelay = time.Minute }()
+	var recovered []*Entry
+	if st := m.Reparent(ctx, &recovered); st != 0 {
+		t.Fatalf("reparent: %s", st)
+	}
+	if len(recovered) != 2 || recovered[0].Inode != dir || recovered[1].Inode != inode || recovered[1].Attr.Length != 1000 {
+		t.Fatalf("recovered: %+v", recovered)
+	}
+	if st := m.Lookup(ctx, 1, LostFoundName, &lostFound, attr); st != 0 || attr.Nlink != 3 {
+		t.Fatalf("lookup %s: %s, nlink %d", LostFoundName, st, attr.Nlink)
+	}
+	dname, fname := fmt.Sprintf("#%d", dir), fmt.Sprintf("#%d", inode)
+	if st := m.Lookup(ctx, lostFound, dname, &ino, attr); st != 0 || ino != dir || attr.Parent != lostFound || attr.Nlink != 2 {
+		t.Fatalf("lookup %s: %s, inode %d, parent %d, nlink %d", dname, st, ino, attr.Parent, attr.Nlink)
+	}
+	if st := m.Lookup(ctx, dir, "f", &ino, attr); st != 0 {
+		t.Fatalf("lookup %s/f: %s", dname, st)
+	}
+	if st := m.Lookup(ctx, lostFound, fname, &ino, attr); st != 0 || ino != inode || attr.Parent != lostFound || attr.Nlink != 1 {
+		t.Fatalf("lookup %s: %s, inode %d, parent %d, nlink %d", fname, st, ino, attr.Parent, attr.Nlink)
+	}
+
+	recovered = recovered[:0]
+	if st := m.Reparent(ctx, &recovered); st != 0 || len(recovered) != 0 {
+		t.Fatalf("reparent again: %s, %+v", st, recovered)
+	}
+
+	if st := m.Unlink(ctx, lostFound, fname); st != 0 {
+		t.Fatalf("unlink %s: %s", fname, st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+		t.Fatalf("recovered file should be deleted after unlink: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink %s/f: %s", dname, st)
+	}
+	if st := m.Rmdir(ctx, lostFound, dname); st != 0 {
+		t.Fatalf("rmdir %s: %s", dname, st)
+	}
+	if st := m.Rmdir(ctx, 1, LostFoundName); st != 0 {
+		t.Fatalf("rmdir %s: %s", LostFoundName, st)
+	}
+}
+
 func testStickyBit(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, false)
 	ctx := Background
@@ -585,6 +783,235 @@ func testStickyBit(t *testing.T, m Meta) {
 	}
 }
 
+func testAtime(t *testing.T, m Meta, base *baseMeta) {
+	defer func() { base.conf.AtimeMode = RelAtime }()
+	ctx := Background
+	var inode Ino
+	attr := &Attr{}
+	if st := m.Create(ctx, 1, "atime", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create atime: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "atime")
+	attr.Atime, attr.Mtime = time.Now().Unix()-86400*2, time.Now().Unix()-86400*3
+	if st := m.SetAttr(ctx, inode, SetAttrAtime|SetAttrMtime, 0, attr); st != 0 {
+		t.Fatalf("setattr atime: %s", st)
+	}
+	old := *attr
+	access := func() Attr {
+		var a Attr
+		if st := m.SetAttr(ctx, inode, SetAttrAtimeRead, 0, &a); st != 0 {
+			t.Fatalf("access atime: %s", st)
+		}
+		if st := m.GetAttr(ctx, inode, &a); st != 0 {
+			t.Fatalf("getattr atime: %s", st)
+		}
+		return a
+	}
+
+	base.conf.AtimeMode = NoAtime
+	if a := access(); a.Atime != old.Atime {
+		t.Fatalf("atime should not be updated with noatime: %d -> %d", old.Atime, a.Atime)
+	}
+	base.conf.AtimeMode = RelAtime
+	a := access()
+	if a.Atime <= old.Atime || a.Ctime != old.Ctime || a.Mtime != old.Mtime {
+		t.Fatalf("atime should be updated with relatime (older than ctime): %+v -> %+v", old, a)
+	}
+	if a2 := access(); a2.Atime != a.Atime || a2.Atimensec != a.Atimensec {
+		t.Fatalf("atime should not be updated with relatime (newer than ctime): %+v -> %+v", a, a2)
+	}
+	base.conf.AtimeMode = StrictAtime
+	time.Sleep(time.Millisecond * 10)
+	if a2 := access(); a2.Atime == a.Atime && a2.Atimensec == a.Atimensec || a2.Ctime != old.Ctime {
+		t.Fatalf("atime should be updated with strictatime: %+v -> %+v", a, a2)
+	}
+}
+
+func testBtime(t *testing.T, m Meta) {
+	ctx := Background
+	var inode Ino
+	attr := &Attr{}
+	start := time.Now()
+	if st := m.Create(ctx, 1, "btime", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create btime: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "btime")
+	if st := m.GetAttr(ctx, inode, attr); st != 0 {
+		t.Fatalf("getattr btime: %s", st)
+	}
+	btime := attr.Birthtime()
+	if btime.Before(start.Truncate(time.Second)) || btime.After(time.Now()) || attr.Btime == 0 {
+		t.Fatalf("btime %s should be the time of creation (%s)", btime, start)
+	}
+	time.Sleep(time.Millisecond * 10)
+	attr.Mode = 0600
+	attr.Mtime = time.Now().Unix() + 10
+	if st := m.SetAttr(ctx, inode, SetAttrMode|SetAttrMtime, 0, attr); st != 0 {
+		t.Fatalf("setattr btime: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write btime: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || !attr.Birthtime().Equal(btime) {
+		t.Fatalf("btime should not be changed: %s -> %s", btime, attr.Birthtime())
+	}
+	// created by old versions
+	old := Attr{Ctime: 1000, Ctimensec: 10}
+	if !old.Birthtime().Equal(time.Unix(1000, 10)) {
+		t.Fatalf("btime of old node should be ctime: %s", old.Birthtime())
+	}
+}
+
+func testFlags(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, inode, src Ino
+	attr := &Attr{}
+	if st := m.Mkdir(ctx, 1, "flags", 0777, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir flags: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0666, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Create(ctx, dir, "src", 0666, 0, 0, &src, attr); st != 0 {
+		t.Fatalf("create src: %s", st)
+	}
+	if st := m.Write(ctx, src, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write src: %s", st)
+	}
+	ctxA := NewContext(1, 1, []uint32{1})
+	setFlags := func(ctx Context, inode Ino, flags uint8) syscall.Errno {
+		return m.SetAttr(ctx, inode, SetAttrFlag, 0, &Attr{Flags: flags})
+	}
+	if st := setFlags(ctxA, inode, FlagImmutable); st != syscall.EPERM {
+		t.Fatalf("set flags by non-root: %s", st)
+	}
+
+	// immutable
+	if st := setFlags(ctx, inode, FlagImmutable); st != 0 {
+		t.Fatalf("set immutable: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Flags != FlagImmutable {
+		t.Fatalf("getattr f: %s %d", st, attr.Flags)
+	}
+	if st := m.Open(ctx, inode, syscall.O_RDONLY, &Attr{}); st != 0 {
+		t.Fatalf("open immutable for read: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	for _, flags := range []uint32{syscall.O_WRONLY, syscall.O_RDWR, syscall.O_WRONLY | syscall.O_APPEND, syscall.O_TRUNC} {
+		if st := m.Open(ctx, inode, flags, &Attr{}); st != syscall.EPERM {
+			t.Fatalf("open immutable with %o: %s", flags, st)
+		}
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 2, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("write immutable: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 100, attr); st != syscall.EPERM {
+		t.Fatalf("truncate immutable: %s", st)
+	}
+	if st := m.Fallocate(ctx, inode, 0, 0, 100); st != syscall.EPERM {
+		t.Fatalf("fallocate immutable: %s", st)
+	}
+	var copied uint64
+	if st := m.CopyFileRange(ctx, src, 0, inode, 0, 100, 0, &copied); st != syscall.EPERM {
+		t.Fatalf("copy into immutable: %s", st)
+	}
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, &Attr{Mode: 0600}); st != syscall.EPERM {
+		t.Fatalf("chmod immutable: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, "user.a", []byte("v"), XattrCreateOrReplace); st != syscall.EPERM {
+		t.Fatalf("setxattr immutable: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink immutable: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", dir, "f2", 0, nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename immutable: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "src", dir, "f", 0, nil, nil); st != syscall.EPERM {
+		t.Fatalf("overwrite immutable: %s", st)
+	}
+	if st := m.Link(ctx, inode, dir, "l", attr); st != syscall.EPERM {
+		t.Fatalf("link immutable: %s", st)
+	}
+	if st := setFlags(ctxA, inode, 0); st != syscall.EPERM {
+		t.Fatalf("clear flags by non-root: %s", st)
+	}
+
+	// append-only
+	if st := setFlags(ctx, inode, FlagAppend); st != 0 {
+		t.Fatalf("set append-only: %s", st)
+	}
+	for _, flags := range []uint32{syscall.O_WRONLY, syscall.O_RDWR, syscall.O_WRONLY | syscall.O_APPEND | syscall.O_TRUNC} {
+		if st := m.Open(ctx, inode, flags, &Attr{}); st != syscall.EPERM {
+			t.Fatalf("open append-only with %o: %s", flags, st)
+		}
+	}
+	if st := m.Open(ctx, inode, syscall.O_WRONLY|syscall.O_APPEND, &Attr{}); st != 0 {
+		t.Fatalf("open append-only for append: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 2, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("append to append-only: %s", st)
+	}
+	if st := m.CopyFileRange(ctx, src, 0, inode, 0, 100, 0, &copied); st != syscall.EPERM {
+		t.Fatalf("overwrite append-only: %s", st)
+	}
+	if st := m.CopyFileRange(ctx, src, 0, inode, 100, 100, 0, &copied); st != 0 || copied != 100 {
+		t.Fatalf("copy to the end of append-only: %s %d", st, copied)
+	}
+	if st := m.Truncate(ctx, inode, 0, 0, attr); st != syscall.EPERM {
+		t.Fatalf("truncate append-only: %s", st)
+	}
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 0, 100); st != syscall.EPERM {
+		t.Fatalf("punch hole in append-only: %s", st)
+	}
+	if st := m.Fallocate(ctx, inode, 0, 200, 100); st != 0 {
+		t.Fatalf("fallocate append-only: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink append-only: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", dir, "f2", 0, nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename append-only: %s", st)
+	}
+
+	// directories
+	if st := setFlags(ctx, dir, FlagAppend); st != 0 {
+		t.Fatalf("set append-only on dir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "new", 0666, 0, 0, nil, &Attr{}); st != 0 {
+		t.Fatalf("create in append-only dir: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "new"); st != syscall.EPERM {
+		t.Fatalf("unlink in append-only dir: %s", st)
+	}
+	if st := setFlags(ctx, dir, FlagImmutable); st != 0 {
+		t.Fatalf("set immutable on dir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "new2", 0666, 0, 0, nil, &Attr{}); st != syscall.EPERM {
+		t.Fatalf("create in immutable dir: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "flags", 1, "flags2", 0, nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename immutable dir: %s", st)
+	}
+
+	if st := setFlags(ctx, dir, 0); st != 0 {
+		t.Fatalf("clear flags of dir: %s", st)
+	}
+	if st := setFlags(ctx, inode, 0); st != 0 {
+		t.Fatalf("clear flags of f: %s", st)
+	}
+	for _, name := range []string{"f", "src", "new"} {
+		if st := m.Unlink(ctx, dir, name); st != 0 {
+			t.Fatalf("unlink %s: %s", name, st)
+		}
+	}
+	if st := m.Rmdir(ctx, 1, "flags"); st != 0 {
+		t.Fatalf("rmdir flags: %s", st)
+	}
+}
+
 func testLocks(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, false)
 	ctx := Background
@@ -750,6 +1177,74 @@ func testRemove(t *testing.T, m Meta) {
 	}
 }
 
+func testRemovePaced(t *testing.T, m Meta) {
+	if err := m.Init(Format{Name: "test", TrashDays: 1}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer func() {
+		if err := m.Init(Format{Name: "test"}, false); err != nil {
+			t.Fatalf("init: %s", err)
+		}
+	}()
+	ctx := Background
+	var parent, sub, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "paced", 0755, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir paced: %s", st)
+	}
+	if st := m.Mkdir(ctx, parent, "sub", 0755, 0, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir paced/sub: %s", st)
+	}
+	for i := 0; i < 20; i++ {
+		dir := parent
+		if i%2 == 1 {
+			dir = sub
+		}
+		if st := m.Create(ctx, dir, "f"+strconv.Itoa(i), 0644, 0, 0, &inode, attr); st != 0 {
+			t.Fatalf("create f%d: %s", i, st)
+		}
+	}
+	// 22 entries at 40 per second in batches of 5, the last pause is after 20 entries (0.5s)
+	var removed uint64
+	start := time.Now()
+	if st := RemovePaced(m, ctx, 1, "paced", Pace{Rate: 40, Batch: 5}, &removed); st != 0 {
+		t.Fatalf("paced rmr: %s", st)
+	}
+	if used := time.Since(start); used < time.Millisecond*450 {
+		t.Fatalf("paced rmr of %d entries takes %s, faster than the pace", removed, used)
+	}
+	if removed != 22 {
+		t.Fatalf("removed entries: %d != 22", removed)
+	}
+	if st := m.Lookup(ctx, 1, "paced", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup paced: %s", st)
+	}
+	// the files are moved into the trash
+	var entries []*Entry
+	if st := m.Readdir(ctx, TrashInode, 0, &entries); st != 0 {
+		t.Fatalf("readdir trash: %s", st)
+	}
+	var trashed int
+	for _, e := range entries {
+		if e.Inode == TrashInode || string(e.Name) == ".." {
+			continue
+		}
+		var files []*Entry
+		if st := m.Readdir(ctx, e.Inode, 0, &files); st != 0 {
+			t.Fatalf("readdir %s: %s", e.Name, st)
+		}
+		for _, f := range files {
+			if f.Attr.Typ == TypeFile {
+				trashed++
+			}
+		}
+	}
+	if trashed < 20 {
+		t.Fatalf("%d files in trash, expect 20", trashed)
+	}
+
+}
+
 func testCaseIncensi(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, false)
 	ctx := Background
@@ -795,7 +1290,7 @@ func testCaseIncensi(t *testing.T, m Meta) {
 }
 
 type compactor interface {
-	compactChunk(inode Ino, indx uint32, force bool)
+	compactChunk(inode Ino, indx uint32, whole, force bool) syscall.Errno
 }
 
 func testCompaction(t *testing.T, m Meta) {
@@ -837,7 +1332,7 @@ func testCompaction(t *testing.T, m Meta) {
 		t.Fatalf("expect 5 slices, but got %+v", cs1)
 	}
 	if c, ok := m.(compactor); ok {
-		c.compactChunk(inode, 1, true)
+		c.compactChunk(inode, 1, false, true)
 	}
 	var cs []Slice
 	_ = m.Read(ctx, inode, 1, &cs)
@@ -856,7 +1351,7 @@ func testCompaction(t *testing.T, m Meta) {
 		time.Sleep(time.Millisecond)
 	}
 	if c, ok := m.(compactor); ok {
-		c.compactChunk(inode, 0, true)
+		c.compactChunk(inode, 0, false, true)
 	}
 	var chunks []Slice
 	if st := m.Read(ctx, inode, 0, &chunks); st != 0 {
@@ -892,87 +1387,476 @@ func testCompaction(t *testing.T, m Meta) {
 	}
 }
 
-func testConcurrentWrite(t *testing.T, m Meta) {
+func testPauseBackground(t *testing.T, m Meta, base *baseMeta) {
+	deleted := make(chan uint64, 10)
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		deleted <- args[0].(uint64)
 		return nil
 	})
 	m.OnMsg(CompactChunk, func(args ...interface{}) error {
 		return nil
 	})
-	_ = m.Init(Format{Name: "test"}, false)
-
 	ctx := Background
 	var inode Ino
 	var attr = &Attr{}
-	_ = m.Unlink(ctx, 1, "f")
-	if st := m.Create(ctx, 1, "f", 0650, 022, 0, &inode, attr); st != 0 {
+	if st := m.Create(ctx, 1, "fpause", 0650, 022, 0, &inode, attr); st != 0 {
 		t.Fatalf("create file %s", st)
 	}
-	defer m.Unlink(ctx, 1, "f")
+	defer m.Unlink(ctx, 1, "fpause")
+	for i := 0; i < 2; i++ {
+		var chunkid uint64
+		m.NewChunk(ctx, &chunkid)
+		_ = m.Write(ctx, inode, 0, uint32(i)*100, Slice{Chunkid: chunkid, Size: 100, Len: 100})
+	}
 
-	var errno syscall.Errno
-	var g sync.WaitGroup
-	for i := 0; i <= 10; i++ {
-		g.Add(1)
-		go func(indx uint32) {
-			defer g.Done()
-			for j := 0; j < 100; j++ {
-				var chunkid uint64
-				m.NewChunk(ctx, &chunkid)
-				var slice = Slice{Chunkid: chunkid, Size: 100, Len: 100}
-				st := m.Write(ctx, inode, indx, 0, slice)
-				if st != 0 {
-					errno = st
-					break
-				}
-			}
-		}(uint32(i))
+	m.PauseBackground(true)
+	if !m.BackgroundPaused() {
+		t.Fatalf("background tasks should be paused")
+	}
+	c, ok := m.(compactor)
+	if !ok {
+		t.Fatalf("%T is not a compactor", m)
+	}
+	c.compactChunk(inode, 0, true, false)
+	var ss []Slice
+	if st := m.Read(ctx, inode, 0, &ss); st != 0 || len(ss) != 2 {
+		t.Fatalf("slices should not be compacted while paused: %s %+v", st, ss)
+	}
+	done := make(chan struct{})
+	go func() {
+		base.deleteSlice(1<<40, 100)
+		close(done)
+	}()
+	select {
+	case id := <-deleted:
+		t.Fatalf("slice %d is deleted while paused", id)
+	case <-time.After(time.Millisecond * 100):
 	}
-	g.Wait()
-	if errno != 0 {
-		t.Fatal()
+
+	m.PauseBackground(false)
+	if m.BackgroundPaused() {
+		t.Fatalf("background tasks should be resumed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("slice is not deleted after resumed")
+	}
+	if id := <-deleted; id != 1<<40 {
+		t.Fatalf("expect slice %d to be deleted, but got %d", uint64(1<<40), id)
+	}
+	c.compactChunk(inode, 0, true, false)
+	if st := m.Read(ctx, inode, 0, &ss); st != 0 || len(ss) != 1 {
+		t.Fatalf("slices should be compacted after resumed: %s %+v", st, ss)
 	}
 }
 
-func testTruncateAndDelete(t *testing.T, m Meta) {
+func testPunchHole(t *testing.T, m Meta) {
+	var l sync.Mutex
+	deleted := make(map[uint64]bool)
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		l.Lock()
+		deleted[args[0].(uint64)] = true
+		l.Unlock()
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
 		return nil
 	})
-	_ = m.Init(Format{Name: "test"}, false)
-
 	ctx := Background
 	var inode Ino
-	var attr = &Attr{}
-	m.Unlink(ctx, 1, "f")
-	if st := m.Truncate(ctx, 1, 0, 4<<10, attr); st != syscall.EPERM {
-		t.Fatalf("truncate dir %s", st)
+	var attr Attr
+	if st := m.Create(ctx, 1, "sparse", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create file: %s", st)
 	}
-	if st := m.Create(ctx, 1, "f", 0650, 022, 0, &inode, attr); st != 0 {
-		t.Fatalf("create file %s", st)
+	defer m.Unlink(ctx, 1, "sparse")
+	var ids []uint64
+	for indx := uint32(0); indx < 2; indx++ {
+		var chunkid uint64
+		m.NewChunk(ctx, &chunkid)
+		if st := m.Write(ctx, inode, indx, 0, Slice{Chunkid: chunkid, Size: 1 << 20, Len: 1 << 20}); st != 0 {
+			t.Fatalf("write chunk %d: %s", indx, st)
+		}
+		ids = append(ids, chunkid)
 	}
-	defer m.Unlink(ctx, 1, "f")
-	var cid uint64
-	if st := m.NewChunk(ctx, &cid); st != 0 {
-		t.Fatalf("new chunk: %s", st)
+	// punch the data of the first chunk and part of the second one
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 0, ChunkSize+(512<<10)); st != 0 {
+		t.Fatalf("punch hole: %s", st)
 	}
-	if st := m.Write(ctx, inode, 0, 100, Slice{cid, 100, 0, 100}); st != 0 {
-		t.Fatalf("write file %s", st)
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 || attr.Length != ChunkSize+(1<<20) {
+		t.Fatalf("expect length %d after punching a hole, but got %d: %s", ChunkSize+(1<<20), attr.Length, st)
 	}
-	if st := m.Truncate(ctx, inode, 0, 200<<20, attr); st != 0 {
-		t.Fatalf("truncate file %s", st)
+	var slices []Slice
+	if st := m.Read(ctx, inode, 1, &slices); st != 0 {
+		t.Fatalf("read chunk 1: %s", st)
 	}
-	if st := m.Truncate(ctx, inode, 0, (10<<40)+10, attr); st != 0 {
-		t.Fatalf("truncate file %s", st)
+	var data uint32
+	for _, s := range slices {
+		if s.Chunkid != 0 {
+			data += s.Len
+		}
 	}
-	if st := m.Truncate(ctx, inode, 0, (300<<20)+10, attr); st != 0 {
-		t.Fatalf("truncate file %s", st)
+	if data != 512<<10 {
+		t.Fatalf("expect %d bytes of data left in chunk 1, but got %+v", 512<<10, slices)
 	}
-	var total int64
-	slices := make(map[Ino][]Slice)
-	m.ListSlices(ctx, slices, false, func() { total++ })
-	var totalSlices int
-	for _, ss := range slices {
-		totalSlices += len(ss)
+
+	// the slices are released in background
+	for i := 0; i < 100; i++ {
+		l.Lock()
+		done := deleted[ids[0]]
+		l.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if c, ok := m.(compactor); ok {
+		c.compactChunk(inode, 0, true, true)
+	}
+	l.Lock()
+	if !deleted[ids[0]] {
+		t.Fatalf("the slice %d in the hole should be deleted", ids[0])
+	}
+	l.Unlock()
+	slices = nil
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 0 {
+		t.Fatalf("expect chunk 0 to be deleted, but got %+v: %s", slices, st)
+	}
+}
+
+func testCompactFile(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		return nil
+	})
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "cf")
+	if st := m.Create(ctx, 1, "cf", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "cf")
+
+	// a large slice overwritten in the middle, which is skipped by the compaction in background
+	write := func(indx uint32, off, size uint32) {
+		var chunkid uint64
+		m.NewChunk(ctx, &chunkid)
+		if st := m.Write(ctx, inode, indx, off, Slice{Chunkid: chunkid, Size: size, Len: size}); st != 0 {
+			t.Fatalf("write %d:%d: %s", indx, off, st)
+		}
+	}
+	write(0, 0, 8<<20)
+	write(0, 1<<20, 4<<10)
+	write(0, 3<<20, 4<<10)
+	write(1, 0, 1<<20)
+	write(1, 1<<20, 1<<20)
+	var stats CompactStats
+	if st := m.CompactFile(ctx, inode, &stats); st != 0 {
+		t.Fatalf("compact file: %s", st)
+	}
+	expected := CompactStats{Chunks: 2, OldSlices: 7, NewSlices: 2, Bytes: 10 << 20}
+	if stats != expected {
+		t.Fatalf("expect %+v, but got %+v", expected, stats)
+	}
+	for indx, length := range []uint32{8 << 20, 2 << 20} {
+		var cs []Slice
+		if st := m.Read(ctx, inode, uint32(indx), &cs); st != 0 || len(cs) != 1 || cs[0].Len != length {
+			t.Fatalf("read chunk %d: %s %+v", indx, st, cs)
+		}
+	}
+
+	// nothing to do
+	stats = CompactStats{}
+	if st := m.CompactFile(ctx, inode, &stats); st != 0 || stats.Chunks != 0 || stats.OldSlices != 2 || stats.NewSlices != 2 {
+		t.Fatalf("compact file again: %s %+v", st, stats)
+	}
+	if st := m.CompactFile(ctx, 1, &stats); st != syscall.EINVAL {
+		t.Fatalf("compact directory should fail with EINVAL, but got %s", st)
+	}
+}
+
+func TestNeedCompact(t *testing.T) {
+	overwrite := func(n int, size uint32) []*slice {
+		var ss []*slice
+		for i := 0; i < n; i++ {
+			ss = append(ss, newSlice(0, uint64(i+1), size, 0, size))
+		}
+		return ss
+	}
+	for _, c := range []struct {
+		conf   Config
+		ss     []*slice
+		expect bool
+	}{
+		{Config{}, overwrite(4, 1<<20), false},
+		{Config{}, overwrite(5, 1<<20), true},
+		{Config{CompactSlices: 10}, overwrite(5, 1<<20), false},
+		{Config{CompactSlices: 10, CompactBytes: 4 << 20}, overwrite(4, 1<<20), true},
+		{Config{CompactSlices: 10, CompactBytes: 8 << 20}, overwrite(4, 1<<20), false},
+		{Config{ReadOnly: true}, overwrite(5, 1<<20), false},
+	} {
+		m := newBaseMeta(&c.conf)
+		if r := m.needCompact(2, c.ss, buildSlice(c.ss)); r != c.expect {
+			t.Fatalf("need compact with %+v and %d slices: expect %v but got %v", c.conf, len(c.ss), c.expect, r)
+		}
+	}
+
+	// the thresholds of an opened file
+	m := newBaseMeta(&Config{})
+	m.of.Open(2, &Attr{}, 0)
+	m.SetCompactHint(2, 10, 0)
+	if m.needCompact(2, overwrite(5, 1<<20), nil) || !m.needCompact(3, overwrite(5, 1<<20), nil) {
+		t.Fatalf("5 slices should be compacted for the other files, but not for the hinted one")
+	}
+	m.SetCompactHint(2, 10, 4<<20)
+	if !m.needCompact(2, overwrite(4, 1<<20), nil) {
+		t.Fatalf("4 MiB of slices should be compacted with the hinted bytes")
+	}
+}
+
+func testConcurrentWrite(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	m.OnMsg(CompactChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, false)
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "f")
+	if st := m.Create(ctx, 1, "f", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "f")
+
+	var errno syscall.Errno
+	var g sync.WaitGroup
+	for i := 0; i <= 10; i++ {
+		g.Add(1)
+		go func(indx uint32) {
+			defer g.Done()
+			for j := 0; j < 100; j++ {
+				var chunkid uint64
+				m.NewChunk(ctx, &chunkid)
+				var slice = Slice{Chunkid: chunkid, Size: 100, Len: 100}
+				st := m.Write(ctx, inode, indx, 0, slice)
+				if st != 0 {
+					errno = st
+					break
+				}
+			}
+		}(uint32(i))
+	}
+	g.Wait()
+	if errno != 0 {
+		t.Fatal()
+	}
+}
+
+func testSliceChecksums(t *testing.T, m Meta) {
+	ctx := Background
+	var chunkid uint64
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	var sums []uint32
+	if st := m.GetSliceChecksums(ctx, chunkid, &sums); st != syscall.ENOENT {
+		t.Fatalf("checksums of new slice: %v %s", sums, st)
+	}
+	if st := m.SetSliceChecksums(ctx, chunkid, []uint32{1, 0xdeadbeef}); st != 0 {
+		t.Fatalf("set checksums: %s", st)
+	}
+	if st := m.GetSliceChecksums(ctx, chunkid, &sums); st != 0 || !reflect.DeepEqual(sums, []uint32{1, 0xdeadbeef}) {
+		t.Fatalf("get checksums: %v %s", sums, st)
+	}
+	if err := m.(engine).doDeleteSlice(chunkid, 100); err != nil {
+		t.Fatalf("delete slice: %s", err)
+	}
+	if st := m.GetSliceChecksums(ctx, chunkid, &sums); st != syscall.ENOENT {
+		t.Fatalf("checksums should be deleted with the slice: %v %s", sums, st)
+	}
+}
+
+func testSliceData(t *testing.T, m Meta) {
+	ctx := Background
+	var chunkid uint64
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	var data []byte
+	if st := m.GetSliceData(ctx, chunkid, &data); st != syscall.ENOENT {
+		t.Fatalf("data of new slice: %v %s", data, st)
+	}
+	if st := m.SetSliceData(ctx, chunkid, []byte("hello")); st != 0 {
+		t.Fatalf("set data: %s", st)
+	}
+	if st := m.GetSliceData(ctx, chunkid, &data); st != 0 || string(data) != "hello" {
+		t.Fatalf("get data: %q %s", data, st)
+	}
+	if err := m.(engine).doDeleteSlice(chunkid, 5); err != nil {
+		t.Fatalf("delete slice: %s", err)
+	}
+	if st := m.GetSliceData(ctx, chunkid, &data); st != syscall.ENOENT {
+		t.Fatalf("data should be deleted with the slice: %q %s", data, st)
+	}
+}
+
+func testCompareAndSwapXattr(t *testing.T, m Meta) {
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "f")
+	if st := m.Create(ctx, 1, "f", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "f")
+
+	if st := m.CompareAndSwapXattr(ctx, inode, "user.v", []byte("0"), []byte("1")); st != syscall.ECANCELED {
+		t.Fatalf("cas of missing xattr: %s", st)
+	}
+	if st := m.CompareAndSwapXattr(ctx, inode, "user.v", nil, []byte("0")); st != 0 {
+		t.Fatalf("cas to create xattr: %s", st)
+	}
+	var wins int32
+	var g sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		g.Add(1)
+		go func(i int) {
+			defer g.Done()
+			st := m.CompareAndSwapXattr(ctx, inode, "user.v", []byte("0"), []byte(strconv.Itoa(i+1)))
+			if st == 0 {
+				atomic.AddInt32(&wins, 1)
+			} else if st != syscall.ECANCELED {
+				t.Errorf("cas: %s", st)
+			}
+		}(i)
+	}
+	g.Wait()
+	var value []byte
+	if st := m.GetXattr(ctx, inode, "user.v", &value); st != 0 || wins != 1 || string(value) == "0" {
+		t.Fatalf("expect exactly one winner, but got %d, value %q: %s", wins, value, st)
+	}
+	if st := m.CompareAndSwapXattr(ctx, inode, "user.v", value, []byte("done")); st != 0 {
+		t.Fatalf("cas: %s", st)
+	}
+	if st := m.GetXattr(ctx, inode, "user.v", &value); st != 0 || string(value) != "done" {
+		t.Fatalf("getxattr: %q %s", value, st)
+	}
+}
+
+// testXattrChecksum stamps the xattrs with checksum, and corrupts one in the engine.
+func testXattrChecksum(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	_ = m.Unlink(ctx, 1, "x")
+	if st := m.Create(ctx, 1, "x", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "x")
+	// set before the checksum is enabled
+	if st := m.SetXattr(ctx, inode, "user.old", []byte("old"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr user.old: %s", st)
+	}
+	base.fmt.XattrChecksum = true
+	defer func() { base.fmt.XattrChecksum = false }()
+	if st := m.SetXattr(ctx, inode, "user.new", []byte("new"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr user.new: %s", st)
+	}
+	var value []byte
+	if st := base.en.doGetXattr(ctx, inode, "user.new", &value); st != 0 || len(value) != 3+xattrStampSize {
+		t.Fatalf("user.new should be stamped: %q %s", value, st)
+	}
+	for name, expected := range map[string]string{"user.old": "old", "user.new": "new"} {
+		if st := m.GetXattr(ctx, inode, name, &value); st != 0 || string(value) != expected {
+			t.Fatalf("getxattr %s: %q %s", name, value, st)
+		}
+		if st := m.CompareAndSwapXattr(ctx, inode, name, []byte("x"), []byte("y")); st != syscall.ECANCELED {
+			t.Fatalf("cas %s with a wrong value: %s", name, st)
+		}
+		if st := m.CompareAndSwapXattr(ctx, inode, name, []byte(expected), []byte(expected+"2")); st != 0 {
+			t.Fatalf("cas %s: %s", name, st)
+		}
+		if st := m.GetXattr(ctx, inode, name, &value); st != 0 || string(value) != expected+"2" {
+			t.Fatalf("getxattr %s after cas: %q %s", name, value, st)
+		}
+	}
+
+	// corrupt the value in the engine
+	if st := base.en.doGetXattr(ctx, inode, "user.new", &value); st != 0 {
+		t.Fatalf("get raw user.new: %s", st)
+	}
+	value[0] ^= 0xFF
+	if st := base.en.doSetXattr(ctx, inode, "user.new", value, XattrReplace); st != 0 {
+		t.Fatalf("corrupt user.new: %s", st)
+	}
+	if st := m.GetXattr(ctx, inode, "user.new", &value); st != syscall.EIO {
+		t.Fatalf("the corrupted user.new should not be returned: %q %s", value, st)
+	}
+	if st := m.CompareAndSwapXattr(ctx, inode, "user.new", []byte("new2"), []byte("new3")); st != syscall.EIO {
+		t.Fatalf("cas of the corrupted user.new: %s", st)
+	}
+	corrupted := make(map[Ino][]string)
+	if st := m.CheckXattrs(ctx, corrupted); st != 0 {
+		t.Fatalf("check xattrs: %s", st)
+	}
+	if len(corrupted) != 1 || len(corrupted[inode]) != 1 || corrupted[inode][0] != "user.new" {
+		t.Fatalf("expect user.new of inode %d is corrupted, but got %+v", inode, corrupted)
+	}
+	// it can be fixed by setting it again
+	if st := m.SetXattr(ctx, inode, "user.new", []byte("new"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr user.new: %s", st)
+	}
+	if st := m.GetXattr(ctx, inode, "user.new", &value); st != 0 || string(value) != "new" {
+		t.Fatalf("getxattr user.new: %q %s", value, st)
+	}
+}
+
+func testTruncateAndDelete(t *testing.T, m Meta) {
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		return nil
+	})
+	_ = m.Init(Format{Name: "test"}, false)
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	m.Unlink(ctx, 1, "f")
+	if st := m.Truncate(ctx, 1, 0, 4<<10, attr); st != syscall.EPERM {
+		t.Fatalf("truncate dir %s", st)
+	}
+	if st := m.Create(ctx, 1, "f", 0650, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create file %s", st)
+	}
+	defer m.Unlink(ctx, 1, "f")
+	var cid uint64
+	if st := m.NewChunk(ctx, &cid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 100, Slice{cid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write file %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 200<<20, attr); st != 0 {
+		t.Fatalf("truncate file %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, (10<<40)+10, attr); st != 0 {
+		t.Fatalf("truncate file %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, (300<<20)+10, attr); st != 0 {
+		t.Fatalf("truncate file %s", st)
+	}
+	var total int64
+	slices := make(map[Ino][]Slice)
+	m.ListSlices(ctx, slices, false, func() { total++ })
+	var totalSlices int
+	for _, ss := range slices {
+		totalSlices += len(ss)
 	}
 	if totalSlices != 1 {
 		t.Fatalf("number of chunks: %d != 1, %+v", totalSlices, slices)
@@ -1115,6 +1999,65 @@ func testCloseSession(t *testing.T, m Meta) {
 	}
 }
 
+// testKillSession leaves a session with locks and a sustained inode behind like a crashed client,
+// and kills it.
+func testKillSession(t *testing.T, m Meta) {
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "k", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create k: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 1, false, syscall.F_WRLCK, 0, 0x10000, 1); st != 0 {
+		t.Fatalf("plock wlock: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "k"); st != 0 {
+		t.Fatalf("unlink k: %s", st)
+	}
+	var sid uint64
+	switch m := m.(type) {
+	case *redisMeta:
+		sid = m.sid
+	case *dbMeta:
+		sid = m.sid
+	case *kvMeta:
+		sid = m.sid
+	}
+	ss, err := m.ListSessions()
+	if err != nil {
+		t.Fatalf("list sessions: %s", err)
+	}
+	var found bool
+	for _, s := range ss {
+		found = found || s.Sid == sid
+	}
+	if !found {
+		t.Fatalf("session %d is not listed: %+v", sid, ss)
+	}
+	if s, err := m.GetSession(sid); err != nil || len(s.Flocks) != 1 || len(s.Plocks) != 1 || len(s.Sustained) != 1 {
+		t.Fatalf("incorrect session: %+v %v", s, err)
+	}
+
+	if err = m.KillSession(sid); err != nil {
+		t.Fatalf("kill session: %s", err)
+	}
+	if _, err = m.GetSession(sid); err == nil {
+		t.Fatalf("session %d is not removed", sid)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+		t.Fatalf("sustained inode %d should be deleted: %s", inode, st)
+	}
+	if err = m.KillSession(sid); err == nil {
+		t.Fatalf("kill a removed session")
+	}
+}
+
 func testTrash(t *testing.T, m Meta) {
 	if err := m.Init(Format{Name: "test", TrashDays: 1}, false); err != nil {
 		t.Fatalf("init: %s", err)
@@ -1224,6 +2167,41 @@ func testOpenCache(t *testing.T, m Meta) {
 	}
 }
 
+func testReadYourWrites(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "ryw", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create ryw: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "ryw")
+	defer m.Close(ctx, inode)
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 0 {
+		t.Fatalf("getattr ryw: %s %d", st, attr.Length)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write ryw: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("length of ryw should be 100 after write: %s %d", st, attr.Length)
+	}
+
+	// the attributes fetched before a local change should not be cached
+	stale := *attr
+	ver := base.of.startFetch()
+	if st := m.Write(ctx, inode, 0, 100, Slice{Chunkid: 2, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write ryw: %s", st)
+	}
+	base.of.Update(inode, &stale, ver)
+	base.of.endFetch()
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 200 {
+		t.Fatalf("length of ryw should be 200 after write: %s %d", st, attr.Length)
+	}
+	if len(base.of.changed) != 0 {
+		t.Fatalf("changes should be dropped when nothing is fetching: %v", base.of.changed)
+	}
+}
+
 func testReadOnly(t *testing.T, m Meta) {
 	ctx := Background
 	if err := m.NewSession(); err != nil {
@@ -1243,3 +2221,539 @@ func testReadOnly(t *testing.T, m Meta) {
 		t.Fatalf("open f: %s", st)
 	}
 }
+
+func testClone(t *testing.T, m Meta) {
+	var deleted = make(chan uint64, 10)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		select {
+		case deleted <- args[0].(uint64):
+		default:
+		}
+		return nil
+	})
+	defer m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	_ = m.Init(Format{Name: "test"}, false)
+
+	ctx := Background
+	var dir, sub, file, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "cs", 0750, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir cs: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir cs/sub: %s", st)
+	}
+	if st := m.Mknod(ctx, sub, "f", TypeFile, 0640, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("mknod cs/sub/f: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, file, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write cs/sub/f: %s", st)
+	}
+	if st := m.SetXattr(ctx, file, "user.k", []byte("v"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr cs/sub/f: %s", st)
+	}
+	if st := m.Symlink(ctx, dir, "s", "sub/f", &inode, attr); st != 0 {
+		t.Fatalf("symlink cs/s: %s", st)
+	}
+
+	if st := CloneEntry(m, ctx, dir, sub, "loop"); st != syscall.EINVAL {
+		t.Fatalf("clone into itself should fail: %s", st)
+	}
+	var ro Ino
+	if st := m.Mkdir(ctx, 1, "cro", 0755, 022, 0, &ro, attr); st != 0 {
+		t.Fatalf("mkdir cro: %s", st)
+	}
+	if st := CloneEntry(m, NewContext(100, 1, []uint32{1}), dir, ro, "cd"); st != syscall.EACCES {
+		t.Fatalf("clone into a readonly directory should fail: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "cro"); st != 0 {
+		t.Fatalf("rmdir cro: %s", st)
+	}
+	if st := CloneEntry(m, ctx, dir, 1, "cs"); st != syscall.EEXIST {
+		t.Fatalf("clone to an existing entry should fail: %s", st)
+	}
+	if st := CloneEntry(m, ctx, dir, 1, "cd"); st != 0 {
+		t.Fatalf("clone cs: %s", st)
+	}
+	var cdir, cfile Ino
+	if st := m.Lookup(ctx, 1, "cd", &cdir, attr); st != 0 || attr.Typ != TypeDirectory || attr.Mode != 0750 {
+		t.Fatalf("lookup cd: %s %+v", st, attr)
+	}
+	if st := m.Resolve(ctx, cdir, "sub/f", &cfile, attr); st == syscall.ENOTSUP {
+		var csub Ino
+		if st = m.Lookup(ctx, cdir, "sub", &csub, attr); st == 0 {
+			st = m.Lookup(ctx, csub, "f", &cfile, attr)
+		}
+		if st != 0 {
+			t.Fatalf("lookup cd/sub/f: %s", st)
+		}
+	} else if st != 0 {
+		t.Fatalf("resolve cd/sub/f: %s", st)
+	}
+	if cfile == file || attr.Length != 100 || attr.Mode != 0640 {
+		t.Fatalf("unexpected clone of file: %d %+v", cfile, attr)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, cfile, "user.k", &value); st != 0 || string(value) != "v" {
+		t.Fatalf("getxattr cd/sub/f: %s %q", st, value)
+	}
+	var target []byte
+	if st := m.Lookup(ctx, cdir, "s", &inode, attr); st != 0 || attr.Typ != TypeSymlink {
+		t.Fatalf("lookup cd/s: %s", st)
+	}
+	if st := m.ReadLink(ctx, inode, &target); st != 0 || string(target) != "sub/f" {
+		t.Fatalf("readlink cd/s: %s %s", st, target)
+	}
+	var slices []Slice
+	if st := m.Read(ctx, cfile, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("clone should share the slices: %s %+v", st, slices)
+	}
+
+	// writes to the clone don't affect the source
+	var chunkid2 uint64
+	_ = m.NewChunk(ctx, &chunkid2)
+	if st := m.Write(ctx, cfile, 0, 0, Slice{chunkid2, 50, 0, 50}); st != 0 {
+		t.Fatalf("write cd/sub/f: %s", st)
+	}
+	if st := m.Read(ctx, file, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("source should not be changed: %s %+v", st, slices)
+	}
+	if st := m.Read(ctx, cfile, 0, &slices); st != 0 || len(slices) != 2 || slices[0].Chunkid != chunkid2 {
+		t.Fatalf("clone should be changed: %s %+v", st, slices)
+	}
+
+	// the shared slice is still referenced by the clone
+	if st := Remove(m, ctx, 1, "cs"); st != 0 {
+		t.Fatalf("rmr cs: %s", st)
+	}
+	select {
+	case id := <-deleted:
+		t.Fatalf("chunk %d should not be deleted", id)
+	case <-time.After(time.Millisecond * 200):
+	}
+	if st := m.Read(ctx, cfile, 0, &slices); st != 0 || len(slices) != 2 || slices[1].Chunkid != chunkid {
+		t.Fatalf("clone should not be changed: %s %+v", st, slices)
+	}
+	if st := Remove(m, ctx, 1, "cd"); st != 0 {
+		t.Fatalf("rmr cd: %s", st)
+	}
+	got := make(map[uint64]bool)
+	for len(got) < 2 {
+		select {
+		case id := <-deleted:
+			got[id] = true
+		case <-time.After(time.Second * 10):
+			t.Fatalf("chunks are not deleted: %+v", got)
+		}
+	}
+	if !got[chunkid] || !got[chunkid2] {
+		t.Fatalf("unexpected deleted chunks: %+v", got)
+	}
+}
+
+func testSnapshot(t *testing.T, m Meta) {
+	var deleted = make(chan uint64, 10)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		select {
+		case deleted <- args[0].(uint64):
+		default:
+		}
+		return nil
+	})
+	defer m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+	_ = m.Init(Format{Name: "test"}, false)
+
+	ctx := Background
+	var dir, file, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "snap", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir snap: %s", st)
+	}
+	if st := m.Mknod(ctx, dir, "f", TypeFile, 0644, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("mknod snap/f: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, file, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write snap/f: %s", st)
+	}
+	if st := CreateSnapshot(m, ctx, "/snap", "s1"); st != 0 {
+		t.Fatalf("create snapshot: %s", st)
+	}
+	if st := CreateSnapshot(m, ctx, "/snap", "s1"); st != syscall.EEXIST {
+		t.Fatalf("create an existing snapshot should fail: %s", st)
+	}
+	for _, c := range []struct{ path, name string }{{"/snap", "a/b"}, {"/snap/f", "s2"}, {"/none", "s2"}, {"/" + SnapshotDir + "/s1", "s2"}} {
+		if st := CreateSnapshot(m, ctx, c.path, c.name); st == 0 {
+			t.Fatalf("create snapshot %s of %s should fail", c.name, c.path)
+		}
+	}
+	snapshots, st := ListSnapshots(m, ctx)
+	if st != 0 || len(snapshots) != 1 || snapshots[0].Name != "s1" || snapshots[0].Path != "/snap" || snapshots[0].Inode == dir {
+		t.Fatalf("list snapshots: %s %+v", st, snapshots)
+	}
+
+	// the snapshots can only be changed by the snapshot API
+	var root, sfile Ino
+	if st := m.Lookup(ctx, 1, SnapshotDir, &root, attr); st != 0 || attr.Flags&FlagImmutable == 0 {
+		t.Fatalf("lookup %s: %s %+v", SnapshotDir, st, attr)
+	}
+	if st := m.Lookup(ctx, snapshots[0].Inode, "f", &sfile, attr); st != 0 || attr.Flags&FlagImmutable == 0 {
+		t.Fatalf("lookup s1/f: %s %+v", st, attr)
+	}
+	if st := m.Write(ctx, sfile, 0, 0, Slice{chunkid, 100, 0, 100}); st != syscall.EPERM {
+		t.Fatalf("write s1/f: %s", st)
+	}
+	if st := m.Unlink(ctx, snapshots[0].Inode, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink s1/f: %s", st)
+	}
+	if st := m.Rmdir(ctx, root, "s1"); st != syscall.EPERM {
+		t.Fatalf("rmdir s1: %s", st)
+	}
+	if st := m.Rename(ctx, root, "s1", 1, "s1", 0, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("rename s1 out of %s: %s", SnapshotDir, st)
+	}
+	if st := m.Rename(ctx, dir, "f", root, "f", 0, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("rename snap/f into %s: %s", SnapshotDir, st)
+	}
+	if st := m.Rmdir(ctx, 1, SnapshotDir); st == 0 {
+		t.Fatalf("rmdir %s should fail", SnapshotDir)
+	}
+
+	// modify the directory and roll back
+	var chunkid2 uint64
+	_ = m.NewChunk(ctx, &chunkid2)
+	if st := m.Write(ctx, file, 0, 0, Slice{chunkid2, 100, 0, 100}); st != 0 {
+		t.Fatalf("write snap/f: %s", st)
+	}
+	if st := m.Mknod(ctx, dir, "new", TypeFile, 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mknod snap/new: %s", st)
+	}
+	if st := RollbackSnapshot(m, ctx, "none"); st != syscall.ENOENT {
+		t.Fatalf("rollback to a missing snapshot should fail: %s", st)
+	}
+	if st := RollbackSnapshot(m, ctx, "s1"); st != 0 {
+		t.Fatalf("rollback: %s", st)
+	}
+	var ndir Ino
+	if st := m.Lookup(ctx, 1, "snap", &ndir, attr); st != 0 || ndir == dir || attr.Mode != 0755 {
+		t.Fatalf("lookup snap: %s %d %+v", st, ndir, attr)
+	}
+	if st := m.Lookup(ctx, ndir, "new", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("snap/new should be gone: %s", st)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, 1, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	}
+	for _, e := range entries {
+		if strings.Contains(string(e.Name), "rollback") {
+			t.Fatalf("temporary entry %s is left", e.Name)
+		}
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, ndir, snapshotXattr, &value); st != ENOATTR {
+		t.Fatalf("bookkeeping of snapshot should not be rolled back: %s %s", st, value)
+	}
+	var slices []Slice
+	if st := m.Lookup(ctx, ndir, "f", &file, attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("lookup snap/f: %s %+v", st, attr)
+	}
+	if st := m.Read(ctx, file, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+		t.Fatalf("snap/f should be rolled back: %s %+v", st, slices)
+	}
+	// the slice written after the snapshot is freed with the old directory
+	select {
+	case id := <-deleted:
+		if id != chunkid2 {
+			t.Fatalf("chunk %d should not be deleted", id)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("chunk %d is not deleted", chunkid2)
+	}
+
+	// the data only used by the snapshot is freed by deleting it
+	if st := Remove(m, ctx, 1, "snap"); st != 0 {
+		t.Fatalf("rmr snap: %s", st)
+	}
+	select {
+	case id := <-deleted:
+		t.Fatalf("chunk %d is still used by the snapshot", id)
+	case <-time.After(time.Millisecond * 200):
+	}
+	if st := RollbackSnapshot(m, ctx, "s1"); st != 0 {
+		t.Fatalf("rollback a removed directory: %s", st)
+	}
+	if st := Remove(m, ctx, 1, "snap"); st != 0 {
+		t.Fatalf("rmr snap: %s", st)
+	}
+	if st := DeleteSnapshot(m, ctx, "s1"); st != 0 {
+		t.Fatalf("delete snapshot: %s", st)
+	}
+	select {
+	case id := <-deleted:
+		if id != chunkid {
+			t.Fatalf("chunk %d should not be deleted", id)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("chunk %d is not deleted", chunkid)
+	}
+	if snapshots, st = ListSnapshots(m, ctx); st != 0 || len(snapshots) != 0 {
+		t.Fatalf("list snapshots: %s %+v", st, snapshots)
+	}
+	if st := DeleteSnapshot(m, ctx, "s1"); st != syscall.ENOENT {
+		t.Fatalf("delete a missing snapshot: %s", st)
+	}
+	if st := setImmutable(m, root, false); st != 0 {
+		t.Fatalf("clear flags of %s: %s", SnapshotDir, st)
+	}
+	if st := m.Rmdir(ctx, 1, SnapshotDir); st != 0 {
+		t.Fatalf("rmdir %s: %s", SnapshotDir, st)
+	}
+}
+
+func testReaddirPage(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "pages", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir pages: %s", st)
+	}
+	for i := 0; i < 100; i++ {
+		if st := m.Create(ctx, dir, fmt.Sprintf("f%03d", i), 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	// list all pages, and calls between with the cursor of next page
+	list := func(plus uint8, limit int, between func(page int)) map[string]int {
+		names := make(map[string]int)
+		var cursor string
+		for page := 0; ; page++ {
+			var entries []*Entry
+			next, st := m.ReaddirPage(ctx, dir, plus, cursor, limit, &entries)
+			if st != 0 {
+				t.Fatalf("readdir page %d after %q: %s", page, cursor, st)
+			}
+			if len(entries) == 0 && next != "" {
+				t.Fatalf("empty page %d with cursor %q", page, next)
+			}
+			for _, e := range entries {
+				names[string(e.Name)]++
+				if plus != 0 && !e.Attr.Full {
+					t.Fatalf("entry %s has no attributes", e.Name)
+				}
+			}
+			if next == "" {
+				return names
+			}
+			cursor = next
+			if between != nil {
+				between(page)
+			}
+		}
+	}
+	for _, limit := range []int{1, 7, 200} {
+		names := list(1, limit, nil)
+		if len(names) != 102 || names["."] != 1 || names[".."] != 1 {
+			t.Fatalf("list in pages of %d: %d entries", limit, len(names))
+		}
+		for n, c := range names {
+			if c != 1 {
+				t.Fatalf("entry %s is listed %d times in pages of %d", n, c, limit)
+			}
+		}
+	}
+	// the entries not changed during the listing are always returned
+	names := list(0, 10, func(page int) {
+		switch page {
+		case 1:
+			_ = m.Unlink(ctx, dir, "f005")
+			_ = m.Unlink(ctx, dir, "f099")
+		case 3:
+			_ = m.Create(ctx, dir, "new", 0644, 022, 0, &inode, attr)
+		}
+	})
+	for i := 0; i < 99; i++ {
+		if name := fmt.Sprintf("f%03d", i); i != 5 && names[name] == 0 {
+			t.Fatalf("entry %s is not listed", name)
+		}
+	}
+	if names["f099"] != 0 {
+		t.Fatalf("f099 is listed after it's removed")
+	}
+}
+
+func testApplyAttrChange(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "ca", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir ca: %s", st)
+	}
+	var nodes = map[string]Ino{"/": dir}
+	var parent = dir
+	for _, name := range []string{"d1", "d2", "d3"} {
+		if st := m.Mkdir(ctx, parent, name, 0755, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("mkdir %s: %s", name, st)
+		}
+		for i := 0; i < 3; i++ {
+			var f Ino
+			if st := m.Create(ctx, inode, fmt.Sprintf("f%d", i), 0644, 022, 0, &f, attr); st != 0 {
+				t.Fatalf("create: %s", st)
+			}
+			nodes[fmt.Sprintf("%s/f%d", name, i)] = f
+		}
+		nodes[name] = inode
+		parent = inode
+	}
+	var link Ino
+	if st := m.Symlink(ctx, dir, "s", "d1", &link, attr); st != 0 {
+		t.Fatalf("symlink: %s", st)
+	}
+	checkMode := func(ino Ino, mode uint16) {
+		if st := m.GetAttr(ctx, ino, attr); st != 0 || attr.Mode != mode {
+			t.Fatalf("mode of inode %d: %s %o, expected %o", ino, st, attr.Mode, mode)
+		}
+	}
+
+	// not recursive
+	var visited, changed uint64
+	c := &AttrChange{Set: SetAttrMode, Clear: 0055, Mode: 0}
+	if last, st := ApplyAttrChange(m, ctx, dir, c, false, "", 0, &visited, &changed); st != 0 || last != "" || visited != 1 || changed != 1 {
+		t.Fatalf("chmod ca: %s %q %d %d", st, last, visited, changed)
+	}
+	checkMode(dir, 0700)
+	checkMode(nodes["d1"], 0755)
+
+	// recursive in batches, the symlink is skipped
+	c = &AttrChange{Set: SetAttrMode, Clear: 0, Mode: 0070}
+	var after string
+	var batches int
+	visited, changed = 0, 0
+	for {
+		last, st := ApplyAttrChange(m, ctx, dir, c, true, after, 4, &visited, &changed)
+		if st != 0 {
+			t.Fatalf("chmod -R ca after %q: %s", after, st)
+		}
+		batches++
+		if last == "" {
+			break
+		}
+		after = last
+	}
+	if visited != 14 || changed != 13 || batches != 4 {
+		t.Fatalf("visited %d, changed %d in %d batches", visited, changed, batches)
+	}
+	checkMode(dir, 0770)
+	checkMode(nodes["d3/f2"], 0674)
+	if st := m.GetAttr(ctx, link, attr); st != 0 || attr.Mode != 0644 {
+		t.Fatalf("mode of symlink: %s %o", st, attr.Mode)
+	}
+	// nothing to change when run again
+	visited, changed = 0, 0
+	if last, st := ApplyAttrChange(m, ctx, dir, c, true, "", 0, &visited, &changed); st != 0 || last != "" || visited != 14 || changed != 0 {
+		t.Fatalf("chmod -R ca again: %s %q %d %d", st, last, visited, changed)
+	}
+
+	// only root can change the owner, and the owner can change the group to one of its groups
+	c = &AttrChange{Set: SetAttrUID | SetAttrGID, Uid: 100, Gid: 100}
+	visited, changed = 0, 0
+	if _, st := ApplyAttrChange(m, ctx, nodes["d1"], c, true, "", 0, &visited, &changed); st != 0 || changed != 12 {
+		t.Fatalf("chown -R d1: %s %d", st, changed)
+	}
+	if st := m.GetAttr(ctx, nodes["d2/f1"], attr); st != 0 || attr.Uid != 100 || attr.Gid != 100 {
+		t.Fatalf("owner of d1/d2/f1: %s %d:%d", st, attr.Uid, attr.Gid)
+	}
+	user := NewContext(1, 100, []uint32{100, 200})
+	if _, st := ApplyAttrChange(m, user, nodes["d1"], &AttrChange{Set: SetAttrUID, Uid: 200}, true, "", 0, &visited, &changed); st != syscall.EPERM {
+		t.Fatalf("chown by non-root should fail: %s", st)
+	}
+	if _, st := ApplyAttrChange(m, user, nodes["d1"], &AttrChange{Set: SetAttrGID, Gid: 300}, true, "", 0, &visited, &changed); st != syscall.EPERM {
+		t.Fatalf("chgrp to other group should fail: %s", st)
+	}
+	visited, changed = 0, 0
+	if _, st := ApplyAttrChange(m, user, nodes["d1"], &AttrChange{Set: SetAttrGID, Gid: 200}, true, "", 0, &visited, &changed); st != 0 || changed != 12 {
+		t.Fatalf("chgrp -R d1: %s %d", st, changed)
+	}
+	// the failed node is returned
+	if last, st := ApplyAttrChange(m, user, dir, &AttrChange{Set: SetAttrMode, Clear: 07777, Mode: 0700}, true, "", 0, &visited, &changed); st != syscall.EPERM || last != "/" {
+		t.Fatalf("chmod by non-owner should fail: %s %q", st, last)
+	}
+	if _, st := ApplyAttrChange(m, ctx, dir, c, true, "d1", 0, &visited, &changed); st != syscall.EINVAL {
+		t.Fatalf("invalid position: %s", st)
+	}
+	if st := Remove(m, ctx, 1, "ca"); st != 0 {
+		t.Fatalf("rmr ca: %s", st)
+	}
+}
+
+func testHardLink(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var parent, d1, d2, inode, ino Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "links", 0755, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir links: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "links")
+	if st := m.Mkdir(ctx, parent, "ld1", 0755, 0, 0, &d1, attr); st != 0 {
+		t.Fatalf("mkdir ld1: %s", st)
+	}
+	defer m.Rmdir(ctx, parent, "ld1")
+	if st := m.Mkdir(ctx, parent, "ld2", 0755, 0, 0, &d2, attr); st != 0 {
+		t.Fatalf("mkdir ld2: %s", st)
+	}
+	defer m.Rmdir(ctx, parent, "ld2")
+	for i := 0; i < 3; i++ {
+		if st := m.Create(ctx, d1, "f", 0644, 0, 0, &inode, attr); st != 0 {
+			t.Fatalf("create ld1/f: %s", st)
+		}
+		_ = m.Close(ctx, inode)
+		var chunkid uint64
+		if st := m.NewChunk(ctx, &chunkid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		if st := m.Write(ctx, inode, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+			t.Fatalf("write ld1/f: %s", st)
+		}
+		if st := m.Link(ctx, inode, d2, "g", attr); st != 0 || attr.Nlink != 2 {
+			t.Fatalf("link ld2/g -> ld1/f: %s, nlink %d", st, attr.Nlink)
+		}
+		if st := m.Link(ctx, inode, d1, "h", attr); st != 0 || attr.Nlink != 3 {
+			t.Fatalf("link ld1/h -> ld1/f: %s, nlink %d", st, attr.Nlink)
+		}
+		if st := m.Lookup(ctx, d2, "g", &ino, attr); st != 0 || ino != inode || attr.Nlink != 3 {
+			t.Fatalf("lookup ld2/g: %s, inode %d, nlink %d", st, ino, attr.Nlink)
+		}
+		var summary Summary
+		if st := GetSummary(m, ctx, parent, &summary, true); st != 0 {
+			t.Fatalf("summary: %s", st)
+		}
+		if summary.Files != 1 || summary.Length != 100 {
+			t.Fatalf("linked file should be counted once: %+v", summary)
+		}
+
+		for j, name := range []string{"f", "h"} {
+			if st := m.Unlink(ctx, d1, name); st != 0 {
+				t.Fatalf("unlink ld1/%s: %s", name, st)
+			}
+			if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Nlink != uint32(2-j) {
+				t.Fatalf("getattr after unlink ld1/%s: %s, nlink %d", name, st, attr.Nlink)
+			}
+			var slices []Slice
+			if st := m.Read(ctx, inode, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Chunkid != chunkid {
+				t.Fatalf("data should be kept after unlink ld1/%s: %s %+v", name, st, slices)
+			}
+		}
+		if st := m.Unlink(ctx, d2, "g"); st != 0 {
+			t.Fatalf("unlink ld2/g: %s", st)
+		}
+		if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+			t.Fatalf("getattr after unlinking all: %s", st)
+		}
+	}
+}
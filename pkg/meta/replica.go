@@ -0,0 +1,181 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ListStrong reads the entries of directories from the primary only, a listing or lookup
+	// sees everything committed before it.
+	ListStrong = "strong"
+	// ListEventual reads the entries of directories from the replica (--meta-replica) as long
+	// as it's not behind the primary more than --max-staleness, the recent changes could be missed.
+	ListEventual = "eventual"
+)
+
+var replicaReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "meta_replica_reads",
+	Help: "Number of the listings and lookups served by the replica, or by the primary because the replica is too stale.",
+}, []string{"source"})
+
+// replicable is implemented by the engines which could read from a replica.
+type replicable interface {
+	// replPosition returns the position of the replication stream applied to this server, the
+	// one of a replica reaches the one of primary when it's in sync.
+	replPosition() (uint64, error)
+}
+
+type replSample struct {
+	time time.Time
+	pos  uint64
+}
+
+// replica is a read-only copy of the engine, it's used only when the time it's behind the
+// primary is known to be within the bound.
+type replica struct {
+	en       engine
+	primary  replicable
+	copy     replicable
+	maxStale time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	samples []replSample // positions of the primary, oldest first
+	usable  int32
+}
+
+// checkLag compares the position of replica with the ones of primary sampled before: the replica
+// has everything committed before the latest sample it reached, which bounds the lag.
+func (r *replica) checkLag(now time.Time) (time.Duration, error) {
+	p, err := r.primary.replPosition()
+	if err != nil {
+		return 0, fmt.Errorf("position of primary: %s", err)
+	}
+	c, err := r.copy.replPosition()
+	if err != nil {
+		return 0, fmt.Errorf("position of replica: %s", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, replSample{now, p})
+	for len(r.samples) > 1 && now.Sub(r.samples[1].time) > r.maxStale+r.interval {
+		r.samples = r.samples[1:]
+	}
+	if c >= p {
+		return 0, nil
+	}
+	for i := len(r.samples) - 1; i >= 0; i-- {
+		if r.samples[i].pos <= c {
+			return now.Sub(r.samples[i].time), nil
+		}
+	}
+	return 0, fmt.Errorf("replica is behind the primary more than %s", now.Sub(r.samples[0].time))
+}
+
+// refresh updates whether the replica is usable, the changes committed in the next interval
+// could be missed also.
+func (r *replica) refresh() {
+	lag, err := r.checkLag(time.Now())
+	usable := err == nil && lag+r.interval <= r.maxStale
+	if err != nil {
+		logger.Debugf("Check lag of meta replica: %s", err)
+	}
+	if usable && atomic.SwapInt32(&r.usable, 1) == 0 {
+		logger.Infof("Meta replica is within %s of the primary, reading entries from it", r.maxStale)
+	} else if !usable && atomic.SwapInt32(&r.usable, 0) == 1 {
+		logger.Warnf("Meta replica is behind the primary more than %s, reading entries from the primary", r.maxStale)
+	}
+}
+
+func (r *replica) check() {
+	for {
+		time.Sleep(r.interval)
+		r.refresh()
+	}
+}
+
+// openReplica opens the replica of m at addr, which uses the same driver as the primary.
+func openReplica(m Meta, driver, addr string, conf *Config) error {
+	if p := strings.Index(addr, "://"); p >= 0 {
+		if addr[:p] != driver {
+			return fmt.Errorf("replica %s should use the same driver as %s", addr[:p], driver)
+		}
+		addr = addr[p+3:]
+	}
+	primary, ok := m.(replicable)
+	if !ok {
+		return fmt.Errorf("read replica is not supported by %s", driver)
+	}
+	rconf := *conf
+	rconf.ReadOnly = true
+	rconf.Replica = ""
+	rm, err := metaDrivers[driver](driver, addr, &rconf)
+	if err != nil {
+		return err
+	}
+	rfmt, err := rm.Load()
+	if err != nil {
+		return fmt.Errorf("load setting from replica: %s", err)
+	}
+	if pfmt, err := m.Load(); err == nil && pfmt.UUID != rfmt.UUID {
+		return fmt.Errorf("replica is not a copy of volume %s", pfmt.Name)
+	}
+	if conf.MaxStaleness <= 0 {
+		conf.MaxStaleness = time.Second * 5
+	}
+	r := &replica{
+		en:       rm.(engine),
+		primary:  primary,
+		copy:     rm.(replicable),
+		maxStale: conf.MaxStaleness,
+		interval: conf.MaxStaleness / 4,
+	}
+	if r.interval > time.Second {
+		r.interval = time.Second
+	}
+	r.refresh()
+	go r.check()
+	_ = prometheus.Register(replicaReads)
+	m.(interface{ setReplica(*replica) }).setReplica(r)
+	return nil
+}
+
+func (m *baseMeta) setReplica(r *replica) {
+	m.replica = r
+}
+
+// listEngine returns the engine to read the entries of directories from, which is the replica
+// if it's allowed by the consistency and not too stale.
+func (m *baseMeta) listEngine() engine {
+	if m.replica == nil || m.conf.ListConsistency != ListEventual {
+		return m.en
+	}
+	if atomic.LoadInt32(&m.replica.usable) == 0 {
+		replicaReads.WithLabelValues("primary").Inc()
+		return m.en
+	}
+	replicaReads.WithLabelValues("replica").Inc()
+	return m.replica.en
+}
@@ -0,0 +1,136 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakePosition struct{ pos uint64 }
+
+func (p *fakePosition) replPosition() (uint64, error) { return p.pos, nil }
+
+func TestReplicaLag(t *testing.T) {
+	primary, copy := &fakePosition{}, &fakePosition{}
+	r := &replica{primary: primary, copy: copy, maxStale: 5 * time.Second, interval: time.Second}
+	now := time.Now()
+	check := func(sec int, expected time.Duration) {
+		t.Helper()
+		lag, err := r.checkLag(now.Add(time.Duration(sec) * time.Second))
+		if err != nil || lag != expected {
+			t.Fatalf("lag at %ds: expect %s, got %s (%v)", sec, expected, lag, err)
+		}
+	}
+	check(0, 0)
+	primary.pos = 100
+	check(1, time.Second) // the replica reached the primary at 0s
+	primary.pos = 200
+	check(2, 2*time.Second)
+	copy.pos = 150
+	check(3, 2*time.Second) // it reached the position at 1s
+	copy.pos = 200
+	check(4, 0)
+	primary.pos = 300
+	check(5, time.Second)
+
+	primary.pos = 1000
+	for i := 6; i < 12; i++ {
+		_, _ = r.checkLag(now.Add(time.Duration(i) * time.Second))
+	}
+	if _, err := r.checkLag(now.Add(12 * time.Second)); err == nil {
+		t.Fatalf("the lag should be unknown after the samples it reached are dropped")
+	}
+}
+
+func TestListConsistency(t *testing.T) {
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.db")
+	conf := &Config{ListConsistency: ListEventual}
+	m, err := newSQLMeta("sqlite3", primary, conf)
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test", UUID: "test-uuid"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Mkdir(Background, 1, "d", 0755, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	dirIno := inode
+	if st := m.Create(Background, dirIno, "old", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	// the replica is stale, it misses the entries created after the copy
+	data, err := ioutil.ReadFile(primary)
+	if err != nil {
+		t.Fatalf("read database: %s", err)
+	}
+	replicaPath := filepath.Join(dir, "replica.db")
+	if err = ioutil.WriteFile(replicaPath, data, 0644); err != nil {
+		t.Fatalf("copy database: %s", err)
+	}
+	if st := m.Create(Background, dirIno, "new", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	if err = openReplica(m, "sqlite3", "sqlite3://"+replicaPath, conf); err != nil {
+		t.Fatalf("open replica: %s", err)
+	}
+
+	names := func() map[string]bool {
+		var entries []*Entry
+		if st := m.Readdir(Background, dirIno, 0, &entries); st != 0 {
+			t.Fatalf("readdir: %s", st)
+		}
+		ns := make(map[string]bool)
+		for _, e := range entries {
+			ns[string(e.Name)] = true
+		}
+		return ns
+	}
+	if ns := names(); !ns["old"] || ns["new"] {
+		t.Fatalf("eventual listing should be served by the stale replica: %v", ns)
+	}
+	if st := m.Lookup(Background, dirIno, "new", &inode, &attr); st != syscall.ENOENT {
+		t.Fatalf("eventual lookup should be served by the stale replica: %s", st)
+	}
+
+	conf.ListConsistency = ListStrong
+	if ns := names(); !ns["old"] || !ns["new"] {
+		t.Fatalf("strong listing should see the new entry: %v", ns)
+	}
+	if st := m.Lookup(Background, dirIno, "new", &inode, &attr); st != 0 {
+		t.Fatalf("strong lookup should see the new entry: %s", st)
+	}
+
+	// the primary is used if the replica is too stale
+	conf.ListConsistency = ListEventual
+	atomic.StoreInt32(&m.(*dbMeta).replica.usable, 0)
+	if ns := names(); !ns["new"] {
+		t.Fatalf("listing should fall back to the primary: %v", ns)
+	}
+
+	if err = openReplica(m, "sqlite3", "redis://127.0.0.1:6379/1", conf); err == nil {
+		t.Fatalf("replica with another driver should fail")
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import "github.com/juicedata/juicefs/pkg/utils"
+
+// revalidateFiles checks the cached chunks of open files every RevalidateInterval until umount.
+func (m *baseMeta) revalidateFiles() {
+	for {
+		utils.SleepWithJitter(m.conf.RevalidateInterval)
+		m.Lock()
+		umounting := m.umounting
+		m.Unlock()
+		if umounting {
+			return
+		}
+		m.revalidate(Background)
+	}
+}
+
+// revalidate reads the chunks cached for the open files from the engine again, the ones with
+// different slices are changed by other clients (the local writes drop them), so they are dropped
+// and the clients are told to drop their data by StaleChunk. It returns the number of stale chunks.
+func (m *baseMeta) revalidate(ctx Context) int {
+	var stale int
+	for inode, chunks := range m.of.cachedChunks() {
+		for indx, cs := range chunks {
+			ss, st := m.en.doRead(ctx, inode, indx)
+			if st != 0 {
+				logger.Debugf("revalidate chunk %d of inode %d: %s", indx, inode, st)
+				continue
+			}
+			revalidatedChunks.Inc()
+			if sameSlices(buildSlice(ss), cs) || !m.of.dropStale(inode, indx, cs) {
+				continue
+			}
+			logger.Debugf("Chunk %d of inode %d is changed by others, drop it from cache", indx, inode)
+			staleChunks.Inc()
+			stale++
+			if err := m.newMsg(StaleChunk, inode, indx); err != nil {
+				logger.Warnf("drop stale chunk %d of inode %d: %s", indx, inode, err)
+			}
+		}
+	}
+	return stale
+}
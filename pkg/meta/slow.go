@@ -0,0 +1,139 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// the number of slow operations kept in memory
+const slowBuffer = 1000
+
+// SlowOp is an operation or transaction which took longer than the threshold.
+type SlowOp struct {
+	Time     time.Time
+	Op       string // name of operation, or "txn:" with the caller of a transaction
+	Inode    Ino
+	Duration time.Duration
+	Retries  int // restarts of a transaction
+}
+
+type slowLog struct {
+	sync.Mutex
+	threshold time.Duration
+	ops       []SlowOp
+	next      int
+}
+
+func newSlowLog(threshold time.Duration) *slowLog {
+	return &slowLog{threshold: threshold, ops: make([]SlowOp, 0, slowBuffer)}
+}
+
+func (l *slowLog) add(op SlowOp) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.ops) < slowBuffer {
+		l.ops = append(l.ops, op)
+	} else {
+		l.ops[l.next] = op
+		l.next = (l.next + 1) % slowBuffer
+	}
+}
+
+// list returns the recorded operations, the oldest first.
+func (l *slowLog) list(reset bool) []SlowOp {
+	l.Lock()
+	defer l.Unlock()
+	ops := make([]SlowOp, 0, len(l.ops))
+	ops = append(ops, l.ops[l.next:]...)
+	ops = append(ops, l.ops[:l.next]...)
+	if reset {
+		l.ops = l.ops[:0]
+		l.next = 0
+	}
+	return ops
+}
+
+// txnCaller finds the name of function which started the transaction.
+func txnCaller() string {
+	var pcs [10]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs[:])])
+	for {
+		f, more := frames.Next()
+		name := f.Function[strings.LastIndex(f.Function, "/")+1:]
+		for strings.Contains(name, ".func") { // closures
+			name = name[:strings.LastIndex(name, ".func")]
+		}
+		name = name[strings.LastIndex(name, ".")+1:]
+		if name != "txn" && name != "timeitTxn" {
+			return name
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// timeit observes the latency of an operation, and records it if it's slow. The operation is
+// delayed if the client is throttled.
+func (m *baseMeta) timeit(op string, inode Ino, start time.Time) {
+	used := time.Since(start)
+	opDist.Observe(used.Seconds())
+	if m.slow != nil && used >= m.slow.threshold {
+		m.slow.add(SlowOp{Time: start, Op: op, Inode: inode, Duration: used})
+	}
+	atomic.AddInt64(&m.ops, 1)
+	if b, _ := m.opsLimiter.Load().(*ratelimit.Bucket); b != nil {
+		b.Wait(1)
+	}
+}
+
+func (m *baseMeta) timeitTxn(start time.Time, retries int) {
+	used := time.Since(start)
+	txDist.Observe(used.Seconds())
+	if m.slow != nil && used >= m.slow.threshold {
+		m.slow.add(SlowOp{Time: start, Op: "txn:" + txnCaller(), Duration: used, Retries: retries})
+	}
+}
+
+// txnRestarted counts a restart of the conflicted transaction, by the operation starting it.
+func (m *baseMeta) txnRestarted() {
+	txRestart.Add(1)
+	txRestartByOp.WithLabelValues(txnCaller()).Inc()
+}
+
+// txnGiveUp returns EAGAIN for the transaction still conflicted after TxnRetries restarts, so the
+// application can back off by itself instead of being blocked by more restarts.
+func (m *baseMeta) txnGiveUp(err error) syscall.Errno {
+	txConflictFailures.Inc()
+	logger.Warnf("Transaction of %s is still conflicted after %d restarts, returning EAGAIN: %s", txnCaller(), m.conf.TxnRetries, err)
+	return syscall.EAGAIN
+}
+
+func (m *baseMeta) SlowOps(reset bool) []SlowOp {
+	if m.slow == nil {
+		return nil
+	}
+	return m.slow.list(reset)
+}
@@ -0,0 +1,132 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := newSlowLog(time.Millisecond)
+	for i := 0; i < slowBuffer+10; i++ {
+		l.add(SlowOp{Op: "lookup", Inode: Ino(i)})
+	}
+	ops := l.list(true)
+	if len(ops) != slowBuffer || ops[0].Inode != 10 || ops[slowBuffer-1].Inode != slowBuffer+9 {
+		t.Fatalf("unexpected operations: %d %+v", len(ops), ops[0])
+	}
+	if ops = l.list(false); len(ops) != 0 {
+		t.Fatalf("operations should be cleared, but got %d", len(ops))
+	}
+}
+
+func TestSlowOps(t *testing.T) {
+	m, err := newKVMeta("memkv", "jfs-unit-test", &Config{MaxDeletes: 1, SlowThreshold: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	_ = m.SlowOps(true)
+	var attr Attr
+	if st := m.GetAttr(Background, 1, &attr); st != 0 {
+		t.Fatalf("getattr: %s", st)
+	}
+	if _, err = m.(*kvMeta).incrCounter("nextInode", 1); err != nil {
+		t.Fatalf("incr counter: %s", err)
+	}
+	ops := m.SlowOps(false)
+	var getattr, txn bool
+	for _, op := range ops {
+		switch op.Op {
+		case "getattr":
+			getattr = op.Inode == 1
+		case "txn:incrCounter":
+			txn = op.Retries == 0
+		}
+	}
+	if !getattr || !txn {
+		t.Fatalf("unexpected slow operations: %+v", ops)
+	}
+
+	m2, _ := newKVMeta("memkv", "jfs-unit-test", &Config{MaxDeletes: 1})
+	if ops := m2.SlowOps(false); ops != nil {
+		t.Fatalf("slow operations should not be recorded: %+v", ops)
+	}
+}
+
+func TestThrottleOps(t *testing.T) {
+	m, err := newKVMeta("memkv", "jfs-unit-test", &Config{MaxDeletes: 1})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test", ClientOpsLimit: 10}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer m.CloseSession()
+	base := &m.(*kvMeta).baseMeta
+	var attr Attr
+	for i := 0; i < 50; i++ {
+		m.GetAttr(Background, 2, &attr)
+	}
+	base.heartbeat = time.Now().Add(-time.Second)
+	if !base.refreshHeartbeat() {
+		t.Fatalf("refresh heartbeat")
+	}
+	if !base.throttled() {
+		t.Fatalf("client should be throttled")
+	}
+	ss, err := m.ListSessions()
+	if err != nil || len(ss) != 1 {
+		t.Fatalf("list sessions: %v %s", ss, err)
+	}
+	if ss[0].OpsRate < 40 || !ss[0].Throttled {
+		t.Fatalf("unexpected session: %+v", ss[0].SessionInfo)
+	}
+
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		m.GetAttr(Background, 2, &attr)
+	}
+	if used := time.Since(start); used < time.Millisecond*400 {
+		t.Fatalf("operations should be throttled, but took %s", used)
+	}
+
+	// calm down
+	base.heartbeat = time.Now().Add(-time.Minute)
+	base.refreshHeartbeat()
+	if base.throttled() {
+		t.Fatalf("client should not be throttled")
+	}
+	// the limit is removed
+	base.throttleOps(100, 10)
+	if !base.throttled() {
+		t.Fatalf("client should be throttled")
+	}
+	if err = m.Init(Format{Name: "test"}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	base.refreshHeartbeat()
+	if ss, _ = m.ListSessions(); base.throttled() || ss[0].Throttled {
+		t.Fatalf("client should not be throttled: %+v", ss[0].SessionInfo)
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SnapshotDir is the directory under root to keep the snapshots, one clone for each of them.
+const SnapshotDir = ".snapshots"
+
+// snapshotXattr keeps the bookkeeping of a snapshot in its root.
+const snapshotXattr = "juicefs.snapshot"
+
+// snapshotLock serializes the snapshot operations in this client, since the directory of snapshots
+// is made mutable during them.
+var snapshotLock sync.Mutex
+
+// Snapshot is a named clone of a directory, which can be rolled back to.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`  // of the directory when the snapshot is created
+	Inode   Ino       `json:"inode"` // root of the clone
+	Created time.Time `json:"created"`
+}
+
+type snapshotInfo struct {
+	Path    string `json:"path"`
+	Created int64  `json:"created"`
+}
+
+// lookupPath returns the inode of path (relative to the root).
+func lookupPath(r Meta, ctx Context, p string) (Ino, *Attr, syscall.Errno) {
+	var inode Ino
+	var attr = &Attr{}
+	if st := r.Resolve(ctx, 1, p, &inode, attr); st != syscall.ENOTSUP {
+		return inode, attr, st
+	}
+	inode = 1
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if st := r.Lookup(ctx, inode, name, &inode, attr); st != 0 {
+			return 0, nil, st
+		}
+	}
+	if inode == 1 {
+		if st := r.GetAttr(ctx, inode, attr); st != 0 {
+			return 0, nil, st
+		}
+	}
+	return inode, attr, 0
+}
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 255 && !strings.ContainsAny(name, "/\x00")
+}
+
+// snapshotRoot returns the directory of snapshots, which is created if create is true. It's
+// immutable, so the snapshots can't be removed, renamed or modified except by the snapshot API.
+func snapshotRoot(r Meta, ctx Context, create bool) (Ino, syscall.Errno) {
+	var inode Ino
+	var attr Attr
+	st := r.Lookup(ctx, 1, SnapshotDir, &inode, &attr)
+	if st == syscall.ENOENT && create {
+		st = r.Mkdir(ctx, 1, SnapshotDir, 0700, 0, 0, &inode, &attr)
+		if st == syscall.EEXIST {
+			st = r.Lookup(ctx, 1, SnapshotDir, &inode, &attr)
+		} else if st == 0 {
+			st = setImmutable(r, inode, true)
+		}
+	}
+	if st == 0 && attr.Typ != TypeDirectory {
+		st = syscall.ENOTDIR
+	}
+	return inode, st
+}
+
+// setImmutable sets or clears FlagImmutable of inode. It's done as root, since the snapshots can be
+// managed by the owner of the mount point, who can't change the flags.
+func setImmutable(r Meta, inode Ino, on bool) syscall.Errno {
+	var attr Attr
+	if st := r.GetAttr(Background, inode, &attr); st != 0 {
+		return st
+	}
+	flags := attr.Flags &^ FlagImmutable
+	if on {
+		flags |= FlagImmutable
+	}
+	if flags == attr.Flags {
+		return 0
+	}
+	attr.Flags = flags
+	return r.SetAttr(Background, inode, SetAttrFlag, 0, &attr)
+}
+
+// setImmutableTree sets or clears FlagImmutable of all the nodes in the tree of inode, except
+// symlinks, which can't be changed anyway.
+func setImmutableTree(r Meta, inode Ino, on bool) syscall.Errno {
+	if !on { // the entries can't be read after the parent is cleared otherwise
+		if st := setImmutable(r, inode, false); st != 0 {
+			return st
+		}
+	}
+	var entries []*Entry
+	if st := r.Readdir(Background, inode, 1, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+			continue
+		}
+		var st syscall.Errno
+		switch e.Attr.Typ {
+		case TypeDirectory:
+			st = setImmutableTree(r, e.Inode, on)
+		case TypeSymlink:
+		default:
+			st = setImmutable(r, e.Inode, on)
+		}
+		if st != 0 {
+			return st
+		}
+	}
+	if on {
+		return setImmutable(r, inode, true)
+	}
+	return 0
+}
+
+// unlockRoot makes the directory of snapshots mutable for the snapshot API, and returns the
+// function to make it immutable again.
+func unlockRoot(r Meta, root Ino) (func(), syscall.Errno) {
+	if st := setImmutable(r, root, false); st != 0 {
+		return nil, st
+	}
+	return func() {
+		if st := setImmutable(r, root, true); st != 0 {
+			logger.Warnf("set %s immutable: %s", SnapshotDir, st)
+		}
+	}, 0
+}
+
+// removeSnapshot removes the snapshot called name under root, which should be unlocked.
+func removeSnapshot(r Meta, ctx Context, root Ino, name string) syscall.Errno {
+	var inode Ino
+	var attr Attr
+	if st := r.Lookup(ctx, root, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		if st := setImmutableTree(r, inode, false); st != 0 {
+			return st
+		}
+	}
+	return Remove(r, ctx, root, name)
+}
+
+func getSnapshot(r Meta, ctx Context, root Ino, name string) (*Snapshot, syscall.Errno) {
+	var inode Ino
+	var attr Attr
+	if st := r.Lookup(ctx, root, name, &inode, &attr); st != 0 {
+		return nil, st
+	}
+	var value []byte
+	if st := r.GetXattr(ctx, inode, snapshotXattr, &value); st != 0 {
+		if st == ENOATTR {
+			st = syscall.ENOENT // not a snapshot
+		}
+		return nil, st
+	}
+	var info snapshotInfo
+	if err := json.Unmarshal(value, &info); err != nil {
+		logger.Warnf("invalid snapshot %s: %s", name, err)
+		return nil, syscall.EIO
+	}
+	return &Snapshot{name, info.Path, inode, time.Unix(info.Created, 0)}, 0
+}
+
+// CreateSnapshot clones the directory at p into the snapshot called name, which shares the data
+// with the directory as CloneEntry. The slices are reference counted, so they are kept by the
+// snapshot after being removed from the directory. All the nodes of the snapshot are immutable.
+func CreateSnapshot(r Meta, ctx Context, p, name string) syscall.Errno {
+	if !validSnapshotName(name) {
+		return syscall.EINVAL
+	}
+	p = path.Clean("/" + p)
+	src, attr, st := lookupPath(r, ctx, p)
+	if st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	root, st := snapshotRoot(r, ctx, true)
+	if st != 0 {
+		return st
+	}
+	if src == root || strings.HasPrefix(p, "/"+SnapshotDir+"/") {
+		return syscall.EINVAL
+	}
+	lock, st := unlockRoot(r, root)
+	if st != 0 {
+		return st
+	}
+	defer lock()
+	if st = CloneEntry(r, ctx, src, root, name); st != 0 {
+		return st
+	}
+	info, _ := json.Marshal(&snapshotInfo{p, time.Now().Unix()})
+	var inode Ino
+	if st = r.Lookup(ctx, root, name, &inode, attr); st == 0 {
+		if st = r.SetXattr(ctx, inode, snapshotXattr, info, 0); st == 0 {
+			st = setImmutableTree(r, inode, true)
+		}
+	}
+	if st != 0 {
+		if e := removeSnapshot(r, ctx, root, name); e != 0 {
+			logger.Warnf("remove snapshot %s: %s", name, e)
+		}
+	}
+	return st
+}
+
+// ListSnapshots returns all the snapshots ordered by name.
+func ListSnapshots(r Meta, ctx Context) ([]*Snapshot, syscall.Errno) {
+	root, st := snapshotRoot(r, ctx, false)
+	if st == syscall.ENOENT {
+		return nil, 0
+	} else if st != 0 {
+		return nil, st
+	}
+	var entries []*Entry
+	if st = r.Readdir(ctx, root, 0, &entries); st != 0 {
+		return nil, st
+	}
+	var snapshots []*Snapshot
+	for _, e := range entries {
+		name := string(e.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+		s, st := getSnapshot(r, ctx, root, name)
+		if st == syscall.ENOENT {
+			continue
+		} else if st != 0 {
+			return nil, st
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots, 0
+}
+
+// RollbackSnapshot replaces the directory at the path of the snapshot with a clone of it. The
+// clone is made aside and exchanged with the directory by a single rename, so the directory is
+// switched to the state of the snapshot atomically, then the old one is removed (into the trash if
+// enabled). The snapshot is kept and can be rolled back to again.
+func RollbackSnapshot(r Meta, ctx Context, name string) syscall.Errno {
+	if !validSnapshotName(name) {
+		return syscall.EINVAL
+	}
+	root, st := snapshotRoot(r, ctx, false)
+	if st != 0 {
+		return st
+	}
+	s, st := getSnapshot(r, ctx, root, name)
+	if st != 0 {
+		return st
+	}
+	parent, attr, st := lookupPath(r, ctx, path.Dir(s.Path))
+	if st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	dname := path.Base(s.Path)
+	tmp := fmt.Sprintf(".%s.rollback.%d", dname, time.Now().UnixNano())
+	if len(tmp) > 255 {
+		tmp = fmt.Sprintf(".rollback.%d", time.Now().UnixNano())
+	}
+	if st = CloneEntry(r, ctx, s.Inode, parent, tmp); st != 0 {
+		return st
+	}
+	var inode Ino
+	if st = r.Lookup(ctx, parent, tmp, &inode, attr); st == 0 {
+		if st = r.RemoveXattr(ctx, inode, snapshotXattr); st == ENOATTR {
+			st = 0
+		}
+	}
+	if st == 0 {
+		var old Ino
+		if st = r.Lookup(ctx, parent, dname, &old, attr); st == 0 {
+			st = r.Rename(ctx, parent, tmp, parent, dname, RenameExchange, &inode, attr)
+		} else if st == syscall.ENOENT {
+			st = r.Rename(ctx, parent, tmp, parent, dname, RenameNoReplace, &inode, attr)
+			if st == 0 {
+				return 0
+			}
+		}
+	}
+	// the old directory after exchanged, or the clone if failed
+	if e := Remove(r, ctx, parent, tmp); e != 0 {
+		logger.Warnf("remove %s: %s", path.Join(path.Dir(s.Path), tmp), e)
+	}
+	return st
+}
+
+// DeleteSnapshot removes the snapshot (into the trash if enabled), the data only used by it is
+// freed then.
+func DeleteSnapshot(r Meta, ctx Context, name string) syscall.Errno {
+	if !validSnapshotName(name) {
+		return syscall.EINVAL
+	}
+	root, st := snapshotRoot(r, ctx, false)
+	if st != 0 {
+		return st
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	if _, st = getSnapshot(r, ctx, root, name); st != 0 {
+		return st
+	}
+	lock, st := unlockRoot(r, root)
+	if st != 0 {
+		return st
+	}
+	defer lock()
+	return removeSnapshot(r, ctx, root, name)
+}
@@ -23,21 +23,27 @@ import (
 	"bufio"
 	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/sirupsen/logrus"
 	"xorm.io/xorm"
+	"xorm.io/xorm/core"
+	"xorm.io/xorm/dialects"
 	"xorm.io/xorm/log"
 	"xorm.io/xorm/names"
 )
@@ -73,6 +79,7 @@ type node struct {
 	Length uint64 `xorm:"notnull"`
 	Rdev   uint32
 	Parent Ino
+	Btime  int64 // 0 for the nodes created by old versions
 }
 
 type namedNode struct {
@@ -90,6 +97,18 @@ type chunkRef struct {
 	Size    uint32 `xorm:"notnull"`
 	Refs    int    `xorm:"notnull"`
 }
+type sliceChecksum struct {
+	Chunkid uint64 `xorm:"pk"`
+	Sums    []byte `xorm:"blob notnull"`
+}
+type inlineSlice struct {
+	Chunkid uint64 `xorm:"pk"`
+	Data    []byte `xorm:"blob notnull"`
+}
+type journalRecord struct {
+	Seq  uint64 `xorm:"pk"`
+	Data []byte `xorm:"blob notnull"`
+}
 type symlink struct {
 	Inode  Ino    `xorm:"pk"`
 	Target string `xorm:"varchar(4096) notnull"`
@@ -149,7 +168,16 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	if driver == "postgres" {
 		addr = driver + "://" + addr
 	}
-	engine, err := xorm.NewEngine(driver, addr)
+	addr, co, err := splitConnOptions(addr)
+	if err != nil {
+		return nil, err
+	}
+	var engine *xorm.Engine
+	if co != nil {
+		engine, err = newEngineWithOptions(driver, addr, co)
+	} else {
+		engine, err = xorm.NewEngine(driver, addr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to use data source %s: %s", driver, err)
 	}
@@ -185,6 +213,47 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	return m, err
 }
 
+// sqlConnectors create connectors which use the options of connection, registered by the drivers.
+var sqlConnectors = make(map[string]func(dsn string, co *connOptions) (driver.Connector, error))
+
+// splitConnOptions removes the options of connection from the query of dsn, the options are nil if there is none.
+func splitConnOptions(dsn string) (string, *connOptions, error) {
+	p := strings.LastIndex(dsn, "@") // the password may contain '?'
+	q := strings.Index(dsn[p+1:], "?")
+	if q < 0 {
+		return dsn, nil, nil
+	}
+	q += p + 1
+	query, err := url.ParseQuery(dsn[q+1:])
+	if err != nil {
+		return dsn, nil, nil // leave it to the driver
+	}
+	co, err := parseConnOptions(query)
+	if err != nil || !co.useTLS() && co.auth == "" {
+		return dsn, nil, err
+	}
+	if len(query) > 0 {
+		return dsn[:q+1] + query.Encode(), co, nil
+	}
+	return dsn[:q], co, nil
+}
+
+func newEngineWithOptions(driverName, dsn string, co *connOptions) (*xorm.Engine, error) {
+	connect, ok := sqlConnectors[driverName]
+	if !ok {
+		return nil, fmt.Errorf("TLS and auth options are not supported by %s", driverName)
+	}
+	connector, err := connect(dsn, co)
+	if err != nil {
+		return nil, err
+	}
+	dialect, err := dialects.OpenDialect(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return xorm.NewEngineWithDialectAndDB(driverName, dsn, dialect, core.FromDB(sql.OpenDB(connector)))
+}
+
 func (m *dbMeta) Shutdown() error {
 	return m.db.Close()
 }
@@ -196,6 +265,121 @@ func (m *dbMeta) Name() string {
 func (m *dbMeta) doDeleteSlice(chunkid uint64, size uint32) error {
 	return m.txn(func(ses *xorm.Session) error {
 		_, err := ses.Exec("delete from jfs_chunk_ref where chunkid=?", chunkid)
+		if err == nil {
+			_, err = ses.Exec("delete from jfs_slice_checksum where chunkid=?", chunkid)
+		}
+		if err == nil {
+			_, err = ses.Exec("delete from jfs_inline_slice where chunkid=?", chunkid)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doSetSliceChecksums(chunkid uint64, sums []byte) error {
+	return m.txn(func(ses *xorm.Session) error {
+		var c = sliceChecksum{chunkid, sums}
+		n, err := ses.Insert(&c)
+		if err != nil || n == 0 {
+			if m.db.DriverName() == "postgres" {
+				// cleanup failed session
+				_ = ses.Rollback()
+			}
+			_, err = ses.Update(&c, &sliceChecksum{Chunkid: chunkid})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doGetSliceChecksums(chunkid uint64) ([]byte, error) {
+	var c = sliceChecksum{Chunkid: chunkid}
+	ok, err := m.db.Get(&c)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return c.Sums, nil
+}
+
+func (m *dbMeta) doSetSliceData(chunkid uint64, data []byte) error {
+	return m.txn(func(ses *xorm.Session) error {
+		var d = inlineSlice{chunkid, data}
+		n, err := ses.Insert(&d)
+		if err != nil || n == 0 {
+			if m.db.DriverName() == "postgres" {
+				// cleanup failed session
+				_ = ses.Rollback()
+			}
+			_, err = ses.Update(&d, &inlineSlice{Chunkid: chunkid})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doGetSliceData(chunkid uint64) ([]byte, error) {
+	var d = inlineSlice{Chunkid: chunkid}
+	ok, err := m.db.Get(&d)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return d.Data, nil
+}
+
+func (m *dbMeta) doAppendJournal(n int, encode func(first uint64) ([][]byte, error)) (uint64, error) {
+	var last uint64
+	err := m.txn(func(s *xorm.Session) error {
+		var c = counter{Name: "nextJournal"}
+		ok, err := s.Get(&c)
+		if err != nil {
+			return err
+		}
+		c.Value += int64(n)
+		if ok {
+			_, err = s.Cols("value").Update(&c, &counter{Name: c.Name})
+		} else {
+			_, err = s.InsertOne(&c)
+		}
+		if err != nil {
+			return err
+		}
+		last = uint64(c.Value)
+		first := last - uint64(n) + 1
+		records, err := encode(first)
+		if err != nil {
+			return err
+		}
+		// not mustInsert, which ignores the errors (e.g. the database is locked) and loses the records
+		for start := 0; start < len(records); start += 200 {
+			end := start + 200
+			if end > len(records) {
+				end = len(records)
+			}
+			rs := make([]*journalRecord, end-start)
+			for i := range rs {
+				rs[i] = &journalRecord{first + uint64(start+i), records[start+i]}
+			}
+			if _, err = s.Insert(rs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+func (m *dbMeta) doReadJournal(since uint64, limit int) ([][]byte, error) {
+	var rs []journalRecord
+	if err := m.db.Where("seq > ?", since).OrderBy("seq").Limit(limit).Find(&rs); err != nil {
+		return nil, err
+	}
+	records := make([][]byte, len(rs))
+	for i, r := range rs {
+		records[i] = r.Data
+	}
+	return records, nil
+}
+
+func (m *dbMeta) doTrimJournal(before uint64) error {
+	return m.txn(func(s *xorm.Session) error {
+		_, err := s.Where("seq < ?", before).Delete(&journalRecord{})
 		return err
 	})
 }
@@ -229,8 +413,8 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(node), new(symlink), new(xattr)); err != nil {
 		logger.Fatalf("create table node, symlink, xattr: %s", err)
 	}
-	if err := m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
-		logger.Fatalf("create table chunk, chunk_ref: %s", err)
+	if err := m.db.Sync2(new(chunk), new(chunkRef), new(sliceChecksum), new(inlineSlice)); err != nil {
+		logger.Fatalf("create table chunk, chunk_ref, slice_checksum, inline_slice: %s", err)
 	}
 	if err := m.db.Sync2(new(session), new(sustained), new(delfile)); err != nil {
 		logger.Fatalf("create table session, sustaind, delfile: %s", err)
@@ -238,6 +422,9 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(flock), new(plock)); err != nil {
 		logger.Fatalf("create table flock, plock: %s", err)
 	}
+	if err := m.db.Sync2(new(journalRecord)); err != nil {
+		logger.Fatalf("create table journal_record: %s", err)
+	}
 	if m.db.DriverName() == "mysql" {
 		m.updateCollate()
 	}
@@ -266,6 +453,19 @@ func (m *dbMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ClientOpsLimit = format.ClientOpsLimit
+			old.JournalSize = format.JournalSize
+			if old.KeyPrefixes == 0 {
+				// it can be enabled for the following slices, but can't be changed once enabled
+				old.KeyPrefixes = format.KeyPrefixes
+				old.PrefixedFrom = format.PrefixedFrom
+			}
+			if format.XattrChecksum {
+				old.XattrChecksum = true // the values set before are not stamped
+			}
+			if compress.Tagged(old.Compression) && compress.Tagged(format.Compression) {
+				old.Compression = format.Compression
+			}
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -286,6 +486,7 @@ func (m *dbMeta) Init(format Format, force bool) error {
 		Atime:  now.UnixNano() / 1000,
 		Mtime:  now.UnixNano() / 1000,
 		Ctime:  now.UnixNano() / 1000,
+		Btime:  now.UnixNano() / 1000,
 		Nlink:  2,
 		Length: 4 << 10,
 		Parent: 1,
@@ -326,9 +527,9 @@ func (m *dbMeta) Init(format Format, force bool) error {
 func (m *dbMeta) Reset() error {
 	return m.db.DropTables(&setting{}, &counter{},
 		&node{}, &edge{}, &symlink{}, &xattr{},
-		&chunk{}, &chunkRef{},
+		&chunk{}, &chunkRef{}, &sliceChecksum{}, &inlineSlice{},
 		&session{}, &sustained{}, &delfile{},
-		&flock{}, &plock{})
+		&flock{}, &plock{}, &journalRecord{})
 }
 
 func (m *dbMeta) doLoad() ([]byte, error) {
@@ -337,16 +538,90 @@ func (m *dbMeta) doLoad() ([]byte, error) {
 	return []byte(s.Value), err
 }
 
+func (m *dbMeta) doCheckHealth() ([]string, error) {
+	if err := m.db.Ping(); err != nil {
+		return nil, err
+	}
+	var warnings []string
+	if st := m.db.DB().Stats(); st.MaxOpenConnections > 0 && st.InUse >= st.MaxOpenConnections*9/10 {
+		warnings = append(warnings, fmt.Sprintf("%d of %d connections are in use, waited %d times for a connection",
+			st.InUse, st.MaxOpenConnections, st.WaitCount))
+	}
+	return warnings, nil
+}
+
+// replPosition returns the position of WAL for PostgreSQL, or the one of binlog for MySQL (the
+// sequence of file in the high bits). Other databases have no replication, they are always in sync.
+func (m *dbMeta) replPosition() (uint64, error) {
+	switch m.db.DriverName() {
+	case "postgres":
+		rows, err := m.db.QueryString("SELECT (CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END) - '0/0'::pg_lsn AS pos")
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) == 0 || rows[0]["pos"] == "" {
+			return 0, fmt.Errorf("no position of WAL")
+		}
+		return strconv.ParseUint(rows[0]["pos"], 10, 64)
+	case "mysql":
+		rows, err := m.db.QueryString("SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) > 0 {
+			return binlogPosition(rows[0]["Relay_Master_Log_File"], rows[0]["Exec_Master_Log_Pos"])
+		}
+		if rows, err = m.db.QueryString("SHOW MASTER STATUS"); err != nil {
+			return 0, err
+		}
+		if len(rows) == 0 {
+			return 0, fmt.Errorf("binlog is not enabled")
+		}
+		return binlogPosition(rows[0]["File"], rows[0]["Position"])
+	default:
+		return 0, nil
+	}
+}
+
+// binlogPosition encodes the name (e.g. binlog.000012) and offset of binlog into one number.
+func binlogPosition(file, offset string) (uint64, error) {
+	seq, err := strconv.ParseUint(file[strings.LastIndex(file, ".")+1:], 10, 24)
+	if err != nil {
+		return 0, fmt.Errorf("invalid binlog %q", file)
+	}
+	pos, err := strconv.ParseUint(offset, 10, 40)
+	if err != nil {
+		return 0, fmt.Errorf("invalid position of binlog %q", offset)
+	}
+	return seq<<40 | pos, nil
+}
+
 func (m *dbMeta) doNewSession(sinfo []byte) error {
 	// old client has no info field
 	err := m.db.Sync2(new(session))
 	if err != nil {
 		return fmt.Errorf("update table session: %s", err)
 	}
+	// old client has no btime field
+	if err = m.db.Sync2(new(node)); err != nil {
+		return fmt.Errorf("update table node: %s", err)
+	}
 	// update the owner from uint64 to int64
 	if err = m.db.Sync2(new(flock), new(plock)); err != nil {
 		return fmt.Errorf("update table flock, plock: %s", err)
 	}
+	// old client has no checksums of slices
+	if err = m.db.Sync2(new(sliceChecksum)); err != nil {
+		return fmt.Errorf("create table slice_checksum: %s", err)
+	}
+	// old client has no inline slices
+	if err = m.db.Sync2(new(inlineSlice)); err != nil {
+		return fmt.Errorf("create table inline_slice: %s", err)
+	}
+	// old client has no change journal
+	if err = m.db.Sync2(new(journalRecord)); err != nil {
+		return fmt.Errorf("create table journal_record: %s", err)
+	}
 	if m.db.DriverName() == "mysql" {
 		m.updateCollate()
 	}
@@ -541,24 +816,26 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error) error {
 	if m.conf.ReadOnly {
 		return syscall.EROFS
 	}
+	var retries int
 	start := time.Now()
-	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
+	defer func() { m.timeitTxn(start, retries) }()
 	var err error
-	for i := 0; i < 50; i++ {
+	for i := 0; ; i++ {
 		_, err = m.db.Transaction(func(s *xorm.Session) (interface{}, error) {
 			s.ForUpdate()
 			return nil, f(s)
 		})
-		if m.shouldRetry(err) {
-			txRestart.Add(1)
-			logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
-			time.Sleep(time.Millisecond * time.Duration(i*i))
-			continue
+		if !m.shouldRetry(err) {
+			return err
 		}
-		return err
+		if i >= m.conf.TxnRetries {
+			return m.txnGiveUp(err)
+		}
+		m.txnRestarted()
+		retries++
+		logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
+		time.Sleep(time.Millisecond * time.Duration(i*i))
 	}
-	logger.Warnf("Already tried 50 times, returning: %s", err)
-	return err
 }
 
 func (m *dbMeta) parseAttr(n *node, attr *Attr) {
@@ -580,6 +857,8 @@ func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	attr.Length = n.Length
 	attr.Rdev = n.Rdev
 	attr.Parent = n.Parent
+	attr.Btime = n.Btime / 1e6
+	attr.Btimensec = uint32(n.Btime % 1e6 * 1000)
 	attr.Full = true
 }
 
@@ -658,10 +937,7 @@ func clearSUGIDSQL(ctx Context, cur *node, set *Attr) {
 	}
 }
 
-func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
-	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
+func (m *dbMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		var cur = node{Inode: inode}
 		ok, err := s.Get(&cur)
@@ -671,10 +947,13 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		if !ok {
 			return syscall.ENOENT
 		}
+		changed, st := changeFlags(ctx, &cur.Flags, set, attr.Flags)
+		if st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
-		var changed bool
 		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
 			clearSUGIDSQL(ctx, &cur, attr)
 			changed = true
@@ -707,6 +986,15 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			cur.Atime = now
 			changed = true
 		}
+		var accessed bool
+		if set&SetAttrAtimeRead != 0 {
+			var a Attr
+			m.parseAttr(&cur, &a)
+			if m.atimeNeedsUpdate(&a, time.Unix(0, now*1e3)) {
+				cur.Atime = now
+				accessed = true
+			}
+		}
 		if set&SetAttrMtime != 0 {
 			cur.Mtime = attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3
 			changed = true
@@ -716,11 +1004,13 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			changed = true
 		}
 		m.parseAttr(&cur, attr)
-		if !changed {
+		if !changed && !accessed {
 			return nil
 		}
-		cur.Ctime = now
-		_, err = s.Cols("mode", "uid", "gid", "atime", "mtime", "ctime").Update(&cur, &node{Inode: inode})
+		if changed {
+			cur.Ctime = now
+		}
+		_, err = s.Cols("flags", "mode", "uid", "gid", "atime", "mtime", "ctime").Update(&cur, &node{Inode: inode})
 		if err == nil {
 			m.parseAttr(&cur, attr)
 		}
@@ -745,8 +1035,8 @@ func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte
 	return err
 }
 
-func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
+func (m *dbMeta) doTruncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	defer m.timeit("truncate", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -763,7 +1053,7 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type != TypeFile {
+		if n.Type != TypeFile || protected(n.Flags) {
 			return syscall.EPERM
 		}
 		if length == n.Length {
@@ -829,7 +1119,7 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	return errno(err)
 }
 
-func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+func (m *dbMeta) doFallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -845,7 +1135,7 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	if size == 0 {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("fallocate", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -865,7 +1155,10 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if n.Type == TypeFIFO {
 			return syscall.EPIPE
 		}
-		if n.Type != TypeFile {
+		if n.Type != TypeFile || n.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		if n.Flags&FlagAppend != 0 && mode&^fallocKeepSize != 0 {
 			return syscall.EPERM
 		}
 		length := n.Length
@@ -972,6 +1265,9 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1013,6 +1309,7 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		n.Atime = now
 		n.Mtime = now
 		n.Ctime = now
+		n.Btime = now
 		if pn.Mode&02000 != 0 || ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			n.Gid = pn.Gid
 			if _type == TypeDirectory && runtime.GOOS == "linux" {
@@ -1060,6 +1357,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pn.Flags) {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1091,6 +1391,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			if ctx.Uid() != 0 && pn.Mode&01000 != 0 && ctx.Uid() != pn.Uid && ctx.Uid() != n.Uid {
 				return syscall.EACCES
 			}
+			if protected(n.Flags) {
+				return syscall.EPERM
+			}
 			n.Ctime = now
 			if trash == 0 {
 				n.Nlink--
@@ -1186,6 +1489,9 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pn.Flags) {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1223,6 +1529,9 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 			if ctx.Uid() != 0 && pn.Mode&01000 != 0 && ctx.Uid() != pn.Uid && ctx.Uid() != n.Uid {
 				return syscall.EACCES
 			}
+			if protected(n.Flags) {
+				return syscall.EPERM
+			}
 			if trash > 0 {
 				n.Ctime = now
 				n.Parent = trash
@@ -1325,6 +1634,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if !ok {
 			return syscall.ENOENT
 		}
+		if protected(spn.Flags) || dpn.Flags&FlagImmutable != 0 || protected(sn.Flags) {
+			return syscall.EPERM
+		}
 
 		var de = edge{Parent: parentDst, Name: nameDst}
 		ok, err = s.Get(&de)
@@ -1355,6 +1667,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				logger.Warnf("no attribute for inode %d (%d, %s)", dino, parentDst, de.Name)
 				trash = 0
 			}
+			if protected(dn.Flags) || protected(dpn.Flags) {
+				return syscall.EPERM
+			}
 			dn.Ctime = now
 			if exchange {
 				dn.Parent = parentSrc
@@ -1537,7 +1852,7 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type == TypeDirectory {
+		if n.Type == TypeDirectory || protected(n.Flags) || pn.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 
@@ -1563,6 +1878,137 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 	}))
 }
 
+func (m *dbMeta) doReparent(ctx Context, parent Ino, name string, inode Ino, attr *Attr) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var pn = node{Inode: parent}
+		ok, err := s.Get(&pn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if pn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		var e = edge{Parent: parent, Name: name}
+		ok, err = s.Get(&e)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return syscall.EEXIST
+		}
+		var n = node{Inode: inode}
+		ok, err = s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+
+		now := time.Now().UnixNano() / 1e3
+		pn.Mtime = now
+		pn.Ctime = now
+		if n.Type == TypeDirectory {
+			pn.Nlink++
+		}
+		n.Nlink = attr.Nlink
+		n.Parent = parent
+		n.Ctime = now
+
+		if err = mustInsert(s, &edge{Parent: parent, Name: name, Inode: inode, Type: n.Type}); err != nil {
+			return err
+		}
+		if _, err := s.Cols("nlink", "mtime", "ctime").Update(&pn, &node{Inode: parent}); err != nil {
+			return err
+		}
+		if _, err := s.Cols("nlink", "parent", "ctime").Update(&n, &node{Inode: inode}); err != nil {
+			return err
+		}
+		m.parseAttr(&n, attr)
+		return nil
+	}))
+}
+
+func (m *dbMeta) doFixNlink(ctx Context, inode Ino, old, nlink *uint32) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		subdirs, err := s.Where("parent=? and type=?", inode, TypeDirectory).Count(&edge{})
+		if err != nil {
+			return err
+		}
+		*old, *nlink = n.Nlink, 2+uint32(subdirs)
+		if n.Nlink == *nlink {
+			return nil
+		}
+		n.Nlink = *nlink
+		_, err = s.Cols("nlink").Update(&n, &node{Inode: inode})
+		return err
+	}))
+}
+
+func (m *dbMeta) scanAllEntries(ctx Context, scan func(parent Ino, name string, typ uint8, inode Ino)) error {
+	var e edge
+	rows, err := m.db.Rows(&e)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&e); err != nil {
+			return err
+		}
+		scan(e.Parent, e.Name, e.Type, e.Inode)
+	}
+	return nil
+}
+
+func (m *dbMeta) scanAllInodes(ctx Context, scan func(inode Ino, attr *Attr)) error {
+	var n node
+	rows, err := m.db.Rows(&n)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			return err
+		}
+		var attr Attr
+		m.parseAttr(&n, &attr)
+		scan(n.Inode, &attr)
+	}
+	return nil
+}
+
+func (m *dbMeta) scanAllXattrs(ctx Context, scan func(inode Ino, name string, value []byte)) error {
+	var x xattr
+	rows, err := m.db.Rows(&x)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&x); err != nil {
+			return err
+		}
+		scan(x.Inode, x.Name, x.Value)
+	}
+	return nil
+}
+
 func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	dbSession := m.db.Table(&edge{})
 	if plus != 0 {
@@ -1588,6 +2034,35 @@ func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	return 0
 }
 
+func (m *dbMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno) {
+	dbSession := m.db.Table(&edge{})
+	if plus != 0 {
+		dbSession = dbSession.Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
+	}
+	var nodes []namedNode
+	err := dbSession.Where("jfs_edge.parent=? AND jfs_edge.name>?", inode, cursor).OrderBy("jfs_edge.name").Limit(limit).Find(&nodes)
+	if err != nil {
+		return "", errno(err)
+	}
+	for _, n := range nodes {
+		entry := &Entry{
+			Inode: n.Inode,
+			Name:  []byte(n.Name),
+			Attr:  &Attr{},
+		}
+		if plus != 0 {
+			m.parseAttr(&n.node, entry.Attr)
+		} else {
+			entry.Attr.Typ = n.Type
+		}
+		*entries = append(*entries, entry)
+	}
+	if len(nodes) < limit {
+		return "", 0
+	}
+	return nodes[len(nodes)-1].Name, 0
+}
+
 func (m *dbMeta) doCleanStaleSession(sid uint64) {
 	// release locks
 	_, _ = m.db.Delete(flock{Sid: sid})
@@ -1640,9 +2115,9 @@ func (m *dbMeta) doFindStaleSessions(ts int64, limit int) ([]uint64, error) {
 	return sids, nil
 }
 
-func (m *dbMeta) doRefreshSession() {
+func (m *dbMeta) doRefreshSession(sinfo []byte) {
 	_ = m.txn(func(ses *xorm.Session) error {
-		n, err := ses.Cols("Heartbeat").Update(&session{Heartbeat: time.Now().Unix()}, &session{Sid: m.sid})
+		n, err := ses.Cols("Heartbeat", "Info").Update(&session{Heartbeat: time.Now().Unix(), Info: sinfo}, &session{Sid: m.sid})
 		if err == nil && n == 0 {
 			err = fmt.Errorf("no session found matching sid: %d", m.sid)
 		}
@@ -1692,26 +2167,34 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 		*chunks = cs
 		return 0
 	}
-	defer timeit(time.Now())
+	defer m.timeit("read", inode, time.Now())
+	ss, st := m.doRead(ctx, inode, indx)
+	if st != 0 {
+		return st
+	}
+	*chunks = buildSlice(ss)
+	m.of.CacheChunk(inode, indx, *chunks)
+	if m.needCompact(inode, ss, *chunks) {
+		go m.compactChunk(inode, indx, false, false)
+	}
+	return 0
+}
+
+func (m *dbMeta) doRead(ctx Context, inode Ino, indx uint32) ([]*slice, syscall.Errno) {
 	var c chunk
 	_, err := m.db.Where("inode=? and indx=?", inode, indx).Get(&c)
 	if err != nil {
-		return errno(err)
+		return nil, errno(err)
 	}
 	ss := readSliceBuf(c.Slices)
 	if ss == nil {
-		return syscall.EIO
-	}
-	*chunks = buildSlice(ss)
-	m.of.CacheChunk(inode, indx, *chunks)
-	if !m.conf.ReadOnly && (len(c.Slices)/sliceBytes >= 5 || len(*chunks) >= 5) {
-		go m.compactChunk(inode, indx, false)
+		return nil, syscall.EIO
 	}
-	return 0
+	return ss, 0
 }
 
 func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("write", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1729,7 +2212,7 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type != TypeFile {
+		if n.Type != TypeFile || n.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
@@ -1770,15 +2253,16 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	})
 	if err == nil {
 		if needCompact {
-			go m.compactChunk(inode, indx, false)
+			go m.compactChunk(inode, indx, false, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.journalWrite(ctx, inode, uint64(indx)*ChunkSize+uint64(off), uint64(slice.Len))
 	}
 	return errno(err)
 }
 
 func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("copyfilerange", fin, time.Now())
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
@@ -1812,6 +2296,9 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if nout.Type != TypeFile {
 			return syscall.EINVAL
 		}
+		if nout.Flags&FlagImmutable != 0 || nout.Flags&FlagAppend != 0 && offOut < nout.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
 		if newleng > nout.Length {
@@ -1902,6 +2389,7 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.journalWrite(ctx, fout, offOut, *copied)
 	}
 	return errno(err)
 }
@@ -2001,14 +2489,17 @@ func (m *dbMeta) doDeleteFileData(inode Ino, length uint64) {
 	_, _ = m.db.Delete(delfile{Inode: inode})
 }
 
-func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
+func (m *dbMeta) compactChunk(inode Ino, indx uint32, whole, force bool) syscall.Errno {
 	if !force {
+		if m.BackgroundPaused() {
+			return 0
+		}
 		// avoid too many or duplicated compaction
 		m.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(m.compacting) > 10 || m.compacting[k] {
 			m.Unlock()
-			return
+			return 0
 		}
 		m.compacting[k] = true
 		m.Unlock()
@@ -2022,21 +2513,27 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	var c chunk
 	_, err := m.db.Where("inode=? and indx=?", inode, indx).Get(&c)
 	if err != nil {
-		return
+		return errno(err)
 	}
 
 	ss := readSliceBuf(c.Slices)
-	skipped := skipSome(ss)
+	var skipped int
+	if !whole {
+		skipped = skipSome(ss)
+	}
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
+	if size == 0 && skipped == 0 && len(ss) > 0 {
+		return m.releaseHoles(inode, indx, c.Slices, ss)
+	}
 	if len(ss) < 2 || size == 0 {
-		return
+		return 0
 	}
 
 	var chunkid uint64
 	st := m.NewChunk(Background, &chunkid)
 	if st != 0 {
-		return
+		return st
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
 	err = m.newMsg(CompactChunk, chunks, chunkid)
@@ -2044,7 +2541,7 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return syscall.EIO
 	}
 	err = m.txn(func(ses *xorm.Session) error {
 		var c2 = chunk{Inode: inode}
@@ -2101,11 +2598,60 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	} else {
 		logger.Warnf("compact %d %d: %s", inode, indx, err)
 	}
+	if whole {
+		return errno(err)
+	}
 	go func() {
 		// wait for the current compaction to finish
 		time.Sleep(time.Millisecond * 10)
-		m.compactChunk(inode, indx, force)
+		m.compactChunk(inode, indx, false, force)
 	}()
+	return errno(err)
+}
+
+// releaseHoles deletes a chunk without any data (all punched as holes) if it's not changed,
+// and releases its slices.
+func (m *dbMeta) releaseHoles(inode Ino, indx uint32, buf []byte, ss []*slice) syscall.Errno {
+	err := m.txn(func(ses *xorm.Session) error {
+		var c = chunk{Inode: inode}
+		ok, err := ses.Where("indx=?", indx).Get(&c)
+		if err != nil {
+			return err
+		}
+		if !ok || !bytes.Equal(c.Slices, buf) {
+			return syscall.EINVAL
+		}
+		for _, s := range ss {
+			if s.chunkid == 0 {
+				continue
+			}
+			if _, err = ses.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? AND size=?", s.chunkid, s.size); err != nil {
+				return err
+			}
+		}
+		c.Slices = nil
+		n, err := ses.Where("inode = ? AND indx = ?", inode, indx).Delete(&c)
+		if err == nil && n == 0 {
+			err = fmt.Errorf("chunk %d:%d changed, try restarting transaction", inode, indx)
+		}
+		return err
+	})
+	if err != nil {
+		return errno(err)
+	}
+	logger.Debugf("release %d slices in the holes of %d:%d", len(ss), inode, indx)
+	m.of.InvalidateChunk(inode, indx)
+	for _, s := range ss {
+		if s.chunkid == 0 {
+			continue
+		}
+		var ref = chunkRef{Chunkid: s.chunkid}
+		ok, err := m.db.Get(&ref)
+		if err == nil && ok && ref.Refs <= 0 {
+			m.deleteSlice(s.chunkid, s.size)
+		}
+	}
+	return 0
 }
 
 func dup(b []byte) []byte {
@@ -2132,7 +2678,7 @@ func (m *dbMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 	bar.IncrTotal(int64(len(cs)))
 	for _, c := range cs {
 		logger.Debugf("compact chunk %d:%d (%d slices)", c.Inode, c.Indx, len(c.Slices)/sliceBytes)
-		m.compactChunk(c.Inode, c.Indx, true)
+		m.compactChunk(c.Inode, c.Indx, false, true)
 		bar.Increment()
 	}
 	return 0
@@ -2167,8 +2713,8 @@ func (m *dbMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, sh
 	return 0
 }
 
-func (m *dbMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+func (m *dbMeta) doGetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	defer m.timeit("getxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	var x = xattr{Inode: inode, Name: name}
 	ok, err := m.db.Get(&x)
@@ -2183,7 +2729,7 @@ func (m *dbMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) sy
 }
 
 func (m *dbMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("listxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	var x = xattr{Inode: inode}
 	rows, err := m.db.Where("inode = ?", inode).Rows(&x)
@@ -2203,11 +2749,11 @@ func (m *dbMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno
 	return 0
 }
 
-func (m *dbMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+func (m *dbMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("setxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	return errno(m.txn(func(s *xorm.Session) error {
 		var x = xattr{inode, name, value}
@@ -2238,11 +2784,32 @@ func (m *dbMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, fla
 	}))
 }
 
-func (m *dbMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+func (m *dbMeta) doCompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno {
+	defer m.timeit("setxattr", inode, time.Now())
+	inode = m.checkRoot(inode)
+	return errno(m.txn(func(s *xorm.Session) error {
+		var x = xattr{Inode: inode, Name: name}
+		ok, err := s.Get(&x)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(x.Value, expected) {
+			return syscall.ECANCELED
+		}
+		if !ok {
+			_, err = s.Insert(&xattr{inode, name, value})
+		} else {
+			_, err = s.Cols("value").Update(&xattr{Value: value}, &xattr{Inode: inode, Name: name})
+		}
+		return err
+	}))
+}
+
+func (m *dbMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("removexattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	return errno(m.txn(func(s *xorm.Session) error {
 		n, err := s.Delete(&xattr{Inode: inode, Name: name})
@@ -2414,7 +2981,7 @@ func (m *dbMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 		entry.Name = e.Name
 		if e.Type == TypeDirectory {
 			err = m.dumpDir(e.Inode, entry, bw, depth+2, showProgress)
-		} else {
+		} else if err = m.dumpSliceData(entry); err == nil {
 			err = entry.writeJSON(bw, depth+2)
 		}
 		if err != nil {
@@ -2628,16 +3195,19 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		Uid:    attr.Uid,
 		Gid:    attr.Gid,
 		Atime:  attr.Atime*1e6 + int64(attr.Atimensec)/1e3,
-		Mtime:  attr.Mtime*1e6 + int64(attr.Atimensec)/1e3,
-		Ctime:  attr.Ctime*1e6 + int64(attr.Atimensec)/1e3,
+		Mtime:  attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3,
+		Ctime:  attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3,
+		Btime:  attr.Btime*1e6 + int64(attr.Btimensec)/1e3,
 		Nlink:  attr.Nlink,
 		Rdev:   attr.Rdev,
+		Flags:  attr.Flags,
 		Parent: e.Parent,
 	} // Length not set
 	var beans []interface{}
 	if n.Type == TypeFile {
 		n.Length = attr.Length
 		chunks := make([]*chunk, 0, len(e.Chunks))
+		var inlines []*inlineSlice
 		for _, c := range e.Chunks {
 			if len(c.Slices) == 0 {
 				continue
@@ -2648,6 +3218,9 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 				m.Lock()
 				if refs[s.Chunkid] == nil {
 					refs[s.Chunkid] = &chunkRef{s.Chunkid, s.Size, 1}
+					if s.Data != nil { // the shared slices are loaded once
+						inlines = append(inlines, &inlineSlice{s.Chunkid, s.Data})
+					}
 				} else {
 					refs[s.Chunkid].Refs++
 				}
@@ -2661,6 +3234,9 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		if len(chunks) > 0 {
 			beans = append(beans, chunks)
 		}
+		if len(inlines) > 0 {
+			beans = append(beans, inlines)
+		}
 	} else if n.Type == TypeDirectory {
 		n.Length = 4 << 10
 		if len(e.Entries) > 0 {
@@ -2706,7 +3282,8 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 	return mustInsert(s, beans...)
 }
 
-func (m *dbMeta) LoadMeta(r io.Reader) error {
+// prepareLoad checks that the database is empty and creates the tables.
+func (m *dbMeta) prepareLoad() error {
 	tables, err := m.db.DBMetas()
 	if err != nil {
 		return err
@@ -2720,8 +3297,8 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.db.Sync2(new(node), new(edge), new(symlink), new(xattr)); err != nil {
 		return fmt.Errorf("create table node, edge, symlink, xattr: %s", err)
 	}
-	if err = m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
-		return fmt.Errorf("create table chunk, chunk_ref: %s", err)
+	if err = m.db.Sync2(new(chunk), new(chunkRef), new(sliceChecksum), new(inlineSlice)); err != nil {
+		return fmt.Errorf("create table chunk, chunk_ref, slice_checksum, inline_slice: %s", err)
 	}
 	if err = m.db.Sync2(new(session), new(sustained), new(delfile)); err != nil {
 		return fmt.Errorf("create table session, sustaind, delfile: %s", err)
@@ -2729,6 +3306,17 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.db.Sync2(new(flock), new(plock)); err != nil {
 		return fmt.Errorf("create table flock, plock: %s", err)
 	}
+	if err = m.db.Sync2(new(journalRecord)); err != nil {
+		return fmt.Errorf("create table journal_record: %s", err)
+	}
+	return nil
+}
+
+func (m *dbMeta) LoadMeta(r io.Reader) error {
+	err := m.prepareLoad()
+	if err != nil {
+		return err
+	}
 
 	dec := json.NewDecoder(r)
 	dm := &DumpedMeta{}
@@ -2833,3 +3421,64 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	defer s.Close()
 	return mustInsert(s, beans...)
 }
+
+func (m *dbMeta) cleanEntry(inode Ino, versions ...*DumpedEntry) error {
+	return m.txn(func(s *xorm.Session) error {
+		for _, bean := range []interface{}{&node{Inode: inode}, &edge{Parent: inode}, &xattr{Inode: inode}, &symlink{Inode: inode}, &chunk{Inode: inode}} {
+			if _, err := s.Delete(bean); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) writeEntry(e *DumpedEntry) error {
+	return m.loadEntry(e, &DumpedCounters{}, make(map[uint64]*chunkRef))
+}
+
+func (m *dbMeta) writeState(dm *DumpedMeta, cs *DumpedCounters, refs map[sliceID]int) error {
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
+		return err
+	}
+	return m.txn(func(s *xorm.Session) error {
+		beans := []interface{}{
+			&setting{"format", string(format)},
+			&counter{"usedSpace", cs.UsedSpace},
+			&counter{"totalInodes", cs.UsedInodes},
+			&counter{"nextInode", cs.NextInode},
+			&counter{"nextChunk", cs.NextChunk},
+			&counter{"nextSession", cs.NextSession},
+			&counter{"nextTrash", cs.NextTrash},
+			&counter{"nextCleanupSlices", 0},
+		}
+		for _, b := range beans {
+			var err error
+			switch b := b.(type) {
+			case *setting:
+				_, err = s.Delete(&setting{Name: b.Name})
+			case *counter:
+				_, err = s.Delete(&counter{Name: b.Name})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := s.Where("inode > 0").Delete(new(delfile)); err != nil {
+			return err
+		}
+		for _, d := range dm.DelFiles {
+			beans = append(beans, &delfile{d.Inode, d.Length, d.Expire})
+		}
+		for id, n := range refs {
+			if _, err := s.Delete(&chunkRef{Chunkid: id.Chunkid}); err != nil {
+				return err
+			}
+			if n > 0 {
+				beans = append(beans, &chunkRef{id.Chunkid, id.Size, n})
+			}
+		}
+		return mustInsert(s, beans...)
+	})
+}
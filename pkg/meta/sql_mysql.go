@@ -20,9 +20,73 @@
 package meta
 
 import (
-	_ "github.com/go-sql-driver/mysql"
+	"context"
+	"database/sql/driver"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 func init() {
 	Register("mysql", newSQLMeta)
+	sqlConnectors["mysql"] = newMySQLConnector
+}
+
+type mysqlConnector struct {
+	cfg    *mysql.Config
+	tokens *tokenRefresher
+}
+
+func newMySQLConnector(dsn string, co *connOptions) (driver.Connector, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if co.useTLS() {
+		tc, err := co.tlsConfig("")
+		if err != nil {
+			return nil, err
+		}
+		name := "juicefs-" + cfg.Addr
+		if err = mysql.RegisterTLSConfig(name, tc); err != nil {
+			return nil, err
+		}
+		cfg.TLSConfig = name
+	}
+	c := &mysqlConnector{cfg: cfg}
+	if co.auth != "" {
+		if c.tokens, err = newTokenRefresher(co, cfg.Addr, cfg.User); err != nil {
+			return nil, err
+		}
+		// the token is sent as clear text, which is required by IAM authentication
+		cfg.AllowCleartextPasswords = true
+		if !co.useTLS() && cfg.TLSConfig == "" {
+			logger.Warnf("The token for MySQL is sent without TLS")
+		}
+	}
+	return c, nil
+}
+
+// Connect uses the latest token as password for new connections.
+func (c *mysqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg := c.cfg.Clone()
+	if c.tokens != nil {
+		cfg.Passwd = c.tokens.current()
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *mysqlConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
+// Close stops refreshing the token, which is called by sql.DB.Close.
+func (c *mysqlConnector) Close() error {
+	if c.tokens != nil {
+		return c.tokens.Close()
+	}
+	return nil
 }
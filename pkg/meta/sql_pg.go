@@ -20,9 +20,82 @@
 package meta
 
 import (
-	_ "github.com/lib/pq"
+	"context"
+	"database/sql/driver"
+	"net"
+	"net/url"
+
+	"github.com/lib/pq"
 )
 
 func init() {
 	Register("postgres", newSQLMeta)
+	sqlConnectors["postgres"] = newPGConnector
+}
+
+type pgConnector struct {
+	dsn    *url.URL
+	tokens *tokenRefresher
+}
+
+func newPGConnector(dsn string, co *connOptions) (driver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if co.useTLS() {
+		// lib/pq loads the certificates by itself
+		query := u.Query()
+		if co.insecure {
+			query.Set("sslmode", "require")
+		} else {
+			if query.Get("sslmode") == "" {
+				query.Set("sslmode", "verify-full")
+			}
+			if co.caFile != "" {
+				query.Set("sslrootcert", co.caFile)
+			}
+		}
+		if co.certFile != "" {
+			query.Set("sslcert", co.certFile)
+			query.Set("sslkey", co.keyFile)
+		}
+		u.RawQuery = query.Encode()
+	}
+	c := &pgConnector{dsn: u}
+	if co.auth != "" {
+		addr := u.Host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "5432")
+		}
+		if c.tokens, err = newTokenRefresher(co, addr, u.User.Username()); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Connect uses the latest token as password for new connections.
+func (c *pgConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	u := *c.dsn
+	if c.tokens != nil {
+		u.User = url.UserPassword(c.dsn.User.Username(), c.tokens.current())
+	}
+	connector, err := pq.NewConnector(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *pgConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Close stops refreshing the token, which is called by sql.DB.Close.
+func (c *pgConnector) Close() error {
+	if c.tokens != nil {
+		return c.tokens.Close()
+	}
+	return nil
 }
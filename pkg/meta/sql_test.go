@@ -19,7 +19,9 @@ package meta
 
 import (
 	"path"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestSQLiteClient(t *testing.T) {
@@ -45,3 +47,52 @@ func TestPostgreSQLClient(t *testing.T) {
 	}
 	testMeta(t, m)
 }
+
+func TestSQLiteConsistency(t *testing.T) {
+	p := path.Join(t.TempDir(), "jfs-unit-test.db")
+	m, err := newSQLMeta("sqlite3", p, &Config{MaxDeletes: 1, OpenCache: time.Minute})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	m2, err := newSQLMeta("sqlite3", p, &Config{MaxDeletes: 1, OpenCache: time.Minute, Consistency: ConsistencyStrict})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if _, err = m2.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	defer m.Close(ctx, inode)
+	if st := m2.Open(ctx, inode, syscall.O_RDONLY, &Attr{}); st != 0 {
+		t.Fatalf("open f: %s", st)
+	}
+	defer m2.Close(ctx, inode)
+	var chunks []Slice
+	if st := m2.Read(ctx, inode, 0, &chunks); st != 0 || len(chunks) != 0 {
+		t.Fatalf("read f: %s %v", st, chunks)
+	}
+
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	// the writer reads its own writes
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("length of f should be 100 in the writer: %s %d", st, attr.Length)
+	}
+	// the strict client sees the writes from others immediately
+	if st := m2.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 100 {
+		t.Fatalf("length of f should be 100 in the other client: %s %d", st, attr.Length)
+	}
+	if st := m2.Read(ctx, inode, 0, &chunks); st != 0 || len(chunks) != 1 || chunks[0].Chunkid != 1 {
+		t.Fatalf("read f in the other client: %s %v", st, chunks)
+	}
+}
@@ -36,6 +36,7 @@ import (
 
 	"github.com/google/btree"
 
+	"github.com/juicedata/juicefs/pkg/compress"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -43,6 +44,7 @@ type kvTxn interface {
 	get(key []byte) []byte
 	gets(keys ...[]byte) [][]byte
 	scanRange(begin, end []byte) map[string][]byte
+	scanRangeN(begin, end []byte, limit int) map[string][]byte // the first limit keys in the range
 	scan(prefix []byte, handler func(key, value []byte))
 	scanKeys(prefix []byte) [][]byte
 	scanValues(prefix []byte, limit int, filter func(k, v []byte) bool) map[string][]byte
@@ -102,7 +104,84 @@ func (m *kvMeta) Name() string {
 }
 
 func (m *kvMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.deleteKeys(m.sliceKey(chunkid, size))
+	return m.deleteKeys(m.sliceKey(chunkid, size), m.sliceSumsKey(chunkid), m.inlineSliceKey(chunkid))
+}
+
+func (m *kvMeta) doSetSliceChecksums(chunkid uint64, sums []byte) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.sliceSumsKey(chunkid), sums)
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetSliceChecksums(chunkid uint64) ([]byte, error) {
+	return m.get(m.sliceSumsKey(chunkid))
+}
+
+func (m *kvMeta) doSetSliceData(chunkid uint64, data []byte) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.inlineSliceKey(chunkid), data)
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetSliceData(chunkid uint64) ([]byte, error) {
+	return m.get(m.inlineSliceKey(chunkid))
+}
+
+func (m *kvMeta) doAppendJournal(n int, encode func(first uint64) ([][]byte, error)) (uint64, error) {
+	var last uint64
+	err := m.txn(func(tx kvTxn) error {
+		last = uint64(tx.incrBy(m.counterKey("nextJournal"), int64(n)))
+		first := last - uint64(n) + 1
+		records, err := encode(first)
+		if err != nil {
+			return err
+		}
+		for i, r := range records {
+			tx.set(m.journalKey(first+uint64(i)), r)
+		}
+		return nil
+	})
+	return last, err
+}
+
+func (m *kvMeta) doReadJournal(since uint64, limit int) ([][]byte, error) {
+	var vals map[string][]byte
+	err := m.client.txn(func(tx kvTxn) error {
+		vals = tx.scanRangeN(m.journalKey(since+1), nextKey(m.fmtKey("J")), limit)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	records := make([][]byte, len(keys))
+	for i, k := range keys {
+		records[i] = vals[k]
+	}
+	return records, nil
+}
+
+func (m *kvMeta) doTrimJournal(before uint64) error {
+	var keys [][]byte
+	for {
+		err := m.client.txn(func(tx kvTxn) error {
+			keys = keys[:0]
+			for k := range tx.scanRangeN(m.journalKey(0), m.journalKey(before), 1000) {
+				keys = append(keys, []byte(k))
+			}
+			tx.dels(keys...)
+			return nil
+		})
+		if err != nil || len(keys) < 1000 {
+			return err
+		}
+	}
 }
 
 func (m *kvMeta) keyLen(args ...interface{}) int {
@@ -167,6 +246,9 @@ All keys:
   Fiiiiiiii          Flocks
   Piiiiiiii          POSIX locks
   Kccccccccnnnn      slice refs
+  Ucccccccc          checksums of slice
+  Icccccccc          inline slice data
+  Jssssssss          change journal (by sequence number)
   SHssssssss         session heartbeat
   SIssssssss         session info
   SSssssssssiiiiiiii sustained inode
@@ -188,6 +270,18 @@ func (m *kvMeta) sliceKey(chunkid uint64, size uint32) []byte {
 	return m.fmtKey("K", chunkid, size)
 }
 
+func (m *kvMeta) sliceSumsKey(chunkid uint64) []byte {
+	return m.fmtKey("U", chunkid)
+}
+
+func (m *kvMeta) inlineSliceKey(chunkid uint64) []byte {
+	return m.fmtKey("I", chunkid)
+}
+
+func (m *kvMeta) journalKey(seq uint64) []byte {
+	return m.fmtKey("J", seq)
+}
+
 func (m *kvMeta) symKey(inode Ino) []byte {
 	return m.fmtKey("A", inode, "S")
 }
@@ -344,6 +438,19 @@ func (m *kvMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ClientOpsLimit = format.ClientOpsLimit
+			old.JournalSize = format.JournalSize
+			if old.KeyPrefixes == 0 {
+				// it can be enabled for the following slices, but can't be changed once enabled
+				old.KeyPrefixes = format.KeyPrefixes
+				old.PrefixedFrom = format.PrefixedFrom
+			}
+			if format.XattrChecksum {
+				old.XattrChecksum = true // the values set before are not stamped
+			}
+			if compress.Tagged(old.Compression) && compress.Tagged(format.Compression) {
+				old.Compression = format.Compression
+			}
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -364,6 +471,7 @@ func (m *kvMeta) Init(format Format, force bool) error {
 		Atime:  ts,
 		Mtime:  ts,
 		Ctime:  ts,
+		Btime:  ts,
 		Nlink:  2,
 		Length: 4 << 10,
 		Parent: 1,
@@ -395,6 +503,11 @@ func (m *kvMeta) doLoad() ([]byte, error) {
 	return m.get(m.fmtKey("setting"))
 }
 
+// doCheckHealth does nothing, the engine is checked by reading the setting.
+func (m *kvMeta) doCheckHealth() ([]string, error) {
+	return nil, nil
+}
+
 func (m *kvMeta) doNewSession(sinfo []byte) error {
 	if err := m.setValue(m.sessionKey(m.sid), m.packInt64(time.Now().Unix())); err != nil {
 		return fmt.Errorf("set session ID %d: %s", m.sid, err)
@@ -407,8 +520,9 @@ func (m *kvMeta) doNewSession(sinfo []byte) error {
 	return nil
 }
 
-func (m *kvMeta) doRefreshSession() {
+func (m *kvMeta) doRefreshSession(sinfo []byte) {
 	_ = m.setValue(m.sessionKey(m.sid), m.packInt64(time.Now().Unix()))
+	_ = m.setValue(m.sessionInfoKey(m.sid), sinfo)
 }
 
 func (m *kvMeta) doCleanStaleSession(sid uint64) {
@@ -601,20 +715,22 @@ func (m *kvMeta) txn(f func(tx kvTxn) error) error {
 	if m.conf.ReadOnly {
 		return syscall.EROFS
 	}
+	var retries int
 	start := time.Now()
-	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
+	defer func() { m.timeitTxn(start, retries) }()
 	var err error
-	for i := 0; i < 50; i++ {
-		if err = m.client.txn(f); m.shouldRetry(err) {
-			txRestart.Add(1)
-			logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
-			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
-			continue
+	for i := 0; ; i++ {
+		if err = m.client.txn(f); !m.shouldRetry(err) {
+			return err
 		}
-		return err
+		if i >= m.conf.TxnRetries {
+			return m.txnGiveUp(err)
+		}
+		m.txnRestarted()
+		retries++
+		logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
+		time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
 	}
-	logger.Warnf("Already tried 50 times, returning: %s", err)
-	return err
 }
 
 func (m *kvMeta) setValue(key, value []byte) error {
@@ -686,10 +802,7 @@ func (m *kvMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	return errno(err)
 }
 
-func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
-	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
+func (m *kvMeta) doSetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	return errno(m.txn(func(tx kvTxn) error {
 		var cur Attr
 		a := tx.get(m.inodeKey(inode))
@@ -697,10 +810,13 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &cur)
+		changed, st := changeFlags(ctx, &cur.Flags, set, attr.Flags)
+		if st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
-		var changed bool
 		if (cur.Mode&06000) != 0 && (set&(SetAttrUID|SetAttrGID)) != 0 {
 			clearSUGID(ctx, &cur, attr)
 			changed = true
@@ -735,6 +851,12 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			cur.Atimensec = uint32(now.Nanosecond())
 			changed = true
 		}
+		var accessed bool
+		if set&SetAttrAtimeRead != 0 && m.atimeNeedsUpdate(&cur, now) {
+			cur.Atime = now.Unix()
+			cur.Atimensec = uint32(now.Nanosecond())
+			accessed = true
+		}
 		if set&SetAttrMtime != 0 && (cur.Mtime != attr.Mtime || cur.Mtimensec != attr.Mtimensec) {
 			cur.Mtime = attr.Mtime
 			cur.Mtimensec = attr.Mtimensec
@@ -745,20 +867,22 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			cur.Mtimensec = uint32(now.Nanosecond())
 			changed = true
 		}
-		if !changed {
+		if !changed && !accessed {
 			*attr = cur
 			return nil
 		}
-		cur.Ctime = now.Unix()
-		cur.Ctimensec = uint32(now.Nanosecond())
+		if changed {
+			cur.Ctime = now.Unix()
+			cur.Ctimensec = uint32(now.Nanosecond())
+		}
 		tx.set(m.inodeKey(inode), m.marshal(&cur))
 		*attr = cur
 		return nil
 	}))
 }
 
-func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
-	defer timeit(time.Now())
+func (m *kvMeta) doTruncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	defer m.timeit("truncate", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -773,7 +897,7 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &t)
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || protected(t.Flags) {
 			return syscall.EPERM
 		}
 		if length == t.Length {
@@ -823,7 +947,7 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	return errno(err)
 }
 
-func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+func (m *kvMeta) doFallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -839,7 +963,7 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	if size == 0 {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("fallocate", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -857,7 +981,10 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if t.Typ == TypeFIFO {
 			return syscall.EPIPE
 		}
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || t.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagAppend != 0 && mode&^fallocKeepSize != 0 {
 			return syscall.EPERM
 		}
 		length := t.Length
@@ -931,6 +1058,7 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 	attr.Mode = mode & ^cumask
 	attr.Uid = ctx.Uid()
 	attr.Gid = ctx.Gid()
+	attr.Flags = 0
 	if _type == TypeDirectory {
 		attr.Nlink = 2
 		attr.Length = 4 << 10
@@ -959,6 +1087,9 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 
 		buf := tx.get(m.entryKey(parent, name))
 		var foundIno Ino
@@ -999,6 +1130,8 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Btime = now.Unix()
+		attr.Btimensec = uint32(now.Nanosecond())
 		if pattr.Mode&02000 != 0 || ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
 			attr.Gid = pattr.Gid
 			if _type == TypeDirectory && runtime.GOOS == "linux" {
@@ -1054,6 +1187,9 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pattr.Flags) {
+			return syscall.EPERM
+		}
 		attr = Attr{}
 		opened = false
 		now := time.Now()
@@ -1062,6 +1198,9 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
+			if protected(attr.Flags) {
+				return syscall.EPERM
+			}
 			attr.Ctime = now.Unix()
 			attr.Ctimensec = uint32(now.Nanosecond())
 			if trash == 0 {
@@ -1149,6 +1288,9 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if protected(pattr.Flags) {
+			return syscall.EPERM
+		}
 		if tx.exist(m.entryKey(inode, "")) {
 			return syscall.ENOTEMPTY
 		}
@@ -1159,6 +1301,9 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
+			if protected(attr.Flags) {
+				return syscall.EPERM
+			}
 			if trash > 0 {
 				attr.Ctime = now.Unix()
 				attr.Ctimensec = uint32(now.Nanosecond())
@@ -1234,6 +1379,9 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			return syscall.ENOTDIR
 		}
 		m.parseAttr(rs[2], &iattr)
+		if protected(sattr.Flags) || dattr.Flags&FlagImmutable != 0 || protected(iattr.Flags) {
+			return syscall.EPERM
+		}
 
 		dbuf := tx.get(m.entryKey(parentDst, nameDst))
 		if dbuf == nil && m.conf.CaseInsensi {
@@ -1256,6 +1404,9 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				trash = 0
 			}
 			m.parseAttr(a, &tattr)
+			if protected(tattr.Flags) || protected(dattr.Flags) {
+				return syscall.EPERM
+			}
 			tattr.Ctime = now.Unix()
 			tattr.Ctimensec = uint32(now.Nanosecond())
 			if exchange {
@@ -1381,7 +1532,7 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 			return syscall.ENOTDIR
 		}
 		m.parseAttr(rs[1], &iattr)
-		if iattr.Typ == TypeDirectory {
+		if iattr.Typ == TypeDirectory || protected(iattr.Flags) || pattr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		buf := tx.get(m.entryKey(parent, name))
@@ -1407,6 +1558,116 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 	}))
 }
 
+func (m *kvMeta) doReparent(ctx Context, parent Ino, name string, inode Ino, attr *Attr) syscall.Errno {
+	return errno(m.txn(func(tx kvTxn) error {
+		rs := tx.gets(m.inodeKey(parent), m.inodeKey(inode))
+		if rs[0] == nil || rs[1] == nil {
+			return syscall.ENOENT
+		}
+		var pattr, iattr Attr
+		m.parseAttr(rs[0], &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+		m.parseAttr(rs[1], &iattr)
+
+		now := time.Now()
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		if iattr.Typ == TypeDirectory {
+			pattr.Nlink++
+		}
+		iattr.Ctime = now.Unix()
+		iattr.Ctimensec = uint32(now.Nanosecond())
+		iattr.Nlink = attr.Nlink
+		iattr.Parent = parent
+		tx.set(m.entryKey(parent, name), m.packEntry(iattr.Typ, inode))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		tx.set(m.inodeKey(inode), m.marshal(&iattr))
+		*attr = iattr
+		return nil
+	}))
+}
+
+func (m *kvMeta) doFixNlink(ctx Context, inode Ino, old, nlink *uint32) syscall.Errno {
+	return errno(m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		m.parseAttr(a, &attr)
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		n := uint32(2)
+		tx.scan(m.entryKey(inode, ""), func(k, v []byte) {
+			if typ, _ := m.parseEntry(v); typ == TypeDirectory {
+				n++
+			}
+		})
+		*old, *nlink = attr.Nlink, n
+		if attr.Nlink != n {
+			attr.Nlink = n
+			tx.set(m.inodeKey(inode), m.marshal(&attr))
+		}
+		return nil
+	}))
+}
+
+func (m *kvMeta) scanAllEntries(ctx Context, scan func(parent Ino, name string, typ uint8, inode Ino)) error {
+	// AiiiiiiiiD...      dentry
+	klen := 1 + 8 + 1
+	result, err := m.scanValues(m.fmtKey("A"), -1, func(k, v []byte) bool {
+		return len(k) > klen && k[1+8] == 'D'
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range result {
+		typ, inode := m.parseEntry(value)
+		scan(m.decodeInode([]byte(key)[1:9]), key[klen:], typ, inode)
+	}
+	return nil
+}
+
+func (m *kvMeta) scanAllInodes(ctx Context, scan func(inode Ino, attr *Attr)) error {
+	// AiiiiiiiiI         inode attribute
+	klen := 1 + 8 + 1
+	result, err := m.scanValues(m.fmtKey("A"), -1, func(k, v []byte) bool {
+		return len(k) == klen && k[1+8] == 'I'
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range result {
+		var attr Attr
+		m.parseAttr(value, &attr)
+		scan(m.decodeInode([]byte(key)[1:9]), &attr)
+	}
+	return nil
+}
+
+func (m *kvMeta) scanAllXattrs(ctx Context, scan func(inode Ino, name string, value []byte)) error {
+	// AiiiiiiiiX...      xattr
+	klen := 1 + 8 + 1
+	result, err := m.scanValues(m.fmtKey("A"), -1, func(k, v []byte) bool {
+		return len(k) > klen && k[1+8] == 'X'
+	})
+	if err != nil {
+		return err
+	}
+	for key, value := range result {
+		scan(m.decodeInode([]byte(key)[1:9]), key[klen:], value)
+	}
+	return nil
+}
+
 func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	// TODO: handle big directory
 	vals, err := m.scanValues(m.entryKey(inode, ""), -1, nil)
@@ -1424,60 +1685,103 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	}
 
 	if plus != 0 {
-		fillAttr := func(es []*Entry) error {
-			var keys = make([][]byte, len(es))
-			for i, e := range es {
-				keys[i] = m.inodeKey(e.Inode)
-			}
-			var rs [][]byte
-			err := m.client.txn(func(tx kvTxn) error {
-				rs = tx.gets(keys...)
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-			for j, re := range rs {
-				if re != nil {
-					m.parseAttr(re, es[j].Attr)
-				}
-			}
+		if err = m.fillAttrs(*entries); err != nil {
+			return errno(err)
+		}
+	}
+	return 0
+}
+
+func (m *kvMeta) doReaddirPage(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, syscall.Errno) {
+	prefix := m.entryKey(inode, "")
+	begin := prefix
+	if cursor != "" {
+		begin = append(m.entryKey(inode, cursor), 0)
+	}
+	var vals map[string][]byte
+	err := m.client.txn(func(tx kvTxn) error {
+		vals = tx.scanRangeN(begin, nextKey(prefix), limit)
+		return nil
+	})
+	if err != nil {
+		return "", errno(err)
+	}
+	names := make([]string, 0, len(vals))
+	for k := range vals {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	n := len(*entries)
+	for _, k := range names {
+		typ, inode := m.parseEntry(vals[k])
+		*entries = append(*entries, &Entry{
+			Inode: inode,
+			Name:  []byte(k)[len(prefix):],
+			Attr:  &Attr{Typ: typ},
+		})
+	}
+	if plus != 0 {
+		if err = m.fillAttrs((*entries)[n:]); err != nil {
+			return "", errno(err)
+		}
+	}
+	if len(names) < limit {
+		return "", 0
+	}
+	return names[len(names)-1][len(prefix):], 0
+}
+
+// fillAttrs reads the attributes of entries in batches.
+func (m *kvMeta) fillAttrs(entries []*Entry) (err error) {
+	fillAttr := func(es []*Entry) error {
+		var keys = make([][]byte, len(es))
+		for i, e := range es {
+			keys[i] = m.inodeKey(e.Inode)
+		}
+		var rs [][]byte
+		err := m.client.txn(func(tx kvTxn) error {
+			rs = tx.gets(keys...)
 			return nil
+		})
+		if err != nil {
+			return err
 		}
-		batchSize := 4096
-		nEntries := len(*entries)
-		if nEntries <= batchSize {
-			err = fillAttr(*entries)
-		} else {
-			indexCh := make(chan []*Entry, 10)
-			var wg sync.WaitGroup
-			for i := 0; i < 2; i++ {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for es := range indexCh {
-						if e := fillAttr(es); e != nil {
-							err = e
-							break
-						}
-					}
-				}()
+		for j, re := range rs {
+			if re != nil {
+				m.parseAttr(re, es[j].Attr)
 			}
-			for i := 0; i < nEntries; i += batchSize {
-				if i+batchSize > nEntries {
-					indexCh <- (*entries)[i:]
-				} else {
-					indexCh <- (*entries)[i : i+batchSize]
+		}
+		return nil
+	}
+	batchSize := 4096
+	nEntries := len(entries)
+	if nEntries <= batchSize {
+		return fillAttr(entries)
+	}
+	indexCh := make(chan []*Entry, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for es := range indexCh {
+				if e := fillAttr(es); e != nil {
+					err = e
+					break
 				}
 			}
-			close(indexCh)
-			wg.Wait()
-		}
-		if err != nil {
-			return errno(err)
+		}()
+	}
+	for i := 0; i < nEntries; i += batchSize {
+		if i+batchSize > nEntries {
+			indexCh <- entries[i:]
+		} else {
+			indexCh <- entries[i : i+batchSize]
 		}
 	}
-	return 0
+	close(indexCh)
+	wg.Wait()
+	return err
 }
 
 func (m *kvMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
@@ -1512,25 +1816,33 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 		*chunks = cs
 		return 0
 	}
-	defer timeit(time.Now())
+	defer m.timeit("read", inode, time.Now())
+	ss, st := m.doRead(ctx, inode, indx)
+	if st != 0 {
+		return st
+	}
+	*chunks = buildSlice(ss)
+	m.of.CacheChunk(inode, indx, *chunks)
+	if m.needCompact(inode, ss, *chunks) {
+		go m.compactChunk(inode, indx, false, false)
+	}
+	return 0
+}
+
+func (m *kvMeta) doRead(ctx Context, inode Ino, indx uint32) ([]*slice, syscall.Errno) {
 	val, err := m.get(m.chunkKey(inode, indx))
 	if err != nil {
-		return errno(err)
+		return nil, errno(err)
 	}
 	ss := readSliceBuf(val)
 	if ss == nil {
-		return syscall.EIO
-	}
-	*chunks = buildSlice(ss)
-	m.of.CacheChunk(inode, indx, *chunks)
-	if !m.conf.ReadOnly && (len(val)/sliceBytes >= 5 || len(*chunks) >= 5) {
-		go m.compactChunk(inode, indx, false)
+		return nil, syscall.EIO
 	}
-	return 0
+	return ss, 0
 }
 
 func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("write", inode, time.Now())
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1546,7 +1858,7 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &attr)
-		if attr.Typ != TypeFile {
+		if attr.Typ != TypeFile || attr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
@@ -1569,15 +1881,16 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	})
 	if err == nil {
 		if needCompact {
-			go m.compactChunk(inode, indx, false)
+			go m.compactChunk(inode, indx, false, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.journalWrite(ctx, inode, uint64(indx)*ChunkSize+uint64(off), uint64(slice.Len))
 	}
 	return errno(err)
 }
 
 func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("copyfilerange", fin, time.Now())
 	var newSpace int64
 	f := m.of.find(fout)
 	if f != nil {
@@ -1607,6 +1920,9 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagImmutable != 0 || attr.Flags&FlagAppend != 0 && offOut < attr.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
 		if newleng > attr.Length {
@@ -1680,6 +1996,7 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.journalWrite(ctx, fout, offOut, *copied)
 	}
 	return errno(err)
 }
@@ -1772,14 +2089,17 @@ func (m *kvMeta) doDeleteFileData(inode Ino, length uint64) {
 	_ = m.deleteKeys(m.delfileKey(inode, length))
 }
 
-func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
+func (m *kvMeta) compactChunk(inode Ino, indx uint32, whole, force bool) syscall.Errno {
 	if !force {
+		if m.BackgroundPaused() {
+			return 0
+		}
 		// avoid too many or duplicated compaction
 		m.Lock()
 		k := uint64(inode) + (uint64(indx) << 32)
 		if len(m.compacting) > 10 || m.compacting[k] {
 			m.Unlock()
-			return
+			return 0
 		}
 		m.compacting[k] = true
 		m.Unlock()
@@ -1792,21 +2112,27 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 
 	buf, err := m.get(m.chunkKey(inode, indx))
 	if err != nil {
-		return
+		return errno(err)
 	}
 
 	ss := readSliceBuf(buf)
-	skipped := skipSome(ss)
+	var skipped int
+	if !whole {
+		skipped = skipSome(ss)
+	}
 	ss = ss[skipped:]
 	pos, size, chunks := compactChunk(ss)
+	if size == 0 && skipped == 0 && len(ss) > 0 {
+		return m.releaseHoles(inode, indx, buf, ss)
+	}
 	if len(ss) < 2 || size == 0 {
-		return
+		return 0
 	}
 
 	var chunkid uint64
 	st := m.NewChunk(Background, &chunkid)
 	if st != 0 {
-		return
+		return st
 	}
 	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
 	err = m.newMsg(CompactChunk, chunks, chunkid)
@@ -1814,7 +2140,7 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
 			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
 		}
-		return
+		return syscall.EIO
 	}
 	err = m.txn(func(tx kvTxn) error {
 		buf2 := tx.get(m.chunkKey(inode, indx))
@@ -1861,11 +2187,43 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	} else {
 		logger.Warnf("compact %d %d: %s", inode, indx, err)
 	}
+	if whole {
+		return errno(err)
+	}
 	go func() {
 		// wait for the current compaction to finish
 		time.Sleep(time.Millisecond * 10)
-		m.compactChunk(inode, indx, force)
+		m.compactChunk(inode, indx, false, force)
 	}()
+	return errno(err)
+}
+
+// releaseHoles deletes a chunk without any data (all punched as holes) if it's not changed,
+// and releases its slices.
+func (m *kvMeta) releaseHoles(inode Ino, indx uint32, buf []byte, ss []*slice) syscall.Errno {
+	var todel []*slice
+	err := m.txn(func(tx kvTxn) error {
+		todel = nil
+		if !bytes.Equal(tx.get(m.chunkKey(inode, indx)), buf) {
+			return syscall.EINVAL
+		}
+		tx.dels(m.chunkKey(inode, indx))
+		for _, s := range ss {
+			if s.chunkid > 0 && tx.incrBy(m.sliceKey(s.chunkid, s.size), -1) < 0 {
+				todel = append(todel, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errno(err)
+	}
+	logger.Debugf("release %d slices in the holes of %d:%d", len(ss), inode, indx)
+	m.of.InvalidateChunk(inode, indx)
+	for _, s := range todel {
+		m.deleteSlice(s.chunkid, s.size)
+	}
+	return 0
 }
 
 func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
@@ -1885,7 +2243,7 @@ func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 		inode := r.decodeInode(key[:8])
 		indx := binary.BigEndian.Uint32(key[9:])
 		logger.Debugf("compact chunk %d:%d (%d slices)", inode, indx, len(value)/sliceBytes)
-		r.compactChunk(inode, indx, true)
+		r.compactChunk(inode, indx, false, true)
 		bar.Increment()
 	}
 	return 0
@@ -1919,8 +2277,8 @@ func (m *kvMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, sh
 	return 0
 }
 
-func (m *kvMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+func (m *kvMeta) doGetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno {
+	defer m.timeit("getxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	buf, err := m.get(m.xattrKey(inode, name))
 	if err != nil {
@@ -1934,7 +2292,7 @@ func (m *kvMeta) GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) sy
 }
 
 func (m *kvMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno {
-	defer timeit(time.Now())
+	defer m.timeit("listxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	keys, err := m.scanKeys(m.xattrKey(inode, ""))
 	if err != nil {
@@ -1949,11 +2307,11 @@ func (m *kvMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno
 	return 0
 }
 
-func (m *kvMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+func (m *kvMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("setxattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	key := m.xattrKey(inode, name)
 	err := m.txn(func(tx kvTxn) error {
@@ -1975,11 +2333,24 @@ func (m *kvMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, fla
 	return errno(err)
 }
 
-func (m *kvMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+func (m *kvMeta) doCompareAndSwapXattr(ctx Context, inode Ino, name string, expected, value []byte) syscall.Errno {
+	defer m.timeit("setxattr", inode, time.Now())
+	inode = m.checkRoot(inode)
+	key := m.xattrKey(inode, name)
+	return errno(m.txn(func(tx kvTxn) error {
+		if !bytes.Equal(tx.get(key), expected) {
+			return syscall.ECANCELED
+		}
+		tx.set(key, value)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
 	if name == "" {
 		return syscall.EINVAL
 	}
-	defer timeit(time.Now())
+	defer m.timeit("removexattr", inode, time.Now())
 	inode = m.checkRoot(inode)
 	value, err := m.get(m.xattrKey(inode, name))
 	if err != nil {
@@ -2085,7 +2456,7 @@ func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 		entry.Name = name[10:]
 		if typ == TypeDirectory {
 			err = m.dumpDir(inode, entry, bw, depth+2, showProgress)
-		} else {
+		} else if err = m.dumpSliceData(entry); err == nil {
 			err = entry.writeJSON(bw, depth+2)
 		}
 		if err != nil {
@@ -2289,6 +2660,9 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 					m.Lock()
 					refs[string(m.sliceKey(s.Chunkid, s.Size))]++
 					m.Unlock()
+					if s.Data != nil {
+						tx.set(m.inlineSliceKey(s.Chunkid), s.Data)
+					}
 					if cs.NextChunk <= int64(s.Chunkid) {
 						cs.NextChunk = int64(s.Chunkid) + 1
 					}
@@ -2326,7 +2700,8 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 	})
 }
 
-func (m *kvMeta) LoadMeta(r io.Reader) error {
+// prepareLoad checks that the database is empty.
+func (m *kvMeta) prepareLoad() error {
 	var exist bool
 	err := m.txn(func(tx kvTxn) error {
 		exist = tx.exist(m.fmtKey())
@@ -2338,6 +2713,14 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 	if exist {
 		return fmt.Errorf("Database %s is not empty", m.Name())
 	}
+	return nil
+}
+
+func (m *kvMeta) LoadMeta(r io.Reader) error {
+	err := m.prepareLoad()
+	if err != nil {
+		return err
+	}
 
 	dec := json.NewDecoder(r)
 	dm := &DumpedMeta{}
@@ -2432,3 +2815,42 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		return nil
 	})
 }
+
+func (m *kvMeta) cleanEntry(inode Ino, versions ...*DumpedEntry) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.dels(tx.scanKeys(m.fmtKey("A", inode))...)
+		return nil
+	})
+}
+
+func (m *kvMeta) writeEntry(e *DumpedEntry) error {
+	return m.loadEntry(e, &DumpedCounters{}, make(map[string]int64))
+}
+
+func (m *kvMeta) writeState(dm *DumpedMeta, cs *DumpedCounters, refs map[sliceID]int) error {
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
+		return err
+	}
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.fmtKey("setting"), format)
+		tx.set(m.counterKey(usedSpace), packCounter(cs.UsedSpace))
+		tx.set(m.counterKey(totalInodes), packCounter(cs.UsedInodes))
+		tx.set(m.counterKey("nextInode"), packCounter(cs.NextInode))
+		tx.set(m.counterKey("nextChunk"), packCounter(cs.NextChunk))
+		tx.set(m.counterKey("nextSession"), packCounter(cs.NextSession))
+		tx.set(m.counterKey("nextTrash"), packCounter(cs.NextTrash))
+		tx.dels(tx.scanKeys(m.fmtKey("D"))...)
+		for _, d := range dm.DelFiles {
+			tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
+		}
+		for id, n := range refs {
+			if k := m.sliceKey(id.Chunkid, id.Size); n > 1 {
+				tx.set(k, packCounter(int64(n-1)))
+			} else {
+				tx.dels(k)
+			}
+		}
+		return nil
+	})
+}
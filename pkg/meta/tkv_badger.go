@@ -95,6 +95,32 @@ func (tx *badgerTxn) scanRange(begin, end []byte) map[string][]byte {
 	return ret
 }
 
+func (tx *badgerTxn) scanRangeN(begin, end []byte, limit int) map[string][]byte {
+	if limit == 0 {
+		return nil
+	}
+
+	it := tx.t.NewIterator(badger.IteratorOptions{
+		PrefetchValues: true,
+		PrefetchSize:   1024,
+	})
+	defer it.Close()
+	var ret = make(map[string][]byte)
+	for it.Seek(begin); it.Valid() && len(ret) != limit; it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			panic(err)
+		}
+		ret[string(key)] = value
+	}
+	return ret
+}
+
 func (tx *badgerTxn) scanKeys(prefix []byte) [][]byte {
 	it := tx.t.NewIterator(badger.IteratorOptions{
 		PrefetchValues: false,
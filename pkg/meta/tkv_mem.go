@@ -98,6 +98,27 @@ func (tx *memTxn) scanRange(begin_, end_ []byte) map[string][]byte {
 	return ret
 }
 
+func (tx *memTxn) scanRangeN(begin_, end_ []byte, limit int) map[string][]byte {
+	tx.store.Lock()
+	defer tx.store.Unlock()
+	begin := string(begin_)
+	end := string(end_)
+	ret := make(map[string][]byte)
+	if limit == 0 {
+		return ret
+	}
+	tx.store.items.AscendGreaterOrEqual(&kvItem{key: begin}, func(i btree.Item) bool {
+		it := i.(*kvItem)
+		if end == "" || it.key < end {
+			tx.observed[it.key] = it.ver
+			ret[it.key] = it.value
+			return len(ret) != limit
+		}
+		return false
+	})
+	return ret
+}
+
 func (tx *memTxn) scan(prefix []byte, handler func(key []byte, value []byte)) {
 	tx.store.Lock()
 	defer tx.store.Unlock()
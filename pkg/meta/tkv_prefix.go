@@ -50,6 +50,14 @@ func (tx *prefixTxn) scanRange(begin_, end_ []byte) map[string][]byte {
 	}
 	return m
 }
+func (tx *prefixTxn) scanRangeN(begin_, end_ []byte, limit int) map[string][]byte {
+	r := tx.kvTxn.scanRangeN(tx.realKey(begin_), tx.realKey(end_), limit)
+	m := make(map[string][]byte, len(r))
+	for k, v := range r {
+		m[k[len(tx.prefix):]] = v
+	}
+	return m
+}
 func (tx *prefixTxn) scan(prefix []byte, handler func(key, value []byte)) {
 	tx.kvTxn.scan(tx.realKey(prefix), func(key, value []byte) {
 		key = tx.origKey(key)
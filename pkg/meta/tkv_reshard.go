@@ -0,0 +1,268 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+// HotRange is a range of keys of the meta engine with high load, served by one region of the KV.
+type HotRange struct {
+	Region uint64  `json:"region"`
+	Start  string  `json:"start"` // the first key (quoted) in the volume
+	End    string  `json:"end"`   // the end key (quoted, exclusive) in the volume, empty means the end of it
+	Reads  float64 `json:"reads"` // bytes per second
+	Writes float64 `json:"writes"`
+	Keys   int     `json:"keys"`            // number of keys in the range
+	Owner  string  `json:"owner"`           // what most of the keys are for, e.g. "entries of directory"
+	Inode  Ino     `json:"inode,omitempty"` // the inode the keys belong to, if any
+	Share  float64 `json:"share"`           // the ratio of keys for the owner
+	Splits int     `json:"splits"`          // number of the regions split from it
+	Error  string  `json:"error,omitempty"` // why it's not split
+}
+
+// ReshardOption controls how the hot ranges are found and split.
+type ReshardOption struct {
+	Top     int     // max number of hot ranges, 0 means no limit
+	Ratio   float64 // a region is hot if its load is at least this times of the average
+	Split   int     // split every hot range into this many regions, less than 2 means reporting only
+	Scatter bool    // scatter the new regions into different nodes
+}
+
+// Resharder is implemented by the meta engines on a KV distributing the keys into regions (e.g. TiKV),
+// which can find the regions with high load and split them.
+type Resharder interface {
+	Reshard(ctx Context, opt *ReshardOption) ([]*HotRange, error)
+}
+
+// kvRegion is a range of keys served together by the KV, with the load of it in bytes per second.
+type kvRegion struct {
+	id            uint64
+	start, end    []byte // the end is exclusive, empty means the end of keyspace
+	reads, writes float64
+}
+
+func (r *kvRegion) load() float64 {
+	return r.reads + r.writes
+}
+
+// regionClient is implemented by the tkvClient distributing the keys into regions.
+type regionClient interface {
+	// regions returns all the regions overlapped with [start, end) and their load.
+	regions(start, end []byte) ([]*kvRegion, error)
+	// splitRegions splits the regions at keys, returns the number of new regions.
+	splitRegions(keys [][]byte, scatter bool) (int, error)
+}
+
+const (
+	reshardPage   = 10000 // keys scanned in a transaction
+	reshardSample = 10000 // max keys sampled from a range
+)
+
+// regionClient returns the client with regions and the prefix of keys of the volume.
+func (m *kvMeta) regionClient() (regionClient, []byte) {
+	c, prefix := m.client, []byte(nil)
+	if pc, ok := c.(*prefixClient); ok {
+		c, prefix = pc.tkvClient, pc.prefix
+	}
+	rc, _ := c.(regionClient)
+	return rc, prefix
+}
+
+func (m *kvMeta) Reshard(ctx Context, opt *ReshardOption) ([]*HotRange, error) {
+	rc, prefix := m.regionClient()
+	if rc == nil {
+		return nil, fmt.Errorf("%s doesn't distribute the keys into regions", m.Name())
+	}
+	regions, err := rc.regions(prefix, nextKey(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("list regions: %s", err)
+	}
+	if len(regions) == 0 {
+		return nil, nil
+	}
+	var total float64
+	for _, r := range regions {
+		total += r.load()
+	}
+	avg := total / float64(len(regions))
+	var hot []*kvRegion
+	for _, r := range regions {
+		if r.load() > 0 && r.load() >= opt.Ratio*avg {
+			hot = append(hot, r)
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].load() > hot[j].load() })
+	if opt.Top > 0 && len(hot) > opt.Top {
+		hot = hot[:opt.Top]
+	}
+
+	var ranges []*HotRange
+	for _, r := range hot {
+		if ctx.Canceled() {
+			return ranges, syscall.EINTR
+		}
+		begin, end := m.clipRegion(r, prefix)
+		hr := &HotRange{Region: r.id, Start: fmt.Sprintf("%q", begin), Reads: r.reads, Writes: r.writes}
+		if end[0] != 0xFF {
+			hr.End = fmt.Sprintf("%q", end)
+		}
+		sample, err := m.sampleKeys(begin, end, hr)
+		if err != nil {
+			return ranges, fmt.Errorf("scan region %d: %s", r.id, err)
+		}
+		m.describeKeys(sample, hr)
+		logger.Infof("Hot region %d: read %.0f B/s, write %.0f B/s, %d keys, %s", r.id, r.reads, r.writes, hr.Keys, hr.Owner)
+		if opt.Split > 1 {
+			if len(sample) < opt.Split {
+				hr.Error = fmt.Sprintf("too few keys to split into %d regions", opt.Split)
+			} else {
+				keys := make([][]byte, 0, opt.Split-1)
+				for i := 1; i < opt.Split; i++ {
+					keys = append(keys, append(append([]byte{}, prefix...), sample[len(sample)*i/opt.Split]...))
+				}
+				if hr.Splits, err = rc.splitRegions(keys, opt.Scatter); err != nil {
+					hr.Error = err.Error()
+					logger.Warnf("Split region %d: %s", r.id, err)
+				} else {
+					logger.Infof("Split region %d into %d regions", r.id, hr.Splits+1)
+				}
+			}
+		}
+		ranges = append(ranges, hr)
+	}
+	return ranges, nil
+}
+
+// clipRegion returns the range of region r within the volume, without the prefix. The end of the
+// volume is represented by 0xFF, since all the keys start with a letter.
+func (m *kvMeta) clipRegion(r *kvRegion, prefix []byte) (begin, end []byte) {
+	begin, end = []byte{}, []byte{0xFF}
+	if bytes.Compare(r.start, prefix) > 0 {
+		begin = r.start[len(prefix):]
+	}
+	if len(r.end) > 0 && bytes.HasPrefix(r.end, prefix) && len(r.end) > len(prefix) {
+		end = r.end[len(prefix):]
+	}
+	return
+}
+
+// sampleKeys counts the keys in [begin, end) into hr, and returns at most reshardSample of them
+// evenly distributed in order.
+func (m *kvMeta) sampleKeys(begin, end []byte, hr *HotRange) ([][]byte, error) {
+	var sample [][]byte
+	step := 1
+	for {
+		var keys []string
+		err := m.client.txn(func(tx kvTxn) error {
+			keys = keys[:0]
+			for k := range tx.scanRangeN(begin, end, reshardPage) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if hr.Keys%step == 0 {
+				sample = append(sample, []byte(k))
+			}
+			hr.Keys++
+			if len(sample) > reshardSample {
+				// keep every other one
+				n := 0
+				for i := 0; i < len(sample); i += 2 {
+					sample[n] = sample[i]
+					n++
+				}
+				sample = sample[:n]
+				step *= 2
+			}
+		}
+		if len(keys) < reshardPage {
+			return sample, nil
+		}
+		begin = append([]byte(keys[len(keys)-1]), 0)
+	}
+}
+
+// describeKeys finds out what most of the keys are for.
+func (m *kvMeta) describeKeys(keys [][]byte, hr *HotRange) {
+	type owner struct {
+		typ   byte
+		inode Ino
+	}
+	counts := make(map[owner]int)
+	for _, k := range keys {
+		var o owner
+		if len(k) >= 10 && k[0] == 'A' {
+			o.typ = k[9]
+			if o.typ == 'D' || o.typ == 'C' || o.typ == 'X' {
+				o.inode = m.decodeInode(k[1:9])
+			}
+		} else if len(k) > 0 {
+			o.typ = k[0] | 0x80 // not in an inode
+		}
+		counts[o]++
+	}
+	var best owner
+	var max int
+	for o, c := range counts {
+		if c > max || c == max && (o.typ < best.typ || o.typ == best.typ && o.inode < best.inode) {
+			best, max = o, c
+		}
+	}
+	if max == 0 {
+		hr.Owner = "no keys"
+		return
+	}
+	hr.Inode = best.inode
+	hr.Share = float64(max) / float64(len(keys))
+	switch best.typ {
+	case 'D':
+		hr.Owner = "entries of directory"
+	case 'C':
+		hr.Owner = "chunks of file"
+	case 'X':
+		hr.Owner = "extended attributes of inode"
+	case 'I':
+		hr.Owner = "attributes of inodes"
+	case 'S':
+		hr.Owner = "targets of symlinks"
+	case 'C' | 0x80:
+		hr.Owner = "counters"
+	case 'D' | 0x80:
+		hr.Owner = "deleted files"
+	case 'F' | 0x80, 'P' | 0x80:
+		hr.Owner = "locks"
+	case 'K' | 0x80:
+		hr.Owner = "references of slices"
+	case 'I' | 0x80:
+		hr.Owner = "inline data of slices"
+	case 'J' | 0x80:
+		hr.Owner = "change journal"
+	case 'S' | 0x80:
+		hr.Owner = "sessions"
+	default:
+		hr.Owner = "other keys"
+	}
+}
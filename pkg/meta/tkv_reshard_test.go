@@ -0,0 +1,160 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// mockRegionKV serves the keys in the regions with the load set by tests.
+type mockRegionKV struct {
+	tkvClient
+	all    []*kvRegion
+	splits [][]byte
+}
+
+func (c *mockRegionKV) regions(start, end []byte) ([]*kvRegion, error) {
+	return c.all, nil
+}
+
+func (c *mockRegionKV) splitRegions(keys [][]byte, scatter bool) (int, error) {
+	c.splits = append(c.splits, keys...)
+	return len(keys), nil
+}
+
+func TestReshard(t *testing.T) {
+	m, err := newKVMeta("memkv", "", &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if _, err = m.(Resharder).Reshard(Background, &ReshardOption{Ratio: 2}); err == nil {
+		t.Fatalf("reshard should fail without regions")
+	}
+	km := m.(*kvMeta)
+	mock := &mockRegionKV{tkvClient: km.client}
+	prefix := []byte("vol\xFD")
+	km.client = withPrefix(mock, prefix)
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	var hot, cold, inode Ino
+	var attr Attr
+	if st := m.Mkdir(Background, 1, "cold", 0755, 022, 0, &cold, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	if st := m.Mkdir(Background, 1, "hot", 0755, 022, 0, &hot, &attr); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	for i := 0; i < 100; i++ {
+		if st := m.Create(Background, hot, fmt.Sprintf("f%03d", i), 0644, 022, 0, &inode, &attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if st := m.Create(Background, cold, fmt.Sprintf("f%d", i), 0644, 022, 0, &inode, &attr); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+	}
+
+	// the entries of the hot directory are in region 2
+	key := func(k []byte) []byte { return append(append([]byte{}, prefix...), k...) }
+	hotStart, hotEnd := key(km.fmtKey("A", hot, "D")), key(nextKey(km.fmtKey("A", hot, "D")))
+	mock.all = []*kvRegion{
+		{id: 1, end: hotStart, reads: 10, writes: 5},
+		{id: 2, start: hotStart, end: hotEnd, reads: 1000, writes: 500},
+		{id: 3, start: hotEnd, reads: 20},
+	}
+	ranges, err := m.(Resharder).Reshard(Background, &ReshardOption{Ratio: 2})
+	if err != nil {
+		t.Fatalf("reshard: %s", err)
+	}
+	if len(ranges) != 1 {
+		t.Fatalf("expect 1 hot range, got %+v", ranges)
+	}
+	r := ranges[0]
+	if r.Region != 2 || r.Keys != 100 || r.Owner != "entries of directory" || r.Inode != hot || r.Share != 1 || r.Reads != 1000 {
+		t.Fatalf("hot range: %+v", r)
+	}
+	if r.End == "" || r.Splits != 0 || len(mock.splits) != 0 {
+		t.Fatalf("hot range should be reported only: %+v", r)
+	}
+
+	// the cold regions are hot if the ratio is low enough, the hottest first
+	if ranges, err = m.(Resharder).Reshard(Background, &ReshardOption{Ratio: 0.01, Top: 2}); err != nil || len(ranges) != 2 {
+		t.Fatalf("reshard with low ratio: %+v %v", ranges, err)
+	}
+	if ranges[0].Region != 2 || ranges[1].Region != 3 || ranges[1].End != "" {
+		t.Fatalf("hot ranges: %+v %+v", ranges[0], ranges[1])
+	}
+
+	ranges, err = m.(Resharder).Reshard(Background, &ReshardOption{Ratio: 2, Split: 4, Scatter: true})
+	if err != nil || len(ranges) != 1 || ranges[0].Splits != 3 {
+		t.Fatalf("split hot range: %+v %v", ranges, err)
+	}
+	if len(mock.splits) != 3 {
+		t.Fatalf("expect 3 split keys, got %d", len(mock.splits))
+	}
+	last := hotStart
+	for _, k := range mock.splits {
+		if bytes.Compare(k, last) <= 0 || bytes.Compare(k, hotEnd) >= 0 {
+			t.Fatalf("split key %q should be in order within the hot range", k)
+		}
+		last = k
+	}
+	// evenly distributed by the number of entries
+	for i, name := range []string{"f025", "f050", "f075"} {
+		if !bytes.Equal(mock.splits[i], key(km.entryKey(hot, name))) {
+			t.Fatalf("split key %d: %q", i, mock.splits[i])
+		}
+	}
+}
+
+func TestReshardSample(t *testing.T) {
+	m, err := newKVMeta("memkv", "", &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	km := m.(*kvMeta)
+	n := reshardSample*3 + 7
+	if err = km.txn(func(tx kvTxn) error {
+		for i := 0; i < n; i++ {
+			tx.set(km.fmtKey("A", Ino(i+1), "I"), []byte{1})
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("set keys: %s", err)
+	}
+	var hr HotRange
+	sample, err := km.sampleKeys([]byte{}, []byte{0xFF}, &hr)
+	if err != nil {
+		t.Fatalf("sample: %s", err)
+	}
+	if hr.Keys < n || len(sample) > reshardSample || len(sample) < reshardSample/2 {
+		t.Fatalf("sampled %d of %d keys", len(sample), hr.Keys)
+	}
+	for i := 1; i < len(sample); i++ {
+		if bytes.Compare(sample[i-1], sample[i]) >= 0 {
+			t.Fatalf("sample should be in order")
+		}
+	}
+	km.describeKeys(sample, &hr)
+	if hr.Owner != "attributes of inodes" || hr.Inode != 0 {
+		t.Fatalf("owner: %s %d", hr.Owner, hr.Inode)
+	}
+}
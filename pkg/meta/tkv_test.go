@@ -19,8 +19,14 @@ package meta
 
 import (
 	"bytes"
+	"errors"
 	"os"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMemKVClient(t *testing.T) {
@@ -41,7 +47,7 @@ func TestTiKVClient(t *testing.T) {
 }
 
 func TestBadgerClient(t *testing.T) {
-	m, err := newKVMeta("badger", "badger", &Config{MaxDeletes: 1})
+	m, err := newKVMeta("badger", t.TempDir(), &Config{MaxDeletes: 1})
 	if err != nil || m.Name() != "badger" {
 		t.Fatalf("create meta: %s", err)
 	}
@@ -157,7 +163,7 @@ func testTKV(t *testing.T, c tkvClient) {
 }
 
 func TestBadgerKV(t *testing.T) {
-	c, err := newBadgerClient("test_badger")
+	c, err := newBadgerClient(t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -169,3 +175,161 @@ func TestMemKV(t *testing.T) {
 	c = withPrefix(c, []byte("jfs"))
 	testTKV(t, c)
 }
+
+// conflictKV fails the first conflicts transactions as conflicted ones.
+type conflictKV struct {
+	tkvClient
+	conflicts int
+}
+
+func (c *conflictKV) txn(f func(kvTxn) error) error {
+	if c.conflicts > 0 {
+		c.conflicts--
+		return errors.New("write conflict: injected")
+	}
+	return c.tkvClient.txn(f)
+}
+
+func TestTxnConflicts(t *testing.T) {
+	m, err := newKVMeta("memkv", "jfs-txn-test", &Config{TxnRetries: 3})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Create(Background, 1, "f", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	km := m.(*kvMeta)
+	client := &conflictKV{tkvClient: km.client}
+	km.client = client
+
+	restarts := testutil.ToFloat64(txRestartByOp.WithLabelValues("Write"))
+	failures := testutil.ToFloat64(txConflictFailures)
+	// the last restart succeeds
+	client.conflicts = 3
+	if st := m.Write(Background, inode, 0, 0, Slice{Chunkid: 1, Size: 1024, Len: 1024}); st != 0 {
+		t.Fatalf("write with %d conflicts: %s", 3, st)
+	}
+	if n := testutil.ToFloat64(txRestartByOp.WithLabelValues("Write")) - restarts; n != 3 {
+		t.Fatalf("expect 3 restarts of Write, but got %v", n)
+	}
+
+	// still conflicted after 3 restarts
+	client.conflicts = 4
+	if st := m.Write(Background, inode, 0, 1024, Slice{Chunkid: 2, Size: 1024, Len: 1024}); st != syscall.EAGAIN {
+		t.Fatalf("write with %d conflicts: expect EAGAIN, but got %s", 4, st)
+	}
+	if n := testutil.ToFloat64(txRestartByOp.WithLabelValues("Write")) - restarts; n != 6 {
+		t.Fatalf("expect 6 restarts of Write, but got %v", n)
+	}
+	if n := testutil.ToFloat64(txConflictFailures) - failures; n != 1 {
+		t.Fatalf("expect 1 failure, but got %v", n)
+	}
+	if client.conflicts != 0 {
+		t.Fatalf("expect no more tries after giving up, but %d conflicts left", client.conflicts)
+	}
+	if st := m.GetAttr(Background, inode, &attr); st != 0 || attr.Length != 1024 {
+		t.Fatalf("expect length 1024 after the failed write, but got %d: %s", attr.Length, st)
+	}
+}
+
+// slowKV holds every transaction open for a while, so the concurrent ones overlap.
+type slowKV struct {
+	tkvClient
+}
+
+func (c *slowKV) txn(f func(kvTxn) error) error {
+	return c.tkvClient.txn(func(tx kvTxn) error {
+		err := f(tx)
+		time.Sleep(time.Millisecond * 5)
+		return err
+	})
+}
+
+func TestTxnConflictsConcurrent(t *testing.T) {
+	const retries, writers = 2, 10
+	m, err := newKVMeta("memkv", "jfs-txn-concurrent", &Config{TxnRetries: retries})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	var inode Ino
+	var attr Attr
+	// not opened, so the writes are not serialized by the client, as the ones from many clients
+	if st := m.Mknod(Background, 1, "f", TypeFile, 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mknod: %s", st)
+	}
+	km := m.(*kvMeta)
+	km.client = &slowKV{km.client}
+
+	restarts := testutil.ToFloat64(txRestartByOp.WithLabelValues("Write"))
+	failures := testutil.ToFloat64(txConflictFailures)
+	// all the writers append to the same chunk, which are conflicted with each other
+	results := make([]syscall.Errno, writers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results[i] = m.Write(Background, inode, 0, uint32(i)*1024, Slice{Chunkid: uint64(i) + 1, Size: 1024, Len: 1024})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var failed int
+	var length uint64
+	for i, st := range results {
+		switch st {
+		case 0:
+			length = uint64(i+1) * 1024
+		case syscall.EAGAIN:
+			failed++
+		default:
+			t.Fatalf("writer %d: expect OK or EAGAIN, but got %s", i, st)
+		}
+	}
+	if failed == 0 {
+		t.Fatalf("expect some of the %d writers to give up after %d restarts", writers, retries)
+	}
+	if n := testutil.ToFloat64(txConflictFailures) - failures; n != float64(failed) {
+		t.Fatalf("expect %d failures, but got %v", failed, n)
+	}
+	// every failed writer was restarted exactly retries times, others no more than that
+	if n := testutil.ToFloat64(txRestartByOp.WithLabelValues("Write")) - restarts; n < float64(failed*retries) || n > float64(writers*retries) {
+		t.Fatalf("expect %d to %d restarts of Write, but got %v", failed*retries, writers*retries, n)
+	}
+
+	// only the succeeded writes are visible
+	if st := m.GetAttr(Background, inode, &attr); st != 0 || attr.Length != length {
+		t.Fatalf("expect length %d, but got %d: %s", length, attr.Length, st)
+	}
+	var slices []Slice
+	if st := m.Read(Background, inode, 0, &slices); st != 0 {
+		t.Fatalf("read: %s", st)
+	}
+	var pos uint32
+	for _, s := range slices {
+		for off := pos; off < pos+s.Len; off += 1024 {
+			var expect uint64 // a hole
+			if i := off / 1024; results[i] == 0 {
+				expect = uint64(i) + 1
+			}
+			if s.Chunkid != expect {
+				t.Fatalf("expect slice %d at %d, but got %d", expect, off, s.Chunkid)
+			}
+		}
+		pos += s.Len
+	}
+	if pos != uint32(length) {
+		t.Fatalf("expect %d bytes in slices, but got %d", length, pos)
+	}
+}
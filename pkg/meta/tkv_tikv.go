@@ -21,7 +21,11 @@ package meta
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	plog "github.com/pingcap/log"
 	"github.com/pkg/errors"
@@ -64,7 +68,7 @@ func newTikvClient(addr string) (tkvClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return withPrefix(&tikvClient{client}, append([]byte(prefix), 0xFD)), nil
+	return withPrefix(&tikvClient{client, pds}, append([]byte(prefix), 0xFD)), nil
 }
 
 type tikvTxn struct {
@@ -127,6 +131,10 @@ func (tx *tikvTxn) scanRange(begin, end []byte) map[string][]byte {
 	return tx.scanRange0(begin, end, -1, nil)
 }
 
+func (tx *tikvTxn) scanRangeN(begin, end []byte, limit int) map[string][]byte {
+	return tx.scanRange0(begin, end, limit, nil)
+}
+
 func (tx *tikvTxn) scan(prefix []byte, handler func(key, value []byte)) {
 	it, err := tx.Iter(prefix, nil) //nolint:typecheck
 	if err != nil {
@@ -205,6 +213,7 @@ func (tx *tikvTxn) dels(keys ...[]byte) {
 
 type tikvClient struct {
 	client *tikv.KVStore
+	pds    []string
 }
 
 func (c *tikvClient) name() string {
@@ -249,3 +258,81 @@ func (c *tikvClient) reset(prefix []byte) error {
 func (c *tikvClient) close() error {
 	return c.client.Close()
 }
+
+func (c *tikvClient) regions(start, end []byte) ([]*kvRegion, error) {
+	ctx := context.Background()
+	var rs []*kvRegion
+	for {
+		regions, err := c.client.GetPDClient().ScanRegions(ctx, start, end, 1024)
+		if err != nil {
+			return nil, err
+		}
+		if len(regions) == 0 {
+			break
+		}
+		for _, r := range regions {
+			rs = append(rs, &kvRegion{id: r.Meta.Id, start: r.Meta.StartKey, end: r.Meta.EndKey})
+		}
+		start = regions[len(regions)-1].Meta.EndKey
+		if len(start) == 0 || len(end) > 0 && string(start) >= string(end) {
+			break
+		}
+	}
+	reads, err := c.hotRegions("read")
+	if err != nil {
+		return nil, err
+	}
+	writes, err := c.hotRegions("write")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		r.reads, r.writes = reads[r.id], writes[r.id]
+	}
+	return rs, nil
+}
+
+// hotRegions returns the flow in bytes per second of the hot regions (as leader) from the HTTP API of PD.
+func (c *tikvClient) hotRegions(kind string) (map[uint64]float64, error) {
+	var stats struct {
+		AsLeader map[string]struct {
+			Stats []struct {
+				RegionID uint64  `json:"region_id"`
+				Bytes    float64 `json:"flow_bytes"`
+			} `json:"statistics"`
+		} `json:"as_leader"`
+	}
+	client := &http.Client{Timeout: time.Second * 10}
+	var err error
+	for _, pd := range c.pds {
+		var resp *http.Response
+		resp, err = client.Get(fmt.Sprintf("http://%s/pd/api/v1/hotspot/regions/%s", pd, kind))
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("hot regions from %s: %s", pd, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&stats)
+		}
+		_ = resp.Body.Close()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	flows := make(map[uint64]float64)
+	for _, store := range stats.AsLeader {
+		for _, s := range store.Stats {
+			flows[s.RegionID] += s.Bytes
+		}
+	}
+	return flows, nil
+}
+
+func (c *tikvClient) splitRegions(keys [][]byte, scatter bool) (int, error) {
+	ids, err := c.client.SplitRegions(context.Background(), keys, scatter, nil)
+	return len(ids), err
+}
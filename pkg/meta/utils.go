@@ -23,19 +23,24 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 const (
-	usedSpace    = "usedSpace"
-	totalInodes  = "totalInodes"
-	delfiles     = "delfiles"
-	allSessions  = "sessions"
-	sessionInfos = "sessionInfos"
-	sliceRefs    = "sliceRef"
+	usedSpace     = "usedSpace"
+	totalInodes   = "totalInodes"
+	delfiles      = "delfiles"
+	allSessions   = "sessions"
+	sessionInfos  = "sessionInfos"
+	sliceRefs     = "sliceRef"
+	sliceSums     = "sliceSums"
+	inlineSlices  = "inlineSlices"
+	changeJournal = "journal"
 )
 
 const (
@@ -268,11 +273,412 @@ func Remove(r Meta, ctx Context, parent Ino, name string) syscall.Errno {
 	return emptyEntry(r, ctx, parent, name, inode, concurrent)
 }
 
+// Pace limits the rate of a recursive removal.
+type Pace struct {
+	Rate  float64 // entries removed per second, 0 means no limit
+	Batch int     // entries removed before waiting for the rate
+}
+
+type pacer struct {
+	Pace
+	start   time.Time
+	removed *uint64
+}
+
+// done counts a removed entry, and waits after every batch until the rate is met.
+func (p *pacer) done(ctx Context) syscall.Errno {
+	n := atomic.AddUint64(p.removed, 1)
+	if p.Rate > 0 && n%uint64(p.Batch) == 0 {
+		due := p.start.Add(time.Duration(float64(n) / p.Rate * float64(time.Second)))
+		for d := time.Until(due); d > 0; d = time.Until(due) {
+			if ctx.Canceled() {
+				return syscall.EINTR
+			}
+			if d > time.Millisecond*100 {
+				d = time.Millisecond * 100
+			}
+			time.Sleep(d)
+		}
+	}
+	if ctx.Canceled() {
+		return syscall.EINTR
+	}
+	return 0
+}
+
+func (p *pacer) removeTree(r Meta, ctx Context, parent Ino, name string, inode Ino) syscall.Errno {
+	if st := r.Access(ctx, inode, 3, nil); st != 0 {
+		return st
+	}
+	var entries []*Entry
+	if st := r.Readdir(ctx, inode, 0, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+			continue
+		}
+		var st syscall.Errno
+		if e.Attr.Typ == TypeDirectory {
+			st = p.removeTree(r, ctx, inode, string(e.Name), e.Inode)
+		} else if st = r.Unlink(ctx, inode, string(e.Name)); st == 0 {
+			st = p.done(ctx)
+		}
+		if st != 0 && st != syscall.ENOENT {
+			return st
+		}
+	}
+	st := r.Rmdir(ctx, parent, name)
+	if st == syscall.ENOTEMPTY { // created during the removal
+		return p.removeTree(r, ctx, parent, name, inode)
+	}
+	if st != 0 {
+		return st
+	}
+	return p.done(ctx)
+}
+
+// RemovePaced removes an entry recursively as Remove, but one entry at a time and no more than
+// pace.Rate entries per second, so a huge tree is removed steadily without starving the other
+// operations of the meta engine and object storage. The entries are moved into the trash if it's
+// enabled, the same as Remove. The number of removed entries is added to removed atomically, to
+// report the progress.
+func RemovePaced(r Meta, ctx Context, parent Ino, name string, pace Pace, removed *uint64) syscall.Errno {
+	if st := r.Access(ctx, parent, 3, nil); st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st := r.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if pace.Batch <= 0 {
+		pace.Batch = 1
+	}
+	p := &pacer{Pace: pace, start: time.Now(), removed: removed}
+	if attr.Typ != TypeDirectory {
+		if st := r.Unlink(ctx, parent, name); st != 0 {
+			return st
+		}
+		return p.done(ctx)
+	}
+	return p.removeTree(r, ctx, parent, name, inode)
+}
+
+// CloneEntry creates a copy of the file or directory tree src as dstName under dstParent. The
+// slices of files are shared (reference counted) instead of copying the data, so nothing is
+// duplicated in object storage until either side is modified. Hard links are not preserved.
+// It's not an atomic snapshot: the tree is walked via the Meta API, so changes made to the
+// source during cloning may or may not be included. The partial copy is removed on failure.
+func CloneEntry(r Meta, ctx Context, src Ino, dstParent Ino, dstName string) syscall.Errno {
+	if src == 1 {
+		return syscall.EINVAL
+	}
+	if st := r.Access(ctx, dstParent, 3, nil); st != 0 {
+		return st
+	}
+	// the destination should not be inside the source
+	var attr Attr
+	for ino := dstParent; ino > 1; ino = attr.Parent {
+		if ino == src {
+			return syscall.EINVAL
+		}
+		if st := r.GetAttr(ctx, ino, &attr); st != 0 {
+			return st
+		}
+	}
+	var inode Ino
+	if st := r.Lookup(ctx, dstParent, dstName, &inode, &attr); st == 0 {
+		return syscall.EEXIST
+	} else if st != syscall.ENOENT {
+		return st
+	}
+	st := cloneNode(r, ctx, src, dstParent, dstName)
+	if st != 0 && st != syscall.EEXIST {
+		if e := Remove(r, ctx, dstParent, dstName); e != 0 && e != syscall.ENOENT {
+			logger.Warnf("remove partial clone %s of inode %d: %s", dstName, src, e)
+		}
+	}
+	return st
+}
+
+func cloneNode(r Meta, ctx Context, src Ino, parent Ino, name string) syscall.Errno {
+	var attr Attr
+	if st := r.GetAttr(ctx, src, &attr); st != 0 {
+		return st
+	}
+	var inode Ino
+	var nattr Attr
+	var st syscall.Errno
+	switch attr.Typ {
+	case TypeDirectory:
+		if st = r.Access(ctx, src, 5, &attr); st != 0 {
+			return st
+		}
+		// keep it writable until all the children are cloned, the mode is restored at the end
+		if st = r.Mkdir(ctx, parent, name, attr.Mode|0700, 0, 0, &inode, &nattr); st != 0 {
+			return st
+		}
+		var entries []*Entry
+		if st = r.Readdir(ctx, src, 0, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Inode == src || len(e.Name) == 2 && string(e.Name) == ".." {
+				continue
+			}
+			if st = cloneNode(r, ctx, e.Inode, inode, string(e.Name)); st != 0 {
+				return st
+			}
+		}
+	case TypeFile:
+		if st = r.Access(ctx, src, 4, &attr); st != 0 {
+			return st
+		}
+		if st = r.Mknod(ctx, parent, name, TypeFile, attr.Mode, 0, 0, &inode, &nattr); st != 0 {
+			return st
+		}
+		var copied uint64
+		if st = r.CopyFileRange(ctx, src, 0, inode, 0, attr.Length, 0, &copied); st != 0 {
+			return st
+		}
+		if copied != attr.Length {
+			logger.Warnf("clone inode %d: copied %d bytes, expected %d", src, copied, attr.Length)
+			return syscall.EIO
+		}
+	case TypeSymlink:
+		var target []byte
+		if st = r.ReadLink(ctx, src, &target); st != 0 {
+			return st
+		}
+		if st = r.Symlink(ctx, parent, name, string(target), &inode, &nattr); st != 0 {
+			return st
+		}
+		return 0 // attributes of symlink can not be changed
+	default:
+		if st = r.Mknod(ctx, parent, name, attr.Typ, attr.Mode, 0, attr.Rdev, &inode, &nattr); st != 0 {
+			return st
+		}
+	}
+	if st = cloneXattrs(r, ctx, src, inode); st != 0 {
+		return st
+	}
+	// keep the timestamps of source, and also owner if allowed
+	set := uint16(SetAttrMode | SetAttrAtime | SetAttrMtime)
+	if ctx.Uid() == 0 {
+		set |= SetAttrUID | SetAttrGID
+	}
+	return r.SetAttr(ctx, inode, set, 0, &attr)
+}
+
+func cloneXattrs(r Meta, ctx Context, src, dst Ino) syscall.Errno {
+	var names []byte
+	if st := r.ListXattr(ctx, src, &names); st != 0 {
+		if st == ENOATTR || st == syscall.ENOTSUP {
+			return 0
+		}
+		return st
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		var value []byte
+		if st := r.GetXattr(ctx, src, string(name), &value); st != 0 {
+			if st == ENOATTR {
+				continue
+			}
+			return st
+		}
+		if st := r.SetXattr(ctx, dst, string(name), value, 0); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
+
+// AttrChange is a change of mode and owner applied to a tree by ApplyAttrChange. The bits in Clear
+// are removed from the mode before the bits in Mode are added, so that relative modes (e.g. g+w)
+// can be applied to every node. Only the fields in Set (SetAttrMode, SetAttrUID, SetAttrGID) are changed.
+type AttrChange struct {
+	Set   uint8
+	Clear uint16
+	Mode  uint16
+	Uid   uint32
+	Gid   uint32
+}
+
+// ApplyAttrChange applies the change to inode, and all the nodes under it if recursive (symlinks are
+// not followed). Every node is changed by a single SetAttr, those already matching are skipped, so
+// it's safe to run it again after interrupted. The walk stops after limit nodes are visited (0 means
+// no limit) or failed, and the path of the last node relative to inode ("/" for itself) is returned;
+// passing it as after continues from the next one. An empty path is returned when all are visited.
+func ApplyAttrChange(r Meta, ctx Context, inode Ino, c *AttrChange, recursive bool, after string, limit int, visited, changed *uint64) (string, syscall.Errno) {
+	w := &attrWalker{r: r, ctx: ctx, c: c, limit: limit, visited: visited, changed: changed}
+	var attr Attr
+	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
+		return "", st
+	}
+	var st syscall.Errno
+	var stop bool
+	if after == "" {
+		if st, stop = w.visit(inode, &attr, nil); st != 0 || stop || !recursive || attr.Typ != TypeDirectory {
+			return w.last(), st
+		}
+		st, _ = w.walk(inode, &attr, nil, nil)
+	} else if !strings.HasPrefix(after, "/") {
+		return "", syscall.EINVAL
+	} else if attr.Typ == TypeDirectory && recursive {
+		var parts []string
+		if after != "/" {
+			parts = strings.Split(after[1:], "/")
+		}
+		st, _ = w.walk(inode, &attr, nil, parts)
+	}
+	return w.last(), st
+}
+
+type attrWalker struct {
+	r       Meta
+	ctx     Context
+	c       *AttrChange
+	limit   int
+	count   int
+	visited *uint64
+	changed *uint64
+	path    []string // of the last visited node, nil if all are visited
+}
+
+func (w *attrWalker) last() string {
+	if w.path == nil {
+		return ""
+	}
+	return "/" + strings.Join(w.path, "/")
+}
+
+// visit changes a node, and returns true if the walk should stop.
+func (w *attrWalker) visit(inode Ino, attr *Attr, path []string) (syscall.Errno, bool) {
+	w.count++
+	*w.visited++
+	var set uint16
+	nattr := *attr
+	if w.c.Set&SetAttrMode != 0 && attr.Typ != TypeSymlink {
+		if mode := attr.Mode&^w.c.Clear | w.c.Mode; mode != attr.Mode {
+			set |= SetAttrMode
+			nattr.Mode = mode
+		}
+	}
+	if w.c.Set&SetAttrUID != 0 && attr.Uid != w.c.Uid {
+		set |= SetAttrUID
+		nattr.Uid = w.c.Uid
+	}
+	if w.c.Set&SetAttrGID != 0 && attr.Gid != w.c.Gid {
+		set |= SetAttrGID
+		nattr.Gid = w.c.Gid
+	}
+	var st syscall.Errno
+	if set != 0 {
+		if st = checkAttrChange(w.ctx, attr, set, &nattr); st == 0 {
+			st = w.r.SetAttr(w.ctx, inode, set, 0, &nattr)
+		}
+		if st == 0 {
+			*w.changed++
+		}
+	}
+	if st != 0 || w.count == w.limit {
+		w.path = append([]string{}, path...)
+		return st, true
+	}
+	return 0, false
+}
+
+// walk visits the children of a directory in the order of names, skipping those up to after.
+func (w *attrWalker) walk(inode Ino, attr *Attr, path, after []string) (syscall.Errno, bool) {
+	if st := w.r.Access(w.ctx, inode, 5, attr); st != 0 {
+		w.path = append([]string{}, path...)
+		return st, true
+	}
+	var entries []*Entry
+	if st := w.r.Readdir(w.ctx, inode, 1, &entries); st != 0 {
+		w.path = append([]string{}, path...)
+		return st, true
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Name, entries[j].Name) < 0 })
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+			continue
+		}
+		name := string(e.Name)
+		p := append(path[:len(path):len(path)], name)
+		if len(after) > 0 {
+			if name < after[0] {
+				continue
+			}
+			if name == after[0] { // visited already
+				if e.Attr.Typ == TypeDirectory {
+					if st, stop := w.walk(e.Inode, e.Attr, p, after[1:]); stop {
+						return st, stop
+					}
+				}
+				after = nil
+				continue
+			}
+			after = nil
+		}
+		if st, stop := w.visit(e.Inode, e.Attr, p); stop {
+			return st, stop
+		}
+		if e.Attr.Typ == TypeDirectory {
+			if st, stop := w.walk(e.Inode, e.Attr, p, nil); stop {
+				return st, stop
+			}
+		}
+	}
+	return 0, false
+}
+
+// checkAttrChange checks the privileges like chmod and chown: only root can change the owner,
+// the group can be changed by the owner to one of its groups, and the mode by the owner.
+func checkAttrChange(ctx Context, attr *Attr, set uint16, nattr *Attr) syscall.Errno {
+	uid := ctx.Uid()
+	if uid == 0 {
+		return 0
+	}
+	if set&SetAttrUID != 0 || uid != attr.Uid {
+		return syscall.EPERM
+	}
+	if set&SetAttrGID != 0 {
+		for _, gid := range ctx.Gids() {
+			if gid == nattr.Gid {
+				return 0
+			}
+		}
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// GetSummary counts the files and directories under inode. A file with multiple hard links is counted once.
 func GetSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool) syscall.Errno {
+	return getSummary(r, ctx, inode, summary, recursive, make(map[Ino]bool))
+}
+
+func getSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool, linked map[Ino]bool) syscall.Errno {
 	var attr Attr
 	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
 		return st
 	}
+	addFile := func(inode Ino, attr *Attr) {
+		if attr.Nlink > 1 {
+			if linked[inode] {
+				return
+			}
+			linked[inode] = true
+		}
+		summary.Files++
+		summary.Length += attr.Length
+		summary.Size += uint64(align4K(attr.Length))
+	}
 	if attr.Typ == TypeDirectory {
 		var entries []*Entry
 		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
@@ -284,7 +690,7 @@ func GetSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool
 			}
 			if e.Attr.Typ == TypeDirectory {
 				if recursive {
-					if st := GetSummary(r, ctx, e.Inode, summary, recursive); st != 0 {
+					if st := getSummary(r, ctx, e.Inode, summary, recursive, linked); st != 0 {
 						return st
 					}
 				} else {
@@ -292,17 +698,13 @@ func GetSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool
 					summary.Size += 4096
 				}
 			} else {
-				summary.Files++
-				summary.Length += e.Attr.Length
-				summary.Size += uint64(align4K(e.Attr.Length))
+				addFile(e.Inode, e.Attr)
 			}
 		}
 		summary.Dirs++
 		summary.Size += 4096
 	} else {
-		summary.Files++
-		summary.Length += attr.Length
-		summary.Size += uint64(align4K(attr.Length))
+		addFile(inode, &attr)
 	}
 	return 0
 }
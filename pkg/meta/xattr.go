@@ -0,0 +1,56 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// With Format.XattrChecksum, the value of xattr is stored with a stamp appended: the CRC32C of the
+// name and value, followed by a magic with the version of the stamp.
+const xattrStampSize = 8
+
+var (
+	xattrStampMagic = []byte{'J', 'X', 'C', 1}
+	xattrCRCTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func xattrChecksum(name string, value []byte) uint32 {
+	sum := crc32.Update(0, xattrCRCTable, []byte(name))
+	sum = crc32.Update(sum, xattrCRCTable, []byte{0})
+	return crc32.Update(sum, xattrCRCTable, value)
+}
+
+func stampXattr(name string, value []byte) []byte {
+	buf := make([]byte, len(value)+xattrStampSize)
+	copy(buf, value)
+	binary.BigEndian.PutUint32(buf[len(value):], xattrChecksum(name, value))
+	copy(buf[len(value)+4:], xattrStampMagic)
+	return buf
+}
+
+// unstampXattr returns the value without the stamp, and false if the checksum mismatches. The values
+// without a stamp (set before the checksum is enabled) are returned as they are.
+func unstampXattr(name string, buf []byte) ([]byte, bool) {
+	n := len(buf) - xattrStampSize
+	if n < 0 || !bytes.Equal(buf[n+4:], xattrStampMagic) {
+		return buf, true
+	}
+	return buf[:n], binary.BigEndian.Uint32(buf[n:n+4]) == xattrChecksum(name, buf[:n])
+}
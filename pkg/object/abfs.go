@@ -0,0 +1,456 @@
+//go:build !noazure
+// +build !noazure
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	abfsVersion    = "2020-02-10"
+	abfsAppendSize = 4 << 20
+	abfsListSize   = 5000
+)
+
+// abfs is Azure Data Lake Storage Gen2, which has a hierarchical namespace, the objects are
+// listed by walking the directories.
+type abfs struct {
+	DefaultObjectStorage
+	endpoint   string // https://ACCOUNT.dfs.core.windows.net/FILESYSTEM
+	account    string
+	filesystem string
+	key        []byte // shared key
+	token      *aadToken
+}
+
+func (b *abfs) String() string {
+	return fmt.Sprintf("abfs://%s@%s/", b.filesystem, b.account)
+}
+
+// aadToken gets the access tokens of Azure AD with client credentials.
+type aadToken struct {
+	sync.Mutex
+	authority string
+	tenant    string
+	clientID  string
+	secret    string
+	token     string
+	expire    time.Time
+}
+
+func (t *aadToken) get() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.token != "" && time.Now().Before(t.expire) {
+		return t.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {t.clientID},
+		"client_secret": {t.secret},
+		"scope":         {"https://storage.azure.com/.default"},
+	}
+	resp, err := httpClient.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/token", t.authority, t.tenant), form)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token of Azure AD: %s", parseError(resp))
+	}
+	var r struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	t.token = r.AccessToken
+	// refresh it before expired
+	t.expire = time.Now().Add(time.Duration(r.ExpiresIn)*time.Second - time.Minute*5)
+	return t.token, nil
+}
+
+// signSharedKey signs the request with shared key of the account.
+func (b *abfs) signSharedKey(req *http.Request) {
+	var size string
+	if req.ContentLength > 0 {
+		size = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	toSign := strings.Join([]string{req.Method, h.Get("Content-Encoding"), h.Get("Content-Language"), size,
+		h.Get("Content-MD5"), h.Get("Content-Type"), h.Get("Date"), h.Get("If-Modified-Since"),
+		h.Get("If-Match"), h.Get("If-None-Match"), h.Get("If-Unmodified-Since"), h.Get("Range")}, "\n") + "\n"
+
+	var names []string
+	for k := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		toSign += k + ":" + strings.TrimSpace(h.Get(k)) + "\n"
+	}
+
+	toSign += "/" + b.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := query[k]
+		sort.Strings(vs)
+		toSign += "\n" + strings.ToLower(k) + ":" + strings.Join(vs, ",")
+	}
+
+	mac := hmac.New(sha256.New, b.key)
+	_, _ = mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+b.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (b *abfs) request(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	uri := b.endpoint
+	if key != "" {
+		uri += "/" + (&url.URL{Path: key}).EscapedPath()
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = nil
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", abfsVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if b.token != nil {
+		token, err := b.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if b.key != nil {
+		b.signSharedKey(req)
+	}
+	return httpClient.Do(req)
+}
+
+func (b *abfs) Create() error {
+	resp, err := b.request(ctx, "PUT", "", url.Values{"resource": {"filesystem"}}, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer cleanup(resp)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		return parseError(resp)
+	}
+	return nil
+}
+
+func (b *abfs) Head(key string) (Object, error) {
+	resp, err := b.request(ctx, "HEAD", strings.TrimSuffix(key, "/"), nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup(resp)
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("head %s: status %d", key, resp.StatusCode)
+	}
+	mtime, _ := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
+	isDir := resp.Header.Get("x-ms-resource-type") == "directory"
+	if isDir && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return &obj{key, resp.ContentLength, mtime, isDir}, nil
+}
+
+func (b *abfs) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return b.GetWithContext(ctx, key, off, limit)
+}
+
+func (b *abfs) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	headers := make(map[string]string)
+	if off > 0 || limit > 0 {
+		if limit > 0 {
+			headers["Range"] = fmt.Sprintf("bytes=%d-%d", off, off+limit-1)
+		} else {
+			headers["Range"] = fmt.Sprintf("bytes=%d-", off)
+		}
+	}
+	resp, err := b.request(ctx, "GET", key, nil, nil, 0, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		cleanup(resp)
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer cleanup(resp)
+		return nil, parseError(resp)
+	}
+	return resp.Body, nil
+}
+
+func (b *abfs) checked(resp *http.Response, err error, codes ...int) error {
+	if err != nil {
+		return err
+	}
+	defer cleanup(resp)
+	for _, c := range codes {
+		if resp.StatusCode == c {
+			return nil
+		}
+	}
+	return parseError(resp)
+}
+
+// Put creates (or overwrites) a file, appends the data, then flushes it to make it visible.
+func (b *abfs) Put(key string, in io.Reader) error {
+	if strings.HasSuffix(key, "/") {
+		resp, err := b.request(ctx, "PUT", strings.TrimSuffix(key, "/"), url.Values{"resource": {"directory"}}, nil, 0, nil)
+		return b.checked(resp, err, http.StatusCreated)
+	}
+	resp, err := b.request(ctx, "PUT", key, url.Values{"resource": {"file"}}, nil, 0, nil)
+	if err = b.checked(resp, err, http.StatusCreated); err != nil {
+		return err
+	}
+	buf := make([]byte, abfsAppendSize)
+	var pos int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			query := url.Values{"action": {"append"}, "position": {strconv.FormatInt(pos, 10)}}
+			resp, e := b.request(ctx, "PATCH", key, query, bytes.NewReader(buf[:n]), int64(n), nil)
+			if e = b.checked(resp, e, http.StatusAccepted); e != nil {
+				return e
+			}
+			pos += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	query := url.Values{"action": {"flush"}, "position": {strconv.FormatInt(pos, 10)}}
+	resp, err = b.request(ctx, "PATCH", key, query, nil, 0, nil)
+	return b.checked(resp, err, http.StatusOK)
+}
+
+func (b *abfs) Delete(key string) error {
+	var query url.Values
+	if strings.HasSuffix(key, "/") {
+		query = url.Values{"recursive": {"false"}}
+	}
+	resp, err := b.request(ctx, "DELETE", strings.TrimSuffix(key, "/"), query, nil, 0, nil)
+	return b.checked(resp, err, http.StatusOK, http.StatusNotFound)
+}
+
+func (b *abfs) List(prefix, marker string, limit int64) ([]Object, error) {
+	return nil, notSupported
+}
+
+// the numbers and booleans are returned as strings in the listing
+type abfsString string
+
+func (s *abfsString) UnmarshalJSON(d []byte) error {
+	*s = abfsString(strings.Trim(string(d), `"`))
+	return nil
+}
+
+type abfsPath struct {
+	Name          string     `json:"name"`
+	IsDirectory   abfsString `json:"isDirectory"`
+	ContentLength abfsString `json:"contentLength"`
+	LastModified  string     `json:"lastModified"`
+}
+
+// readDir lists the direct children of a directory, sorted by their keys (directories end with "/").
+func (b *abfs) readDir(dir string) ([]Object, error) {
+	var objs []Object
+	var continuation string
+	for {
+		query := url.Values{
+			"resource":   {"filesystem"},
+			"recursive":  {"false"},
+			"maxResults": {strconv.Itoa(abfsListSize)},
+		}
+		if dir != "" {
+			query.Set("directory", strings.TrimSuffix(dir, "/"))
+		}
+		if continuation != "" {
+			query.Set("continuation", continuation)
+		}
+		resp, err := b.request(ctx, "GET", "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			cleanup(resp)
+			return nil, nil
+		} else if resp.StatusCode != http.StatusOK {
+			defer cleanup(resp)
+			return nil, parseError(resp)
+		}
+		var r struct {
+			Paths []abfsPath `json:"paths"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		cleanup(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range r.Paths {
+			isDir := p.IsDirectory == "true"
+			size, _ := strconv.ParseInt(string(p.ContentLength), 10, 64)
+			mtime, _ := time.Parse(time.RFC1123, p.LastModified)
+			key := p.Name
+			if isDir {
+				key += "/"
+				size = 0
+			}
+			objs = append(objs, &obj{key, size, mtime, isDir})
+		}
+		if continuation = resp.Header.Get("x-ms-continuation"); continuation == "" {
+			break
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	return objs, nil
+}
+
+// walk sends the files under dir in lexical order, skipping the directories out of prefix and marker.
+func (b *abfs) walk(dir, prefix, marker string, listed chan<- Object) error {
+	objs, err := b.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		key := o.Key()
+		if o.IsDir() {
+			if (strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key)) &&
+				(marker == "" || key > marker || strings.HasPrefix(marker, key)) {
+				if err = b.walk(key, prefix, marker, listed); err != nil {
+					return err
+				}
+			}
+		} else if strings.HasPrefix(key, prefix) && (marker == "" || key > marker) {
+			listed <- o
+		}
+	}
+	return nil
+}
+
+func (b *abfs) ListAll(prefix, marker string) (<-chan Object, error) {
+	listed := make(chan Object, 10240)
+	go func() {
+		// start from the deepest directory of prefix
+		var dir string
+		if i := strings.LastIndex(prefix, "/"); i > 0 {
+			dir = prefix[:i+1]
+		}
+		if err := b.walk(dir, prefix, marker, listed); err != nil {
+			logger.Errorf("list %s: %s", prefix, err)
+			listed <- nil
+		}
+		close(listed)
+	}()
+	return listed, nil
+}
+
+func newAbfs(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = fmt.Sprintf("https://%s", endpoint)
+	}
+	uri, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid endpoint: %v, error: %v", endpoint, err)
+	}
+	// https://FILESYSTEM.ACCOUNT.dfs.core.windows.net or https://ACCOUNT.dfs.core.windows.net/FILESYSTEM
+	host, filesystem := uri.Host, strings.Trim(uri.Path, "/")
+	if filesystem == "" {
+		parts := strings.SplitN(host, ".", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("no filesystem in endpoint %s", endpoint)
+		}
+		filesystem, host = parts[0], parts[1]
+	}
+	b := &abfs{
+		endpoint:   fmt.Sprintf("%s://%s/%s", uri.Scheme, host, filesystem),
+		account:    strings.SplitN(host, ".", 2)[0],
+		filesystem: filesystem,
+	}
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		// Azure AD with access key as client ID and secret key as client secret
+		if accessKey == "" {
+			accessKey = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if secretKey == "" {
+			secretKey = os.Getenv("AZURE_CLIENT_SECRET")
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com"
+		}
+		b.token = &aadToken{authority: strings.TrimSuffix(authority, "/"), tenant: tenant, clientID: accessKey, secret: secretKey}
+	} else if secretKey != "" {
+		// shared key with access key as account name
+		if accessKey != "" {
+			b.account = accessKey
+		}
+		if b.key, err = base64.StdEncoding.DecodeString(secretKey); err != nil {
+			return nil, fmt.Errorf("invalid account key: %s", err)
+		}
+	}
+	return b, nil
+}
+
+func init() {
+	Register("abfs", newAbfs)
+}
@@ -0,0 +1,184 @@
+//go:build !noazure
+// +build !noazure
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dfsPath struct {
+	data  []byte
+	isDir bool
+	mtime time.Time
+}
+
+// fakeDFS is a minimal DFS endpoint of ADLS Gen2 in memory.
+type fakeDFS struct {
+	sync.Mutex
+	fs    string
+	paths map[string]*dfsPath
+	lists int
+}
+
+func (f *fakeDFS) mkdirs(name string) {
+	ps := strings.Split(name, "/")
+	for i := 1; i < len(ps); i++ {
+		if dir := strings.Join(ps[:i], "/"); f.paths[dir] == nil {
+			f.paths[dir] = &dfsPath{isDir: true, mtime: time.Now()}
+		}
+	}
+}
+
+func (f *fakeDFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey test:") || r.Header.Get("x-ms-version") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.fs), "/")
+	p := f.paths[name]
+	switch {
+	case r.Method == "PUT" && q.Get("resource") == "filesystem":
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT":
+		f.mkdirs(name)
+		f.paths[name] = &dfsPath{isDir: q.Get("resource") == "directory", mtime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PATCH" && p != nil:
+		pos, _ := strconv.Atoi(q.Get("position"))
+		if q.Get("action") == "append" {
+			d, _ := ioutil.ReadAll(r.Body)
+			if pos != len(p.data) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			p.data = append(p.data, d...)
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	case r.Method == "HEAD" && p != nil:
+		w.Header().Set("Content-Length", strconv.Itoa(len(p.data)))
+		w.Header().Set("Last-Modified", p.mtime.UTC().Format(http.TimeFormat))
+		if p.isDir {
+			w.Header().Set("x-ms-resource-type", "directory")
+		}
+	case r.Method == "GET" && q.Get("resource") == "filesystem":
+		f.lists++
+		dir := q.Get("directory")
+		var names []string
+		for n := range f.paths {
+			if dir == "" && !strings.Contains(n, "/") || strings.HasPrefix(n, dir+"/") && !strings.Contains(n[len(dir)+1:], "/") {
+				names = append(names, n)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		var paths []map[string]string
+		for _, n := range names {
+			p := f.paths[n]
+			paths = append(paths, map[string]string{"name": n, "isDirectory": strconv.FormatBool(p.isDir),
+				"contentLength": strconv.Itoa(len(p.data)), "lastModified": p.mtime.UTC().Format(http.TimeFormat)})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"paths": paths})
+	case r.Method == "GET" && p != nil:
+		d := p.data
+		if rg := r.Header.Get("Range"); rg != "" {
+			var start, end int
+			if n, _ := fmt.Sscanf(rg, "bytes=%d-%d", &start, &end); n < 2 {
+				end = len(d) - 1
+			}
+			if start >= len(d) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if end >= len(d) {
+				end = len(d) - 1
+			}
+			d = d[start : end+1]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write(d)
+	case r.Method == "DELETE" && p != nil:
+		delete(f.paths, name)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAbfsFake(t *testing.T) {
+	f := &fakeDFS{fs: "jfs", paths: make(map[string]*dfsPath)}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	s, err := newAbfs(ts.URL+"/jfs", "test", "c2VjcmV0")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	testStorage(t, s)
+
+	for _, k := range []string{"a/b/c", "a/b-c", "a-b", "b", "c/d"} {
+		if err := s.Put(k, strings.NewReader(k)); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	f.lists = 0
+	ch, _ := s.ListAll("a", "a/b-c")
+	var keys []string
+	for o := range ch {
+		keys = append(keys, o.Key())
+	}
+	if strings.Join(keys, ",") != "a/b/c" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if f.lists != 3 { // /, a/ and a/b/
+		t.Fatalf("directories out of range should not be listed, but listed %d", f.lists)
+	}
+	ch, _ = s.ListAll("", "")
+	keys = keys[:0]
+	for o := range ch {
+		keys = append(keys, o.Key())
+	}
+	if strings.Join(keys, ",") != "a-b,a/b-c,a/b/c,b,c/d" {
+		t.Fatalf("keys should be sorted: %v", keys)
+	}
+}
+
+func TestAbfs(t *testing.T) {
+	if os.Getenv("ABFS_TEST_BUCKET") == "" {
+		t.SkipNow()
+	}
+	s, err := newAbfs(os.Getenv("ABFS_TEST_BUCKET"), os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	testStorage(t, s)
+}
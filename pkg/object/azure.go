@@ -79,6 +79,35 @@ func (b *wasb) Put(key string, data io.Reader) error {
 	return b.container.GetBlobReference(key).CreateBlockBlobFromReader(data, nil)
 }
 
+// maxAppendBlock is the max size of a block appended to an append blob.
+const maxAppendBlock = 4 << 20
+
+// Append writes the object as an append blob, so the objects written by Put can't be appended.
+func (b *wasb) Append(key string, off int64, in io.Reader) error {
+	blob := b.container.GetBlobReference(key)
+	if off == 0 {
+		if err := blob.PutAppendBlob(&storage.PutBlobOptions{IfNoneMatch: "*"}); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, maxAppendBlock)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			pos := uint(off)
+			if e := blob.AppendBlock(buf[:n], &storage.AppendBlockOptions{AppendPosition: &pos}); e != nil {
+				return e
+			}
+			off += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 func (b *wasb) Copy(dst, src string) error {
 	uri := b.container.GetBlobReference(src).GetURL()
 	return b.container.GetBlobReference(dst).Copy(uri, nil)
@@ -131,6 +160,9 @@ func autoWasbEndpoint(containerName, accountName, accountKey string, useHTTPS bo
 		if err != nil {
 			log.Fatalf("Failed to create client: %v", err)
 		}
+		if customTransport {
+			client.HTTPClient = httpClient
+		}
 		blobService := client.GetBlobService()
 		resp, err := blobService.ListContainers(storage.ListContainersParameters{Prefix: containerName, MaxResults: 1})
 		if err != nil {
@@ -201,6 +233,9 @@ func newWabs(endpoint, accountName, accountKey string) (ObjectStorage, error) {
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
+	if customTransport {
+		client.HTTPClient = httpClient
+	}
 	service := client.GetBlobService()
 	container := service.GetContainerReference(name)
 	return &wasb{container: container}, nil
@@ -146,6 +146,9 @@ func newB2(endpoint, keyID, applicationKey string) (ObjectStorage, error) {
 	}
 	hostParts := strings.Split(uri.Host, ".")
 	name := hostParts[0]
+	if customTransport {
+		logger.Warnf("Custom CA bundle and --insecure-skip-verify are not supported by B2")
+	}
 	client, err := backblaze.NewB2(backblaze.Credentials{
 		KeyID:          keyID,
 		ApplicationKey: applicationKey,
@@ -0,0 +1,97 @@
+//go:build ceph
+// +build ceph
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCeph runs against the cluster in the default config file (or CEPH_CONF), with the pool in CEPH_POOL.
+func TestCeph(t *testing.T) {
+	pool := os.Getenv("CEPH_POOL")
+	if pool == "" {
+		t.SkipNow()
+	}
+	cluster, user := os.Getenv("CEPH_CLUSTER"), os.Getenv("CEPH_USER")
+	if cluster == "" {
+		cluster = "ceph"
+	}
+	if user == "" {
+		user = "client.admin"
+	}
+	s, err := newCeph("ceph://"+pool, cluster, user)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := s.Create(); err != nil {
+		t.Fatalf("create pool %s: %s", pool, err)
+	}
+	s = WithPrefix(s, "unit-test/")
+
+	if err := s.Put("test", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	defer s.Delete("test")
+	if d, err := get(s, "test", 0, -1); err != nil || d != "hello" {
+		t.Fatalf("expect hello, but got %q: %v", d, err)
+	}
+	if d, err := get(s, "test", 2, 2); err != nil || d != "ll" {
+		t.Fatalf("expect ll, but got %q: %v", d, err)
+	}
+
+	// a block is written in pieces if it's not a bytes.Reader
+	large := strings.Repeat("x", 5<<20+1)
+	if err := s.Put("large", strings.NewReader(large)); err != nil {
+		t.Fatalf("put large: %s", err)
+	}
+	defer s.Delete("large")
+	if d, err := get(s, "large", 0, -1); err != nil || d != large {
+		t.Fatalf("get large: %d bytes, %v", len(d), err)
+	}
+	if d, err := get(s, "large", 5<<20, -1); err != nil || d != "x" {
+		t.Fatalf("get the end of large: %q, %v", d, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("list/%d", i)
+		if err := s.Put(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		defer s.Delete(key)
+	}
+	objs, err := listAll(s, "list/", "list/0", 10)
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(objs) != 2 || objs[0].Key() != "list/1" || objs[1].Key() != "list/2" || objs[1].Size() != 6 {
+		t.Fatalf("list after list/0: %+v", objs)
+	}
+
+	if err := s.Delete("test"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if d, err := get(s, "test", 0, -1); err == nil && d != "" {
+		t.Fatalf("test should be deleted, but got %q", d)
+	}
+}
@@ -18,7 +18,10 @@ package object
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"reflect"
@@ -29,6 +32,24 @@ const checksumAlgr = "Crc32c"
 
 var crc32c = crc32.MakeTable(crc32.Castagnoli)
 
+// hashContent writes the whole content into h, then seeks back to the beginning.
+func hashContent(in io.ReadSeeker, h hash.Hash) error {
+	if _, err := io.Copy(h, in); err != nil {
+		return err
+	}
+	_, err := in.Seek(0, io.SeekStart)
+	return err
+}
+
+// contentMD5 returns the base64 encoded MD5 of the content, as the Content-MD5 header.
+func contentMD5(in io.ReadSeeker) (string, error) {
+	h := md5.New()
+	if err := hashContent(in, h); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
 func generateChecksum(in io.ReadSeeker) string {
 	if b, ok := in.(*bytes.Reader); ok {
 		v := reflect.ValueOf(b)
@@ -18,9 +18,17 @@ package object
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
 )
 
 func TestChecksum(t *testing.T) {
@@ -38,3 +46,123 @@ func TestChecksum(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+// corrupter flips the first byte of the uploaded data, as corrupted in transit.
+type corrupter struct {
+	http.RoundTripper
+}
+
+func (c *corrupter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" && req.Body != nil {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			data[0] ^= 0xFF
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	return c.RoundTripper.RoundTrip(req)
+}
+
+// md5Server stores the uploaded data, or rejects it if it doesn't match Content-MD5.
+func md5Server(stored *[]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if sum := r.Header.Get("Content-MD5"); sum != "" {
+			h := md5.Sum(data)
+			if sum != base64.StdEncoding.EncodeToString(h[:]) {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`<Error><Code>BadDigest</Code><Message>The Content-MD5 you specified did not match what we received.</Message></Error>`))
+				return
+			}
+		}
+		*stored = data
+	}))
+}
+
+func TestUploadChecksum(t *testing.T) {
+	var stored []byte
+	ts := md5Server(&stored)
+	defer ts.Close()
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Transport: &corrupter{http.DefaultTransport}}
+	s, err := newCOS(ts.URL, "testUser", "testUserPassword")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err = s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put without checksum: %s", err)
+	}
+	if string(stored) == "hello" {
+		t.Fatalf("the data should be corrupted")
+	}
+
+	if err = SetUploadChecksum(s, true); err != nil {
+		t.Fatalf("set upload checksum: %s", err)
+	}
+	stored = nil
+	if err = s.Put("b", bytes.NewReader([]byte("hello"))); err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Fatalf("corrupted data should be rejected: %v", err)
+	}
+	if stored != nil {
+		t.Fatalf("corrupted data is stored: %q", stored)
+	}
+
+	httpClient = &http.Client{Transport: http.DefaultTransport}
+	if s, err = newCOS(ts.URL, "testUser", "testUserPassword"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	_ = SetUploadChecksum(s, true)
+	if err = s.Put("c", bytes.NewReader([]byte("hello"))); err != nil || string(stored) != "hello" {
+		t.Fatalf("put with checksum: %s %q", err, stored)
+	}
+
+	m, _ := newMem("test", "", "")
+	if err = SetUploadChecksum(m, true); err != notSupported {
+		t.Fatalf("upload checksum should not be supported by mem: %v", err)
+	}
+}
+
+// corrupt flips the first byte of the data uploaded by the AWS SDK.
+func corrupt(r *request.Request) {
+	if r.HTTPRequest.Method != "PUT" || r.HTTPRequest.Body == nil {
+		return
+	}
+	data, err := ioutil.ReadAll(r.HTTPRequest.Body)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	if len(data) > 0 {
+		data[0] ^= 0xFF
+	}
+	r.HTTPRequest.Body = ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func TestS3ContentMD5(t *testing.T) {
+	var stored []byte
+	ts := md5Server(&stored)
+	defer ts.Close()
+
+	m, err := newMinio(ts.URL+"/test", "testUser", "testUserPassword")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	s := m.(*minio)
+	s.s3.Handlers.Send.PushFront(corrupt)
+	// Content-MD5 is always sent by the SDK
+	if err = s.Put("a", bytes.NewReader([]byte("hello"))); err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Fatalf("corrupted data should be rejected: %v", err)
+	}
+	if stored != nil {
+		t.Fatalf("corrupted data is stored: %q", stored)
+	}
+}
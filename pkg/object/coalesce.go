@@ -0,0 +1,207 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coalescedGets = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "object_request_coalesced",
+	Help: "Ranged reads served by a request shared with other ones, instead of a request of their own.",
+})
+
+// rangeGet is a ranged request shared by the reads within it.
+type rangeGet struct {
+	off, end int64
+	issued   bool      // the range can't be extended after the request is sent
+	merged   *rangeGet // the request serving this one
+	data     []byte
+	err      error
+	done     chan struct{}
+}
+
+type coalescedGet struct {
+	ObjectStorage
+	gap  int64
+	wait time.Duration
+
+	sync.Mutex
+	pending map[string][]*rangeGet
+}
+
+// WithCoalescedGet returns an object storage that merges the ranged reads of an object into one
+// request, if they overlap or are at most gap bytes apart. A request is sent after waiting for
+// the others to join it, and the reads within it are served by it until it's done. The storage
+// is returned untouched if gap is not positive, or it can not fetch a range of an object.
+func WithCoalescedGet(s ObjectStorage, gap int64, wait time.Duration) ObjectStorage {
+	if gap <= 0 || !supportRange(s) {
+		return s
+	}
+	_ = prometheus.Register(coalescedGets)
+	return &coalescedGet{ObjectStorage: s, gap: gap, wait: wait, pending: make(map[string][]*rangeGet)}
+}
+
+func (c *coalescedGet) DeleteMany(keys []string) map[string]error {
+	return DeleteMany(c.ObjectStorage, keys)
+}
+
+func (c *coalescedGet) PutIfAbsent(key string, in io.Reader) error {
+	return PutIfAbsent(c.ObjectStorage, key, in)
+}
+
+func (c *coalescedGet) Append(key string, off int64, in io.Reader) error {
+	return Append(c.ObjectStorage, key, off, in)
+}
+
+func (c *coalescedGet) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(c.ObjectStorage, accessKey, secretKey, token)
+}
+
+func (c *coalescedGet) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return c.GetWithContext(context.Background(), key, off, limit)
+}
+
+func (c *coalescedGet) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	// the size of object is unknown without limit
+	if limit <= 0 {
+		return GetWithContext(ctx, c.ObjectStorage, key, off, limit)
+	}
+	end := off + limit
+	c.Lock()
+	var g *rangeGet
+	for _, p := range c.pending[key] {
+		if p.issued && off >= p.off && end <= p.end {
+			g = p
+			break
+		}
+		if !p.issued && off <= p.end+c.gap && end >= p.off-c.gap {
+			if off < p.off {
+				p.off = off
+			}
+			if end > p.end {
+				p.end = end
+			}
+			g = p
+			break
+		}
+	}
+	if g != nil {
+		coalescedGets.Inc()
+	} else {
+		g = &rangeGet{off: off, end: end, done: make(chan struct{})}
+		c.pending[key] = append(c.pending[key], g)
+		go c.fetch(key, g)
+	}
+	c.Unlock()
+
+	select {
+	case <-g.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	// the object could end before the range
+	start, stop := off-g.off, end-g.off
+	if stop > int64(len(g.data)) {
+		stop = int64(len(g.data))
+	}
+	if start > stop {
+		start = stop
+	}
+	return ioutil.NopCloser(bytes.NewReader(g.data[start:stop])), nil
+}
+
+// fetch sends the request after waiting for the others to join, it's not bound to any of them. The
+// requests still waiting within the gap are merged into it, they are served by it then.
+func (c *coalescedGet) fetch(key string, g *rangeGet) {
+	if c.wait > 0 {
+		time.Sleep(c.wait)
+	}
+	defer func() {
+		c.Lock()
+		gs := c.pending[key]
+		for i, p := range gs {
+			if p == g {
+				gs = append(gs[:i], gs[i+1:]...)
+				break
+			}
+		}
+		if len(gs) == 0 {
+			delete(c.pending, key)
+		} else {
+			c.pending[key] = gs
+		}
+		c.Unlock()
+		close(g.done)
+	}()
+	c.Lock()
+	if g.merged != nil {
+		c.Unlock()
+		p := g.merged
+		<-p.done
+		start, stop := g.off-p.off, g.end-p.off
+		if stop > int64(len(p.data)) {
+			stop = int64(len(p.data))
+		}
+		if start > stop {
+			start = stop
+		}
+		g.data, g.err = p.data[start:stop], p.err
+		return
+	}
+	g.issued = true
+	for merged := true; merged; {
+		merged = false
+		for _, p := range c.pending[key] {
+			if !p.issued && p.off <= g.end+c.gap && p.end >= g.off-c.gap {
+				p.issued, p.merged = true, g
+				if p.off < g.off {
+					g.off = p.off
+				}
+				if p.end > g.end {
+					g.end = p.end
+				}
+				coalescedGets.Inc()
+				merged = true
+			}
+		}
+	}
+	off, limit := g.off, g.end-g.off
+	c.Unlock()
+	in, err := GetWithContext(context.Background(), c.ObjectStorage, key, off, limit)
+	if err != nil {
+		g.err = err
+		return
+	}
+	defer in.Close()
+	data := make([]byte, limit)
+	n, err := io.ReadFull(in, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	g.data, g.err = data[:n], err
+}
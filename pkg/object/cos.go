@@ -21,6 +21,7 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -38,6 +39,11 @@ const cosChecksumKey = "x-cos-meta-" + checksumAlgr
 type COS struct {
 	c        *cos.Client
 	endpoint string
+	checksum bool // send Content-MD5 in Put
+}
+
+func (c *COS) SetUploadChecksum(enabled bool) {
+	c.checksum = enabled
 }
 
 func (c *COS) String() string {
@@ -74,6 +80,10 @@ func (c *COS) Head(key string) (Object, error) {
 }
 
 func (c *COS) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return c.GetWithContext(ctx, key, off, limit)
+}
+
+func (c *COS) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
 	params := &cos.ObjectGetOptions{}
 	if off > 0 || limit > 0 {
 		var r string
@@ -101,6 +111,13 @@ func (c *COS) Put(key string, in io.Reader) error {
 			cosChecksumKey: {generateChecksum(ins)},
 		})
 		options = &cos.ObjectPutOptions{ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{XCosMetaXXX: &header}}
+		if c.checksum {
+			sum, err := contentMD5(ins)
+			if err != nil {
+				return err
+			}
+			options.ContentMD5 = sum
+		}
 	}
 	_, err := c.c.Object.Put(ctx, key, in, options)
 	return err
@@ -247,7 +264,7 @@ func newCOS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		},
 	})
 	client.UserAgent = UserAgent
-	return &COS{client, uri.Host}, nil
+	return &COS{c: client, endpoint: uri.Host}, nil
 }
 
 func init() {
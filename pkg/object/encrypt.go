@@ -18,6 +18,7 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -200,7 +201,11 @@ func (e *encrypted) String() string {
 }
 
 func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
-	r, err := e.ObjectStorage.Get(key, 0, -1)
+	return e.GetWithContext(ctx, key, off, limit)
+}
+
+func (e *encrypted) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	r, err := GetWithContext(ctx, e.ObjectStorage, key, 0, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -225,15 +230,35 @@ func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (e *encrypted) Put(key string, in io.Reader) error {
-	plain, err := ioutil.ReadAll(in)
+	ciphertext, err := e.encrypt(in)
 	if err != nil {
 		return err
 	}
-	ciphertext, err := e.enc.Encrypt(plain)
+	return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
+}
+
+func (e *encrypted) PutIfAbsent(key string, in io.Reader) error {
+	ciphertext, err := e.encrypt(in)
 	if err != nil {
 		return err
 	}
-	return e.ObjectStorage.Put(key, bytes.NewReader(ciphertext))
+	return PutIfAbsent(e.ObjectStorage, key, bytes.NewReader(ciphertext))
+}
+
+func (e *encrypted) encrypt(in io.Reader) ([]byte, error) {
+	plain, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return e.enc.Encrypt(plain)
+}
+
+func (e *encrypted) DeleteMany(keys []string) map[string]error {
+	return DeleteMany(e.ObjectStorage, keys)
+}
+
+func (e *encrypted) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(e.ObjectStorage, accessKey, secretKey, token)
 }
 
 var _ ObjectStorage = &encrypted{}
@@ -0,0 +1,252 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	endpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "object_endpoint_up",
+		Help: "Whether the endpoint of object storage is healthy (1), or deprioritized after a failure until a probe succeeds (0).",
+	}, []string{"endpoint"})
+	endpointFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_endpoint_failovers",
+		Help: "Reads served by an endpoint after the preferred ones failed.",
+	}, []string{"endpoint"})
+)
+
+// probeKey is a key which is not expected to exist, a Head of it tells whether an endpoint is reachable.
+const probeKey = "juicefs-endpoint-probe"
+
+// EndpointStatus is the health of an endpoint seen by an EndpointResolver.
+type EndpointStatus struct {
+	Name    string
+	Healthy bool
+	Latency time.Duration // of the last successful probe, 0 if not probed yet
+}
+
+// EndpointResolver returns the endpoints (as indexes of eps) to read key from, in order of preference,
+// the unhealthy ones are tried after all the healthy ones regardless of the order.
+type EndpointResolver func(key string, eps []EndpointStatus) []int
+
+// NearestEndpoints is the default EndpointResolver, which prefers the endpoints with lower latency of
+// probes, the ones not probed yet are tried last in the given order.
+func NearestEndpoints(key string, eps []EndpointStatus) []int {
+	order := make([]int, len(eps))
+	for i := range order {
+		order[i] = i
+	}
+	latency := func(i int) time.Duration {
+		if eps[i].Latency == 0 {
+			return math.MaxInt64
+		}
+		return eps[i].Latency
+	}
+	sort.SliceStable(order, func(i, j int) bool { return latency(order[i]) < latency(order[j]) })
+	return order
+}
+
+type endpoint struct {
+	ObjectStorage
+	healthy bool
+	latency time.Duration
+}
+
+type endpointsStore struct {
+	ObjectStorage // the primary one, for all the writes
+	sync.Mutex
+	endpoints []*endpoint // the primary one is the first
+	resolve   EndpointResolver
+}
+
+// WithEndpoints returns an object storage reading from the endpoints (the primary one and the
+// replicas in other regions) chosen by resolve (NearestEndpoints if nil), and writing to the primary
+// one only to avoid split-brain. An endpoint failing a request (not a missing object) is
+// deprioritized until a probe of it succeeds, and all of them are probed every interval.
+func WithEndpoints(primary ObjectStorage, replicas []ObjectStorage, resolve EndpointResolver, interval time.Duration) ObjectStorage {
+	_ = prometheus.Register(endpointUp)
+	_ = prometheus.Register(endpointFailovers)
+	if resolve == nil {
+		resolve = NearestEndpoints
+	}
+	s := &endpointsStore{ObjectStorage: primary, resolve: resolve}
+	for _, o := range append([]ObjectStorage{primary}, replicas...) {
+		s.endpoints = append(s.endpoints, &endpoint{ObjectStorage: o, healthy: true})
+		endpointUp.WithLabelValues(o.String()).Set(1)
+	}
+	if interval > 0 {
+		go func() {
+			for {
+				s.probe()
+				time.Sleep(interval)
+			}
+		}()
+	}
+	return s
+}
+
+func (s *endpointsStore) String() string {
+	return s.ObjectStorage.String()
+}
+
+// probe checks all the endpoints, the ones responding (even with an error of missing object) are healthy.
+func (s *endpointsStore) probe() {
+	var wg sync.WaitGroup
+	for _, e := range s.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			start := time.Now()
+			_, err := e.Head(probeKey)
+			if err != nil && !isNotFound(err) {
+				s.setHealth(e, false, 0, err)
+			} else {
+				s.setHealth(e, true, time.Since(start), nil)
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (s *endpointsStore) setHealth(e *endpoint, healthy bool, latency time.Duration, err error) {
+	s.Lock()
+	changed := e.healthy != healthy
+	e.healthy = healthy
+	if latency > 0 {
+		e.latency = latency
+	}
+	s.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		logger.Infof("Endpoint %s is healthy again", e)
+		endpointUp.WithLabelValues(e.String()).Set(1)
+	} else {
+		logger.Warnf("Endpoint %s is deprioritized: %s", e, err)
+		endpointUp.WithLabelValues(e.String()).Set(0)
+	}
+}
+
+// order returns the endpoints to read key from, the healthy ones first.
+func (s *endpointsStore) order(key string) []*endpoint {
+	s.Lock()
+	status := make([]EndpointStatus, len(s.endpoints))
+	for i, e := range s.endpoints {
+		status[i] = EndpointStatus{e.String(), e.healthy, e.latency}
+	}
+	s.Unlock()
+	var healthy, unhealthy []*endpoint
+	for _, i := range s.resolve(key, status) {
+		if i < 0 || i >= len(s.endpoints) {
+			continue
+		}
+		if status[i].Healthy {
+			healthy = append(healthy, s.endpoints[i])
+		} else {
+			unhealthy = append(unhealthy, s.endpoints[i])
+		}
+	}
+	if len(healthy)+len(unhealthy) == 0 {
+		return s.endpoints[:1]
+	}
+	return append(healthy, unhealthy...)
+}
+
+// read tries the endpoints in order until one of them succeeds, returns the error of the first one
+// if all of them fail. The object missing in an endpoint (e.g. not replicated yet) is read from the
+// next one, without changing its health.
+func (s *endpointsStore) read(ctx context.Context, key string, read func(o ObjectStorage) error) error {
+	var first error
+	for i, e := range s.order(key) {
+		err := read(e.ObjectStorage)
+		if err == nil {
+			if i > 0 {
+				endpointFailovers.WithLabelValues(e.String()).Inc()
+			}
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !isNotFound(err) {
+			s.setHealth(e, false, 0, err)
+		}
+	}
+	return first
+}
+
+func (s *endpointsStore) Head(key string) (o Object, err error) {
+	err = s.read(context.Background(), key, func(store ObjectStorage) (e error) {
+		o, e = store.Head(key)
+		return
+	})
+	return
+}
+
+func (s *endpointsStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key, off, limit)
+}
+
+// GetWithContext fails over only if the request fails, not the failures when reading the body.
+func (s *endpointsStore) GetWithContext(ctx context.Context, key string, off, limit int64) (in io.ReadCloser, err error) {
+	err = s.read(ctx, key, func(store ObjectStorage) (e error) {
+		in, e = GetWithContext(ctx, store, key, off, limit)
+		return
+	})
+	return
+}
+
+// PutIfAbsent writes into the primary one only, the same as the other writes.
+func (s *endpointsStore) PutIfAbsent(key string, in io.Reader) error {
+	return PutIfAbsent(s.ObjectStorage, key, in)
+}
+
+// Append writes into the primary one only, the same as the other writes.
+func (s *endpointsStore) Append(key string, off int64, in io.Reader) error {
+	return Append(s.ObjectStorage, key, off, in)
+}
+
+func (s *endpointsStore) DeleteMany(keys []string) map[string]error {
+	return DeleteMany(s.ObjectStorage, keys)
+}
+
+// UpdateCredentials updates the credentials of all the endpoints, which share the same ones.
+func (s *endpointsStore) UpdateCredentials(accessKey, secretKey, token string) error {
+	for _, e := range s.endpoints {
+		if err := UpdateCredentials(e.ObjectStorage, accessKey, secretKey, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *endpointsStore) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(s.ObjectStorage, key, expire)
+}
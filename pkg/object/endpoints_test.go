@@ -0,0 +1,171 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// regionStore is an object storage in a region with the latency of requests, which can be in outage.
+type regionStore struct {
+	ObjectStorage
+	name    string
+	latency time.Duration
+	down    int32
+	gets    int32
+}
+
+func (s *regionStore) String() string {
+	return s.name
+}
+
+func (s *regionStore) Head(key string) (Object, error) {
+	time.Sleep(s.latency)
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errors.New("503 Service Unavailable")
+	}
+	return s.ObjectStorage.Head(key)
+}
+
+func (s *regionStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.gets, 1)
+	if atomic.LoadInt32(&s.down) == 1 {
+		return nil, errors.New("503 Service Unavailable")
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestEndpoints(t *testing.T) {
+	m1, _ := CreateStorage("mem", "", "", "")
+	m2, _ := CreateStorage("mem", "", "", "")
+	primary := &regionStore{ObjectStorage: m1, name: "primary", latency: time.Millisecond * 20}
+	replica := &regionStore{ObjectStorage: m2, name: "replica"}
+	for _, o := range []ObjectStorage{m1, m2} {
+		_ = o.Put("a", bytes.NewReader([]byte("hello")))
+	}
+	s := WithEndpoints(primary, []ObjectStorage{replica}, nil, 0).(*endpointsStore)
+	s.probe()
+	get := func(key string) error {
+		r, err := s.Get(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if d, _ := ioutil.ReadAll(r); string(d) != "hello" {
+			t.Fatalf("expect hello but got %q", d)
+		}
+		return nil
+	}
+	expect := func(p, r int32) {
+		t.Helper()
+		if primary.gets != p || replica.gets != r {
+			t.Fatalf("expect %d gets from primary and %d from replica, but got %d and %d", p, r, primary.gets, replica.gets)
+		}
+	}
+
+	// the nearest one is read
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(0, 1)
+	// writes go to primary only
+	if err := s.Put("b", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put b: %s", err)
+	}
+	if _, err := m2.Head("b"); err == nil {
+		t.Fatalf("b should not be written into replica")
+	}
+	// missing in replica (not replicated yet), which is still healthy
+	if err := get("b"); err != nil {
+		t.Fatalf("get b: %s", err)
+	}
+	expect(1, 2)
+	if !s.endpoints[1].healthy {
+		t.Fatalf("replica should be healthy")
+	}
+
+	// the region of replica is in outage
+	atomic.StoreInt32(&replica.down, 1)
+	failovers := testutil.ToFloat64(endpointFailovers.WithLabelValues("primary"))
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(2, 3)
+	if v := testutil.ToFloat64(endpointFailovers.WithLabelValues("primary")); v != failovers+1 {
+		t.Fatalf("failovers: %v", v)
+	}
+	if v := testutil.ToFloat64(endpointUp.WithLabelValues("replica")); v != 0 {
+		t.Fatalf("replica should be down: %v", v)
+	}
+	// deprioritized, so it's not tried first
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(3, 3)
+	s.probe()
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(4, 3)
+
+	// recovered after a probe
+	atomic.StoreInt32(&replica.down, 0)
+	s.probe()
+	if v := testutil.ToFloat64(endpointUp.WithLabelValues("replica")); v != 1 {
+		t.Fatalf("replica should be up: %v", v)
+	}
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(4, 4)
+
+	// all of them in outage, the error of the first one is returned
+	atomic.StoreInt32(&primary.down, 1)
+	atomic.StoreInt32(&replica.down, 1)
+	if err := get("a"); err == nil || isNotFound(err) {
+		t.Fatalf("get a should fail: %v", err)
+	}
+
+	// a resolver reading from primary only
+	atomic.StoreInt32(&primary.down, 0)
+	atomic.StoreInt32(&replica.down, 0)
+	s = WithEndpoints(primary, []ObjectStorage{replica}, func(key string, eps []EndpointStatus) []int {
+		return []int{0}
+	}, 0).(*endpointsStore)
+	if err := get("a"); err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	expect(6, 5)
+}
+
+func TestNearestEndpoints(t *testing.T) {
+	eps := []EndpointStatus{{Name: "a", Latency: time.Millisecond * 50}, {Name: "b"}, {Name: "c", Latency: time.Millisecond}, {Name: "d"}}
+	order := NearestEndpoints("key", eps)
+	for i, expected := range []int{2, 0, 1, 3} {
+		if order[i] != expected {
+			t.Fatalf("expect %v but got %v", []int{2, 0, 1, 3}, order)
+		}
+	}
+}
@@ -74,7 +74,7 @@ func newEos(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &eos{s3client{bucket, s3.New(ses), ses}}, nil
+	return &eos{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
@@ -0,0 +1,122 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var fallbackReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "object_fallback_reads",
+	Help: "Reads served by the fallback object storage, by the failure of the primary one (missing or unavailable).",
+}, []string{"method", "reason"})
+
+type fallbackStore struct {
+	ObjectStorage
+	secondary ObjectStorage
+}
+
+// WithFallback returns an object storage that reads an object from secondary (e.g. a replica in
+// another region) when it can't be read from primary, all the other requests go to primary.
+func WithFallback(primary, secondary ObjectStorage) ObjectStorage {
+	_ = prometheus.Register(fallbackReads)
+	return &fallbackStore{primary, secondary}
+}
+
+func (s *fallbackStore) String() string {
+	return s.ObjectStorage.String()
+}
+
+// fallback is called after a read of key failed with err in primary, returns the error of primary if
+// the secondary fails too. An object missing in primary but found in secondary is warned, since it's
+// either not replicated yet or lost in primary.
+func (s *fallbackStore) fallback(method, key string, err error, read func() error) error {
+	reason := "unavailable"
+	if isNotFound(err) {
+		reason = "missing"
+	}
+	if err2 := read(); err2 != nil {
+		if reason == "missing" && isNotFound(err2) {
+			logger.Errorf("%s is missing in both %s and %s", key, s.ObjectStorage, s.secondary)
+		} else {
+			logger.Debugf("%s %s from %s: %s", method, key, s.secondary, err2)
+		}
+		return err
+	}
+	if reason == "missing" {
+		logger.Warnf("%s is missing in %s, read it from %s", key, s.ObjectStorage, s.secondary)
+	} else {
+		logger.Debugf("%s %s from %s: %s", method, key, s.secondary, err)
+	}
+	fallbackReads.WithLabelValues(method, reason).Inc()
+	return nil
+}
+
+func (s *fallbackStore) Head(key string) (Object, error) {
+	o, err := s.ObjectStorage.Head(key)
+	if err != nil {
+		err = s.fallback("HEAD", key, err, func() (e error) {
+			o, e = s.secondary.Head(key)
+			return
+		})
+	}
+	return o, err
+}
+
+func (s *fallbackStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key, off, limit)
+}
+
+// GetWithContext falls back only if the request fails, not the failures when reading the body.
+func (s *fallbackStore) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	in, err := GetWithContext(ctx, s.ObjectStorage, key, off, limit)
+	if err != nil && ctx.Err() == nil {
+		err = s.fallback("GET", key, err, func() (e error) {
+			in, e = GetWithContext(ctx, s.secondary, key, off, limit)
+			return
+		})
+	}
+	return in, err
+}
+
+// PutIfAbsent writes into primary only, the objects only in secondary are not checked.
+func (s *fallbackStore) PutIfAbsent(key string, in io.Reader) error {
+	return PutIfAbsent(s.ObjectStorage, key, in)
+}
+
+// Append writes into primary only, an object only in secondary can't be appended.
+func (s *fallbackStore) Append(key string, off int64, in io.Reader) error {
+	return Append(s.ObjectStorage, key, off, in)
+}
+
+// DeleteMany deletes the objects from primary only, the same as the other writes.
+func (s *fallbackStore) DeleteMany(keys []string) map[string]error {
+	return DeleteMany(s.ObjectStorage, keys)
+}
+
+// UpdateCredentials updates the credentials of primary, the secondary one has its own credentials.
+func (s *fallbackStore) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(s.ObjectStorage, accessKey, secretKey, token)
+}
+
+func (s *fallbackStore) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(s.ObjectStorage, key, expire)
+}
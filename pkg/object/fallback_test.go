@@ -0,0 +1,95 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// unavailableStore fails all the reads as a primary storage in outage.
+type unavailableStore struct {
+	ObjectStorage
+}
+
+func (s *unavailableStore) Head(key string) (Object, error) {
+	return nil, errors.New("503 Service Unavailable")
+}
+
+func (s *unavailableStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return nil, errors.New("503 Service Unavailable")
+}
+
+func TestFallback(t *testing.T) {
+	primary, _ := CreateStorage("mem", "", "", "")
+	secondary, _ := CreateStorage("mem", "", "", "")
+	_ = secondary.Put("a", bytes.NewReader([]byte("hello")))
+	s := WithFallback(primary, secondary)
+
+	// missing in primary
+	missing := testutil.ToFloat64(fallbackReads.WithLabelValues("GET", "missing"))
+	r, err := s.Get("a", 1, 2)
+	if err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "el" {
+		t.Fatalf("expect el but got %q", d)
+	}
+	if v := testutil.ToFloat64(fallbackReads.WithLabelValues("GET", "missing")); v != missing+1 {
+		t.Fatalf("missing reads: %v", v)
+	}
+	if o, err := s.Head("a"); err != nil || o.Size() != 5 {
+		t.Fatalf("head a: %v %s", o, err)
+	}
+
+	// missing in both
+	if _, err = s.Get("b", 0, -1); err == nil || !isNotFound(err) {
+		t.Fatalf("get b should be not found: %v", err)
+	}
+
+	// writes go to primary only
+	_ = s.Put("c", bytes.NewReader([]byte("world")))
+	if _, err = secondary.Head("c"); err == nil {
+		t.Fatalf("c should not be written into secondary")
+	}
+	if _, err = primary.Head("c"); err != nil {
+		t.Fatalf("head c from primary: %s", err)
+	}
+
+	// primary unavailable
+	s = WithFallback(&unavailableStore{primary}, secondary)
+	unavailable := testutil.ToFloat64(fallbackReads.WithLabelValues("GET", "unavailable"))
+	r, err = s.Get("a", 0, -1)
+	if err != nil {
+		t.Fatalf("get a: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "hello" {
+		t.Fatalf("expect hello but got %q", d)
+	}
+	if v := testutil.ToFloat64(fallbackReads.WithLabelValues("GET", "unavailable")); v != unavailable+1 {
+		t.Fatalf("unavailable reads: %v", v)
+	}
+	// the error of primary is returned if secondary fails too
+	if _, err = s.Get("b", 0, -1); err == nil || isNotFound(err) {
+		t.Fatalf("get b should fail with the error of primary: %v", err)
+	}
+}
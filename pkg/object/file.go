@@ -25,6 +25,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
@@ -36,9 +37,18 @@ const (
 	dirSuffix = "/"
 )
 
+// the temporary files written by file, sftp and hdfs, they are renamed once complete
+var tempPattern = regexp.MustCompile(`^\..+\.tmp(\.?\d+)?$`)
+
+// IsTempKey returns whether key is a temporary file, which is left behind if the writer is interrupted.
+func IsTempKey(key string) bool {
+	return tempPattern.MatchString(path.Base(key))
+}
+
 type filestore struct {
 	DefaultObjectStorage
-	root string
+	root      string
+	keepLinks bool // list symlinks as they are, see KeepSymlinks
 }
 
 func (d *filestore) String() string {
@@ -58,7 +68,11 @@ func (d *filestore) path(key string) string {
 func (d *filestore) Head(key string) (Object, error) {
 	p := d.path(key)
 
-	fi, err := os.Stat(p)
+	stat := os.Stat
+	if d.keepLinks {
+		stat = os.Lstat
+	}
+	fi, err := stat(p)
 	if err != nil {
 		return nil, err
 	}
@@ -148,6 +162,62 @@ func (d *filestore) Put(key string, in io.Reader) error {
 	return err
 }
 
+// Append writes into the file directly, the readers may see the data partially appended.
+func (d *filestore) Append(key string, off int64, in io.Reader) error {
+	p := d.path(key)
+	flags := os.O_WRONLY | os.O_APPEND
+	if off == 0 {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(p, flags, 0644)
+	if err != nil && off == 0 && os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(p), os.FileMode(0755)); err != nil {
+			return err
+		}
+		f, err = os.OpenFile(p, flags, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err != nil {
+		_ = f.Close()
+		return err
+	} else if fi.Size() != off {
+		_ = f.Close()
+		return fmt.Errorf("append %s at %d: the object has %d bytes", key, off, fi.Size())
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	if _, err = io.CopyBuffer(f, in, *buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *filestore) Symlink(target, key string) error {
+	p := d.path(key)
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".tmp"+strconv.Itoa(rand.Int()))
+	err := os.Symlink(target, tmp)
+	if err != nil && os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(p), os.FileMode(0755)); err != nil {
+			return err
+		}
+		err = os.Symlink(target, tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *filestore) Readlink(key string) (string, error) {
+	return os.Readlink(d.path(key))
+}
+
 func (d *filestore) Copy(dst, src string) error {
 	r, err := d.Get(src, 0, -1)
 	if err != nil {
@@ -166,7 +236,7 @@ func (d *filestore) Delete(key string) error {
 }
 
 // walk recursively descends path, calling w.
-func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+func walk(path string, info os.FileInfo, followLinks bool, walkFn filepath.WalkFunc) error {
 	err := walkFn(path, info, nil)
 	if err != nil {
 		if info.IsDir() && err == filepath.SkipDir {
@@ -179,7 +249,7 @@ func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
 		return nil
 	}
 
-	entries, err := readDirSorted(path)
+	entries, err := readDirSorted(path, followLinks)
 	if err != nil {
 		return walkFn(path, info, err)
 	}
@@ -191,7 +261,7 @@ func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
 		}
 		in, err := e.Info()
 		if err == nil {
-			err = walk(p, in, walkFn)
+			err = walk(p, in, followLinks, walkFn)
 		}
 		if err != nil && err != filepath.SkipDir && !os.IsNotExist(err) {
 			return err
@@ -207,11 +277,16 @@ func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
 // large directories Walk can be inefficient.
 // Walk always follow symbolic links.
 func Walk(root string, walkFn filepath.WalkFunc) error {
+	return walkTree(root, true, walkFn)
+}
+
+// walkTree is the same as Walk, the symlinks under root are passed to walkFn as they are if followLinks is false.
+func walkTree(root string, followLinks bool, walkFn filepath.WalkFunc) error {
 	info, err := os.Stat(root)
 	if err != nil {
 		err = walkFn(root, nil, err)
 	} else {
-		err = walk(root, info, walkFn)
+		err = walk(root, info, followLinks, walkFn)
 	}
 	if err == filepath.SkipDir {
 		return nil
@@ -238,18 +313,19 @@ func (m *mEntry) Info() (os.FileInfo, error) {
 
 // readDirSorted reads the directory named by dirname and returns
 // a sorted list of directory entries.
-func readDirSorted(dirname string) ([]os.DirEntry, error) {
+func readDirSorted(dirname string, followLinks bool) ([]os.DirEntry, error) {
 	f, err := os.Open(dirname)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 	entries, err := f.ReadDir(-1)
-	for i, e := range entries {
+	n := 0
+	for _, e := range entries {
 		if e.IsDir() {
-			entries[i] = &mEntry{e, e.Name() + dirSuffix, nil}
-		} else if !e.Type().IsRegular() {
-			// follow symlink
+			e = &mEntry{e, e.Name() + dirSuffix, nil}
+		} else if !e.Type().IsRegular() && (followLinks || e.Type()&os.ModeSymlink == 0) {
+			// follow symlink, unless they are listed as they are
 			fi, err := os.Stat(filepath.Join(dirname, e.Name()))
 			if err != nil {
 				logger.Warnf("skip broken symlink %s: %s", filepath.Join(dirname, e.Name()), err)
@@ -259,9 +335,12 @@ func readDirSorted(dirname string) ([]os.DirEntry, error) {
 			if fi.IsDir() {
 				name = e.Name() + dirSuffix
 			}
-			entries[i] = &mEntry{e, name, fi}
+			e = &mEntry{e, name, fi}
 		}
+		entries[n] = e
+		n++
 	}
+	entries = entries[:n]
 	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
 	return entries, err
 }
@@ -281,7 +360,7 @@ func (d *filestore) ListAll(prefix, marker string) (<-chan Object, error) {
 			walkRoot = path.Dir(d.root)
 		}
 
-		_ = Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		_ = walkTree(walkRoot, !d.keepLinks, func(path string, info os.FileInfo, err error) error {
 			if runtime.GOOS == "windows" {
 				path = strings.Replace(path, "\\", "/", -1)
 			}
@@ -0,0 +1,102 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrBuf calls f with a buffer large enough for the result, which is ERANGE if the buffer is
+// too small, or the size of result when it's empty.
+func xattrBuf(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := f(buf)
+		if err == syscall.ERANGE { // it grows in between
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func (d *filestore) GetXattrs(key string) (map[string][]byte, error) {
+	p := d.path(key)
+	names, err := xattrBuf(func(buf []byte) (int, error) { return unix.Listxattr(p, buf) })
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n := string(name)
+		value, err := xattrBuf(func(buf []byte) (int, error) { return unix.Getxattr(p, n, buf) })
+		if err == syscall.ENODATA { // removed in between
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get xattr %s of %s: %s", n, key, err)
+		}
+		attrs[n] = value
+	}
+	return attrs, nil
+}
+
+func (d *filestore) SetXattrs(key string, attrs map[string][]byte) error {
+	old, err := d.GetXattrs(key)
+	if err != nil {
+		return err
+	}
+	p := d.path(key)
+	for name := range old {
+		if _, ok := attrs[name]; !ok {
+			if err = unix.Removexattr(p, name); err != nil && err != syscall.ENODATA {
+				return fmt.Errorf("remove xattr %s of %s: %s", name, key, err)
+			}
+		}
+	}
+	for name, value := range attrs {
+		if v, ok := old[name]; ok && bytes.Equal(v, value) {
+			continue
+		}
+		if err = unix.Setxattr(p, name, value, 0); err != nil {
+			return fmt.Errorf("set xattr %s of %s: %s", name, key, err)
+		}
+	}
+	return nil
+}
@@ -22,7 +22,10 @@ package object
 import (
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -30,18 +33,38 @@ import (
 	"github.com/pkg/errors"
 
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 
 	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
+// objects larger than this are uploaded in chunks by resumable uploads, each chunk is retried on failure
+const gsChunkSize = 16 << 20
+
 type gs struct {
 	DefaultObjectStorage
-	client    *storage.Client
-	bucket    string
-	region    string
-	pageToken string
+	client      *storage.Client
+	bucket      string
+	region      string
+	userProject string
+	pageToken   string
+	checksum    bool // send CRC32C in Put
+}
+
+func (g *gs) SetUploadChecksum(enabled bool) {
+	g.checksum = enabled
+}
+
+// handle returns the bucket, which bills the requests to the user project for requester-pays buckets.
+func (g *gs) handle() *storage.BucketHandle {
+	b := g.client.Bucket(g.bucket)
+	if g.userProject != "" {
+		b = b.UserProject(g.userProject)
+	}
+	return b
 }
 
 func (g *gs) String() string {
@@ -78,7 +101,7 @@ func (g *gs) Create() error {
 		}
 	}
 
-	err := g.client.Bucket(g.bucket).Create(ctx, projectID, &storage.BucketAttrs{
+	err := g.handle().Create(ctx, projectID, &storage.BucketAttrs{
 		Name:         g.bucket,
 		StorageClass: "regional",
 		Location:     g.region,
@@ -90,7 +113,7 @@ func (g *gs) Create() error {
 }
 
 func (g *gs) Head(key string) (Object, error) {
-	attrs, err := g.client.Bucket(g.bucket).Object(key).Attrs(ctx)
+	attrs, err := g.handle().Object(key).Attrs(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +127,11 @@ func (g *gs) Head(key string) (Object, error) {
 }
 
 func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
-	reader, err := g.client.Bucket(g.bucket).Object(key).NewRangeReader(ctx, off, limit)
+	return g.GetWithContext(ctx, key, off, limit)
+}
+
+func (g *gs) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	reader, err := g.handle().Object(key).NewRangeReader(ctx, off, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +139,16 @@ func (g *gs) Get(key string, off, limit int64) (io.ReadCloser, error) {
 }
 
 func (g *gs) Put(key string, data io.Reader) error {
-	writer := g.client.Bucket(g.bucket).Object(key).NewWriter(ctx)
+	writer := g.handle().Object(key).NewWriter(ctx)
+	writer.ChunkSize = gsChunkSize
+	if ins, ok := data.(io.ReadSeeker); ok && g.checksum {
+		h := crc32.New(crc32c)
+		if err := hashContent(ins, h); err != nil {
+			return err
+		}
+		writer.CRC32C = h.Sum32()
+		writer.SendCRC32C = true
+	}
 	_, err := io.Copy(writer, data)
 	if err != nil {
 		return err
@@ -121,14 +157,14 @@ func (g *gs) Put(key string, data io.Reader) error {
 }
 
 func (g *gs) Copy(dst, src string) error {
-	srcObj := g.client.Bucket(g.bucket).Object(src)
-	dstObj := g.client.Bucket(g.bucket).Object(dst)
+	srcObj := g.handle().Object(src)
+	dstObj := g.handle().Object(dst)
 	_, err := dstObj.CopierFrom(srcObj).Run(ctx)
 	return err
 }
 
 func (g *gs) Delete(key string) error {
-	if err := g.client.Bucket(g.bucket).Object(key).Delete(ctx); err != storage.ErrObjectNotExist {
+	if err := g.handle().Object(key).Delete(ctx); err != storage.ErrObjectNotExist {
 		return err
 	}
 	return nil
@@ -139,7 +175,7 @@ func (g *gs) List(prefix, marker string, limit int64) ([]Object, error) {
 		// last page
 		return nil, nil
 	}
-	objectIterator := g.client.Bucket(g.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	objectIterator := g.handle().Objects(ctx, &storage.Query{Prefix: prefix})
 	pager := iterator.NewPager(objectIterator, int(limit), g.pageToken)
 	var entries []*storage.ObjectAttrs
 	nextPageToken, err := pager.NextPage(&entries)
@@ -171,11 +207,39 @@ func newGS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		region = hostParts[1]
 	}
 
-	client, err := storage.NewClient(ctx)
+	// service account key in JSON, or the path of it, application default credentials are used if absent
+	var cred *google.Credentials
+	if secretKey != "" {
+		data := []byte(secretKey)
+		if !strings.HasPrefix(strings.TrimSpace(secretKey), "{") {
+			if data, err = ioutil.ReadFile(secretKey); err != nil {
+				return nil, errors.Errorf("read service account key %s: %s", secretKey, err)
+			}
+		}
+		if cred, err = google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl); err != nil {
+			return nil, errors.Errorf("invalid service account key: %s", err)
+		}
+	}
+	var opts []option.ClientOption
+	if customTransport {
+		var hc *http.Client
+		hctx := context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+		if cred != nil {
+			hc = oauth2.NewClient(hctx, cred.TokenSource)
+		} else if hc, err = google.DefaultClient(hctx, storage.ScopeFullControl); err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(hc))
+	} else if cred != nil {
+		opts = append(opts, option.WithCredentials(cred))
+	}
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return &gs{client: client, bucket: bucket, region: region}, nil
+	// gs://bucket?user_project=my-project for requester-pays buckets
+	userProject := uri.Query().Get("user_project")
+	return &gs{client: client, bucket: bucket, region: region, userProject: userProject}, nil
 }
 
 func init() {
@@ -161,6 +161,30 @@ func (h *hdfsclient) Put(key string, in io.Reader) error {
 	return h.c.Rename(tmp, path)
 }
 
+func (h *hdfsclient) Append(key string, off int64, in io.Reader) error {
+	path := h.path(key)
+	var f *hdfs.FileWriter
+	fi, err := h.c.Stat(path)
+	if err != nil && off == 0 && os.IsNotExist(err) {
+		_ = h.c.MkdirAll(filepath.Dir(path), 0755)
+		f, err = h.c.CreateFile(path, 3, 128<<20, 0755)
+	} else if err == nil && fi.Size() != off {
+		return fmt.Errorf("append %s at %d: the object has %d bytes", key, off, fi.Size())
+	} else if err == nil {
+		f, err = h.c.Append(path)
+	}
+	if err != nil {
+		return err
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	if _, err = io.CopyBuffer(f, in, *buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func (h *hdfsclient) Delete(key string) error {
 	err := h.c.Remove(h.path(key))
 	if err != nil && os.IsNotExist(err) {
@@ -17,6 +17,7 @@
 package object
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -90,3 +91,65 @@ type ObjectStorage interface {
 	// ListUploads lists existing multipart uploads.
 	ListUploads(marker string) ([]*PendingPart, string, error)
 }
+
+// ContextGetter is implemented by object storages that can abort an in-flight
+// request (and the underlying connection) when the context is done.
+type ContextGetter interface {
+	GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error)
+}
+
+// BatchDeleter is implemented by object storages that can delete many objects in one request.
+type BatchDeleter interface {
+	// DeleteMany deletes the objects and returns the errors of the ones failed to be deleted.
+	DeleteMany(keys []string) map[string]error
+}
+
+// CredentialsUpdater is implemented by object storages that can replace the credentials at
+// runtime, e.g. to refresh the temporary credentials before they expire.
+type CredentialsUpdater interface {
+	// UpdateCredentials verifies the new credentials and uses them for the following requests,
+	// the old ones are kept if the new ones are invalid.
+	UpdateCredentials(accessKey, secretKey, token string) error
+}
+
+// ConditionalPutter is implemented by object storages that can put an object only if it doesn't
+// exist in one request (e.g. If-None-Match: * of S3).
+type ConditionalPutter interface {
+	// PutIfAbsent fails with an error matching os.ErrExist if the object exists already.
+	PutIfAbsent(key string, in io.Reader) error
+}
+
+// ServerSideEncrypter is implemented by object storages that can encrypt the objects at rest
+// with the keys managed by themselves or a KMS, e.g. SSE-S3 and SSE-KMS of S3.
+type ServerSideEncrypter interface {
+	SetServerSideEncryption(sse, kmsKeyID string) error
+}
+
+// ChecksumUploader is implemented by object storages that can send the checksum of the content
+// (Content-MD5, or CRC32C for GCS) in Put, so that the data corrupted in transit is rejected by
+// them, e.g. OSS, COS and GCS. S3 (and compatible ones) always send Content-MD5 by the SDK.
+type ChecksumUploader interface {
+	SetUploadChecksum(enabled bool)
+}
+
+// Copier is implemented by object storages that can copy an object inside the same bucket on
+// the server side, without transferring the data through the client.
+type Copier interface {
+	Copy(dst, src string) error
+}
+
+// Presigner is implemented by object storages that can make a URL for others to read an
+// object without the credentials.
+type Presigner interface {
+	Presign(key string, expire time.Duration) (string, error)
+}
+
+// Appender is implemented by object storages that can append data to an object in place
+// (e.g. the append blobs of Azure), so an object can grow without being written again. The blocks
+// of slices are not appended, since the length of a block is a part of its key.
+type Appender interface {
+	// Append writes the data at the end of the object, which must be off bytes long, or creates
+	// the object if off is 0. It fails if the object has another length, so an append retried
+	// after it succeeded is not written twice.
+	Append(key string, off int64, in io.Reader) error
+}
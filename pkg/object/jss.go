@@ -74,7 +74,7 @@ func newJSS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, err
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &jss{s3client{bucket, s3.New(ses), ses}}, nil
+	return &jss{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
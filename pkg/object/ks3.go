@@ -21,6 +21,7 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -70,6 +71,10 @@ func (s *ks3) Head(key string) (Object, error) {
 }
 
 func (s *ks3) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(ctx, key, off, limit)
+}
+
+func (s *ks3) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
 	if off > 0 || limit > 0 {
 		var r string
@@ -80,8 +85,9 @@ func (s *ks3) Get(key string, off, limit int64) (io.ReadCloser, error) {
 		}
 		params.Range = &r
 	}
-	resp, err := s.s3.GetObject(params)
-	if err != nil {
+	req, resp := s.s3.GetObjectRequest(params)
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	if err := req.Send(); err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
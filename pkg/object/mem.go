@@ -30,11 +30,12 @@ import (
 )
 
 type mobj struct {
-	data  []byte
-	mtime time.Time
-	mode  os.FileMode
-	owner string
-	group string
+	data   []byte
+	mtime  time.Time
+	mode   os.FileMode
+	owner  string
+	group  string
+	xattrs map[string][]byte
 }
 
 type memStore struct {
@@ -110,6 +111,93 @@ func (m *memStore) Put(key string, in io.Reader) error {
 	return nil
 }
 
+func (m *memStore) PutIfAbsent(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if key == "" {
+		return errors.New("object key cannot be empty")
+	}
+	if _, ok := m.objects[key]; ok {
+		return fmt.Errorf("put %s: %w", key, os.ErrExist)
+	}
+	m.objects[key] = &mobj{data: data, mtime: time.Now()}
+	return nil
+}
+
+func (m *memStore) Append(key string, off int64, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if key == "" {
+		return errors.New("object key cannot be empty")
+	}
+	o, ok := m.objects[key]
+	if !ok && off == 0 {
+		m.objects[key] = &mobj{data: data, mtime: time.Now()}
+		return nil
+	}
+	if !ok {
+		return errors.New("not exists")
+	}
+	if int64(len(o.data)) != off {
+		return fmt.Errorf("append %s at %d: the object has %d bytes", key, off, len(o.data))
+	}
+	m.objects[key] = &mobj{data: append(o.data[:off:off], data...), mtime: time.Now(), mode: o.mode}
+	return nil
+}
+
+// Symlink keeps the target as the content, and marks the object as symlink.
+func (m *memStore) Symlink(target, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if key == "" {
+		return errors.New("object key cannot be empty")
+	}
+	m.objects[key] = &mobj{data: []byte(target), mtime: time.Now(), mode: os.ModeSymlink | 0777}
+	return nil
+}
+
+func (m *memStore) Readlink(key string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return "", errors.New("not exists")
+	}
+	if o.mode&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("%s is not a symlink", key)
+	}
+	return string(o.data), nil
+}
+
+func (m *memStore) GetXattrs(key string) (map[string][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, errors.New("not exists")
+	}
+	return o.xattrs, nil
+}
+
+func (m *memStore) SetXattrs(key string, attrs map[string][]byte) error {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return errors.New("not exists")
+	}
+	o.xattrs = attrs
+	return nil
+}
+
 func (m *memStore) Copy(dst, src string) error {
 	d, err := m.Get(src, 0, -1)
 	if err != nil {
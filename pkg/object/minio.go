@@ -79,7 +79,8 @@ func newMinio(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		bucket = bucket[len("minio/"):]
 	}
 	bucket = strings.Split(bucket, "/")[0]
-	return &minio{s3client{bucket, s3.New(ses), ses}}, nil
+	creds := swappable(ses)
+	return &minio{s3client{bucket, s3.New(ses), ses, creds, nil}}, nil
 }
 
 func init() {
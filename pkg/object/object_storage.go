@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -83,6 +84,56 @@ type FileSystem interface {
 	Chown(path string, owner, group string) error
 }
 
+// SymlinkStore is implemented by the storages which can keep symlinks as they are, the
+// object storages keep the target in the metadata of an object.
+type SymlinkStore interface {
+	// Symlink creates a symlink at key which points to target, the existing one is replaced.
+	Symlink(target, key string) error
+	// Readlink returns the target of the symlink at key, or an error if it's not a symlink.
+	Readlink(key string) (string, error)
+}
+
+// SupportSymlink returns whether the storage can keep symlinks.
+func SupportSymlink(store ObjectStorage) bool {
+	switch s := store.(type) {
+	case *withPrefix:
+		return SupportSymlink(s.os)
+	case SymlinkStore:
+		return true
+	}
+	return false
+}
+
+// XattrStore is implemented by the storages which can keep the extended attributes of files, the
+// object storages keep them in the metadata of an object, which is replaced when it's put again.
+type XattrStore interface {
+	// GetXattrs returns the extended attributes of the file at key.
+	GetXattrs(key string) (map[string][]byte, error)
+	// SetXattrs replaces the extended attributes of the file at key with attrs.
+	SetXattrs(key string, attrs map[string][]byte) error
+}
+
+// SupportXattrs returns whether the storage can keep extended attributes.
+func SupportXattrs(store ObjectStorage) bool {
+	switch s := store.(type) {
+	case *withPrefix:
+		return SupportXattrs(s.os)
+	case XattrStore:
+		return true
+	}
+	return false
+}
+
+// KeepSymlinks makes a file store list symlinks as they are, rather than following them.
+func KeepSymlinks(store ObjectStorage) {
+	switch s := store.(type) {
+	case *withPrefix:
+		KeepSymlinks(s.os)
+	case *filestore:
+		s.keepLinks = true
+	}
+}
+
 var notSupported = errors.New("not supported")
 
 type DefaultObjectStorage struct{}
@@ -121,6 +172,180 @@ func (s DefaultObjectStorage) ListAll(prefix, marker string) (<-chan Object, err
 	return nil, notSupported
 }
 
+// Presign returns a URL to read the object, which is valid for expire.
+func Presign(store ObjectStorage, key string, expire time.Duration) (string, error) {
+	if p, ok := store.(Presigner); ok {
+		return p.Presign(key, expire)
+	}
+	return "", notSupported
+}
+
+// PutIfAbsent writes the object only if it doesn't exist, otherwise it fails with an error matching
+// os.ErrExist. The storages that can't write conditionally are checked by Head before Put, which
+// is racy, so it's a best-effort check to catch the bugs overwriting objects.
+func PutIfAbsent(store ObjectStorage, key string, in io.Reader) error {
+	if cp, ok := store.(ConditionalPutter); ok {
+		return cp.PutIfAbsent(key, in)
+	}
+	if _, err := store.Head(key); err == nil {
+		return fmt.Errorf("put %s: %w", key, os.ErrExist)
+	} else if !isNotFound(err) && err != notSupported {
+		return err
+	}
+	return store.Put(key, in)
+}
+
+// Append appends the data to the object which is off bytes long, or creates it if off is 0. The
+// storages that can't append in place return an error matching IsNotSupported, the callers should
+// write the whole object again instead.
+func Append(store ObjectStorage, key string, off int64, in io.Reader) error {
+	if a, ok := store.(Appender); ok {
+		return a.Append(key, off, in)
+	}
+	return notSupported
+}
+
+// IsNotSupported tells whether err means the operation is not supported by the storage.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, notSupported)
+}
+
+// UpdateCredentials replaces the credentials of the storage if it supports it. The requests in flight
+// are finished with the old credentials.
+func UpdateCredentials(store ObjectStorage, accessKey, secretKey, token string) error {
+	if cu, ok := store.(CredentialsUpdater); ok {
+		return cu.UpdateCredentials(accessKey, secretKey, token)
+	}
+	return notSupported
+}
+
+// SetServerSideEncryption asks the storage to encrypt the objects written by it at rest, which is
+// independent of the client-side encryption of JuiceFS.
+func SetServerSideEncryption(store ObjectStorage, sse, kmsKeyID string) error {
+	if e, ok := store.(ServerSideEncrypter); ok {
+		return e.SetServerSideEncryption(sse, kmsKeyID)
+	}
+	return notSupported
+}
+
+// SetUploadChecksum asks the storage to send the checksum of the content in Put.
+func SetUploadChecksum(store ObjectStorage, enabled bool) error {
+	if c, ok := store.(ChecksumUploader); ok {
+		c.SetUploadChecksum(enabled)
+		return nil
+	}
+	return notSupported
+}
+
+// unwrapPrefix returns the underlying storage of store and the prefix added to the keys.
+func unwrapPrefix(store ObjectStorage) (ObjectStorage, string) {
+	var prefix string
+	for {
+		p, ok := store.(*withPrefix)
+		if !ok {
+			return store, prefix
+		}
+		prefix = p.prefix + prefix
+		store = p.os
+	}
+}
+
+// ServerSideCopy copies srcKey of src into dstKey of dst on the server side, if both of them are
+// in the same bucket (maybe with different prefixes) and the storage can copy objects, otherwise
+// it returns an error of not supported, and the data should be copied through the client.
+func ServerSideCopy(dst ObjectStorage, dstKey string, src ObjectStorage, srcKey string) error {
+	ds, dp := unwrapPrefix(dst)
+	ss, sp := unwrapPrefix(src)
+	c, ok := ds.(Copier)
+	if !ok || ds != ss && ds.String() != ss.String() {
+		return notSupported
+	}
+	return c.Copy(dp+dstKey, sp+srcKey)
+}
+
+// DeleteMany deletes the objects in batches if the storage supports it, or one by one. The errors of
+// the objects failed to be deleted are returned, which is empty if all of them are deleted.
+func DeleteMany(store ObjectStorage, keys []string) map[string]error {
+	if bd, ok := store.(BatchDeleter); ok {
+		return bd.DeleteMany(keys)
+	}
+	return deleteEach(store, keys)
+}
+
+func deleteEach(store ObjectStorage, keys []string) map[string]error {
+	errs := make(map[string]error)
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+// GetWithContext reads an object, the request is canceled once ctx is done. If the
+// storage can not cancel the request, the connection is closed as soon as possible.
+func GetWithContext(ctx context.Context, store ObjectStorage, key string, off, limit int64) (io.ReadCloser, error) {
+	if cg, ok := store.(ContextGetter); ok {
+		return cg.GetWithContext(ctx, key, off, limit)
+	}
+	if ctx.Done() == nil {
+		return store.Get(key, off, limit)
+	}
+	type result struct {
+		in  io.ReadCloser
+		err error
+	}
+	done := make(chan result, 1)
+	r := &ctxReader{ctx: ctx, closed: make(chan struct{})}
+	// the same goroutine closes the body when ctx is done, to unblock pending reads
+	go func() {
+		in, err := store.Get(key, off, limit)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		r.ReadCloser = in
+		done <- result{r, nil}
+		select {
+		case <-ctx.Done():
+			_ = r.Close()
+		case <-r.closed:
+		}
+	}()
+	select {
+	case res := <-done:
+		return res.in, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type ctxReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && r.ctx.Err() != nil {
+		err = r.ctx.Err()
+	}
+	return n, err
+}
+
+func (r *ctxReader) Close() (err error) {
+	r.once.Do(func() {
+		close(r.closed)
+		err = r.ReadCloser.Close()
+	})
+	return
+}
+
 type Creator func(bucket, accessKey, secretKey string) (ObjectStorage, error)
 
 var storages = make(map[string]Creator)
@@ -0,0 +1,393 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package objecttest provides an in-memory object storage for the tests of the layers above it,
+// where errors and latency can be injected to exercise their retry and fallback logic.
+package objecttest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// Op is an operation of object storage that faults can be injected into.
+type Op string
+
+const (
+	OpCreate    Op = "create"
+	OpGet       Op = "get"
+	OpPut       Op = "put"
+	OpDelete    Op = "delete"
+	OpHead      Op = "head"
+	OpList      Op = "list"      // both List and ListAll
+	OpMultipart Op = "multipart" // CreateMultipartUpload, UploadPart, CompleteUpload and ListUploads
+)
+
+// ErrInjected is the default error returned by the injected faults.
+var ErrInjected = errors.New("injected error")
+
+type obj struct {
+	key   string
+	size  int64
+	mtime time.Time
+}
+
+func (o *obj) Key() string      { return o.key }
+func (o *obj) Size() int64      { return o.size }
+func (o *obj) Mtime() time.Time { return o.mtime }
+func (o *obj) IsDir() bool      { return strings.HasSuffix(o.key, "/") }
+
+type item struct {
+	data  []byte
+	mtime time.Time
+}
+
+type upload struct {
+	key     string
+	parts   map[int][]byte
+	created time.Time
+}
+
+type fault struct {
+	op     Op
+	prefix string
+	err    error
+	size   int // the size of truncated responses
+	times  int // < 0 means forever
+}
+
+// Store is an object storage keeping the objects in memory, which is safe for concurrent use.
+type Store struct {
+	// MinPartSize is the minimum size of parts (except the last one) in multipart uploads.
+	MinPartSize int
+
+	mu      sync.Mutex
+	name    string
+	objects map[string]*item
+	uploads map[string]*upload
+	nextID  int
+	faults  []*fault
+	truncs  []*fault
+	latency time.Duration
+	calls   map[Op]int
+}
+
+// New returns an empty store, the parts of multipart uploads should be at least 5 MiB as S3.
+func New(name string) *Store {
+	return &Store{
+		MinPartSize: 5 << 20,
+		name:        name,
+		objects:     make(map[string]*item),
+		uploads:     make(map[string]*upload),
+		calls:       make(map[Op]int),
+	}
+}
+
+// Fail makes the next times calls of op fail with err for the keys with the prefix (all the keys
+// if it's empty), forever if times is negative. err is ErrInjected if it's nil. The faults are
+// checked in the order they're added.
+func (s *Store) Fail(op Op, prefix string, err error, times int) {
+	if err == nil {
+		err = ErrInjected
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{op: op, prefix: prefix, err: err, times: times})
+}
+
+// Truncate makes the next times Gets of the keys with the prefix return at most size bytes of the
+// requested data without any error, forever if times is negative, like a connection closed early.
+func (s *Store) Truncate(prefix string, size int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncs = append(s.truncs, &fault{op: OpGet, prefix: prefix, size: size, times: times})
+}
+
+// Recover removes all the faults.
+func (s *Store) Recover() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+	s.truncs = nil
+}
+
+// SetLatency makes every call sleep for d before it's served.
+func (s *Store) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Calls returns the number of calls of op, including the failed ones.
+func (s *Store) Calls(op Op) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+// Keys returns the keys of all the objects in order.
+func (s *Store) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// enter counts the call, waits for the latency, and returns the injected error if any, with the
+// lock held if the error is nil.
+func (s *Store) enter(op Op, key string) error {
+	s.mu.Lock()
+	s.calls[op]++
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	s.mu.Lock()
+	if f := match(&s.faults, op, key); f != nil {
+		s.mu.Unlock()
+		return f.err
+	}
+	return nil
+}
+
+// match returns the first fault of op for the key in faults and counts it down, with the lock held.
+func match(faults *[]*fault, op Op, key string) *fault {
+	for i, f := range *faults {
+		if f.op != op || !strings.HasPrefix(key, f.prefix) {
+			continue
+		}
+		if f.times > 0 {
+			if f.times--; f.times == 0 {
+				*faults = append((*faults)[:i], (*faults)[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Store) String() string {
+	return fmt.Sprintf("memtest://%s/", s.name)
+}
+
+func (s *Store) Create() error {
+	if err := s.enter(OpCreate, ""); err != nil {
+		return err
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if err := s.enter(OpGet, key); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if off > int64(len(o.data)) {
+		off = int64(len(o.data))
+	}
+	data := o.data[off:]
+	if limit > 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	if f := match(&s.truncs, OpGet, key); f != nil && f.size < len(data) {
+		data = data[:f.size]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *Store) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if err := s.enter(OpPut, key); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.objects[key] = &item{data, time.Now()}
+	return nil
+}
+
+// PutIfAbsent is counted as OpPut.
+func (s *Store) PutIfAbsent(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if err := s.enter(OpPut, key); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; ok {
+		return fmt.Errorf("put %s: %w", key, os.ErrExist)
+	}
+	s.objects[key] = &item{data, time.Now()}
+	return nil
+}
+
+func (s *Store) Delete(key string) error {
+	if err := s.enter(OpDelete, key); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *Store) Head(key string) (object.Object, error) {
+	if err := s.enter(OpHead, key); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &obj{key, int64(len(o.data)), o.mtime}, nil
+}
+
+// list returns the objects with the prefix after marker in order, with the lock held.
+func (s *Store) list(prefix, marker string) []object.Object {
+	var objs []object.Object
+	for k, o := range s.objects {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			objs = append(objs, &obj{k, int64(len(o.data)), o.mtime})
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key() < objs[j].Key() })
+	return objs
+}
+
+func (s *Store) List(prefix, marker string, limit int64) ([]object.Object, error) {
+	if err := s.enter(OpList, prefix); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	objs := s.list(prefix, marker)
+	if limit > 0 && int64(len(objs)) > limit {
+		objs = objs[:limit]
+	}
+	return objs, nil
+}
+
+func (s *Store) ListAll(prefix, marker string) (<-chan object.Object, error) {
+	if err := s.enter(OpList, prefix); err != nil {
+		return nil, err
+	}
+	objs := s.list(prefix, marker)
+	s.mu.Unlock()
+	ch := make(chan object.Object, len(objs))
+	for _, o := range objs {
+		ch <- o
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (s *Store) CreateMultipartUpload(key string) (*object.MultipartUpload, error) {
+	if err := s.enter(OpMultipart, key); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{key: key, parts: make(map[int][]byte), created: time.Now()}
+	return &object.MultipartUpload{MinPartSize: s.MinPartSize, MaxCount: 10000, UploadID: id}, nil
+}
+
+func (s *Store) UploadPart(key string, uploadID string, num int, body []byte) (*object.Part, error) {
+	if err := s.enter(OpMultipart, key); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		return nil, fmt.Errorf("upload %s of %s: %w", uploadID, key, os.ErrNotExist)
+	}
+	u.parts[num] = append([]byte(nil), body...)
+	return &object.Part{Num: num, Size: len(body), ETag: fmt.Sprintf("%s-%d-%d", uploadID, num, len(body))}, nil
+}
+
+func (s *Store) AbortUpload(key string, uploadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.uploads[uploadID]; ok && u.key == key {
+		delete(s.uploads, uploadID)
+	}
+}
+
+func (s *Store) CompleteUpload(key string, uploadID string, parts []*object.Part) error {
+	if err := s.enter(OpMultipart, key); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		return fmt.Errorf("upload %s of %s: %w", uploadID, key, os.ErrNotExist)
+	}
+	var data []byte
+	for i, p := range parts {
+		body, ok := u.parts[p.Num]
+		if !ok || len(body) != p.Size {
+			return fmt.Errorf("part %d of upload %s is not uploaded", p.Num, uploadID)
+		}
+		if i < len(parts)-1 && len(body) < s.MinPartSize {
+			return fmt.Errorf("part %d of upload %s is smaller than %d", p.Num, uploadID, s.MinPartSize)
+		}
+		data = append(data, body...)
+	}
+	s.objects[key] = &item{data, time.Now()}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *Store) ListUploads(marker string) ([]*object.PendingPart, string, error) {
+	if err := s.enter(OpMultipart, ""); err != nil {
+		return nil, "", err
+	}
+	defer s.mu.Unlock()
+	var pending []*object.PendingPart
+	for id, u := range s.uploads {
+		if u.key > marker {
+			pending = append(pending, &object.PendingPart{Key: u.key, UploadID: id, Created: u.created})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Key < pending[j].Key })
+	return pending, "", nil
+}
+
+var _ object.ObjectStorage = (*Store)(nil)
+var _ object.ConditionalPutter = (*Store)(nil)
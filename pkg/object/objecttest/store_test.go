@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objecttest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+func get(t *testing.T, s *Store, key string, off, limit int64) string {
+	r, err := s.Get(key, off, limit)
+	if err != nil {
+		t.Fatalf("get %s: %s", key, err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
+
+func TestStore(t *testing.T) {
+	s := New("test")
+	if err := s.Create(); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err := s.Get("missing", 0, -1); !os.IsNotExist(err) {
+		t.Fatalf("get missing object: %v", err)
+	}
+	for _, k := range []string{"b/2", "a", "b/1", "b/"} {
+		if err := s.Put(k, strings.NewReader("hello "+k)); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	if d := get(t, s, "a", 0, -1); d != "hello a" {
+		t.Fatalf("get a: %s", d)
+	}
+	if d := get(t, s, "a", 2, 3); d != "llo" {
+		t.Fatalf("get a in range: %s", d)
+	}
+	if d := get(t, s, "a", 10, 3); d != "" {
+		t.Fatalf("get a out of range: %s", d)
+	}
+	if o, err := s.Head("b/1"); err != nil || o.Size() != 9 || o.IsDir() {
+		t.Fatalf("head b/1: %+v %v", o, err)
+	}
+	if o, err := s.Head("b/"); err != nil || !o.IsDir() {
+		t.Fatalf("head b/: %+v %v", o, err)
+	}
+
+	objs, err := s.List("b/", "b/", 1)
+	if err != nil || len(objs) != 1 || objs[0].Key() != "b/1" {
+		t.Fatalf("list: %v %v", objs, err)
+	}
+	ch, err := s.ListAll("", "a")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var keys []string
+	for o := range ch {
+		keys = append(keys, o.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{"b/", "b/1", "b/2"}) {
+		t.Fatalf("list all: %v", keys)
+	}
+
+	if err = s.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err = s.Delete("a"); err != nil {
+		t.Fatalf("delete missing object: %s", err)
+	}
+	if !reflect.DeepEqual(s.Keys(), []string{"b/", "b/1", "b/2"}) {
+		t.Fatalf("keys: %v", s.Keys())
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	s := New("test")
+	s.MinPartSize = 4
+	up, err := s.CreateMultipartUpload("large")
+	if err != nil || up.MinPartSize != 4 {
+		t.Fatalf("create multipart upload: %+v %v", up, err)
+	}
+	p1, _ := s.UploadPart("large", up.UploadID, 1, []byte("ab"))
+	p2, err := s.UploadPart("large", up.UploadID, 2, []byte("cd"))
+	if err != nil {
+		t.Fatalf("upload part: %s", err)
+	}
+	if pending, _, err := s.ListUploads(""); err != nil || len(pending) != 1 || pending[0].UploadID != up.UploadID {
+		t.Fatalf("list uploads: %v %v", pending, err)
+	}
+	if err = s.CompleteUpload("large", up.UploadID, []*object.Part{p1, p2}); err == nil {
+		t.Fatalf("the first part is too small")
+	}
+	// upload the first part again
+	p1, _ = s.UploadPart("large", up.UploadID, 1, []byte("abcd"))
+	if err = s.CompleteUpload("large", up.UploadID, []*object.Part{p1, p2}); err != nil {
+		t.Fatalf("complete upload: %s", err)
+	}
+	if d := get(t, s, "large", 0, -1); d != "abcdcd" {
+		t.Fatalf("get large: %s", d)
+	}
+	if _, err = s.UploadPart("large", up.UploadID, 3, []byte("ef")); err == nil {
+		t.Fatalf("upload part of completed upload")
+	}
+
+	up, _ = s.CreateMultipartUpload("aborted")
+	s.AbortUpload("aborted", up.UploadID)
+	if pending, _, _ := s.ListUploads(""); len(pending) != 0 {
+		t.Fatalf("aborted upload is listed: %v", pending)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := New("test")
+	_ = s.Put("data/1", bytes.NewReader([]byte("1")))
+	_ = s.Put("meta/1", bytes.NewReader([]byte("1")))
+	myErr := errors.New("slow down")
+	s.Fail(OpGet, "data/", myErr, 2)
+	s.Fail(OpPut, "", nil, -1)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Get("data/1", 0, -1); err != myErr {
+			t.Fatalf("get %d: %v", i, err)
+		}
+	}
+	if d := get(t, s, "data/1", 0, -1); d != "1" {
+		t.Fatalf("get after faults: %s", d)
+	}
+	if d := get(t, s, "meta/1", 0, -1); d != "1" {
+		t.Fatalf("get other prefix: %s", d)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Put("x", bytes.NewReader(nil)); err != ErrInjected {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+	if s.Calls(OpGet) != 4 || s.Calls(OpPut) != 5 {
+		t.Fatalf("calls of get %d, put %d", s.Calls(OpGet), s.Calls(OpPut))
+	}
+	s.Recover()
+	if err := s.Put("x", bytes.NewReader(nil)); err != nil {
+		t.Fatalf("put after recovered: %s", err)
+	}
+
+	_ = s.Put("data/2", bytes.NewReader([]byte("hello")))
+	s.Truncate("data/", 2, 1)
+	if d := get(t, s, "data/2", 1, -1); d != "el" {
+		t.Fatalf("get truncated: %s", d)
+	}
+	if d := get(t, s, "data/2", 1, -1); d != "ello" {
+		t.Fatalf("get after truncated: %s", d)
+	}
+
+	s.SetLatency(time.Millisecond * 50)
+	start := time.Now()
+	if _, err := s.Head("x"); err != nil || time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("head with latency: %s in %s", err, time.Since(start))
+	}
+}
@@ -313,7 +313,13 @@ func newOBS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 
 	// Empty proxy url string has no effect
 	// there is a bug in the retry of PUT (did not call Seek(0,0) before retry), so disable the retry here
-	c, err := obs.New(accessKey, secretKey, endpoint, obs.WithProxyUrl(urlString), obs.WithMaxRetryCount(0))
+	var c *obs.ObsClient
+	if customTransport {
+		c, err = obs.New(accessKey, secretKey, endpoint, obs.WithProxyUrl(urlString), obs.WithMaxRetryCount(0),
+			obs.WithHttpTransport(transport))
+	} else {
+		c, err = obs.New(accessKey, secretKey, endpoint, obs.WithProxyUrl(urlString), obs.WithMaxRetryCount(0))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize OBS: %q", err)
 	}
@@ -86,7 +86,7 @@ func newOOS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("OOS session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &oos{s3client{bucket, s3.New(ses), ses}}, nil
+	return &oos{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
@@ -39,8 +39,13 @@ import (
 const ossDefaultRegionID = "cn-hangzhou"
 
 type ossClient struct {
-	client *oss.Client
-	bucket *oss.Bucket
+	client   *oss.Client
+	bucket   *oss.Bucket
+	checksum bool // send Content-MD5 in Put
+}
+
+func (o *ossClient) SetUploadChecksum(enabled bool) {
+	o.checksum = enabled
 }
 
 func (o *ossClient) String() string {
@@ -109,11 +114,18 @@ func (o *ossClient) Get(key string, off, limit int64) (resp io.ReadCloser, err e
 }
 
 func (o *ossClient) Put(key string, in io.Reader) error {
+	var options []oss.Option
 	if ins, ok := in.(io.ReadSeeker); ok {
-		option := oss.Meta(checksumAlgr, generateChecksum(ins))
-		return o.checkError(o.bucket.PutObject(key, in, option))
+		options = append(options, oss.Meta(checksumAlgr, generateChecksum(ins)))
+		if o.checksum {
+			sum, err := contentMD5(ins)
+			if err != nil {
+				return err
+			}
+			options = append(options, oss.ContentMD5(sum))
+		}
 	}
-	return o.checkError(o.bucket.PutObject(key, in))
+	return o.checkError(o.bucket.PutObject(key, in, options...))
 }
 
 func (o *ossClient) Copy(dst, src string) error {
@@ -282,6 +294,17 @@ func (o *ossClient) refreshToken() time.Time {
 	return expire
 }
 
+func ossOptions(securityToken string) []oss.ClientOption {
+	var options []oss.ClientOption
+	if securityToken != "" {
+		options = append(options, oss.SecurityToken(securityToken))
+	}
+	if customTransport {
+		options = append(options, oss.HTTPClient(httpClient))
+	}
+	return options
+}
+
 func autoOSSEndpoint(bucketName, accessKey, secretKey, securityToken string) (string, error) {
 	var client *oss.Client
 	var err error
@@ -292,15 +315,8 @@ func autoOSSEndpoint(bucketName, accessKey, secretKey, securityToken string) (st
 	}
 	defaultEndpoint := fmt.Sprintf("https://oss-%s.aliyuncs.com", regionID)
 
-	if securityToken == "" {
-		if client, err = oss.New(defaultEndpoint, accessKey, secretKey); err != nil {
-			return "", err
-		}
-	} else {
-		if client, err = oss.New(defaultEndpoint, accessKey, secretKey,
-			oss.SecurityToken(securityToken)); err != nil {
-			return "", err
-		}
+	if client, err = oss.New(defaultEndpoint, accessKey, secretKey, ossOptions(securityToken)...); err != nil {
+		return "", err
 	}
 
 	result, err := client.ListBuckets(oss.Prefix(bucketName), oss.MaxKeys(1))
@@ -363,12 +379,7 @@ func newOSS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		logger.Debugf("Use endpoint %q", domain)
 	}
 
-	var client *oss.Client
-	if securityToken == "" {
-		client, err = oss.New(domain, accessKey, secretKey)
-	} else {
-		client, err = oss.New(domain, accessKey, secretKey, oss.SecurityToken(securityToken))
-	}
+	client, err := oss.New(domain, accessKey, secretKey, ossOptions(securityToken)...)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot create OSS client with endpoint %s: %s", endpoint, err)
 	}
@@ -0,0 +1,160 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"io"
+)
+
+type parallelGet struct {
+	ObjectStorage
+	threshold int64
+	parts     int
+}
+
+// WithParallelGet returns an object storage that downloads a range not smaller than threshold
+// with up to parts ranged requests in parallel. The storage is returned untouched if it can not
+// fetch a range of an object from the server.
+func WithParallelGet(s ObjectStorage, threshold int64, parts int) ObjectStorage {
+	if parts <= 1 || threshold <= 0 || !supportRange(s) {
+		return s
+	}
+	return &parallelGet{s, threshold, parts}
+}
+
+// supportRange checks whether the storage fetches only the requested range of an object,
+// rather than downloading all of it and dropping the rest.
+func supportRange(s ObjectStorage) bool {
+	switch s := s.(type) {
+	case *withPrefix:
+		return supportRange(s.os)
+	case *loggedStore:
+		return supportRange(s.ObjectStorage)
+	case *sharded:
+		return supportRange(s.stores[0])
+	case *memStore, *redisStore, *tikv, *up, *encrypted:
+		return false
+	}
+	return true
+}
+
+func (p *parallelGet) DeleteMany(keys []string) map[string]error {
+	return DeleteMany(p.ObjectStorage, keys)
+}
+
+func (p *parallelGet) PutIfAbsent(key string, in io.Reader) error {
+	return PutIfAbsent(p.ObjectStorage, key, in)
+}
+
+func (p *parallelGet) Append(key string, off int64, in io.Reader) error {
+	return Append(p.ObjectStorage, key, off, in)
+}
+
+func (p *parallelGet) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(p.ObjectStorage, accessKey, secretKey, token)
+}
+
+func (p *parallelGet) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return p.GetWithContext(context.Background(), key, off, limit)
+}
+
+func (p *parallelGet) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	// the size of object is unknown without limit
+	if limit < p.threshold {
+		return GetWithContext(ctx, p.ObjectStorage, key, off, limit)
+	}
+	size := (limit-1)/int64(p.parts) + 1
+	ctx, cancel := context.WithCancel(ctx)
+	r := &partsReader{cancel: cancel}
+	for start := int64(0); start < limit; start += size {
+		n := size
+		if start+n > limit {
+			n = limit - start
+		}
+		part := &objPart{done: make(chan struct{})}
+		r.parts = append(r.parts, part)
+		go part.fetch(ctx, p.ObjectStorage, key, off+start, n)
+	}
+	// fail fast if the object can not be read
+	first := r.parts[0]
+	<-first.done
+	if first.err != nil {
+		cancel()
+		return nil, first.err
+	}
+	return r, nil
+}
+
+type objPart struct {
+	data  []byte
+	short bool // the object ends within this part
+	err   error
+	done  chan struct{}
+}
+
+func (p *objPart) fetch(ctx context.Context, s ObjectStorage, key string, off, limit int64) {
+	defer close(p.done)
+	in, err := GetWithContext(ctx, s, key, off, limit)
+	if err != nil {
+		p.err = err
+		return
+	}
+	defer in.Close()
+	p.data = make([]byte, limit)
+	n, err := io.ReadFull(in, p.data)
+	p.data = p.data[:n]
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		p.short = true
+	} else {
+		p.err = err
+	}
+}
+
+// partsReader returns the data of parts in order.
+type partsReader struct {
+	parts  []*objPart
+	cancel context.CancelFunc
+}
+
+func (r *partsReader) Read(buf []byte) (int, error) {
+	for len(r.parts) > 0 {
+		p := r.parts[0]
+		<-p.done
+		if p.err != nil {
+			return 0, p.err
+		}
+		if len(p.data) > 0 {
+			n := copy(buf, p.data)
+			p.data = p.data[n:]
+			return n, nil
+		}
+		if p.short {
+			// the following parts are beyond the end
+			_ = r.Close()
+		} else {
+			r.parts = r.parts[1:]
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *partsReader) Close() error {
+	r.cancel()
+	r.parts = nil
+	return nil
+}
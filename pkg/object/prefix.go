@@ -17,6 +17,7 @@
 package object
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -59,14 +60,46 @@ func (p *withPrefix) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return p.os.Get(p.prefix+key, off, limit)
 }
 
+func (p *withPrefix) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	return GetWithContext(ctx, p.os, p.prefix+key, off, limit)
+}
+
+func (p *withPrefix) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(p.os, p.prefix+key, expire)
+}
+
 func (p *withPrefix) Put(key string, in io.Reader) error {
 	return p.os.Put(p.prefix+key, in)
 }
 
+func (p *withPrefix) PutIfAbsent(key string, in io.Reader) error {
+	return PutIfAbsent(p.os, p.prefix+key, in)
+}
+
+func (p *withPrefix) Append(key string, off int64, in io.Reader) error {
+	return Append(p.os, p.prefix+key, off, in)
+}
+
 func (p *withPrefix) Delete(key string) error {
 	return p.os.Delete(p.prefix + key)
 }
 
+func (p *withPrefix) DeleteMany(keys []string) map[string]error {
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = p.prefix + key
+	}
+	errs := make(map[string]error)
+	for key, err := range DeleteMany(p.os, full) {
+		errs[key[len(p.prefix):]] = err
+	}
+	return errs
+}
+
+func (p *withPrefix) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(p.os, accessKey, secretKey, token)
+}
+
 func (p *withPrefix) List(prefix, marker string, limit int64) ([]Object, error) {
 	if marker != "" {
 		marker = p.prefix + marker
@@ -132,6 +165,34 @@ func (p *withPrefix) Chtimes(key string, mtime time.Time) error {
 	return nil
 }
 
+func (p *withPrefix) Symlink(target, key string) error {
+	if ls, ok := p.os.(SymlinkStore); ok {
+		return ls.Symlink(target, p.prefix+key)
+	}
+	return notSupported
+}
+
+func (p *withPrefix) Readlink(key string) (string, error) {
+	if ls, ok := p.os.(SymlinkStore); ok {
+		return ls.Readlink(p.prefix + key)
+	}
+	return "", notSupported
+}
+
+func (p *withPrefix) GetXattrs(key string) (map[string][]byte, error) {
+	if xs, ok := p.os.(XattrStore); ok {
+		return xs.GetXattrs(p.prefix + key)
+	}
+	return nil, notSupported
+}
+
+func (p *withPrefix) SetXattrs(key string, attrs map[string][]byte) error {
+	if xs, ok := p.os.(XattrStore); ok {
+		return xs.SetXattrs(p.prefix+key, attrs)
+	}
+	return notSupported
+}
+
 func (p *withPrefix) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 	return p.os.CreateMultipartUpload(p.prefix + key)
 }
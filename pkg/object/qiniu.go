@@ -20,6 +20,7 @@
 package object
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -90,6 +91,10 @@ func (q *qiniu) Head(key string) (Object, error) {
 }
 
 func (q *qiniu) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return q.GetWithContext(ctx, key, off, limit)
+}
+
+func (q *qiniu) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
 	// S3 SDK cannot get objects with prefix "/" in the key
 	if strings.HasPrefix(key, "/") && os.Getenv("QINIU_DOMAIN") != "" {
 		return q.download(key, off, limit)
@@ -98,7 +103,7 @@ func (q *qiniu) Get(key string, off, limit int64) (io.ReadCloser, error) {
 		key = key[1:]
 	}
 	// S3ForcePathStyle = true
-	return q.s3client.Get("/"+key, off, limit)
+	return q.s3client.GetWithContext(ctx, "/"+key, off, limit)
 }
 
 func (q *qiniu) Put(key string, in io.Reader) error {
@@ -113,6 +118,14 @@ func (q *qiniu) Put(key string, in io.Reader) error {
 	return formUploader.Put(ctx, &ret, upToken, key, body, vlen, nil)
 }
 
+// PutIfAbsent overrides the one of s3client, since the objects are written by the qiniu API.
+func (q *qiniu) PutIfAbsent(key string, in io.Reader) error {
+	if _, err := q.Head(key); err == nil {
+		return fmt.Errorf("put %s: %w", key, os.ErrExist)
+	}
+	return q.Put(key, in)
+}
+
 func (q *qiniu) Copy(dst, src string) error {
 	return q.bm.Copy(q.bucket, src, q.bucket, dst, true)
 }
@@ -125,6 +138,11 @@ func (q *qiniu) Delete(key string) error {
 	return q.bm.Delete(q.bucket, key)
 }
 
+// DeleteMany overrides the one of s3client, since the objects are deleted by the qiniu API.
+func (q *qiniu) DeleteMany(keys []string) map[string]error {
+	return deleteEach(q, keys)
+}
+
 func (q *qiniu) List(prefix, marker string, limit int64) ([]Object, error) {
 	if limit > 1000 {
 		limit = 1000
@@ -200,7 +218,7 @@ func newQiniu(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	s3client := s3client{bucket, s3.New(ses), ses}
+	s3client := s3client{bucket, s3.New(ses), ses, nil, nil}
 
 	cfg := storage.Config{
 		UseHTTPS: uri.Scheme == "https",
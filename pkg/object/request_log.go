@@ -0,0 +1,287 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestStat is the summary of requests of a type.
+type RequestStat struct {
+	Count    int64
+	Errors   int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+// RequestLog writes a line for every request sent to the object storages wrapped by
+// WithRequestLog, and counts them by type.
+type RequestLog struct {
+	sync.Mutex
+	w     io.Writer
+	stats map[string]*RequestStat
+}
+
+// NewRequestLog returns a RequestLog writing to w.
+func NewRequestLog(w io.Writer) *RequestLog {
+	return &RequestLog{w: w, stats: make(map[string]*RequestStat)}
+}
+
+// the credentials could be in the URLs of error messages
+var secretPattern = regexp.MustCompile(`(?i)(://[^/:@\s]+:|(?:signature|sig|credential|security-token|token|accesskeyid|secretkey|password)=)[^@&\s"']+`)
+
+func redact(s string) string {
+	return secretPattern.ReplaceAllString(s, "$1****")
+}
+
+func (l *RequestLog) record(method, key string, bytes int64, start time.Time, err error) {
+	used := time.Since(start)
+	result := "OK"
+	if err != nil {
+		result = strings.ReplaceAll(redact(err.Error()), "\n", " ")
+	}
+	l.Lock()
+	defer l.Unlock()
+	s := l.stats[method]
+	if s == nil {
+		s = &RequestStat{}
+		l.stats[method] = s
+	}
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.Bytes += bytes
+	s.Duration += used
+	if l.w != nil {
+		_, _ = fmt.Fprintf(l.w, "%s %s %s %d %s %s\n", start.Format("2006-01-02T15:04:05.000000Z07:00"), method, key, bytes, used, result)
+	}
+}
+
+// Stats returns the summary of requests by type.
+func (l *RequestLog) Stats() map[string]RequestStat {
+	l.Lock()
+	defer l.Unlock()
+	r := make(map[string]RequestStat, len(l.stats))
+	for m, s := range l.stats {
+		r[m] = *s
+	}
+	return r
+}
+
+// Summary writes the number of requests, errors, bytes and total time of every type.
+func (l *RequestLog) Summary(w io.Writer) {
+	stats := l.Stats()
+	var methods []string
+	for m := range stats {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		s := stats[m]
+		_, _ = fmt.Fprintf(w, "%s: %d requests, %d errors, %d bytes, %s\n", m, s.Count, s.Errors, s.Bytes, s.Duration)
+	}
+}
+
+type loggedStore struct {
+	ObjectStorage
+	log *RequestLog
+}
+
+// WithRequestLog returns an object storage that records every request in log.
+func WithRequestLog(s ObjectStorage, log *RequestLog) ObjectStorage {
+	return &loggedStore{s, log}
+}
+
+func (s *loggedStore) Create() error {
+	start := time.Now()
+	err := s.ObjectStorage.Create()
+	s.log.record("CREATE", "", 0, start, err)
+	return err
+}
+
+func (s *loggedStore) Head(key string) (Object, error) {
+	start := time.Now()
+	o, err := s.ObjectStorage.Head(key)
+	s.log.record("HEAD", key, 0, start, err)
+	return o, err
+}
+
+// loggedReader records the request with the bytes read, when it reaches the end or is closed.
+type loggedReader struct {
+	io.ReadCloser
+	log   *RequestLog
+	key   string
+	start time.Time
+	n     int64
+}
+
+func (r *loggedReader) done(err error) {
+	if r.log != nil {
+		r.log.record("GET", r.key, r.n, r.start, err)
+		r.log = nil
+	}
+}
+
+func (r *loggedReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.done(nil)
+	} else if err != nil {
+		r.done(err)
+	}
+	return n, err
+}
+
+func (r *loggedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.done(nil)
+	return err
+}
+
+func (s *loggedStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key, off, limit)
+}
+
+func (s *loggedStore) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	start := time.Now()
+	in, err := GetWithContext(ctx, s.ObjectStorage, key, off, limit)
+	if err != nil {
+		s.log.record("GET", key, 0, start, err)
+		return nil, err
+	}
+	return &loggedReader{ReadCloser: in, log: s.log, key: key, start: start}, nil
+}
+
+type countedReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Presign is not logged, since no request is sent.
+func (s *loggedStore) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(s.ObjectStorage, key, expire)
+}
+
+func (s *loggedStore) Put(key string, in io.Reader) error {
+	start := time.Now()
+	r := &countedReader{Reader: in}
+	err := s.ObjectStorage.Put(key, r)
+	s.log.record("PUT", key, r.n, start, err)
+	return err
+}
+
+func (s *loggedStore) PutIfAbsent(key string, in io.Reader) error {
+	start := time.Now()
+	r := &countedReader{Reader: in}
+	err := PutIfAbsent(s.ObjectStorage, key, r)
+	s.log.record("PUT_IF_ABSENT", key, r.n, start, err)
+	return err
+}
+
+func (s *loggedStore) Append(key string, off int64, in io.Reader) error {
+	start := time.Now()
+	r := &countedReader{Reader: in}
+	err := Append(s.ObjectStorage, key, off, r)
+	s.log.record("APPEND", key, r.n, start, err)
+	return err
+}
+
+func (s *loggedStore) Delete(key string) error {
+	start := time.Now()
+	err := s.ObjectStorage.Delete(key)
+	s.log.record("DELETE", key, 0, start, err)
+	return err
+}
+
+// DeleteMany is recorded as one request with the number of objects.
+func (s *loggedStore) DeleteMany(keys []string) map[string]error {
+	start := time.Now()
+	errs := DeleteMany(s.ObjectStorage, keys)
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("failed to delete %d of %d objects", len(errs), len(keys))
+	}
+	s.log.record("DELETE_MANY", fmt.Sprintf("(%d keys)", len(keys)), 0, start, err)
+	return errs
+}
+
+func (s *loggedStore) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(s.ObjectStorage, accessKey, secretKey, token)
+}
+
+func (s *loggedStore) List(prefix, marker string, limit int64) ([]Object, error) {
+	start := time.Now()
+	objs, err := s.ObjectStorage.List(prefix, marker, limit)
+	s.log.record("LIST", prefix, 0, start, err)
+	return objs, err
+}
+
+func (s *loggedStore) ListAll(prefix, marker string) (<-chan Object, error) {
+	start := time.Now()
+	ch, err := s.ObjectStorage.ListAll(prefix, marker)
+	s.log.record("LISTALL", prefix, 0, start, err)
+	return ch, err
+}
+
+func (s *loggedStore) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	start := time.Now()
+	u, err := s.ObjectStorage.CreateMultipartUpload(key)
+	s.log.record("CREATE_UPLOAD", key, 0, start, err)
+	return u, err
+}
+
+func (s *loggedStore) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	start := time.Now()
+	p, err := s.ObjectStorage.UploadPart(key, uploadID, num, body)
+	s.log.record("UPLOAD_PART", key, int64(len(body)), start, err)
+	return p, err
+}
+
+func (s *loggedStore) AbortUpload(key string, uploadID string) {
+	start := time.Now()
+	s.ObjectStorage.AbortUpload(key, uploadID)
+	s.log.record("ABORT_UPLOAD", key, 0, start, nil)
+}
+
+func (s *loggedStore) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	start := time.Now()
+	err := s.ObjectStorage.CompleteUpload(key, uploadID, parts)
+	s.log.record("COMPLETE_UPLOAD", key, 0, start, err)
+	return err
+}
+
+func (s *loggedStore) ListUploads(marker string) ([]*PendingPart, string, error) {
+	start := time.Now()
+	parts, next, err := s.ObjectStorage.ListUploads(marker)
+	s.log.record("LIST_UPLOADS", marker, 0, start, err)
+	return parts, next, err
+}
@@ -18,8 +18,11 @@ package object
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -38,6 +41,15 @@ import (
 var resolver = dnscache.New(time.Minute)
 var httpClient *http.Client
 
+// customTransport is set when the TLS or connection settings of httpClient are changed,
+// SDKs that bring their own transport should use httpClient instead in that case.
+var customTransport bool
+
+// transport is the one of httpClient, which is wrapped by timeoutTransport if the timeouts are changed.
+var transport *http.Transport
+
+var dialTimeout = time.Second * 10
+
 func init() {
 	rand.Seed(time.Now().Unix())
 	httpClient = &http.Client{
@@ -47,28 +59,31 @@ func init() {
 			ResponseHeaderTimeout: time.Second * 30,
 			IdleConnTimeout:       time.Second * 300,
 			MaxIdleConnsPerHost:   500,
-			Dial: func(network string, address string) (net.Conn, error) {
-				separator := strings.LastIndex(address, ":")
-				host := address[:separator]
-				port := address[separator:]
-				ips, err := resolver.Fetch(host)
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
 				if err != nil {
 					return nil, err
 				}
+				var ips []net.IP
+				if ip := net.ParseIP(host); ip != nil { // IPv4 or IPv6 literal
+					ips = []net.IP{ip}
+				} else if ips, err = resolver.Fetch(host); err != nil {
+					return nil, err
+				}
 				if len(ips) == 0 {
 					return nil, fmt.Errorf("No such host: %s", host)
 				}
 				var conn net.Conn
 				n := len(ips)
 				first := rand.Intn(n)
-				dialer := &net.Dialer{Timeout: time.Second * 10}
+				dialer := &net.Dialer{Timeout: dialTimeout}
+				if t, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && t > 0 {
+					dialer.Timeout = t
+				}
 				for i := 0; i < n; i++ {
 					ip := ips[(first+i)%n]
-					address = ip.String()
-					if port != "" {
-						address = net.JoinHostPort(address, port[1:])
-					}
-					conn, err = dialer.Dial(network, address)
+					address = net.JoinHostPort(ip.String(), port)
+					conn, err = dialer.DialContext(ctx, network, address)
 					if err == nil {
 						return conn, nil
 					}
@@ -79,6 +94,65 @@ func init() {
 		},
 		Timeout: time.Hour,
 	}
+	transport = httpClient.Transport.(*http.Transport)
+}
+
+// SetTLSConfig sets the CA bundle to verify the certificates of object storages (the system
+// ones are still trusted), or skip the verification. It applies to all HTTPS-based storages.
+func SetTLSConfig(caFile string, insecureSkipVerify bool) error {
+	if caFile == "" && !insecureSkipVerify {
+		return nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA bundle %s: %s", caFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no valid certificate found in %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+	if insecureSkipVerify {
+		logger.Warnf("Certificates of object storage will NOT be verified")
+	}
+	transport.TLSClientConfig = conf
+	customTransport = true
+	return nil
+}
+
+// TransportConfig is the settings of the connections to object storages.
+type TransportConfig struct {
+	HTTP2               bool          // attempt HTTP/2 for HTTPS endpoints
+	MaxIdleConnsPerHost int           // idle connections kept for reuse
+	MaxConnsPerHost     int           // zero means no limit
+	IdleConnTimeout     time.Duration // how long an idle connection is kept
+	DialTimeout         time.Duration // timeout to establish a connection
+}
+
+// SetTransportConfig changes the connection settings of all HTTP-based storages.
+func SetTransportConfig(conf TransportConfig) error {
+	if conf.MaxIdleConnsPerHost < 0 || conf.MaxConnsPerHost < 0 || conf.IdleConnTimeout < 0 || conf.DialTimeout <= 0 {
+		return fmt.Errorf("invalid transport settings: %+v", conf)
+	}
+	t := transport
+	if conf == (TransportConfig{t.ForceAttemptHTTP2, t.MaxIdleConnsPerHost, t.MaxConnsPerHost, t.IdleConnTimeout, dialTimeout}) {
+		return nil
+	}
+	// HTTP/2 is disabled for customized transport unless it's forced, a connection
+	// is shared by concurrent requests then, so the idle ones are rarely used
+	t.ForceAttemptHTTP2 = conf.HTTP2
+	t.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = conf.MaxConnsPerHost
+	t.IdleConnTimeout = conf.IdleConnTimeout
+	dialTimeout = conf.DialTimeout
+	customTransport = true
+	return nil
 }
 
 func cleanup(response *http.Response) {
@@ -122,8 +196,12 @@ func sign(req *http.Request, accessKey, secretKey, signName string) {
 }
 
 func (s *RestfulStorage) request(method, key string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	return s.requestWithContext(ctx, method, key, body, headers)
+}
+
+func (s *RestfulStorage) requestWithContext(ctx context.Context, method, key string, body io.Reader, headers map[string]string) (*http.Response, error) {
 	uri := s.endpoint + "/" + key
-	req, err := http.NewRequest(method, uri, body)
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
 	if err != nil {
 		return nil, err
 	}
@@ -174,6 +252,10 @@ func (s *RestfulStorage) Head(key string) (Object, error) {
 }
 
 func (s *RestfulStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(ctx, key, off, limit)
+}
+
+func (s *RestfulStorage) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
 	headers := make(map[string]string)
 	if off > 0 || limit > 0 {
 		if limit > 0 {
@@ -182,7 +264,7 @@ func (s *RestfulStorage) Get(key string, off, limit int64) (io.ReadCloser, error
 			headers["Range"] = fmt.Sprintf("bytes=%d-", off)
 		}
 	}
-	resp, err := s.request("GET", key, nil, headers)
+	resp, err := s.requestWithContext(ctx, "GET", key, nil, headers)
 	if err != nil {
 		return nil, err
 	}
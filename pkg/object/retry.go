@@ -0,0 +1,271 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy is the number of retries for failed requests, and the backoff before the first
+// retry, which is doubled for every next one.
+type RetryPolicy struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// ParseRetryPolicy parses a policy in format of RETRIES[,BACKOFF], e.g. 3,100ms.
+func ParseRetryPolicy(s string) (RetryPolicy, error) {
+	var p RetryPolicy
+	parts := strings.SplitN(s, ",", 2)
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 0 {
+		return p, fmt.Errorf("invalid retries: %s", s)
+	}
+	p.Retries = n
+	if len(parts) == 2 {
+		if p.Backoff, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil || p.Backoff < 0 {
+			return p, fmt.Errorf("invalid backoff: %s", s)
+		}
+	}
+	return p, nil
+}
+
+func (p RetryPolicy) String() string {
+	return fmt.Sprintf("%d,%s", p.Retries, p.Backoff)
+}
+
+// RetryConfig is the retry policies of requests by their idempotency.
+type RetryConfig struct {
+	// Head, Get, List and ListUploads, which can be retried safely
+	Read RetryPolicy
+	// Put and Delete, whose result could be observed by others between retries
+	Write RetryPolicy
+	// CreateMultipartUpload, UploadPart and CompleteUpload, an upload is completed again only if
+	// the object is not found with the size of all the parts
+	Multipart RetryPolicy
+}
+
+type retriedStore struct {
+	ObjectStorage
+	conf RetryConfig
+}
+
+// WithRetry returns an object storage that retries the failed requests according to conf.
+func WithRetry(s ObjectStorage, conf RetryConfig) ObjectStorage {
+	return &retriedStore{s, conf}
+}
+
+// isNotFound returns whether the error means the object does not exist.
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsNotExist(err) {
+		return true
+	}
+	s := strings.ToLower(err.Error())
+	for _, p := range []string{"nosuchkey", "notfound", "not found", "no such", "not exist"} {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable returns whether the error could be transient.
+func retryable(err error) bool {
+	return err != nil && !isNotFound(err) && !errors.Is(err, os.ErrExist) && err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// do calls f until it succeeds, fails with an error that is not transient, or the retries are used up.
+func (p RetryPolicy) do(ctx context.Context, method, key string, f func() error) error {
+	err := f()
+	backoff := p.Backoff
+	for i := 0; i < p.Retries && retryable(err) && ctx.Err() == nil; i++ {
+		logger.Debugf("%s %s: %s, retry after %s (%d/%d)", method, key, err, backoff, i+1, p.Retries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
+
+func (s *retriedStore) Head(key string) (o Object, err error) {
+	err = s.conf.Read.do(context.Background(), "HEAD", key, func() error {
+		o, err = s.ObjectStorage.Head(key)
+		return err
+	})
+	return
+}
+
+func (s *retriedStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key, off, limit)
+}
+
+// GetWithContext retries the request, but not the failures when reading the body.
+func (s *retriedStore) GetWithContext(ctx context.Context, key string, off, limit int64) (in io.ReadCloser, err error) {
+	err = s.conf.Read.do(ctx, "GET", key, func() error {
+		in, err = GetWithContext(ctx, s.ObjectStorage, key, off, limit)
+		return err
+	})
+	return
+}
+
+func (s *retriedStore) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(s.ObjectStorage, key, expire)
+}
+
+// Put is retried only if the body can be read again from the beginning.
+func (s *retriedStore) Put(key string, in io.Reader) error {
+	return s.put("PUT", key, in, s.ObjectStorage.Put)
+}
+
+// PutIfAbsent is retried as Put, and the object found by a retry is likely written by a failed
+// try (e.g. timed out after the object is written), so it's taken as success.
+func (s *retriedStore) PutIfAbsent(key string, in io.Reader) error {
+	var tries int
+	err := s.put("PUT_IF_ABSENT", key, in, func(key string, in io.Reader) error {
+		tries++
+		return PutIfAbsent(s.ObjectStorage, key, in)
+	})
+	if tries > 1 && errors.Is(err, os.ErrExist) {
+		logger.Debugf("%s is found after %d tries, it's likely written by a failed one", key, tries)
+		return nil
+	}
+	return err
+}
+
+// Append is not retried, since a failed try may have appended the data partially.
+func (s *retriedStore) Append(key string, off int64, in io.Reader) error {
+	return Append(s.ObjectStorage, key, off, in)
+}
+
+func (s *retriedStore) put(method, key string, in io.Reader, put func(key string, in io.Reader) error) error {
+	body, ok := in.(io.ReadSeeker)
+	if !ok {
+		return put(key, in)
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return put(key, in)
+	}
+	first := true
+	return s.conf.Write.do(context.Background(), method, key, func() error {
+		if !first {
+			if _, err := body.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		return put(key, body)
+	})
+}
+
+func (s *retriedStore) Delete(key string) error {
+	return s.conf.Write.do(context.Background(), "DELETE", key, func() error {
+		return s.ObjectStorage.Delete(key)
+	})
+}
+
+// DeleteMany retries the objects failed to be deleted one by one.
+func (s *retriedStore) DeleteMany(keys []string) map[string]error {
+	errs := DeleteMany(s.ObjectStorage, keys)
+	for key := range errs {
+		if err := s.Delete(key); err == nil {
+			delete(errs, key)
+		} else {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+func (s *retriedStore) UpdateCredentials(accessKey, secretKey, token string) error {
+	return UpdateCredentials(s.ObjectStorage, accessKey, secretKey, token)
+}
+
+func (s *retriedStore) List(prefix, marker string, limit int64) (objs []Object, err error) {
+	err = s.conf.Read.do(context.Background(), "LIST", prefix, func() error {
+		objs, err = s.ObjectStorage.List(prefix, marker, limit)
+		return err
+	})
+	return
+}
+
+func (s *retriedStore) ListAll(prefix, marker string) (ch <-chan Object, err error) {
+	err = s.conf.Read.do(context.Background(), "LISTALL", prefix, func() error {
+		ch, err = s.ObjectStorage.ListAll(prefix, marker)
+		return err
+	})
+	return
+}
+
+func (s *retriedStore) CreateMultipartUpload(key string) (u *MultipartUpload, err error) {
+	err = s.conf.Multipart.do(context.Background(), "CREATE_UPLOAD", key, func() error {
+		u, err = s.ObjectStorage.CreateMultipartUpload(key)
+		return err
+	})
+	return
+}
+
+// UploadPart can be retried, since the part is replaced by another one with the same number.
+func (s *retriedStore) UploadPart(key string, uploadID string, num int, body []byte) (p *Part, err error) {
+	err = s.conf.Multipart.do(context.Background(), "UPLOAD_PART", key, func() error {
+		p, err = s.ObjectStorage.UploadPart(key, uploadID, num, body)
+		return err
+	})
+	return
+}
+
+// CompleteUpload could have succeeded even if it returns an error (e.g. timeout), then it would fail
+// again because the upload is gone, so the object is checked before completing it again.
+func (s *retriedStore) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	var size int64
+	for _, p := range parts {
+		size += int64(p.Size)
+	}
+	first := true
+	return s.conf.Multipart.do(context.Background(), "COMPLETE_UPLOAD", key, func() error {
+		if !first {
+			if o, err := s.ObjectStorage.Head(key); err == nil && o.Size() == size {
+				logger.Infof("Upload %s of %s was completed", uploadID, key)
+				return nil
+			}
+		}
+		first = false
+		return s.ObjectStorage.CompleteUpload(key, uploadID, parts)
+	})
+}
+
+func (s *retriedStore) ListUploads(marker string) (parts []*PendingPart, next string, err error) {
+	err = s.conf.Read.do(context.Background(), "LIST_UPLOADS", marker, func() error {
+		parts, next, err = s.ObjectStorage.ListUploads(marker)
+		return err
+	})
+	return
+}
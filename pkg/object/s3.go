@@ -21,6 +21,8 @@ package object
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,9 +30,12 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -53,6 +58,88 @@ type s3client struct {
 	bucket string
 	s3     *s3.S3
 	ses    *session.Session
+	creds  *swapProvider // nil if the credentials can't be updated
+	sse    *serverSideEncryption
+}
+
+// serverSideEncryption is the encryption at rest by the object storage, which is asked for in the
+// requests creating objects.
+type serverSideEncryption struct {
+	algorithm string // AES256 or aws:kms
+	kmsKeyID  string // the default key of KMS if empty
+}
+
+// SetServerSideEncryption asks the object storage to encrypt the objects with the keys managed
+// by it (sse is "s3") or by KMS (sse is "kms", with the key kmsKeyID or the default one), it should
+// be called before any object is written. The objects not encrypted by the storage are taken as
+// failed to be written.
+func (s *s3client) SetServerSideEncryption(sse, kmsKeyID string) error {
+	switch sse {
+	case "s3":
+		if kmsKeyID != "" {
+			return fmt.Errorf("KMS key ID is only used by SSE-KMS")
+		}
+		s.sse = &serverSideEncryption{algorithm: s3.ServerSideEncryptionAes256}
+	case "kms":
+		s.sse = &serverSideEncryption{algorithm: s3.ServerSideEncryptionAwsKms, kmsKeyID: kmsKeyID}
+	default:
+		return fmt.Errorf("invalid server-side encryption: %s, should be s3 or kms", sse)
+	}
+	return nil
+}
+
+func (s *s3client) encryptionParams() (algorithm, kmsKeyID *string) {
+	if s.sse == nil {
+		return nil, nil
+	}
+	algorithm = aws.String(s.sse.algorithm)
+	if s.sse.kmsKeyID != "" {
+		kmsKeyID = aws.String(s.sse.kmsKeyID)
+	}
+	return
+}
+
+// checkEncrypted verifies the algorithm of server-side encryption in the response of key.
+func (s *s3client) checkEncrypted(key string, algorithm *string) error {
+	if s.sse == nil || algorithm != nil && *algorithm == s.sse.algorithm {
+		return nil
+	}
+	return fmt.Errorf("%s is not encrypted by the object storage with %s (got %q), server-side encryption may not be supported",
+		key, s.sse.algorithm, aws.StringValue(algorithm))
+}
+
+// swapProvider provides the credentials which could be replaced at runtime, the requests
+// signed already are not affected.
+type swapProvider struct {
+	sync.Mutex
+	value *credentials.Value
+	creds *credentials.Credentials // the original ones, used until replaced
+}
+
+// swappable makes the credentials of ses replaceable, it should be called before any client is created.
+func swappable(ses *session.Session) *swapProvider {
+	if ses.Config.Credentials == credentials.AnonymousCredentials {
+		return nil
+	}
+	p := &swapProvider{creds: ses.Config.Credentials}
+	ses.Config.Credentials = credentials.NewCredentials(p)
+	return p
+}
+
+func (p *swapProvider) Retrieve() (credentials.Value, error) {
+	p.Lock()
+	v := p.value
+	p.Unlock()
+	if v != nil {
+		return *v, nil
+	}
+	return p.creds.Get()
+}
+
+func (p *swapProvider) IsExpired() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.value == nil && p.creds.IsExpired()
 }
 
 func (s *s3client) String() string {
@@ -93,6 +180,10 @@ func (s *s3client) Head(key string) (Object, error) {
 }
 
 func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	return s.GetWithContext(ctx, key, off, limit)
+}
+
+func (s *s3client) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
 	params := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
 	if off > 0 || limit > 0 {
 		var r string
@@ -103,7 +194,7 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 		}
 		params.Range = &r
 	}
-	resp, err := s.s3.GetObject(params)
+	resp, err := s.s3.GetObjectWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +207,22 @@ func (s *s3client) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+func (s *s3client) Presign(key string, expire time.Duration) (string, error) {
+	req, _ := s.s3.GetObjectRequest(&s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	return req.Presign(expire)
+}
+
 func (s *s3client) Put(key string, in io.Reader) error {
+	return s.put(key, in, false)
+}
+
+// PutIfAbsent sends the object with If-None-Match: *, which fails with 412 if it exists already.
+// The storages ignoring the header overwrite the object silently.
+func (s *s3client) PutIfAbsent(key string, in io.Reader) error {
+	return s.put(key, in, true)
+}
+
+func (s *s3client) put(key string, in io.Reader, ifAbsent bool) error {
 	var body io.ReadSeeker
 	if b, ok := in.(io.ReadSeeker); ok {
 		body = b
@@ -134,8 +240,118 @@ func (s *s3client) Put(key string, in io.Reader) error {
 		Body:     body,
 		Metadata: map[string]*string{checksumAlgr: &checksum},
 	}
-	_, err := s.s3.PutObject(params)
-	return err
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryptionParams()
+	req, resp := s.s3.PutObjectRequest(params)
+	if ifAbsent {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+	err := req.Send()
+	if e, ok := err.(awserr.RequestFailure); ok && ifAbsent && e.StatusCode() == 412 {
+		return fmt.Errorf("put %s: %w", key, os.ErrExist)
+	}
+	if err != nil {
+		return err
+	}
+	return s.checkEncrypted(key, resp.ServerSideEncryption)
+}
+
+// symlinkMeta is the metadata (x-amz-meta-symlink-target) to keep the target of a symlink.
+const symlinkMeta = "Symlink-Target"
+
+// Symlink stores the target as the content of an object, and also in the metadata
+// (escaped as the value of header should be ASCII) to tell it from regular ones.
+func (s *s3client) Symlink(target, key string) error {
+	escaped := url.QueryEscape(target)
+	params := &s3.PutObjectInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		Body:     strings.NewReader(target),
+		Metadata: map[string]*string{symlinkMeta: &escaped},
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryptionParams()
+	resp, err := s.s3.PutObject(params)
+	if err != nil {
+		return err
+	}
+	return s.checkEncrypted(key, resp.ServerSideEncryption)
+}
+
+func (s *s3client) Readlink(key string) (string, error) {
+	r, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return "", err
+	}
+	target := r.Metadata[symlinkMeta]
+	if target == nil {
+		return "", fmt.Errorf("%s is not a symlink", key)
+	}
+	return url.QueryUnescape(*target)
+}
+
+// xattrsMeta is the metadata (x-amz-meta-xattrs) to keep the extended attributes of a file, as
+// escaped JSON. The metadata of an object is limited to 2 KiB.
+const xattrsMeta = "Xattrs"
+
+func (s *s3client) GetXattrs(key string) (map[string][]byte, error) {
+	r, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return nil, err
+	}
+	v := r.Metadata[xattrsMeta]
+	if v == nil {
+		return nil, nil
+	}
+	data, err := url.QueryUnescape(*v)
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string][]byte
+	if err = json.Unmarshal([]byte(data), &attrs); err != nil {
+		return nil, fmt.Errorf("invalid xattrs of %s: %s", key, err)
+	}
+	return attrs, nil
+}
+
+// SetXattrs copies the object onto itself to replace the metadata, the other ones are kept.
+func (s *s3client) SetXattrs(key string, attrs map[string][]byte) error {
+	r, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return err
+	}
+	meta := r.Metadata
+	if meta == nil {
+		meta = make(map[string]*string)
+	}
+	if len(attrs) == 0 {
+		if meta[xattrsMeta] == nil {
+			return nil
+		}
+		delete(meta, xattrsMeta)
+	} else {
+		data, err := json.Marshal(attrs)
+		if err != nil {
+			return err
+		}
+		escaped := url.QueryEscape(string(data))
+		if len(escaped) > 2048 {
+			return fmt.Errorf("xattrs of %s (%d bytes) are too large for the metadata", key, len(escaped))
+		}
+		meta[xattrsMeta] = &escaped
+	}
+	src := s.bucket + "/" + key
+	params := &s3.CopyObjectInput{
+		Bucket:            &s.bucket,
+		Key:               &key,
+		CopySource:        &src,
+		Metadata:          meta,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryptionParams()
+	resp, err := s.s3.CopyObject(params)
+	if err != nil {
+		return err
+	}
+	return s.checkEncrypted(key, resp.ServerSideEncryption)
 }
 
 func (s *s3client) Copy(dst, src string) error {
@@ -145,8 +361,12 @@ func (s *s3client) Copy(dst, src string) error {
 		Key:        &dst,
 		CopySource: &src,
 	}
-	_, err := s.s3.CopyObject(params)
-	return err
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryptionParams()
+	resp, err := s.s3.CopyObject(params)
+	if err != nil {
+		return err
+	}
+	return s.checkEncrypted(dst, resp.ServerSideEncryption)
 }
 
 func (s *s3client) Delete(key string) error {
@@ -158,6 +378,58 @@ func (s *s3client) Delete(key string) error {
 	return err
 }
 
+func (s *s3client) UpdateCredentials(accessKey, secretKey, token string) error {
+	if s.creds == nil {
+		return notSupported
+	}
+	value := credentials.Value{AccessKeyID: accessKey, SecretAccessKey: secretKey, SessionToken: token}
+	// verify them with another client, the same as Create()
+	ses := s.ses.Copy(&aws.Config{Credentials: credentials.NewStaticCredentialsFromCreds(value)})
+	_, err := s3.New(ses).ListObjects(&s3.ListObjectsInput{Bucket: &s.bucket, MaxKeys: aws.Int64(1)})
+	if err != nil {
+		return fmt.Errorf("verify credentials: %s", err)
+	}
+	s.creds.Lock()
+	s.creds.value = &value
+	s.creds.Unlock()
+	s.ses.Config.Credentials.Expire()
+	logger.Infof("Credentials of %s are updated to access key %s", s, accessKey)
+	return nil
+}
+
+// maxDeleteKeys is the maximum number of objects deleted by one DeleteObjects request.
+const maxDeleteKeys = 1000
+
+func (s *s3client) DeleteMany(keys []string) map[string]error {
+	errs := make(map[string]error)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxDeleteKeys {
+			batch = batch[:maxDeleteKeys]
+		}
+		keys = keys[len(batch):]
+		objs := make([]*s3.ObjectIdentifier, len(batch))
+		for i := range batch {
+			objs[i] = &s3.ObjectIdentifier{Key: &batch[i]}
+		}
+		param := s3.DeleteObjectsInput{
+			Bucket: &s.bucket,
+			Delete: &s3.Delete{Objects: objs, Quiet: aws.Bool(true)},
+		}
+		resp, err := s.s3.DeleteObjects(&param)
+		if err != nil {
+			for _, key := range batch {
+				errs[key] = err
+			}
+			continue
+		}
+		for _, e := range resp.Errors {
+			errs[aws.StringValue(e.Key)] = fmt.Errorf("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+		}
+	}
+	return errs
+}
+
 func (s *s3client) List(prefix, marker string, limit int64) ([]Object, error) {
 	param := s3.ListObjectsInput{
 		Bucket:  &s.bucket,
@@ -192,10 +464,15 @@ func (s *s3client) CreateMultipartUpload(key string) (*MultipartUpload, error) {
 		Bucket: &s.bucket,
 		Key:    &key,
 	}
+	params.ServerSideEncryption, params.SSEKMSKeyId = s.encryptionParams()
 	resp, err := s.s3.CreateMultipartUpload(params)
 	if err != nil {
 		return nil, err
 	}
+	if err = s.checkEncrypted(key, resp.ServerSideEncryption); err != nil {
+		s.AbortUpload(key, *resp.UploadId)
+		return nil, err
+	}
 	return &MultipartUpload{UploadID: *resp.UploadId, MinPartSize: 5 << 20, MaxCount: 10000}, nil
 }
 
@@ -237,7 +514,10 @@ func (s *s3client) CompleteUpload(key string, uploadID string, parts []*Part) er
 		UploadId:        &uploadID,
 		MultipartUpload: &s3.CompletedMultipartUpload{Parts: s3Parts},
 	}
-	_, err := s.s3.CompleteMultipartUpload(params)
+	// a retry could fail after the last try succeeded, so it's left to WithRetry, which checks the object first
+	_, err := s.s3.CompleteMultipartUploadWithContext(aws.BackgroundContext(), params, func(r *request.Request) {
+		r.Retryer = client.NoOpRetryer{}
+	})
 	return err
 }
 
@@ -429,7 +709,8 @@ func newS3(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("Fail to create aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &s3client{bucketName, s3.New(ses), ses}, nil
+	creds := swappable(ses)
+	return &s3client{bucketName, s3.New(ses), ses, creds, nil}, nil
 }
 
 func init() {
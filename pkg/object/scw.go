@@ -74,7 +74,7 @@ func newScw(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &scw{s3client{bucket, s3.New(ses), ses}}, nil
+	return &scw{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
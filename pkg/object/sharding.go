@@ -18,6 +18,7 @@ package object
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -58,14 +59,71 @@ func (s *sharded) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return s.pick(key).Get(key, off, limit)
 }
 
+func (s *sharded) GetWithContext(ctx context.Context, key string, off, limit int64) (io.ReadCloser, error) {
+	return GetWithContext(ctx, s.pick(key), key, off, limit)
+}
+
+func (s *sharded) Presign(key string, expire time.Duration) (string, error) {
+	return Presign(s.pick(key), key, expire)
+}
+
 func (s *sharded) Put(key string, body io.Reader) error {
 	return s.pick(key).Put(key, body)
 }
 
+func (s *sharded) PutIfAbsent(key string, body io.Reader) error {
+	return PutIfAbsent(s.pick(key), key, body)
+}
+
+func (s *sharded) Append(key string, off int64, body io.Reader) error {
+	return Append(s.pick(key), key, off, body)
+}
+
 func (s *sharded) Delete(key string) error {
 	return s.pick(key).Delete(key)
 }
 
+func (s *sharded) DeleteMany(keys []string) map[string]error {
+	groups := make(map[ObjectStorage][]string)
+	for _, key := range keys {
+		o := s.pick(key)
+		groups[o] = append(groups[o], key)
+	}
+	errs := make(map[string]error)
+	for o, ks := range groups {
+		for key, err := range DeleteMany(o, ks) {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+// UpdateCredentials updates all the shards, the ones failed keep their old credentials.
+func (s *sharded) UpdateCredentials(accessKey, secretKey, token string) error {
+	var lastErr error
+	for _, o := range s.stores {
+		if err := UpdateCredentials(o, accessKey, secretKey, token); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (s *sharded) SetServerSideEncryption(sse, kmsKeyID string) error {
+	for _, o := range s.stores {
+		if err := SetServerSideEncryption(o, sse, kmsKeyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sharded) SetUploadChecksum(enabled bool) {
+	for _, o := range s.stores {
+		_ = SetUploadChecksum(o, enabled)
+	}
+}
+
 const maxResults = 10000
 
 // ListAll on all the keys that starts at marker from object storage.
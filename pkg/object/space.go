@@ -63,7 +63,7 @@ func newSpace(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &space{s3client{bucket, s3.New(ses), ses}}, nil
+	return &space{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
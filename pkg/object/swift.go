@@ -94,6 +94,9 @@ func newSwiftOSS(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		ApiKey:   secretKey,
 		AuthUrl:  authURL,
 	}
+	if customTransport {
+		conn.Transport = httpClient.Transport
+	}
 	err = conn.Authenticate()
 	if err != nil {
 		return nil, fmt.Errorf("Auth: %s", err)
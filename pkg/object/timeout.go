@@ -0,0 +1,330 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeouts is the timeouts of a request to object storage, zero means no limit (or the default one
+// when it's overridden for a type of requests).
+type Timeouts struct {
+	Connect time.Duration // to establish a new connection, the dial timeout of transport if zero
+	Header  time.Duration // to receive the response header after the request is sent
+	Body    time.Duration // without any progress in sending the request body or reading the response body
+}
+
+// TimeoutConfig is the timeouts of requests, which can be overridden by the type of requests:
+// head, get, list, put, delete and multipart.
+type TimeoutConfig struct {
+	Default Timeouts
+	Ops     map[string]Timeouts
+}
+
+var opTypes = []string{"head", "get", "list", "put", "delete", "multipart"}
+
+func isOpType(op string) bool {
+	for _, o := range opTypes {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+var timeouts = TimeoutConfig{Default: Timeouts{Header: time.Second * 30}}
+
+// of returns the timeouts of a type of requests, the zero ones in the override are the default ones.
+func (c *TimeoutConfig) of(op string) Timeouts {
+	t := c.Default
+	if o, ok := c.Ops[op]; ok {
+		if o.Connect > 0 {
+			t.Connect = o.Connect
+		}
+		if o.Header > 0 {
+			t.Header = o.Header
+		}
+		if o.Body > 0 {
+			t.Body = o.Body
+		}
+	}
+	return t
+}
+
+// ParseOpTimeouts parses the timeouts of a type of requests in format of OP:KEY=DURATION[,KEY=DURATION],
+// the keys are connect, header and body, e.g. multipart:header=2m,body=1m.
+func ParseOpTimeouts(s string) (string, Timeouts, error) {
+	var t Timeouts
+	parts := strings.SplitN(s, ":", 2)
+	op := strings.ToLower(strings.TrimSpace(parts[0]))
+	if !isOpType(op) || len(parts) < 2 {
+		return op, t, fmt.Errorf("invalid timeouts: %s, should be OP:KEY=DURATION with OP in %s", s, strings.Join(opTypes, ", "))
+	}
+	for _, kv := range strings.Split(parts[1], ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) < 2 {
+			return op, t, fmt.Errorf("invalid timeout %q in %s", kv, s)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(p[1]))
+		if err != nil || d < 0 {
+			return op, t, fmt.Errorf("invalid timeout %q in %s", kv, s)
+		}
+		switch strings.TrimSpace(p[0]) {
+		case "connect":
+			t.Connect = d
+		case "header":
+			t.Header = d
+		case "body":
+			t.Body = d
+		default:
+			return op, t, fmt.Errorf("invalid timeout %q in %s, should be connect, header or body", kv, s)
+		}
+	}
+	return op, t, nil
+}
+
+// SetTimeoutConfig changes the timeouts of requests of all HTTP-based storages, the transport is
+// wrapped to apply them by the type of every request if they are not the default ones.
+func SetTimeoutConfig(conf TimeoutConfig) error {
+	check := func(t Timeouts) bool { return t.Connect >= 0 && t.Header >= 0 && t.Body >= 0 }
+	if !check(conf.Default) {
+		return fmt.Errorf("invalid timeouts: %+v", conf.Default)
+	}
+	for op, t := range conf.Ops {
+		if !isOpType(op) || !check(t) {
+			return fmt.Errorf("invalid timeouts of %s: %+v", op, t)
+		}
+	}
+	if conf.Default == timeouts.Default && len(conf.Ops) == 0 && len(timeouts.Ops) == 0 {
+		return nil
+	}
+	if os.Getenv("AWS_CA_BUNDLE") != "" {
+		logger.Warnf("AWS_CA_BUNDLE can't be used with the timeouts of requests, please use --ca-cert instead")
+	}
+	timeouts = conf
+	// the header timeout of transport can't be overridden by the type of requests
+	transport.ResponseHeaderTimeout = 0
+	httpClient.Transport = &timeoutTransport{transport}
+	customTransport = true
+	return nil
+}
+
+// opOf returns the type of a request, guessed from the method and the query, which is the same
+// for most of the storages.
+func opOf(req *http.Request) string {
+	q := req.URL.Query()
+	has := func(keys ...string) bool {
+		for _, k := range keys {
+			if _, ok := q[k]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case req.Method == http.MethodHead:
+		return "head"
+	case has("uploadId", "uploads"):
+		return "multipart"
+	case req.Method == http.MethodDelete || req.Method == http.MethodPost && has("delete"):
+		return "delete"
+	case req.Method == http.MethodGet && (has("prefix", "list-type", "marker", "delimiter") || q.Get("comp") == "list"):
+		return "list"
+	case req.Method == http.MethodGet:
+		return "get"
+	default:
+		return "put"
+	}
+}
+
+type connectTimeoutKey struct{}
+
+// timeoutError is returned when a request makes no progress in time.
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timeout after %s %s", e.timeout, e.phase)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// watchdog cancels a request if it makes no progress before the deadline of the current phase.
+type watchdog struct {
+	sync.Mutex
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	phase    string
+	timeout  time.Duration
+	deadline time.Time
+	expired  bool
+}
+
+// arm starts a phase of the request, which should make progress in every timeout (no limit if zero).
+func (w *watchdog) arm(phase string, timeout time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	if w.expired {
+		return
+	}
+	w.phase, w.timeout = phase, timeout
+	if timeout <= 0 {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		return
+	}
+	w.deadline = time.Now().Add(timeout)
+	if w.timer == nil {
+		w.timer = time.AfterFunc(timeout, w.fire)
+	} else {
+		w.timer.Stop()
+		w.timer.Reset(timeout)
+	}
+}
+
+// progress extends the deadline of the current phase, it's cheaper than resetting the timer.
+func (w *watchdog) progress() {
+	w.Lock()
+	if w.timeout > 0 {
+		w.deadline = time.Now().Add(w.timeout)
+	}
+	w.Unlock()
+}
+
+func (w *watchdog) fire() {
+	w.Lock()
+	defer w.Unlock()
+	if w.timeout <= 0 || w.expired {
+		return
+	}
+	if d := time.Until(w.deadline); d > 0 {
+		w.timer.Reset(d)
+		return
+	}
+	w.expired = true
+	w.cancel()
+}
+
+func (w *watchdog) stop() {
+	w.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timeout = 0
+	w.Unlock()
+	w.cancel()
+}
+
+// err returns a timeoutError instead of err if the request was canceled by the watchdog.
+func (w *watchdog) err(err error) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.expired {
+		return &timeoutError{w.phase, w.timeout}
+	}
+	return err
+}
+
+type sendingBody struct {
+	io.ReadCloser
+	w      *watchdog
+	header time.Duration
+}
+
+func (b *sendingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.w.arm("waiting for response header", b.header)
+	} else {
+		b.w.progress()
+	}
+	return n, err
+}
+
+type receivingBody struct {
+	io.ReadCloser
+	w *watchdog
+}
+
+func (b *receivingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.w.progress()
+	}
+	if err != nil && err != io.EOF {
+		err = b.w.err(err)
+	}
+	return n, err
+}
+
+func (b *receivingBody) Close() error {
+	b.w.stop()
+	return b.ReadCloser.Close()
+}
+
+// timeoutTransport applies the timeouts to every request by its type.
+type timeoutTransport struct {
+	*http.Transport
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	to := timeouts.of(opOf(req))
+	if to == (Timeouts{}) {
+		return t.Transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	if to.Connect > 0 {
+		ctx = context.WithValue(ctx, connectTimeoutKey{}, to.Connect)
+	}
+	w := &watchdog{cancel: cancel}
+	req = req.WithContext(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &sendingBody{req.Body, w, to.Header}
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return &sendingBody{body, w, to.Header}, nil
+			}
+		}
+		w.arm("sending request body", to.Body)
+	} else {
+		w.arm("waiting for response header", to.Header)
+	}
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		err = w.err(err)
+		w.stop()
+		return nil, err
+	}
+	w.arm("reading response body", to.Body)
+	resp.Body = &receivingBody{resp.Body, w}
+	return resp, nil
+}
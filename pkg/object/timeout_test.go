@@ -0,0 +1,164 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader returns the data after a delay.
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.Reader.Read(p)
+}
+
+func TestTimeouts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(time.Millisecond * 300)
+		case "/stuck-body":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 300)
+			_, _ = w.Write([]byte("data"))
+		case "/slow-body":
+			w.WriteHeader(http.StatusOK)
+			for i := 0; i < 10; i++ {
+				_, _ = w.Write(bytes.Repeat([]byte{'a'}, 1024))
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond * 50)
+			}
+		default:
+			_, _ = ioutil.ReadAll(r.Body)
+		}
+	}))
+	defer ts.Close()
+	orig := timeouts
+	defer func() { timeouts = orig }()
+
+	do := func(method, path string, body io.Reader) (int, error) {
+		req, _ := http.NewRequest(method, ts.URL+path, body)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		return len(data), err
+	}
+	timedOut := func(err error, phase string) bool {
+		var e *timeoutError
+		return errors.As(err, &e) && e.phase == phase
+	}
+	withTransport(func(tr *http.Transport) {
+		if err := SetTimeoutConfig(TimeoutConfig{
+			Default: Timeouts{Header: time.Millisecond * 100, Body: time.Millisecond * 150},
+			Ops:     map[string]Timeouts{"head": {Header: time.Second}},
+		}); err != nil {
+			t.Fatalf("set timeouts: %s", err)
+		}
+		if !customTransport {
+			t.Fatalf("transport should be customized")
+		}
+		if _, err := do("GET", "/stuck-body", nil); !timedOut(err, "reading response body") {
+			t.Fatalf("stuck body should time out: %v", err)
+		}
+		if n, err := do("GET", "/slow-body", nil); err != nil || n != 10<<10 {
+			t.Fatalf("slow but progressing body should not time out: %d %v", n, err)
+		}
+		if _, err := do("GET", "/slow-header", nil); !timedOut(err, "waiting for response header") {
+			t.Fatalf("slow header should time out: %v", err)
+		}
+		if _, err := do("HEAD", "/slow-header", nil); err != nil {
+			t.Fatalf("header timeout of HEAD is overridden: %v", err)
+		}
+		if _, err := do("PUT", "/put", &slowReader{strings.NewReader("data"), time.Millisecond * 300}); !timedOut(err, "sending request body") {
+			t.Fatalf("stuck request body should time out: %v", err)
+		}
+		if _, err := do("PUT", "/put", &slowReader{strings.NewReader(strings.Repeat("a", 10<<10)), time.Millisecond * 50}); err != nil {
+			t.Fatalf("slow but progressing request body should not time out: %v", err)
+		}
+	})
+
+	for _, conf := range []TimeoutConfig{
+		{Default: Timeouts{Body: -1}},
+		{Ops: map[string]Timeouts{"copy": {Header: time.Second}}},
+	} {
+		if err := SetTimeoutConfig(conf); err == nil {
+			t.Fatalf("%+v should be invalid", conf)
+		}
+	}
+}
+
+func TestParseOpTimeouts(t *testing.T) {
+	op, to, err := ParseOpTimeouts("multipart:header=2m,body=1m")
+	if err != nil || op != "multipart" || to != (Timeouts{Header: time.Minute * 2, Body: time.Minute}) {
+		t.Fatalf("parse: %s %+v %v", op, to, err)
+	}
+	op, to, err = ParseOpTimeouts("HEAD:connect=1s")
+	if err != nil || op != "head" || to != (Timeouts{Connect: time.Second}) {
+		t.Fatalf("parse: %s %+v %v", op, to, err)
+	}
+	for _, s := range []string{"head", "copy:header=1s", "get:header", "get:header=-1s", "get:read=1s", "get:header=1x"} {
+		if _, _, err := ParseOpTimeouts(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+	conf := TimeoutConfig{Default: Timeouts{Connect: time.Second, Header: time.Second}, Ops: map[string]Timeouts{"get": {Body: time.Minute}}}
+	if to := conf.of("get"); to != (Timeouts{time.Second, time.Second, time.Minute}) {
+		t.Fatalf("timeouts of get: %+v", to)
+	}
+	if to := conf.of("put"); to != conf.Default {
+		t.Fatalf("timeouts of put: %+v", to)
+	}
+}
+
+func TestOpOf(t *testing.T) {
+	cases := []struct {
+		method, url, op string
+	}{
+		{"HEAD", "/bucket/key", "head"},
+		{"GET", "/bucket/key", "get"},
+		{"GET", "/bucket/?list-type=2&prefix=a", "list"},
+		{"GET", "/container?restype=container&comp=list", "list"},
+		{"PUT", "/bucket/key", "put"},
+		{"PUT", "/bucket/key?partNumber=1&uploadId=x", "multipart"},
+		{"POST", "/bucket/key?uploads", "multipart"},
+		{"DELETE", "/bucket/key", "delete"},
+		{"POST", "/bucket/?delete", "delete"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://localhost"+c.url, nil)
+		if op := opOf(req); op != c.op {
+			t.Fatalf("%s %s should be %s, but got %s", c.method, c.url, c.op, op)
+		}
+	}
+}
@@ -66,7 +66,7 @@ func newWasabi(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
 		return nil, fmt.Errorf("aws session: %s", err)
 	}
 	ses.Handlers.Build.PushFront(disableSha256Func)
-	return &wasabi{s3client{bucket, s3.New(ses), ses}}, nil
+	return &wasabi{s3client{bucket, s3.New(ses), ses, nil, nil}}, nil
 }
 
 func init() {
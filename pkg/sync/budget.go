@@ -0,0 +1,74 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"fmt"
+	"sync"
+)
+
+// budget limits the number of objects and bytes copied in one run (0 means unlimited). An object
+// is copied only if it fits into the rest of budget, the others are deferred to the next run, which
+// will find them again by comparing the source and destination.
+type budget struct {
+	sync.Mutex
+	maxObjects, maxBytes int64
+	objects, bytes       int64
+}
+
+var spending *budget
+
+func newBudget(maxObjects, maxBytes int64) *budget {
+	if maxObjects <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	return &budget{maxObjects: maxObjects, maxBytes: maxBytes}
+}
+
+// take spends the budget for an object of size, or returns false if it doesn't fit.
+func (b *budget) take(size int64) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.maxObjects > 0 && b.objects+1 > b.maxObjects || b.maxBytes > 0 && b.bytes+size > b.maxBytes {
+		return false
+	}
+	b.objects++
+	b.bytes += size
+	return true
+}
+
+func (b *budget) String() string {
+	b.Lock()
+	defer b.Unlock()
+	limit := func(used, max int64, f func(int64) string) string {
+		if max <= 0 {
+			return f(used)
+		}
+		return fmt.Sprintf("%s/%s", f(used), f(max))
+	}
+	count := func(n int64) string { return fmt.Sprint(n) }
+	return fmt.Sprintf("%s objects, %s", limit(b.objects, b.maxObjects, count), limit(b.bytes, b.maxBytes, formatSize))
+}
+
+// deferTask counts an object deferred by the budget.
+func deferTask(size int64) {
+	deferred.Increment()
+	deferredBytes.IncrInt64(size)
+}
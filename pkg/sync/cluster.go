@@ -25,6 +25,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -43,6 +44,9 @@ type Stat struct {
 	Deleted      int64 // the number of deleted files
 	Skipped      int64 // the number of files skipped
 	Failed       int64 // the number of files that fail to copy
+	Mismatched   int64 // the number of copied files different from source, with --verify-after
+	Unverified   int64 // the number of files failed the verification after retries
+	ServerCopied int64 // the number of files copied on the server side
 }
 
 func updateStats(r *Stat) {
@@ -52,6 +56,9 @@ func updateStats(r *Stat) {
 	deleted.IncrInt64(r.Deleted)
 	skipped.IncrInt64(r.Skipped)
 	failed.IncrInt64(r.Failed)
+	mismatched.IncrInt64(r.Mismatched)
+	unverified.IncrInt64(r.Unverified)
+	serverCopied.IncrInt64(r.ServerCopied)
 	handled.IncrInt64(r.Copied + r.Deleted + r.Skipped + r.Failed)
 }
 
@@ -81,6 +88,9 @@ func sendStats(addr string) {
 	r.Deleted = deleted.Current()
 	r.Skipped = skipped.Current()
 	r.Failed = failed.Current()
+	r.Mismatched = mismatched.Current()
+	r.Unverified = unverified.Current()
+	r.ServerCopied = serverCopied.Current()
 	d, _ := json.Marshal(r)
 	ans, err := httpRequest(fmt.Sprintf("http://%s/stats", addr), d)
 	if err != nil || string(ans) != "OK" {
@@ -92,6 +102,9 @@ func sendStats(addr string) {
 		deleted.IncrInt64(-r.Deleted)
 		skipped.IncrInt64(-r.Skipped)
 		failed.IncrInt64(-r.Failed)
+		mismatched.IncrInt64(-r.Mismatched)
+		unverified.IncrInt64(-r.Unverified)
+		serverCopied.IncrInt64(-r.ServerCopied)
 	}
 }
 
@@ -132,23 +145,140 @@ func findLocalIP() (string, error) {
 	return "", errors.New("are you connected to the network?")
 }
 
-func startManager(tasks <-chan object.Object) (string, error) {
-	http.HandleFunc("/fetch", func(w http.ResponseWriter, req *http.Request) {
-		var objs []object.Object
-		obj, ok := <-tasks
+// workerLease is how long a worker can be silent before its batches are taken over by others.
+var workerLease = time.Minute
+
+// batch is the objects sent to a worker in one fetch.
+type batch struct {
+	ID      uint64                   `json:"id"`
+	Worker  string                   `json:"worker"`
+	Objects []map[string]interface{} `json:"objects"`
+	Done    map[string]bool          `json:"done,omitempty"` // the keys handled
+}
+
+func (b *batch) remaining() []map[string]interface{} {
+	var objs []map[string]interface{}
+	for _, o := range b.Objects {
+		if !b.Done[o["key"].(string)] {
+			objs = append(objs, o)
+		}
+	}
+	return objs
+}
+
+type fetchReply struct {
+	Batches []*batch `json:"batches"`
+	Wait    bool     `json:"wait,omitempty"` // no more objects, but some batches are not finished
+}
+
+type doneReport struct {
+	Worker  string              `json:"worker"`
+	Session string              `json:"session"`
+	Done    map[uint64][]string `json:"done"`
+}
+
+// manager hands out the objects to the workers in batches, and remembers the unfinished ones
+// (persisted into the checkpoint file if any), so a restarted worker (with the same id) resumes
+// its batches, and the ones of dead workers are taken over by others.
+type manager struct {
+	sync.Mutex
+	tasks      <-chan object.Object
+	checkpoint string
+	dirty      bool
+	NextID     uint64            `json:"next"`
+	Batches    map[uint64]*batch `json:"batches"`
+	sessions   map[string]string
+	seen       map[string]time.Time
+}
+
+func newManager(tasks <-chan object.Object, checkpoint string) (*manager, error) {
+	m := &manager{
+		tasks:      tasks,
+		checkpoint: checkpoint,
+		Batches:    make(map[uint64]*batch),
+		sessions:   make(map[string]string),
+		seen:       make(map[string]time.Time),
+	}
+	if checkpoint == "" {
+		return m, nil
+	}
+	d, err := ioutil.ReadFile(checkpoint)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, m); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %s", checkpoint, err)
+	}
+	if m.Batches == nil {
+		m.Batches = make(map[uint64]*batch)
+	}
+	for _, b := range m.Batches {
+		// resumed by the worker with the same id, or taken over by others after the lease
+		m.seen[b.Worker] = time.Now()
+		m.sessions[b.Worker] = ""
+	}
+	logger.Infof("Resume %d unfinished batches from checkpoint %s", len(m.Batches), checkpoint)
+	return m, nil
+}
+
+func (m *manager) reply(b *batch) *batch {
+	return &batch{ID: b.ID, Worker: b.Worker, Objects: b.remaining()}
+}
+
+// fetch returns the batches for a worker: the unfinished ones of itself if it's restarted, or the
+// ones of a dead worker, or a new batch.
+func (m *manager) fetch(worker, session string) *fetchReply {
+	var r fetchReply
+	m.Lock()
+	now := time.Now()
+	m.seen[worker] = now
+	if s, ok := m.sessions[worker]; ok && s != session {
+		for _, b := range m.Batches {
+			if b.Worker == worker {
+				r.Batches = append(r.Batches, m.reply(b))
+			}
+		}
+		if len(r.Batches) > 0 {
+			logger.Infof("Worker %s is restarted, resume its %d batches", worker, len(r.Batches))
+		}
+	}
+	m.sessions[worker] = session
+	if len(r.Batches) == 0 {
+		for _, b := range m.Batches {
+			if b.Worker != worker && now.Sub(m.seen[b.Worker]) > workerLease {
+				logger.Infof("Worker %s is silent for %s, its batch %d is taken over by %s", b.Worker, now.Sub(m.seen[b.Worker]), b.ID, worker)
+				b.Worker = worker
+				m.dirty = true
+				r.Batches = append(r.Batches, m.reply(b))
+				break
+			}
+		}
+	}
+	m.Unlock()
+	if len(r.Batches) > 0 {
+		return &r
+	}
+
+	var objs []map[string]interface{}
+	for len(objs) == 0 {
+		obj, ok := <-m.tasks
 		if !ok {
-			_, _ = w.Write([]byte("[]"))
-			return
+			m.Lock()
+			r.Wait = len(m.Batches) > 0
+			m.Unlock()
+			return &r
 		}
-		objs = append(objs, obj)
+		objs = admit(objs, obj)
 	LOOP:
 		for {
 			select {
-			case obj = <-tasks:
+			case obj = <-m.tasks:
 				if obj == nil {
 					break LOOP
 				}
-				objs = append(objs, obj)
+				objs = admit(objs, obj)
 				if len(objs) > 100 {
 					break LOOP
 				}
@@ -156,14 +286,145 @@ func startManager(tasks <-chan object.Object) (string, error) {
 				break LOOP
 			}
 		}
-		d, err := marshalObjects(objs)
+	}
+	m.Lock()
+	m.NextID++
+	b := &batch{ID: m.NextID, Worker: worker, Objects: objs, Done: make(map[string]bool)}
+	m.Batches[b.ID] = b
+	m.dirty = true
+	m.Unlock()
+	r.Batches = append(r.Batches, m.reply(b))
+	return &r
+}
+
+// admit appends the object to a batch if it fits into the budget (the workers don't check it).
+func admit(objs []map[string]interface{}, obj object.Object) []map[string]interface{} {
+	if obj.Size() >= 0 && !spending.take(obj.Size()) {
+		deferTask(obj.Size())
+		handled.Increment()
+		return objs
+	}
+	return append(objs, object.MarshalObject(obj))
+}
+
+func (m *manager) done(r *doneReport) {
+	m.Lock()
+	defer m.Unlock()
+	m.seen[r.Worker] = time.Now()
+	for id, keys := range r.Done {
+		b := m.Batches[id]
+		if b == nil {
+			continue
+		}
+		if b.Done == nil {
+			b.Done = make(map[string]bool)
+		}
+		for _, k := range keys {
+			b.Done[k] = true
+		}
+		if len(b.remaining()) == 0 {
+			delete(m.Batches, id)
+		}
+		m.dirty = true
+	}
+}
+
+// takeAll returns the unfinished objects of all the batches, which are left by the dead workers.
+func (m *manager) takeAll() []object.Object {
+	m.Lock()
+	defer m.Unlock()
+	var objs []object.Object
+	for _, b := range m.Batches {
+		for _, o := range b.remaining() {
+			// the same as the ones sent to workers in JSON
+			var m map[string]interface{}
+			d, _ := json.Marshal(o)
+			_ = json.Unmarshal(d, &m)
+			objs = append(objs, object.UnmarshalObject(m))
+		}
+	}
+	return objs
+}
+
+// save writes the unfinished batches into the checkpoint file atomically.
+func (m *manager) save() error {
+	m.Lock()
+	defer m.Unlock()
+	if m.checkpoint == "" || !m.dirty {
+		return nil
+	}
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := m.checkpoint + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(d)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, m.checkpoint)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	} else {
+		m.dirty = false
+	}
+	return err
+}
+
+// close removes the checkpoint after all the objects are handled.
+func (m *manager) close() {
+	m.Lock()
+	defer m.Unlock()
+	if m.checkpoint != "" {
+		_ = os.Remove(m.checkpoint)
+		m.checkpoint = ""
+	}
+}
+
+func startManager(m *manager) (string, error) {
+	http.HandleFunc("/fetch", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		r := m.fetch(q.Get("worker"), q.Get("session"))
+		d, err := json.Marshal(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		logger.Debugf("send %d objects to %s", len(objs), req.RemoteAddr)
+		logger.Debugf("send %d batches to %s (%s)", len(r.Batches), q.Get("worker"), req.RemoteAddr)
 		_, _ = w.Write(d)
 	})
+	http.HandleFunc("/done", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "POST required", http.StatusBadRequest)
+			return
+		}
+		var r doneReport
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.done(&r)
+		_, _ = w.Write([]byte("OK"))
+	})
+	if m.checkpoint != "" {
+		go func() {
+			for {
+				if err := m.save(); err != nil {
+					logger.Warnf("Save checkpoint: %s", err)
+				}
+				time.Sleep(time.Second)
+			}
+		}()
+	}
 	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "POST" {
 			http.Error(w, "POST required", http.StatusBadRequest)
@@ -221,9 +482,16 @@ func findSelfPath() (string, error) {
 
 func launchWorker(address string, config *Config, wg *sync.WaitGroup) {
 	workers := strings.Split(strings.Join(config.Workers, ","), ",")
+	launched := make(map[string]int)
 	for _, host := range workers {
+		// the id should not be changed when the worker is restarted
+		id := host
+		if n := launched[host]; n > 0 {
+			id = fmt.Sprintf("%s#%d", host, n)
+		}
+		launched[host]++
 		wg.Add(1)
-		go func(host string) {
+		go func(host, id string) {
 			defer wg.Done()
 			// copy
 			path, err := findSelfPath()
@@ -247,9 +515,9 @@ func launchWorker(address string, config *Config, wg *sync.WaitGroup) {
 			var args = []string{host, rpath}
 			if strings.HasSuffix(path, "juicefs") {
 				args = append(args, os.Args[1:]...)
-				args = append(args, "--manager", address)
+				args = append(args, "--manager", address, "--worker-id", id)
 			} else {
-				args = append(args, "--manager", address)
+				args = append(args, "--manager", address, "--worker-id", id)
 				args = append(args, os.Args[1:]...)
 			}
 			if !config.Verbose && !config.Quiet {
@@ -282,53 +550,105 @@ func launchWorker(address string, config *Config, wg *sync.WaitGroup) {
 			if err != nil {
 				logger.Errorf("%s: %s", host, err)
 			}
-		}(host)
+		}(host, id)
 	}
 }
 
-func marshalObjects(objs []object.Object) ([]byte, error) {
-	var arr []map[string]interface{}
-	for _, o := range objs {
-		arr = append(arr, object.MarshalObject(o))
+// doneTracker remembers the batches of the objects fetched by a worker, and reports the handled
+// ones to the manager.
+type doneTracker struct {
+	sync.Mutex
+	worker  string
+	session string
+	pending map[string][]uint64
+	done    map[uint64][]string
+}
+
+var jobs *doneTracker
+
+func newDoneTracker(worker string) *doneTracker {
+	if worker == "" {
+		worker, _ = os.Hostname()
+	}
+	return &doneTracker{
+		worker:  worker,
+		session: fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()),
+		pending: make(map[string][]uint64),
+		done:    make(map[uint64][]string),
 	}
-	return json.MarshalIndent(arr, "", " ")
 }
 
-func unmarshalObjects(d []byte) ([]object.Object, error) {
-	var arr []map[string]interface{}
-	err := json.Unmarshal(d, &arr)
-	if err != nil {
-		return nil, err
+func (t *doneTracker) add(key string, id uint64) {
+	t.Lock()
+	t.pending[key] = append(t.pending[key], id)
+	t.Unlock()
+}
+
+func (t *doneTracker) finish(key string) {
+	if t == nil {
+		return
 	}
-	var objs []object.Object
-	for _, m := range arr {
-		objs = append(objs, object.UnmarshalObject(m))
+	t.Lock()
+	defer t.Unlock()
+	ids := t.pending[key]
+	if len(ids) == 0 {
+		return
+	}
+	t.done[ids[0]] = append(t.done[ids[0]], key)
+	if len(ids) == 1 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = ids[1:]
+	}
+}
+
+// report sends the handled objects to the manager, it's also the heartbeat of the worker.
+func (t *doneTracker) report(addr string) {
+	t.Lock()
+	r := doneReport{Worker: t.worker, Session: t.session, Done: t.done}
+	t.done = make(map[uint64][]string)
+	t.Unlock()
+	d, _ := json.Marshal(&r)
+	ans, err := httpRequest(fmt.Sprintf("http://%s/done", addr), d)
+	if err != nil || string(ans) != "OK" {
+		logger.Errorf("report handled objects: %s %s", string(ans), err)
+		t.Lock()
+		for id, keys := range r.Done {
+			t.done[id] = append(t.done[id], keys...)
+		}
+		t.Unlock()
 	}
-	return objs, nil
 }
 
 func fetchJobs(tasks chan<- object.Object, config *Config) {
 	for {
-		url := fmt.Sprintf("http://%s/fetch", config.Manager)
+		url := fmt.Sprintf("http://%s/fetch?worker=%s&session=%s", config.Manager, neturl.QueryEscape(jobs.worker), jobs.session)
 		ans, err := httpRequest(url, nil)
 		if err != nil {
 			logger.Errorf("fetch jobs: %s", err)
 			time.Sleep(time.Second)
 			continue
 		}
-		var jobs []object.Object
-		jobs, err = unmarshalObjects(ans)
-		if err != nil {
+		var r fetchReply
+		if err = json.Unmarshal(ans, &r); err != nil {
 			logger.Errorf("Unmarshal %s: %s", string(ans), err)
 			time.Sleep(time.Second)
 			continue
 		}
-		logger.Debugf("got %d jobs", len(jobs))
-		if len(jobs) == 0 {
+		if r.Wait {
+			time.Sleep(time.Second)
+			continue
+		}
+		logger.Debugf("got %d batches", len(r.Batches))
+		if len(r.Batches) == 0 {
 			break
 		}
-		for _, obj := range jobs {
-			tasks <- obj
+		for _, b := range r.Batches {
+			for _, m := range b.Objects {
+				obj := object.UnmarshalObject(m)
+				jobs.add(obj.Key(), b.ID)
+				tasks <- obj
+			}
 		}
 	}
 	close(tasks)
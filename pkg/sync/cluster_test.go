@@ -16,6 +16,9 @@
 package sync
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,7 +40,8 @@ func (o *obj) IsDir() bool      { return o.isDir }
 func TestCluster(t *testing.T) {
 	// manager
 	todo := make(chan object.Object, 100)
-	addr, err := startManager(todo)
+	mgr, _ := newManager(todo, "")
+	addr, err := startManager(mgr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,6 +49,8 @@ func TestCluster(t *testing.T) {
 	// worker
 	var conf Config
 	conf.Manager = addr
+	jobs = newDoneTracker("w1")
+	defer func() { jobs = nil }()
 	mytodo := make(chan object.Object, 100)
 	go fetchJobs(mytodo, &conf)
 
@@ -55,7 +61,124 @@ func TestCluster(t *testing.T) {
 	if obj.Key() != "test" {
 		t.Fatalf("expect test but got %s", obj.Key())
 	}
+	// the worker waits until its batch is finished
+	jobs.finish(obj.Key())
+	jobs.report(addr)
 	if _, ok := <-mytodo; ok {
 		t.Fatalf("should end")
 	}
 }
+
+func keysOf(r *fetchReply) []string {
+	var keys []string
+	for _, b := range r.Batches {
+		for _, o := range b.Objects {
+			keys = append(keys, o["key"].(string))
+		}
+	}
+	return keys
+}
+
+func TestManagerResume(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	todo := make(chan object.Object, 10)
+	m, err := newManager(todo, checkpoint)
+	if err != nil {
+		t.Fatalf("new manager: %s", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		todo <- &obj{key: k}
+	}
+	r := m.fetch("w1", "s1")
+	if len(r.Batches) != 1 || len(keysOf(r)) != 3 {
+		t.Fatalf("expect a batch of 3 objects, but got %+v", keysOf(r))
+	}
+	id := r.Batches[0].ID
+	m.done(&doneReport{Worker: "w1", Session: "s1", Done: map[uint64][]string{id: {"a"}}})
+
+	// w1 is restarted, it resumes the unfinished objects only
+	todo <- &obj{key: "d"}
+	r = m.fetch("w1", "s2")
+	if len(r.Batches) != 1 || r.Batches[0].ID != id || strings.Join(keysOf(r), ",") != "b,c" {
+		t.Fatalf("expect b,c of batch %d, but got %+v", id, r.Batches)
+	}
+	r = m.fetch("w1", "s2")
+	if strings.Join(keysOf(r), ",") != "d" {
+		t.Fatalf("expect d, but got %+v", keysOf(r))
+	}
+	if err = m.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	// the manager is restarted from the checkpoint
+	close(todo)
+	m2, err := newManager(todo, checkpoint)
+	if err != nil || len(m2.Batches) != 2 {
+		t.Fatalf("load checkpoint: %+v %s", m2, err)
+	}
+	if r = m2.fetch("w2", "s3"); !r.Wait || len(r.Batches) != 0 {
+		t.Fatalf("w2 should wait for the batches of w1: %+v", r)
+	}
+	r = m2.fetch("w1", "s4")
+	if keys := keysOf(r); len(r.Batches) != 2 || len(keys) != 3 {
+		t.Fatalf("w1 should resume 2 batches, but got %+v", keys)
+	}
+	m2.done(&doneReport{Worker: "w1", Session: "s4", Done: map[uint64][]string{id: {"b", "c"}, id + 1: {"d"}}})
+	if r = m2.fetch("w2", "s3"); r.Wait || len(r.Batches) != 0 {
+		t.Fatalf("all the batches should be finished: %+v", r)
+	}
+	m2.close()
+	if _, err = os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed: %s", err)
+	}
+}
+
+func TestManagerTakeOver(t *testing.T) {
+	defer func(lease time.Duration) { workerLease = lease }(workerLease)
+	workerLease = time.Millisecond * 100
+	todo := make(chan object.Object, 10)
+	m, _ := newManager(todo, "")
+	todo <- &obj{key: "a"}
+	todo <- &obj{key: "b"}
+	r := m.fetch("w1", "s1")
+	id := r.Batches[0].ID
+	m.done(&doneReport{Worker: "w1", Session: "s1", Done: map[uint64][]string{id: {"a"}}})
+	close(todo)
+	if r = m.fetch("w2", "s2"); !r.Wait {
+		t.Fatalf("w2 should wait for w1: %+v", r)
+	}
+	time.Sleep(time.Millisecond * 200)
+	// w1 is dead, w2 takes over its batch
+	if r = m.fetch("w2", "s2"); len(r.Batches) != 1 || r.Batches[0].ID != id || strings.Join(keysOf(r), ",") != "b" {
+		t.Fatalf("w2 should take over b, but got %+v", r)
+	}
+	// w1 comes back, but the batch is not its any more
+	if r = m.fetch("w1", "s3"); !r.Wait || len(r.Batches) != 0 {
+		t.Fatalf("w1 should not get the batch again: %+v", r)
+	}
+	if objs := m.takeAll(); len(objs) != 1 || objs[0].Key() != "b" {
+		t.Fatalf("expect b left, but got %+v", objs)
+	}
+	m.done(&doneReport{Worker: "w2", Session: "s2", Done: map[uint64][]string{id: {"b"}}})
+	if objs := m.takeAll(); len(objs) != 0 {
+		t.Fatalf("expect nothing left, but got %+v", objs)
+	}
+}
+
+func TestDoneTracker(t *testing.T) {
+	tr := newDoneTracker("")
+	if tr.worker == "" {
+		t.Fatalf("worker id should be the hostname")
+	}
+	tr.add("a", 1)
+	tr.add("a", 2)
+	tr.add("b", 2)
+	tr.finish("a")
+	tr.finish("a")
+	tr.finish("c")
+	if len(tr.done[1]) != 1 || len(tr.done[2]) != 1 || len(tr.pending) != 1 {
+		t.Fatalf("unexpected tracker: %+v", tr)
+	}
+	var nilTracker *doneTracker
+	nilTracker.finish("a")
+}
@@ -21,50 +21,94 @@ import (
 )
 
 type Config struct {
-	Start       string
-	End         string
-	Threads     int
-	HTTPPort    int
-	Update      bool
-	ForceUpdate bool
-	Perms       bool
-	Dry         bool
-	DeleteSrc   bool
-	DeleteDst   bool
-	Dirs        bool
-	Exclude     []string
-	Include     []string
-	Manager     string
-	Workers     []string
-	BWLimit     int
-	NoHTTPS     bool
-	Verbose     bool
-	Quiet       bool
-	CheckAll    bool
-	CheckNew    bool
+	Start          string
+	End            string
+	Threads        int
+	HTTPPort       int
+	Update         bool
+	ForceUpdate    bool
+	Perms          bool
+	Xattrs         bool
+	Dry            bool
+	DeleteSrc      bool
+	DeleteDst      bool
+	Dirs           bool
+	Links          bool
+	Exclude        []string
+	Include        []string
+	ExcludeFrom    string
+	Manager        string
+	Workers        []string
+	WorkerID       string
+	Checkpoint     string
+	BWLimit        int
+	MaxObjects     int64
+	MaxBytes       int64
+	NoHTTPS        bool
+	Verbose        bool
+	Quiet          bool
+	CheckAll       bool
+	CheckNew       bool
+	VerifyAfter    bool
+	TwoWay         bool
+	Conflict       string
+	StateFile      string
+	ListOnly       bool
+	Plan           string
+	Failures       string
+	RetryFrom      string
+	Compress       bool
+	Decompress     bool
+	RewriteKey     string
+	AtMostOnce     bool
+	Manifest       string
+	VerifyManifest string
+	StructureOnly  bool
 }
 
 func NewConfigFromCli(c *cli.Context) *Config {
 	return &Config{
-		Start:       c.String("start"),
-		End:         c.String("end"),
-		Threads:     c.Int("threads"),
-		Update:      c.Bool("update"),
-		ForceUpdate: c.Bool("force-update"),
-		Perms:       c.Bool("perms"),
-		Dirs:        c.Bool("dirs"),
-		Dry:         c.Bool("dry"),
-		DeleteSrc:   c.Bool("delete-src"),
-		DeleteDst:   c.Bool("delete-dst"),
-		Exclude:     c.StringSlice("exclude"),
-		Include:     c.StringSlice("include"),
-		Workers:     c.StringSlice("worker"),
-		Manager:     c.String("manager"),
-		BWLimit:     c.Int("bwlimit"),
-		NoHTTPS:     c.Bool("no-https"),
-		Verbose:     c.Bool("verbose"),
-		Quiet:       c.Bool("quiet"),
-		CheckAll:    c.Bool("check-all"),
-		CheckNew:    c.Bool("check-new"),
+		Start:          c.String("start"),
+		End:            c.String("end"),
+		Threads:        c.Int("threads"),
+		Update:         c.Bool("update"),
+		ForceUpdate:    c.Bool("force-update"),
+		Perms:          c.Bool("perms"),
+		Xattrs:         c.Bool("xattrs"),
+		Dirs:           c.Bool("dirs"),
+		Links:          c.Bool("links"),
+		Dry:            c.Bool("dry"),
+		DeleteSrc:      c.Bool("delete-src"),
+		DeleteDst:      c.Bool("delete-dst"),
+		Exclude:        c.StringSlice("exclude"),
+		Include:        c.StringSlice("include"),
+		ExcludeFrom:    c.String("exclude-from"),
+		Workers:        c.StringSlice("worker"),
+		Manager:        c.String("manager"),
+		WorkerID:       c.String("worker-id"),
+		Checkpoint:     c.String("checkpoint"),
+		BWLimit:        c.Int("bwlimit"),
+		MaxObjects:     c.Int64("max-objects"),
+		MaxBytes:       c.Int64("max-bytes"),
+		NoHTTPS:        c.Bool("no-https"),
+		Verbose:        c.Bool("verbose"),
+		Quiet:          c.Bool("quiet"),
+		CheckAll:       c.Bool("check-all"),
+		CheckNew:       c.Bool("check-new"),
+		VerifyAfter:    c.Bool("verify-after"),
+		TwoWay:         c.Bool("two-way"),
+		Conflict:       c.String("conflict"),
+		StateFile:      c.String("state-file"),
+		ListOnly:       c.Bool("list-only"),
+		Plan:           c.String("plan"),
+		Failures:       c.String("failures-file"),
+		RetryFrom:      c.String("retry-failures"),
+		Compress:       c.Bool("compress"),
+		Decompress:     c.Bool("decompress"),
+		RewriteKey:     c.String("rewrite-key"),
+		AtMostOnce:     c.Bool("at-most-once"),
+		Manifest:       c.String("manifest"),
+		VerifyManifest: c.String("verify-manifest"),
+		StructureOnly:  c.Bool("structure-only"),
 	}
 }
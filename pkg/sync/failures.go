@@ -0,0 +1,100 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// failureList records the objects failed to sync after retries. It's written in the format
+// of a plan (with the errors), so the failed ones can be retried later by executing it.
+type failureList struct {
+	sync.Mutex
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	count int
+	err   error
+}
+
+var failures *failureList
+
+func newFailureList(path string, src, dst object.ObjectStorage) (*failureList, error) {
+	// write into a temporary file, so it can be the one being retried
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	l := &failureList{path: path, f: f, w: bufio.NewWriter(f)}
+	l.enc = json.NewEncoder(l.w)
+	if err = l.enc.Encode(&planHeader{src.String(), dst.String(), time.Now()}); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return l, nil
+}
+
+// add records a failed task, which could be the one with marks.
+func (l *failureList) add(o object.Object, err error) {
+	if l == nil {
+		return
+	}
+	a := newAction(o)
+	a.Error = err.Error()
+	l.Lock()
+	defer l.Unlock()
+	if e := l.enc.Encode(a); e != nil && l.err == nil {
+		logger.Errorf("Failed to record failure of %s into %s: %s", a.Key, l.path, e)
+		l.err = e
+	}
+	l.count++
+}
+
+// close replaces the file at path with the recorded failures, or removes it if nothing is failed.
+func (l *failureList) close() error {
+	tmp := l.f.Name()
+	err := l.w.Flush()
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if e := l.f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = l.err
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if l.count == 0 {
+		_ = os.Remove(tmp)
+		if err = os.Remove(l.path); os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
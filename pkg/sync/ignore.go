@@ -0,0 +1,172 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are patterns in the format of gitignore, the keys are relative to the root of source and destination.
+type ignoreRules []*ignoreRule
+
+func loadIgnoreFile(path string) (ignoreRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := parseIgnore(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return rules, nil
+}
+
+func parseIgnore(r io.Reader) (ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		// trailing spaces are ignored unless they are quoted with backslash
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var rule ignoreRule
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(ignoreToRegexp(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %s", n, line, err)
+		}
+		rule.re = re
+		rules = append(rules, &rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ignoreToRegexp translates a pattern into regular expression which matches the whole path.
+// A pattern without slash matches the name at any level, otherwise it's relative to the root.
+func ignoreToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.Contains(pattern, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/') && (i+2 == len(pattern) || pattern[i+2] == '/') {
+				if i+2 == len(pattern) {
+					b.WriteString(".*") // everything inside
+					i++
+				} else {
+					b.WriteString("(?:.*/)?") // zero or more directories
+					i += 2
+				}
+			} else {
+				for i+1 < len(pattern) && pattern[i+1] == '*' {
+					i++
+				}
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == 0 && i+2 < len(pattern) { // ']' as the first character in class
+				end = strings.IndexByte(pattern[i+2:], ']') + 1
+			}
+			if end <= 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `[`, `\[`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				c = pattern[i]
+			}
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// match returns whether the path is ignored by the last matched rule.
+func (rs ignoreRules) match(path string, dir bool) bool {
+	for i := len(rs) - 1; i >= 0; i-- {
+		r := rs[i]
+		if r.dirOnly && !dir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			return !r.negate
+		}
+	}
+	return false
+}
+
+// ignored checks the key and all its parent directories, a key can't be included again
+// by negative pattern if any of its parents is ignored, which is the same as git.
+func (rs ignoreRules) ignored(key string) bool {
+	if len(rs) == 0 || key == "" {
+		return false
+	}
+	isDir := strings.HasSuffix(key, "/")
+	key = strings.TrimSuffix(key, "/")
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' && rs.match(key[:i], true) {
+			return true
+		}
+	}
+	return rs.match(key, isDir)
+}
@@ -0,0 +1,262 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// A manifest is a file in JSON lines, with the header at the first line, then the objects in
+// destination sorted by key, one per line.
+type manifestHeader struct {
+	Dst     string    `json:"dst"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+type manifestEntry struct {
+	Key   string    `json:"key"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Hash  string    `json:"sha256"`
+}
+
+func loadManifest(path string) (*manifestHeader, []*manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var header manifestHeader
+	if err = dec.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("invalid header: %s", err)
+	}
+	var entries []*manifestEntry
+	for {
+		var e manifestEntry
+		if err = dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid entry after %d ones: %s", len(entries), err)
+		}
+		entries = append(entries, &e)
+	}
+	return &header, entries, nil
+}
+
+func hashObject(store object.ObjectStorage, key string) (string, int64, error) {
+	var sum string
+	var size int64
+	err := try(3, func() error {
+		in, err := store.Get(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		h := sha256.New()
+		buf := bufPool.Get().(*[]byte)
+		defer bufPool.Put(buf)
+		if size, err = io.CopyBuffer(h, in, *buf); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return sum, size, err
+}
+
+// hashAll calls fn for every entry in the goroutines of the number of threads.
+func hashAll(entries []*manifestEntry, threads int, fn func(e *manifestEntry)) {
+	if threads < 1 {
+		threads = 1
+	}
+	todo := make(chan *manifestEntry, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range todo {
+				fn(e)
+			}
+		}()
+	}
+	for _, e := range entries {
+		todo <- e
+	}
+	close(todo)
+	wg.Wait()
+}
+
+// writeManifest writes the hashes of the objects in destination into config.Manifest, only the
+// ones changed since the previous manifest (in size or mtime) are read and hashed again. It returns
+// the number of objects hashed.
+func writeManifest(dst object.ObjectStorage, config *Config) (int64, error) {
+	old := make(map[string]*manifestEntry)
+	if _, entries, err := loadManifest(config.Manifest); err == nil {
+		for _, e := range entries {
+			old[e.Key] = e
+		}
+	} else if !os.IsNotExist(err) {
+		logger.Warnf("Load the previous manifest %s: %s, all the objects will be hashed", config.Manifest, err)
+	}
+
+	objs, err := ListAll(dst, config.Start, config.End)
+	if err != nil {
+		return 0, err
+	}
+	var f *keyFilter
+	if !xform.rewritesKey() && (config.Exclude != nil || config.Include != nil || config.ExcludeFrom != "") {
+		f = newKeyFilter(config)
+	}
+	var entries, changed []*manifestEntry
+	for o := range objs {
+		if o == nil {
+			return 0, fmt.Errorf("list %s failed", dst)
+		}
+		if o.IsDir() || object.IsTempKey(o.Key()) || f != nil && !f.match(o.Key()) {
+			continue
+		}
+		e := &manifestEntry{Key: o.Key(), Size: o.Size(), Mtime: o.Mtime()}
+		if p, ok := old[e.Key]; ok && p.Size == e.Size && p.Mtime.Unix() == e.Mtime.Unix() {
+			e.Hash = p.Hash
+		} else {
+			changed = append(changed, e)
+		}
+		entries = append(entries, e)
+	}
+
+	progress := utils.NewProgress(config.Verbose || config.Quiet, true)
+	hashed := progress.AddCountBar("Hashed objects", int64(len(changed)))
+	var failed int64
+	var mu sync.Mutex
+	hashAll(changed, config.Threads, func(e *manifestEntry) {
+		sum, size, err := hashObject(dst, e.Key)
+		if err == nil && size != e.Size {
+			err = fmt.Errorf("read %d bytes, but the size is %d", size, e.Size)
+		}
+		if err != nil {
+			logger.Errorf("Failed to hash %s: %s", e.Key, err)
+			mu.Lock()
+			failed++
+			mu.Unlock()
+		}
+		e.Hash = sum
+		hashed.Increment()
+	})
+	progress.Done()
+	if failed > 0 {
+		return hashed.Current(), fmt.Errorf("failed to hash %d objects", failed)
+	}
+
+	tmp := config.Manifest + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return hashed.Current(), err
+	}
+	w := bufio.NewWriter(fp)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&manifestHeader{dst.String(), "sha256", time.Now()})
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(e)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, config.Manifest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return hashed.Current(), err
+	}
+	logger.Infof("Manifest of %d objects is written into %s, %d of them are hashed", len(entries), config.Manifest, hashed.Current())
+	return hashed.Current(), nil
+}
+
+// VerifyManifest reads all the objects in the manifest from dst again, and reports the ones
+// missing or changed.
+func VerifyManifest(dst object.ObjectStorage, config *Config) error {
+	header, entries, err := loadManifest(config.VerifyManifest)
+	if err != nil {
+		return fmt.Errorf("load manifest %s: %s", config.VerifyManifest, err)
+	}
+	if header.Hash != "sha256" {
+		return fmt.Errorf("unsupported hash in manifest: %s", header.Hash)
+	}
+	if header.Dst != dst.String() {
+		logger.Warnf("The manifest is created for %s, but verifying %s", header.Dst, dst)
+	}
+	progress := utils.NewProgress(config.Verbose || config.Quiet, true)
+	verified := progress.AddCountBar("Verified objects", int64(len(entries)))
+	verifiedBytes := progress.AddByteSpinner("Verified objects")
+	var mu sync.Mutex
+	var missing, corrupted, failed int
+	hashAll(entries, config.Threads, func(e *manifestEntry) {
+		defer verified.Increment()
+		var problem *int
+		if o, err := dst.Head(e.Key); err != nil {
+			logger.Errorf("Object %s is missing: %s", e.Key, err)
+			problem = &missing
+		} else if o.Size() != e.Size {
+			logger.Errorf("Size of %s is changed: %d -> %d", e.Key, e.Size, o.Size())
+			problem = &corrupted
+		} else if sum, size, err := hashObject(dst, e.Key); err != nil {
+			logger.Errorf("Failed to verify %s: %s", e.Key, err)
+			problem = &failed
+		} else {
+			verifiedBytes.IncrInt64(size)
+			if sum != e.Hash {
+				logger.Errorf("Content of %s is changed: sha256 %s -> %s", e.Key, e.Hash, sum)
+				problem = &corrupted
+			}
+		}
+		if problem != nil {
+			mu.Lock()
+			*problem++
+			mu.Unlock()
+		}
+	})
+	progress.Done()
+	logger.Infof("Verified: %d (%s), missing: %d, changed: %d, failed: %d",
+		len(entries), formatSize(verifiedBytes.Current()), missing, corrupted, failed)
+	if missing+corrupted+failed > 0 {
+		return fmt.Errorf("%d of %d objects don't match the manifest %s", missing+corrupted+failed, len(entries), config.VerifyManifest)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// actions in a plan
+const (
+	actionCopy      = "copy"   // the object does not exist in destination
+	actionUpdate    = "update" // the object in destination will be overwritten
+	actionCheck     = "check"  // compare the checksums, copy it if they are different
+	actionPerms     = "perms"
+	actionXattrs    = "xattrs" // compare the extended attributes, copy them if they are different
+	actionDeleteSrc = "delete-src"
+	actionDeleteDst = "delete-dst"
+)
+
+// A plan is a file in JSON lines, with the header at the first line, then one action per line.
+type planHeader struct {
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+	Created time.Time `json:"created"`
+}
+
+type planAction struct {
+	Action string                 `json:"action"`
+	Key    string                 `json:"key"`
+	Size   int64                  `json:"size"`
+	Object map[string]interface{} `json:"object"`
+	Error  string                 `json:"error,omitempty"` // only in the list of failures
+}
+
+// updating is an object which exists in destination, only used to list the actions.
+type updating struct {
+	object.Object
+}
+
+func newAction(o object.Object) *planAction {
+	var a planAction
+	switch o.Size() {
+	case markDeleteSrc:
+		a.Action = actionDeleteSrc
+		o = o.(*withSize).Object
+	case markDeleteDst:
+		a.Action = actionDeleteDst
+		o = o.(*withSize).Object
+	case markCopyPerms:
+		a.Action = actionPerms
+		o = o.(*withFSize).File
+	case markChecksum:
+		a.Action = actionCheck
+		o = o.(*withSize).Object
+	case markCopyXattrs:
+		a.Action = actionXattrs
+		o = o.(*withSize).Object
+	default:
+		a.Action = actionCopy
+		if u, ok := o.(*updating); ok {
+			a.Action = actionUpdate
+			o = u.Object
+		}
+	}
+	a.Key = o.Key()
+	a.Size = o.Size()
+	a.Object = object.MarshalObject(o)
+	return &a
+}
+
+// writePlan writes the actions from producer into the plan file, without executing them.
+func writePlan(tasks <-chan object.Object, src, dst object.ObjectStorage, path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(&planHeader{src.String(), dst.String(), time.Now()}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	var count = make(map[string]int)
+	var bytes int64
+	for o := range tasks {
+		a := newAction(o)
+		if err = enc.Encode(a); err != nil {
+			_ = f.Close()
+			return err
+		}
+		count[a.Action]++
+		if a.Action == actionCopy || a.Action == actionUpdate {
+			bytes += a.Size
+		}
+		handled.Increment()
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("Planned to copy %d new and %d updated objects (%s), check %d, copy permissions of %d, compare xattrs of %d, delete %d from source and %d from destination",
+		count[actionCopy], count[actionUpdate], formatSize(bytes), count[actionCheck], count[actionPerms], count[actionXattrs], count[actionDeleteSrc], count[actionDeleteDst])
+	return os.Rename(tmp, path)
+}
+
+// done checks whether the copy is finished by a previous run of the plan.
+func done(dst object.ObjectStorage, o object.Object) bool {
+	d, err := dst.Head(o.Key())
+	return err == nil && d.Size() == o.Size() && !d.Mtime().Before(o.Mtime())
+}
+
+// executePlan sends the actions in the plan file to workers. It can be run again after interrupted,
+// the objects copied already are skipped.
+func executePlan(tasks chan<- object.Object, src, dst object.ObjectStorage, path string) error {
+	defer close(tasks)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var h planHeader
+	if err = dec.Decode(&h); err != nil {
+		return fmt.Errorf("invalid plan %s: %s", path, err)
+	}
+	if h.Src != src.String() || h.Dst != dst.String() {
+		return fmt.Errorf("plan %s is made for syncing from %s to %s", path, h.Src, h.Dst)
+	}
+	logger.Infof("Executing the plan made at %s", h.Created.Format(time.RFC3339))
+	for dec.More() {
+		var a planAction
+		if err = dec.Decode(&a); err != nil {
+			return fmt.Errorf("invalid plan %s: %s", path, err)
+		}
+		o := object.UnmarshalObject(a.Object)
+		handled.IncrTotal(1)
+		switch a.Action {
+		case actionCopy, actionUpdate:
+			if so, err := src.Head(a.Key); err != nil || so.Size() != a.Size {
+				if err == nil {
+					err = fmt.Errorf("size %d -> %d", a.Size, so.Size())
+				}
+				logger.Errorf("Object %s is changed since planned: %s", a.Key, err)
+				failed.Increment()
+				if so != nil {
+					o = so
+				}
+				failures.add(o, err)
+				handled.Increment()
+			} else if done(dst, o) {
+				skipped.Increment()
+				handled.Increment()
+			} else {
+				tasks <- o
+			}
+		case actionCheck:
+			tasks <- &withSize{o, markChecksum}
+		case actionPerms:
+			tasks <- &withFSize{o.(object.File), markCopyPerms}
+		case actionXattrs:
+			tasks <- &withSize{o, markCopyXattrs}
+		case actionDeleteSrc:
+			tasks <- &withSize{o, markDeleteSrc}
+		case actionDeleteDst:
+			tasks <- &withSize{o, markDeleteDst}
+		default:
+			return fmt.Errorf("unknown action %q of %s", a.Action, a.Key)
+		}
+	}
+	return nil
+}
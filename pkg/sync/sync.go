@@ -22,6 +22,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
@@ -42,15 +43,23 @@ const (
 	markDeleteDst   = -2
 	markCopyPerms   = -3
 	markChecksum    = -4
+	markCopyXattrs  = -5
+	maxLinkSize     = 4096 // PATH_MAX
+	verifyRetries   = 3    // times to copy an object again if it's different after copied
 )
 
 var (
 	handled                  *utils.Bar
 	copied, copiedBytes      *utils.Bar
 	checkedBytes             *utils.Bar
+	mismatched, unverified   *utils.Bar
+	serverCopied             *utils.Bar
 	deleted, skipped, failed *utils.Bar
+	deferred, deferredBytes  *utils.Bar
 	concurrent               chan int
 	limiter                  *ratelimit.Bucket
+	xform                    *transform
+	ignores                  ignoreRules // loaded from --exclude-from
 )
 
 var logger = utils.GetLogger("juicefs")
@@ -177,41 +186,47 @@ var bufPool = sync.Pool{
 	},
 }
 
+// try calls f at most n times, with exponential backoff between the failures.
 func try(n int, f func() error) (err error) {
 	for i := 0; i < n; i++ {
 		err = f()
-		if err == nil {
+		if err == nil || i == n-1 {
 			return
 		}
-		time.Sleep(time.Second * time.Duration(i*i))
+		time.Sleep(time.Second << i)
 	}
 	return
 }
 
-func deleteObj(storage object.ObjectStorage, key string, dry bool) {
+func deleteObj(storage object.ObjectStorage, key string, dry bool) error {
 	if dry {
 		logger.Infof("Will delete %s from %s", key, storage)
-		return
+		return nil
 	}
 	start := time.Now()
-	if err := try(3, func() error { return storage.Delete(key) }); err == nil {
+	err := try(3, func() error { return storage.Delete(key) })
+	if err == nil {
 		deleted.Increment()
 		logger.Debugf("Deleted %s from %s in %s", key, storage, time.Since(start))
 	} else {
 		failed.Increment()
 		logger.Errorf("Failed to delete %s from %s in %s: %s", key, storage, time.Since(start), err)
 	}
+	return err
 }
 
 func needCopyPerms(o1, o2 object.Object) bool {
 	f1 := o1.(object.File)
 	f2 := o2.(object.File)
+	if f1.Mode()&os.ModeSymlink != 0 {
+		return false // the permissions of symlink are not used
+	}
 	return f2.Mode() != f1.Mode() || f2.Owner() != f1.Owner() || f2.Group() != f1.Group()
 }
 
 func copyPerms(dst object.ObjectStorage, obj object.Object) {
 	start := time.Now()
-	key := obj.Key()
+	key := xform.key(obj.Key())
 	fi := obj.(object.File)
 	if err := dst.(object.FileSystem).Chmod(key, fi.Mode()); err != nil {
 		logger.Warnf("Chmod %s to %d: %s", key, fi.Mode(), err)
@@ -222,6 +237,73 @@ func copyPerms(dst object.ObjectStorage, obj object.Object) {
 	logger.Debugf("Copied permissions (%s:%s:%s) for %s in %s", fi.Owner(), fi.Group(), fi.Mode(), key, time.Since(start))
 }
 
+// copyXattrs copies the extended attributes of obj into destination if they are different, and
+// returns whether they are copied. They are not kept for symlinks.
+func copyXattrs(src, dst object.ObjectStorage, obj object.Object) (bool, error) {
+	if f, ok := obj.(object.File); ok && f.Mode()&os.ModeSymlink != 0 {
+		return false, nil
+	}
+	key := obj.Key()
+	attrs, err := src.(object.XattrStore).GetXattrs(key)
+	if err != nil {
+		return false, fmt.Errorf("get xattrs of %s: %s", key, err)
+	}
+	dkey := xform.key(key)
+	old, err := dst.(object.XattrStore).GetXattrs(dkey)
+	if err == nil && (len(attrs) == 0 && len(old) == 0 || reflect.DeepEqual(attrs, old)) {
+		return false, nil
+	}
+	start := time.Now()
+	if err = try(3, func() error { return dst.(object.XattrStore).SetXattrs(dkey, attrs) }); err != nil {
+		return false, fmt.Errorf("set xattrs of %s: %s", dkey, err)
+	}
+	logger.Debugf("Copied %d xattrs for %s in %s", len(attrs), key, time.Since(start))
+	return true, nil
+}
+
+// readLink returns the target if the object is a symlink. The objects in object storage are not
+// marked in listing, so the small ones are checked one by one.
+func readLink(store object.ObjectStorage, o object.Object) (string, bool) {
+	if !object.SupportSymlink(store) || o.IsDir() {
+		return "", false
+	}
+	if f, ok := o.(object.File); ok {
+		if f.Mode()&os.ModeSymlink == 0 {
+			return "", false
+		}
+	} else if o.Size() > maxLinkSize {
+		return "", false
+	}
+	target, err := store.(object.SymlinkStore).Readlink(o.Key())
+	if err != nil {
+		logger.Debugf("Readlink %s from %s: %s", o.Key(), store, err)
+		return "", false
+	}
+	return target, true
+}
+
+// sameLink returns whether the object is a symlink, and whether the one in dst has the same target.
+func sameLink(src, dst object.ObjectStorage, o object.Object) (isLink, equal bool) {
+	target, ok := readLink(src, o)
+	if !ok {
+		return false, false
+	}
+	t, err := dst.(object.SymlinkStore).Readlink(xform.key(o.Key()))
+	return true, err == nil && t == target
+}
+
+func copyLink(dst object.ObjectStorage, key, target string) error {
+	start := time.Now()
+	err := try(3, func() error { return dst.(object.SymlinkStore).Symlink(target, key) })
+	if err == nil {
+		copiedBytes.IncrInt64(int64(len(target)))
+		logger.Debugf("Copied symlink %s -> %s in %s", key, target, time.Since(start))
+	} else {
+		logger.Errorf("Failed to copy symlink %s in %s: %s", key, time.Since(start), err)
+	}
+	return err
+}
+
 func doCheckSum(src, dst object.ObjectStorage, key string, size int64, equal *bool) error {
 	abort := make(chan struct{})
 	checkPart := func(offset, length int64) error {
@@ -241,7 +323,7 @@ func doCheckSum(src, dst object.ObjectStorage, key string, size int64, equal *bo
 			return fmt.Errorf("src get: %s", err)
 		}
 		defer in.Close()
-		in2, err := dst.Get(key, offset, length)
+		in2, err := dst.Get(xform.key(key), offset, length)
 		if err != nil {
 			return fmt.Errorf("dest get: %s", err)
 		}
@@ -306,7 +388,15 @@ func doCheckSum(src, dst object.ObjectStorage, key string, size int64, equal *bo
 func checkSum(src, dst object.ObjectStorage, key string, size int64) (bool, error) {
 	start := time.Now()
 	var equal bool
-	err := try(3, func() error { return doCheckSum(src, dst, key, size, &equal) })
+	var err error
+	if xform.changesData() {
+		err = try(3, func() (e error) {
+			equal, e = xform.sameContents(src, dst, key, size)
+			return
+		})
+	} else {
+		err = try(3, func() error { return doCheckSum(src, dst, key, size, &equal) })
+	}
 	if err == nil {
 		checkedBytes.IncrInt64(size)
 		if equal {
@@ -320,6 +410,29 @@ func checkSum(src, dst object.ObjectStorage, key string, size int64) (bool, erro
 	return equal, err
 }
 
+// verifyCopied reads the copied object back from dst and compares it with the one in src, it's
+// copied again if they are different, and failed if it's still different after verifyRetries times.
+func verifyCopied(src, dst object.ObjectStorage, key string, size int64) error {
+	for i := 0; ; i++ {
+		equal, err := checkSum(src, dst, key, size)
+		if err != nil {
+			return err
+		}
+		if equal {
+			return nil
+		}
+		mismatched.Increment()
+		if i == verifyRetries {
+			unverified.Increment()
+			return fmt.Errorf("copied object %s is still different from source after copied %d times", key, i+1)
+		}
+		logger.Warnf("Copied object %s is different from source, copy it again", key)
+		if err = copyData(src, dst, key, size); err != nil {
+			return err
+		}
+	}
+}
+
 func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
 	if limiter != nil {
 		limiter.Wait(size)
@@ -337,11 +450,20 @@ func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
 		return err
 	}
 	defer in.Close()
+	if xform.changesData() {
+		zr, err := xform.reader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		in = zr
+	}
 
+	dkey := xform.key(key)
 	if size <= maxBlock ||
 		strings.HasPrefix(src.String(), "file://") ||
 		strings.HasPrefix(dst.String(), "file://") {
-		return dst.Put(key, in)
+		return dst.Put(dkey, in)
 	} else { // obj.Size > maxBlock, download the object into disk first
 		f, err := ioutil.TempFile("", "rep")
 		if err != nil {
@@ -357,7 +479,7 @@ func doCopySingle(src, dst object.ObjectStorage, key string, size int64) error {
 		if _, err = f.Seek(0, 0); err != nil {
 			return err
 		}
-		return dst.Put(key, f)
+		return dst.Put(dkey, f)
 	}
 }
 
@@ -371,6 +493,7 @@ func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, uploa
 		partSize = ((partSize-1)>>20 + 1) << 20 // align to MB
 	}
 	n := int((size-1)/partSize) + 1
+	dkey := xform.key(key)
 	logger.Debugf("Copying data of %s as %d parts (size: %d): %s", key, n, partSize, upload.UploadID)
 	abort := make(chan struct{})
 	parts := make([]*object.Part, n)
@@ -405,7 +528,7 @@ func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, uploa
 					return err
 				}
 				// PartNumber starts from 1
-				parts[num], err = dst.UploadPart(key, upload.UploadID, num+1, data)
+				parts[num], err = dst.UploadPart(dkey, upload.UploadID, num+1, data)
 				return err
 			}); err == nil {
 				errs <- nil
@@ -426,26 +549,114 @@ func doCopyMultiple(src, dst object.ObjectStorage, key string, size int64, uploa
 		}
 	}
 	if err == nil {
-		err = try(3, func() error { return dst.CompleteUpload(key, upload.UploadID, parts) })
+		err = try(3, func() error { return dst.CompleteUpload(dkey, upload.UploadID, parts) })
+	}
+	if err != nil {
+		dst.AbortUpload(dkey, upload.UploadID)
+		return fmt.Errorf("multipart: %s", err)
+	}
+	return nil
+}
+
+// doCopyStream copies the transformed data of key part by part as it's read, since the size of it
+// is unknown. Only one part is kept in memory, and nothing is staged in local disk.
+func doCopyStream(src, dst object.ObjectStorage, key string, size int64, upload *object.MultipartUpload) error {
+	partSize := int64(upload.MinPartSize)
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if size > partSize*int64(upload.MaxCount) {
+		partSize = size / int64(upload.MaxCount)
+		partSize = ((partSize-1)>>20 + 1) << 20 // align to MB
 	}
+	dkey := xform.key(key)
+	err := func() error {
+		if limiter != nil {
+			limiter.Wait(size)
+		}
+		concurrent <- 1
+		defer func() {
+			<-concurrent
+		}()
+		in, err := src.Get(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		zr, err := xform.reader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		var parts []*object.Part
+		for num := 1; ; num++ {
+			data := make([]byte, partSize)
+			n, err := io.ReadFull(zr, data)
+			if err == io.EOF && num > 1 {
+				break
+			} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			if num > upload.MaxCount {
+				return fmt.Errorf("more than %d parts", upload.MaxCount)
+			}
+			var part *object.Part
+			if err := try(3, func() (e error) {
+				part, e = dst.UploadPart(dkey, upload.UploadID, num, data[:n])
+				return
+			}); err != nil {
+				return fmt.Errorf("part %d: %s", num, err)
+			}
+			parts = append(parts, part)
+			if n < len(data) {
+				break
+			}
+		}
+		logger.Debugf("Copied data of %s as %d parts (part size: %d): %s", key, len(parts), partSize, upload.UploadID)
+		return try(3, func() error { return dst.CompleteUpload(dkey, upload.UploadID, parts) })
+	}()
 	if err != nil {
-		dst.AbortUpload(key, upload.UploadID)
+		dst.AbortUpload(dkey, upload.UploadID)
 		return fmt.Errorf("multipart: %s", err)
 	}
 	return nil
 }
 
+// copyOnServer copies key on the server side if the source and destination are in the same
+// bucket, it returns an error of not supported otherwise.
+func copyOnServer(src, dst object.ObjectStorage, key string) error {
+	concurrent <- 1
+	defer func() {
+		<-concurrent
+	}()
+	return object.ServerSideCopy(dst, xform.key(key), src, key)
+}
+
 func copyData(src, dst object.ObjectStorage, key string, size int64) error {
 	start := time.Now()
 	var multiple bool
 	var err error
+	if !xform.changesData() {
+		if err = copyOnServer(src, dst, key); err == nil {
+			serverCopied.Increment()
+			copiedBytes.IncrInt64(size)
+			logger.Debugf("Copied data of %s (%d bytes) on the server side in %s", key, size, time.Since(start))
+			return nil
+		} else if err.Error() != "not supported" {
+			logger.Warnf("Failed to copy %s on the server side, copy the data through the client: %s", key, err)
+		}
+	}
 	if size < maxBlock {
 		err = try(3, func() error { return doCopySingle(src, dst, key, size) })
 	} else {
 		var upload *object.MultipartUpload
-		if upload, err = dst.CreateMultipartUpload(key); err == nil {
-			multiple = true
-			err = doCopyMultiple(src, dst, key, size, upload)
+		if upload, err = dst.CreateMultipartUpload(xform.key(key)); err == nil {
+			if xform.changesData() {
+				err = doCopyStream(src, dst, key, size, upload)
+			} else {
+				multiple = true
+				err = doCopyMultiple(src, dst, key, size, upload)
+			}
 		} else { // fallback
 			err = try(3, func() error { return doCopySingle(src, dst, key, size) })
 		}
@@ -461,44 +672,113 @@ func copyData(src, dst object.ObjectStorage, key string, size int64) error {
 	return err
 }
 
+// createEmpty creates an empty object (or a directory) in destination for key, without reading
+// the source, for --structure-only.
+func createEmpty(dst object.ObjectStorage, key string) error {
+	err := try(3, func() error { return dst.Put(xform.key(key), bytes.NewReader(nil)) })
+	if err == nil {
+		logger.Debugf("Created empty %s", key)
+	} else {
+		logger.Errorf("Failed to create empty %s: %s", key, err)
+	}
+	return err
+}
+
 func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *Config) {
 	for obj := range tasks {
 		key := obj.Key()
 		switch obj.Size() {
 		case markDeleteSrc:
-			deleteObj(src, key, config.Dry)
+			if err := deleteObj(src, key, config.Dry); err != nil {
+				failures.add(obj, err)
+			}
 		case markDeleteDst:
-			deleteObj(dst, key, config.Dry)
+			if err := deleteObj(dst, key, config.Dry); err != nil {
+				failures.add(obj, err)
+			}
 		case markCopyPerms:
 			if config.Dry {
 				logger.Infof("Will copy permissions for %s", key)
 				break
 			}
 			copyPerms(dst, obj)
+			if config.Xattrs {
+				if _, err := copyXattrs(src, dst, obj); err != nil {
+					logger.Warnf("Copy xattrs: %s", err)
+				}
+			}
 			copied.Increment()
+		case markCopyXattrs:
+			if config.Dry {
+				logger.Infof("Will compare xattrs for %s", key)
+				break
+			}
+			task := obj
+			if o, ok := obj.(*withSize); ok {
+				obj = o.Object
+			}
+			if changed, err := copyXattrs(src, dst, obj); err != nil {
+				logger.Errorf("Failed to copy xattrs: %s", err)
+				failed.Increment()
+				failures.add(task, err)
+			} else if changed {
+				copied.Increment()
+			} else {
+				skipped.Increment()
+			}
 		case markChecksum:
 			if config.Dry {
 				logger.Infof("Will compare checksum for %s", key)
 				break
 			}
+			task := obj
 			obj = obj.(*withSize).Object
-			if equal, err := checkSum(src, dst, key, obj.Size()); err != nil {
+			var isLink, equal bool
+			var err error
+			if config.Links {
+				isLink, equal = sameLink(src, dst, obj)
+			}
+			if !isLink {
+				equal, err = checkSum(src, dst, key, obj.Size())
+			}
+			if err != nil {
 				failed.Increment()
+				failures.add(task, err)
 				break
 			} else if equal {
 				if config.DeleteSrc {
-					deleteObj(src, key, false)
-				} else if config.Perms {
-					if o, e := dst.Head(key); e == nil {
+					if err = deleteObj(src, key, false); err != nil {
+						failures.add(&withSize{obj, markDeleteSrc}, err)
+					}
+				} else if config.Perms || config.Xattrs {
+					var changed bool
+					if config.Perms {
+						o, e := dst.Head(xform.key(key))
+						if e != nil {
+							logger.Warnf("Failed to head object %s: %s", key, e)
+							failed.Increment()
+							failures.add(task, e)
+							break
+						}
 						if needCopyPerms(obj, o) {
 							copyPerms(dst, obj)
-							copied.Increment()
-						} else {
-							skipped.Increment()
+							changed = true
 						}
+					}
+					if config.Xattrs {
+						c, e := copyXattrs(src, dst, obj)
+						if e != nil {
+							logger.Errorf("Failed to copy xattrs: %s", e)
+							failed.Increment()
+							failures.add(task, e)
+							break
+						}
+						changed = changed || c
+					}
+					if changed {
+						copied.Increment()
 					} else {
-						logger.Warnf("Failed to head object %s: %s", key, e)
-						failed.Increment()
+						skipped.Increment()
 					}
 				} else {
 					skipped.Increment()
@@ -508,12 +788,40 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 			// checkSum not equal, copy the object
 			fallthrough
 		default:
+			size := obj.Size()
+			if config.StructureOnly {
+				size = 0 // nothing is transferred
+			}
+			if !spending.take(size) {
+				logger.Debugf("Defer %s (%d bytes) to the next run, out of budget", key, size)
+				deferTask(size)
+				handled.Increment()
+				continue
+			}
 			if config.Dry {
-				logger.Infof("Will copy %s (%d bytes)", obj.Key(), obj.Size())
+				logger.Infof("Will copy %s (%d bytes)", obj.Key(), size)
 				break
 			}
-			err := copyData(src, dst, key, obj.Size())
-			if err == nil && (config.CheckAll || config.CheckNew) {
+			if config.Links {
+				if target, ok := readLink(src, obj); ok {
+					if err := copyLink(dst, xform.key(key), target); err == nil {
+						copied.Increment()
+					} else {
+						failed.Increment()
+						failures.add(obj, err)
+					}
+					break
+				}
+			}
+			var err error
+			if config.StructureOnly {
+				err = createEmpty(dst, key)
+			} else {
+				err = copyData(src, dst, key, obj.Size())
+			}
+			if err == nil && config.VerifyAfter {
+				err = verifyCopied(src, dst, key, obj.Size())
+			} else if err == nil && (config.CheckAll || config.CheckNew) {
 				var equal bool
 				if equal, err = checkSum(src, dst, key, obj.Size()); err == nil && !equal {
 					err = fmt.Errorf("checksums of copied object %s don't match", key)
@@ -521,19 +829,26 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 			}
 			if err == nil {
 				if mc, ok := dst.(object.MtimeChanger); ok {
-					if err = mc.Chtimes(obj.Key(), obj.Mtime()); err != nil {
+					if err = mc.Chtimes(xform.key(key), obj.Mtime()); err != nil {
 						logger.Warnf("Update mtime of %s: %s", key, err)
 					}
 				}
 				if config.Perms {
 					copyPerms(dst, obj)
 				}
+				if config.Xattrs {
+					if _, err := copyXattrs(src, dst, obj); err != nil {
+						logger.Warnf("Copy xattrs: %s", err)
+					}
+				}
 				copied.Increment()
 			} else {
 				failed.Increment()
 				logger.Errorf("Failed to copy object %s: %s", key, err)
+				failures.add(obj, err)
 			}
 		}
+		jobs.finish(key)
 		handled.Increment()
 	}
 }
@@ -581,16 +896,28 @@ func producer(tasks chan<- object.Object, src, dst object.ObjectStorage, config
 		logger.Fatal(err)
 	}
 
+	var f *keyFilter
+	if config.Exclude != nil || config.ExcludeFrom != "" || config.AtMostOnce {
+		f = newKeyFilter(config)
+		srckeys = filter(srckeys, f)
+	}
+
+	defer close(tasks)
+	if xform.rewritesKey() {
+		lookupDst(tasks, srckeys, dst, config)
+		return
+	}
 	dstkeys, err := ListAll(dst, start, end)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	if config.Exclude != nil {
-		srckeys = filter(srckeys, config.Include, config.Exclude)
-		dstkeys = filter(dstkeys, config.Include, config.Exclude)
+	if config.AtMostOnce {
+		dstkeys = cleanupTemp(dstkeys, dst, config.Dry)
+	}
+	if f != nil {
+		dstkeys = filter(dstkeys, f)
 	}
 
-	defer close(tasks)
 	var dstobj object.Object
 	for obj := range srckeys {
 		if obj == nil {
@@ -629,23 +956,7 @@ func producer(tasks chan<- object.Object, src, dst object.ObjectStorage, config
 		if dstobj == nil || obj.Key() < dstobj.Key() {
 			tasks <- obj
 		} else { // obj.key == dstobj.key
-			if config.ForceUpdate ||
-				(config.Update && obj.Mtime().Unix() > dstobj.Mtime().Unix()) ||
-				(!config.Update && obj.Size() != dstobj.Size()) {
-				tasks <- obj
-			} else if config.Update && obj.Mtime().Unix() < dstobj.Mtime().Unix() {
-				skipped.Increment()
-				handled.Increment()
-			} else if config.CheckAll { // two objects are likely the same
-				tasks <- &withSize{obj, markChecksum}
-			} else if config.DeleteSrc {
-				tasks <- &withSize{obj, markDeleteSrc}
-			} else if config.Perms && needCopyPerms(obj, dstobj) {
-				tasks <- &withFSize{obj.(object.File), markCopyPerms}
-			} else {
-				skipped.Increment()
-				handled.Increment()
-			}
+			compare(tasks, obj, dstobj, config)
 			dstobj = nil
 		}
 	}
@@ -661,6 +972,62 @@ func producer(tasks chan<- object.Object, src, dst object.ObjectStorage, config
 	}
 }
 
+// compare decides what to do with the object in source, when there is one with the same key in destination.
+func compare(tasks chan<- object.Object, obj, dstobj object.Object, config *Config) {
+	if config.ForceUpdate ||
+		(config.Update && obj.Mtime().Unix() > dstobj.Mtime().Unix()) ||
+		(!config.Update && !xform.changesData() && !config.StructureOnly && obj.Size() != dstobj.Size()) {
+		if config.ListOnly {
+			tasks <- &updating{obj}
+		} else {
+			tasks <- obj
+		}
+	} else if config.Update && obj.Mtime().Unix() < dstobj.Mtime().Unix() {
+		skipped.Increment()
+		handled.Increment()
+	} else if config.CheckAll { // two objects are likely the same
+		tasks <- &withSize{obj, markChecksum}
+	} else if config.DeleteSrc {
+		tasks <- &withSize{obj, markDeleteSrc}
+	} else if config.Perms && needCopyPerms(obj, dstobj) {
+		tasks <- &withFSize{obj.(object.File), markCopyPerms}
+	} else if config.Xattrs { // they are not listed, so compared by the worker
+		tasks <- &withSize{obj, markCopyXattrs}
+	} else {
+		skipped.Increment()
+		handled.Increment()
+	}
+}
+
+// lookupDst finds the objects in destination one by one, because the keys rewritten by --rewrite-key
+// could be in a different order from the ones in source.
+func lookupDst(tasks chan<- object.Object, srckeys <-chan object.Object, dst object.ObjectStorage, config *Config) {
+	var wg sync.WaitGroup
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range srckeys {
+				if obj == nil {
+					logger.Errorf("Listing failed, stop syncing, waiting for pending ones")
+					return
+				}
+				if !config.Dirs && obj.IsDir() {
+					logger.Debug("Ignore directory ", obj.Key())
+					continue
+				}
+				handled.IncrTotal(1)
+				if dstobj, err := dst.Head(xform.key(obj.Key())); err == nil {
+					compare(tasks, obj, dstobj, config)
+				} else {
+					tasks <- obj
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func compileExp(patterns []string) []*regexp.Regexp {
 	var rs []*regexp.Regexp
 	for _, p := range patterns {
@@ -682,21 +1049,72 @@ func findAny(s string, ps []*regexp.Regexp) bool {
 	return false
 }
 
-func filter(keys <-chan object.Object, include, exclude []string) <-chan object.Object {
-	inc := compileExp(include)
-	exc := compileExp(exclude)
+// keyFilter decides whether a key should be synced. A key is skipped if it matches any of --exclude,
+// or it's ignored by the patterns from --exclude-from, otherwise it must match one of --include if any.
+type keyFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	ignore  ignoreRules
+	noTemp  bool
+}
+
+func newKeyFilter(config *Config) *keyFilter {
+	return &keyFilter{include: compileExp(config.Include), exclude: compileExp(config.Exclude), ignore: ignores, noTemp: config.AtMostOnce}
+}
+
+func (f *keyFilter) match(key string) bool {
+	if f.noTemp && object.IsTempKey(key) {
+		logger.Debugf("skip temporary file %s", key)
+		return false
+	}
+	if findAny(key, f.exclude) {
+		logger.Debugf("exclude %s", key)
+		return false
+	}
+	if f.ignore.ignored(key) {
+		logger.Debugf("ignore %s", key)
+		return false
+	}
+	if len(f.include) > 0 && !findAny(key, f.include) {
+		logger.Debugf("%s is not included", key)
+		return false
+	}
+	return true
+}
+
+func filter(keys <-chan object.Object, f *keyFilter) <-chan object.Object {
 	r := make(chan object.Object)
 	go func() {
 		for o := range keys {
 			if o == nil {
 				break
 			}
-			if findAny(o.Key(), exc) {
-				logger.Debugf("exclude %s", o.Key())
+			if !f.match(o.Key()) {
 				continue
 			}
-			if len(inc) > 0 && !findAny(o.Key(), inc) {
-				logger.Debugf("%s is not included", o.Key())
+			r <- o
+		}
+		close(r)
+	}()
+	return r
+}
+
+// the temporary files and multipart uploads not touched for this long are left by interrupted syncs
+const staleTemp = time.Hour
+
+// cleanupTemp removes the stale temporary files in the keys of dst, and passes the others through.
+func cleanupTemp(keys <-chan object.Object, dst object.ObjectStorage, dry bool) <-chan object.Object {
+	r := make(chan object.Object)
+	go func() {
+		for o := range keys {
+			if o == nil {
+				break
+			}
+			if object.IsTempKey(o.Key()) && !o.IsDir() {
+				if time.Since(o.Mtime()) > staleTemp {
+					logger.Infof("Remove the stale temporary file %s (modified at %s)", o.Key(), o.Mtime())
+					_ = deleteObj(dst, o.Key(), dry)
+				}
 				continue
 			}
 			r <- o
@@ -706,6 +1124,28 @@ func filter(keys <-chan object.Object, include, exclude []string) <-chan object.
 	return r
 }
 
+// abortStaleUploads aborts the multipart uploads in dst which are left by interrupted syncs.
+func abortStaleUploads(dst object.ObjectStorage) {
+	var marker string
+	for {
+		parts, next, err := dst.ListUploads(marker)
+		if err != nil {
+			logger.Debugf("list multipart uploads in %s: %s", dst, err)
+			return
+		}
+		for _, p := range parts {
+			if time.Since(p.Created) > staleTemp*24 {
+				logger.Infof("Abort the stale multipart upload of %s (created at %s)", p.Key, p.Created)
+				dst.AbortUpload(p.Key, p.UploadID)
+			}
+		}
+		if next == "" || next == marker {
+			return
+		}
+		marker = next
+	}
+}
+
 // Sync syncs all the keys between to object storage
 func Sync(src, dst object.ObjectStorage, config *Config) error {
 	var bufferSize = 10240
@@ -715,11 +1155,40 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 	tasks := make(chan object.Object, bufferSize)
 	wg := sync.WaitGroup{}
 	concurrent = make(chan int, config.Threads)
+	var err error
+	var mgr *manager
+	if xform, err = newTransform(config); err != nil {
+		return err
+	}
+	ignores = nil
+	if config.ExcludeFrom != "" {
+		if ignores, err = loadIgnoreFile(config.ExcludeFrom); err != nil {
+			return fmt.Errorf("load patterns from %s: %s", config.ExcludeFrom, err)
+		}
+	}
 	if config.BWLimit > 0 {
 		bps := float64(config.BWLimit*(1<<20)/8) * 0.85 // 15% overhead
 		limiter = ratelimit.NewBucketWithRate(bps, int64(bps)*3)
 	}
 
+	if config.StructureOnly {
+		config.Dirs = true // the directories are part of the structure
+	}
+	if config.Links {
+		if object.SupportSymlink(dst) {
+			object.KeepSymlinks(src)
+			object.KeepSymlinks(dst)
+		} else {
+			logger.Warnf("%s can't keep symlinks, they will be followed", dst)
+			config.Links = false
+		}
+	}
+
+	if config.Xattrs && (!object.SupportXattrs(src) || !object.SupportXattrs(dst)) {
+		logger.Warnf("%s or %s can't keep extended attributes, they will not be copied", src, dst)
+		config.Xattrs = false
+	}
+
 	progress := utils.NewProgress(config.Verbose || config.Quiet || config.Manager != "", true)
 	handled = progress.AddCountBar("Scanned objects", 0)
 	copied = progress.AddCountSpinner("Copied objects")
@@ -728,6 +1197,49 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 	deleted = progress.AddCountSpinner("Deleted objects")
 	skipped = progress.AddCountSpinner("Skipped objects")
 	failed = progress.AddCountSpinner("Failed objects")
+	mismatched = progress.AddCountSpinner("Mismatched objects")
+	unverified = progress.AddCountSpinner("Unverified objects")
+	serverCopied = progress.AddCountSpinner("Server-side copied objects")
+	deferred = progress.AddCountSpinner("Deferred objects")
+	deferredBytes = progress.AddByteSpinner("Deferred objects")
+	if config.Manager == "" {
+		spending = newBudget(config.MaxObjects, config.MaxBytes)
+	} else {
+		spending = nil // checked by the manager
+	}
+	if config.TwoWay {
+		err := syncTwoWay(src, dst, config)
+		progress.Done()
+		logger.Infof("Found: %d, copied: %d (%s), deleted: %d, skipped: %d, failed: %d",
+			handled.Current(), copied.Current(), formatSize(copiedBytes.Current()),
+			deleted.Current(), skipped.Current(), failed.Current())
+		if err != nil {
+			return err
+		}
+		if n := failed.Current(); n > 0 {
+			return fmt.Errorf("Failed to handle %d objects", n)
+		}
+		return nil
+	}
+	if config.ListOnly {
+		go producer(tasks, src, dst, config)
+		err := writePlan(tasks, src, dst, config.Plan)
+		progress.Done()
+		if err != nil {
+			return fmt.Errorf("write plan %s: %s", config.Plan, err)
+		}
+		logger.Infof("Found: %d, the plan is written into %s", handled.Current(), config.Plan)
+		return nil
+	}
+	if config.AtMostOnce && config.Manager == "" && !config.Dry {
+		abortStaleUploads(dst)
+	}
+	if config.Failures != "" {
+		var err error
+		if failures, err = newFailureList(config.Failures, src, dst); err != nil {
+			return fmt.Errorf("create %s: %s", config.Failures, err)
+		}
+	}
 	for i := 0; i < config.Threads; i++ {
 		wg.Add(1)
 		go func() {
@@ -736,37 +1248,104 @@ func Sync(src, dst object.ObjectStorage, config *Config) error {
 		}()
 	}
 
-	if config.Manager == "" {
-		go producer(tasks, src, dst, config)
+	plan := config.Plan
+	if config.RetryFrom != "" {
+		plan = config.RetryFrom
+	}
+	var planErr chan error
+	if plan != "" {
+		planErr = make(chan error, 1)
+		go func() {
+			planErr <- executePlan(tasks, src, dst, plan)
+		}()
+	} else if config.Manager == "" {
 		if config.Workers != nil {
-			addr, err := startManager(tasks)
+			mgr, err = newManager(tasks, config.Checkpoint)
+			if err != nil {
+				return err
+			}
+			addr, err := startManager(mgr)
 			if err != nil {
 				return err
 			}
 			launchWorker(addr, config, &wg)
 		}
+		go producer(tasks, src, dst, config)
 	} else {
+		jobs = newDoneTracker(config.WorkerID)
 		go fetchJobs(tasks, config)
 		go func() {
 			for {
 				sendStats(config.Manager)
+				jobs.report(config.Manager)
 				time.Sleep(time.Second)
 			}
 		}()
 	}
 
 	wg.Wait()
+	if mgr != nil {
+		if objs := mgr.takeAll(); len(objs) > 0 {
+			logger.Infof("Handle %d objects left by the dead workers", len(objs))
+			left := make(chan object.Object, len(objs))
+			for _, o := range objs {
+				left <- o
+			}
+			close(left)
+			for i := 0; i < config.Threads; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					worker(left, src, dst, config)
+				}()
+			}
+			wg.Wait()
+		}
+		mgr.close()
+	}
 	progress.Done()
 
 	if config.Manager == "" {
 		logger.Infof("Found: %d, copied: %d (%s), checked: %s, deleted: %d, skipped: %d, failed: %d",
 			handled.Current(), copied.Current(), formatSize(copiedBytes.Current()), formatSize(checkedBytes.Current()),
 			deleted.Current(), skipped.Current(), failed.Current())
+		if serverCopied.Current() > 0 {
+			logger.Infof("Copied on the server side: %d", serverCopied.Current())
+		}
+		if config.VerifyAfter {
+			logger.Infof("Verified after copied: %d mismatched and copied again, %d failed the verification", mismatched.Current(), unverified.Current())
+		}
+		if spending != nil {
+			logger.Infof("Budget used: %s, deferred to the next run: %d (%s)", spending, deferred.Current(), formatSize(deferredBytes.Current()))
+		}
+		spending = nil
 	} else {
+		jobs.report(config.Manager)
 		sendStats(config.Manager)
 	}
+	if failures != nil {
+		n := failures.count
+		err := failures.close()
+		failures = nil
+		if err != nil {
+			return fmt.Errorf("write failures into %s: %s", config.Failures, err)
+		}
+		if n > 0 {
+			logger.Infof("%d failed objects are recorded into %s, they can be retried with --retry-failures %s", n, config.Failures, config.Failures)
+		}
+	}
+	if planErr != nil {
+		if err := <-planErr; err != nil {
+			return fmt.Errorf("execute plan: %s", err)
+		}
+	}
 	if n := failed.Current(); n > 0 {
 		return fmt.Errorf("Failed to handle %d objects", n)
 	}
+	if config.Manifest != "" && config.Manager == "" && !config.Dry {
+		if _, err := writeManifest(dst, config); err != nil {
+			return fmt.Errorf("write manifest into %s: %s", config.Manifest, err)
+		}
+	}
 	return nil
 }
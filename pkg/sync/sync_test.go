@@ -17,9 +17,24 @@ package sync
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
 )
@@ -159,3 +174,1013 @@ func TestSync(t *testing.T) {
 		t.Fatalf("sync: %s", err)
 	}
 }
+
+// nolint:errcheck
+func TestSyncTwoWay(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		Threads:   10,
+		TwoWay:    true,
+		Conflict:  ConflictKeepBoth,
+		StateFile: filepath.Join(dir, "state.json"),
+		Quiet:     true,
+	}
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("x")))
+	a.Put("y", bytes.NewReader([]byte("y")))
+	b.Put("z", bytes.NewReader([]byte("z")))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copied.Current(); c != 3 {
+		t.Fatalf("should copy 3 keys, but got %d", c)
+	}
+	for _, k := range []string{"x", "y", "z"} {
+		for _, s := range []object.ObjectStorage{a, b} {
+			if _, err := s.Head(k); err != nil {
+				t.Fatalf("%s should exist in %s: %s", k, s, err)
+			}
+		}
+	}
+
+	// delete x from b, modify y in both sides, modify z in b
+	b.Delete("x")
+	a.Put("y", bytes.NewReader([]byte("y from a")))
+	b.Put("y", bytes.NewReader([]byte("y from b, newer")))
+	future := time.Now().Add(time.Minute)
+	b.(object.MtimeChanger).Chtimes("y", future)
+	b.Put("z", bytes.NewReader([]byte("z2")))
+	b.(object.MtimeChanger).Chtimes("z", future)
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if _, err := a.Head("x"); err == nil {
+		t.Fatalf("x should be deleted from a")
+	}
+	for _, s := range []object.ObjectStorage{a, b} {
+		if o, err := s.Head("y"); err != nil || o.Size() != 15 {
+			t.Fatalf("the newer y should win in %s: %v %v", s, o, err)
+		}
+		if o, err := s.Head("z"); err != nil || o.Size() != 2 {
+			t.Fatalf("z should be updated in %s: %v %v", s, o, err)
+		}
+		ch, _ := s.ListAll("y.conflict-", "")
+		var found bool
+		for o := range ch {
+			if strings.HasPrefix(o.Key(), "y.conflict-") && o.Size() == 8 {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("the older y should be kept in %s", s)
+		}
+	}
+
+	// nothing changed
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copied.Current(); c != 0 {
+		t.Fatalf("should copy 0 keys, but got %d", c)
+	}
+	if d := deleted.Current(); d != 0 {
+		t.Fatalf("should delete 0 keys, but got %d", d)
+	}
+}
+
+// nolint:errcheck
+func TestSyncPlan(t *testing.T) {
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.json")
+	config := &Config{
+		Threads:   10,
+		DeleteDst: true,
+		ListOnly:  true,
+		Plan:      plan,
+		Quiet:     true,
+	}
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("x")))
+	a.Put("y", bytes.NewReader([]byte("y")))
+	b.Put("y", bytes.NewReader([]byte("yy")))
+	b.Put("z", bytes.NewReader([]byte("z")))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if _, err := b.Head("x"); err == nil {
+		t.Fatalf("x should not be copied in list-only mode")
+	}
+	data, err := ioutil.ReadFile(plan)
+	if err != nil {
+		t.Fatalf("read plan: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var actions []string
+	for _, l := range lines[1:] {
+		var a planAction
+		if err := json.Unmarshal([]byte(l), &a); err != nil {
+			t.Fatalf("invalid action %s: %s", l, err)
+		}
+		actions = append(actions, a.Action+":"+a.Key)
+	}
+	sort.Strings(actions)
+	if strings.Join(actions, ",") != "copy:x,delete-dst:z,update:y" {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+
+	config.ListOnly = false
+	config.DeleteDst = false // only the plan matters
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("execute: %s", err)
+	}
+	if c, d := copied.Current(), deleted.Current(); c != 2 || d != 1 {
+		t.Fatalf("should copy 2 and delete 1, but got %d and %d", c, d)
+	}
+	if o, err := b.Head("y"); err != nil || o.Size() != 1 {
+		t.Fatalf("y should be updated: %v %v", o, err)
+	}
+	if _, err := b.Head("z"); err == nil {
+		t.Fatalf("z should be deleted")
+	}
+	// run again, copied ones are skipped
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("execute again: %s", err)
+	}
+	if c := copied.Current(); c != 0 {
+		t.Fatalf("should copy nothing, but got %d", c)
+	}
+	// source is changed
+	b.Delete("x")
+	a.Put("x", bytes.NewReader([]byte("x2")))
+	if err := Sync(a, b, config); err == nil {
+		t.Fatalf("should fail when the source is changed since planned")
+	}
+	if _, err := b.Head("x"); err == nil {
+		t.Fatalf("changed x should not be copied")
+	}
+	// the plan is made for other storages
+	if err := Sync(b, a, config); err == nil || !strings.Contains(err.Error(), "execute plan") {
+		t.Fatalf("should fail to execute the plan for other storages: %v", err)
+	}
+}
+
+type brokenStore struct {
+	object.ObjectStorage
+	broken bool
+}
+
+func (s *brokenStore) Put(key string, in io.Reader) error {
+	if s.broken && key == "bad" {
+		return fmt.Errorf("broken")
+	}
+	return s.ObjectStorage.Put(key, in)
+}
+
+// nolint:errcheck
+func TestSyncFailures(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "failures.json")
+	config := &Config{
+		Threads:  10,
+		Failures: list,
+		Quiet:    true,
+	}
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("good", bytes.NewReader([]byte("good")))
+	a.Put("bad", bytes.NewReader([]byte("bad")))
+	dst := &brokenStore{b, true}
+	if err := Sync(a, dst, config); err == nil {
+		t.Fatalf("sync should fail")
+	}
+	if _, err := b.Head("good"); err != nil {
+		t.Fatalf("good should be copied: %s", err)
+	}
+	data, err := ioutil.ReadFile(list)
+	if err != nil {
+		t.Fatalf("read failures: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var f planAction
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &f) != nil || f.Action != actionCopy || f.Key != "bad" || f.Error != "broken" {
+		t.Fatalf("unexpected failures: %s", data)
+	}
+
+	// retry the failed ones only
+	dst.broken = false
+	config.RetryFrom = list
+	b.Delete("good")
+	if err := Sync(a, dst, config); err != nil {
+		t.Fatalf("retry: %s", err)
+	}
+	if _, err := b.Head("good"); err == nil {
+		t.Fatalf("good should not be copied when retrying")
+	}
+	if _, err := b.Head("bad"); err != nil {
+		t.Fatalf("bad should be copied: %s", err)
+	}
+	if _, err := ioutil.ReadFile(list); err == nil {
+		t.Fatalf("failures should be removed after all succeeded")
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := parseIgnore(strings.NewReader(`
+# build artifacts
+*.o
+!keep.o
+/bin/
+build/
+docs/**/*.pdf
+**/tmp
+\#hash
+trailing` + "   " + `
+logs/**
+!logs/important.log
+vendor/
+!vendor/keep
+`))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	cases := map[string]bool{
+		"main.go":               false,
+		"a.o":                   true,
+		"src/lib/a.o":           true,
+		"src/keep.o":            false,
+		"bin/":                  true,
+		"bin/juicefs":           true,
+		"src/bin/x":             false, // anchored to the root
+		"bin":                   false, // directory only
+		"build/":                true,
+		"src/build/x.txt":       true,
+		"build":                 false,
+		"docs/a.pdf":            true, // zero directories
+		"docs/x/y/a.pdf":        true,
+		"docs/x/a.pdf.txt":      false,
+		"tmp":                   true,
+		"a/b/tmp/":              true,
+		"a/b/tmp/c":             true,
+		"#hash":                 true,
+		"trailing":              true,
+		"logs/":                 false,
+		"logs/a.log":            true,
+		"logs/important.log":    false,
+		"vendor/keep":           true, // the parent is excluded
+		"vendor/":               true,
+		"vendors/x":             false,
+		"":                      false,
+		"src/lib/":              false,
+		"src/lib/keep.o/inside": false,
+	}
+	for key, expected := range cases {
+		if got := rules.ignored(key); got != expected {
+			t.Errorf("ignored(%q) = %v, expected %v", key, got, expected)
+		}
+	}
+
+	for p, expected := range map[string]string{
+		"a?[!b-c]*": `^(?:.*/)?a[^/][^b-c][^/]*$`,
+		"[]x]":      `^(?:.*/)?[]x]$`,
+		"a[b":       `^(?:.*/)?a\[b$`,
+		"a/**/b":    `^a/(?:.*/)?b$`,
+		"\\*.go":    `^(?:.*/)?\*\.go$`,
+	} {
+		if got := ignoreToRegexp(p); got != expected {
+			t.Errorf("ignoreToRegexp(%q) = %q, expected %q", p, got, expected)
+		}
+	}
+}
+
+// nolint:errcheck
+func TestSyncExcludeFrom(t *testing.T) {
+	dir := t.TempDir()
+	ignore := filepath.Join(dir, ".gitignore")
+	ioutil.WriteFile(ignore, []byte("*.o\n!main.o\nout/\n"), 0644)
+	config := &Config{
+		Threads:     10,
+		Dirs:        true,
+		Exclude:     []string{"main"}, // --exclude wins over the negative pattern
+		ExcludeFrom: ignore,
+		Quiet:       true,
+	}
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	for _, k := range []string{"README", "main.o", "src/a.c", "src/a.o", "src/out/x", "out/y"} {
+		a.Put(k, bytes.NewReader([]byte(k)))
+	}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	keys, _ := b.ListAll("", "")
+	expected := []string{"", "README", "src/", "src/a.c"}
+	if got := collectAll(keys); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+
+	config.Exclude = nil
+	config.Include = []string{"\\.o$"}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if _, err := b.Head("main.o"); err != nil {
+		t.Fatalf("main.o should be copied: %s", err)
+	}
+	if _, err := b.Head("src/a.o"); err == nil {
+		t.Fatalf("src/a.o should not be copied")
+	}
+
+	config.ExcludeFrom = filepath.Join(dir, "missing")
+	if err := Sync(a, b, config); err == nil {
+		t.Fatalf("sync with missing %s should fail", config.ExcludeFrom)
+	}
+}
+
+// nolint:errcheck
+func TestSyncLinks(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	a.Put("f", bytes.NewReader([]byte("data")))
+	a.Put("d/x", bytes.NewReader([]byte("x")))
+	os.Symlink("f", filepath.Join(dir, "a", "link"))
+	os.Symlink("d", filepath.Join(dir, "a", "dlink"))
+	os.Symlink("missing", filepath.Join(dir, "a", "broken"))
+	readlink := func(name string) string {
+		target, _ := os.Readlink(filepath.Join(dir, name))
+		return target
+	}
+
+	// --links: mirror the symlinks, including the broken one
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	config := &Config{Threads: 10, Links: true, Quiet: true}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	for name, target := range map[string]string{"b/link": "f", "b/dlink": "d", "b/broken": "missing"} {
+		if got := readlink(name); got != target {
+			t.Fatalf("%s should point to %s, but got %q", name, target, got)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "b", "dlink", "x")); err != nil {
+		t.Fatalf("dlink/x should be reachable: %s", err)
+	}
+	if err := Sync(a, b, config); err != nil || copied.Current() != 0 {
+		t.Fatalf("symlinks should be skipped in the second sync: copied %d, %v", copied.Current(), err)
+	}
+	os.Remove(filepath.Join(dir, "a", "link"))
+	os.Symlink("d/x", filepath.Join(dir, "a", "link"))
+	config.CheckAll = true
+	if err := Sync(a, b, config); err != nil || copied.Current() != 1 || readlink("b/link") != "d/x" {
+		t.Fatalf("the changed symlink should be copied: copied %d, %v", copied.Current(), err)
+	}
+	config.CheckAll = false
+
+	// object storage keeps the target in metadata, and restores the symlinks
+	m, _ := object.CreateStorage("mem", "", "", "")
+	if err := Sync(a, m, config); err != nil {
+		t.Fatalf("sync to mem: %s", err)
+	}
+	if target, err := m.(object.SymlinkStore).Readlink("broken"); err != nil || target != "missing" {
+		t.Fatalf("broken should be kept as symlink: %q %v", target, err)
+	}
+	if _, err := m.Head("dlink/x"); err == nil {
+		t.Fatalf("dlink should not be followed")
+	}
+	c, _ := object.CreateStorage("file", filepath.Join(dir, "c")+"/", "", "")
+	if err := Sync(m, c, config); err != nil {
+		t.Fatalf("restore from mem: %s", err)
+	}
+	if readlink("c/link") != "d/x" || readlink("c/broken") != "missing" {
+		t.Fatalf("symlinks should be restored: %q %q", readlink("c/link"), readlink("c/broken"))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "c", "f")); string(data) != "data" {
+		t.Fatalf("content of f: %q", data)
+	}
+
+	// --copy-links (default): follow the symlinks, skip the broken one with a warning
+	a, _ = object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	e, _ := object.CreateStorage("file", filepath.Join(dir, "e")+"/", "", "")
+	if err := Sync(a, e, &Config{Threads: 10, Quiet: true}); err != nil {
+		t.Fatalf("sync with --copy-links: %s", err)
+	}
+	keys, _ := e.ListAll("", "")
+	expected := []string{"", "d/", "d/x", "dlink/", "dlink/x", "f", "link"}
+	if got := collectAll(keys); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "e", "link")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("link should be copied as a regular file: %v", err)
+	}
+}
+
+// nolint:errcheck
+func TestSyncCompress(t *testing.T) {
+	config := &Config{
+		Threads:  10,
+		Compress: true,
+		Quiet:    true,
+	}
+	a, _ := object.CreateStorage("mem", "a", "", "")
+	b, _ := object.CreateStorage("mem", "b", "", "")
+	c, _ := object.CreateStorage("mem", "c", "", "")
+	data := bytes.Repeat([]byte("juicefs"), 1000)
+	a.Put("x", bytes.NewReader(data))
+	a.Put("y", bytes.NewReader([]byte("y")))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+	if n := copied.Current(); n != 2 {
+		t.Fatalf("should copy 2 objects, but got %d", n)
+	}
+	in, _ := b.Get("x", 0, -1)
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("x should be compressed: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(zr); !bytes.Equal(d, data) {
+		t.Fatalf("gunzip x: %d bytes", len(d))
+	}
+
+	// the sizes are different, but nothing needs to be copied again
+	config.CheckAll = true
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("compress again: %s", err)
+	}
+	if n, s := copied.Current(), skipped.Current(); n != 0 || s != 2 {
+		t.Fatalf("should skip 2 objects, but copied %d and skipped %d", n, s)
+	}
+	a.Put("y", bytes.NewReader([]byte("z")))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("compress changed: %s", err)
+	}
+	if n := copied.Current(); n != 1 {
+		t.Fatalf("should copy 1 object, but got %d", n)
+	}
+
+	config = &Config{Threads: 10, Decompress: true, CheckNew: true, Quiet: true}
+	if err := Sync(b, c, config); err != nil {
+		t.Fatalf("decompress: %s", err)
+	}
+	for _, key := range []string{"x", "y"} {
+		in, _ := a.Get(key, 0, -1)
+		expected, _ := ioutil.ReadAll(in)
+		if in, err = c.Get(key, 0, -1); err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		if d, _ := ioutil.ReadAll(in); !bytes.Equal(d, expected) {
+			t.Fatalf("content of %s: %q != %q", key, d, expected)
+		}
+	}
+
+	config.Compress = true
+	if err := Sync(a, b, config); err == nil {
+		t.Fatalf("--compress and --decompress should not be used together")
+	}
+}
+
+// nolint:errcheck
+func TestSyncRewriteKey(t *testing.T) {
+	config := &Config{
+		Threads:    10,
+		RewriteKey: "a/:b/",
+		Quiet:      true,
+	}
+	src, _ := object.CreateStorage("mem", "src", "", "")
+	dst, _ := object.CreateStorage("mem", "dst", "", "")
+	src.Put("a/1", bytes.NewReader([]byte("1")))
+	src.Put("a/2", bytes.NewReader([]byte("2")))
+	src.Put("c/a/3", bytes.NewReader([]byte("3")))
+	dst.Put("b/2", bytes.NewReader([]byte("22")))
+	if err := Sync(src, dst, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if n := copied.Current(); n != 3 {
+		t.Fatalf("should copy 3 objects, but got %d", n)
+	}
+	ch, _ := ListAll(dst, "", "")
+	keys := collectAll(ch)
+	if strings.Join(keys, ",") != "b/1,b/2,c/a/3" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if o, err := dst.Head("b/2"); err != nil || o.Size() != 1 {
+		t.Fatalf("b/2 should be updated: %v %v", o, err)
+	}
+	if err := Sync(src, dst, config); err != nil {
+		t.Fatalf("sync again: %s", err)
+	}
+	if n, s := copied.Current(), skipped.Current(); n != 0 || s != 3 {
+		t.Fatalf("should skip 3 objects, but copied %d and skipped %d", n, s)
+	}
+
+	config.RewriteKey = `([^/]+)/a/:a/${1}/`
+	if err := Sync(src, dst, config); err != nil {
+		t.Fatalf("sync with groups: %s", err)
+	}
+	if _, err := dst.Head("a/c/3"); err != nil {
+		t.Fatalf("c/a/3 should be copied into a/c/3: %s", err)
+	}
+
+	config.RewriteKey = "nocolon"
+	if err := Sync(src, dst, config); err == nil {
+		t.Fatalf("invalid --rewrite-key should fail")
+	}
+}
+
+// stuckReader returns part of the data, then fails once released, like a sync killed mid-way.
+type stuckReader struct {
+	data    []byte
+	release chan struct{}
+}
+
+func (r *stuckReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.release
+	return 0, fmt.Errorf("killed")
+}
+
+func (r *stuckReader) Close() error { return nil }
+
+type stuckStore struct {
+	object.ObjectStorage
+	release chan struct{}
+}
+
+func (s *stuckStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if key == "big" {
+		return &stuckReader{[]byte("partial"), s.release}, nil
+	}
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+// nolint:errcheck
+// corruptStore flips the first byte of the objects written into it, for the first n times.
+type corruptStore struct {
+	object.ObjectStorage
+	n int32
+}
+
+func (s *corruptStore) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && atomic.AddInt32(&s.n, -1) >= 0 {
+		data[0] ^= 0xff
+	}
+	return s.ObjectStorage.Put(key, bytes.NewReader(data))
+}
+
+// nolint:errcheck
+func TestSyncVerifyAfter(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("hello")))
+
+	dst := &corruptStore{b, 2}
+	if err := Sync(a, dst, &Config{Threads: 2, Quiet: true, VerifyAfter: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if mismatched.Current() != 2 || unverified.Current() != 0 {
+		t.Fatalf("expect 2 mismatched and 0 unverified, but got %d %d", mismatched.Current(), unverified.Current())
+	}
+	if in, err := b.Get("x", 0, -1); err != nil {
+		t.Fatalf("get x: %s", err)
+	} else if data, _ := ioutil.ReadAll(in); string(data) != "hello" {
+		t.Fatalf("x should be copied again after corrupted: %q", data)
+	}
+
+	// always corrupted
+	b.Delete("x")
+	dst.n = math.MaxInt32
+	if err := Sync(a, dst, &Config{Threads: 2, Quiet: true, VerifyAfter: true}); err == nil {
+		t.Fatalf("sync should fail")
+	}
+	if mismatched.Current() != verifyRetries+1 || unverified.Current() != 1 || failed.Current() != 1 {
+		t.Fatalf("expect %d mismatched, 1 unverified and 1 failed, but got %d %d %d",
+			verifyRetries+1, mismatched.Current(), unverified.Current(), failed.Current())
+	}
+}
+
+func TestSyncServerSideCopy(t *testing.T) {
+	m, _ := object.CreateStorage("mem", "", "", "")
+	src, dst := object.WithPrefix(m, "a/"), object.WithPrefix(m, "b/")
+	for _, key := range []string{"x", "d/y"} {
+		src.Put(key, bytes.NewReader([]byte("hello "+key)))
+	}
+	if err := Sync(src, dst, &Config{Threads: 2, Quiet: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if serverCopied.Current() != 2 || copied.Current() != 2 {
+		t.Fatalf("expect 2 objects copied on the server side, but got %d of %d", serverCopied.Current(), copied.Current())
+	}
+	for _, key := range []string{"x", "d/y"} {
+		in, err := dst.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("get %s: %s", key, err)
+		}
+		if data, _ := ioutil.ReadAll(in); string(data) != "hello "+key {
+			t.Fatalf("get %s: %q", key, data)
+		}
+	}
+
+	// different buckets
+	other, _ := object.CreateStorage("mem", "other", "", "")
+	if err := Sync(src, other, &Config{Threads: 2, Quiet: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if serverCopied.Current() != 0 || copied.Current() != 2 {
+		t.Fatalf("expect 2 objects copied through the client, but got %d of %d on the server side", copied.Current(), serverCopied.Current())
+	}
+}
+
+// partStore keeps the parts of multipart uploads in memory.
+type partStore struct {
+	object.ObjectStorage
+	sync.Mutex
+	parts   map[string]map[int][]byte
+	uploads int
+}
+
+func (s *partStore) CreateMultipartUpload(key string) (*object.MultipartUpload, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.uploads++
+	s.parts[key] = make(map[int][]byte)
+	return &object.MultipartUpload{UploadID: key, MinPartSize: defaultPartSize, MaxCount: 10000}, nil
+}
+
+func (s *partStore) UploadPart(key string, uploadID string, num int, body []byte) (*object.Part, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.parts[uploadID][num] = append([]byte{}, body...)
+	return &object.Part{Num: num, Size: len(body)}, nil
+}
+
+func (s *partStore) CompleteUpload(key string, uploadID string, parts []*object.Part) error {
+	s.Lock()
+	var data []byte
+	for _, p := range parts {
+		data = append(data, s.parts[uploadID][p.Num]...)
+	}
+	delete(s.parts, uploadID)
+	s.Unlock()
+	return s.Put(key, bytes.NewReader(data))
+}
+
+func TestSyncCompressStream(t *testing.T) {
+	// nothing should be staged in local disk
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	a, _ := object.CreateStorage("mem", "a", "", "")
+	b, _ := object.CreateStorage("mem", "b", "", "")
+	data := make([]byte, maxBlock+(3<<20))
+	rand.Read(data)
+	a.Put("big", bytes.NewReader(data))
+
+	dst := &partStore{ObjectStorage: b, parts: make(map[string]map[int][]byte)}
+	if err := Sync(a, dst, &Config{Threads: 2, Quiet: true, Compress: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if dst.uploads != 1 || copied.Current() != 1 || serverCopied.Current() != 0 {
+		t.Fatalf("expect 1 multipart upload, but got %d, copied %d", dst.uploads, copied.Current())
+	}
+	in, err := b.Get("big", 0, -1)
+	if err != nil {
+		t.Fatalf("get big: %s", err)
+	}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("gunzip: %s", err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("big is not copied correctly: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestSyncAtMostOnce(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("big", bytes.NewReader(make([]byte, 100)))
+	a.Put("small", bytes.NewReader([]byte("small")))
+	a.Put(".small.tmp123", bytes.NewReader([]byte("partial"))) // being written in source
+
+	src := &stuckStore{a, make(chan struct{})}
+	done := make(chan error)
+	go func() { done <- Sync(src, b, &Config{Threads: 2, Quiet: true, AtMostOnce: true}) }()
+	var tmp string
+	for i := 0; i < 100 && tmp == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+		names, _ := filepath.Glob(filepath.Join(dir, "b", ".big.tmp*"))
+		if len(names) > 0 {
+			tmp = names[0]
+		}
+	}
+	if tmp == "" {
+		t.Fatalf("big should be written into a temporary file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b", "big")); !os.IsNotExist(err) {
+		t.Fatalf("partial big should not be visible: %v", err)
+	}
+	close(src.release)
+	if err := <-done; err == nil {
+		t.Fatalf("sync should fail")
+	}
+	if _, err := b.Head("big"); err == nil {
+		t.Fatalf("partial big should not be visible")
+	}
+	if _, err := b.Head(".small.tmp123"); err == nil {
+		t.Fatalf("temporary file in source should not be copied")
+	}
+	if _, err := b.Head("small"); err != nil {
+		t.Fatalf("small should be copied: %s", err)
+	}
+
+	// the one left by a crashed sync
+	os.WriteFile(tmp, []byte("partial"), 0644)
+	old := time.Now().Add(-staleTemp * 2)
+	os.Chtimes(tmp, old, old)
+	b.Put(".small.tmp456", bytes.NewReader([]byte("writing")))
+	if err := Sync(a, b, &Config{Threads: 2, Quiet: true, AtMostOnce: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("stale temporary file should be removed: %v", err)
+	}
+	if _, err := b.Head(".small.tmp456"); err != nil {
+		t.Fatalf("recent temporary file should be kept: %s", err)
+	}
+	if _, err := b.Head("big"); err != nil {
+		t.Fatalf("big should be copied: %s", err)
+	}
+}
+
+// nolint:errcheck
+func TestSyncManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.json")
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	a.Put("x", bytes.NewReader([]byte("x")))
+	a.Put("d/y", bytes.NewReader([]byte("yy")))
+	a.Put("z", bytes.NewReader([]byte("zzz")))
+	config := &Config{Threads: 2, Quiet: true, Manifest: manifest}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	header, entries, err := loadManifest(manifest)
+	if err != nil {
+		t.Fatalf("load manifest: %s", err)
+	}
+	if header.Dst != b.String() || header.Hash != "sha256" || len(entries) != 3 {
+		t.Fatalf("unexpected manifest: %+v %d", header, len(entries))
+	}
+	// sha256 of "x"
+	if e := entries[1]; e.Key != "x" || e.Size != 1 || e.Hash != "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if entries[0].Key != "d/y" || entries[2].Key != "z" {
+		t.Fatalf("entries should be sorted: %s %s", entries[0].Key, entries[2].Key)
+	}
+
+	// only the changed one is hashed again
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "b", "z"), future, future)
+	if n, err := writeManifest(b, config); err != nil || n != 1 {
+		t.Fatalf("incremental manifest: %d %v", n, err)
+	}
+
+	verify := &Config{Threads: 2, Quiet: true, VerifyManifest: manifest}
+	if err := VerifyManifest(b, verify); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	// corrupted in place, with the same size and mtime
+	p := filepath.Join(dir, "b", "x")
+	fi, _ := os.Stat(p)
+	os.WriteFile(p, []byte("X"), 0644)
+	os.Chtimes(p, fi.ModTime(), fi.ModTime())
+	if err := VerifyManifest(b, verify); err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Fatalf("corrupted x should be detected: %v", err)
+	}
+	b.Delete("d/y")
+	if err := VerifyManifest(b, verify); err == nil || !strings.Contains(err.Error(), "2 of 3") {
+		t.Fatalf("missing d/y should be detected: %v", err)
+	}
+}
+
+type genObject struct{ key string }
+
+func (o *genObject) Key() string      { return o.key }
+func (o *genObject) Size() int64      { return 0 }
+func (o *genObject) Mtime() time.Time { return time.Unix(1, 0) }
+func (o *genObject) IsDir() bool      { return false }
+
+// genStore generates the keys in pages on listing, without storing them.
+type genStore struct {
+	object.ObjectStorage
+	total  int
+	listed int64
+}
+
+func (s *genStore) String() string { return "gen://" }
+
+func (s *genStore) ListAll(prefix, marker string) (<-chan object.Object, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (s *genStore) List(prefix, marker string, limit int64) ([]object.Object, error) {
+	start := 0
+	if marker != "" {
+		n, _ := strconv.Atoi(marker)
+		start = n + 1
+	}
+	var objs []object.Object
+	for i := start; i < s.total && int64(len(objs)) < limit; i++ {
+		objs = append(objs, &genObject{fmt.Sprintf("%08d", i)})
+	}
+	atomic.AddInt64(&s.listed, int64(len(objs)))
+	return objs, nil
+}
+
+func TestSyncBudget(t *testing.T) {
+	a, _ := object.CreateStorage("mem", "a", "", "")
+	b, _ := object.CreateStorage("mem", "b", "", "")
+	for i := 0; i < 10; i++ {
+		a.Put(fmt.Sprintf("k%d", i), bytes.NewReader(make([]byte, 1000)))
+	}
+	count := func() int {
+		objs, _ := b.List("", "", 100)
+		return len(objs)
+	}
+
+	if err := Sync(a, b, &Config{Threads: 4, Quiet: true, MaxObjects: 3}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if n := count(); n != 3 || copied.Current() != 3 || deferred.Current() != 7 || deferredBytes.Current() != 7000 {
+		t.Fatalf("expect 3 objects copied and 7 deferred, but got %d objects, copied %d, deferred %d (%d bytes)",
+			n, copied.Current(), deferred.Current(), deferredBytes.Current())
+	}
+	if err := Sync(a, b, &Config{Threads: 4, Quiet: true, MaxBytes: 2500}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if n := count(); n != 5 || copiedBytes.Current() != 2000 || deferred.Current() != 5 {
+		t.Fatalf("expect 2 more objects copied, but got %d objects, copied %d bytes, deferred %d", n, copiedBytes.Current(), deferred.Current())
+	}
+	if err := Sync(a, b, &Config{Threads: 4, Quiet: true}); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if n := count(); n != 10 || deferred.Current() != 0 {
+		t.Fatalf("expect all the objects copied, but got %d objects, deferred %d", n, deferred.Current())
+	}
+}
+
+// nolint:errcheck
+func TestSyncStructureOnly(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	a.Put("f", bytes.NewReader(make([]byte, 1000)))
+	a.Put("d/x", bytes.NewReader([]byte("x")))
+	a.Put("d/e/", bytes.NewReader(nil))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(dir, "a", "f"), mtime, mtime)
+	os.Chmod(filepath.Join(dir, "a", "d", "x"), 0600)
+
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	config := &Config{Threads: 10, Quiet: true, StructureOnly: true, Perms: true}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if copiedBytes.Current() != 0 {
+		t.Fatalf("no data should be copied, but got %d bytes", copiedBytes.Current())
+	}
+	akeys, _ := a.ListAll("", "")
+	bkeys, _ := b.ListAll("", "")
+	if ak, bk := collectAll(akeys), collectAll(bkeys); !reflect.DeepEqual(ak, bk) {
+		t.Fatalf("expect the same structure %v, but got %v", ak, bk)
+	}
+	for _, name := range []string{"f", "d/x"} {
+		fi1, _ := os.Stat(filepath.Join(dir, "a", name))
+		fi2, err := os.Stat(filepath.Join(dir, "b", name))
+		if err != nil || fi2.Size() != 0 {
+			t.Fatalf("%s should be empty: %+v %v", name, fi2, err)
+		}
+		if !fi2.ModTime().Equal(fi1.ModTime()) || fi2.Mode() != fi1.Mode() {
+			t.Fatalf("mtime and mode of %s should be kept: %s %s, %s %s", name, fi1.ModTime(), fi1.Mode(), fi2.ModTime(), fi2.Mode())
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "b", "d", "e")); err != nil || !fi.IsDir() {
+		t.Fatalf("d/e should be a directory: %v", err)
+	}
+
+	// the empty files are not copied again because of the sizes
+	if err := Sync(a, b, config); err != nil || copied.Current() != 0 {
+		t.Fatalf("nothing should be copied in the second sync: copied %d, %v", copied.Current(), err)
+	}
+}
+
+// nolint:errcheck
+func TestSyncXattrs(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := object.CreateStorage("file", filepath.Join(dir, "a")+"/", "", "")
+	if !object.SupportXattrs(a) {
+		t.Skipf("%s can't keep xattrs", a)
+	}
+	a.Put("f", bytes.NewReader([]byte("f")))
+	a.Put("d/x", bytes.NewReader([]byte("x")))
+	xa := a.(object.XattrStore)
+	attrs := map[string][]byte{"user.tag": []byte("dr"), "user.bin": {0, 1, 2}}
+	if err := xa.SetXattrs("f", attrs); err != nil {
+		t.Skipf("set xattrs: %s", err)
+	}
+	// an ACL giving read to user 1000: user::rw-, user:1000:r--, group::r--, mask::r--, other::---
+	acl := []byte{2, 0, 0, 0, 1, 0, 6, 0, 255, 255, 255, 255, 2, 0, 4, 0, 232, 3, 0, 0,
+		4, 0, 4, 0, 255, 255, 255, 255, 16, 0, 4, 0, 255, 255, 255, 255, 32, 0, 0, 0, 255, 255, 255, 255}
+	withACL := map[string][]byte{"user.tag": []byte("x"), "system.posix_acl_access": acl}
+	if err := xa.SetXattrs("d/x", withACL); err != nil {
+		t.Logf("ACL is not supported: %s", err)
+		withACL = map[string][]byte{"user.tag": []byte("x")}
+		xa.SetXattrs("d/x", withACL)
+	}
+
+	b, _ := object.CreateStorage("file", filepath.Join(dir, "b")+"/", "", "")
+	config := &Config{Threads: 10, Quiet: true, Xattrs: true}
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	xb := b.(object.XattrStore)
+	for key, expected := range map[string]map[string][]byte{"f": attrs, "d/x": withACL} {
+		if got, err := xb.GetXattrs(key); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Fatalf("xattrs of %s: expect %v, but got %v %v", key, expected, got, err)
+		}
+	}
+
+	// the changed ones are copied without the data
+	delete(attrs, "user.bin")
+	attrs["user.tag"] = []byte("dr2")
+	xa.SetXattrs("f", attrs)
+	if err := Sync(a, b, config); err != nil || copied.Current() != 1 || copiedBytes.Current() != 0 {
+		t.Fatalf("the changed xattrs should be copied: copied %d (%d bytes), %v", copied.Current(), copiedBytes.Current(), err)
+	}
+	if got, _ := xb.GetXattrs("f"); !reflect.DeepEqual(got, attrs) {
+		t.Fatalf("xattrs of f: expect %v, but got %v", attrs, got)
+	}
+	if err := Sync(a, b, config); err != nil || copied.Current() != 0 {
+		t.Fatalf("nothing should be copied in the third sync: copied %d, %v", copied.Current(), err)
+	}
+
+	// object storage keeps them in metadata, and restores them
+	m, _ := object.CreateStorage("mem", "", "", "")
+	if err := Sync(a, m, config); err != nil {
+		t.Fatalf("sync to mem: %s", err)
+	}
+	c, _ := object.CreateStorage("file", filepath.Join(dir, "c")+"/", "", "")
+	if err := Sync(m, c, config); err != nil {
+		t.Fatalf("sync from mem: %s", err)
+	}
+	for key, expected := range map[string]map[string][]byte{"f": attrs, "d/x": withACL} {
+		if got, err := c.(object.XattrStore).GetXattrs(key); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Fatalf("restored xattrs of %s: expect %v, but got %v %v", key, expected, got, err)
+		}
+	}
+}
+
+func TestListAllBounded(t *testing.T) {
+	s := &genStore{total: 1000000}
+	runtime.GC()
+	var before, during runtime.MemStats
+	runtime.ReadMemStats(&before)
+	objs, err := ListAll(s, "", "")
+	if err != nil {
+		t.Fatalf("list all: %s", err)
+	}
+	var consumed, ahead int64
+	for o := range objs {
+		if o == nil {
+			t.Fatalf("listing failed")
+		}
+		consumed++
+		if n := atomic.LoadInt64(&s.listed) - consumed; n > ahead {
+			ahead = n
+		}
+		if consumed == int64(s.total)/2 {
+			runtime.GC()
+			runtime.ReadMemStats(&during)
+		}
+	}
+	if consumed != int64(s.total) {
+		t.Fatalf("expect %d objects but got %d", s.total, consumed)
+	}
+	// the buffered channel and a page in the producer
+	if ahead > maxResults*12 {
+		t.Fatalf("the listing should not go too far ahead of the consumer: %d objects", ahead)
+	}
+	if during.HeapAlloc > before.HeapAlloc && during.HeapAlloc-before.HeapAlloc > 32<<20 {
+		t.Fatalf("heap grows by %d bytes while listing %d objects", during.HeapAlloc-before.HeapAlloc, s.total)
+	}
+}
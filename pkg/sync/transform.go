@@ -0,0 +1,162 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// transform changes the keys (--rewrite-key) or the contents (--compress or --decompress) of objects
+// when they are copied into the destination.
+type transform struct {
+	compress   bool
+	decompress bool
+	pattern    *regexp.Regexp
+	replace    string
+}
+
+func newTransform(config *Config) (*transform, error) {
+	if !config.Compress && !config.Decompress && config.RewriteKey == "" {
+		return nil, nil
+	}
+	if config.Compress && config.Decompress {
+		return nil, fmt.Errorf("--compress and --decompress can't be used together")
+	}
+	if config.TwoWay {
+		return nil, fmt.Errorf("--two-way can't be used with --compress, --decompress or --rewrite-key")
+	}
+	t := &transform{compress: config.Compress, decompress: config.Decompress}
+	if config.RewriteKey != "" {
+		if config.DeleteDst {
+			return nil, fmt.Errorf("--delete-dst can't be used with --rewrite-key")
+		}
+		p := strings.LastIndexByte(config.RewriteKey, ':')
+		if p < 0 {
+			return nil, fmt.Errorf("invalid --rewrite-key %q, it should be PATTERN:REPLACEMENT", config.RewriteKey)
+		}
+		// only the beginning of keys is matched, so a prefix can be replaced with a plain pattern
+		re, err := regexp.Compile("^(?:" + config.RewriteKey[:p] + ")")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of --rewrite-key: %s", err)
+		}
+		t.pattern, t.replace = re, config.RewriteKey[p+1:]
+	}
+	return t, nil
+}
+
+// key returns the key of object in destination.
+func (t *transform) key(key string) string {
+	if t == nil || t.pattern == nil {
+		return key
+	}
+	return t.pattern.ReplaceAllString(key, t.replace)
+}
+
+func (t *transform) rewritesKey() bool {
+	return t != nil && t.pattern != nil
+}
+
+// changesData returns whether the contents are changed, then the sizes of objects in source and
+// destination can't be compared.
+func (t *transform) changesData() bool {
+	return t != nil && (t.compress || t.decompress)
+}
+
+// reader returns the contents to be written into the destination, in should be closed by the caller.
+func (t *transform) reader(in io.Reader) (io.ReadCloser, error) {
+	if t.compress {
+		pr, pw := io.Pipe()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, in)
+			if err == nil {
+				err = zw.Close()
+			}
+			_ = pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip: %s", err)
+	}
+	return zr, nil
+}
+
+// sameContents compares the original contents of the objects in source and destination, the
+// compressed one (destination if --compress, or source if --decompress) is decompressed first.
+func (t *transform) sameContents(src, dst object.ObjectStorage, key string, size int64) (bool, error) {
+	if limiter != nil {
+		limiter.Wait(size)
+	}
+	concurrent <- 1
+	defer func() {
+		<-concurrent
+	}()
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return false, fmt.Errorf("src get: %s", err)
+	}
+	defer in.Close()
+	in2, err := dst.Get(t.key(key), 0, -1)
+	if err != nil {
+		return false, fmt.Errorf("dest get: %s", err)
+	}
+	defer in2.Close()
+	var r1, r2 io.Reader = in, in2
+	if t.decompress {
+		if r1, err = gzip.NewReader(in); err != nil {
+			return false, fmt.Errorf("src gunzip: %s", err)
+		}
+	} else if r2, err = gzip.NewReader(in2); err != nil {
+		logger.Debugf("Gunzip %s in destination: %s", t.key(key), err)
+		return false, nil
+	}
+	return sameStream(r1, r2)
+}
+
+func sameStream(r1, r2 io.Reader) (bool, error) {
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	buf2 := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf2)
+	b1, b2 := (*buf)[:cap(*buf)], (*buf2)[:cap(*buf2)]
+	for {
+		n1, err1 := io.ReadFull(r1, b1)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return false, fmt.Errorf("src read: %s", err1)
+		}
+		n2, err2 := io.ReadFull(r2, b2)
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			logger.Debugf("Read destination: %s", err2)
+			return false, nil
+		}
+		if n1 != n2 || !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false, nil
+		}
+		if err1 != nil || err2 != nil {
+			return err1 != nil && err2 != nil, nil
+		}
+	}
+}
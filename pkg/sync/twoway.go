@@ -0,0 +1,445 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// policies to resolve the conflicts of two-way sync
+const (
+	ConflictNewer    = "newer"
+	ConflictLarger   = "larger"
+	ConflictKeepBoth = "keep-both"
+)
+
+type fileState struct {
+	Size  int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+}
+
+func stateOf(o object.Object) fileState {
+	return fileState{o.Size(), o.Mtime().Unix()}
+}
+
+func (s fileState) changed(o object.Object) bool {
+	return s != stateOf(o)
+}
+
+// syncRecord is the state of both sides after a key is synced last time.
+type syncRecord struct {
+	Src fileState `json:"src"`
+	Dst fileState `json:"dst"`
+}
+
+type syncState struct {
+	sync.Mutex
+	path    string
+	Records map[string]*syncRecord `json:"records"`
+}
+
+func defaultStatePath(src, dst object.ObjectStorage) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	h := md5.Sum([]byte(src.String() + "\n" + dst.String()))
+	return filepath.Join(home, ".juicefs", "sync", fmt.Sprintf("%x.json", h[:8]))
+}
+
+func loadState(path string) (*syncState, error) {
+	s := &syncState{path: path, Records: make(map[string]*syncRecord)}
+	d, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(d, s); err != nil {
+		return nil, fmt.Errorf("invalid sync state %s: %s", path, err)
+	}
+	if s.Records == nil {
+		s.Records = make(map[string]*syncRecord)
+	}
+	return s, nil
+}
+
+func (s *syncState) get(key string) *syncRecord {
+	s.Lock()
+	defer s.Unlock()
+	return s.Records[key]
+}
+
+func (s *syncState) set(key string, src, dst object.Object) {
+	s.Lock()
+	defer s.Unlock()
+	s.Records[key] = &syncRecord{stateOf(src), stateOf(dst)}
+}
+
+func (s *syncState) remove(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.Records, key)
+}
+
+func (s *syncState) save() error {
+	s.Lock()
+	d, err := json.Marshal(s)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// keys returns the recorded keys in the range, sorted.
+func (s *syncState) keys(start, end string) []string {
+	var keys []string
+	for k := range s.Records {
+		if k >= start && (end == "" || k <= end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lister iterates the files of a listing, ignoring the directories.
+type lister struct {
+	ch  <-chan object.Object
+	cur object.Object
+}
+
+func (l *lister) peek() (object.Object, error) {
+	for l.cur == nil && l.ch != nil {
+		o, ok := <-l.ch
+		if !ok {
+			l.ch = nil
+		} else if o == nil {
+			return nil, fmt.Errorf("listing failed")
+		} else if !o.IsDir() {
+			l.cur = o
+		}
+	}
+	return l.cur, nil
+}
+
+func (l *lister) take(key string) object.Object {
+	if l.cur != nil && l.cur.Key() == key {
+		o := l.cur
+		l.cur = nil
+		return o
+	}
+	return nil
+}
+
+func sameFile(o1, o2 object.Object) bool {
+	return o1.Size() == o2.Size() && o1.Mtime().Unix() == o2.Mtime().Unix()
+}
+
+// srcWins decides which version of a conflicted file should be kept.
+func srcWins(so, do object.Object, policy string) bool {
+	if policy == ConflictLarger && so.Size() != do.Size() {
+		return so.Size() > do.Size()
+	}
+	if so.Mtime().Unix() != do.Mtime().Unix() {
+		return so.Mtime().After(do.Mtime())
+	}
+	return so.Size() >= do.Size()
+}
+
+func conflictKey(key string, mtime time.Time) string {
+	return key + ".conflict-" + mtime.UTC().Format("20060102-150405")
+}
+
+type twoWay struct {
+	src, dst object.ObjectStorage
+	config   *Config
+	state    *syncState
+	tasks    chan func()
+}
+
+func (t *twoWay) copy(from, to object.ObjectStorage, obj object.Object) (object.Object, error) {
+	key := obj.Key()
+	if t.config.Dry {
+		logger.Infof("Will copy %s (%d bytes) from %s to %s", key, obj.Size(), from, to)
+		return obj, nil
+	}
+	err := copyData(from, to, key, obj.Size())
+	if err == nil && t.config.VerifyAfter {
+		err = verifyCopied(from, to, key, obj.Size())
+	} else if err == nil && (t.config.CheckAll || t.config.CheckNew) {
+		var equal bool
+		if equal, err = checkSum(from, to, key, obj.Size()); err == nil && !equal {
+			err = fmt.Errorf("checksums of copied object %s don't match", key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mc, ok := to.(object.MtimeChanger); ok {
+		if err = mc.Chtimes(key, obj.Mtime()); err != nil {
+			logger.Warnf("Update mtime of %s: %s", key, err)
+		}
+	}
+	if _, ok := to.(object.FileSystem); ok && t.config.Perms {
+		if _, ok = obj.(object.File); ok {
+			copyPerms(to, obj)
+		}
+	}
+	copied.Increment()
+	return to.Head(key)
+}
+
+// copyTo copies the file of one side to the other, then records the state of both sides.
+func (t *twoWay) copyTo(toDst bool, obj object.Object) {
+	from, to := t.src, t.dst
+	if !toDst {
+		from, to = to, from
+	}
+	o, err := t.copy(from, to, obj)
+	if err != nil {
+		failed.Increment()
+		logger.Errorf("Failed to copy %s from %s to %s: %s", obj.Key(), from, to, err)
+		return
+	}
+	if toDst {
+		t.state.set(obj.Key(), obj, o)
+	} else {
+		t.state.set(obj.Key(), o, obj)
+	}
+}
+
+// keepBoth saves the loser of a conflict into a new key on both sides.
+func (t *twoWay) keepBoth(store, other object.ObjectStorage, obj object.Object) error {
+	key := obj.Key()
+	ckey := conflictKey(key, obj.Mtime())
+	if t.config.Dry {
+		logger.Infof("Will save %s of %s as %s", key, store, ckey)
+		return nil
+	}
+	in, err := store.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := ioutil.TempFile("", "conflict")
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(f.Name()) // will be deleted after Close()
+	defer f.Close()
+	if _, err = io.Copy(f, in); err != nil {
+		return err
+	}
+	for _, s := range []object.ObjectStorage{store, other} {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err = s.Put(ckey, f); err != nil {
+			return err
+		}
+		if mc, ok := s.(object.MtimeChanger); ok {
+			_ = mc.Chtimes(ckey, obj.Mtime())
+		}
+	}
+	logger.Infof("Saved %s of %s as %s", key, store, ckey)
+	return nil
+}
+
+func (t *twoWay) resolve(so, do object.Object) {
+	toDst := srcWins(so, do, t.config.Conflict)
+	logger.Warnf("Both sides of %s are changed (%d bytes at %s, %d bytes at %s), keep the one from %s",
+		so.Key(), so.Size(), so.Mtime(), do.Size(), do.Mtime(), map[bool]string{true: "source", false: "destination"}[toDst])
+	if t.config.Conflict == ConflictKeepBoth {
+		var err error
+		if toDst {
+			err = t.keepBoth(t.dst, t.src, do)
+		} else {
+			err = t.keepBoth(t.src, t.dst, so)
+		}
+		if err != nil {
+			failed.Increment()
+			logger.Errorf("Failed to keep both versions of %s: %s", so.Key(), err)
+			return
+		}
+	}
+	if toDst {
+		t.copyTo(true, so)
+	} else {
+		t.copyTo(false, do)
+	}
+}
+
+func (t *twoWay) delete(store object.ObjectStorage, key string) {
+	if deleteObj(store, key, t.config.Dry) == nil {
+		t.state.remove(key)
+	}
+}
+
+func (t *twoWay) submit(f func()) {
+	handled.IncrTotal(1)
+	t.tasks <- f
+}
+
+func (t *twoWay) skip() {
+	handled.IncrTotal(1)
+	skipped.Increment()
+	handled.Increment()
+}
+
+// diff compares the files of both sides with the state of last sync.
+func (t *twoWay) diff(key string, so, do object.Object) {
+	rec := t.state.get(key)
+	switch {
+	case so != nil && do != nil:
+		srcChanged := rec == nil || rec.Src.changed(so)
+		dstChanged := rec == nil || rec.Dst.changed(do)
+		if !srcChanged && !dstChanged {
+			t.skip()
+		} else if sameFile(so, do) {
+			t.state.set(key, so, do)
+			t.skip()
+		} else if !dstChanged {
+			t.submit(func() { t.copyTo(true, so) })
+		} else if !srcChanged {
+			t.submit(func() { t.copyTo(false, do) })
+		} else {
+			t.submit(func() { t.resolve(so, do) })
+		}
+	case so != nil:
+		if rec != nil && !rec.Src.changed(so) { // deleted from destination
+			t.submit(func() { t.delete(t.src, key) })
+		} else {
+			t.submit(func() { t.copyTo(true, so) })
+		}
+	case do != nil:
+		if rec != nil && !rec.Dst.changed(do) { // deleted from source
+			t.submit(func() { t.delete(t.dst, key) })
+		} else {
+			t.submit(func() { t.copyTo(false, do) })
+		}
+	default: // deleted from both sides
+		t.state.remove(key)
+	}
+}
+
+func (t *twoWay) produce() error {
+	defer close(t.tasks)
+	srckeys, err := ListAll(t.src, t.config.Start, t.config.End)
+	if err != nil {
+		return err
+	}
+	dstkeys, err := ListAll(t.dst, t.config.Start, t.config.End)
+	if err != nil {
+		return err
+	}
+	f := newKeyFilter(t.config)
+	if t.config.Exclude != nil || t.config.ExcludeFrom != "" {
+		srckeys = filter(srckeys, f)
+		dstkeys = filter(dstkeys, f)
+	}
+	srcs, dsts := &lister{ch: srckeys}, &lister{ch: dstkeys}
+	recorded := t.state.keys(t.config.Start, t.config.End)
+	for {
+		so, err := srcs.peek()
+		if err != nil {
+			return err
+		}
+		do, err := dsts.peek()
+		if err != nil {
+			return err
+		}
+		var key string
+		var found bool
+		for _, o := range []object.Object{so, do} {
+			if o != nil && (!found || o.Key() < key) {
+				key, found = o.Key(), true
+			}
+		}
+		if len(recorded) > 0 && (!found || recorded[0] <= key) {
+			key, found = recorded[0], true
+		}
+		if !found {
+			return nil
+		}
+		if len(recorded) > 0 && recorded[0] == key {
+			recorded = recorded[1:]
+		}
+		so, do = srcs.take(key), dsts.take(key)
+		if so == nil && do == nil && !f.match(key) {
+			continue // keep the records of the excluded keys
+		}
+		t.diff(key, so, do)
+	}
+}
+
+// syncTwoWay propagates the changes of both sides since last sync, which is recorded in a state file.
+func syncTwoWay(src, dst object.ObjectStorage, config *Config) error {
+	path := config.StateFile
+	if path == "" {
+		path = defaultStatePath(src, dst)
+	}
+	state, err := loadState(path)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Syncing between %s and %s, state file: %s", src, dst, path)
+	t := &twoWay{src: src, dst: dst, config: config, state: state, tasks: make(chan func(), 10240)}
+	var wg sync.WaitGroup
+	for i := 0; i < config.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range t.tasks {
+				f()
+				handled.Increment()
+			}
+		}()
+	}
+	err = t.produce()
+	wg.Wait()
+	if config.Dry {
+		return err
+	}
+	// the keys not reached are kept when the listing failed
+	if e := state.save(); e != nil {
+		logger.Errorf("Save sync state into %s: %s", path, e)
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
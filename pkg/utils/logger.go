@@ -16,6 +16,7 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
@@ -29,13 +30,16 @@ var mu sync.Mutex
 var loggers = make(map[string]*logHandle)
 
 var syslogHook logrus.Hook
+var logOutput io.Writer
+var logID string
 
 type logHandle struct {
 	logrus.Logger
 
-	name string
-	lvl  *logrus.Level
-	tty  bool
+	name  string
+	logid string
+	lvl   *logrus.Level
+	tty   bool
 }
 
 func (l *logHandle) Format(e *logrus.Entry) ([]byte, error) {
@@ -60,11 +64,12 @@ func (l *logHandle) Format(e *logrus.Entry) ([]byte, error) {
 	}
 	const timeFormat = "2006/01/02 15:04:05.000000"
 	timestamp := e.Time.Format(timeFormat)
-	str := fmt.Sprintf("%v %s[%d] <%v>: %v [%s:%d]",
+	str := fmt.Sprintf("%v %s[%d] <%v>: %s%v [%s:%d]",
 		timestamp,
 		l.name,
 		os.Getpid(),
 		lvlStr,
+		l.logid,
 		e.Message,
 		path.Base(e.Caller.File),
 		e.Caller.Line)
@@ -84,8 +89,12 @@ func (l *logHandle) Log(args ...interface{}) {
 }
 
 func newLogger(name string) *logHandle {
-	l := &logHandle{Logger: *logrus.New(), name: name, tty: isatty.IsTerminal(os.Stderr.Fd())}
+	l := &logHandle{Logger: *logrus.New(), name: name, logid: logID, tty: isatty.IsTerminal(os.Stderr.Fd())}
 	l.Formatter = l
+	if logOutput != nil {
+		l.SetOutput(logOutput)
+		l.tty = false
+	}
 	if syslogHook != nil {
 		l.Hooks.Add(syslogHook)
 	}
@@ -119,6 +128,27 @@ func DisableLogColor() {
 	}
 }
 
+// SetLogID sets an id (e.g. name of the volume) to be logged in every line of all the loggers.
+func SetLogID(id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	logID = "[" + id + "] "
+	for _, logger := range loggers {
+		logger.logid = logID
+	}
+}
+
+// SetOutput writes the logs of all the loggers into w, which should be safe for concurrent writes.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	logOutput = w
+	for _, logger := range loggers {
+		logger.SetOutput(w)
+		logger.tty = false
+	}
+}
+
 func SetOutFile(name string) {
 	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
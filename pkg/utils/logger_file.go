@@ -0,0 +1,124 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is a log file rotated by size or age, the rotated ones are renamed as PATH.1 (the newest),
+// PATH.2 and so on. It's safe to be written by many goroutines.
+type LogFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64         // 0 means no limit
+	maxAge  time.Duration // 0 means no limit
+	backups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenLogFile opens (or creates) a log file to append.
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, backups int) (*LogFile, error) {
+	f := &LogFile{path: path, maxSize: maxSize, maxAge: maxAge, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) open() error {
+	fd, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+	f.file, f.size, f.opened = fd, fi.Size(), time.Now()
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize || f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			// keep writing into the current one
+			fmt.Fprintf(os.Stderr, "rotate log file %s: %s\n", f.path, err)
+			f.opened = time.Now()
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *LogFile) rotate() error {
+	if f.backups > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.backups))
+		for i := f.backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(f.path, 0); err != nil {
+		return err
+	}
+	return f.reopen()
+}
+
+func (f *LogFile) reopen() error {
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	_ = old.Close()
+	return nil
+}
+
+// Reopen opens the file again after it's moved away (e.g. by logrotate).
+func (f *LogFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.reopen()
+}
+
+func (f *LogFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -17,10 +17,14 @@
 package utils
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -56,3 +60,82 @@ func TestLogger(t *testing.T) {
 		t.Fatalf("warn/error should be logged: %s", s)
 	}
 }
+
+func TestLogFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "juicefs.log")
+	f, err := OpenLogFile(path, 1000, 0, 2)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+	line := strings.Repeat("x", 99) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := f.Write([]byte(line)); err != nil {
+					t.Errorf("write: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, name := range []string{"juicefs.log", "juicefs.log.1", "juicefs.log.2"} {
+		d, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || len(d) != 1000 && name != "juicefs.log" || len(d)%100 != 0 {
+			t.Fatalf("%s: %d bytes, %v", name, len(d), err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("only 2 backups should be kept: %v", err)
+	}
+
+	// moved away by logrotate
+	if err = os.Rename(path, path+".old"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if err = f.Reopen(); err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	_, _ = f.Write([]byte("after reopen\n"))
+	if d, _ := ioutil.ReadFile(path); string(d) != "after reopen\n" {
+		t.Fatalf("new file: %q", d)
+	}
+
+	g, err := OpenLogFile(filepath.Join(dir, "age.log"), 0, time.Millisecond*50, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	_, _ = g.Write([]byte("first\n"))
+	time.Sleep(time.Millisecond * 100)
+	_, _ = g.Write([]byte("second\n"))
+	if d, _ := ioutil.ReadFile(filepath.Join(dir, "age.log")); string(d) != "second\n" {
+		t.Fatalf("file should be truncated without backups: %q", d)
+	}
+	_ = g.Close()
+	if _, err = g.Write([]byte("closed")); err == nil {
+		t.Fatalf("write into closed file should fail")
+	}
+
+	logger := GetLogger("test_file")
+	SetOutput(f)
+	SetLogID("myjfs")
+	defer func() {
+		SetOutput(os.Stderr)
+		logOutput, logID = nil, ""
+		for _, l := range loggers {
+			l.logid = ""
+		}
+	}()
+	logger.Warnf("with volume")
+	GetLogger("test_file2").Warnf("new logger")
+	d, _ := ioutil.ReadFile(path)
+	for _, msg := range []string{"with volume", "new logger"} {
+		if !strings.Contains(string(d), fmt.Sprintf("<WARNING>: [myjfs] %s", msg)) {
+			t.Fatalf("log: %s", d)
+		}
+	}
+}
@@ -17,6 +17,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -24,6 +25,9 @@ import (
 	"time"
 )
 
+// ErrLocked is returned by LockFile if the file is locked by others.
+var ErrLocked = errors.New("locked by others")
+
 // Min returns min of 2 int
 func Min(a, b int) int {
 	if a < b {
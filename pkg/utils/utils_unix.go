@@ -34,3 +34,34 @@ func GetFileInode(path string) (uint64, error) {
 	}
 	return 0, nil
 }
+
+// GetLinkInode returns the inode of path, without following symlink.
+func GetLinkInode(path string) (uint64, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if sst, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return sst.Ino, nil
+	}
+	return 0, nil
+}
+
+// LockFile takes an exclusive lock of the opened file, which is released when it's closed. It
+// waits for the lock held by others if wait is true, or returns ErrLocked.
+func LockFile(f *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return ErrLocked
+		}
+		return err
+	}
+}
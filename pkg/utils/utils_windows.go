@@ -36,3 +36,22 @@ func GetFileInode(path string) (uint64, error) {
 	}
 	return uint64(data.FileIndexHigh)<<32 + uint64(data.FileIndexLow), nil
 }
+
+// GetLinkInode returns the inode of path (symlink is followed on Windows).
+func GetLinkInode(path string) (uint64, error) {
+	return GetFileInode(path)
+}
+
+// LockFile takes an exclusive lock of the opened file, which is released when it's closed. It
+// waits for the lock held by others if wait is true, or returns ErrLocked.
+func LockFile(f *os.File, wait bool) error {
+	var flags uint32 = windows.LOCKFILE_EXCLUSIVE_LOCK
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
@@ -19,6 +19,7 @@ package vfs
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -42,6 +43,7 @@ type logReader struct {
 var (
 	readerLock sync.Mutex
 	readers    map[uint64]*logReader
+	lastOp     int64 // utils.Clock() when the last operation is finished
 )
 
 func init() {
@@ -49,6 +51,7 @@ func init() {
 }
 
 func logit(ctx Context, format string, args ...interface{}) {
+	atomic.StoreInt64(&lastOp, int64(utils.Clock()))
 	used := ctx.Duration()
 	opsDurationsHistogram.Observe(used.Seconds())
 	readerLock.Lock()
@@ -74,6 +77,11 @@ func logit(ctx Context, format string, args ...interface{}) {
 	}
 }
 
+// IdleTime returns the duration since the last operation was finished (or the client was started).
+func (v *VFS) IdleTime() time.Duration {
+	return utils.Clock() - time.Duration(atomic.LoadInt64(&lastOp))
+}
+
 func openAccessLog(fh uint64) uint64 {
 	readerLock.Lock()
 	defer readerLock.Unlock()
@@ -0,0 +1,71 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deletedInodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fuse_deleted_inodes",
+	Help: "The number of cached inodes or entries found deleted (by other clients), and the ENOENT recovered by retry (transient).",
+}, []string{"result"})
+
+// checkDeleted calls op on an inode, which could have been deleted by other clients while it's still
+// cached (in this client or the kernel). For ENOENT, the cached attributes and entries of the inode are
+// dropped, so the next lookup goes to the meta engine and gets a clean ENOENT too. With RetryENOENT,
+// op is called once more before that, in case the error is transient (e.g. a lagging replica).
+func (v *VFS) checkDeleted(ino Ino, op func() syscall.Errno) syscall.Errno {
+	err := op()
+	if err != syscall.ENOENT || IsSpecialNode(ino) {
+		return err
+	}
+	if v.Conf.RetryENOENT {
+		if err = op(); err != syscall.ENOENT {
+			logger.Debugf("Inode %d is back after ENOENT: %s", ino, err)
+			deletedInodes.WithLabelValues("transient").Inc()
+			return err
+		}
+	}
+	if v.cache.invalidateInode(ino) {
+		logger.Debugf("Inode %d is deleted by other clients, drop it from cache", ino)
+		deletedInodes.WithLabelValues("deleted").Inc()
+	}
+	return err
+}
+
+// checkDeletedEntry calls the lookup op of an entry, and handles ENOENT as checkDeleted does.
+func (v *VFS) checkDeletedEntry(parent Ino, name string, op func() syscall.Errno) syscall.Errno {
+	err := op()
+	if err != syscall.ENOENT {
+		return err
+	}
+	if v.Conf.RetryENOENT {
+		if err = op(); err != syscall.ENOENT {
+			logger.Debugf("Entry (%d,%s) is back after ENOENT: %s", parent, name, err)
+			deletedInodes.WithLabelValues("transient").Inc()
+			return err
+		}
+	}
+	if ino := v.cache.invalidateEntry(parent, name); ino != 0 {
+		logger.Debugf("Entry (%d,%s) is deleted by other clients, drop it from cache", parent, name)
+		deletedInodes.WithLabelValues("deleted").Inc()
+	}
+	return err
+}
@@ -21,18 +21,32 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 )
 
+// the maximum number of threads to warm up cache in one request
+const maxFillThreads = 1000
+
 type _file struct {
-	ino  Ino
-	size uint64
+	ino   Ino
+	size  uint64
+	mtime time.Time
+	path  int // index of the path it belongs to
+}
+
+func newFile(inode Ino, attr *Attr, path int) _file {
+	return _file{inode, attr.Length, time.Unix(attr.Mtime, int64(attr.Mtimensec)), path}
 }
 
-func (v *VFS) fillCache(paths []string, concurrent int) {
+// fillCache warms up the files modified after the given time (zero for all) in the paths, and returns
+// the number of paths skipped because they are being deleted, the number of files modified before it,
+// the number of files failed to be warmed up, and the bytes warmed up for every path.
+func (v *VFS) fillCache(paths []string, concurrent int, after time.Time) (skipped, old, failed uint64, sizes []uint64) {
+	sizes = make([]uint64, len(paths))
 	logger.Infof("start to warmup %d paths with %d workers", len(paths), concurrent)
 	start := time.Now()
 	todo := make(chan _file, 10240)
@@ -45,9 +59,20 @@ func (v *VFS) fillCache(paths []string, concurrent int) {
 				if f.ino == 0 {
 					break
 				}
+				if !after.IsZero() && f.mtime.Before(after) {
+					atomic.AddUint64(&old, 1)
+					continue
+				}
+				if v.deleting(f.ino) {
+					logger.Debugf("Skip inode %d which is being deleted", f.ino)
+					continue
+				}
 				err := v.fillInode(f.ino, f.size)
 				if err != nil { // TODO: print path instead of inode
 					logger.Errorf("Inode %d could be corrupted: %s", f.ino, err)
+					atomic.AddUint64(&failed, 1)
+				} else {
+					atomic.AddUint64(&sizes[f.path], f.size)
 				}
 			}
 			wg.Done()
@@ -56,21 +81,350 @@ func (v *VFS) fillCache(paths []string, concurrent int) {
 
 	var inode Ino
 	var attr = &Attr{}
-	for _, p := range paths {
+	for i, p := range paths {
 		if st := v.resolve(p, &inode, attr); st != 0 {
 			logger.Warnf("Failed to resolve path %s: %s", p, st)
 			continue
 		}
+		if !IsSpecialNode(inode) && v.deleting(inode) {
+			logger.Debugf("Skip path %s which is being deleted", p)
+			skipped++
+			continue
+		}
 		logger.Debugf("Warming up path %s", p)
 		if attr.Typ == meta.TypeDirectory {
-			v.walkDir(inode, todo)
+			v.walkDir(inode, i, todo)
 		} else if attr.Typ == meta.TypeFile {
-			todo <- _file{inode, attr.Length}
+			todo <- newFile(inode, attr, i)
 		}
 	}
 	close(todo)
 	wg.Wait()
-	logger.Infof("Warmup %d paths in %s", len(paths), time.Since(start))
+	if after.IsZero() {
+		logger.Infof("Warmup %d paths in %s, skipped %d paths being deleted", len(paths), time.Since(start), skipped)
+	} else {
+		logger.Infof("Warmup %d paths in %s, skipped %d paths being deleted and %d files modified before %s",
+			len(paths), time.Since(start), skipped, old, after.Format(time.RFC3339))
+	}
+	if failed > 0 {
+		logger.Warnf("Failed to warm up %d files of %d paths", failed, len(paths))
+	}
+	return
+}
+
+// fillPhases is the number of files done in each phase of fillCachePhased.
+type fillPhases struct {
+	meta uint64 // the slices are read
+	data uint64 // the blocks are fetched into cache
+}
+
+type fileSlices struct {
+	_file
+	slices []meta.Slice
+}
+
+// fillCachePhased warms up the paths as fillCache does, but in two phases overlapped as a pipeline:
+// the metadata workers walk the directories in parallel and read the slices of the files, then the
+// data workers fetch the blocks of them, so the data workers are not blocked by the cold metadata.
+// A single file is warmed up by fillCache, which has nothing to overlap.
+func (v *VFS) fillCachePhased(paths []string, concurrent int, after time.Time) (skipped, old, failed uint64, sizes []uint64, phases fillPhases) {
+	var inode Ino
+	var attr = &Attr{}
+	if len(paths) == 1 && v.resolve(paths[0], &inode, attr) == 0 && attr.Typ == meta.TypeFile {
+		skipped, old, failed, sizes = v.fillCache(paths, concurrent, after)
+		return
+	}
+	sizes = make([]uint64, len(paths))
+	logger.Infof("start to warmup %d paths with %d workers in two phases", len(paths), concurrent)
+	start := time.Now()
+	todo := make(chan _file, 10240)
+	ready := make(chan fileSlices, 10240)
+	var metaUsed time.Duration
+	var metaWg, dataWg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		metaWg.Add(1)
+		go func() {
+			defer metaWg.Done()
+			for f := range todo {
+				if !after.IsZero() && f.mtime.Before(after) {
+					atomic.AddUint64(&old, 1)
+					continue
+				}
+				if v.deleting(f.ino) {
+					logger.Debugf("Skip inode %d which is being deleted", f.ino)
+					continue
+				}
+				slices, err := v.fileSlices(f.ino, f.size)
+				if err != nil {
+					logger.Errorf("Inode %d could be corrupted: %s", f.ino, err)
+					atomic.AddUint64(&failed, 1)
+					continue
+				}
+				atomic.AddUint64(&phases.meta, 1)
+				ready <- fileSlices{f, slices}
+			}
+		}()
+		dataWg.Add(1)
+		go func() {
+			defer dataWg.Done()
+			for f := range ready {
+				if err := v.fillSlices(f.ino, f.slices); err != nil {
+					logger.Errorf("Inode %d could be corrupted: %s", f.ino, err)
+					atomic.AddUint64(&failed, 1)
+				} else {
+					atomic.AddUint64(&sizes[f.path], f.size)
+					atomic.AddUint64(&phases.data, 1)
+				}
+			}
+		}()
+	}
+	go func() {
+		metaWg.Wait()
+		metaUsed = time.Since(start)
+		close(ready)
+	}()
+
+	for i, p := range paths {
+		if st := v.resolve(p, &inode, attr); st != 0 {
+			logger.Warnf("Failed to resolve path %s: %s", p, st)
+			continue
+		}
+		if !IsSpecialNode(inode) && v.deleting(inode) {
+			logger.Debugf("Skip path %s which is being deleted", p)
+			skipped++
+			continue
+		}
+		logger.Debugf("Warming up path %s", p)
+		if attr.Typ == meta.TypeDirectory {
+			v.walkDirs(inode, i, todo, concurrent)
+		} else if attr.Typ == meta.TypeFile {
+			todo <- newFile(inode, attr, i)
+		}
+	}
+	close(todo)
+	dataWg.Wait()
+	logger.Infof("Warmup %d paths in %s: prefetched the metadata of %d files in %s, fetched the data of %d files, skipped %d paths being deleted and %d old files",
+		len(paths), time.Since(start), phases.meta, metaUsed, phases.data, skipped, old)
+	if failed > 0 {
+		logger.Warnf("Failed to warm up %d files of %d paths", failed, len(paths))
+	}
+	return
+}
+
+// PinCache marks the blocks of the paths as non-evictable in cache, then warms them up in background.
+// It fails if the pinned blocks can't fit in the cache. Files created after it are not pinned.
+func (v *VFS) PinCache(paths []string, concurrent int) error {
+	start := time.Now()
+	todo := make(chan _file, 10240)
+	go func() {
+		var inode Ino
+		var attr = &Attr{}
+		for i, p := range paths {
+			if st := v.resolve(p, &inode, attr); st != 0 {
+				logger.Warnf("Failed to resolve path %s: %s", p, st)
+				continue
+			}
+			if attr.Typ == meta.TypeDirectory {
+				v.walkDir(inode, i, todo)
+			} else if attr.Typ == meta.TypeFile {
+				todo <- newFile(inode, attr, i)
+			}
+		}
+		close(todo)
+	}()
+	var err error
+	var files int
+	for f := range todo {
+		if err != nil {
+			continue // drain
+		}
+		err = v.pinInode(f.ino, f.size)
+		files++
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("Pinned %d files of %d paths in cache in %s", files, len(paths), time.Since(start))
+	go v.fillCache(paths, concurrent, time.Time{})
+	return nil
+}
+
+func (v *VFS) pinInode(inode Ino, size uint64) error {
+	var slices []meta.Slice
+	for indx := uint64(0); indx*meta.ChunkSize < size; indx++ {
+		if st := v.Meta.Read(meta.Background, inode, uint32(indx), &slices); st != 0 {
+			return fmt.Errorf("Failed to get slices of inode %d index %d: %d", inode, indx, st)
+		}
+		for _, s := range slices {
+			if s.Chunkid == 0 {
+				continue
+			}
+			if err := v.Store.PinCache(s.Chunkid, s.Size); err != nil {
+				return fmt.Errorf("Failed to pin inode %d slice %d: %s", inode, s.Chunkid, err)
+			}
+		}
+	}
+	return nil
+}
+
+// noCacheXattr marks a directory whose files (in the whole subtree) bypass the cache.
+const noCacheXattr = "user.jfs.no-cache"
+
+// bypassTTL is how long the result of checking a directory is kept.
+const bypassTTL = time.Minute
+
+type bypassResult struct {
+	nocache bool
+	expire  time.Time
+}
+
+type bypassDirs struct {
+	sync.Mutex
+	dirs    map[Ino]bool // specified when mounting
+	checked map[Ino]bypassResult
+}
+
+// BypassCache makes the files under the directories in paths read from and written into
+// the object storage directly, without touching the cache.
+func (v *VFS) BypassCache(paths []string) {
+	var inode Ino
+	var attr = &Attr{}
+	v.bypass.Lock()
+	defer v.bypass.Unlock()
+	if v.bypass.dirs == nil {
+		v.bypass.dirs = make(map[Ino]bool)
+	}
+	for _, p := range paths {
+		if st := v.resolve(p, &inode, attr); st != 0 {
+			logger.Warnf("Failed to resolve path %s: %s", p, st)
+			continue
+		}
+		if attr.Typ != meta.TypeDirectory {
+			logger.Warnf("%s is not a directory, ignore it", p)
+			continue
+		}
+		v.bypass.dirs[inode] = true
+	}
+	v.bypass.checked = nil
+}
+
+func (v *VFS) resetBypass() {
+	v.bypass.Lock()
+	v.bypass.checked = nil
+	v.bypass.Unlock()
+}
+
+// bypassCache checks whether the files in directory parent should bypass the cache, which is true
+// if any of its ancestors was specified when mounting or has the xattr noCacheXattr.
+func (v *VFS) bypassCache(parent Ino) bool {
+	now := time.Now()
+	var visited []Ino
+	var nocache bool
+	for parent > 0 && parent < trashInode {
+		v.bypass.Lock()
+		r, ok := v.bypass.checked[parent]
+		specified := v.bypass.dirs[parent]
+		v.bypass.Unlock()
+		if ok && now.Before(r.expire) {
+			nocache = r.nocache
+			break
+		}
+		visited = append(visited, parent)
+		var value []byte
+		if specified || v.Meta.GetXattr(meta.Background, parent, noCacheXattr, &value) == 0 {
+			nocache = true
+			break
+		}
+		var attr Attr
+		if parent == rootID || v.Meta.GetAttr(meta.Background, parent, &attr) != 0 || attr.Parent == parent {
+			break
+		}
+		parent = attr.Parent
+	}
+	v.bypass.Lock()
+	if v.bypass.checked == nil || len(v.bypass.checked) > 100000 {
+		v.bypass.checked = make(map[Ino]bypassResult)
+	}
+	for _, ino := range visited {
+		v.bypass.checked[ino] = bypassResult{nocache, now.Add(bypassTTL)}
+	}
+	v.bypass.Unlock()
+	return nocache
+}
+
+// deleting checks whether the file is removed (but still opened) or moved into trash,
+// its data is going to be deleted soon, so it's not worth to be cached.
+func (v *VFS) deleting(inode Ino) bool {
+	var attr Attr
+	if st := v.Meta.GetAttr(meta.Background, inode, &attr); st != 0 {
+		return st == syscall.ENOENT
+	}
+	return attr.Nlink == 0 || attr.Parent >= trashInode
+}
+
+// workingSet returns the total length of files in the paths, the files with multiple hard links or
+// in overlapped paths could be counted more than once.
+func (v *VFS) workingSet(paths []string) uint64 {
+	var size uint64
+	var inode Ino
+	var attr = &Attr{}
+	for _, p := range paths {
+		if st := v.resolve(p, &inode, attr); st != 0 {
+			logger.Warnf("Failed to resolve path %s: %s", p, st)
+			continue
+		}
+		var summary meta.Summary
+		if st := meta.GetSummary(v.Meta, meta.Background, inode, &summary, true); st != 0 {
+			logger.Warnf("Failed to get summary of %s: %s", p, st)
+		}
+		size += summary.Length
+	}
+	return size
+}
+
+// checkCache returns the bytes in cache and the total bytes of the files in every path, which are
+// counted by the blocks of slices, so the holes are not counted and the overwritten data could be.
+// The paths failed to be resolved have nothing in it.
+func (v *VFS) checkCache(paths []string, concurrent int) (cached, total []uint64) {
+	cached, total = make([]uint64, len(paths)), make([]uint64, len(paths))
+	todo := make(chan _file, 10240)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range todo {
+				slices, err := v.fileSlices(f.ino, f.size)
+				if err != nil {
+					logger.Warnf("Check cache of inode %d: %s", f.ino, err)
+					continue
+				}
+				for _, s := range slices {
+					if s.Chunkid == 0 {
+						continue
+					}
+					atomic.AddUint64(&total[f.path], uint64(s.Size))
+					atomic.AddUint64(&cached[f.path], v.Store.CheckCache(s.Chunkid, s.Size))
+				}
+			}
+		}()
+	}
+	var inode Ino
+	var attr = &Attr{}
+	for i, p := range paths {
+		if st := v.resolve(p, &inode, attr); st != 0 {
+			logger.Warnf("Failed to resolve path %s: %s", p, st)
+			continue
+		}
+		if attr.Typ == meta.TypeDirectory {
+			v.walkDir(inode, i, todo)
+		} else if attr.Typ == meta.TypeFile {
+			todo <- newFile(inode, attr, i)
+		}
+	}
+	close(todo)
+	wg.Wait()
+	return
 }
 
 func (v *VFS) resolve(p string, inode *Ino, attr *Attr) syscall.Errno {
@@ -127,7 +481,60 @@ func (v *VFS) resolve(p string, inode *Ino, attr *Attr) syscall.Errno {
 	return 0
 }
 
-func (v *VFS) walkDir(inode Ino, todo chan _file) {
+// walkDirs walks a directory as walkDir does, with up to concurrent directories read at the same time.
+func (v *VFS) walkDirs(inode Ino, path int, todo chan _file, concurrent int) {
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	pending := []Ino{inode}
+	var reading int
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(pending) == 0 && reading > 0 {
+					cond.Wait()
+				}
+				if len(pending) == 0 {
+					mu.Unlock()
+					return
+				}
+				dir := pending[len(pending)-1]
+				pending = pending[:len(pending)-1]
+				reading++
+				mu.Unlock()
+
+				var subdirs []Ino
+				var entries []*meta.Entry
+				if r := v.Meta.Readdir(meta.Background, dir, 1, &entries); r != 0 {
+					logger.Warnf("readdir %d: %s", dir, r)
+				}
+				for _, f := range entries {
+					name := string(f.Name)
+					if name == "." || name == ".." {
+						continue
+					}
+					if f.Attr.Typ == meta.TypeDirectory {
+						subdirs = append(subdirs, f.Inode)
+					} else if f.Attr.Typ != meta.TypeSymlink {
+						todo <- newFile(f.Inode, f.Attr, path)
+					}
+				}
+
+				mu.Lock()
+				pending = append(pending, subdirs...)
+				reading--
+				mu.Unlock()
+				cond.Broadcast()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (v *VFS) walkDir(inode Ino, path int, todo chan _file) {
 	pending := make([]Ino, 1)
 	pending[0] = inode
 	for len(pending) > 0 {
@@ -146,7 +553,7 @@ func (v *VFS) walkDir(inode Ino, todo chan _file) {
 				if f.Attr.Typ == meta.TypeDirectory {
 					pending = append(pending, f.Inode)
 				} else if f.Attr.Typ != meta.TypeSymlink {
-					todo <- _file{f.Inode, f.Attr.Length}
+					todo <- newFile(f.Inode, f.Attr, path)
 				}
 			}
 		} else {
@@ -156,16 +563,148 @@ func (v *VFS) walkDir(inode Ino, todo chan _file) {
 }
 
 func (v *VFS) fillInode(inode Ino, size uint64) error {
-	var slices []meta.Slice
+	slices, err := v.fileSlices(inode, size)
+	if err != nil {
+		return err
+	}
+	return v.fillSlices(inode, slices)
+}
+
+// fileSlices reads the slices of all the chunks of a file.
+func (v *VFS) fileSlices(inode Ino, size uint64) ([]meta.Slice, error) {
+	var all, slices []meta.Slice
 	for indx := uint64(0); indx*meta.ChunkSize < size; indx++ {
 		if st := v.Meta.Read(meta.Background, inode, uint32(indx), &slices); st != 0 {
-			return fmt.Errorf("Failed to get slices of inode %d index %d: %d", inode, indx, st)
+			return nil, fmt.Errorf("Failed to get slices of inode %d index %d: %d", inode, indx, st)
 		}
-		for _, s := range slices {
-			if err := v.Store.FillCache(s.Chunkid, s.Size); err != nil {
-				return fmt.Errorf("Failed to cache inode %d slice %d: %s", inode, s.Chunkid, err)
-			}
+		all = append(all, slices...)
+	}
+	return all, nil
+}
+
+func (v *VFS) fillSlices(inode Ino, slices []meta.Slice) error {
+	for _, s := range slices {
+		if err := v.Store.FillCache(s.Chunkid, s.Size); err != nil {
+			return fmt.Errorf("Failed to cache inode %d slice %d: %s", inode, s.Chunkid, err)
 		}
 	}
 	return nil
 }
+
+// fillAttrCache loads the attributes and entries under the paths (recursively) into the inode cache,
+// so the first lookup and getattr of them are served without meta. It stops once the cache is full,
+// and returns the number of inodes loaded and whether the cache is full. The missing paths are skipped.
+func (v *VFS) fillAttrCache(ctx Context, paths []string) (loaded uint64, full bool, st syscall.Errno) {
+	if v.cache == nil || v.cache.ttl <= 0 {
+		return 0, false, syscall.ENOTSUP
+	}
+	var dirs []Ino
+	for _, p := range paths {
+		// the entry of the path is loaded as well, so it's looked up in the parent
+		p = strings.Trim(p, "/")
+		inode, parent := Ino(1), Ino(0)
+		var attr Attr
+		gen := v.cache.generation()
+		if p == "" {
+			st = v.Meta.GetAttr(ctx, inode, &attr)
+		} else {
+			parent = 1
+			if i := strings.LastIndex(p, "/"); i > 0 {
+				st = v.resolve(p[:i], &parent, &attr)
+			}
+			if st == 0 {
+				st = v.Meta.Lookup(ctx, parent, path.Base(p), &inode, &attr)
+			}
+		}
+		if st != 0 {
+			logger.Warnf("Failed to resolve path /%s: %s", p, st)
+			st = 0
+			continue
+		}
+		if parent != 0 {
+			v.cache.putEntry(gen, parent, path.Base(p), inode, &attr)
+		} else {
+			v.cache.putAttr(gen, inode, &attr)
+		}
+		loaded++
+		if attr.Typ == meta.TypeDirectory {
+			dirs = append(dirs, inode)
+		}
+	}
+	for len(dirs) > 0 {
+		if ctx.Canceled() {
+			return loaded, false, syscall.EINTR
+		}
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		var entries []*meta.Entry
+		gen := v.cache.generation()
+		if st := v.Meta.Readdir(ctx, dir, 1, &entries); st != 0 {
+			logger.Warnf("Failed to read directory %d: %s", dir, st)
+			continue
+		}
+		for _, e := range entries {
+			name := string(e.Name)
+			if name == "." || name == ".." {
+				continue
+			}
+			if 2*(loaded+1) > uint64(v.cache.size) { // an entry and its attributes are two items
+				return loaded, true, 0
+			}
+			v.cache.putEntry(gen, dir, name, e.Inode, e.Attr)
+			loaded++
+			if e.Attr.Typ == meta.TypeDirectory {
+				dirs = append(dirs, e.Inode)
+			}
+		}
+	}
+	return loaded, false, 0
+}
+
+// fillParents loads the entries along the paths, from the root down to the paths themselves, into
+// the inode cache, so a reader walking down to them doesn't look up any of them in meta. The entries
+// shared by the paths are looked up once, and it returns the number of them loaded. It stops once
+// the cache is full, and the paths which can't be resolved are skipped.
+func (v *VFS) fillParents(ctx Context, paths []string) (loaded uint64, st syscall.Errno) {
+	if v.cache == nil || v.cache.ttl <= 0 {
+		return 0, syscall.ENOTSUP
+	}
+	resolved := make(map[string]Ino)
+	for _, p := range paths {
+		if ctx.Canceled() {
+			return loaded, syscall.EINTR
+		}
+		p = strings.Trim(p, "/")
+		if p == "" {
+			continue
+		}
+		parent := Ino(1)
+		names := strings.Split(p, "/")
+		for i, name := range names {
+			prefix := strings.Join(names[:i+1], "/")
+			if ino, ok := resolved[prefix]; ok {
+				parent = ino
+				continue
+			}
+			if 2*(loaded+1) > uint64(v.cache.size) { // an entry and its attributes are two items
+				logger.Warnf("The inode cache is full after %d entries loaded", loaded)
+				return loaded, 0
+			}
+			var inode Ino
+			var attr Attr
+			gen := v.cache.generation()
+			if st := v.Meta.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+				logger.Warnf("Failed to look up /%s: %s", prefix, st)
+				break
+			}
+			v.cache.putEntry(gen, parent, name, inode, &attr)
+			loaded++
+			resolved[prefix] = inode
+			if attr.Typ != meta.TypeDirectory {
+				break
+			}
+			parent = inode
+		}
+	}
+	return loaded, 0
+}
@@ -17,10 +17,17 @@
 package vfs
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 func TestFill(t *testing.T) {
@@ -36,7 +43,53 @@ func TestFill(t *testing.T) {
 	_, _ = v.Symlink(ctx, "testfile", 1, "sym3")
 
 	// normal cases
-	v.fillCache([]string{"/test/file", "/test", "/sym", "/"}, 2)
+	skipped, _, failed, sizes := v.fillCache([]string{"/test/file", "/test", "/sym", "/"}, 2, time.Time{})
+	if skipped != 0 || failed != 0 {
+		t.Fatalf("expect 0 skipped paths and 0 failed files, but got %d and %d", skipped, failed)
+	}
+	if !reflect.DeepEqual(sizes, []uint64{5, 5, 5, 5}) {
+		t.Fatalf("expect 5 bytes for every path, but got %v", sizes)
+	}
+	// incremental
+	if _, old, _, _ := v.fillCache([]string{"/test", "/sym"}, 2, time.Now().Add(-time.Hour)); old != 0 {
+		t.Fatalf("expect 0 old files, but got %d", old)
+	}
+	if _, old, _, sizes := v.fillCache([]string{"/test", "/sym"}, 2, time.Now().Add(time.Hour)); old != 2 || sizes[0]+sizes[1] != 0 {
+		t.Fatalf("expect 2 old files and nothing warmed up, but got %d and %v", old, sizes)
+	}
+	// the sizes are reported to the client only if it asks for it
+	paths := "/test\n/not_exists"
+	w := utils.NewBuffer(4 + uint32(len(paths)) + 2 + 1 + 1)
+	w.Put32(uint32(len(paths)))
+	w.Put([]byte(paths))
+	w.Put16(1)
+	w.Put8(0)
+	w.Put8(meta.FillCacheStats | meta.FillCacheThreads | meta.FillCacheSizes)
+	resp := v.handleInternalMsg(ctx, meta.FillCache, utils.ReadBuffer(w.Bytes()))
+	r := utils.ReadBuffer(resp)
+	if st := r.Get8(); st != meta.FillCacheOK || len(resp) != 1+8+2+4+16 {
+		t.Fatalf("expect status 0 with %d bytes, but got %d with %d bytes", 1+8+2+4+16, st, len(resp))
+	}
+	_, _ = r.Get64(), r.Get16()
+	if n, s1, s2 := r.Get32(), r.Get64(), r.Get64(); n != 2 || s1 != 5 || s2 != 0 {
+		t.Fatalf("expect sizes [5 0], but got %d paths: %d %d", n, s1, s2)
+	}
+
+	// the coverage of cache
+	paths = "/test/file\n/\n/not_exists"
+	w = utils.NewBuffer(4 + uint32(len(paths)) + 2)
+	w.Put32(uint32(len(paths)))
+	w.Put([]byte(paths))
+	w.Put16(2)
+	r = utils.ReadBuffer(v.handleInternalMsg(ctx, meta.CheckCache, utils.ReadBuffer(w.Bytes())))
+	if st, n := r.Get8(), r.Get32(); st != 0 || n != 3 {
+		t.Fatalf("expect status 0 with 3 paths, but got %d with %d paths", st, n)
+	}
+	for i, expected := range []uint64{5, 5, 0} {
+		if cached, total := r.Get64(), r.Get64(); cached != expected || total != expected {
+			t.Fatalf("expect %d bytes of path %d in cache, but got %d of %d", expected, i, cached, total)
+		}
+	}
 
 	// remove chunk
 	var slices []meta.Slice
@@ -45,5 +98,264 @@ func TestFill(t *testing.T) {
 		_ = v.Store.Remove(s.Chunkid, int(s.Size))
 	}
 	// bad cases
-	v.fillCache([]string{"/test/file", "/sym2", "/sym3", "/.stats", "/not_exists"}, 2)
+	if _, _, failed, _ := v.fillCache([]string{"/test/file", "/sym2", "/sym3", "/.stats", "/not_exists"}, 2, time.Time{}); failed != 1 {
+		t.Fatalf("expect 1 failed file, but got %d", failed)
+	}
+	// the failure is reported to the client only if it asks for it
+	for _, flags := range []uint8{meta.FillCacheStats, meta.FillCacheStats | meta.FillCacheErrors} {
+		w := utils.NewBuffer(4 + 10 + 2 + 1 + 1)
+		w.Put32(10)
+		w.Put([]byte("/test/file"))
+		w.Put16(1)
+		w.Put8(0)
+		w.Put8(flags)
+		resp := v.handleInternalMsg(ctx, meta.FillCache, utils.ReadBuffer(w.Bytes()))
+		expected := uint8(meta.FillCacheOK)
+		if flags&meta.FillCacheErrors != 0 {
+			expected = meta.FillCacheAgain
+		}
+		if resp[0] != expected {
+			t.Fatalf("expect status %d with flags %d, but got %d", expected, flags, resp[0])
+		}
+	}
+}
+
+func TestFillDeleting(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, _ := v.Create(ctx, 1, "deleting", 0644, 0, uint32(os.O_WRONLY))
+	_ = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh)
+	_ = v.Flush(ctx, fe.Inode, fh, 0)
+	if v.deleting(fe.Inode) {
+		t.Fatalf("file %d should not be deleting", fe.Inode)
+	}
+	// removed but still opened
+	if st := v.Unlink(ctx, 1, "deleting"); st != 0 {
+		t.Fatalf("unlink: %s", st)
+	}
+	if !v.deleting(fe.Inode) {
+		t.Fatalf("file %d should be deleting", fe.Inode)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if !v.deleting(fe.Inode) {
+		t.Fatalf("file %d should be deleted", fe.Inode)
+	}
+}
+
+func TestFillPhased(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	write := func(parent Ino, name string, data string) {
+		fe, fh, st := v.Create(ctx, parent, name, 0644, 0, uint32(os.O_WRONLY))
+		if st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		_ = v.Write(ctx, fe.Inode, []byte(data), 0, fh)
+		_ = v.Flush(ctx, fe.Inode, fh, 0)
+		v.Release(ctx, fe.Inode, fh)
+	}
+	top, _ := v.Mkdir(ctx, 1, "tree", 0777, 022)
+	for i := 0; i < 3; i++ {
+		sub, _ := v.Mkdir(ctx, top.Inode, fmt.Sprintf("d%d", i), 0777, 022)
+		deep, _ := v.Mkdir(ctx, sub.Inode, "deep", 0777, 022)
+		write(sub.Inode, "a", "hello")
+		write(deep.Inode, "b", "world!")
+	}
+	write(top.Inode, "c", "!")
+
+	skipped, old, failed, sizes, phases := v.fillCachePhased([]string{"/tree", "/tree/d0", "/not_exists"}, 4, time.Time{})
+	if skipped != 0 || old != 0 || failed != 0 {
+		t.Fatalf("expect nothing skipped or failed, but got %d %d %d", skipped, old, failed)
+	}
+	if !reflect.DeepEqual(sizes, []uint64{34, 11, 0}) {
+		t.Fatalf("expect sizes [34 11 0], but got %v", sizes)
+	}
+	if phases.meta != 9 || phases.data != 9 {
+		t.Fatalf("expect 9 files in both phases, but got %+v", phases)
+	}
+	if _, old, _, _, phases := v.fillCachePhased([]string{"/tree"}, 2, time.Now().Add(time.Hour)); old != 7 || phases.meta != 0 {
+		t.Fatalf("expect 7 old files and nothing prefetched, but got %d and %+v", old, phases)
+	}
+	// a single file is warmed up in one phase
+	if _, _, _, sizes, phases := v.fillCachePhased([]string{"/tree/c"}, 2, time.Time{}); sizes[0] != 1 || phases.meta != 0 {
+		t.Fatalf("expect 1 byte warmed up in one phase, but got %v and %+v", sizes, phases)
+	}
+
+	paths := "/tree/d1\n/tree/c"
+	w := utils.NewBuffer(4 + uint32(len(paths)) + 2 + 1 + 1)
+	w.Put32(uint32(len(paths)))
+	w.Put([]byte(paths))
+	w.Put16(2)
+	w.Put8(0)
+	w.Put8(meta.FillCacheStats | meta.FillCacheSizes | meta.FillCachePhased)
+	resp := v.handleInternalMsg(ctx, meta.FillCache, utils.ReadBuffer(w.Bytes()))
+	if len(resp) != 1+8+4+16+16 {
+		t.Fatalf("expect %d bytes, but got %d", 1+8+4+16+16, len(resp))
+	}
+	r := utils.ReadBuffer(resp)
+	_, _ = r.Get8(), r.Get64()
+	if n, s1, s2 := r.Get32(), r.Get64(), r.Get64(); n != 2 || s1 != 11 || s2 != 1 {
+		t.Fatalf("expect sizes [11 1], but got %d paths: %d %d", n, s1, s2)
+	}
+	if m, d := r.Get64(), r.Get64(); m != 3 || d != 3 {
+		t.Fatalf("expect 3 files in both phases, but got %d and %d", m, d)
+	}
+}
+
+// countingMeta counts the calls to fetch the attributes and entries from meta.
+type countingMeta struct {
+	meta.Meta
+	calls int32
+}
+
+func (m *countingMeta) GetAttr(ctx meta.Context, inode Ino, attr *Attr) syscall.Errno {
+	atomic.AddInt32(&m.calls, 1)
+	return m.Meta.GetAttr(ctx, inode, attr)
+}
+
+func (m *countingMeta) Lookup(ctx meta.Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	atomic.AddInt32(&m.calls, 1)
+	return m.Meta.Lookup(ctx, parent, name, inode, attr)
+}
+
+func TestFillAttrCache(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	sendPaths := func(paths string) []byte {
+		w := utils.NewBuffer(4 + uint32(len(paths)))
+		w.Put32(uint32(len(paths)))
+		w.Put([]byte(paths))
+		return v.handleInternalMsg(ctx, meta.FillAttrCache, utils.ReadBuffer(w.Bytes()))
+	}
+	if resp := sendPaths("/"); len(resp) != 1 || resp[0] != uint8(syscall.ENOTSUP) {
+		t.Fatalf("expect ENOTSUP without inode cache, but got %v", resp)
+	}
+
+	v.cache = newInodeCache(100, time.Minute)
+	paths := []string{"tree", "tree/d1", "tree/d1/f1", "tree/d1/d2", "tree/d1/d2/f2", "tree/f3"}
+	for _, p := range paths {
+		parent, name := Ino(1), p
+		if i := strings.LastIndex(p, "/"); i > 0 {
+			var attr Attr
+			_ = v.resolve(p[:i], &parent, &attr)
+			name = p[i+1:]
+		}
+		if strings.HasPrefix(name, "f") {
+			fe, fh, e := v.Create(ctx, parent, name, 0644, 0, uint32(os.O_WRONLY))
+			if e != 0 {
+				t.Fatalf("create %s: %s", p, e)
+			}
+			v.Release(ctx, fe.Inode, fh)
+		} else if _, e := v.Mkdir(ctx, parent, name, 0755, 0); e != 0 {
+			t.Fatalf("mkdir %s: %s", p, e)
+		}
+	}
+	m := &countingMeta{Meta: v.Meta}
+	v.Meta = m
+	// stat all the paths as `find tree -ls` does
+	statAll := func() int32 {
+		atomic.StoreInt32(&m.calls, 0)
+		for _, p := range paths {
+			parent := Ino(1)
+			for _, name := range strings.Split(p, "/") {
+				entry, e := v.Lookup(ctx, parent, name)
+				if e != 0 {
+					t.Fatalf("lookup %s in %s: %s", name, p, e)
+				}
+				parent = entry.Inode
+			}
+			if _, e := v.GetAttr(ctx, parent, 0); e != 0 {
+				t.Fatalf("getattr %s: %s", p, e)
+			}
+		}
+		return atomic.LoadInt32(&m.calls)
+	}
+	v.cache.clear()
+	if n := statAll(); n == 0 {
+		t.Fatalf("the cold stats should go to meta")
+	}
+
+	v.cache.clear()
+	resp := sendPaths("/tree\n/missing")
+	r := utils.ReadBuffer(resp)
+	if st, loaded, full := r.Get8(), r.Get64(), r.Get8(); st != 0 || loaded != uint64(len(paths)) || full != 0 {
+		t.Fatalf("expect %d inodes loaded, but got %d (status %d, full %d)", len(paths), loaded, st, full)
+	}
+	if n := statAll(); n != 0 {
+		t.Fatalf("expect no meta calls after loading the attributes, but got %d", n)
+	}
+
+	// stop once the cache is full
+	v.cache = newInodeCache(6, time.Minute)
+	r = utils.ReadBuffer(sendPaths("/tree"))
+	if st, loaded, full := r.Get8(), r.Get64(), r.Get8(); st != 0 || loaded != 3 || full != 1 {
+		t.Fatalf("expect 3 inodes loaded into a full cache, but got %d (status %d, full %d)", loaded, st, full)
+	}
+}
+
+func TestFillParents(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	sendPaths := func(paths string) []byte {
+		w := utils.NewBuffer(4 + uint32(len(paths)))
+		w.Put32(uint32(len(paths)))
+		w.Put([]byte(paths))
+		return v.handleInternalMsg(ctx, meta.FillParents, utils.ReadBuffer(w.Bytes()))
+	}
+	if resp := sendPaths("/a"); len(resp) != 1 || resp[0] != uint8(syscall.ENOTSUP) {
+		t.Fatalf("expect ENOTSUP without inode cache, but got %v", resp)
+	}
+
+	v.cache = newInodeCache(100, time.Minute)
+	parent := Ino(1)
+	for _, name := range []string{"p1", "p2", "p3"} {
+		entry, e := v.Mkdir(ctx, parent, name, 0755, 0)
+		if e != 0 {
+			t.Fatalf("mkdir %s: %s", name, e)
+		}
+		parent = entry.Inode
+	}
+	for _, name := range []string{"f1", "f2"} {
+		fe, fh, e := v.Create(ctx, parent, name, 0644, 0, uint32(os.O_WRONLY))
+		if e != 0 {
+			t.Fatalf("create %s: %s", name, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+	m := &countingMeta{Meta: v.Meta}
+	v.Meta = m
+	lookupAll := func(p string) int32 {
+		atomic.StoreInt32(&m.calls, 0)
+		parent := Ino(1)
+		for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+			entry, e := v.Lookup(ctx, parent, name)
+			if e != 0 {
+				t.Fatalf("lookup %s in %s: %s", name, p, e)
+			}
+			parent = entry.Inode
+		}
+		return atomic.LoadInt32(&m.calls)
+	}
+
+	v.cache.clear()
+	// the shared parents are looked up once, and the missing paths are skipped
+	r := utils.ReadBuffer(sendPaths("/p1/p2/p3/f1\n/p1/p2/p3/f2\n/p1/missing/f3"))
+	if st, loaded := r.Get8(), r.Get64(); st != 0 || loaded != 5 {
+		t.Fatalf("expect 5 entries loaded, but got %d (status %d)", loaded, st)
+	}
+	if n := m.calls; n != 6 {
+		t.Fatalf("expect 6 lookups in meta, but got %d", n)
+	}
+	for _, p := range []string{"/p1/p2/p3/f1", "/p1/p2/p3/f2"} {
+		if n := lookupAll(p); n != 0 {
+			t.Fatalf("expect no meta calls to look up %s, but got %d", p, n)
+		}
+	}
+
+	// stop once the cache is full
+	v.cache = newInodeCache(4, time.Minute)
+	r = utils.ReadBuffer(sendPaths("/p1/p2/p3/f1"))
+	if st, loaded := r.Get8(), r.Get64(); st != 0 || loaded != 2 {
+		t.Fatalf("expect 2 entries loaded into a full cache, but got %d (status %d)", loaded, st)
+	}
 }
@@ -32,6 +32,9 @@ type handle struct {
 
 	// for dir
 	children []*meta.Entry
+	dirOff   int    // offset of the first one in children, which is the current page
+	dirNext  string // cursor of the next page, empty at the end
+	dirPlus  uint8
 
 	// for file
 	locks      uint8
@@ -39,6 +42,7 @@ type handle struct {
 	reader     FileReader
 	writer     FileWriter
 	ops        []Context
+	accessed   uint32 // atime is updated
 
 	// rwlock
 	writing uint32
@@ -85,13 +89,16 @@ func (h *handle) cancelOp(pid uint32) {
 
 func (h *handle) Rlock(ctx Context) bool {
 	h.Lock()
+	done := waitOn(ctx, waitLock)
 	for (h.writing | h.writers) != 0 {
 		if h.cond.WaitWithTimeout(time.Second) && ctx.Canceled() {
 			h.Unlock()
+			done()
 			logger.Warnf("read lock %d interrupted", h.inode)
 			return false
 		}
 	}
+	done()
 	h.readers++
 	h.Unlock()
 	h.addOp(ctx)
@@ -110,14 +117,17 @@ func (h *handle) Runlock() {
 func (h *handle) Wlock(ctx Context) bool {
 	h.Lock()
 	h.writers++
+	done := waitOn(ctx, waitLock)
 	for (h.readers | h.writing) != 0 {
 		if h.cond.WaitWithTimeout(time.Second) && ctx.Canceled() {
 			h.writers--
 			h.Unlock()
+			done()
 			logger.Warnf("write lock %d interrupted", h.inode)
 			return false
 		}
 	}
+	done()
 	h.writers--
 	h.writing = 1
 	h.Unlock()
@@ -190,18 +200,22 @@ func (v *VFS) releaseHandle(inode Ino, fh uint64) {
 	}
 }
 
-func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
+func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32, nocache bool) uint64 {
 	h := v.newHandle(inode)
 	h.Lock()
 	defer h.Unlock()
 	switch flags & O_ACCMODE {
 	case syscall.O_RDONLY:
-		h.reader = v.reader.Open(inode, length)
+		if v.Conf.ReadSemantics == ReadSnapshot {
+			h.reader = v.reader.OpenSnapshot(inode, length, nocache)
+		} else {
+			h.reader = v.reader.Open(inode, length, nocache)
+		}
 	case syscall.O_WRONLY: // FUSE writeback_cache mode need reader even for WRONLY
 		fallthrough
 	case syscall.O_RDWR:
-		h.reader = v.reader.Open(inode, length)
-		h.writer = v.writer.Open(inode, length)
+		h.reader = v.reader.Open(inode, length, nocache)
+		h.writer = v.writer.Open(inode, length, nocache)
 	}
 	return h.fh
 }
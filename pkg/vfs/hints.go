@@ -0,0 +1,152 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// writeHintsXattr sets the hints for the files in the subtree of a directory, the nearest one
+// wins, e.g. "write-combine=10s,write-combine-size=64,compact-slices=20".
+const writeHintsXattr = "user.jfs.write-hints"
+
+// writeHints overrides the options of mount for the slices of some files, zero means the one of
+// mount is used.
+type writeHints struct {
+	combineWindow time.Duration // negative means write combining is disabled
+	combineSize   int
+	compactSlices int
+	compactBytes  uint64
+}
+
+// parseWriteHints parses the value of writeHintsXattr, the sizes are in MiB.
+func parseWriteHints(value string) (*writeHints, error) {
+	var h writeHints
+	for _, kv := range strings.Split(value, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		ps := strings.SplitN(kv, "=", 2)
+		if len(ps) != 2 {
+			return nil, fmt.Errorf("invalid hint: %s", kv)
+		}
+		k, v := strings.TrimSpace(ps[0]), strings.TrimSpace(ps[1])
+		if k == "write-combine" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %s", k, v)
+			}
+			if d <= 0 {
+				d = -1
+			}
+			h.combineWindow = d
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid value of %s: %s", k, v)
+		}
+		switch k {
+		case "write-combine-size":
+			h.combineSize = n << 20
+		case "compact-slices":
+			h.compactSlices = n
+		case "compact-size":
+			h.compactBytes = uint64(n) << 20
+		default:
+			return nil, fmt.Errorf("unknown hint: %s", k)
+		}
+	}
+	return &h, nil
+}
+
+type hintsResult struct {
+	hints  *writeHints
+	expire time.Time
+}
+
+type hintDirs struct {
+	sync.Mutex
+	checked map[Ino]hintsResult
+}
+
+func (v *VFS) resetWriteHints() {
+	v.hints.Lock()
+	v.hints.checked = nil
+	v.hints.Unlock()
+}
+
+// writeHints returns the hints for the files in directory parent, which are set on the nearest
+// ancestor with writeHintsXattr, nil if there is none.
+func (v *VFS) writeHints(parent Ino) *writeHints {
+	now := time.Now()
+	var visited []Ino
+	var hints *writeHints
+	for parent > 0 && parent < trashInode {
+		v.hints.Lock()
+		r, ok := v.hints.checked[parent]
+		v.hints.Unlock()
+		if ok && now.Before(r.expire) {
+			hints = r.hints
+			break
+		}
+		visited = append(visited, parent)
+		var value []byte
+		if v.Meta.GetXattr(meta.Background, parent, writeHintsXattr, &value) == 0 {
+			var err error
+			if hints, err = parseWriteHints(string(value)); err != nil {
+				logger.Warnf("Ignore %s of directory %d: %s", writeHintsXattr, parent, err)
+			}
+			break
+		}
+		var attr Attr
+		if parent == rootID || v.Meta.GetAttr(meta.Background, parent, &attr) != 0 || attr.Parent == parent {
+			break
+		}
+		parent = attr.Parent
+	}
+	v.hints.Lock()
+	if v.hints.checked == nil || len(v.hints.checked) > 100000 {
+		v.hints.checked = make(map[Ino]hintsResult)
+	}
+	for _, ino := range visited {
+		v.hints.checked[ino] = hintsResult{hints, now.Add(bypassTTL)}
+	}
+	v.hints.Unlock()
+	return hints
+}
+
+// applyWriteHints applies the hints of directory parent to the opened file inode.
+func (v *VFS) applyWriteHints(inode, parent Ino, fh uint64) {
+	hints := v.writeHints(parent)
+	if hints == nil {
+		return
+	}
+	if hints.compactSlices > 0 || hints.compactBytes > 0 {
+		v.Meta.SetCompactHint(inode, hints.compactSlices, hints.compactBytes)
+	}
+	if h := v.findHandle(inode, fh); h != nil && h.writer != nil && (hints.combineWindow != 0 || hints.combineSize > 0) {
+		h.writer.SetCombine(hints.combineWindow, hints.combineSize)
+	}
+}
@@ -0,0 +1,306 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	inodeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inode_cache_hits",
+		Help: "The number of lookup/getattr served by the inode cache.",
+	})
+	inodeCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inode_cache_misses",
+		Help: "The number of lookup/getattr missed in the inode cache.",
+	})
+)
+
+type cacheItem struct {
+	ino    Ino
+	parent Ino // non-zero for entries
+	name   string
+	attr   Attr
+	expire time.Time
+}
+
+// inodeCache is a LRU cache of attributes (by inode) and entries (by parent and name),
+// shared by all the handles in this client. Every invalidation bumps the generation,
+// so that an attribute fetched before a local change will not be put into the cache.
+// The expired items are kept if stale is true, which could be used when meta is unreachable.
+type inodeCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	stale   bool
+	gen     uint64
+	lru     *list.List
+	attrs   map[Ino]*list.Element
+	entries map[Ino]map[string]*list.Element
+}
+
+func newInodeCache(size int, ttl time.Duration) *inodeCache {
+	return &inodeCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		attrs:   make(map[Ino]*list.Element),
+		entries: make(map[Ino]map[string]*list.Element),
+	}
+}
+
+func (c *inodeCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.gen
+}
+
+func (c *inodeCache) getAttr(ino Ino, attr *Attr) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.attrs[ino]; ok {
+		it := e.Value.(*cacheItem)
+		if time.Now().Before(it.expire) {
+			c.lru.MoveToFront(e)
+			*attr = it.attr
+			inodeCacheHits.Inc()
+			return true
+		}
+		if !c.stale {
+			c.remove(e)
+		}
+	}
+	inodeCacheMisses.Inc()
+	return false
+}
+
+func (c *inodeCache) lookup(parent Ino, name string, inode *Ino, attr *Attr) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[parent][name]; ok {
+		it := e.Value.(*cacheItem)
+		if time.Now().Before(it.expire) {
+			if a, ok := c.attrs[it.ino]; ok && time.Now().Before(a.Value.(*cacheItem).expire) {
+				c.lru.MoveToFront(e)
+				c.lru.MoveToFront(a)
+				*inode = it.ino
+				*attr = a.Value.(*cacheItem).attr
+				inodeCacheHits.Inc()
+				return true
+			}
+		} else if !c.stale {
+			c.remove(e)
+		}
+	}
+	inodeCacheMisses.Inc()
+	return false
+}
+
+// getStaleAttr returns the cached attribute even if it's expired.
+func (c *inodeCache) getStaleAttr(ino Ino, attr *Attr) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.attrs[ino]; ok {
+		*attr = e.Value.(*cacheItem).attr
+		return true
+	}
+	return false
+}
+
+// lookupStale returns the cached entry even if it's expired.
+func (c *inodeCache) lookupStale(parent Ino, name string, inode *Ino, attr *Attr) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[parent][name]; ok {
+		ino := e.Value.(*cacheItem).ino
+		if a, ok := c.attrs[ino]; ok {
+			*inode = ino
+			*attr = a.Value.(*cacheItem).attr
+			return true
+		}
+	}
+	return false
+}
+
+// putAttr caches the attribute fetched at generation gen, a changed directory
+// (probably by other clients) drops all the cached entries in it.
+func (c *inodeCache) putAttr(gen uint64, ino Ino, attr *Attr) {
+	if c == nil || !attr.Full {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.attrs[ino]; ok {
+		it := e.Value.(*cacheItem)
+		if it.attr.Mtime != attr.Mtime || it.attr.Mtimensec != attr.Mtimensec {
+			c.dropEntries(ino)
+		}
+		it.attr = *attr
+		it.expire = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.attrs[ino] = c.add(&cacheItem{ino: ino, attr: *attr})
+}
+
+func (c *inodeCache) putEntry(gen uint64, parent Ino, name string, inode Ino, attr *Attr) {
+	if c == nil || !attr.Full {
+		return
+	}
+	c.putAttr(gen, inode, attr)
+	c.Lock()
+	defer c.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.entries[parent][name]; ok {
+		it := e.Value.(*cacheItem)
+		it.ino = inode
+		it.expire = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.entries[parent] == nil {
+		c.entries[parent] = make(map[string]*list.Element)
+	}
+	c.entries[parent][name] = c.add(&cacheItem{ino: inode, parent: parent, name: name})
+}
+
+func (c *inodeCache) add(it *cacheItem) *list.Element {
+	it.expire = time.Now().Add(c.ttl)
+	e := c.lru.PushFront(it)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return e
+}
+
+func (c *inodeCache) remove(e *list.Element) {
+	it := c.lru.Remove(e).(*cacheItem)
+	if it.parent == 0 {
+		delete(c.attrs, it.ino)
+	} else if es := c.entries[it.parent]; es != nil {
+		delete(es, it.name)
+		if len(es) == 0 {
+			delete(c.entries, it.parent)
+		}
+	}
+}
+
+func (c *inodeCache) dropEntries(parent Ino) {
+	for _, e := range c.entries[parent] {
+		c.remove(e)
+	}
+}
+
+// invalidate drops the attributes of the inodes.
+func (c *inodeCache) invalidate(inodes ...Ino) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	for _, ino := range inodes {
+		if e, ok := c.attrs[ino]; ok {
+			c.remove(e)
+		}
+	}
+}
+
+// invalidateEntry drops the entry and the attributes of the inode it points to, returns the inode
+// (zero if the entry is not cached).
+func (c *inodeCache) invalidateEntry(parent Ino, name string) Ino {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	var ino Ino
+	if e, ok := c.entries[parent][name]; ok {
+		c.gen++
+		ino = e.Value.(*cacheItem).ino
+		c.remove(e)
+		if a, ok := c.attrs[ino]; ok {
+			c.remove(a)
+		}
+	}
+	return ino
+}
+
+// invalidateInode drops the attributes of a deleted inode and all the entries pointing to it,
+// returns false if nothing is cached for it. It scans all the entries, so it's only used for
+// the rare case that an inode is deleted by other clients while it's cached.
+func (c *inodeCache) invalidateInode(ino Ino) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	var found bool
+	if e, ok := c.attrs[ino]; ok {
+		c.remove(e)
+		found = true
+	}
+	for _, es := range c.entries {
+		for _, e := range es {
+			if e.Value.(*cacheItem).ino == ino {
+				c.remove(e)
+				found = true
+			}
+		}
+	}
+	if found {
+		c.gen++
+	}
+	return found
+}
+
+func (c *inodeCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.attrs = make(map[Ino]*list.Element)
+	c.entries = make(map[Ino]map[string]*list.Element)
+}
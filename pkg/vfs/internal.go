@@ -18,13 +18,17 @@ package vfs
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
@@ -153,13 +157,91 @@ func collectMetrics() []byte {
 	return w.Bytes()
 }
 
+// removals are the paced Rmr in progress, the key is parent/name and the value is the number of
+// removed entries.
+var removals sync.Map
+
+func rmrKey(parent Ino, name string) string {
+	return strconv.FormatUint(uint64(parent), 10) + "/" + name
+}
+
 func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte {
 	switch cmd {
 	case meta.Rmr:
 		inode := Ino(r.Get64())
 		name := string(r.Get(int(r.Get8())))
-		r := meta.Remove(v.Meta, ctx, inode, name)
-		return []byte{uint8(r)}
+		if !r.HasMore() {
+			st := meta.Remove(v.Meta, ctx, inode, name)
+			v.cache.clear() // the whole tree is removed
+			return []byte{uint8(st)}
+		}
+		// paced removal, the reply has the number of removed entries after the status
+		pace := meta.Pace{Rate: float64(r.Get32()), Batch: int(r.Get32())}
+		key := rmrKey(inode, name)
+		removed := new(uint64)
+		if _, loaded := removals.LoadOrStore(key, removed); loaded {
+			return []byte{uint8(syscall.EBUSY)}
+		}
+		st := meta.RemovePaced(v.Meta, ctx, inode, name, pace, removed)
+		removals.Delete(key)
+		v.cache.clear()
+		logger.Infof("Removed %d entries of %s in inode %d: %s", atomic.LoadUint64(removed), name, inode, st)
+		wb := utils.NewBuffer(1 + 8)
+		wb.Put8(uint8(st))
+		wb.Put64(atomic.LoadUint64(removed))
+		return wb.Bytes()
+	case meta.RmrProgress:
+		inode := Ino(r.Get64())
+		name := string(r.Get(int(r.Get8())))
+		removed, ok := removals.Load(rmrKey(inode, name))
+		if !ok {
+			return []byte{uint8(syscall.ENOENT)}
+		}
+		wb := utils.NewBuffer(1 + 8)
+		wb.Put8(0)
+		wb.Put64(atomic.LoadUint64(removed.(*uint64)))
+		return wb.Bytes()
+	case meta.Clone:
+		src := Ino(r.Get64())
+		parent := Ino(r.Get64())
+		name := string(r.Get(int(r.Get8())))
+		st := meta.CloneEntry(v.Meta, ctx, src, parent, name)
+		v.cache.invalidate(parent)
+		return []byte{uint8(st)}
+	case meta.ChangeFlags:
+		inode := Ino(r.Get64())
+		clear, set := r.Get8(), r.Get8()
+		var attr Attr
+		st := v.Meta.GetAttr(ctx, inode, &attr)
+		if st == 0 {
+			attr.Flags = attr.Flags&^clear | set
+			st = v.Meta.SetAttr(ctx, inode, meta.SetAttrFlag, 0, &attr)
+			v.cache.invalidate(inode)
+		}
+		return []byte{uint8(st), attr.Flags}
+	case meta.ChangeAttrs:
+		inode := Ino(r.Get64())
+		var c meta.AttrChange
+		c.Set = r.Get8()
+		c.Clear = r.Get16()
+		c.Mode = r.Get16()
+		c.Uid = r.Get32()
+		c.Gid = r.Get32()
+		recursive := r.Get8()
+		limit := r.Get32()
+		after := string(r.Get(int(r.Get32())))
+		var visited, changed uint64
+		last, st := meta.ApplyAttrChange(v.Meta, ctx, inode, &c, recursive != 0, after, int(limit), &visited, &changed)
+		if changed > 0 {
+			v.cache.clear()
+		}
+		wb := utils.NewBuffer(1 + 8 + 8 + 4 + uint32(len(last)))
+		wb.Put8(uint8(st))
+		wb.Put64(visited)
+		wb.Put64(changed)
+		wb.Put32(uint32(len(last)))
+		wb.Put([]byte(last))
+		return wb.Bytes()
 	case meta.Info:
 		var summary meta.Summary
 		inode := Ino(r.Get64())
@@ -181,6 +263,10 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 		fmt.Fprintf(w, " dirs:\t%d\n", summary.Dirs)
 		fmt.Fprintf(w, " length:\t%d\n", summary.Length)
 		fmt.Fprintf(w, " size:\t%d\n", summary.Size)
+		var attr Attr
+		if v.Meta.GetAttr(ctx, inode, &attr) == 0 {
+			fmt.Fprintf(w, " btime:\t%s\n", attr.Birthtime().Format(time.RFC3339Nano))
+		}
 
 		if summary.Files == 1 && summary.Dirs == 0 {
 			fmt.Fprintf(w, " chunks:\n")
@@ -194,16 +280,281 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 		}
 		wb.Put32(uint32(w.Len()))
 		return append(wb.Bytes(), w.Bytes()...)
+	case meta.SlowOps:
+		var reset uint8
+		if r.HasMore() {
+			reset = r.Get8()
+		}
+		var w = bytes.NewBuffer(nil)
+		for _, op := range v.Meta.SlowOps(reset != 0) {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", op.Time.Format("2006/01/02 15:04:05.000000"), op.Op, op.Inode, op.Duration, op.Retries)
+		}
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(w.Len()))
+		return append(wb.Bytes(), w.Bytes()...)
+	case meta.PendingOps:
+		data, err := json.Marshal(dumpPendingOps())
+		if err != nil {
+			logger.Errorf("marshal pending operations: %s", err)
+			return []byte{uint8(syscall.EIO & 0xff)}
+		}
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(data)))
+		return append(wb.Bytes(), data...)
+	case meta.CacheStats:
+		var reset uint8
+		if r.HasMore() {
+			reset = r.Get8()
+		}
+		data, err := json.Marshal(chunk.ReadCacheStats(reset != 0))
+		if err != nil {
+			logger.Errorf("marshal cache stats: %s", err)
+			return []byte{uint8(syscall.EIO & 0xff)}
+		}
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(data)))
+		return append(wb.Bytes(), data...)
+	case meta.CompactFile:
+		inode := Ino(r.Get64())
+		if w, ok := v.writer.(*dataWriter); ok && w.find(inode) != nil {
+			logger.Warnf("Refuse to compact inode %d, which is being written", inode)
+			return []byte{uint8(syscall.EBUSY & 0xff)}
+		}
+		var stats meta.CompactStats
+		if st := v.Meta.CompactFile(ctx, inode, &stats); st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		logger.Infof("Compacted inode %d: %d -> %d slices, %d bytes rewritten", inode, stats.OldSlices, stats.NewSlices, stats.Bytes)
+		data, err := json.Marshal(&stats)
+		if err != nil {
+			logger.Errorf("marshal compact stats: %s", err)
+			return []byte{uint8(syscall.EIO & 0xff)}
+		}
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(data)))
+		return append(wb.Bytes(), data...)
+	case meta.FillAttrCache:
+		paths := strings.Split(string(r.Get(int(r.Get32()))), "\n")
+		start := time.Now()
+		loaded, full, st := v.fillAttrCache(ctx, paths)
+		if st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		logger.Infof("Loaded %d inodes under %d paths into the inode cache in %s", loaded, len(paths), time.Since(start))
+		wb := utils.NewBuffer(1 + 8 + 1)
+		wb.Put8(0)
+		wb.Put64(loaded)
+		if full {
+			wb.Put8(1)
+		} else {
+			wb.Put8(0)
+		}
+		return wb.Bytes()
+	case meta.FillParents:
+		paths := strings.Split(string(r.Get(int(r.Get32()))), "\n")
+		start := time.Now()
+		loaded, st := v.fillParents(ctx, paths)
+		if st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		logger.Infof("Loaded %d entries along %d paths into the inode cache in %s", loaded, len(paths), time.Since(start))
+		wb := utils.NewBuffer(1 + 8)
+		wb.Put8(0)
+		wb.Put64(loaded)
+		return wb.Bytes()
+	case meta.CacheSpace:
+		var paths []string
+		if n := r.Get32(); n > 0 {
+			paths = strings.Split(string(r.Get(int(n))), "\n")
+		}
+		capacity, free := v.Store.CacheSpace()
+		wb := utils.NewBuffer(1 + 8 + 8 + 8)
+		wb.Put8(0)
+		wb.Put64(uint64(capacity))
+		wb.Put64(uint64(free))
+		wb.Put64(v.workingSet(paths))
+		return wb.Bytes()
+	case meta.CheckCache:
+		paths := strings.Split(string(r.Get(int(r.Get32()))), "\n")
+		concurrent := r.Get16()
+		if concurrent > maxFillThreads {
+			concurrent = maxFillThreads
+		} else if concurrent == 0 {
+			concurrent = 1
+		}
+		cached, total := v.checkCache(paths, int(concurrent))
+		wb := utils.NewBuffer(1 + 4 + 16*uint32(len(paths)))
+		wb.Put8(0)
+		wb.Put32(uint32(len(paths)))
+		for i := range paths {
+			wb.Put64(cached[i])
+			wb.Put64(total[i])
+		}
+		return wb.Bytes()
 	case meta.FillCache:
 		paths := strings.Split(string(r.Get(int(r.Get32()))), "\n")
 		concurrent := r.Get16()
 		background := r.Get8()
-		if background == 0 {
-			v.fillCache(paths, int(concurrent))
+		var flags uint8
+		if n := r.Left(); n == 1 || n == 1+8 { // with the time of FillCacheAfter
+			flags = r.Get8()
+		}
+		if flags&^(meta.FillCacheStats|meta.FillCacheThreads|meta.FillCacheAfter|meta.FillCacheErrors|meta.FillCacheSizes|meta.FillCachePhased) != 0 {
+			logger.Warnf("unknown flags of fill cache: %x", flags)
+			return []byte{meta.FillCacheInvalid}
+		}
+		var after time.Time
+		if flags&meta.FillCacheAfter != 0 {
+			if r.Left() < 8 {
+				return []byte{meta.FillCacheInvalid}
+			}
+			after = time.Unix(0, int64(r.Get64()))
+		}
+		if concurrent > maxFillThreads {
+			logger.Warnf("Too many threads to warm up: %d, use %d instead", concurrent, maxFillThreads)
+			concurrent = maxFillThreads
+		} else if concurrent == 0 {
+			concurrent = 1
+		}
+		var skipped, old, failed uint64 // unknown in background
+		var sizes []uint64
+		var phases fillPhases
+		if flags&meta.FillCachePhased != 0 {
+			if background == 0 {
+				skipped, old, failed, sizes, phases = v.fillCachePhased(paths, int(concurrent), after)
+			} else {
+				go v.fillCachePhased(paths, int(concurrent), after)
+			}
+		} else if background == 0 {
+			skipped, old, failed, sizes = v.fillCache(paths, int(concurrent), after)
 		} else {
-			go v.fillCache(paths, int(concurrent))
+			go v.fillCache(paths, int(concurrent), after)
+		}
+		var size uint32 = 1
+		if flags&meta.FillCacheStats != 0 {
+			size += 8
+		}
+		if flags&meta.FillCacheThreads != 0 {
+			size += 2
+		}
+		if flags&meta.FillCacheAfter != 0 {
+			size += 8
+		}
+		if flags&meta.FillCacheSizes != 0 {
+			size += 4 + 8*uint32(len(sizes))
+		}
+		if flags&meta.FillCachePhased != 0 {
+			size += 8 + 8
+		}
+		wb := utils.NewBuffer(size)
+		if failed > 0 && flags&meta.FillCacheErrors != 0 {
+			wb.Put8(meta.FillCacheAgain)
+		} else {
+			wb.Put8(meta.FillCacheOK)
+		}
+		if flags&meta.FillCacheStats != 0 {
+			wb.Put64(skipped)
+		}
+		if flags&meta.FillCacheThreads != 0 {
+			wb.Put16(concurrent)
+		}
+		if flags&meta.FillCacheAfter != 0 {
+			wb.Put64(old)
+		}
+		if flags&meta.FillCacheSizes != 0 {
+			wb.Put32(uint32(len(sizes)))
+			for _, s := range sizes {
+				wb.Put64(s)
+			}
+		}
+		if flags&meta.FillCachePhased != 0 {
+			wb.Put64(phases.meta)
+			wb.Put64(phases.data)
+		}
+		return wb.Bytes()
+	case meta.RefreshCreds:
+		accessKey := string(r.Get(int(r.Get32())))
+		secretKey := string(r.Get(int(r.Get32())))
+		token := string(r.Get(int(r.Get32())))
+		var st syscall.Errno
+		var msg string
+		if ctx.Uid() != 0 && ctx.Uid() != uint32(os.Getuid()) {
+			st = syscall.EPERM
+		} else if err := v.Store.UpdateCredentials(accessKey, secretKey, token); err != nil {
+			logger.Warnf("Update credentials of object storage: %s", err)
+			st, msg = syscall.EIO, err.Error()
+		}
+		wb := utils.NewBuffer(1 + 4 + uint32(len(msg)))
+		wb.Put8(uint8(st))
+		wb.Put32(uint32(len(msg)))
+		wb.Put([]byte(msg))
+		return wb.Bytes()
+	case meta.Profile:
+		kind := string(r.Get(int(r.Get32())))
+		seconds := r.Get32()
+		if ctx.Uid() != 0 && ctx.Uid() != uint32(os.Getuid()) {
+			return []byte{uint8(syscall.EPERM & 0xff)}
+		}
+		data, st := captureProfile(kind, time.Duration(seconds)*time.Second)
+		if st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		logger.Infof("Captured %s profile (%d bytes)", kind, len(data))
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(data)))
+		return append(wb.Bytes(), data...)
+	case meta.ManageSnapshot:
+		op := r.Get8()
+		name := string(r.Get(int(r.Get8())))
+		var inode Ino
+		if op == meta.SnapshotCreate {
+			inode = Ino(r.Get64())
+		}
+		if ctx.Uid() != 0 && ctx.Uid() != uint32(os.Getuid()) {
+			return []byte{uint8(syscall.EPERM & 0xff)}
+		}
+		var st syscall.Errno
+		switch op {
+		case meta.SnapshotCreate:
+			var p string
+			if p, st = meta.GetPath(v.Meta, ctx, inode); st == 0 {
+				st = meta.CreateSnapshot(v.Meta, ctx, p, name)
+			}
+		case meta.SnapshotList:
+			snapshots, st := meta.ListSnapshots(v.Meta, ctx)
+			if st != 0 {
+				return []byte{uint8(st & 0xff)}
+			}
+			if snapshots == nil {
+				snapshots = []*meta.Snapshot{}
+			}
+			data, err := json.Marshal(snapshots)
+			if err != nil {
+				logger.Errorf("marshal snapshots: %s", err)
+				return []byte{uint8(syscall.EIO & 0xff)}
+			}
+			wb := utils.NewBuffer(4)
+			wb.Put32(uint32(len(data)))
+			return append(wb.Bytes(), data...)
+		case meta.SnapshotRollback:
+			st = meta.RollbackSnapshot(v.Meta, ctx, name)
+			v.cache.clear()
+		case meta.SnapshotDelete:
+			st = meta.DeleteSnapshot(v.Meta, ctx, name)
+		default:
+			st = syscall.EINVAL
+		}
+		if st != 0 {
+			logger.Warnf("Snapshot operation %d on %s: %s", op, name, st)
+		}
+		return []byte{uint8(st & 0xff)}
+	case meta.PauseBackground:
+		pause := r.Get8() != 0
+		if ctx.Uid() != 0 && ctx.Uid() != uint32(os.Getuid()) {
+			return []byte{uint8(syscall.EPERM & 0xff)}
 		}
-		return []byte{uint8(0)}
+		v.Meta.PauseBackground(pause)
+		return []byte{0}
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		return []byte{uint8(syscall.EINVAL & 0xff)}
@@ -0,0 +1,105 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// maxCachedDepths is the number of directories whose depths are cached, the cache is dropped
+// when it's full.
+const maxCachedDepths = 100000
+
+// dirDepths caches the depths of directories (the root is 0) for MaxDepth. It's dropped when a
+// directory is renamed by this client, so it could be stale if directories are moved by others.
+type dirDepths struct {
+	sync.Mutex
+	depths map[Ino]int
+}
+
+func (d *dirDepths) get(ino Ino) (int, bool) {
+	d.Lock()
+	defer d.Unlock()
+	n, ok := d.depths[ino]
+	return n, ok
+}
+
+func (d *dirDepths) set(ino Ino, n int) {
+	d.Lock()
+	defer d.Unlock()
+	if d.depths == nil || len(d.depths) >= maxCachedDepths {
+		d.depths = make(map[Ino]int)
+	}
+	d.depths[ino] = n
+}
+
+func (d *dirDepths) reset() {
+	d.Lock()
+	d.depths = nil
+	d.Unlock()
+}
+
+// fileSizeLimit returns the maximum size of a file, a file can be as large as it.
+func (v *VFS) fileSizeLimit() uint64 {
+	if v.Conf.MaxFileSize > 0 && v.Conf.MaxFileSize < maxFileSize {
+		return v.Conf.MaxFileSize
+	}
+	return maxFileSize - 1
+}
+
+// depth returns the depth of directory ino by walking up its parents, the walk stops at the
+// cached ones, or once it's deeper than MaxDepth. The depth is counted from the root of the
+// volume, and 0 is returned if it's unknown.
+func (v *VFS) depth(ctx Context, ino Ino) int {
+	var inodes []Ino
+	n := 0
+	for ino != rootID && ino != 0 {
+		if d, ok := v.depths.get(ino); ok {
+			n = d
+			break
+		}
+		if len(inodes) > v.Conf.MaxDepth {
+			return len(inodes) // deep enough, the ancestors are unknown
+		}
+		var attr Attr
+		if st := v.Meta.GetAttr(ctx, ino, &attr); st != 0 || attr.Typ != meta.TypeDirectory {
+			return 0
+		}
+		inodes = append(inodes, ino)
+		ino = attr.Parent
+	}
+	for i := len(inodes) - 1; i >= 0; i-- {
+		n++
+		v.depths.set(inodes[i], n)
+	}
+	return n
+}
+
+// checkDepth returns ENAMETOOLONG if a new entry in directory parent is deeper than MaxDepth.
+func (v *VFS) checkDepth(ctx Context, parent Ino) syscall.Errno {
+	if v.Conf.MaxDepth <= 0 {
+		return 0
+	}
+	if v.depth(ctx, parent)+1 > v.Conf.MaxDepth {
+		logger.Debugf("Entry in directory %d is deeper than %d, rejected", parent, v.Conf.MaxDepth)
+		return syscall.ENAMETOOLONG
+	}
+	return 0
+}
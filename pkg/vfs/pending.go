@@ -0,0 +1,92 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// the resources that a pending operation is waiting for
+const (
+	waitMeta   = "meta"
+	waitObject = "object"
+	waitLock   = "lock"
+)
+
+// PendingOp is an operation in progress, used to diagnose a hung mount point.
+type PendingOp struct {
+	Op      string    `json:"op"`
+	Inode   Ino       `json:"inode"`
+	Pid     uint32    `json:"pid"`
+	Start   time.Time `json:"start"`
+	Age     float64   `json:"age"` // in seconds
+	Waiting string    `json:"waiting"`
+}
+
+type pendingOp struct {
+	op      string
+	inode   Ino
+	pid     uint32
+	start   time.Time
+	waiting atomic.Value
+}
+
+var pendingOps sync.Map // meta.Context -> *pendingOp
+
+// BeginOp starts to track an operation, which should be finished by EndOp with the same context.
+func BeginOp(ctx meta.Context, op string, inode Ino) {
+	p := &pendingOp{op: op, inode: inode, pid: ctx.Pid(), start: time.Now()}
+	p.waiting.Store(waitMeta)
+	pendingOps.Store(ctx, p)
+}
+
+// EndOp finishes the operation started by BeginOp.
+func EndOp(ctx meta.Context) {
+	pendingOps.Delete(ctx)
+}
+
+// waitOn marks the operation of ctx as waiting for the resource, and returns a function to undo it.
+func waitOn(ctx meta.Context, resource string) func() {
+	v, ok := pendingOps.Load(ctx)
+	if !ok {
+		return func() {}
+	}
+	p := v.(*pendingOp)
+	old := p.waiting.Load()
+	p.waiting.Store(resource)
+	return func() { p.waiting.Store(old) }
+}
+
+// dumpPendingOps returns the operations in progress, the oldest first.
+func dumpPendingOps() []PendingOp {
+	now := time.Now()
+	ops := make([]PendingOp, 0)
+	pendingOps.Range(func(k, v interface{}) bool {
+		p := v.(*pendingOp)
+		if !IsSpecialNode(p.inode) {
+			ops = append(ops, PendingOp{p.op, p.inode, p.pid, p.start, now.Sub(p.start).Seconds(), p.waiting.Load().(string)})
+		}
+		return true
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Start.Before(ops[j].Start) })
+	return ops
+}
@@ -0,0 +1,80 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"syscall"
+)
+
+// Events of poll, in the values of Linux, which are used by FUSE on all the platforms.
+const (
+	PollIn     = 0x1
+	PollPri    = 0x2
+	PollOut    = 0x4
+	PollErr    = 0x8
+	PollHup    = 0x10
+	PollNval   = 0x20
+	PollRdNorm = 0x40
+	PollWrNorm = 0x100
+)
+
+const (
+	pollReadable = PollIn | PollRdNorm
+	pollWritable = PollOut | PollWrNorm
+)
+
+// accessLogReady returns whether there are lines to read in the access log opened as fh.
+func accessLogReady(fh uint64) (ready, ok bool) {
+	readerLock.Lock()
+	r, ok := readers[fh]
+	readerLock.Unlock()
+	if !ok {
+		return false, false
+	}
+	r.Lock()
+	defer r.Unlock()
+	return len(r.last) > 0 || len(r.buffer) > 0, true
+}
+
+// Poll returns the events ready on the file handle among the requested ones (POLLERR and POLLHUP
+// are always reported). Regular files are always ready to read and write as in local file systems,
+// while the access log is readable only when there are lines in its buffer.
+//
+// The go-fuse in use doesn't pass POLL requests to the file system yet, it answers them with
+// ENOSYS, then the kernel treats all the files as always ready, so it's not called by FUSE for now.
+func (v *VFS) Poll(ctx Context, ino Ino, fh uint64, events uint32) (revents uint32, err syscall.Errno) {
+	defer func() { logit(ctx, "poll (%d,%d,%#x): %s (%#x)", ino, fh, events, strerr(err), revents) }()
+	var ready uint32
+	if ino == logInode {
+		readable, ok := accessLogReady(fh)
+		if !ok {
+			err = syscall.EBADF
+			return
+		}
+		if readable {
+			ready = pollReadable
+		}
+	} else {
+		if v.findHandle(ino, fh) == nil {
+			err = syscall.EBADF
+			return
+		}
+		ready = pollReadable | pollWritable
+	}
+	revents = ready & (events | PollErr | PollHup)
+	return
+}
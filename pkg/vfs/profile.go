@@ -0,0 +1,53 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"syscall"
+	"time"
+)
+
+// MaxProfileDuration is the longest CPU profile can be captured through the control file.
+const MaxProfileDuration = time.Minute * 10
+
+// captureProfile returns a profile in the format of pprof: a CPU profile of the duration, or a
+// snapshot of heap or goroutines. Only one CPU profile can be captured at a time.
+func captureProfile(kind string, duration time.Duration) ([]byte, syscall.Errno) {
+	var buf bytes.Buffer
+	switch kind {
+	case "cpu":
+		if duration <= 0 || duration > MaxProfileDuration {
+			return nil, syscall.EINVAL
+		}
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			logger.Warnf("Start CPU profile: %s", err)
+			return nil, syscall.EBUSY
+		}
+		time.Sleep(duration)
+		pprof.StopCPUProfile()
+	case "heap", "goroutine":
+		if err := pprof.Lookup(kind).WriteTo(&buf, 0); err != nil {
+			logger.Warnf("Write %s profile: %s", kind, err)
+			return nil, syscall.EIO
+		}
+	default:
+		return nil, syscall.EINVAL
+	}
+	return buf.Bytes(), 0
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 /*
@@ -53,6 +54,11 @@ const readSessions = 2
 
 var readBufferUsed int64
 
+var readTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fuse_read_timeouts",
+	Help: "The number of reads canceled because of read timeout.",
+})
+
 type sstate uint8
 
 func (m sstate) valid() bool { return m != BREAK && m != INVALID }
@@ -72,7 +78,9 @@ type FileReader interface {
 }
 
 type DataReader interface {
-	Open(inode Ino, length uint64) FileReader
+	Open(inode Ino, length uint64, nocache bool) FileReader
+	// OpenSnapshot opens a reader which sees the file as it is now, see ReadSnapshot.
+	OpenSnapshot(inode Ino, length uint64, nocache bool) FileReader
 	Truncate(inode Ino, length uint64)
 	Invalidate(inode Ino, off, length uint64)
 }
@@ -172,7 +180,12 @@ func (s *sliceReader) run() {
 	length := f.length
 	f.Unlock()
 	var chunks []meta.Slice
-	err := f.r.m.Read(meta.Background, inode, indx, &chunks)
+	var err syscall.Errno
+	if cs, ok := f.chunks[indx]; ok {
+		chunks = cs
+	} else {
+		err = f.r.m.Read(meta.Background, inode, indx, &chunks)
+	}
 	f.Lock()
 	if s.state != BUSY || f.err != 0 || f.closing {
 		s.done(0, 0)
@@ -204,7 +217,12 @@ func (s *sliceReader) run() {
 	defer p.Release()
 	var n int
 	ctx := context.TODO()
-	n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	if f.r.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.r.readTimeout)
+		defer cancel()
+	}
+	n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize, f.nocache)
 
 	f.Lock()
 	if s.state != BUSY || f.shouldStop() {
@@ -221,7 +239,12 @@ func (s *sliceReader) run() {
 		err = syscall.EIO
 		f.tried++
 		_ = f.r.m.InvalidateChunkCache(meta.Background, inode, indx)
-		if f.tried >= f.r.maxRetries {
+		if ctx.Err() == context.DeadlineExceeded {
+			// fail fast, retrying a stuck object is likely to time out again
+			logger.Warnf("read inode %d chunk %d timed out after %s", inode, indx, f.r.readTimeout)
+			readTimeouts.Inc()
+			s.done(err, 0)
+		} else if f.tried >= f.r.maxRetries {
 			s.done(err, 0)
 		} else {
 			s.done(0, retry_time(f.tried))
@@ -283,6 +306,9 @@ type fileReader struct {
 	// protected by itself
 	inode    Ino
 	length   uint64
+	nocache  bool                    // bypass the cache
+	snapshot bool                    // not changed by Truncate and Invalidate
+	chunks   map[uint32][]meta.Slice // the slices when it's opened with snapshot, never changed
 	err      syscall.Errno
 	tried    uint32
 	sessions [readSessions]session
@@ -575,6 +601,7 @@ func (f *fileReader) shouldStop() bool {
 
 func (f *fileReader) waitForIO(ctx meta.Context, reqs []*req, buf []byte) (int, syscall.Errno) {
 	start := time.Now()
+	defer waitOn(ctx, waitObject)()
 	for _, req := range reqs {
 		s := req.s
 		for s.state != READY && uint64(s.currentPos) < s.block.len {
@@ -678,6 +705,7 @@ type dataReader struct {
 	readAheadTotal uint64
 	maxRequests    int
 	maxRetries     uint32
+	readTimeout    time.Duration
 }
 
 func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader {
@@ -698,6 +726,7 @@ func NewDataReader(conf *Config, m meta.Meta, store chunk.ChunkStore) DataReader
 		readAheadMax:   uint64(readAheadMax),
 		maxRequests:    readAheadMax/conf.Chunk.BlockSize*readSessions + 1,
 		maxRetries:     uint32(conf.Meta.Retries),
+		readTimeout:    conf.ReadTimeout,
 	}
 	go r.checkReadBuffer()
 	return r
@@ -719,18 +748,45 @@ func (r *dataReader) checkReadBuffer() {
 	}
 }
 
-func (r *dataReader) Open(inode Ino, length uint64) FileReader {
-	f := &fileReader{
-		r:      r,
-		inode:  inode,
-		length: length,
-	}
+func (r *dataReader) Open(inode Ino, length uint64, nocache bool) FileReader {
+	return r.open(&fileReader{
+		r:       r,
+		inode:   inode,
+		length:  length,
+		nocache: nocache,
+	})
+}
+
+// OpenSnapshot reads the slices of all the chunks at once, which are used for all the reads later,
+// so a truncation or write after it (by any client) is not mixed into the data read. The chunks
+// failed to be read are read as Open.
+func (r *dataReader) OpenSnapshot(inode Ino, length uint64, nocache bool) FileReader {
+	chunks := make(map[uint32][]meta.Slice)
+	for indx := uint64(0); indx*meta.ChunkSize < length; indx++ {
+		var slices []meta.Slice
+		if st := r.m.Read(meta.Background, inode, uint32(indx), &slices); st != 0 {
+			logger.Warnf("Read slices of inode %d chunk %d: %s, it's not in the snapshot", inode, indx, st)
+			continue
+		}
+		chunks[uint32(indx)] = slices
+	}
+	return r.open(&fileReader{
+		r:        r,
+		inode:    inode,
+		length:   length,
+		nocache:  nocache,
+		snapshot: true,
+		chunks:   chunks,
+	})
+}
+
+func (r *dataReader) open(f *fileReader) FileReader {
 	f.last = &(f.slices)
 
 	r.Lock()
 	f.refs = 1
-	f.next = r.files[inode]
-	r.files[inode] = f
+	f.next = r.files[f.inode]
+	r.files[f.inode] = f
 	r.Unlock()
 	return f
 }
@@ -754,6 +810,9 @@ func (r *dataReader) visit(inode Ino, fn func(*fileReader)) {
 
 func (r *dataReader) Truncate(inode Ino, length uint64) {
 	r.visit(inode, func(f *fileReader) {
+		if f.snapshot {
+			return
+		}
 		if length < f.length {
 			f.visit(func(s *sliceReader) {
 				if s.block.off+s.block.len > length {
@@ -768,6 +827,9 @@ func (r *dataReader) Truncate(inode Ino, length uint64) {
 func (r *dataReader) Invalidate(inode Ino, off, length uint64) {
 	b := frange{off, length}
 	r.visit(inode, func(f *fileReader) {
+		if f.snapshot {
+			return
+		}
 		if off+length > f.length {
 			f.length = off + length
 		}
@@ -779,7 +841,7 @@ func (r *dataReader) Invalidate(inode Ino, off, length uint64) {
 	})
 }
 
-func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.Page, off int) error {
+func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.Page, off int, nocache bool) error {
 	buf := page.Data
 	read := 0
 	if s.Chunkid == 0 {
@@ -790,7 +852,12 @@ func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.P
 		return nil
 	}
 
-	reader := r.store.NewReader(s.Chunkid, int(s.Size))
+	var reader chunk.Reader
+	if nocache {
+		reader = r.store.NewUncachedReader(s.Chunkid, int(s.Size))
+	} else {
+		reader = r.store.NewReader(s.Chunkid, int(s.Size))
+	}
 	for read < len(buf) {
 		p := page.Slice(read, len(buf)-read)
 		n, err := reader.ReadAt(ctx, p, off+int(s.Off))
@@ -806,9 +873,9 @@ func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.P
 	return nil
 }
 
-func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32, nocache bool) int {
 	if len(chunks) > 16 {
-		return r.readManyChunks(ctx, page, chunks, offset)
+		return r.readManyChunks(ctx, page, chunks, offset, nocache)
 	}
 	read := 0
 	var pos uint32
@@ -821,7 +888,7 @@ func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.S
 			toread := utils.Min(size-read, int(pos+chunks[i].Len-offset))
 			go func(s *meta.Slice, p *chunk.Page, off, pos uint32) {
 				defer p.Release()
-				errs <- r.readSlice(ctx, s, p, int(off))
+				errs <- r.readSlice(ctx, s, p, int(off), nocache)
 			}(&chunks[i], page.Slice(read, toread), offset-pos, pos)
 			read += toread
 			offset += uint32(toread)
@@ -847,7 +914,7 @@ func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.S
 	return read
 }
 
-func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32, nocache bool) int {
 	read := 0
 	var pos uint32
 	var err error
@@ -876,7 +943,7 @@ CHUNKS:
 			}
 			go func(s *meta.Slice, p *chunk.Page, off int, pos uint32) {
 				defer p.Release()
-				errs <- r.readSlice(ctx, s, p, off)
+				errs <- r.readSlice(ctx, s, p, off, nocache)
 				<-concurrency
 			}(&chunks[i], page.Slice(read, toread), int(offset-pos), pos)
 
@@ -0,0 +1,135 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staleCacheSize is the size of inode cache used by AllowStaleReads if it's not enabled,
+// whose items are always expired, only used when meta is unreachable.
+const staleCacheSize = 100000
+
+var probeInterval = time.Second
+
+var staleReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fuse_stale_reads",
+	Help: "The number of lookup/getattr/open served by stale cache when meta is unreachable.",
+})
+
+// metaHealth tracks whether the meta engine is reachable, for AllowStaleReads. The client is
+// degraded after a lookup/getattr/open failed because of the meta engine, and recovers when
+// it responds to the probe (or any other request) again.
+type metaHealth struct {
+	sync.Mutex
+	degraded bool
+	probing  bool
+	since    time.Time
+}
+
+func unreachable(err syscall.Errno) bool {
+	return err == syscall.EIO || err == syscall.ETIMEDOUT
+}
+
+func (v *VFS) degraded() bool {
+	if !v.Conf.AllowStaleReads {
+		return false
+	}
+	v.health.Lock()
+	defer v.health.Unlock()
+	return v.health.degraded
+}
+
+// metaFailed returns true if the stale cache should be used for the error, the client is
+// degraded until probe succeeds.
+func (v *VFS) metaFailed(err syscall.Errno, probe func() syscall.Errno) bool {
+	if !v.Conf.AllowStaleReads || !unreachable(err) {
+		return false
+	}
+	v.health.Lock()
+	defer v.health.Unlock()
+	if !v.health.degraded {
+		v.health.degraded = true
+		v.health.since = time.Now()
+		logger.Warnf("Meta engine is unreachable (%s), serve reads from stale cache until it's back", err)
+	}
+	if !v.health.probing {
+		v.health.probing = true
+		go v.probeMeta(probe)
+	}
+	return true
+}
+
+func (v *VFS) probeMeta(probe func() syscall.Errno) {
+	for {
+		time.Sleep(probeInterval)
+		st := probe()
+		v.health.Lock()
+		if !unreachable(st) {
+			v.recovered()
+		}
+		if !v.health.degraded {
+			v.health.probing = false
+			v.health.Unlock()
+			return
+		}
+		v.health.Unlock()
+	}
+}
+
+func (v *VFS) metaRecovered() {
+	if !v.Conf.AllowStaleReads {
+		return
+	}
+	v.health.Lock()
+	defer v.health.Unlock()
+	v.recovered()
+}
+
+func (v *VFS) recovered() {
+	if v.health.degraded {
+		v.health.degraded = false
+		logger.Infof("Meta engine is back after %s, leave degraded mode", time.Since(v.health.since))
+	}
+}
+
+func (v *VFS) probeAttr(ino Ino) func() syscall.Errno {
+	return func() syscall.Errno {
+		return v.Meta.GetAttr(meta.Background, ino, &Attr{})
+	}
+}
+
+func (v *VFS) staleAttr(ino Ino, attr *Attr) bool {
+	if v.cache.getStaleAttr(ino, attr) {
+		staleReads.Inc()
+		return true
+	}
+	return false
+}
+
+func (v *VFS) staleLookup(parent Ino, name string, inode *Ino, attr *Attr) bool {
+	if v.cache.lookupStale(parent, name, inode, attr) {
+		staleReads.Inc()
+		return true
+	}
+	return false
+}
@@ -17,9 +17,14 @@
 package vfs
 
 import (
+	"bytes"
 	"encoding/json"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -41,19 +46,94 @@ const (
 )
 
 type Config struct {
-	Meta            *meta.Config
-	Format          *meta.Format
-	Chunk           *chunk.Config
-	Version         string
-	Mountpoint      string
-	AttrTimeout     time.Duration
-	DirEntryTimeout time.Duration
-	EntryTimeout    time.Duration
-	FastResolve     bool   `json:",omitempty"`
-	AccessLog       string `json:",omitempty"`
-	HideInternal    bool
+	Meta             *meta.Config
+	Format           *meta.Format
+	Chunk            *chunk.Config
+	Version          string
+	Mountpoint       string
+	AttrTimeout      time.Duration
+	DirEntryTimeout  time.Duration
+	EntryTimeout     time.Duration
+	FastResolve      bool   `json:",omitempty"`
+	AccessLog        string `json:",omitempty"`
+	HideInternal     bool
+	ReadTimeout      time.Duration `json:",omitempty"`
+	InodeCacheSize   int           `json:",omitempty"`
+	InodeCacheTTL    time.Duration `json:",omitempty"`
+	WriteCombine     time.Duration `json:",omitempty"`
+	WriteCombineSize int           `json:",omitempty"`
+	WriteCacheLimit  uint64        `json:",omitempty"` // the data written beyond this offset of a file bypasses the cache
+	AllowStaleReads  bool          `json:",omitempty"`
+	RetryENOENT      bool          `json:",omitempty"` // retry once if an inode (probably cached) is not found
+	ReaddirPageSize  int           `json:",omitempty"`
+	ReaddirOrder     string        `json:",omitempty"` // OrderNone (default), OrderName, OrderInode or OrderMtime
+	Umask            *uint16       `json:",omitempty"` // used instead of the umask of process if set
+	Uid              *uint32       `json:",omitempty"` // the owner of all the files as seen by the mount if set
+	Gid              *uint32       `json:",omitempty"` // the group of all the files as seen by the mount if set
+	AllSquash        bool          `json:",omitempty"` // the requests are made as Uid and Gid
+	RootSquash       bool          `json:",omitempty"` // the requests of root are made as AnonUid and AnonGid
+	AnonUid          uint32        `json:",omitempty"`
+	AnonGid          uint32        `json:",omitempty"`
+	FileMode         uint16        `json:",omitempty"` // permissions of new files, instead of the requested ones
+	DirMode          uint16        `json:",omitempty"` // permissions of new directories
+	FsyncPolicy      string        `json:",omitempty"` // FsyncBoth (default), FsyncData or FsyncMeta
+	RenameDurability string        `json:",omitempty"` // RenameNone (default), RenameFsynced or RenameAlways
+	WriteFailure     string        `json:",omitempty"` // WriteFailureReport (default) or WriteFailureRollback
+	MaxFileSize      uint64        `json:",omitempty"` // 0 means the hard limit (maxFileSize)
+	MaxDepth         int           `json:",omitempty"` // of the entries from the root of volume, 0 means no limit
+	ReadSemantics    string        `json:",omitempty"` // ReadShared (default) or ReadSnapshot
 }
 
+const (
+	// FsyncBoth waits for the buffered data to be persisted and the slices committed into the meta engine.
+	FsyncBoth = "both"
+	// FsyncData waits for the buffered data to be persisted, the slices are committed in background.
+	FsyncData = "data"
+	// FsyncMeta doesn't wait for the buffered data, only the metadata (always written synchronously) is durable.
+	FsyncMeta = "meta"
+)
+
+const (
+	// RenameNone renames a file without waiting for its buffered data, which could be committed
+	// after the rename, or lost with it if the client crashes in between.
+	RenameNone = "none"
+	// RenameFsynced waits for the buffered data of a file to be committed before renaming it, if
+	// fsync has been called on it (with any fsync policy).
+	RenameFsynced = "fsync"
+	// RenameAlways waits for the buffered data of a file to be committed before renaming it.
+	RenameAlways = "always"
+)
+
+const (
+	// WriteFailureReport keeps the data committed when some slices of a file fail to be written, and
+	// reports the offset below which all the data written since the file is opened is durable.
+	WriteFailureReport = "report"
+	// WriteFailureRollback commits the slices of a file only when all of them written since the last
+	// flush are persisted, otherwise none of them is committed, so the file keeps the content of last flush.
+	WriteFailureRollback = "rollback"
+)
+
+const (
+	// ReadShared makes the readers see the changes of a file after it's opened as soon as they are known,
+	// as POSIX, so a reader could get the data mixed with the new one if it's truncated (e.g. by O_TRUNC)
+	// and written again in the middle.
+	ReadShared = "shared"
+	// ReadSnapshot makes the read-only handles see a file as it's opened, the slices of it are read
+	// when opening, so the truncations and writes after it are invisible to them.
+	ReadSnapshot = "snapshot"
+)
+
+const (
+	// OrderNone returns the entries of a directory in the order of meta engine, which is the fastest.
+	OrderNone = "none"
+	// OrderName sorts the entries by name.
+	OrderName = "name"
+	// OrderInode sorts the entries by inode.
+	OrderInode = "inode"
+	// OrderMtime sorts the entries by mtime (the oldest first), then by name.
+	OrderMtime = "mtime"
+)
+
 var (
 	readSizeHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "fuse_read_size_bytes",
@@ -84,7 +164,24 @@ func (v *VFS) Lookup(ctx Context, parent Ino, name string) (entry *meta.Entry, e
 		err = syscall.ENAMETOOLONG
 		return
 	}
-	err = v.Meta.Lookup(ctx, parent, name, &inode, attr)
+	if v.cache.lookup(parent, name, &inode, attr) || v.degraded() && v.staleLookup(parent, name, &inode, attr) {
+		v.UpdateLength(inode, attr)
+		entry = &meta.Entry{Inode: inode, Attr: attr}
+		return
+	}
+	gen := v.cache.generation()
+	err = v.checkDeletedEntry(parent, name, func() syscall.Errno { return v.Meta.Lookup(ctx, parent, name, &inode, attr) })
+	if err == 0 {
+		v.metaRecovered()
+		if name != "." && name != ".." {
+			v.cache.putEntry(gen, parent, name, inode, attr)
+		}
+	} else if v.metaFailed(err, func() syscall.Errno {
+		var ino Ino
+		return v.Meta.Lookup(meta.Background, parent, name, &ino, &Attr{})
+	}) && v.staleLookup(parent, name, &inode, attr) {
+		err = 0
+	}
 	if err == 0 {
 		v.UpdateLength(inode, attr)
 		entry = &meta.Entry{Inode: inode, Attr: attr}
@@ -100,7 +197,19 @@ func (v *VFS) GetAttr(ctx Context, ino Ino, opened uint8) (entry *meta.Entry, er
 	}
 	defer func() { logit(ctx, "getattr (%d): %s%s", ino, strerr(err), (*Entry)(entry)) }()
 	var attr = &Attr{}
-	err = v.Meta.GetAttr(ctx, ino, attr)
+	if v.cache.getAttr(ino, attr) || v.degraded() && v.staleAttr(ino, attr) {
+		v.UpdateLength(ino, attr)
+		entry = &meta.Entry{Inode: ino, Attr: attr}
+		return
+	}
+	gen := v.cache.generation()
+	err = v.checkDeleted(ino, func() syscall.Errno { return v.Meta.GetAttr(ctx, ino, attr) })
+	if err == 0 {
+		v.metaRecovered()
+		v.cache.putAttr(gen, ino, attr)
+	} else if v.metaFailed(err, v.probeAttr(ino)) && v.staleAttr(ino, attr) {
+		err = 0
+	}
 	if err == 0 {
 		v.UpdateLength(ino, attr)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
@@ -128,6 +237,19 @@ func get_filetype(mode uint16) uint8 {
 	return meta.TypeFile
 }
 
+// newMode returns the mode and umask of a new file or directory according to the config.
+func (v *VFS) newMode(_type uint8, mode, cumask uint16) (uint16, uint16) {
+	if _type == meta.TypeFile && v.Conf.FileMode > 0 {
+		mode = mode&07000 | v.Conf.FileMode&0777
+	} else if _type == meta.TypeDirectory && v.Conf.DirMode > 0 {
+		mode = mode&07000 | v.Conf.DirMode&0777
+	}
+	if v.Conf.Umask != nil {
+		cumask = *v.Conf.Umask
+	}
+	return mode, cumask
+}
+
 func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask uint16, rdev uint32) (entry *meta.Entry, err syscall.Errno) {
 	defer func() {
 		logit(ctx, "mknod (%d,%s,%s:0%04o,0x%08X): %s%s", parent, name, smode(mode), mode, rdev, strerr(err), (*Entry)(entry))
@@ -145,10 +267,15 @@ func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask ui
 		err = syscall.EPERM
 		return
 	}
+	if err = v.checkDepth(ctx, parent); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
-	err = v.Meta.Mknod(ctx, parent, name, _type, mode&07777, cumask, rdev, &inode, attr)
+	mode, cumask = v.newMode(_type, mode&07777, cumask)
+	err = v.Meta.Mknod(ctx, parent, name, _type, mode, cumask, rdev, &inode, attr)
+	v.cache.invalidate(parent)
 	if err == 0 {
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
@@ -166,6 +293,7 @@ func (v *VFS) Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		return
 	}
 	err = v.Meta.Unlink(ctx, parent, name)
+	v.cache.invalidate(parent, v.cache.invalidateEntry(parent, name))
 	return
 }
 
@@ -181,12 +309,20 @@ func (v *VFS) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask ui
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkDepth(ctx, parent); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
+	mode, cumask = v.newMode(meta.TypeDirectory, mode, cumask)
 	err = v.Meta.Mkdir(ctx, parent, name, mode, cumask, 0, &inode, attr)
+	v.cache.invalidate(parent)
 	if err == 0 {
 		entry = &meta.Entry{Inode: inode, Attr: attr}
+		if d, ok := v.depths.get(parent); ok {
+			v.depths.set(inode, d+1)
+		}
 	}
 	return
 }
@@ -198,6 +334,7 @@ func (v *VFS) Rmdir(ctx Context, parent Ino, name string) (err syscall.Errno) {
 		return
 	}
 	err = v.Meta.Rmdir(ctx, parent, name)
+	v.cache.invalidate(parent, v.cache.invalidateEntry(parent, name))
 	return
 }
 
@@ -213,10 +350,14 @@ func (v *VFS) Symlink(ctx Context, path string, parent Ino, name string) (entry
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkDepth(ctx, parent); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
 	err = v.Meta.Symlink(ctx, parent, name, path, &inode, attr)
+	v.cache.invalidate(parent)
 	if err == 0 {
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
@@ -225,7 +366,7 @@ func (v *VFS) Symlink(ctx Context, path string, parent Ino, name string) (entry
 
 func (v *VFS) Readlink(ctx Context, ino Ino) (path []byte, err syscall.Errno) {
 	defer func() { logit(ctx, "readlink (%d): %s (%s)", ino, strerr(err), string(path)) }()
-	err = v.Meta.ReadLink(ctx, ino, &path)
+	err = v.checkDeleted(ino, func() syscall.Errno { return v.Meta.ReadLink(ctx, ino, &path) })
 	return
 }
 
@@ -245,11 +386,43 @@ func (v *VFS) Rename(ctx Context, parent Ino, name string, newparent Ino, newnam
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if newparent != parent {
+		if err = v.checkDepth(ctx, newparent); err != 0 {
+			return
+		}
+	}
 
-	err = v.Meta.Rename(ctx, parent, name, newparent, newname, flags, nil, nil)
+	if err = v.flushRenamed(ctx, parent, name); err != 0 {
+		return
+	}
+
+	var inode Ino
+	var attr = &Attr{}
+	err = v.Meta.Rename(ctx, parent, name, newparent, newname, flags, &inode, attr)
+	v.cache.invalidate(parent, newparent, v.cache.invalidateEntry(parent, name), v.cache.invalidateEntry(newparent, newname))
+	if err == 0 && attr.Typ == meta.TypeDirectory && newparent != parent {
+		v.depths.reset() // the depths of the subdirectories are changed
+	}
 	return
 }
 
+// flushRenamed commits the buffered data of the file to be renamed with RenameDurability, so the
+// rename is never seen without it, even after a crash right after the rename.
+func (v *VFS) flushRenamed(ctx Context, parent Ino, name string) syscall.Errno {
+	if v.Conf.RenameDurability != RenameFsynced && v.Conf.RenameDurability != RenameAlways {
+		return 0
+	}
+	var inode Ino
+	var attr = &Attr{}
+	if st := v.Meta.Lookup(ctx, parent, name, &inode, attr); st != 0 {
+		return st
+	}
+	if attr.Typ != meta.TypeFile || v.Conf.RenameDurability == RenameFsynced && !v.writer.Fsynced(inode) {
+		return 0
+	}
+	return v.writer.Flush(ctx, inode)
+}
+
 func (v *VFS) Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *meta.Entry, err syscall.Errno) {
 	defer func() {
 		logit(ctx, "link (%d,%d,%s): %s%s", ino, newparent, newname, strerr(err), (*Entry)(entry))
@@ -266,9 +439,13 @@ func (v *VFS) Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkDepth(ctx, newparent); err != 0 {
+		return
+	}
 
 	var attr = &Attr{}
 	err = v.Meta.Link(ctx, ino, newparent, newname, attr)
+	v.cache.invalidate(ino, newparent)
 	if err == 0 {
 		v.UpdateLength(ino, attr)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
@@ -302,33 +479,119 @@ func (v *VFS) Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plu
 	h.Lock()
 	defer h.Unlock()
 
-	if h.children == nil || off == 0 {
-		var inodes []*meta.Entry
-		err = v.Meta.Readdir(ctx, ino, 1, &inodes)
-		if err == syscall.EACCES {
-			err = v.Meta.Readdir(ctx, ino, 0, &inodes)
+	if h.children == nil || off == 0 || off < h.dirOff {
+		h.children, h.dirOff, h.dirNext, h.dirPlus = nil, 0, "", 1
+		if err = v.readdirPage(ctx, h); err != 0 {
+			return
 		}
-		if err != 0 {
+	}
+	// the pages before off are dropped
+	for off >= h.dirOff+len(h.children) && h.dirNext != "" {
+		if err = v.readdirPage(ctx, h); err != 0 {
+			return
+		}
+	}
+	if off-h.dirOff < len(h.children) {
+		entries = h.children[off-h.dirOff:]
+	}
+	v.touchAtime(ctx, h)
+	return
+}
+
+// touchAtime updates the access time of the node read through h, only for the first read of the
+// handle unless it's strictatime, and the meta engine decides whether it's needed for relatime.
+func (v *VFS) touchAtime(ctx Context, h *handle) {
+	switch v.Conf.Meta.AtimeMode {
+	case meta.NoAtime:
+		return
+	case meta.StrictAtime:
+	default:
+		if !atomic.CompareAndSwapUint32(&h.accessed, 0, 1) {
 			return
 		}
-		h.children = inodes
-		if ino == rootID && !v.Conf.HideInternal {
-			// add internal nodes
-			for _, node := range internalNodes {
-				h.children = append(h.children, &meta.Entry{
-					Inode: node.inode,
-					Name:  []byte(node.name),
-					Attr:  node.attr,
-				})
+	}
+	var attr Attr
+	if st := v.Meta.SetAttr(ctx, h.inode, meta.SetAttrAtimeRead, 0, &attr); st != 0 {
+		logger.Debugf("update atime of %d: %s", h.inode, st)
+	}
+}
+
+// readdirPage reads the next page of the directory into the handle, or all the entries if
+// the pagination is disabled.
+func (v *VFS) readdirPage(ctx Context, h *handle) (err syscall.Errno) {
+	ino := h.inode
+	var inodes []*meta.Entry
+	var next string
+	gen := v.cache.generation()
+	err = v.checkDeleted(ino, func() (err syscall.Errno) {
+		if v.Conf.ReaddirPageSize <= 0 {
+			err = v.Meta.Readdir(ctx, ino, 1, &inodes)
+			if err == syscall.EACCES {
+				err = v.Meta.Readdir(ctx, ino, 0, &inodes)
+			}
+		} else {
+			next, err = v.Meta.ReaddirPage(ctx, ino, h.dirPlus, h.dirNext, v.Conf.ReaddirPageSize, &inodes)
+			if err == syscall.EACCES && h.dirPlus != 0 {
+				h.dirPlus = 0
+				next, err = v.Meta.ReaddirPage(ctx, ino, 0, h.dirNext, v.Conf.ReaddirPageSize, &inodes)
 			}
 		}
+		return
+	})
+	if err != 0 {
+		return
+	}
+	sortEntries(inodes, v.Conf.ReaddirOrder)
+	h.dirOff += len(h.children)
+	h.children = inodes
+	h.dirNext = next
+	for _, e := range inodes {
+		if name := string(e.Name); name != "." && name != ".." {
+			v.cache.putEntry(gen, ino, name, e.Inode, e.Attr)
+		}
 	}
-	if off < len(h.children) {
-		entries = h.children[off:]
+	if next == "" && ino == rootID && !v.Conf.HideInternal {
+		// add internal nodes
+		for _, node := range internalNodes {
+			h.children = append(h.children, &meta.Entry{
+				Inode: node.inode,
+				Name:  []byte(node.name),
+				Attr:  node.attr,
+			})
+		}
 	}
 	return
 }
 
+// sortEntries sorts the entries of a page by the order, "." and ".." are kept in the front.
+func sortEntries(entries []*meta.Entry, order string) {
+	var less func(a, b *meta.Entry) bool
+	switch order {
+	case OrderName:
+		less = func(a, b *meta.Entry) bool { return bytes.Compare(a.Name, b.Name) < 0 }
+	case OrderInode:
+		less = func(a, b *meta.Entry) bool { return a.Inode < b.Inode }
+	case OrderMtime:
+		less = func(a, b *meta.Entry) bool {
+			if a.Attr.Mtime != b.Attr.Mtime {
+				return a.Attr.Mtime < b.Attr.Mtime
+			}
+			if a.Attr.Mtimensec != b.Attr.Mtimensec {
+				return a.Attr.Mtimensec < b.Attr.Mtimensec
+			}
+			return bytes.Compare(a.Name, b.Name) < 0
+		}
+	default:
+		return
+	}
+	var i int
+	for i < len(entries) && (string(entries[i].Name) == "." || string(entries[i].Name) == "..") {
+		i++
+	}
+	entries = entries[i:]
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+}
+
 func (v *VFS) Releasedir(ctx Context, ino Ino, fh uint64) int {
 	h := v.findHandle(ino, fh)
 	if h == nil {
@@ -351,16 +614,22 @@ func (v *VFS) Create(ctx Context, parent Ino, name string, mode uint16, cumask u
 		err = syscall.ENAMETOOLONG
 		return
 	}
+	if err = v.checkDepth(ctx, parent); err != 0 {
+		return
+	}
 
 	var inode Ino
 	var attr = &Attr{}
-	err = v.Meta.Create(ctx, parent, name, mode&07777, cumask, flags, &inode, attr)
+	mode, cumask = v.newMode(meta.TypeFile, mode&07777, cumask)
+	err = v.Meta.Create(ctx, parent, name, mode, cumask, flags, &inode, attr)
+	v.cache.invalidate(parent)
 	if runtime.GOOS == "darwin" && err == syscall.ENOENT {
 		err = syscall.EACCES
 	}
 	if err == 0 {
 		v.UpdateLength(inode, attr)
-		fh = v.newFileHandle(inode, attr.Length, flags)
+		fh = v.newFileHandle(inode, attr.Length, flags, v.bypassCache(parent))
+		v.applyWriteHints(inode, parent, fh)
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
 	return
@@ -397,10 +666,21 @@ func (v *VFS) Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh ui
 			logit(ctx, "open (%d): %s", ino, strerr(err))
 		}
 	}()
-	err = v.Meta.Open(ctx, ino, flags, attr)
+	gen := v.cache.generation()
+	readonly := flags&O_ACCMODE == syscall.O_RDONLY && flags&syscall.O_TRUNC == 0
+	open := func() syscall.Errno { return v.Meta.Open(ctx, ino, flags, attr) }
+	if readonly && v.degraded() && v.staleAttr(ino, attr) {
+		err = open() // a full attribute is not fetched again
+	} else if err = v.checkDeleted(ino, open); err == 0 {
+		v.metaRecovered()
+		v.cache.putAttr(gen, ino, attr)
+	} else if readonly && v.metaFailed(err, v.probeAttr(ino)) && v.staleAttr(ino, attr) {
+		err = v.Meta.Open(ctx, ino, flags, attr)
+	}
 	if err == 0 {
 		v.UpdateLength(ino, attr)
-		fh = v.newFileHandle(ino, attr.Length, flags)
+		fh = v.newFileHandle(ino, attr.Length, flags, v.bypassCache(attr.Parent))
+		v.applyWriteHints(ino, attr.Parent, fh)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
 	}
 	return
@@ -416,7 +696,7 @@ func (v *VFS) Truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Att
 		err = syscall.EINVAL
 		return
 	}
-	if size >= maxFileSize {
+	if uint64(size) > v.fileSizeLimit() {
 		err = syscall.EFBIG
 		return
 	}
@@ -430,6 +710,7 @@ func (v *VFS) Truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Att
 	}
 	_ = v.writer.Flush(ctx, ino)
 	err = v.Meta.Truncate(ctx, ino, 0, uint64(size), attr)
+	v.cache.invalidate(ino)
 	if err == 0 {
 		v.writer.Truncate(ino, uint64(size))
 		v.reader.Truncate(ino, uint64(size))
@@ -468,6 +749,7 @@ func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 			f.Unlock()
 			if f.writer != nil {
 				_ = f.writer.Flush(ctx)
+				v.cache.invalidate(ino)
 			}
 			if locks&1 != 0 {
 				_ = v.Meta.Flock(ctx, ino, owner, F_UNLCK, false)
@@ -543,6 +825,9 @@ func (v *VFS) Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n i
 		err = syscall.EBADF
 	}
 	h.removeOp(ctx)
+	if err == 0 {
+		v.touchAtime(ctx, h)
+	}
 	return
 }
 
@@ -554,7 +839,7 @@ func (v *VFS) Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err sysca
 		err = syscall.EBADF
 		return
 	}
-	if off >= maxFileSize || off+size >= maxFileSize {
+	if limit := v.fileSizeLimit(); off > limit || off+size > limit {
 		err = syscall.EFBIG
 		return
 	}
@@ -591,6 +876,7 @@ func (v *VFS) Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err sysca
 	defer h.Wunlock()
 
 	err = h.writer.Write(ctx, off, buf)
+	v.cache.invalidate(ino)
 	if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 		err = syscall.EBADF
 	}
@@ -618,7 +904,7 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 		err = syscall.EBADF
 		return
 	}
-	if off >= maxFileSize || off+length >= maxFileSize {
+	if limit := v.fileSizeLimit(); uint64(off) > limit || uint64(off+length) > limit {
 		err = syscall.EFBIG
 		return
 	}
@@ -633,7 +919,16 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 	defer h.Wunlock()
 	defer h.removeOp(ctx)
 
+	// the buffered data should not be committed on top of the hole
+	err = v.writer.Flush(ctx, ino)
+	if err != 0 {
+		return
+	}
 	err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+	v.cache.invalidate(ino)
+	if err == 0 {
+		v.reader.Invalidate(ino, uint64(off), uint64(length))
+	}
 	return
 }
 
@@ -667,7 +962,7 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 		err = syscall.EACCES
 		return
 	}
-	if offIn >= maxFileSize || offIn+size >= maxFileSize || offOut >= maxFileSize || offOut+size >= maxFileSize {
+	if limit := v.fileSizeLimit(); offIn >= maxFileSize || offIn+size >= maxFileSize || offOut > limit || offOut+size > limit {
 		err = syscall.EFBIG
 		return
 	}
@@ -700,6 +995,7 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 		return
 	}
 	err = v.Meta.CopyFileRange(ctx, nodeIn, offIn, nodeOut, offOut, size, flags, &copied)
+	v.cache.invalidate(nodeOut)
 	if err == 0 {
 		v.reader.Invalidate(nodeOut, offOut, size)
 	}
@@ -725,6 +1021,7 @@ func (v *VFS) Flush(ctx Context, ino Ino, fh uint64, lockOwner uint64) (err sysc
 		}
 
 		err = h.writer.Flush(ctx)
+		v.cache.invalidate(ino)
 		if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 			err = syscall.EBADF
 		}
@@ -760,7 +1057,8 @@ func (v *VFS) Fsync(ctx Context, ino Ino, datasync int, fh uint64) (err syscall.
 		defer h.Wunlock()
 		defer h.removeOp(ctx)
 
-		err = h.writer.Flush(ctx)
+		err = h.writer.Fsync(ctx, v.Conf.FsyncPolicy)
+		v.cache.invalidate(ino)
 		if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 			err = syscall.EBADF
 		}
@@ -771,8 +1069,28 @@ func (v *VFS) Fsync(ctx Context, ino Ino, datasync int, fh uint64) (err syscall.
 const (
 	xattrMaxName = 255
 	xattrMaxSize = 65536
+	// casXattrPrefix sets the xattr after it with compare-and-swap, the value is "LEN:EXPECTEDVALUE",
+	// where LEN is the length of expected value, which is empty if the xattr should not exist.
+	casXattrPrefix = "user.jfs.cas."
+	// durableOffsetXattr returns the offset below which the data written is durable, if the file failed
+	// to be written in this mount point with WriteFailureReport. It's not stored in the meta engine, and
+	// only available before the file is closed by all the handles.
+	durableOffsetXattr = "user.jfs.durable-offset"
 )
 
+// parseCASValue splits the value of a compare-and-swap setxattr into the expected and new values.
+func parseCASValue(v []byte) (expected, value []byte, ok bool) {
+	i := bytes.IndexByte(v, ':')
+	if i <= 0 {
+		return nil, nil, false
+	}
+	n, err := strconv.Atoi(string(v[:i]))
+	if err != nil || n < 0 || n > len(v)-i-1 {
+		return nil, nil, false
+	}
+	return v[i+1 : i+1+n], v[i+1+n:], true
+}
+
 func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags uint32) (err syscall.Errno) {
 	defer func() { logit(ctx, "setxattr (%d,%s,%d,%d): %s", ino, name, len(value), flags, strerr(err)) }()
 	if IsSpecialNode(ino) {
@@ -803,7 +1121,32 @@ func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags ui
 		err = syscall.ENOTSUP
 		return
 	}
-	err = v.Meta.SetXattr(ctx, ino, name, value, flags)
+	if name == writeHintsXattr {
+		if _, e := parseWriteHints(string(value)); e != nil {
+			logger.Warnf("Invalid %s of inode %d: %s", name, ino, e)
+			err = syscall.EINVAL
+			return
+		}
+	}
+	target := name
+	if strings.HasPrefix(name, casXattrPrefix) {
+		target = name[len(casXattrPrefix):]
+		expected, nv, ok := parseCASValue(value)
+		if !ok || target == "" {
+			err = syscall.EINVAL
+			return
+		}
+		err = v.Meta.CompareAndSwapXattr(ctx, ino, target, expected, nv)
+	} else {
+		err = v.Meta.SetXattr(ctx, ino, name, value, flags)
+	}
+	v.cache.invalidate(ino)
+	if err == 0 && target == noCacheXattr {
+		v.resetBypass()
+	}
+	if err == 0 && target == writeHintsXattr {
+		v.resetWriteHints()
+	}
 	return
 }
 
@@ -830,7 +1173,15 @@ func (v *VFS) GetXattr(ctx Context, ino Ino, name string, size uint32) (value []
 		err = syscall.ENOTSUP
 		return
 	}
-	err = v.Meta.GetXattr(ctx, ino, name, &value)
+	if name == durableOffsetXattr {
+		if off, ok := v.writer.DurableOffset(ino); ok {
+			value = []byte(strconv.FormatUint(off, 10))
+		} else {
+			err = meta.ENOATTR
+		}
+	} else {
+		err = v.Meta.GetXattr(ctx, ino, name, &value)
+	}
 	if size > 0 && len(value) > int(size) {
 		err = syscall.ERANGE
 	}
@@ -872,6 +1223,13 @@ func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno)
 		return
 	}
 	err = v.Meta.RemoveXattr(ctx, ino, name)
+	v.cache.invalidate(ino)
+	if err == 0 && name == noCacheXattr {
+		v.resetBypass()
+	}
+	if err == 0 && name == writeHintsXattr {
+		v.resetWriteHints()
+	}
 	return
 }
 
@@ -891,6 +1249,33 @@ type VFS struct {
 	handlersGause  prometheus.GaugeFunc
 	usedBufferSize prometheus.GaugeFunc
 	storeCacheSize prometheus.GaugeFunc
+	degradedGauge  prometheus.GaugeFunc
+	pausedGauge    prometheus.GaugeFunc
+
+	cache  *inodeCache
+	health metaHealth
+	bypass bypassDirs
+	hints  hintDirs
+	depths dirDepths
+}
+
+// dropStaleChunk drops the buffered data of a chunk and the cached attributes of inode, as they
+// are changed by other clients (found by meta.Config.RevalidateInterval).
+func (v *VFS) dropStaleChunk(inode Ino, indx uint32) {
+	v.cache.invalidate(inode)
+	var attr Attr
+	if st := v.Meta.GetAttr(meta.Background, inode, &attr); st != 0 {
+		logger.Warnf("getattr of stale inode %d: %s", inode, st)
+		return
+	}
+	v.reader.Truncate(inode, attr.Length)
+	if off := uint64(indx) * meta.ChunkSize; off < attr.Length {
+		size := attr.Length - off
+		if size > meta.ChunkSize {
+			size = meta.ChunkSize
+		}
+		v.reader.Invalidate(inode, off, size)
+	}
 }
 
 func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore) *VFS {
@@ -907,6 +1292,20 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore) *VFS {
 		nextfh:  1,
 	}
 
+	if conf.InodeCacheSize > 0 && conf.Meta.Consistency != meta.ConsistencyStrict {
+		v.cache = newInodeCache(conf.InodeCacheSize, conf.InodeCacheTTL)
+	} else if conf.AllowStaleReads {
+		v.cache = newInodeCache(staleCacheSize, 0)
+	}
+	if v.cache != nil {
+		v.cache.stale = conf.AllowStaleReads
+	}
+
+	m.OnMsg(meta.StaleChunk, func(args ...interface{}) error {
+		v.dropStaleChunk(args[0].(Ino), args[1].(uint32))
+		return nil
+	})
+
 	if conf.Meta.Subdir != "" { // don't show trash directory
 		internalNodes = internalNodes[:len(internalNodes)-1]
 	}
@@ -937,9 +1336,29 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore) *VFS {
 		}
 		return 0.0
 	})
+	v.degradedGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "meta_degraded",
+		Help: "1 if the meta engine is unreachable and reads are served by stale cache.",
+	}, func() float64 {
+		if v.degraded() {
+			return 1
+		}
+		return 0
+	})
+	v.pausedGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "meta_background_paused",
+		Help: "1 if the background tasks (cleanup, compaction and deletion) are paused.",
+	}, func() float64 {
+		if v.Meta.BackgroundPaused() {
+			return 1
+		}
+		return 0
+	})
 	_ = prometheus.Register(v.handlersGause)
 	_ = prometheus.Register(v.usedBufferSize)
 	_ = prometheus.Register(v.storeCacheSize)
+	_ = prometheus.Register(v.degradedGauge)
+	_ = prometheus.Register(v.pausedGauge)
 	return v
 }
 
@@ -948,4 +1367,11 @@ func InitMetrics() {
 	prometheus.MustRegister(writtenSizeHistogram)
 	prometheus.MustRegister(opsDurationsHistogram)
 	prometheus.MustRegister(compactSizeHistogram)
+	prometheus.MustRegister(readTimeouts)
+	prometheus.MustRegister(inodeCacheHits)
+	prometheus.MustRegister(inodeCacheMisses)
+	prometheus.MustRegister(deletedInodes)
+	prometheus.MustRegister(combinedWrites)
+	prometheus.MustRegister(flushedSlices)
+	prometheus.MustRegister(staleReads)
 }
@@ -17,10 +17,19 @@
 package vfs
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -30,6 +39,7 @@ import (
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"golang.org/x/sys/unix"
 )
 
@@ -74,6 +84,21 @@ func createTestVFS() (*VFS, object.ObjectStorage) {
 	return NewVFS(conf, m, store), blob
 }
 
+func TestIdleTime(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.NewContext(10, 1, []uint32{2}))
+	time.Sleep(time.Millisecond * 100)
+	if d := v.IdleTime(); d < time.Millisecond*100 {
+		t.Fatalf("idle for %s, expect at least 100ms", d)
+	}
+	if _, e := v.GetAttr(ctx, 1, 0); e != 0 {
+		t.Fatalf("getattr: %s", e)
+	}
+	if d := v.IdleTime(); d >= time.Millisecond*100 {
+		t.Fatalf("the operation doesn't reset idle time: %s", d)
+	}
+}
+
 func TestVFSBasic(t *testing.T) {
 	v, _ := createTestVFS()
 	ctx := NewLogContext(meta.NewContext(10, 1, []uint32{2}))
@@ -183,6 +208,313 @@ func TestVFSBasic(t *testing.T) {
 
 }
 
+func TestInlineFile(t *testing.T) {
+	metaConf := &meta.Config{Retries: 10, Strict: true, MountPoint: "/jfs", MaxDeletes: 1}
+	m := meta.NewClient("memkv://", metaConf)
+	format := meta.Format{Name: "test", UUID: uuid.New().String(), Storage: "mem", BlockSize: 4096, InlineSize: 4 << 10}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("setting: %s", err)
+	}
+	chunkConf := chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		MaxUpload:  2,
+		BufferSize: 30 << 20,
+		CacheDir:   "memory",
+		InlineSize: format.InlineSize,
+		SaveInline: func(id uint64, data []byte) error {
+			if st := m.SetSliceData(meta.Background, id, data); st != 0 {
+				return st
+			}
+			return nil
+		},
+		LoadInline: func(id uint64) ([]byte, error) {
+			var data []byte
+			if st := m.GetSliceData(meta.Background, id, &data); st == syscall.ENOENT {
+				return nil, nil
+			} else if st != 0 {
+				return nil, st
+			}
+			return data, nil
+		},
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	store := chunk.NewCachedStore(blob, chunkConf)
+	m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
+		return Compact(chunkConf, store, args[0].([]meta.Slice), args[1].(uint64))
+	})
+	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
+		return store.Remove(args[0].(uint64), int(args[1].(uint32)))
+	})
+	v := NewVFS(&Config{Meta: metaConf, Format: &format, Version: "Juicefs", Mountpoint: "/jfs", Chunk: &chunkConf}, m, store)
+	ctx := NewLogContext(meta.Background)
+	objects := func() int {
+		objs, _ := blob.List("", "", 100)
+		return len(objs)
+	}
+
+	small := bytes.Repeat([]byte{'a'}, 100)
+	fe, fh, e := v.Create(ctx, 1, "small", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, small, 0, fh); e != 0 {
+		t.Fatalf("write file: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush file: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if n := objects(); n != 0 {
+		t.Fatalf("the small file should be stored inline, but got %d objects", n)
+	}
+	var slices []meta.Slice
+	if st := m.Read(meta.Background, fe.Inode, 0, &slices); st != 0 || len(slices) != 1 {
+		t.Fatalf("read chunk: %v %s", slices, st)
+	}
+	inlined := slices[0].Chunkid
+
+	// grows past the threshold with an append
+	large := bytes.Repeat([]byte{'b'}, 8<<10)
+	if _, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDWR); e != 0 {
+		t.Fatalf("open file: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, large, uint64(len(small)), fh); e != 0 {
+		t.Fatalf("append file: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush file: %s", e)
+	}
+	expect := append(append([]byte{}, small...), large...)
+	buf := make([]byte, len(expect)+100)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || !bytes.Equal(buf[:n], expect) {
+		t.Fatalf("read grown file: %d %s", n, e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	// the data is moved into object storage by the compaction
+	var stats meta.CompactStats
+	if st := m.CompactFile(meta.Background, fe.Inode, &stats); st != 0 {
+		t.Fatalf("compact file: %s", st)
+	}
+	if n := objects(); n != 1 {
+		t.Fatalf("the compacted slice should be stored in object storage, but got %d objects", n)
+	}
+	if _, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY); e != 0 {
+		t.Fatalf("open file: %s", e)
+	}
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || !bytes.Equal(buf[:n], expect) {
+		t.Fatalf("read compacted file: %d %s", n, e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	var data []byte
+	for i := 0; i < 50 && m.GetSliceData(meta.Background, inlined, &data) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+	}
+	if st := m.GetSliceData(meta.Background, inlined, &data); st != syscall.ENOENT {
+		t.Fatalf("the inline data should be removed with the compacted slice: %s", st)
+	}
+}
+
+func TestFallocateHoles(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "sparse", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	data := bytes.Repeat([]byte{'x'}, 1<<20)
+	// the buffered data should not show up in the hole
+	if e = v.Write(ctx, fe.Inode, data, 0, fh); e != 0 {
+		t.Fatalf("write file: %s", e)
+	}
+	const punchHole, keepSize, zeroRange = 0x02, 0x01, 0x10
+	if e = v.Fallocate(ctx, fe.Inode, punchHole|keepSize, 100<<10, 200<<10, fh); e != 0 {
+		t.Fatalf("punch hole: %s", e)
+	}
+	buf := make([]byte, 1<<20)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 1<<20 {
+		t.Fatalf("read file: %d %s", n, e)
+	}
+	expect := append([]byte{}, data...)
+	copy(expect[100<<10:300<<10], make([]byte, 200<<10))
+	if !bytes.Equal(buf, expect) {
+		t.Fatalf("expect zeros in the hole [%d, %d) only", 100<<10, 300<<10)
+	}
+
+	// zero range extends the file unless the size is kept
+	if e = v.Fallocate(ctx, fe.Inode, zeroRange|keepSize, 900<<10, 200<<10, fh); e != 0 {
+		t.Fatalf("zero range: %s", e)
+	}
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Length != 1<<20 {
+		t.Fatalf("expect length %d with the size kept: %+v %s", 1<<20, entry, e)
+	}
+	if e = v.Fallocate(ctx, fe.Inode, zeroRange, 900<<10, 200<<10, fh); e != 0 {
+		t.Fatalf("zero range: %s", e)
+	}
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Length != 1100<<10 {
+		t.Fatalf("expect length %d after zero range: %+v %s", 1100<<10, entry, e)
+	}
+	if n, e := v.Read(ctx, fe.Inode, buf, 800<<10, fh); e != 0 || n != 300<<10 {
+		t.Fatalf("read file: %d %s", n, e)
+	}
+	if !bytes.Equal(buf[:100<<10], data[:100<<10]) || !bytes.Equal(buf[100<<10:300<<10], make([]byte, 200<<10)) {
+		t.Fatalf("expect zeros in the range [%d, %d)", 900<<10, 1100<<10)
+	}
+	// a punched hole never extends the file
+	if e = v.Fallocate(ctx, fe.Inode, punchHole, 0, 100, fh); e != syscall.EINVAL {
+		t.Fatalf("punch hole without keeping the size: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+}
+
+func TestRevalidateOpenFiles(t *testing.T) {
+	addr := "sqlite3://" + filepath.Join(t.TempDir(), "jfs-revalidate.db")
+	format := meta.Format{Name: "test", UUID: uuid.New().String(), Storage: "mem", BlockSize: 4096}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	newClient := func(interval time.Duration) *VFS {
+		metaConf := &meta.Config{Retries: 10, Strict: true, MountPoint: "/jfs", RevalidateInterval: interval}
+		m := meta.NewClient(addr, metaConf)
+		if err := m.Init(format, false); err != nil {
+			t.Fatalf("setting: %s", err)
+		}
+		conf := &Config{
+			Meta:    metaConf,
+			Format:  &format,
+			Version: "Juicefs",
+			Chunk: &chunk.Config{
+				BlockSize:  format.BlockSize * 1024,
+				MaxUpload:  2,
+				BufferSize: 30 << 20,
+				CacheSize:  10,
+				CacheDir:   "memory",
+			},
+		}
+		v := NewVFS(conf, m, chunk.NewCachedStore(blob, *conf.Chunk))
+		if err := m.NewSession(); err != nil {
+			t.Fatalf("new session: %s", err)
+		}
+		t.Cleanup(func() { _ = m.CloseSession() })
+		return v
+	}
+	writer := newClient(0)
+	reader := newClient(time.Millisecond * 100)
+	ctx := NewLogContext(meta.Background)
+
+	write := func(data []byte) {
+		fe, fh, e := writer.Create(ctx, 1, "file", 0644, 0, syscall.O_RDWR)
+		if e == syscall.EEXIST {
+			if fe, e = writer.Lookup(ctx, 1, "file"); e == 0 {
+				_, fh, e = writer.Open(ctx, fe.Inode, syscall.O_RDWR)
+			}
+		}
+		if e != 0 {
+			t.Fatalf("open file: %s", e)
+		}
+		if e = writer.Write(ctx, fe.Inode, data, 0, fh); e != 0 {
+			t.Fatalf("write file: %s", e)
+		}
+		if e = writer.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush file: %s", e)
+		}
+		writer.Release(ctx, fe.Inode, fh)
+	}
+	write(bytes.Repeat([]byte{'a'}, 1<<20))
+
+	fe, e := reader.Lookup(ctx, 1, "file")
+	if e != 0 {
+		t.Fatalf("lookup file: %s", e)
+	}
+	_, fh, e := reader.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open file: %s", e)
+	}
+	defer reader.Release(ctx, fe.Inode, fh)
+	buf := make([]byte, 1<<20)
+	if n, e := reader.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 1<<20 || buf[0] != 'a' {
+		t.Fatalf("read file: %d %s %q", n, e, buf[0])
+	}
+
+	// overwritten by another client, which is picked up by the next revalidation
+	write(bytes.Repeat([]byte{'b'}, 1<<20))
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 50) {
+		n, e := reader.Read(ctx, fe.Inode, buf, 0, fh)
+		if e != 0 || n != 1<<20 {
+			t.Fatalf("read file: %d %s", n, e)
+		}
+		if bytes.Equal(buf, bytes.Repeat([]byte{'b'}, 1<<20)) {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("the overwrite is not picked up after %s: %q", time.Since(start), buf[0])
+		}
+	}
+}
+
+func TestReadSemantics(t *testing.T) {
+	const size = 10 << 20
+	old, data := bytes.Repeat([]byte{'a'}, size), bytes.Repeat([]byte{'b'}, size)
+	for _, semantics := range []string{ReadShared, ReadSnapshot} {
+		v, _ := createTestVFS()
+		v.Conf.ReadSemantics = semantics
+		ctx := NewLogContext(meta.Background)
+		fe, fh, e := v.Create(ctx, 1, "file", 0644, 0, syscall.O_WRONLY)
+		if e != 0 {
+			t.Fatalf("create file: %s", e)
+		}
+		write := func(buf []byte) {
+			if e := v.Write(ctx, fe.Inode, buf, 0, fh); e != 0 {
+				t.Fatalf("write file: %s", e)
+			}
+			if e := v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+				t.Fatalf("flush file: %s", e)
+			}
+		}
+		write(old)
+		_, rfh, e := v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+		if e != 0 {
+			t.Fatalf("open file: %s", e)
+		}
+
+		// truncate and write it again (as O_TRUNC) while it's being read
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var attr Attr
+			if e := v.Truncate(ctx, fe.Inode, 0, 1, &attr); e != 0 {
+				t.Errorf("truncate file: %s", e)
+			}
+			write(data)
+		}()
+		buf := make([]byte, 1<<20)
+		var reads int
+		for stop := false; !stop; reads++ {
+			select {
+			case <-done:
+				stop = true
+			default:
+			}
+			off := uint64(reads%10) << 20
+			n, e := v.Read(ctx, fe.Inode, buf, off, rfh)
+			if e != 0 {
+				t.Fatalf("read file at %d: %s", off, e)
+			}
+			if semantics == ReadSnapshot && (n != len(buf) || !bytes.Equal(buf, old[off:off+uint64(n)])) {
+				t.Fatalf("read %d bytes at %d, which is not the data when it's opened", n, off)
+			}
+		}
+		// the shared reader sees the new data at last
+		n, e := v.Read(ctx, fe.Inode, buf, 0, rfh)
+		if e != 0 || n != len(buf) {
+			t.Fatalf("read file: %d %s", n, e)
+		}
+		if expected := map[string][]byte{ReadShared: data, ReadSnapshot: old}[semantics]; !bytes.Equal(buf, expected[:n]) {
+			t.Fatalf("read %q with %s semantics after %d reads, expect %q", buf[0], semantics, reads, expected[0])
+		}
+		v.Release(ctx, fe.Inode, rfh)
+		v.Release(ctx, fe.Inode, fh)
+	}
+}
+
 func TestVFSIO(t *testing.T) {
 	v, _ := createTestVFS()
 	ctx := NewLogContext(meta.Background)
@@ -426,6 +758,27 @@ func TestVFSXattrs(t *testing.T) {
 	if e := v.RemoveXattr(ctx, configInode, "test"); e != syscall.EPERM {
 		t.Fatalf("removexattr test: %s", e)
 	}
+	// compare and swap
+	if e := v.SetXattr(ctx, fe.Inode, "user.jfs.cas.user.lock", []byte("0:v1"), 0); e != 0 {
+		t.Fatalf("cas to create: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "user.jfs.cas.user.lock", []byte("2:v0v2"), 0); e != syscall.ECANCELED {
+		t.Fatalf("cas with wrong value: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "user.jfs.cas.user.lock", []byte("2:v1v2"), 0); e != 0 {
+		t.Fatalf("cas: %s", e)
+	}
+	if value, e := v.GetXattr(ctx, fe.Inode, "user.lock", 0); e != 0 || string(value) != "v2" {
+		t.Fatalf("getxattr after cas: %s %q", e, value)
+	}
+	for _, bad := range []string{"v1", ":v1", "-1:v1", "3:v1"} {
+		if e := v.SetXattr(ctx, fe.Inode, "user.jfs.cas.user.lock", []byte(bad), 0); e != syscall.EINVAL {
+			t.Fatalf("cas with invalid value %q: %s", bad, e)
+		}
+	}
+	if e := v.SetXattr(ctx, fe.Inode, "user.jfs.cas.", []byte("0:v"), 0); e != syscall.EINVAL {
+		t.Fatalf("cas without name: %s", e)
+	}
 }
 
 type accessCase struct {
@@ -481,6 +834,50 @@ func TestSetattrStr(t *testing.T) {
 	assertEqual(t, setattrStr(meta.SetAttrUID|meta.SetAttrGID, 0, 1, 2, 0, 0, 0), "uid=1,gid=2")
 }
 
+func TestNewMode(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	umask := func(m uint16) *uint16 { return &m }
+	cases := []struct {
+		umask             *uint16
+		fileMode, dirMode uint16
+		mode, cumask      uint16
+		file, dir         uint16
+	}{
+		{nil, 0, 0, 0666, 022, 0644, 0644},
+		{umask(002), 0, 0, 0666, 022, 0664, 0664},
+		{umask(0), 0, 0, 0640, 077, 0640, 0640},
+		{umask(002), 0666, 0777, 0600, 077, 0664, 0775},
+		{nil, 0660, 0770, 0644, 022, 0640, 0750},
+		{umask(0), 0660, 0, 02755, 022, 02660, 02755},
+	}
+	for i, c := range cases {
+		v.Conf.Umask, v.Conf.FileMode, v.Conf.DirMode = c.umask, c.fileMode, c.dirMode
+		fe, fh, e := v.Create(ctx, 1, fmt.Sprintf("umask-f%d", i), c.mode, c.cumask, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		if fe.Attr.Mode != c.file {
+			t.Fatalf("case %d: expect mode of file %o, but got %o", i, c.file, fe.Attr.Mode)
+		}
+		de, e := v.Mkdir(ctx, 1, fmt.Sprintf("umask-d%d", i), c.mode, c.cumask)
+		if e != 0 {
+			t.Fatalf("mkdir: %s", e)
+		}
+		if de.Attr.Mode != c.dir {
+			t.Fatalf("case %d: expect mode of directory %o, but got %o", i, c.dir, de.Attr.Mode)
+		}
+		ne, e := v.Mknod(ctx, 1, fmt.Sprintf("umask-n%d", i), syscall.S_IFREG|c.mode, c.cumask, 0)
+		if e != 0 {
+			t.Fatalf("mknod: %s", e)
+		}
+		if ne.Attr.Mode != c.file {
+			t.Fatalf("case %d: expect mode of node %o, but got %o", i, c.file, ne.Attr.Mode)
+		}
+	}
+}
+
 func TestVFSLocks(t *testing.T) {
 	v, _ := createTestVFS()
 	ctx := NewLogContext(meta.Background)
@@ -759,6 +1156,228 @@ func TestInternalFile(t *testing.T) {
 		t.Fatalf("fill result: %s", string(buf[:n]))
 	}
 	off += uint64(n)
+	// fill with stats
+	buf = make([]byte, 4+4+4+1+2+1+1)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.FillCache)
+	w.Put32(9)
+	w.Put32(1)
+	w.Put([]byte("/"))
+	w.Put16(2)
+	w.Put8(0)
+	w.Put8(meta.FillCacheStats)
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write fill: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024*10)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 9 {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if resp[0] != 0 || utils.ReadBuffer(resp[1:n]).Get64() != 0 {
+		t.Fatalf("fill result: %v", resp[:n])
+	}
+	off += uint64(n)
+	// fill with too many threads
+	buf = make([]byte, 4+4+4+1+2+1+1)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.FillCache)
+	w.Put32(9)
+	w.Put32(1)
+	w.Put([]byte("/"))
+	w.Put16(2000)
+	w.Put8(0)
+	w.Put8(meta.FillCacheStats | meta.FillCacheThreads)
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write fill: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024*10)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 11 {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if rb := utils.ReadBuffer(resp[1:n]); resp[0] != 0 || rb.Get64() != 0 || rb.Get16() != maxFillThreads {
+		t.Fatalf("fill result: %v", resp[:n])
+	}
+	off += uint64(n)
+	// fill the files modified after a time
+	if oe, fh2, e := v.Create(ctx, 1, "oldfile", 0644, 0, syscall.O_WRONLY); e != 0 {
+		t.Fatalf("create: %s", e)
+	} else {
+		v.Release(ctx, oe.Inode, fh2)
+	}
+	buf = make([]byte, 4+4+4+1+2+1+1+8)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.FillCache)
+	w.Put32(17)
+	w.Put32(1)
+	w.Put([]byte("/"))
+	w.Put16(2)
+	w.Put8(0)
+	w.Put8(meta.FillCacheStats | meta.FillCacheThreads | meta.FillCacheAfter)
+	w.Put64(uint64(time.Now().Add(time.Hour).UnixNano()))
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write fill: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024*10)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 19 {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if rb := utils.ReadBuffer(resp[1:n]); resp[0] != 0 || rb.Get64() != 0 || rb.Get16() != 2 || rb.Get64() == 0 {
+		t.Fatalf("fill result: %v", resp[:n])
+	}
+	off += uint64(n)
+	// slow operations
+	buf = make([]byte, 4+4+1)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.SlowOps)
+	w.Put32(1)
+	w.Put8(0)
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write slowops: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 4 {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if utils.ReadBuffer(resp[:n]).Get32() != 0 {
+		t.Fatalf("slow operations should not be recorded: %v", resp[:n])
+	}
+	off += uint64(n)
+	// cache space
+	buf = make([]byte, 4+4+4+1)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.CacheSpace)
+	w.Put32(5)
+	w.Put32(1)
+	w.Put([]byte("/"))
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write cachespace: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 25 {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if rb := utils.ReadBuffer(resp[1:n]); resp[0] != 0 || rb.Get64() != uint64(v.Conf.Chunk.CacheSize<<20) {
+		t.Fatalf("cache space: %v", resp[:n])
+	}
+	off += uint64(n)
+	// cache stats, which are reset by the first request
+	resetAt := time.Now()
+	for _, reset := range []uint8{1, 0} {
+		buf = make([]byte, 4+4+1)
+		w = utils.FromBuffer(buf)
+		w.Put32(meta.CacheStats)
+		w.Put32(1)
+		w.Put8(reset)
+		if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+			t.Fatalf("write cachestats: %s", e)
+		}
+		off += uint64(len(buf))
+		resp = make([]byte, 1024)
+		if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n < 4 {
+			t.Fatalf("read result: %s %d", e, n)
+		}
+		off += uint64(n)
+		var stats chunk.CacheStats
+		if err := json.Unmarshal(resp[4:n], &stats); err != nil {
+			t.Fatalf("cache stats %s: %s", resp[4:n], err)
+		}
+		if reset == 0 && stats.Since.Before(resetAt) || reset == 1 && stats.Since.After(resetAt) {
+			t.Fatalf("cache stats since %s, reset at %s", stats.Since, resetAt)
+		}
+	}
+	// refresh credentials, which is not supported by mem
+	buf = make([]byte, 4+4+4+2+4+2+4)
+	w = utils.FromBuffer(buf)
+	w.Put32(meta.RefreshCreds)
+	w.Put32(4 + 2 + 4 + 2 + 4)
+	w.Put32(2)
+	w.Put([]byte("ak"))
+	w.Put32(2)
+	w.Put([]byte("sk"))
+	w.Put32(0)
+	if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+		t.Fatalf("write refreshcreds: %s", e)
+	}
+	off += uint64(len(buf))
+	resp = make([]byte, 1024)
+	if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 1+4+len("not supported") {
+		t.Fatalf("read result: %s %d", e, n)
+	} else if resp[0] != uint8(syscall.EIO) || string(resp[5:n]) != "not supported" {
+		t.Fatalf("refresh credentials: %v", resp[:n])
+	}
+	off += uint64(n)
+
+	// pause and resume the background tasks
+	for _, pause := range []uint8{1, 0} {
+		buf = make([]byte, 4+4+1)
+		w = utils.FromBuffer(buf)
+		w.Put32(meta.PauseBackground)
+		w.Put32(1)
+		w.Put8(pause)
+		if e := v.Write(ctx, fe.Inode, w.Bytes(), off, fh); e != 0 {
+			t.Fatalf("write pausebackground: %s", e)
+		}
+		off += uint64(len(buf))
+		resp = make([]byte, 1024)
+		if n, e = v.Read(ctx, fe.Inode, resp, off, fh); e != 0 || n != 1 || resp[0] != 0 {
+			t.Fatalf("read result: %s %d %v", e, n, resp[:n])
+		}
+		off += uint64(n)
+		if v.Meta.BackgroundPaused() != (pause == 1) {
+			t.Fatalf("background tasks should be paused: %t", pause == 1)
+		}
+		if g := testutil.ToFloat64(v.pausedGauge); g != float64(pause) {
+			t.Fatalf("paused gauge should be %d, but got %f", pause, g)
+		}
+	}
+
+	// snapshots
+	snapshot := func(op uint8, name string, inode Ino) []byte {
+		buf := make([]byte, 4+4+1+1+len(name)+8)
+		w := utils.FromBuffer(buf)
+		w.Put32(meta.ManageSnapshot)
+		w.Put32(uint32(len(buf) - 8))
+		w.Put8(op)
+		w.Put8(uint8(len(name)))
+		w.Put([]byte(name))
+		w.Put64(uint64(inode))
+		if e := v.Write(ctx, fe.Inode, buf, off, fh); e != 0 {
+			t.Fatalf("write snapshot: %s", e)
+		}
+		off += uint64(len(buf))
+		resp := make([]byte, 1024)
+		n, e := v.Read(ctx, fe.Inode, resp, off, fh)
+		if e != 0 || n == 0 {
+			t.Fatalf("read result: %s %d", e, n)
+		}
+		off += uint64(n)
+		return resp[:n]
+	}
+	sdir, e := v.Mkdir(ctx, 1, "sdir", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir sdir: %s", e)
+	}
+	if r := snapshot(meta.SnapshotCreate, "s1", sdir.Inode); len(r) != 1 || r[0] != 0 {
+		t.Fatalf("create snapshot: %v", r)
+	}
+	if r := snapshot(meta.SnapshotCreate, "s1", sdir.Inode); len(r) != 1 || r[0] != uint8(syscall.EEXIST) {
+		t.Fatalf("create an existing snapshot: %v", r)
+	}
+	var snapshots []*meta.Snapshot
+	if r := snapshot(meta.SnapshotList, "", 0); len(r) < 4 {
+		t.Fatalf("list snapshots: %v", r)
+	} else if err := json.Unmarshal(r[4:], &snapshots); err != nil || len(snapshots) != 1 || snapshots[0].Path != "/sdir" {
+		t.Fatalf("snapshots %s: %v", r[4:], err)
+	}
+	if r := snapshot(meta.SnapshotRollback, "s1", 0); len(r) != 1 || r[0] != 0 {
+		t.Fatalf("rollback snapshot: %v", r)
+	}
+	if r := snapshot(meta.SnapshotDelete, "s1", 0); len(r) != 1 || r[0] != 0 {
+		t.Fatalf("delete snapshot: %v", r)
+	}
+	if r := snapshot(meta.SnapshotDelete, "s1", 0); len(r) != 1 || r[0] != uint8(syscall.ENOENT) {
+		t.Fatalf("delete a missing snapshot: %v", r)
+	}
 
 	// invalid msg
 	buf = make([]byte, 4+4+2)
@@ -776,3 +1395,1452 @@ func TestInternalFile(t *testing.T) {
 		t.Fatalf("result: %s", string(resp[:n]))
 	}
 }
+
+type stuckStorage struct {
+	object.ObjectStorage
+	stuck chan struct{}
+}
+
+func (s *stuckStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	<-s.stuck
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestReadTimeout(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "stuck", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write file: %s", e)
+	}
+	if e = v.Fsync(ctx, fe.Inode, 1, fh); e != 0 {
+		t.Fatalf("fsync file: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	// a new client without cached blocks
+	store := &stuckStorage{blob, make(chan struct{})}
+	defer close(store.stuck)
+	conf := *v.Conf
+	conf.ReadTimeout = time.Millisecond * 200
+	v2 := NewVFS(&conf, v.Meta, chunk.NewCachedStore(store, *conf.Chunk))
+	_, fh, e = v2.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open file: %s", e)
+	}
+	defer v2.Release(ctx, fe.Inode, fh)
+	timeouts := testutil.ToFloat64(readTimeouts)
+	start := time.Now()
+	buf := make([]byte, 5)
+	if n, e := v2.Read(ctx, fe.Inode, buf, 0, fh); e != syscall.EIO {
+		t.Fatalf("read from stuck store should fail with EIO, got %d %s", n, e)
+	}
+	if used := time.Since(start); used > time.Second*5 {
+		t.Fatalf("read takes too long: %s", used)
+	}
+	if testutil.ToFloat64(readTimeouts) <= timeouts {
+		t.Fatalf("read timeout is not counted")
+	}
+}
+
+func TestPendingOps(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "pending", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create file: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write file: %s", e)
+	}
+	if e = v.Fsync(ctx, fe.Inode, 1, fh); e != 0 {
+		t.Fatalf("fsync file: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	store := &stuckStorage{blob, make(chan struct{})}
+	conf := *v.Conf
+	conf.ReadTimeout = 0
+	v2 := NewVFS(&conf, v.Meta, chunk.NewCachedStore(store, *conf.Chunk))
+	_, fh, e = v2.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open file: %s", e)
+	}
+	defer v2.Release(ctx, fe.Inode, fh)
+	rctx := NewLogContext(meta.NewContext(100, 1, []uint32{2}))
+	done := make(chan struct{})
+	go func() {
+		BeginOp(rctx, "read", fe.Inode)
+		defer EndOp(rctx)
+		_, _ = v2.Read(rctx, fe.Inode, make([]byte, 5), 0, fh)
+		close(done)
+	}()
+
+	var ops []PendingOp
+	for i := 0; i < 100; i++ {
+		ops = nil
+		resp := v2.handleInternalMsg(ctx, meta.PendingOps, utils.ReadBuffer(nil))
+		if err := json.Unmarshal(resp[4:], &ops); err != nil {
+			t.Fatalf("unmarshal pending operations %q: %s", resp, err)
+		}
+		if len(ops) == 1 && ops[0].Waiting == waitObject {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(ops) != 1 || ops[0].Op != "read" || ops[0].Inode != fe.Inode || ops[0].Pid != 100 || ops[0].Waiting != waitObject {
+		t.Fatalf("pending operations: %+v", ops)
+	}
+	close(store.stuck)
+	<-done
+	if ops = dumpPendingOps(); len(ops) != 0 {
+		t.Fatalf("finished operations are still pending: %+v", ops)
+	}
+}
+
+func TestInodeCache(t *testing.T) {
+	v, _ := createTestVFS()
+	v.cache = newInodeCache(8, time.Millisecond*500)
+	ctx := NewLogContext(meta.NewContext(10, 1, []uint32{2}))
+	de, e := v.Mkdir(ctx, 1, "icache", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir: %s", e)
+	}
+	fe, fh, e := v.Create(ctx, de.Inode, "file", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create: %s", e)
+	}
+	if _, e = v.GetAttr(ctx, fe.Inode, 0); e != 0 {
+		t.Fatalf("getattr: %s", e)
+	}
+	hits := testutil.ToFloat64(inodeCacheHits)
+	if _, e = v.Lookup(ctx, de.Inode, "file"); e != 0 {
+		t.Fatalf("lookup: %s", e)
+	}
+	if _, e = v.Lookup(ctx, de.Inode, "file"); e != 0 {
+		t.Fatalf("lookup: %s", e)
+	}
+	if testutil.ToFloat64(inodeCacheHits) != hits+1 {
+		t.Fatalf("the second lookup should hit the cache")
+	}
+
+	// local changes are visible immediately
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush: %s", e)
+	}
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Length != 5 {
+		t.Fatalf("getattr after write: %s %+v", e, entry)
+	}
+	if entry, e := v.SetAttr(ctx, fe.Inode, meta.SetAttrMode, 0, 0600, 0, 0, 0, 0, 0, 0, 0); e != 0 || entry.Attr.Mode != 0600 {
+		t.Fatalf("setattr: %s", e)
+	}
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Mode != 0600 {
+		t.Fatalf("getattr after setattr: %s %+v", e, entry)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if _, e = v.GetAttr(ctx, fe.Inode, 0); e != 0 {
+		t.Fatalf("getattr: %s", e)
+	}
+
+	// changes from other clients are visible after timeout
+	var attr = &Attr{Mode: 0640}
+	if e = v.Meta.SetAttr(ctx, fe.Inode, meta.SetAttrMode, 0, attr); e != 0 {
+		t.Fatalf("setattr in meta: %s", e)
+	}
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Mode != 0600 {
+		t.Fatalf("getattr should be served by cache: %s %+v", e, entry)
+	}
+	time.Sleep(time.Millisecond * 600)
+	if entry, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || entry.Attr.Mode != 0640 {
+		t.Fatalf("getattr after timeout: %s %+v", e, entry)
+	}
+
+	if e = v.Rename(ctx, de.Inode, "file", de.Inode, "file2", 0); e != 0 {
+		t.Fatalf("rename: %s", e)
+	}
+	if _, e = v.Lookup(ctx, de.Inode, "file"); e != syscall.ENOENT {
+		t.Fatalf("lookup renamed file: %s", e)
+	}
+	if e = v.Unlink(ctx, de.Inode, "file2"); e != 0 {
+		t.Fatalf("unlink: %s", e)
+	}
+	if _, e = v.Lookup(ctx, de.Inode, "file2"); e != syscall.ENOENT {
+		t.Fatalf("lookup unlinked file: %s", e)
+	}
+
+	// entries are filled by readdir
+	for _, name := range []string{"a", "b", "c"} {
+		if _, e = v.Mkdir(ctx, de.Inode, name, 0755, 0); e != 0 {
+			t.Fatalf("mkdir %s: %s", name, e)
+		}
+	}
+	fh, _ = v.Opendir(ctx, de.Inode)
+	if _, e = v.Readdir(ctx, de.Inode, 20, 0, fh, true); e != 0 {
+		t.Fatalf("readdir: %s", e)
+	}
+	v.Releasedir(ctx, de.Inode, fh)
+	hits = testutil.ToFloat64(inodeCacheHits)
+	if _, e = v.Lookup(ctx, de.Inode, "c"); e != 0 || testutil.ToFloat64(inodeCacheHits) != hits+1 {
+		t.Fatalf("lookup after readdir should hit the cache: %s", e)
+	}
+	for i := 0; i < 10; i++ {
+		v.cache.putAttr(v.cache.generation(), Ino(100+i), &Attr{Full: true})
+	}
+	if n := v.cache.lru.Len(); n != 8 {
+		t.Fatalf("cache is not bounded: %d", n)
+	}
+	if v.cache.getAttr(100, attr) || !v.cache.getAttr(109, attr) {
+		t.Fatalf("the least recently used should be evicted")
+	}
+
+	// a stale attribute should not be cached after local changes
+	gen := v.cache.generation()
+	v.cache.invalidate(de.Inode)
+	v.cache.putAttr(gen, de.Inode, &Attr{Full: true})
+	if v.cache.getAttr(de.Inode, attr) {
+		t.Fatalf("stale attribute is cached")
+	}
+	// a changed directory drops its entries
+	gen = v.cache.generation()
+	v.cache.putEntry(gen, de.Inode, "x", 100, &Attr{Full: true})
+	v.cache.putAttr(gen, de.Inode, &Attr{Full: true, Mtime: 1})
+	v.cache.putAttr(gen, de.Inode, &Attr{Full: true, Mtime: 2})
+	var ino Ino
+	if v.cache.lookup(de.Inode, "x", &ino, attr) {
+		t.Fatalf("entries of changed directory should be dropped")
+	}
+}
+
+// flakyMeta returns ENOENT for the getattr of existing inodes for a few times.
+type flakyMeta struct {
+	meta.Meta
+	missing int32
+}
+
+func (m *flakyMeta) GetAttr(ctx meta.Context, inode Ino, attr *Attr) syscall.Errno {
+	if atomic.AddInt32(&m.missing, -1) >= 0 {
+		return syscall.ENOENT
+	}
+	return m.Meta.GetAttr(ctx, inode, attr)
+}
+
+func TestDeletedByOthers(t *testing.T) {
+	v, _ := createTestVFS()
+	v.cache = newInodeCache(100, time.Minute)
+	ctx := NewLogContext(meta.Background)
+	de, _ := v.Mkdir(ctx, 1, "deleted", 0755, 0)
+	sub, _ := v.Mkdir(ctx, de.Inode, "sub", 0755, 0)
+	fe, fh, _ := v.Create(ctx, de.Inode, "file", 0644, 0, syscall.O_RDWR)
+	v.Release(ctx, fe.Inode, fh)
+	for _, name := range []string{"file", "sub"} {
+		if _, e := v.Lookup(ctx, de.Inode, name); e != 0 {
+			t.Fatalf("lookup %s: %s", name, e)
+		}
+	}
+
+	// deleted by another client, which is not visible in the cache
+	if e := v.Meta.Unlink(ctx, de.Inode, "file"); e != 0 {
+		t.Fatalf("unlink in meta: %s", e)
+	}
+	if e := v.Meta.Rmdir(ctx, de.Inode, "sub"); e != 0 {
+		t.Fatalf("rmdir in meta: %s", e)
+	}
+	if entry, e := v.Lookup(ctx, de.Inode, "file"); e != 0 || entry.Inode != fe.Inode {
+		t.Fatalf("lookup should be served by cache: %s", e)
+	}
+	deleted := testutil.ToFloat64(deletedInodes.WithLabelValues("deleted"))
+	if _, _, e := v.Open(ctx, fe.Inode, syscall.O_RDONLY); e != syscall.ENOENT {
+		t.Fatalf("open deleted file: %s", e)
+	}
+	if _, e := v.Lookup(ctx, de.Inode, "file"); e != syscall.ENOENT {
+		t.Fatalf("lookup after the stale entry is dropped: %s", e)
+	}
+	if _, e := v.GetAttr(ctx, fe.Inode, 0); e != syscall.ENOENT {
+		t.Fatalf("getattr after the stale entry is dropped: %s", e)
+	}
+	fh, _ = v.Opendir(ctx, sub.Inode)
+	if _, e := v.Readdir(ctx, sub.Inode, 20, 0, fh, true); e != syscall.ENOENT {
+		t.Fatalf("readdir deleted directory: %s", e)
+	}
+	v.Releasedir(ctx, sub.Inode, fh)
+	if _, e := v.Lookup(ctx, de.Inode, "sub"); e != syscall.ENOENT {
+		t.Fatalf("lookup after the stale directory is dropped: %s", e)
+	}
+	if got := testutil.ToFloat64(deletedInodes.WithLabelValues("deleted")) - deleted; got != 2 {
+		t.Fatalf("expect 2 deleted inodes found in cache, but got %v", got)
+	}
+
+	// transient ENOENT
+	m := &flakyMeta{Meta: v.Meta}
+	v.Meta = m
+	v.cache.clear()
+	atomic.StoreInt32(&m.missing, 1)
+	if _, e := v.GetAttr(ctx, de.Inode, 0); e != syscall.ENOENT {
+		t.Fatalf("getattr without retry: %s", e)
+	}
+	v.Conf.RetryENOENT = true
+	transient := testutil.ToFloat64(deletedInodes.WithLabelValues("transient"))
+	atomic.StoreInt32(&m.missing, 1)
+	if _, e := v.GetAttr(ctx, de.Inode, 0); e != 0 {
+		t.Fatalf("getattr with retry: %s", e)
+	}
+	if got := testutil.ToFloat64(deletedInodes.WithLabelValues("transient")) - transient; got != 1 {
+		t.Fatalf("expect 1 transient ENOENT, but got %v", got)
+	}
+	v.cache.clear()
+	atomic.StoreInt32(&m.missing, 2)
+	if _, e := v.GetAttr(ctx, de.Inode, 0); e != syscall.ENOENT {
+		t.Fatalf("getattr with retry should fail for ENOENT twice: %s", e)
+	}
+}
+
+// downMeta fails the lookup/getattr/open and changes with EIO while it's down, like an unreachable meta.
+type downMeta struct {
+	meta.Meta
+	down int32
+}
+
+func (m *downMeta) isDown() bool { return atomic.LoadInt32(&m.down) == 1 }
+
+func (m *downMeta) Lookup(ctx meta.Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno {
+	if m.isDown() {
+		return syscall.EIO
+	}
+	return m.Meta.Lookup(ctx, parent, name, inode, attr)
+}
+
+func (m *downMeta) GetAttr(ctx meta.Context, inode Ino, attr *Attr) syscall.Errno {
+	if m.isDown() {
+		return syscall.EIO
+	}
+	return m.Meta.GetAttr(ctx, inode, attr)
+}
+
+func (m *downMeta) Open(ctx meta.Context, inode Ino, flags uint32, attr *Attr) syscall.Errno {
+	if m.isDown() && !attr.Full {
+		return syscall.EIO
+	}
+	return m.Meta.Open(ctx, inode, flags, attr)
+}
+
+func (m *downMeta) Create(ctx meta.Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+	if m.isDown() {
+		return syscall.EIO
+	}
+	return m.Meta.Create(ctx, parent, name, mode, cumask, flags, inode, attr)
+}
+
+func TestStaleReads(t *testing.T) {
+	defer func(d time.Duration) { probeInterval = d }(probeInterval)
+	probeInterval = time.Millisecond * 10
+	v0, blob := createTestVFS()
+	m := &downMeta{Meta: v0.Meta}
+	conf := *v0.Conf
+	conf.AllowStaleReads = true
+	v := NewVFS(&conf, m, chunk.NewCachedStore(blob, *conf.Chunk))
+	ctx := NewLogContext(meta.Background)
+	de, e := v.Mkdir(ctx, 1, "stale", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir: %s", e)
+	}
+	fe, fh, e := v.Create(ctx, de.Inode, "file", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush: %s", e)
+	}
+	buf := make([]byte, 5)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 5 {
+		t.Fatalf("read: %d %s", n, e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if _, e = v.Lookup(ctx, de.Inode, "file"); e != 0 {
+		t.Fatalf("lookup: %s", e)
+	}
+	if v.degraded() || testutil.ToFloat64(v.degradedGauge) != 0 {
+		t.Fatalf("should not be degraded")
+	}
+
+	atomic.StoreInt32(&m.down, 1)
+	stale := testutil.ToFloat64(staleReads)
+	entry, e := v.Lookup(ctx, de.Inode, "file")
+	if e != 0 || entry.Inode != fe.Inode || entry.Attr.Length != 5 {
+		t.Fatalf("lookup from stale cache: %s %+v", e, entry)
+	}
+	if !v.degraded() || testutil.ToFloat64(v.degradedGauge) != 1 {
+		t.Fatalf("should be degraded")
+	}
+	if _, e = v.GetAttr(ctx, fe.Inode, 0); e != 0 {
+		t.Fatalf("getattr from stale cache: %s", e)
+	}
+	_, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open from stale cache: %s", e)
+	}
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 5 || string(buf) != "hello" {
+		t.Fatalf("read from stale cache: %d %s %q", n, e, buf)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if got := testutil.ToFloat64(staleReads) - stale; got != 3 {
+		t.Fatalf("stale reads: %v", got)
+	}
+	// writes and new lookups still fail
+	if _, _, e = v.Open(ctx, fe.Inode, syscall.O_RDWR); e != syscall.EIO {
+		t.Fatalf("open for write should fail: %s", e)
+	}
+	if _, _, e = v.Create(ctx, de.Inode, "file2", 0644, 0, syscall.O_RDWR); e != syscall.EIO {
+		t.Fatalf("create should fail: %s", e)
+	}
+	if _, e = v.Lookup(ctx, de.Inode, "unknown"); e != syscall.EIO {
+		t.Fatalf("lookup of uncached entry should fail: %s", e)
+	}
+
+	// recovered automatically
+	atomic.StoreInt32(&m.down, 0)
+	for i := 0; v.degraded(); i++ {
+		if i > 100 {
+			t.Fatalf("should be recovered")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, e = v.Lookup(ctx, de.Inode, "unknown"); e != syscall.ENOENT {
+		t.Fatalf("lookup after recovered: %s", e)
+	}
+}
+
+// appendSlowly appends n small records into a new file in every VFS, with an idle interval longer than
+// the flush timeout between them, and returns the number of slices after fsync.
+func appendSlowly(t testing.TB, vs []*VFS, n int, interval time.Duration) []int {
+	return appendSlowlyIn(t, vs, make([]Ino, len(vs)), n, interval)
+}
+
+// appendSlowlyIn appends to a file in every directory of parents (the root if it's 0) with vs.
+func appendSlowlyIn(t testing.TB, vs []*VFS, parents []Ino, n int, interval time.Duration) []int {
+	ctx := NewLogContext(meta.Background)
+	inodes := make([]Ino, len(vs))
+	fhs := make([]uint64, len(vs))
+	for i, v := range vs {
+		parent := parents[i]
+		if parent == 0 {
+			parent = 1
+		}
+		fe, fh, e := v.Create(ctx, parent, fmt.Sprintf("append-%d-%d", i, time.Now().UnixNano()), 0644, 0, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create file: %s", e)
+		}
+		inodes[i], fhs[i] = fe.Inode, fh
+	}
+	record := []byte("a small record of log\n")
+	for j := 0; j < n; j++ {
+		if j > 0 {
+			time.Sleep(interval)
+		}
+		for i, v := range vs {
+			if e := v.Write(ctx, inodes[i], record, uint64(j*len(record)), fhs[i]); e != 0 {
+				t.Fatalf("write file: %s", e)
+			}
+		}
+	}
+	counts := make([]int, len(vs))
+	for i, v := range vs {
+		if e := v.Fsync(ctx, inodes[i], 1, fhs[i]); e != 0 {
+			t.Fatalf("fsync file: %s", e)
+		}
+		buf := make([]byte, n*len(record))
+		if m, e := v.Read(ctx, inodes[i], buf, 0, fhs[i]); e != 0 || m != len(buf) || string(buf[len(buf)-len(record):]) != string(record) {
+			t.Fatalf("read file: %d %s", m, e)
+		}
+		v.Release(ctx, inodes[i], fhs[i])
+		var slices []meta.Slice
+		if e := v.Meta.Read(ctx, inodes[i], 0, &slices); e != 0 {
+			t.Fatalf("read slices: %s", e)
+		}
+		counts[i] = len(slices)
+	}
+	return counts
+}
+
+func TestWriteCombine(t *testing.T) {
+	v, blob := createTestVFS()
+	conf := *v.Conf
+	conf.WriteCombine = time.Minute
+	v2 := NewVFS(&conf, v.Meta, chunk.NewCachedStore(blob, *conf.Chunk))
+
+	flushed := testutil.ToFloat64(flushedSlices)
+	combined := testutil.ToFloat64(combinedWrites)
+	counts := appendSlowly(t, []*VFS{v, v2}, 3, time.Millisecond*1300)
+	if counts[0] != 3 {
+		t.Fatalf("idle slices should be flushed without combining, got %d slices", counts[0])
+	}
+	if counts[1] != 1 {
+		t.Fatalf("small appends should be combined into one slice, got %d slices", counts[1])
+	}
+	if n := testutil.ToFloat64(flushedSlices) - flushed; n != 4 {
+		t.Fatalf("flushed slices: %f", n)
+	}
+	if n := testutil.ToFloat64(combinedWrites) - combined; n != 2 {
+		t.Fatalf("combined writes: %f", n)
+	}
+}
+
+// BenchmarkAppendSlices reports the number of slices created by tiny appends with idle gaps,
+// every iteration takes more than one second, run it with -benchtime=10x.
+func BenchmarkAppendSlices(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Minute} {
+		b.Run(fmt.Sprintf("window=%s", window), func(b *testing.B) {
+			v, blob := createTestVFS()
+			conf := *v.Conf
+			conf.WriteCombine = window
+			v = NewVFS(&conf, v.Meta, chunk.NewCachedStore(blob, *conf.Chunk))
+			b.ResetTimer()
+			counts := appendSlowly(b, []*VFS{v}, b.N, time.Millisecond*1100)
+			b.ReportMetric(float64(counts[0])/float64(b.N), "slices/op")
+		})
+	}
+}
+
+// hintMeta records the compaction hints of the files.
+type hintMeta struct {
+	meta.Meta
+	sync.Mutex
+	compact map[Ino]int
+}
+
+func (m *hintMeta) SetCompactHint(inode Ino, slices int, bytes uint64) {
+	m.Lock()
+	m.compact[inode] = slices
+	m.Unlock()
+	m.Meta.SetCompactHint(inode, slices, bytes)
+}
+
+func TestWriteHints(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		hints *writeHints
+	}{
+		{"", &writeHints{}},
+		{"write-combine=10s, write-combine-size=64", &writeHints{combineWindow: time.Second * 10, combineSize: 64 << 20}},
+		{"write-combine=0,compact-slices=20,compact-size=128", &writeHints{combineWindow: -1, compactSlices: 20, compactBytes: 128 << 20}},
+		{"write-combine", nil},
+		{"compact-slices=0", nil},
+		{"block-size=1", nil},
+	} {
+		if h, err := parseWriteHints(c.value); !reflect.DeepEqual(h, c.hints) {
+			t.Fatalf("parse %q: expect %+v, but got %+v (%v)", c.value, c.hints, h, err)
+		}
+	}
+
+	v, blob := createTestVFS()
+	m := &hintMeta{Meta: v.Meta, compact: make(map[Ino]int)}
+	v = NewVFS(v.Conf, m, chunk.NewCachedStore(blob, *v.Conf.Chunk))
+	ctx := NewLogContext(meta.Background)
+	logs, e := v.Mkdir(ctx, 1, "logs", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir: %s", e)
+	}
+	sub, e := v.Mkdir(ctx, logs.Inode, "app", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir: %s", e)
+	}
+	if e = v.SetXattr(ctx, logs.Inode, writeHintsXattr, []byte("write-combine=xx"), 0); e != syscall.EINVAL {
+		t.Fatalf("invalid hints should be rejected: %s", e)
+	}
+	if e = v.SetXattr(ctx, logs.Inode, writeHintsXattr, []byte("write-combine=1m,compact-slices=20"), 0); e != 0 {
+		t.Fatalf("set hints: %s", e)
+	}
+	// the small appends are combined in the subtree only
+	counts := appendSlowlyIn(t, []*VFS{v, v}, []Ino{1, sub.Inode}, 3, time.Millisecond*1300)
+	if counts[0] != 3 || counts[1] != 1 {
+		t.Fatalf("expect 3 slices out of the subtree and 1 in it, but got %v", counts)
+	}
+	m.Lock()
+	if len(m.compact) != 1 {
+		t.Fatalf("the compaction hint should be set for the file in the subtree only: %v", m.compact)
+	}
+	for _, n := range m.compact {
+		if n != 20 {
+			t.Fatalf("expect compact-slices 20, but got %d", n)
+		}
+	}
+	m.Unlock()
+
+	// the nearest one wins, and a change is seen at once by the same client
+	if e = v.SetXattr(ctx, sub.Inode, writeHintsXattr, []byte("write-combine=0"), 0); e != 0 {
+		t.Fatalf("set hints: %s", e)
+	}
+	if h := v.writeHints(sub.Inode); h == nil || h.combineWindow != -1 || h.compactSlices != 0 {
+		t.Fatalf("hints of app: %+v", h)
+	}
+	if e = v.RemoveXattr(ctx, logs.Inode, writeHintsXattr); e != 0 {
+		t.Fatalf("remove hints: %s", e)
+	}
+	if h := v.writeHints(logs.Inode); h != nil {
+		t.Fatalf("hints of logs should be removed: %+v", h)
+	}
+}
+
+// BenchmarkWriteHints reports the number of slices created by two workloads sharing one volume:
+// small appends with idle gaps to a log (combined into one slice by the hints of its directory),
+// and small writes to a database which should be committed promptly. Every iteration takes more
+// than one second, run it with -benchtime=10x.
+func BenchmarkWriteHints(b *testing.B) {
+	for _, hints := range []bool{false, true} {
+		b.Run(fmt.Sprintf("hints=%v", hints), func(b *testing.B) {
+			v, _ := createTestVFS()
+			ctx := NewLogContext(meta.Background)
+			logs, _ := v.Mkdir(ctx, 1, "logs", 0755, 0)
+			db, _ := v.Mkdir(ctx, 1, "db", 0755, 0)
+			if hints {
+				_ = v.SetXattr(ctx, logs.Inode, writeHintsXattr, []byte("write-combine=1m,write-combine-size=64"), 0)
+				_ = v.SetXattr(ctx, db.Inode, writeHintsXattr, []byte("write-combine=0,compact-slices=10"), 0)
+			}
+			b.ResetTimer()
+			counts := appendSlowlyIn(b, []*VFS{v, v}, []Ino{logs.Inode, db.Inode}, b.N, time.Millisecond*1100)
+			b.ReportMetric(float64(counts[0])/float64(b.N), "log-slices/op")
+			b.ReportMetric(float64(counts[1])/float64(b.N), "db-slices/op")
+		})
+	}
+}
+
+// readAll lists the directory like the kernel, which takes at most n entries in a call.
+func readAll(t testing.TB, v *VFS, ctx Context, ino Ino, fh uint64, n int) []string {
+	var names []string
+	for off := 0; ; {
+		entries, e := v.Readdir(ctx, ino, 4096, off, fh, true)
+		if e != 0 {
+			t.Fatalf("readdir %d at %d: %s", ino, off, e)
+		}
+		if len(entries) == 0 {
+			return names
+		}
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+		for _, e := range entries {
+			names = append(names, string(e.Name))
+		}
+		off += len(entries)
+	}
+}
+
+func TestReaddirPages(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, _ := v.Mkdir(ctx, 1, "pages", 0755, 022)
+	for i := 0; i < 50; i++ {
+		fe, fh, e := v.Create(ctx, de.Inode, fmt.Sprintf("f%02d", i), 0644, 022, uint32(syscall.O_WRONLY))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+	fh, _ := v.Opendir(ctx, de.Inode)
+	defer v.Releasedir(ctx, de.Inode, fh)
+	all := readAll(t, v, ctx, de.Inode, fh, 1000)
+	if len(all) != 52 {
+		t.Fatalf("expect 52 entries, but got %d", len(all))
+	}
+
+	sort.Strings(all)
+	v.Conf.ReaddirPageSize = 7
+	defer func() { v.Conf.ReaddirPageSize = 0 }()
+	for _, n := range []int{1, 5, 7, 100} {
+		if names := readAll(t, v, ctx, de.Inode, fh, n); !reflect.DeepEqual(names, all) {
+			t.Fatalf("read %d entries at a time: %v", n, names)
+		}
+	}
+	// seek back to a dropped page
+	entries, _ := v.Readdir(ctx, de.Inode, 4096, 30, fh, true)
+	if len(entries) == 0 || string(entries[0].Name) != all[30] {
+		t.Fatalf("readdir at 30: %d entries", len(entries))
+	}
+	if entries, _ = v.Readdir(ctx, de.Inode, 4096, 3, fh, true); len(entries) == 0 || string(entries[0].Name) != all[3] || !entries[0].Attr.Full {
+		t.Fatalf("readdir at 3: %d entries", len(entries))
+	}
+	// the entries removed before listed are skipped
+	_ = v.Unlink(ctx, de.Inode, "f49")
+	if names := readAll(t, v, ctx, de.Inode, fh, 5); len(names) != 51 || names[50] == "f49" {
+		t.Fatalf("list after unlink: %v", names)
+	}
+
+	// internal files are in the last page of root
+	rfh, _ := v.Opendir(ctx, 1)
+	defer v.Releasedir(ctx, 1, rfh)
+	names := readAll(t, v, ctx, 1, rfh, 3)
+	if len(names) != 3+len(internalNodes) || names[len(names)-1] != internalNodes[len(internalNodes)-1].name {
+		t.Fatalf("list root: %v", names)
+	}
+}
+
+// BenchmarkReaddir reports the peak heap used to list a directory with 2M entries.
+func BenchmarkReaddir(b *testing.B) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, _ := v.Mkdir(ctx, 1, "big", 0755, 022)
+	var inode Ino
+	for i := 0; i < 2000000; i++ {
+		if st := v.Meta.Mknod(meta.Background, de.Inode, fmt.Sprintf("file-%07d", i), meta.TypeFile, 0644, 022, 0, &inode, nil); st != 0 {
+			b.Fatalf("mknod: %s", st)
+		}
+	}
+	for _, size := range []int{0, 10000} {
+		b.Run(fmt.Sprintf("page-%d", size), func(b *testing.B) {
+			v.Conf.ReaddirPageSize = size
+			var peak uint64
+			var ms runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&ms)
+			base := ms.HeapInuse // mostly the memkv engine
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				fh, _ := v.Opendir(ctx, de.Inode)
+				for off, calls := 0, 0; ; calls++ {
+					entries, e := v.Readdir(ctx, de.Inode, 4096, off, fh, true)
+					if e != 0 {
+						b.Fatalf("readdir: %s", e)
+					}
+					if len(entries) == 0 {
+						break
+					}
+					if len(entries) > 100 {
+						entries = entries[:100]
+					}
+					off += len(entries)
+					if calls%5000 == 0 {
+						runtime.GC()
+						runtime.ReadMemStats(&ms)
+						if ms.HeapInuse > base+peak {
+							peak = ms.HeapInuse - base
+						}
+					}
+				}
+				v.Releasedir(ctx, de.Inode, fh)
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+// slowPutStore delays every PUT, as uploading into a remote object storage.
+type slowPutStore struct {
+	object.ObjectStorage
+	delay time.Duration
+	puts  int32
+}
+
+func (s *slowPutStore) Put(key string, in io.Reader) error {
+	time.Sleep(s.delay)
+	atomic.AddInt32(&s.puts, 1)
+	return s.ObjectStorage.Put(key, in)
+}
+
+func createFsyncVFS(policy string, delay time.Duration) (*VFS, *slowPutStore) {
+	v, blob := createTestVFS()
+	conf := *v.Conf
+	conf.FsyncPolicy = policy
+	slow := &slowPutStore{ObjectStorage: blob, delay: delay}
+	return NewVFS(&conf, v.Meta, chunk.NewCachedStore(slow, *conf.Chunk)), slow
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	ctx := NewLogContext(meta.Background)
+	for _, policy := range []string{FsyncBoth, FsyncData, FsyncMeta} {
+		v, blob := createFsyncVFS(policy, time.Millisecond*200)
+		fe, fh, e := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_RDWR))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+			t.Fatalf("write: %s", e)
+		}
+		start := time.Now()
+		if e = v.Fsync(ctx, fe.Inode, 0, fh); e != 0 {
+			t.Fatalf("fsync (%s): %s", policy, e)
+		}
+		used := time.Since(start)
+		var slices []meta.Slice
+		_ = v.Meta.Read(meta.Background, fe.Inode, 0, &slices)
+		switch policy {
+		case FsyncBoth:
+			if used < time.Millisecond*200 || atomic.LoadInt32(&blob.puts) != 1 || len(slices) != 1 {
+				t.Fatalf("fsync (%s) should wait for the data and the slice: %s, %d objects, %d slices", policy, used, blob.puts, len(slices))
+			}
+		case FsyncData:
+			if used < time.Millisecond*200 || atomic.LoadInt32(&blob.puts) != 1 {
+				t.Fatalf("fsync (%s) should wait for the data: %s, %d objects", policy, used, blob.puts)
+			}
+		case FsyncMeta:
+			if used > time.Millisecond*100 || atomic.LoadInt32(&blob.puts) != 0 || len(slices) != 0 {
+				t.Fatalf("fsync (%s) should not wait for the data: %s, %d objects, %d slices", policy, used, blob.puts, len(slices))
+			}
+		}
+		// the data is always persisted on flush
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush: %s", e)
+		}
+		if _ = v.Meta.Read(meta.Background, fe.Inode, 0, &slices); len(slices) != 1 || slices[0].Len != 5 {
+			t.Fatalf("slices after flush (%s): %+v", policy, slices)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+}
+
+func TestRenameDurability(t *testing.T) {
+	ctx := NewLogContext(meta.Background)
+	for _, c := range []struct {
+		durability string
+		fsync      bool
+		durable    bool
+	}{
+		{RenameNone, true, false},
+		{RenameFsynced, false, false},
+		{RenameFsynced, true, true},
+		{RenameAlways, false, true},
+	} {
+		// fsync doesn't commit the data with FsyncMeta
+		v, _ := createFsyncVFS(FsyncMeta, time.Millisecond*200)
+		v.Conf.RenameDurability = c.durability
+		fe, fh, e := v.Create(ctx, 1, "f.tmp", 0644, 022, uint32(syscall.O_RDWR))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+			t.Fatalf("write: %s", e)
+		}
+		if c.fsync {
+			if e = v.Fsync(ctx, fe.Inode, 0, fh); e != 0 {
+				t.Fatalf("fsync: %s", e)
+			}
+		}
+		if e = v.Rename(ctx, 1, "f.tmp", 1, "f", 0); e != 0 {
+			t.Fatalf("rename: %s", e)
+		}
+		// what's left in meta engine if the client crashes right after the rename
+		var inode Ino
+		var attr = &Attr{}
+		if e = v.Meta.Lookup(meta.Background, 1, "f", &inode, attr); e != 0 || inode != fe.Inode {
+			t.Fatalf("lookup renamed file: %s", e)
+		}
+		if durable := attr.Length == 5; durable != c.durable {
+			t.Fatalf("rename (%s, fsync: %v) should be durable: %v, but the length is %d", c.durability, c.fsync, c.durable, attr.Length)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+}
+
+// BenchmarkFsync reports the latency of fsync after a 4 KiB write with every policy, the object storage takes
+// 20ms for a PUT.
+func BenchmarkFsync(b *testing.B) {
+	ctx := NewLogContext(meta.Background)
+	data := make([]byte, 4096)
+	for _, policy := range []string{FsyncBoth, FsyncData, FsyncMeta} {
+		b.Run(policy, func(b *testing.B) {
+			v, _ := createFsyncVFS(policy, time.Millisecond*20)
+			fe, fh, e := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_RDWR))
+			if e != 0 {
+				b.Fatalf("create: %s", e)
+			}
+			defer v.Release(ctx, fe.Inode, fh)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if e = v.Write(ctx, fe.Inode, data, uint64(i*len(data)), fh); e != 0 {
+					b.Fatalf("write: %s", e)
+				}
+				b.StartTimer()
+				if e = v.Fsync(ctx, fe.Inode, 0, fh); e != 0 {
+					b.Fatalf("fsync: %s", e)
+				}
+			}
+		})
+	}
+}
+
+func TestAtimeMode(t *testing.T) {
+	ctx := NewLogContext(meta.Background)
+	for _, mode := range []string{meta.NoAtime, meta.RelAtime, meta.StrictAtime} {
+		v, _ := createTestVFS()
+		v.Conf.Meta.AtimeMode = mode
+		fe, fh, e := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_RDWR))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		_ = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh)
+		_ = v.Flush(ctx, fe.Inode, fh, 0)
+		v.Release(ctx, fe.Inode, fh)
+		attr := &Attr{Atime: time.Now().Unix() - 86400*2}
+		if e = v.Meta.SetAttr(meta.Background, fe.Inode, meta.SetAttrAtime, 0, attr); e != 0 {
+			t.Fatalf("setattr: %s", e)
+		}
+		atime := func() int64 {
+			var a Attr
+			_ = v.Meta.GetAttr(meta.Background, fe.Inode, &a)
+			return a.Atime*1e9 + int64(a.Atimensec)
+		}
+		old := atime()
+
+		_, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+		if e != 0 {
+			t.Fatalf("open: %s", e)
+		}
+		buf := make([]byte, 5)
+		if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 5 {
+			t.Fatalf("read: %d %s", n, e)
+		}
+		first := atime()
+		time.Sleep(time.Millisecond * 10)
+		_, _ = v.Read(ctx, fe.Inode, buf, 0, fh)
+		second := atime()
+		v.Release(ctx, fe.Inode, fh)
+		switch mode {
+		case meta.NoAtime:
+			if first != old || second != old {
+				t.Fatalf("atime should not be updated with %s: %d %d %d", mode, old, first, second)
+			}
+		case meta.RelAtime:
+			if first <= old || second != first {
+				t.Fatalf("atime should be updated once with %s: %d %d %d", mode, old, first, second)
+			}
+		case meta.StrictAtime:
+			if first <= old || second <= first {
+				t.Fatalf("atime should be updated on every read with %s: %d %d %d", mode, old, first, second)
+			}
+		}
+	}
+}
+
+func TestBypassCache(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	d1, e := v.Mkdir(ctx, 1, "d1", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir d1: %s", e)
+	}
+	d2, e := v.Mkdir(ctx, d1.Inode, "d2", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir d2: %s", e)
+	}
+	d3, e := v.Mkdir(ctx, 1, "d3", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir d3: %s", e)
+	}
+	if v.bypassCache(d2.Inode) || v.bypassCache(d3.Inode) {
+		t.Fatalf("no directory should bypass cache")
+	}
+
+	if e = v.SetXattr(ctx, d1.Inode, noCacheXattr, []byte("1"), 0); e != 0 {
+		t.Fatalf("setxattr: %s", e)
+	}
+	if !v.bypassCache(d2.Inode) || v.bypassCache(d3.Inode) {
+		t.Fatalf("only d1/d2 should bypass cache")
+	}
+	fe, fh, e := v.Create(ctx, d2.Inode, "f", 0644, 022, uint32(syscall.O_RDWR))
+	if e != 0 {
+		t.Fatalf("create: %s", e)
+	}
+	h := v.findHandle(fe.Inode, fh)
+	if !h.reader.(*fileReader).nocache || !h.writer.(*fileWriter).nocache {
+		t.Fatalf("file in d1/d2 should bypass cache")
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	if e = v.RemoveXattr(ctx, d1.Inode, noCacheXattr); e != 0 {
+		t.Fatalf("removexattr: %s", e)
+	}
+	if v.bypassCache(d2.Inode) {
+		t.Fatalf("d1/d2 should not bypass cache any more")
+	}
+	v.BypassCache([]string{"/d3"})
+	if !v.bypassCache(d3.Inode) || v.bypassCache(d2.Inode) {
+		t.Fatalf("only d3 should bypass cache")
+	}
+}
+
+// TestCopyShared checks that a copy by copy_file_range (used by `cp --reflink=auto` on JuiceFS)
+// shares the data with the source until it's modified.
+func TestCopyShared(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	objects := func() int {
+		objs, err := blob.List("", "", 10000)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		return len(objs)
+	}
+	src, fh, e := v.Create(ctx, 1, "src", 0644, 022, uint32(syscall.O_RDWR))
+	if e != 0 {
+		t.Fatalf("create src: %s", e)
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if e = v.Write(ctx, src.Inode, data, 0, fh); e != 0 {
+		t.Fatalf("write src: %s", e)
+	}
+	if e = v.Flush(ctx, src.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush src: %s", e)
+	}
+	v.Release(ctx, src.Inode, fh)
+	before := objects()
+
+	dst, fh, e := v.Create(ctx, 1, "dst", 0644, 022, uint32(syscall.O_RDWR))
+	if e != 0 {
+		t.Fatalf("create dst: %s", e)
+	}
+	_, sfh, e := v.Open(ctx, src.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open src: %s", e)
+	}
+	if n, e := v.CopyFileRange(ctx, src.Inode, sfh, 0, dst.Inode, fh, 0, uint64(len(data)), 0); e != 0 || n != uint64(len(data)) {
+		t.Fatalf("copy: %d %s", n, e)
+	}
+	v.Release(ctx, src.Inode, sfh)
+	var ss, ds []meta.Slice
+	_ = v.Meta.Read(ctx, src.Inode, 0, &ss)
+	_ = v.Meta.Read(ctx, dst.Inode, 0, &ds)
+	if len(ds) == 0 || len(ss) == 0 || ds[0].Chunkid != ss[0].Chunkid || objects() != before {
+		t.Fatalf("the copy should share the data: %+v %+v, objects %d -> %d", ss, ds, before, objects())
+	}
+
+	// copy on write
+	if e = v.Write(ctx, dst.Inode, []byte("changed"), 0, fh); e != 0 {
+		t.Fatalf("write dst: %s", e)
+	}
+	if e = v.Flush(ctx, dst.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush dst: %s", e)
+	}
+	v.Release(ctx, dst.Inode, fh)
+	if objects() == before {
+		t.Fatalf("the changed data should be written into new objects")
+	}
+	if e = v.Unlink(ctx, 1, "src"); e != 0 {
+		t.Fatalf("unlink src: %s", e)
+	}
+	_, fh, e = v.Open(ctx, dst.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open dst: %s", e)
+	}
+	buf := make([]byte, len(data))
+	if n, e := v.Read(ctx, dst.Inode, buf, 0, fh); e != 0 || n != len(buf) {
+		t.Fatalf("read dst: %d %s", n, e)
+	}
+	v.Release(ctx, dst.Inode, fh)
+	if string(buf[:7]) != "changed" || !bytes.Equal(buf[7:], data[7:]) {
+		t.Fatalf("unexpected content of dst after the source is removed")
+	}
+}
+
+type uncachedCounter struct {
+	chunk.ChunkStore
+	cached, uncached int32
+}
+
+func (s *uncachedCounter) NewWriter(chunkid uint64) chunk.Writer {
+	atomic.AddInt32(&s.cached, 1)
+	return s.ChunkStore.NewWriter(chunkid)
+}
+
+func (s *uncachedCounter) NewUncachedWriter(chunkid uint64) chunk.Writer {
+	atomic.AddInt32(&s.uncached, 1)
+	return s.ChunkStore.NewUncachedWriter(chunkid)
+}
+
+func TestWriteCacheLimit(t *testing.T) {
+	v, _ := createTestVFS()
+	w := v.writer.(*dataWriter)
+	store := &uncachedCounter{ChunkStore: w.store}
+	w.store = store
+	w.cacheLimit = 1 << 20
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "big", 0644, 022, uint32(syscall.O_RDWR))
+	if e != 0 {
+		t.Fatalf("create: %s", e)
+	}
+	data := make([]byte, 256<<10)
+	for off := uint64(0); off < 2<<20; off += uint64(len(data)) {
+		if e = v.Write(ctx, fe.Inode, data, off, fh); e != 0 {
+			t.Fatalf("write at %d: %s", off, e)
+		}
+		// one slice per write
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush: %s", e)
+		}
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if store.cached != 4 || store.uncached != 4 {
+		t.Fatalf("expect 4 cached and 4 uncached slices, but got %d and %d", store.cached, store.uncached)
+	}
+	_, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open: %s", e)
+	}
+	buf := make([]byte, 2<<20)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != len(buf) {
+		t.Fatalf("read: %d %s", n, e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+}
+
+// failingStore fails the upload of the nth slice, as the object storage goes down in the middle.
+type failingStore struct {
+	chunk.ChunkStore
+	fail    int32
+	writers int32
+}
+
+type failingWriter struct {
+	chunk.Writer
+}
+
+func (w *failingWriter) Finish(length int) error {
+	return fmt.Errorf("injected failure")
+}
+
+func (s *failingStore) NewWriter(chunkid uint64) chunk.Writer {
+	if atomic.AddInt32(&s.writers, 1) == s.fail {
+		return &failingWriter{s.ChunkStore.NewWriter(chunkid)}
+	}
+	return s.ChunkStore.NewWriter(chunkid)
+}
+
+func TestWriteFailure(t *testing.T) {
+	ctx := NewLogContext(meta.Background)
+	data := make([]byte, 1<<20)
+	for _, mode := range []string{WriteFailureReport, WriteFailureRollback} {
+		v, blob := createTestVFS()
+		v.Conf.WriteFailure = mode
+		w := NewDataWriter(v.Conf, v.Meta, v.writer.(*dataWriter).store, v.reader).(*dataWriter)
+		store := &failingStore{ChunkStore: w.store, fail: 3}
+		w.store = store
+		v.writer = w
+		fe, fh, e := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_RDWR))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		if e = v.Write(ctx, fe.Inode, data, 0, fh); e != 0 {
+			t.Fatalf("write: %s", e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush: %s", e)
+		}
+		// one slice in every chunk, the one at 128 MiB fails
+		for i := uint64(1); i <= 3; i++ {
+			if e = v.Write(ctx, fe.Inode, data, i*meta.ChunkSize, fh); e != 0 {
+				t.Fatalf("write at chunk %d: %s", i, e)
+			}
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != syscall.EIO {
+			t.Fatalf("flush (%s) should fail: %s", mode, e)
+		}
+		offset, e := v.GetXattr(ctx, fe.Inode, durableOffsetXattr, 0)
+		var attr Attr
+		_ = v.Meta.GetAttr(meta.Background, fe.Inode, &attr)
+		var slices []meta.Slice
+		objs, _ := blob.List("", "", 100)
+		switch mode {
+		case WriteFailureReport:
+			// the data below 128 MiB is durable, and the slices after it are kept
+			if e != 0 || string(offset) != fmt.Sprint(2*meta.ChunkSize) {
+				t.Fatalf("durable offset (%s): %q %s", mode, offset, e)
+			}
+			if _ = v.Meta.Read(meta.Background, fe.Inode, 1, &slices); len(slices) != 1 {
+				t.Fatalf("slices of chunk 1 (%s): %+v", mode, slices)
+			}
+			if attr.Length != 3*meta.ChunkSize+1<<20 {
+				t.Fatalf("length (%s): %d", mode, attr.Length)
+			}
+		case WriteFailureRollback:
+			// the file is rolled back to the last flush
+			if e != meta.ENOATTR {
+				t.Fatalf("durable offset (%s): %q %s", mode, offset, e)
+			}
+			if _ = v.Meta.Read(meta.Background, fe.Inode, 1, &slices); len(slices) != 0 {
+				t.Fatalf("slices of chunk 1 (%s): %+v", mode, slices)
+			}
+			if attr.Length != 1<<20 {
+				t.Fatalf("length (%s): %d", mode, attr.Length)
+			}
+			if len(objs) != 1 {
+				t.Fatalf("the objects rolled back should be removed: %d left", len(objs))
+			}
+		}
+		if e = v.Write(ctx, fe.Inode, data, 0, fh); e != syscall.EIO {
+			t.Fatalf("write after failure (%s): %s", mode, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		for w.find(fe.Inode) != nil {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if _, e = v.GetXattr(ctx, fe.Inode, durableOffsetXattr, 0); e != meta.ENOATTR {
+			t.Fatalf("durable offset should be cleared after released: %s", e)
+		}
+
+		// resume in a new handle
+		_, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("open: %s", e)
+		}
+		if e = v.Write(ctx, fe.Inode, data, 2*meta.ChunkSize, fh); e != 0 {
+			t.Fatalf("write: %s", e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush: %s", e)
+		}
+		if _, e = v.GetXattr(ctx, fe.Inode, durableOffsetXattr, 0); e != meta.ENOATTR {
+			t.Fatalf("durable offset should be cleared after written successfully: %s", e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+}
+
+func TestReaddirOrder(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, _ := v.Mkdir(ctx, 1, "order", 0755, 022)
+	// created in reverse order of names, with mtime in neither order
+	names := []string{"e", "d", "c", "b", "a"}
+	mtimes := []int64{300, 100, 500, 200, 400}
+	for i, name := range names {
+		fe, fh, e := v.Create(ctx, de.Inode, name, 0644, 022, uint32(syscall.O_WRONLY))
+		if e != 0 {
+			t.Fatalf("create: %s", e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		if e = v.Meta.SetAttr(ctx, fe.Inode, meta.SetAttrMtime, 0, &Attr{Mtime: mtimes[i]}); e != 0 {
+			t.Fatalf("set mtime: %s", e)
+		}
+	}
+	defer func() { v.Conf.ReaddirOrder, v.Conf.ReaddirPageSize = "", 0 }()
+	for _, c := range []struct {
+		order    string
+		expected []string
+	}{
+		{OrderName, []string{".", "..", "a", "b", "c", "d", "e"}},
+		{OrderInode, []string{".", "..", "e", "d", "c", "b", "a"}},
+		{OrderMtime, []string{".", "..", "d", "b", "e", "a", "c"}},
+	} {
+		v.Conf.ReaddirOrder = c.order
+		for _, size := range []int{0, 100} {
+			v.Conf.ReaddirPageSize = size
+			fh, _ := v.Opendir(ctx, de.Inode)
+			if got := readAll(t, v, ctx, de.Inode, fh, 1000); !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("readdir by %s (page size %d): %v", c.order, size, got)
+			}
+			v.Releasedir(ctx, de.Inode, fh)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	v, _ := createTestVFS()
+	v.Conf.MaxDepth = 3
+	ctx := NewLogContext(meta.Background)
+	// depth of /a/b/c is 3
+	dirs := []Ino{1}
+	for _, name := range []string{"a", "b", "c"} {
+		e, err := v.Mkdir(ctx, dirs[len(dirs)-1], name, 0755, 022)
+		if err != 0 {
+			t.Fatalf("mkdir %s: %s", name, err)
+		}
+		dirs = append(dirs, e.Inode)
+	}
+	parent := dirs[3]
+	if _, err := v.Mkdir(ctx, parent, "d", 0755, 022); err != syscall.ENAMETOOLONG {
+		t.Fatalf("mkdir too deep: %s", err)
+	}
+	if _, _, err := v.Create(ctx, parent, "f", 0644, 022, uint32(syscall.O_WRONLY)); err != syscall.ENAMETOOLONG {
+		t.Fatalf("create too deep: %s", err)
+	}
+	if _, err := v.Mknod(ctx, parent, "n", syscall.S_IFIFO|0644, 022, 0); err != syscall.ENAMETOOLONG {
+		t.Fatalf("mknod too deep: %s", err)
+	}
+	if _, err := v.Symlink(ctx, "/a", parent, "s"); err != syscall.ENAMETOOLONG {
+		t.Fatalf("symlink too deep: %s", err)
+	}
+	fe, fh, err := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_WRONLY))
+	if err != 0 {
+		t.Fatalf("create: %s", err)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if err = v.Rename(ctx, 1, "f", parent, "f", 0); err != syscall.ENAMETOOLONG {
+		t.Fatalf("rename too deep: %s", err)
+	}
+	if _, err = v.Link(ctx, fe.Inode, parent, "l"); err != syscall.ENAMETOOLONG {
+		t.Fatalf("link too deep: %s", err)
+	}
+
+	// move /a/b to the root, the depths are not cached any more
+	if err = v.Rename(ctx, dirs[1], "b", 1, "b", 0); err != 0 {
+		t.Fatalf("rename: %s", err)
+	}
+	if _, err = v.Mkdir(ctx, parent, "d", 0755, 022); err != 0 {
+		t.Fatalf("mkdir /b/c/d: %s", err)
+	}
+	// no limit with 0
+	v.depths.reset()
+	v.Conf.MaxDepth = 0
+	if _, err = v.Mkdir(ctx, parent, "e", 0755, 022); err != 0 {
+		t.Fatalf("mkdir without limit: %s", err)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	v, _ := createTestVFS()
+	v.Conf.MaxFileSize = 1 << 20
+	ctx := NewLogContext(meta.Background)
+	fe, fh, err := v.Create(ctx, 1, "f", 0644, 022, uint32(syscall.O_RDWR))
+	if err != 0 {
+		t.Fatalf("create: %s", err)
+	}
+	defer v.Release(ctx, fe.Inode, fh)
+	if err = v.Write(ctx, fe.Inode, []byte("hello"), 1<<20-4, fh); err != syscall.EFBIG {
+		t.Fatalf("write beyond the limit: %s", err)
+	}
+	if err = v.Write(ctx, fe.Inode, []byte("hello"), 1<<20-5, fh); err != 0 {
+		t.Fatalf("write to the limit: %s", err)
+	}
+	if err = v.Truncate(ctx, fe.Inode, 1<<20+1, 1, &Attr{}); err != syscall.EFBIG {
+		t.Fatalf("truncate beyond the limit: %s", err)
+	}
+	if _, err = v.SetAttr(ctx, fe.Inode, meta.SetAttrSize, 1, 0, 0, 0, 0, 0, 0, 0, 2<<20); err != syscall.EFBIG {
+		t.Fatalf("setattr beyond the limit: %s", err)
+	}
+	if err = v.Fallocate(ctx, fe.Inode, 0, 1<<20-1, 10, fh); err != syscall.EFBIG {
+		t.Fatalf("fallocate beyond the limit: %s", err)
+	}
+	if err = v.Fallocate(ctx, fe.Inode, 0, 1<<20-10, 10, fh); err != 0 {
+		t.Fatalf("fallocate to the limit: %s", err)
+	}
+	if err = v.Truncate(ctx, fe.Inode, 1<<20, 1, &Attr{}); err != 0 {
+		t.Fatalf("truncate to the limit: %s", err)
+	}
+	// the hard limit is used if the configured one is larger
+	v.Conf.MaxFileSize = maxFileSize * 2
+	if err = v.Truncate(ctx, fe.Inode, maxFileSize, 1, &Attr{}); err != syscall.EFBIG {
+		t.Fatalf("truncate to the hard limit: %s", err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "pollfile", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create pollfile: %s", e)
+	}
+	if r, e := v.Poll(ctx, fe.Inode, fh, PollIn|PollOut); e != 0 || r != PollIn|PollOut {
+		t.Fatalf("poll regular file: %s %#x", e, r)
+	}
+	if r, e := v.Poll(ctx, fe.Inode, fh, PollIn|PollRdNorm); e != 0 || r != PollIn|PollRdNorm {
+		t.Fatalf("poll regular file for read: %s %#x", e, r)
+	}
+	if _, e := v.Poll(ctx, fe.Inode, fh+100, PollIn); e != syscall.EBADF {
+		t.Fatalf("poll unknown handle: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	// the access log is readable only when there are lines
+	le, e := v.Lookup(ctx, 1, ".accesslog")
+	if e != 0 {
+		t.Fatalf("lookup .accesslog: %s", e)
+	}
+	_, lfh, e := v.Open(ctx, le.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open .accesslog: %s", e)
+	}
+	defer v.Release(ctx, le.Inode, lfh)
+	_, _ = v.Read(ctx, le.Inode, make([]byte, 1<<20), 0, lfh) // drain it
+	if r, e := v.Poll(ctx, le.Inode, lfh, PollIn|PollOut); e != 0 || r != 0 {
+		t.Fatalf("poll empty access log: %s %#x", e, r)
+	}
+	// the last poll is logged
+	if r, e := v.Poll(ctx, le.Inode, lfh, PollIn|PollOut); e != 0 || r != PollIn {
+		t.Fatalf("poll access log: %s %#x", e, r)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	profile := func(ctx Context, kind string, seconds uint32) []byte {
+		w := utils.NewBuffer(4 + uint32(len(kind)) + 4)
+		w.Put32(uint32(len(kind)))
+		w.Put([]byte(kind))
+		w.Put32(seconds)
+		return v.handleInternalMsg(ctx, meta.Profile, utils.ReadBuffer(w.Bytes()))
+	}
+	for _, kind := range []string{"heap", "goroutine", "cpu"} {
+		resp := profile(ctx, kind, 1)
+		if len(resp) < 4 {
+			t.Fatalf("capture %s profile: %v", kind, resp)
+		}
+		data := resp[4:]
+		if size := utils.ReadBuffer(resp).Get32(); int(size) != len(data) {
+			t.Fatalf("size of %s profile: %d != %d", kind, size, len(data))
+		}
+		if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b { // gzipped protobuf
+			t.Fatalf("invalid %s profile: %v", kind, data)
+		}
+	}
+	if resp := profile(ctx, "block", 0); len(resp) != 1 || resp[0] != uint8(syscall.EINVAL) {
+		t.Fatalf("unknown profile: %v", resp)
+	}
+	if resp := profile(ctx, "cpu", 0); len(resp) != 1 || resp[0] != uint8(syscall.EINVAL) {
+		t.Fatalf("CPU profile without duration: %v", resp)
+	}
+	uctx := NewLogContext(meta.NewContext(100, uint32(os.Getuid())+1, []uint32{1}))
+	if resp := profile(uctx, "heap", 0); len(resp) != 1 || resp[0] != uint8(syscall.EPERM) {
+		t.Fatalf("profile by other user: %v", resp)
+	}
+}
+
+func TestPacedRmr(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	de, e := v.Mkdir(ctx, 1, "paced", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir paced: %s", e)
+	}
+	for i := 0; i < 5; i++ {
+		if _, e = v.Mknod(ctx, de.Inode, fmt.Sprintf("f%d", i), 0644, 0, 0); e != 0 {
+			t.Fatalf("mknod f%d: %s", i, e)
+		}
+	}
+	msg := func(pace bool) *utils.Buffer {
+		w := utils.NewBuffer(8 + 1 + 5 + 8)
+		w.Put64(1)
+		w.Put8(5)
+		w.Put([]byte("paced"))
+		if pace {
+			w.Put32(1000)
+			w.Put32(2)
+		}
+		return utils.ReadBuffer(w.Bytes())
+	}
+	if resp := v.handleInternalMsg(ctx, meta.RmrProgress, msg(false)); len(resp) != 1 || resp[0] != uint8(syscall.ENOENT) {
+		t.Fatalf("progress of no rmr: %v", resp)
+	}
+	resp := v.handleInternalMsg(ctx, meta.Rmr, msg(true))
+	if len(resp) != 9 {
+		t.Fatalf("paced rmr: %v", resp)
+	}
+	rb := utils.ReadBuffer(resp)
+	if st, removed := rb.Get8(), rb.Get64(); st != 0 || removed != 6 {
+		t.Fatalf("paced rmr: %s, %d removed", syscall.Errno(st), removed)
+	}
+	if _, e = v.Lookup(ctx, 1, "paced"); e != syscall.ENOENT {
+		t.Fatalf("lookup paced: %s", e)
+	}
+}
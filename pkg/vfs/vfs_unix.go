@@ -178,7 +178,12 @@ func (v *VFS) SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gi
 		attr.Mtime = mtime
 		attr.Mtimensec = mtimensec
 	}
-	err = v.Meta.SetAttr(ctx, ino, uint16(set), 0, attr)
+	// the flags are only changed by chattr (via the control file), the same bit is FATTR_LOCKOWNER in FUSE,
+	// and SetAttrAtimeRead is only for reads, the same bit is FATTR_CTIME
+	err = v.checkDeleted(ino, func() syscall.Errno {
+		return v.Meta.SetAttr(ctx, ino, uint16(set)&^(meta.SetAttrFlag|meta.SetAttrAtimeRead), 0, attr)
+	})
+	v.cache.invalidate(ino)
 	if err == 0 {
 		v.UpdateLength(ino, attr)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
@@ -237,6 +242,9 @@ func (v *VFS) Setlk(ctx Context, ino Ino, fh uint64, owner uint64, start, end ui
 	h.addOp(ctx)
 	defer h.removeOp(ctx)
 
+	if block {
+		defer waitOn(ctx, waitLock)()
+	}
 	err = v.Meta.Setlk(ctx, ino, owner, block, typ, start, end, pid)
 	if err == 0 {
 		h.Lock()
@@ -275,6 +283,9 @@ func (v *VFS) Flock(ctx Context, ino Ino, fh uint64, owner uint64, typ uint32, b
 	}
 	h.addOp(ctx)
 	defer h.removeOp(ctx)
+	if block {
+		defer waitOn(ctx, waitLock)()
+	}
 	err = v.Meta.Flock(ctx, ino, owner, typ, block)
 	if err == 0 {
 		h.Lock()
@@ -26,25 +26,41 @@ import (
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	flushDuration = time.Second * 5
 )
 
+var (
+	combinedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fuse_combined_writes",
+		Help: "The number of writes appended into pending slices.",
+	})
+	flushedSlices = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fuse_flushed_slices",
+		Help: "The number of slices committed into metadata.",
+	})
+)
+
 type FileWriter interface {
 	Write(ctx meta.Context, offset uint64, data []byte) syscall.Errno
 	Flush(ctx meta.Context) syscall.Errno
+	Fsync(ctx meta.Context, policy string) syscall.Errno
+	SetCombine(window time.Duration, size int)
 	Close(ctx meta.Context) syscall.Errno
 	GetLength() uint64
 	Truncate(length uint64)
 }
 
 type DataWriter interface {
-	Open(inode Ino, fleng uint64) FileWriter
+	Open(inode Ino, fleng uint64, nocache bool) FileWriter
 	Flush(ctx meta.Context, inode Ino) syscall.Errno
+	Fsynced(inode Ino) bool
 	GetLength(inode Ino) uint64
 	Truncate(inode Ino, length uint64)
+	DurableOffset(inode Ino) (uint64, bool)
 }
 
 type sliceWriter struct {
@@ -57,6 +73,7 @@ type sliceWriter struct {
 	writer  chunk.Writer
 	freezed bool
 	done    bool
+	settled bool // to be committed with WriteFailureRollback
 	err     syscall.Errno
 	notify  *utils.Cond
 	started time.Time
@@ -96,7 +113,11 @@ func (s *sliceWriter) markDone() {
 	f := s.chunk.file
 	f.Lock()
 	s.done = true
-	s.notify.Signal()
+	// a signal is lost if commitThread is not waiting yet, then it would wake up after timeout (100ms)
+	s.notify.Broadcast()
+	if f.flushwaiting > 0 {
+		f.flushcond.Broadcast() // for FsyncData
+	}
 	f.Unlock()
 }
 
@@ -127,6 +148,7 @@ func (s *sliceWriter) write(ctx meta.Context, off uint32, data []uint8) syscall.
 	_, err := s.writer.WriteAt(data, int64(off))
 	if err != nil {
 		logger.Warnf("write: chunk: %d off: %d %s", s.id, off, err)
+		s.err = syscall.EIO
 		return syscall.EIO
 	}
 	if off+uint32(len(data)) > s.slen {
@@ -141,6 +163,7 @@ func (s *sliceWriter) write(ctx meta.Context, off uint32, data []uint8) syscall.
 			err := s.writer.FlushTo(int(s.slen))
 			if err != nil {
 				logger.Warnf("write: chunk: %d off: %d %s", s.id, off, err)
+				s.err = syscall.EIO
 				return syscall.EIO
 			}
 		} else if int(off) <= f.w.blockSize {
@@ -150,6 +173,14 @@ func (s *sliceWriter) write(ctx meta.Context, off uint32, data []uint8) syscall.
 	return 0
 }
 
+// combining returns whether the slice is kept open for more writes, even if it's idle or old,
+// small slices are kept within the window of write combining to reduce the number of slices.
+// protected by s.chunk.file
+func (s *sliceWriter) combining(now time.Time) bool {
+	f := s.chunk.file
+	return f.combineWindow > 0 && int(s.slen) < f.combineSize && now.Sub(s.started) < f.combineWindow
+}
+
 type chunkWriter struct {
 	indx   uint32
 	file   *fileWriter
@@ -187,19 +218,30 @@ func (c *chunkWriter) commitThread() {
 	// the slices should be committed in the order that are created
 	for len(c.slices) > 0 {
 		s := c.slices[0]
-		for !s.done {
-			if s.notify.WaitWithTimeout(time.Millisecond*100) && !s.freezed && time.Since(s.started) > flushDuration*2 {
+		for !s.done || f.w.rollback && f.err == 0 && !s.settled && !f.settle() {
+			if s.notify.WaitWithTimeout(time.Millisecond*100) && !s.freezed && time.Since(s.started) > flushDuration*2 &&
+				!s.combining(time.Now()) {
 				s.freezed = true
 				go s.flushData()
 			}
 		}
 		err := s.err
+		drop := f.w.rollback && f.err != 0
 		f.Unlock()
 
-		if err == 0 {
+		if drop {
+			if err == 0 && s.id > 0 && s.length > 0 {
+				if e := f.w.store.Remove(s.id, int(s.length)); e != nil {
+					logger.Warnf("remove chunk %d (length: %d) rolled back: %s", s.id, s.length, e)
+				}
+			}
+		} else if err == 0 {
 			var ss = meta.Slice{Chunkid: s.id, Size: s.length, Off: s.soff, Len: s.slen}
 			err = f.w.m.Write(meta.Background, f.inode, c.indx, s.off, ss)
 			f.w.reader.Invalidate(f.inode, uint64(c.indx)*meta.ChunkSize+uint64(s.off), uint64(ss.Len))
+			if err == 0 && ss.Len > 0 {
+				flushedSlices.Inc()
+			}
 		}
 
 		f.Lock()
@@ -210,6 +252,10 @@ func (c *chunkWriter) commitThread() {
 			}
 			f.err = err
 			logger.Errorf("write inode:%d indx:%d  %s", f.inode, c.indx, err)
+			if off := uint64(c.indx)*meta.ChunkSize + uint64(s.off); !f.failed || off < f.failedAt {
+				f.failed = true
+				f.failedAt = off
+			}
 		}
 		c.slices = c.slices[1:]
 	}
@@ -220,13 +266,21 @@ type fileWriter struct {
 	sync.Mutex
 	w *dataWriter
 
-	inode        Ino
-	length       uint64
-	err          syscall.Errno
-	flushwaiting uint16
-	writewaiting uint16
-	refs         uint16
-	chunks       map[uint32]*chunkWriter
+	inode   Ino
+	length  uint64
+	nocache bool // bypass the cache
+	fsynced bool // fsync is called on it
+	// the write combining of the file, from dataWriter or the hints of the directory
+	combineWindow time.Duration
+	combineSize   int
+	err           syscall.Errno
+	written       bool   // Write is called on it
+	failed        bool   // some slices failed to be written
+	failedAt      uint64 // the lowest offset of the failed slices
+	flushwaiting  uint16
+	writewaiting  uint16
+	refs          uint16
+	chunks        map[uint32]*chunkWriter
 
 	flushcond *utils.Cond // wait for chunks==nil (flush)
 	writecond *utils.Cond // wait for flushwaiting==0 (write)
@@ -258,10 +312,14 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 		s = &sliceWriter{
 			chunk:   c,
 			off:     off,
-			writer:  f.w.store.NewWriter(0),
 			notify:  utils.NewCond(&f.Mutex),
 			started: time.Now(),
 		}
+		if f.nocache || f.w.cacheLimit > 0 && uint64(indx)*meta.ChunkSize+uint64(off) >= f.w.cacheLimit {
+			s.writer = f.w.store.NewUncachedWriter(0)
+		} else {
+			s.writer = f.w.store.NewWriter(0)
+		}
 		c.slices = append(c.slices, s)
 		if len(c.slices) == 1 {
 			f.w.Lock()
@@ -269,6 +327,8 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 			f.w.Unlock()
 			go c.commitThread()
 		}
+	} else {
+		combinedWrites.Inc()
 	}
 	return s.write(ctx, off-s.off, data)
 }
@@ -288,12 +348,17 @@ func (w *dataWriter) usedBufferSize() int64 {
 }
 
 func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Errno {
-	for {
-		if f.totalSlices() < 1000 {
-			break
+	for f.totalSlices() >= 1000 {
+		if f.w.rollback {
+			// the slices are committed only when the file is flushed
+			if st := f.flush(ctx, false); st != 0 {
+				return st
+			}
+			continue
 		}
 		time.Sleep(time.Millisecond)
 	}
+	done := waitOn(ctx, waitObject)
 	if f.w.usedBufferSize() > f.w.bufferSize {
 		// slow down
 		time.Sleep(time.Millisecond * 10)
@@ -311,11 +376,14 @@ func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Er
 		if f.writecond.WaitWithTimeout(time.Second) && ctx.Canceled() {
 			f.writewaiting--
 			logger.Warnf("write %d interrupted after %d", f.inode, time.Since(s))
+			done()
 			return syscall.EINTR
 		}
 	}
 	f.writewaiting--
+	done()
 
+	f.written = true
 	indx := uint32(off / meta.ChunkSize)
 	pos := uint32(off % meta.ChunkSize)
 	for len(data) > 0 {
@@ -336,8 +404,57 @@ func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Er
 	return f.err
 }
 
-func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
+// protected by file
+func (f *fileWriter) flushing(dataOnly bool) bool {
+	if !dataOnly {
+		return len(f.chunks) > 0
+	}
+	for _, c := range f.chunks {
+		for _, s := range c.slices {
+			if !s.done {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protected by file
+func (f *fileWriter) sliceError() syscall.Errno {
+	for _, c := range f.chunks {
+		for _, s := range c.slices {
+			if s.done && s.err != 0 {
+				return syscall.EIO
+			}
+		}
+	}
+	return 0
+}
+
+// settle marks the slices to be committed with WriteFailureRollback, when the file is being flushed
+// and all of them are done. The file fails if any of them failed, so none of them is committed.
+// protected by file
+func (f *fileWriter) settle() bool {
+	if f.flushwaiting == 0 || f.flushing(true) {
+		return false
+	}
+	if f.sliceError() != 0 {
+		logger.Warnf("write inode:%d failed, roll back the writes since last flush", f.inode)
+		f.err = syscall.EIO
+		return true
+	}
+	for _, c := range f.chunks {
+		for _, s := range c.slices {
+			s.settled = true
+		}
+	}
+	return true
+}
+
+// flush waits for the buffered data to be persisted, and committed into the meta engine if dataOnly is false.
+func (f *fileWriter) flush(ctx meta.Context, dataOnly bool) syscall.Errno {
 	s := time.Now()
+	defer waitOn(ctx, waitObject)()
 	f.Lock()
 	defer f.Unlock()
 	f.flushwaiting++
@@ -348,7 +465,7 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 		wait = time.Minute * 5
 	}
 	var deadline = time.Now().Add(wait)
-	for len(f.chunks) > 0 && err == 0 {
+	for f.flushing(dataOnly) && err == 0 {
 		for _, c := range f.chunks {
 			for _, s := range c.slices {
 				if !s.freezed {
@@ -383,6 +500,12 @@ func (f *fileWriter) flush(ctx meta.Context, writeback bool) syscall.Errno {
 	if err == 0 {
 		err = f.err
 	}
+	if err == 0 && dataOnly {
+		err = f.sliceError()
+	}
+	if !dataOnly && !f.flushing(false) {
+		f.w.report(f)
+	}
 	return err
 }
 
@@ -390,6 +513,36 @@ func (f *fileWriter) Flush(ctx meta.Context) syscall.Errno {
 	return f.flush(ctx, false)
 }
 
+func (f *fileWriter) Fsync(ctx meta.Context, policy string) syscall.Errno {
+	f.Lock()
+	f.fsynced = true
+	f.Unlock()
+	switch policy {
+	case FsyncMeta:
+		// the buffered data is flushed in background
+		f.Lock()
+		defer f.Unlock()
+		return f.err
+	case FsyncData:
+		return f.flush(ctx, true)
+	default:
+		return f.flush(ctx, false)
+	}
+}
+
+// SetCombine overrides the window (disabled if negative) and size of write combining of the file,
+// zero means unchanged.
+func (f *fileWriter) SetCombine(window time.Duration, size int) {
+	f.Lock()
+	defer f.Unlock()
+	if window != 0 {
+		f.combineWindow = window
+	}
+	if size > 0 {
+		f.combineSize = size
+	}
+}
+
 func (f *fileWriter) Close(ctx meta.Context) syscall.Errno {
 	defer f.w.free(f)
 	return f.Flush(ctx)
@@ -417,6 +570,12 @@ type dataWriter struct {
 	bufferSize int64
 	files      map[Ino]*fileWriter
 	maxRetries uint32
+	rollback   bool           // WriteFailureRollback
+	durable    map[Ino]uint64 // the durable offsets of the opened files failed to be written
+
+	combineWindow time.Duration // keep small slices open within this window
+	combineSize   int           // only the slices smaller than this are combined
+	cacheLimit    uint64        // the slices starting beyond this offset of a file bypass the cache
 }
 
 func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader DataReader) DataWriter {
@@ -428,6 +587,15 @@ func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader Dat
 		bufferSize: int64(conf.Chunk.BufferSize),
 		files:      make(map[Ino]*fileWriter),
 		maxRetries: uint32(conf.Meta.Retries),
+		rollback:   conf.WriteFailure == WriteFailureRollback,
+		durable:    make(map[Ino]uint64),
+
+		combineWindow: conf.WriteCombine,
+		combineSize:   conf.WriteCombineSize,
+		cacheLimit:    conf.WriteCacheLimit,
+	}
+	if w.combineSize <= 0 {
+		w.combineSize = w.blockSize
 	}
 	go w.flushAll()
 	return w
@@ -447,7 +615,7 @@ func (w *dataWriter) flushAll() {
 			for i, c := range f.chunks {
 				hs := len(c.slices) / 2
 				for j, s := range c.slices {
-					if !s.freezed && (now.Sub(s.started) > flushDuration || now.Sub(s.lastMod) > time.Second ||
+					if !s.freezed && (!s.combining(now) && (now.Sub(s.started) > flushDuration || now.Sub(s.lastMod) > time.Second) ||
 						tooMany && i%2 == lastBit && j <= hs) {
 						s.freezed = true
 						go s.flushData()
@@ -463,16 +631,20 @@ func (w *dataWriter) flushAll() {
 	}
 }
 
-func (w *dataWriter) Open(inode Ino, len uint64) FileWriter {
+func (w *dataWriter) Open(inode Ino, len uint64, nocache bool) FileWriter {
 	w.Lock()
 	defer w.Unlock()
 	f, ok := w.files[inode]
 	if !ok {
 		f = &fileWriter{
-			w:      w,
-			inode:  inode,
-			length: len,
-			chunks: make(map[uint32]*chunkWriter),
+			w:       w,
+			inode:   inode,
+			length:  len,
+			nocache: nocache,
+			chunks:  make(map[uint32]*chunkWriter),
+
+			combineWindow: w.combineWindow,
+			combineSize:   w.combineSize,
 		}
 		f.flushcond = utils.NewCond(f)
 		f.writecond = utils.NewCond(f)
@@ -494,6 +666,7 @@ func (w *dataWriter) free(f *fileWriter) {
 	f.refs--
 	if f.refs == 0 {
 		delete(w.files, f.inode)
+		delete(w.durable, f.inode)
 	}
 }
 
@@ -505,6 +678,17 @@ func (w *dataWriter) Flush(ctx meta.Context, inode Ino) syscall.Errno {
 	return 0
 }
 
+// Fsynced returns whether fsync is called on the opened file.
+func (w *dataWriter) Fsynced(inode Ino) bool {
+	f := w.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+		return f.fsynced
+	}
+	return false
+}
+
 func (w *dataWriter) GetLength(inode Ino) uint64 {
 	f := w.find(inode)
 	if f != nil {
@@ -519,3 +703,32 @@ func (w *dataWriter) Truncate(inode Ino, len uint64) {
 		f.Truncate(len)
 	}
 }
+
+// report keeps the durable offset of a file after all the slices of it are committed, with
+// WriteFailureReport: all the data written below it since the file is opened is committed. It's
+// cleared once the file is written and flushed successfully, or closed by all the handles (including
+// the ones of an unlinked file).
+// protected by f
+func (w *dataWriter) report(f *fileWriter) {
+	if w.rollback {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if f.failed {
+		if _, ok := w.durable[f.inode]; !ok {
+			logger.Warnf("write inode:%d failed, the data below offset %d is durable", f.inode, f.failedAt)
+		}
+		w.durable[f.inode] = f.failedAt
+	} else if f.written {
+		delete(w.durable, f.inode)
+	}
+}
+
+// DurableOffset returns the durable offset of the file, if it failed to be written.
+func (w *dataWriter) DurableOffset(inode Ino) (uint64, bool) {
+	w.Lock()
+	defer w.Unlock()
+	off, ok := w.durable[inode]
+	return off, ok
+}
@@ -518,35 +518,41 @@ func (j *juice) Readdir(path string,
 		return
 	}
 	ctx := j.newContext()
-	entries, err := j.vfs.Readdir(ctx, ino, 100000, int(ofst), fh, true)
-	if err != 0 {
-		e = -int(err)
-		return
-	}
-	var st fuse.Stat_t
-	var ok bool
-	var full = true
-	// all the entries should have same format
-	for _, e := range entries {
-		if !e.Attr.Full {
-			full = false
-			break
+	// the directory could be read in pages, all of them are filled in one call
+	for off := int(ofst); ; {
+		entries, err := j.vfs.Readdir(ctx, ino, 100000, off, fh, true)
+		if err != 0 {
+			e = -int(err)
+			return
 		}
-	}
-	for _, e := range entries {
-		name := string(e.Name)
-		if full {
-			j.vfs.UpdateLength(e.Inode, e.Attr)
-			attrToStat(e.Inode, e.Attr, &st)
-			ok = fill(name, &st, 0)
-		} else {
-			ok = fill(name, nil, 0)
+		if len(entries) == 0 {
+			return
 		}
-		if !ok {
-			break
+		off += len(entries)
+		var st fuse.Stat_t
+		var ok bool
+		var full = true
+		// all the entries should have same format
+		for _, e := range entries {
+			if !e.Attr.Full {
+				full = false
+				break
+			}
+		}
+		for _, e := range entries {
+			name := string(e.Name)
+			if full {
+				j.vfs.UpdateLength(e.Inode, e.Attr)
+				attrToStat(e.Inode, e.Attr, &st)
+				ok = fill(name, &st, 0)
+			} else {
+				ok = fill(name, nil, 0)
+			}
+			if !ok {
+				return
+			}
 		}
 	}
-	return
 }
 
 // Releasedir closes an open directory.
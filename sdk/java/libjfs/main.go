@@ -408,10 +408,30 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			Prefetch:       jConf.Prefetch,
 			Writeback:      jConf.Writeback,
 			Partitions:     format.Partitions,
+			KeyPrefixes:    format.KeyPrefixes,
+			PrefixedFrom:   format.PrefixedFrom,
 			GetTimeout:     time.Second * time.Duration(jConf.GetTimeout),
 			PutTimeout:     time.Second * time.Duration(jConf.PutTimeout),
 			BufferSize:     jConf.MemorySize << 20,
 			Readahead:      jConf.Readahead << 20,
+			InlineSize:     format.InlineSize,
+		}
+		if chunkConf.InlineSize > 0 {
+			chunkConf.SaveInline = func(id uint64, data []byte) error {
+				if st := m.SetSliceData(meta.Background, id, data); st != 0 {
+					return st
+				}
+				return nil
+			}
+			chunkConf.LoadInline = func(id uint64) ([]byte, error) {
+				var data []byte
+				if st := m.GetSliceData(meta.Background, id, &data); st == syscall.ENOENT {
+					return nil, nil
+				} else if st != 0 {
+					return nil, st
+				}
+				return data, nil
+			}
 		}
 		if chunkConf.CacheDir != "memory" {
 			ds := utils.SplitDir(chunkConf.CacheDir)